@@ -29,6 +29,10 @@ type FileRequest struct {
 	//	*FileRequest_FileInfo
 	//	*FileRequest_ChunkHash
 	//	*FileRequest_ChunkData
+	//	*FileRequest_Chunk
+	//	*FileRequest_FileEnd
+	//	*FileRequest_Batch
+	//	*FileRequest_Start
 	RequestType   isFileRequest_RequestType `protobuf_oneof:"request_type"`
 	unknownFields protoimpl.UnknownFields
 	sizeCache     protoimpl.SizeCache
@@ -105,6 +109,42 @@ func (x *FileRequest) GetChunkData() *ChunkData {
 	return nil
 }
 
+func (x *FileRequest) GetChunk() *Chunk {
+	if x != nil {
+		if x, ok := x.RequestType.(*FileRequest_Chunk); ok {
+			return x.Chunk
+		}
+	}
+	return nil
+}
+
+func (x *FileRequest) GetFileEnd() *FileEnd {
+	if x != nil {
+		if x, ok := x.RequestType.(*FileRequest_FileEnd); ok {
+			return x.FileEnd
+		}
+	}
+	return nil
+}
+
+func (x *FileRequest) GetBatch() *FileBatch {
+	if x != nil {
+		if x, ok := x.RequestType.(*FileRequest_Batch); ok {
+			return x.Batch
+		}
+	}
+	return nil
+}
+
+func (x *FileRequest) GetStart() *StreamStart {
+	if x != nil {
+		if x, ok := x.RequestType.(*FileRequest_Start); ok {
+			return x.Start
+		}
+	}
+	return nil
+}
+
 type isFileRequest_RequestType interface {
 	isFileRequest_RequestType()
 }
@@ -117,27 +157,613 @@ type FileRequest_ChunkHash struct {
 	ChunkHash *ChunkHash `protobuf:"bytes,3,opt,name=chunk_hash,json=chunkHash,proto3,oneof"`
 }
 
-type FileRequest_ChunkData struct {
-	ChunkData *ChunkData `protobuf:"bytes,4,opt,name=chunk_data,json=chunkData,proto3,oneof"`
+type FileRequest_ChunkData struct {
+	ChunkData *ChunkData `protobuf:"bytes,4,opt,name=chunk_data,json=chunkData,proto3,oneof"`
+}
+
+type FileRequest_Chunk struct {
+	Chunk *Chunk `protobuf:"bytes,5,opt,name=chunk,proto3,oneof"`
+}
+
+type FileRequest_FileEnd struct {
+	FileEnd *FileEnd `protobuf:"bytes,6,opt,name=file_end,json=fileEnd,proto3,oneof"`
+}
+
+type FileRequest_Batch struct {
+	Batch *FileBatch `protobuf:"bytes,7,opt,name=batch,proto3,oneof"`
+}
+
+type FileRequest_Start struct {
+	Start *StreamStart `protobuf:"bytes,8,opt,name=start,proto3,oneof"`
+}
+
+func (*FileRequest_FileInfo) isFileRequest_RequestType() {}
+
+func (*FileRequest_ChunkHash) isFileRequest_RequestType() {}
+
+func (*FileRequest_ChunkData) isFileRequest_RequestType() {}
+
+func (*FileRequest_Chunk) isFileRequest_RequestType() {}
+
+func (*FileRequest_FileEnd) isFileRequest_RequestType() {}
+
+func (*FileRequest_Batch) isFileRequest_RequestType() {}
+
+func (*FileRequest_Start) isFileRequest_RequestType() {}
+
+// StreamStart opens a resumable stream, before its first file. The writer records which of its
+// files are committed under the job, stream id and resume token.
+type StreamStart struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	JobId         string                 `protobuf:"bytes,1,opt,name=job_id,json=jobId,proto3" json:"job_id,omitempty"`
+	ResumeToken   string                 `protobuf:"bytes,2,opt,name=resume_token,json=resumeToken,proto3" json:"resume_token,omitempty"` // identifies the run of the job, the same for every attempt of a stream
+	Host          string                 `protobuf:"bytes,3,opt,name=host,proto3" json:"host,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *StreamStart) Reset() {
+	*x = StreamStart{}
+	mi := &file_api_backup_proto_msgTypes[1]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *StreamStart) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*StreamStart) ProtoMessage() {}
+
+func (x *StreamStart) ProtoReflect() protoreflect.Message {
+	mi := &file_api_backup_proto_msgTypes[1]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use StreamStart.ProtoReflect.Descriptor instead.
+func (*StreamStart) Descriptor() ([]byte, []int) {
+	return file_api_backup_proto_rawDescGZIP(), []int{1}
+}
+
+func (x *StreamStart) GetJobId() string {
+	if x != nil {
+		return x.JobId
+	}
+	return ""
+}
+
+func (x *StreamStart) GetResumeToken() string {
+	if x != nil {
+		return x.ResumeToken
+	}
+	return ""
+}
+
+func (x *StreamStart) GetHost() string {
+	if x != nil {
+		return x.Host
+	}
+	return ""
+}
+
+type StreamProgressRequest struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Host          string                 `protobuf:"bytes,1,opt,name=host,proto3" json:"host,omitempty"`
+	JobId         string                 `protobuf:"bytes,2,opt,name=job_id,json=jobId,proto3" json:"job_id,omitempty"`
+	StreamId      int32                  `protobuf:"varint,3,opt,name=stream_id,json=streamId,proto3" json:"stream_id,omitempty"`
+	ResumeToken   string                 `protobuf:"bytes,4,opt,name=resume_token,json=resumeToken,proto3" json:"resume_token,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *StreamProgressRequest) Reset() {
+	*x = StreamProgressRequest{}
+	mi := &file_api_backup_proto_msgTypes[2]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *StreamProgressRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*StreamProgressRequest) ProtoMessage() {}
+
+func (x *StreamProgressRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_api_backup_proto_msgTypes[2]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use StreamProgressRequest.ProtoReflect.Descriptor instead.
+func (*StreamProgressRequest) Descriptor() ([]byte, []int) {
+	return file_api_backup_proto_rawDescGZIP(), []int{2}
+}
+
+func (x *StreamProgressRequest) GetHost() string {
+	if x != nil {
+		return x.Host
+	}
+	return ""
+}
+
+func (x *StreamProgressRequest) GetJobId() string {
+	if x != nil {
+		return x.JobId
+	}
+	return ""
+}
+
+func (x *StreamProgressRequest) GetStreamId() int32 {
+	if x != nil {
+		return x.StreamId
+	}
+	return 0
+}
+
+func (x *StreamProgressRequest) GetResumeToken() string {
+	if x != nil {
+		return x.ResumeToken
+	}
+	return ""
+}
+
+// StreamProgress is how far a stream got: its files up to last_file_id, in the order sent, are committed
+type StreamProgress struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Committed     int64                  `protobuf:"varint,1,opt,name=committed,proto3" json:"committed,omitempty"`                      // number of files committed, 0 when the stream is unknown or had another resume token
+	LastFileId    string                 `protobuf:"bytes,2,opt,name=last_file_id,json=lastFileId,proto3" json:"last_file_id,omitempty"` // empty when committed is 0
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *StreamProgress) Reset() {
+	*x = StreamProgress{}
+	mi := &file_api_backup_proto_msgTypes[3]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *StreamProgress) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*StreamProgress) ProtoMessage() {}
+
+func (x *StreamProgress) ProtoReflect() protoreflect.Message {
+	mi := &file_api_backup_proto_msgTypes[3]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use StreamProgress.ProtoReflect.Descriptor instead.
+func (*StreamProgress) Descriptor() ([]byte, []int) {
+	return file_api_backup_proto_rawDescGZIP(), []int{3}
+}
+
+func (x *StreamProgress) GetCommitted() int64 {
+	if x != nil {
+		return x.Committed
+	}
+	return 0
+}
+
+func (x *StreamProgress) GetLastFileId() string {
+	if x != nil {
+		return x.LastFileId
+	}
+	return ""
+}
+
+// JobRun summarises one backup run of a reader
+type JobRun struct {
+	state          protoimpl.MessageState `protogen:"open.v1"`
+	JobId          string                 `protobuf:"bytes,1,opt,name=job_id,json=jobId,proto3" json:"job_id,omitempty"`
+	Host           string                 `protobuf:"bytes,2,opt,name=host,proto3" json:"host,omitempty"`
+	StartedUnixMs  int64                  `protobuf:"varint,3,opt,name=started_unix_ms,json=startedUnixMs,proto3" json:"started_unix_ms,omitempty"`
+	FinishedUnixMs int64                  `protobuf:"varint,4,opt,name=finished_unix_ms,json=finishedUnixMs,proto3" json:"finished_unix_ms,omitempty"`
+	FilesScanned   int64                  `protobuf:"varint,5,opt,name=files_scanned,json=filesScanned,proto3" json:"files_scanned,omitempty"`
+	FilesStored    int64                  `protobuf:"varint,6,opt,name=files_stored,json=filesStored,proto3" json:"files_stored,omitempty"`    // data sent and stored by the writer
+	FilesSkipped   int64                  `protobuf:"varint,7,opt,name=files_skipped,json=filesSkipped,proto3" json:"files_skipped,omitempty"` // already backed up, nothing sent
+	FilesFailed    int64                  `protobuf:"varint,8,opt,name=files_failed,json=filesFailed,proto3" json:"files_failed,omitempty"`
+	BytesSent      int64                  `protobuf:"varint,9,opt,name=bytes_sent,json=bytesSent,proto3" json:"bytes_sent,omitempty"` // file data sent, as compressed on the wire
+	Errors         int64                  `protobuf:"varint,10,opt,name=errors,proto3" json:"errors,omitempty"`                       // failed files and failed streams
+	Interrupted    bool                   `protobuf:"varint,11,opt,name=interrupted,proto3" json:"interrupted,omitempty"`
+	unknownFields  protoimpl.UnknownFields
+	sizeCache      protoimpl.SizeCache
+}
+
+func (x *JobRun) Reset() {
+	*x = JobRun{}
+	mi := &file_api_backup_proto_msgTypes[4]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *JobRun) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*JobRun) ProtoMessage() {}
+
+func (x *JobRun) ProtoReflect() protoreflect.Message {
+	mi := &file_api_backup_proto_msgTypes[4]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use JobRun.ProtoReflect.Descriptor instead.
+func (*JobRun) Descriptor() ([]byte, []int) {
+	return file_api_backup_proto_rawDescGZIP(), []int{4}
+}
+
+func (x *JobRun) GetJobId() string {
+	if x != nil {
+		return x.JobId
+	}
+	return ""
+}
+
+func (x *JobRun) GetHost() string {
+	if x != nil {
+		return x.Host
+	}
+	return ""
+}
+
+func (x *JobRun) GetStartedUnixMs() int64 {
+	if x != nil {
+		return x.StartedUnixMs
+	}
+	return 0
+}
+
+func (x *JobRun) GetFinishedUnixMs() int64 {
+	if x != nil {
+		return x.FinishedUnixMs
+	}
+	return 0
+}
+
+func (x *JobRun) GetFilesScanned() int64 {
+	if x != nil {
+		return x.FilesScanned
+	}
+	return 0
+}
+
+func (x *JobRun) GetFilesStored() int64 {
+	if x != nil {
+		return x.FilesStored
+	}
+	return 0
+}
+
+func (x *JobRun) GetFilesSkipped() int64 {
+	if x != nil {
+		return x.FilesSkipped
+	}
+	return 0
+}
+
+func (x *JobRun) GetFilesFailed() int64 {
+	if x != nil {
+		return x.FilesFailed
+	}
+	return 0
+}
+
+func (x *JobRun) GetBytesSent() int64 {
+	if x != nil {
+		return x.BytesSent
+	}
+	return 0
+}
+
+func (x *JobRun) GetErrors() int64 {
+	if x != nil {
+		return x.Errors
+	}
+	return 0
+}
+
+func (x *JobRun) GetInterrupted() bool {
+	if x != nil {
+		return x.Interrupted
+	}
+	return false
+}
+
+type JobRunRecorded struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *JobRunRecorded) Reset() {
+	*x = JobRunRecorded{}
+	mi := &file_api_backup_proto_msgTypes[5]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *JobRunRecorded) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*JobRunRecorded) ProtoMessage() {}
+
+func (x *JobRunRecorded) ProtoReflect() protoreflect.Message {
+	mi := &file_api_backup_proto_msgTypes[5]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use JobRunRecorded.ProtoReflect.Descriptor instead.
+func (*JobRunRecorded) Descriptor() ([]byte, []int) {
+	return file_api_backup_proto_rawDescGZIP(), []int{5}
+}
+
+type ContentQuery struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Checksum      string                 `protobuf:"bytes,1,opt,name=checksum,proto3" json:"checksum,omitempty"` // BLAKE3 of the whole content, hex encoded
+	Size          int64                  `protobuf:"varint,2,opt,name=size,proto3" json:"size,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *ContentQuery) Reset() {
+	*x = ContentQuery{}
+	mi := &file_api_backup_proto_msgTypes[6]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *ContentQuery) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*ContentQuery) ProtoMessage() {}
+
+func (x *ContentQuery) ProtoReflect() protoreflect.Message {
+	mi := &file_api_backup_proto_msgTypes[6]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use ContentQuery.ProtoReflect.Descriptor instead.
+func (*ContentQuery) Descriptor() ([]byte, []int) {
+	return file_api_backup_proto_rawDescGZIP(), []int{6}
+}
+
+func (x *ContentQuery) GetChecksum() string {
+	if x != nil {
+		return x.Checksum
+	}
+	return ""
+}
+
+func (x *ContentQuery) GetSize() int64 {
+	if x != nil {
+		return x.Size
+	}
+	return 0
+}
+
+type ContentKnown struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Known         bool                   `protobuf:"varint,1,opt,name=known,proto3" json:"known,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *ContentKnown) Reset() {
+	*x = ContentKnown{}
+	mi := &file_api_backup_proto_msgTypes[7]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *ContentKnown) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*ContentKnown) ProtoMessage() {}
+
+func (x *ContentKnown) ProtoReflect() protoreflect.Message {
+	mi := &file_api_backup_proto_msgTypes[7]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use ContentKnown.ProtoReflect.Descriptor instead.
+func (*ContentKnown) Descriptor() ([]byte, []int) {
+	return file_api_backup_proto_rawDescGZIP(), []int{7}
+}
+
+func (x *ContentKnown) GetKnown() bool {
+	if x != nil {
+		return x.Known
+	}
+	return false
+}
+
+type BackedUpFilesRequest struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Host          string                 `protobuf:"bytes,1,opt,name=host,proto3" json:"host,omitempty"`
+	Path          string                 `protobuf:"bytes,2,opt,name=path,proto3" json:"path,omitempty"` // the path itself and everything below it
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *BackedUpFilesRequest) Reset() {
+	*x = BackedUpFilesRequest{}
+	mi := &file_api_backup_proto_msgTypes[8]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *BackedUpFilesRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*BackedUpFilesRequest) ProtoMessage() {}
+
+func (x *BackedUpFilesRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_api_backup_proto_msgTypes[8]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use BackedUpFilesRequest.ProtoReflect.Descriptor instead.
+func (*BackedUpFilesRequest) Descriptor() ([]byte, []int) {
+	return file_api_backup_proto_rawDescGZIP(), []int{8}
+}
+
+func (x *BackedUpFilesRequest) GetHost() string {
+	if x != nil {
+		return x.Host
+	}
+	return ""
+}
+
+func (x *BackedUpFilesRequest) GetPath() string {
+	if x != nil {
+		return x.Path
+	}
+	return ""
+}
+
+// BackedUpFile is what an incremental run compares a scanned file with
+type BackedUpFile struct {
+	state            protoimpl.MessageState `protogen:"open.v1"`
+	Path             string                 `protobuf:"bytes,1,opt,name=path,proto3" json:"path,omitempty"`
+	Size             int64                  `protobuf:"varint,2,opt,name=size,proto3" json:"size,omitempty"`
+	ModTimeUnixNs    int64                  `protobuf:"varint,3,opt,name=mod_time_unix_ns,json=modTimeUnixNs,proto3" json:"mod_time_unix_ns,omitempty"`
+	ChangeTimeUnixNs int64                  `protobuf:"varint,4,opt,name=change_time_unix_ns,json=changeTimeUnixNs,proto3" json:"change_time_unix_ns,omitempty"`
+	unknownFields    protoimpl.UnknownFields
+	sizeCache        protoimpl.SizeCache
+}
+
+func (x *BackedUpFile) Reset() {
+	*x = BackedUpFile{}
+	mi := &file_api_backup_proto_msgTypes[9]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *BackedUpFile) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*BackedUpFile) ProtoMessage() {}
+
+func (x *BackedUpFile) ProtoReflect() protoreflect.Message {
+	mi := &file_api_backup_proto_msgTypes[9]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use BackedUpFile.ProtoReflect.Descriptor instead.
+func (*BackedUpFile) Descriptor() ([]byte, []int) {
+	return file_api_backup_proto_rawDescGZIP(), []int{9}
+}
+
+func (x *BackedUpFile) GetPath() string {
+	if x != nil {
+		return x.Path
+	}
+	return ""
+}
+
+func (x *BackedUpFile) GetSize() int64 {
+	if x != nil {
+		return x.Size
+	}
+	return 0
 }
 
-func (*FileRequest_FileInfo) isFileRequest_RequestType() {}
-
-func (*FileRequest_ChunkHash) isFileRequest_RequestType() {}
+func (x *BackedUpFile) GetModTimeUnixNs() int64 {
+	if x != nil {
+		return x.ModTimeUnixNs
+	}
+	return 0
+}
 
-func (*FileRequest_ChunkData) isFileRequest_RequestType() {}
+func (x *BackedUpFile) GetChangeTimeUnixNs() int64 {
+	if x != nil {
+		return x.ChangeTimeUnixNs
+	}
+	return 0
+}
 
 type FileInfo struct {
 	state         protoimpl.MessageState `protogen:"open.v1"`
-	FileId        string                 `protobuf:"bytes,1,opt,name=file_id,json=fileId,proto3" json:"file_id,omitempty"`
+	FileId        string                 `protobuf:"bytes,1,opt,name=file_id,json=fileId,proto3" json:"file_id,omitempty"` // hostname:fullpath:mtime
 	Attributes    []byte                 `protobuf:"bytes,4,opt,name=attributes,proto3" json:"attributes,omitempty"`
+	HashAlgo      string                 `protobuf:"bytes,5,opt,name=hash_algo,json=hashAlgo,proto3" json:"hash_algo,omitempty"` // Algorithm of the chunk and file checksums sent for the file, empty for blake3
 	unknownFields protoimpl.UnknownFields
 	sizeCache     protoimpl.SizeCache
 }
 
 func (x *FileInfo) Reset() {
 	*x = FileInfo{}
-	mi := &file_api_backup_proto_msgTypes[1]
+	mi := &file_api_backup_proto_msgTypes[10]
 	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 	ms.StoreMessageInfo(mi)
 }
@@ -149,7 +775,7 @@ func (x *FileInfo) String() string {
 func (*FileInfo) ProtoMessage() {}
 
 func (x *FileInfo) ProtoReflect() protoreflect.Message {
-	mi := &file_api_backup_proto_msgTypes[1]
+	mi := &file_api_backup_proto_msgTypes[10]
 	if x != nil {
 		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 		if ms.LoadMessageInfo() == nil {
@@ -162,7 +788,7 @@ func (x *FileInfo) ProtoReflect() protoreflect.Message {
 
 // Deprecated: Use FileInfo.ProtoReflect.Descriptor instead.
 func (*FileInfo) Descriptor() ([]byte, []int) {
-	return file_api_backup_proto_rawDescGZIP(), []int{1}
+	return file_api_backup_proto_rawDescGZIP(), []int{10}
 }
 
 func (x *FileInfo) GetFileId() string {
@@ -179,6 +805,105 @@ func (x *FileInfo) GetAttributes() []byte {
 	return nil
 }
 
+func (x *FileInfo) GetHashAlgo() string {
+	if x != nil {
+		return x.HashAlgo
+	}
+	return ""
+}
+
+// FileBatch carries the metadata of several files, answered with a single FileNeededBatch
+type FileBatch struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Files         []*FileInfo            `protobuf:"bytes,1,rep,name=files,proto3" json:"files,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *FileBatch) Reset() {
+	*x = FileBatch{}
+	mi := &file_api_backup_proto_msgTypes[11]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *FileBatch) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*FileBatch) ProtoMessage() {}
+
+func (x *FileBatch) ProtoReflect() protoreflect.Message {
+	mi := &file_api_backup_proto_msgTypes[11]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use FileBatch.ProtoReflect.Descriptor instead.
+func (*FileBatch) Descriptor() ([]byte, []int) {
+	return file_api_backup_proto_rawDescGZIP(), []int{11}
+}
+
+func (x *FileBatch) GetFiles() []*FileInfo {
+	if x != nil {
+		return x.Files
+	}
+	return nil
+}
+
+// FilePreview answers a PreviewFiles batch with one action per file, in the same order:
+// "new" when no version of the path is stored, "changed" when its data would be sent again,
+// "metadata" when only its metadata would be updated, "unchanged" when nothing would be done
+type FilePreview struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Actions       []string               `protobuf:"bytes,1,rep,name=actions,proto3" json:"actions,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *FilePreview) Reset() {
+	*x = FilePreview{}
+	mi := &file_api_backup_proto_msgTypes[12]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *FilePreview) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*FilePreview) ProtoMessage() {}
+
+func (x *FilePreview) ProtoReflect() protoreflect.Message {
+	mi := &file_api_backup_proto_msgTypes[12]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use FilePreview.ProtoReflect.Descriptor instead.
+func (*FilePreview) Descriptor() ([]byte, []int) {
+	return file_api_backup_proto_rawDescGZIP(), []int{12}
+}
+
+func (x *FilePreview) GetActions() []string {
+	if x != nil {
+		return x.Actions
+	}
+	return nil
+}
+
 type ChunkHash struct {
 	state         protoimpl.MessageState `protogen:"open.v1"`
 	FileId        string                 `protobuf:"bytes,1,opt,name=file_id,json=fileId,proto3" json:"file_id,omitempty"`
@@ -191,7 +916,7 @@ type ChunkHash struct {
 
 func (x *ChunkHash) Reset() {
 	*x = ChunkHash{}
-	mi := &file_api_backup_proto_msgTypes[2]
+	mi := &file_api_backup_proto_msgTypes[13]
 	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 	ms.StoreMessageInfo(mi)
 }
@@ -203,7 +928,7 @@ func (x *ChunkHash) String() string {
 func (*ChunkHash) ProtoMessage() {}
 
 func (x *ChunkHash) ProtoReflect() protoreflect.Message {
-	mi := &file_api_backup_proto_msgTypes[2]
+	mi := &file_api_backup_proto_msgTypes[13]
 	if x != nil {
 		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 		if ms.LoadMessageInfo() == nil {
@@ -216,7 +941,7 @@ func (x *ChunkHash) ProtoReflect() protoreflect.Message {
 
 // Deprecated: Use ChunkHash.ProtoReflect.Descriptor instead.
 func (*ChunkHash) Descriptor() ([]byte, []int) {
-	return file_api_backup_proto_rawDescGZIP(), []int{2}
+	return file_api_backup_proto_rawDescGZIP(), []int{13}
 }
 
 func (x *ChunkHash) GetFileId() string {
@@ -259,7 +984,7 @@ type ChunkData struct {
 
 func (x *ChunkData) Reset() {
 	*x = ChunkData{}
-	mi := &file_api_backup_proto_msgTypes[3]
+	mi := &file_api_backup_proto_msgTypes[14]
 	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 	ms.StoreMessageInfo(mi)
 }
@@ -271,7 +996,7 @@ func (x *ChunkData) String() string {
 func (*ChunkData) ProtoMessage() {}
 
 func (x *ChunkData) ProtoReflect() protoreflect.Message {
-	mi := &file_api_backup_proto_msgTypes[3]
+	mi := &file_api_backup_proto_msgTypes[14]
 	if x != nil {
 		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 		if ms.LoadMessageInfo() == nil {
@@ -284,7 +1009,7 @@ func (x *ChunkData) ProtoReflect() protoreflect.Message {
 
 // Deprecated: Use ChunkData.ProtoReflect.Descriptor instead.
 func (*ChunkData) Descriptor() ([]byte, []int) {
-	return file_api_backup_proto_rawDescGZIP(), []int{3}
+	return file_api_backup_proto_rawDescGZIP(), []int{14}
 }
 
 func (x *ChunkData) GetFileId() string {
@@ -315,6 +1040,168 @@ func (x *ChunkData) GetData() []byte {
 	return nil
 }
 
+// Chunk carries a piece of a file's content, sent in order after the writer asked for the file
+type Chunk struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	FileId        string                 `protobuf:"bytes,1,opt,name=file_id,json=fileId,proto3" json:"file_id,omitempty"`
+	Offset        int64                  `protobuf:"varint,2,opt,name=offset,proto3" json:"offset,omitempty"` // position in the file, ranges skipped between chunks are holes reading as zeros
+	Data          []byte                 `protobuf:"bytes,3,opt,name=data,proto3" json:"data,omitempty"`
+	Checksum      string                 `protobuf:"bytes,4,opt,name=checksum,proto3" json:"checksum,omitempty"`       // BLAKE3 of the uncompressed data, hex encoded
+	Compression   string                 `protobuf:"bytes,5,opt,name=compression,proto3" json:"compression,omitempty"` // Codec data is compressed with: empty or "none" for raw data, "gzip"
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *Chunk) Reset() {
+	*x = Chunk{}
+	mi := &file_api_backup_proto_msgTypes[15]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *Chunk) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*Chunk) ProtoMessage() {}
+
+func (x *Chunk) ProtoReflect() protoreflect.Message {
+	mi := &file_api_backup_proto_msgTypes[15]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use Chunk.ProtoReflect.Descriptor instead.
+func (*Chunk) Descriptor() ([]byte, []int) {
+	return file_api_backup_proto_rawDescGZIP(), []int{15}
+}
+
+func (x *Chunk) GetFileId() string {
+	if x != nil {
+		return x.FileId
+	}
+	return ""
+}
+
+func (x *Chunk) GetOffset() int64 {
+	if x != nil {
+		return x.Offset
+	}
+	return 0
+}
+
+func (x *Chunk) GetData() []byte {
+	if x != nil {
+		return x.Data
+	}
+	return nil
+}
+
+func (x *Chunk) GetChecksum() string {
+	if x != nil {
+		return x.Checksum
+	}
+	return ""
+}
+
+func (x *Chunk) GetCompression() string {
+	if x != nil {
+		return x.Compression
+	}
+	return ""
+}
+
+// FileEnd closes the transfer of a file
+type FileEnd struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	FileId        string                 `protobuf:"bytes,1,opt,name=file_id,json=fileId,proto3" json:"file_id,omitempty"`
+	Size          int64                  `protobuf:"varint,2,opt,name=size,proto3" json:"size,omitempty"`                                        // size of the content sent, holes included
+	Checksum      string                 `protobuf:"bytes,3,opt,name=checksum,proto3" json:"checksum,omitempty"`                                 // BLAKE3 of the whole content, empty for non-regular files
+	Error         string                 `protobuf:"bytes,4,opt,name=error,proto3" json:"error,omitempty"`                                       // set when the reader could not read the file; the writer discards it
+	SameAs        string                 `protobuf:"bytes,5,opt,name=same_as,json=sameAs,proto3" json:"same_as,omitempty"`                       // path of a file sent earlier in this run with the same content, no chunks were sent
+	StoredContent bool                   `protobuf:"varint,6,opt,name=stored_content,json=storedContent,proto3" json:"stored_content,omitempty"` // the writer already stores content with this checksum and size, no chunks were sent
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *FileEnd) Reset() {
+	*x = FileEnd{}
+	mi := &file_api_backup_proto_msgTypes[16]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *FileEnd) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*FileEnd) ProtoMessage() {}
+
+func (x *FileEnd) ProtoReflect() protoreflect.Message {
+	mi := &file_api_backup_proto_msgTypes[16]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use FileEnd.ProtoReflect.Descriptor instead.
+func (*FileEnd) Descriptor() ([]byte, []int) {
+	return file_api_backup_proto_rawDescGZIP(), []int{16}
+}
+
+func (x *FileEnd) GetFileId() string {
+	if x != nil {
+		return x.FileId
+	}
+	return ""
+}
+
+func (x *FileEnd) GetSize() int64 {
+	if x != nil {
+		return x.Size
+	}
+	return 0
+}
+
+func (x *FileEnd) GetChecksum() string {
+	if x != nil {
+		return x.Checksum
+	}
+	return ""
+}
+
+func (x *FileEnd) GetError() string {
+	if x != nil {
+		return x.Error
+	}
+	return ""
+}
+
+func (x *FileEnd) GetSameAs() string {
+	if x != nil {
+		return x.SameAs
+	}
+	return ""
+}
+
+func (x *FileEnd) GetStoredContent() bool {
+	if x != nil {
+		return x.StoredContent
+	}
+	return false
+}
+
 type FileResponse struct {
 	state    protoimpl.MessageState `protogen:"open.v1"`
 	StreamId int32                  `protobuf:"varint,1,opt,name=stream_id,json=streamId,proto3" json:"stream_id,omitempty"`
@@ -323,6 +1210,7 @@ type FileResponse struct {
 	//	*FileResponse_FileNeeded
 	//	*FileResponse_ChunkNeeded
 	//	*FileResponse_Result
+	//	*FileResponse_NeededBatch
 	ResponseType  isFileResponse_ResponseType `protobuf_oneof:"response_type"`
 	unknownFields protoimpl.UnknownFields
 	sizeCache     protoimpl.SizeCache
@@ -330,7 +1218,7 @@ type FileResponse struct {
 
 func (x *FileResponse) Reset() {
 	*x = FileResponse{}
-	mi := &file_api_backup_proto_msgTypes[4]
+	mi := &file_api_backup_proto_msgTypes[17]
 	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 	ms.StoreMessageInfo(mi)
 }
@@ -342,7 +1230,7 @@ func (x *FileResponse) String() string {
 func (*FileResponse) ProtoMessage() {}
 
 func (x *FileResponse) ProtoReflect() protoreflect.Message {
-	mi := &file_api_backup_proto_msgTypes[4]
+	mi := &file_api_backup_proto_msgTypes[17]
 	if x != nil {
 		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 		if ms.LoadMessageInfo() == nil {
@@ -355,7 +1243,7 @@ func (x *FileResponse) ProtoReflect() protoreflect.Message {
 
 // Deprecated: Use FileResponse.ProtoReflect.Descriptor instead.
 func (*FileResponse) Descriptor() ([]byte, []int) {
-	return file_api_backup_proto_rawDescGZIP(), []int{4}
+	return file_api_backup_proto_rawDescGZIP(), []int{17}
 }
 
 func (x *FileResponse) GetStreamId() int32 {
@@ -399,6 +1287,15 @@ func (x *FileResponse) GetResult() *ProcessingResult {
 	return nil
 }
 
+func (x *FileResponse) GetNeededBatch() *FileNeededBatch {
+	if x != nil {
+		if x, ok := x.ResponseType.(*FileResponse_NeededBatch); ok {
+			return x.NeededBatch
+		}
+	}
+	return nil
+}
+
 type isFileResponse_ResponseType interface {
 	isFileResponse_ResponseType()
 }
@@ -415,12 +1312,18 @@ type FileResponse_Result struct {
 	Result *ProcessingResult `protobuf:"bytes,4,opt,name=result,proto3,oneof"`
 }
 
+type FileResponse_NeededBatch struct {
+	NeededBatch *FileNeededBatch `protobuf:"bytes,5,opt,name=needed_batch,json=neededBatch,proto3,oneof"`
+}
+
 func (*FileResponse_FileNeeded) isFileResponse_ResponseType() {}
 
 func (*FileResponse_ChunkNeeded) isFileResponse_ResponseType() {}
 
 func (*FileResponse_Result) isFileResponse_ResponseType() {}
 
+func (*FileResponse_NeededBatch) isFileResponse_ResponseType() {}
+
 type FileNeeded struct {
 	state         protoimpl.MessageState `protogen:"open.v1"`
 	FileId        string                 `protobuf:"bytes,1,opt,name=file_id,json=fileId,proto3" json:"file_id,omitempty"`
@@ -432,7 +1335,7 @@ type FileNeeded struct {
 
 func (x *FileNeeded) Reset() {
 	*x = FileNeeded{}
-	mi := &file_api_backup_proto_msgTypes[5]
+	mi := &file_api_backup_proto_msgTypes[18]
 	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 	ms.StoreMessageInfo(mi)
 }
@@ -444,7 +1347,7 @@ func (x *FileNeeded) String() string {
 func (*FileNeeded) ProtoMessage() {}
 
 func (x *FileNeeded) ProtoReflect() protoreflect.Message {
-	mi := &file_api_backup_proto_msgTypes[5]
+	mi := &file_api_backup_proto_msgTypes[18]
 	if x != nil {
 		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 		if ms.LoadMessageInfo() == nil {
@@ -457,7 +1360,7 @@ func (x *FileNeeded) ProtoReflect() protoreflect.Message {
 
 // Deprecated: Use FileNeeded.ProtoReflect.Descriptor instead.
 func (*FileNeeded) Descriptor() ([]byte, []int) {
-	return file_api_backup_proto_rawDescGZIP(), []int{5}
+	return file_api_backup_proto_rawDescGZIP(), []int{18}
 }
 
 func (x *FileNeeded) GetFileId() string {
@@ -481,6 +1384,51 @@ func (x *FileNeeded) GetHost() string {
 	return ""
 }
 
+// FileNeededBatch answers a FileBatch, one FileNeeded per file in the same order
+type FileNeededBatch struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Files         []*FileNeeded          `protobuf:"bytes,1,rep,name=files,proto3" json:"files,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *FileNeededBatch) Reset() {
+	*x = FileNeededBatch{}
+	mi := &file_api_backup_proto_msgTypes[19]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *FileNeededBatch) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*FileNeededBatch) ProtoMessage() {}
+
+func (x *FileNeededBatch) ProtoReflect() protoreflect.Message {
+	mi := &file_api_backup_proto_msgTypes[19]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use FileNeededBatch.ProtoReflect.Descriptor instead.
+func (*FileNeededBatch) Descriptor() ([]byte, []int) {
+	return file_api_backup_proto_rawDescGZIP(), []int{19}
+}
+
+func (x *FileNeededBatch) GetFiles() []*FileNeeded {
+	if x != nil {
+		return x.Files
+	}
+	return nil
+}
+
 type ChunkNeeded struct {
 	state         protoimpl.MessageState `protogen:"open.v1"`
 	Filename      string                 `protobuf:"bytes,1,opt,name=filename,proto3" json:"filename,omitempty"`
@@ -492,7 +1440,7 @@ type ChunkNeeded struct {
 
 func (x *ChunkNeeded) Reset() {
 	*x = ChunkNeeded{}
-	mi := &file_api_backup_proto_msgTypes[6]
+	mi := &file_api_backup_proto_msgTypes[20]
 	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 	ms.StoreMessageInfo(mi)
 }
@@ -504,7 +1452,7 @@ func (x *ChunkNeeded) String() string {
 func (*ChunkNeeded) ProtoMessage() {}
 
 func (x *ChunkNeeded) ProtoReflect() protoreflect.Message {
-	mi := &file_api_backup_proto_msgTypes[6]
+	mi := &file_api_backup_proto_msgTypes[20]
 	if x != nil {
 		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 		if ms.LoadMessageInfo() == nil {
@@ -517,7 +1465,7 @@ func (x *ChunkNeeded) ProtoReflect() protoreflect.Message {
 
 // Deprecated: Use ChunkNeeded.ProtoReflect.Descriptor instead.
 func (*ChunkNeeded) Descriptor() ([]byte, []int) {
-	return file_api_backup_proto_rawDescGZIP(), []int{6}
+	return file_api_backup_proto_rawDescGZIP(), []int{20}
 }
 
 func (x *ChunkNeeded) GetFilename() string {
@@ -552,7 +1500,7 @@ type ProcessingResult struct {
 
 func (x *ProcessingResult) Reset() {
 	*x = ProcessingResult{}
-	mi := &file_api_backup_proto_msgTypes[7]
+	mi := &file_api_backup_proto_msgTypes[21]
 	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 	ms.StoreMessageInfo(mi)
 }
@@ -564,7 +1512,7 @@ func (x *ProcessingResult) String() string {
 func (*ProcessingResult) ProtoMessage() {}
 
 func (x *ProcessingResult) ProtoReflect() protoreflect.Message {
-	mi := &file_api_backup_proto_msgTypes[7]
+	mi := &file_api_backup_proto_msgTypes[21]
 	if x != nil {
 		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 		if ms.LoadMessageInfo() == nil {
@@ -577,7 +1525,7 @@ func (x *ProcessingResult) ProtoReflect() protoreflect.Message {
 
 // Deprecated: Use ProcessingResult.ProtoReflect.Descriptor instead.
 func (*ProcessingResult) Descriptor() ([]byte, []int) {
-	return file_api_backup_proto_rawDescGZIP(), []int{7}
+	return file_api_backup_proto_rawDescGZIP(), []int{21}
 }
 
 func (x *ProcessingResult) GetFileId() string {
@@ -605,20 +1553,70 @@ var File_api_backup_proto protoreflect.FileDescriptor
 
 const file_api_backup_proto_rawDesc = "" +
 	"\n" +
-	"\x10api/backup.proto\x12\rbackupservice\"\xe8\x01\n" +
+	"\x10api/backup.proto\x12\rbackupservice\"\xb1\x03\n" +
 	"\vFileRequest\x12\x1b\n" +
 	"\tstream_id\x18\x01 \x01(\x05R\bstreamId\x126\n" +
 	"\tfile_info\x18\x02 \x01(\v2\x17.backupservice.FileInfoH\x00R\bfileInfo\x129\n" +
 	"\n" +
 	"chunk_hash\x18\x03 \x01(\v2\x18.backupservice.ChunkHashH\x00R\tchunkHash\x129\n" +
 	"\n" +
-	"chunk_data\x18\x04 \x01(\v2\x18.backupservice.ChunkDataH\x00R\tchunkDataB\x0e\n" +
-	"\frequest_type\"C\n" +
+	"chunk_data\x18\x04 \x01(\v2\x18.backupservice.ChunkDataH\x00R\tchunkData\x12,\n" +
+	"\x05chunk\x18\x05 \x01(\v2\x14.backupservice.ChunkH\x00R\x05chunk\x123\n" +
+	"\bfile_end\x18\x06 \x01(\v2\x16.backupservice.FileEndH\x00R\afileEnd\x120\n" +
+	"\x05batch\x18\a \x01(\v2\x18.backupservice.FileBatchH\x00R\x05batch\x122\n" +
+	"\x05start\x18\b \x01(\v2\x1a.backupservice.StreamStartH\x00R\x05startB\x0e\n" +
+	"\frequest_type\"[\n" +
+	"\vStreamStart\x12\x15\n" +
+	"\x06job_id\x18\x01 \x01(\tR\x05jobId\x12!\n" +
+	"\fresume_token\x18\x02 \x01(\tR\vresumeToken\x12\x12\n" +
+	"\x04host\x18\x03 \x01(\tR\x04host\"\x82\x01\n" +
+	"\x15StreamProgressRequest\x12\x12\n" +
+	"\x04host\x18\x01 \x01(\tR\x04host\x12\x15\n" +
+	"\x06job_id\x18\x02 \x01(\tR\x05jobId\x12\x1b\n" +
+	"\tstream_id\x18\x03 \x01(\x05R\bstreamId\x12!\n" +
+	"\fresume_token\x18\x04 \x01(\tR\vresumeToken\"P\n" +
+	"\x0eStreamProgress\x12\x1c\n" +
+	"\tcommitted\x18\x01 \x01(\x03R\tcommitted\x12 \n" +
+	"\flast_file_id\x18\x02 \x01(\tR\n" +
+	"lastFileId\"\xee\x02\n" +
+	"\x06JobRun\x12\x15\n" +
+	"\x06job_id\x18\x01 \x01(\tR\x05jobId\x12\x12\n" +
+	"\x04host\x18\x02 \x01(\tR\x04host\x12&\n" +
+	"\x0fstarted_unix_ms\x18\x03 \x01(\x03R\rstartedUnixMs\x12(\n" +
+	"\x10finished_unix_ms\x18\x04 \x01(\x03R\x0efinishedUnixMs\x12#\n" +
+	"\rfiles_scanned\x18\x05 \x01(\x03R\ffilesScanned\x12!\n" +
+	"\ffiles_stored\x18\x06 \x01(\x03R\vfilesStored\x12#\n" +
+	"\rfiles_skipped\x18\a \x01(\x03R\ffilesSkipped\x12!\n" +
+	"\ffiles_failed\x18\b \x01(\x03R\vfilesFailed\x12\x1d\n" +
+	"\n" +
+	"bytes_sent\x18\t \x01(\x03R\tbytesSent\x12\x16\n" +
+	"\x06errors\x18\n" +
+	" \x01(\x03R\x06errors\x12 \n" +
+	"\vinterrupted\x18\v \x01(\bR\vinterrupted\"\x10\n" +
+	"\x0eJobRunRecorded\">\n" +
+	"\fContentQuery\x12\x1a\n" +
+	"\bchecksum\x18\x01 \x01(\tR\bchecksum\x12\x12\n" +
+	"\x04size\x18\x02 \x01(\x03R\x04size\"$\n" +
+	"\fContentKnown\x12\x14\n" +
+	"\x05known\x18\x01 \x01(\bR\x05known\">\n" +
+	"\x14BackedUpFilesRequest\x12\x12\n" +
+	"\x04host\x18\x01 \x01(\tR\x04host\x12\x12\n" +
+	"\x04path\x18\x02 \x01(\tR\x04path\"\x8e\x01\n" +
+	"\fBackedUpFile\x12\x12\n" +
+	"\x04path\x18\x01 \x01(\tR\x04path\x12\x12\n" +
+	"\x04size\x18\x02 \x01(\x03R\x04size\x12'\n" +
+	"\x10mod_time_unix_ns\x18\x03 \x01(\x03R\rmodTimeUnixNs\x12-\n" +
+	"\x13change_time_unix_ns\x18\x04 \x01(\x03R\x10changeTimeUnixNs\"`\n" +
 	"\bFileInfo\x12\x17\n" +
 	"\afile_id\x18\x01 \x01(\tR\x06fileId\x12\x1e\n" +
 	"\n" +
 	"attributes\x18\x04 \x01(\fR\n" +
-	"attributes\"\x85\x01\n" +
+	"attributes\x12\x1b\n" +
+	"\thash_algo\x18\x05 \x01(\tR\bhashAlgo\":\n" +
+	"\tFileBatch\x12-\n" +
+	"\x05files\x18\x01 \x03(\v2\x17.backupservice.FileInfoR\x05files\"'\n" +
+	"\vFilePreview\x12\x18\n" +
+	"\aactions\x18\x01 \x03(\tR\aactions\"\x85\x01\n" +
 	"\tChunkHash\x12\x17\n" +
 	"\afile_id\x18\x01 \x01(\tR\x06fileId\x12\x1f\n" +
 	"\vblake3_hash\x18\x02 \x01(\tR\n" +
@@ -633,19 +1631,35 @@ const file_api_backup_proto_rawDesc = "" +
 	"blake3Hash\x12\x1f\n" +
 	"\vchunk_index\x18\x03 \x01(\x03R\n" +
 	"chunkIndex\x12\x12\n" +
-	"\x04data\x18\x04 \x01(\fR\x04data\"\xf6\x01\n" +
+	"\x04data\x18\x04 \x01(\fR\x04data\"\x8a\x01\n" +
+	"\x05Chunk\x12\x17\n" +
+	"\afile_id\x18\x01 \x01(\tR\x06fileId\x12\x16\n" +
+	"\x06offset\x18\x02 \x01(\x03R\x06offset\x12\x12\n" +
+	"\x04data\x18\x03 \x01(\fR\x04data\x12\x1a\n" +
+	"\bchecksum\x18\x04 \x01(\tR\bchecksum\x12 \n" +
+	"\vcompression\x18\x05 \x01(\tR\vcompression\"\xa8\x01\n" +
+	"\aFileEnd\x12\x17\n" +
+	"\afile_id\x18\x01 \x01(\tR\x06fileId\x12\x12\n" +
+	"\x04size\x18\x02 \x01(\x03R\x04size\x12\x1a\n" +
+	"\bchecksum\x18\x03 \x01(\tR\bchecksum\x12\x14\n" +
+	"\x05error\x18\x04 \x01(\tR\x05error\x12\x17\n" +
+	"\asame_as\x18\x05 \x01(\tR\x06sameAs\x12%\n" +
+	"\x0estored_content\x18\x06 \x01(\bR\rstoredContent\"\xbb\x02\n" +
 	"\fFileResponse\x12\x1b\n" +
 	"\tstream_id\x18\x01 \x01(\x05R\bstreamId\x12<\n" +
 	"\vfile_needed\x18\x02 \x01(\v2\x19.backupservice.FileNeededH\x00R\n" +
 	"fileNeeded\x12?\n" +
 	"\fchunk_needed\x18\x03 \x01(\v2\x1a.backupservice.ChunkNeededH\x00R\vchunkNeeded\x129\n" +
-	"\x06result\x18\x04 \x01(\v2\x1f.backupservice.ProcessingResultH\x00R\x06resultB\x0f\n" +
+	"\x06result\x18\x04 \x01(\v2\x1f.backupservice.ProcessingResultH\x00R\x06result\x12C\n" +
+	"\fneeded_batch\x18\x05 \x01(\v2\x1e.backupservice.FileNeededBatchH\x00R\vneededBatchB\x0f\n" +
 	"\rresponse_type\"Q\n" +
 	"\n" +
 	"FileNeeded\x12\x17\n" +
 	"\afile_id\x18\x01 \x01(\tR\x06fileId\x12\x16\n" +
 	"\x06needed\x18\x02 \x01(\bR\x06needed\x12\x12\n" +
-	"\x04host\x18\x03 \x01(\tR\x04host\"b\n" +
+	"\x04host\x18\x03 \x01(\tR\x04host\"B\n" +
+	"\x0fFileNeededBatch\x12/\n" +
+	"\x05files\x18\x01 \x03(\v2\x19.backupservice.FileNeededR\x05files\"b\n" +
 	"\vChunkNeeded\x12\x1a\n" +
 	"\bfilename\x18\x01 \x01(\tR\bfilename\x12\x1f\n" +
 	"\vblake3_hash\x18\x02 \x01(\tR\n" +
@@ -654,9 +1668,15 @@ const file_api_backup_proto_rawDesc = "" +
 	"\x10ProcessingResult\x12\x17\n" +
 	"\afile_id\x18\x01 \x01(\tR\x06fileId\x12\x18\n" +
 	"\amessage\x18\x02 \x01(\tR\amessage\x12\x18\n" +
-	"\asuccess\x18\x03 \x01(\bR\asuccess2c\n" +
+	"\asuccess\x18\x03 \x01(\bR\asuccess2\xea\x03\n" +
 	"\rBackupService\x12R\n" +
-	"\x13ProcessBackupStream\x12\x1a.backupservice.FileRequest\x1a\x1b.backupservice.FileResponse(\x010\x01B\tZ\a./protob\x06proto3"
+	"\x13ProcessBackupStream\x12\x1a.backupservice.FileRequest\x1a\x1b.backupservice.FileResponse(\x010\x01\x12X\n" +
+	"\x11GetStreamProgress\x12$.backupservice.StreamProgressRequest\x1a\x1d.backupservice.StreamProgress\x12D\n" +
+	"\fRecordJobRun\x12\x15.backupservice.JobRun\x1a\x1d.backupservice.JobRunRecorded\x12F\n" +
+	"\n" +
+	"HasContent\x12\x1b.backupservice.ContentQuery\x1a\x1b.backupservice.ContentKnown\x12W\n" +
+	"\x11ListBackedUpFiles\x12#.backupservice.BackedUpFilesRequest\x1a\x1b.backupservice.BackedUpFile0\x01\x12D\n" +
+	"\fPreviewFiles\x12\x18.backupservice.FileBatch\x1a\x1a.backupservice.FilePreviewB\tZ\a./protob\x06proto3"
 
 var (
 	file_api_backup_proto_rawDescOnce sync.Once
@@ -670,31 +1690,62 @@ func file_api_backup_proto_rawDescGZIP() []byte {
 	return file_api_backup_proto_rawDescData
 }
 
-var file_api_backup_proto_msgTypes = make([]protoimpl.MessageInfo, 8)
+var file_api_backup_proto_msgTypes = make([]protoimpl.MessageInfo, 22)
 var file_api_backup_proto_goTypes = []any{
-	(*FileRequest)(nil),      // 0: backupservice.FileRequest
-	(*FileInfo)(nil),         // 1: backupservice.FileInfo
-	(*ChunkHash)(nil),        // 2: backupservice.ChunkHash
-	(*ChunkData)(nil),        // 3: backupservice.ChunkData
-	(*FileResponse)(nil),     // 4: backupservice.FileResponse
-	(*FileNeeded)(nil),       // 5: backupservice.FileNeeded
-	(*ChunkNeeded)(nil),      // 6: backupservice.ChunkNeeded
-	(*ProcessingResult)(nil), // 7: backupservice.ProcessingResult
+	(*FileRequest)(nil),           // 0: backupservice.FileRequest
+	(*StreamStart)(nil),           // 1: backupservice.StreamStart
+	(*StreamProgressRequest)(nil), // 2: backupservice.StreamProgressRequest
+	(*StreamProgress)(nil),        // 3: backupservice.StreamProgress
+	(*JobRun)(nil),                // 4: backupservice.JobRun
+	(*JobRunRecorded)(nil),        // 5: backupservice.JobRunRecorded
+	(*ContentQuery)(nil),          // 6: backupservice.ContentQuery
+	(*ContentKnown)(nil),          // 7: backupservice.ContentKnown
+	(*BackedUpFilesRequest)(nil),  // 8: backupservice.BackedUpFilesRequest
+	(*BackedUpFile)(nil),          // 9: backupservice.BackedUpFile
+	(*FileInfo)(nil),              // 10: backupservice.FileInfo
+	(*FileBatch)(nil),             // 11: backupservice.FileBatch
+	(*FilePreview)(nil),           // 12: backupservice.FilePreview
+	(*ChunkHash)(nil),             // 13: backupservice.ChunkHash
+	(*ChunkData)(nil),             // 14: backupservice.ChunkData
+	(*Chunk)(nil),                 // 15: backupservice.Chunk
+	(*FileEnd)(nil),               // 16: backupservice.FileEnd
+	(*FileResponse)(nil),          // 17: backupservice.FileResponse
+	(*FileNeeded)(nil),            // 18: backupservice.FileNeeded
+	(*FileNeededBatch)(nil),       // 19: backupservice.FileNeededBatch
+	(*ChunkNeeded)(nil),           // 20: backupservice.ChunkNeeded
+	(*ProcessingResult)(nil),      // 21: backupservice.ProcessingResult
 }
 var file_api_backup_proto_depIdxs = []int32{
-	1, // 0: backupservice.FileRequest.file_info:type_name -> backupservice.FileInfo
-	2, // 1: backupservice.FileRequest.chunk_hash:type_name -> backupservice.ChunkHash
-	3, // 2: backupservice.FileRequest.chunk_data:type_name -> backupservice.ChunkData
-	5, // 3: backupservice.FileResponse.file_needed:type_name -> backupservice.FileNeeded
-	6, // 4: backupservice.FileResponse.chunk_needed:type_name -> backupservice.ChunkNeeded
-	7, // 5: backupservice.FileResponse.result:type_name -> backupservice.ProcessingResult
-	0, // 6: backupservice.BackupService.ProcessBackupStream:input_type -> backupservice.FileRequest
-	4, // 7: backupservice.BackupService.ProcessBackupStream:output_type -> backupservice.FileResponse
-	7, // [7:8] is the sub-list for method output_type
-	6, // [6:7] is the sub-list for method input_type
-	6, // [6:6] is the sub-list for extension type_name
-	6, // [6:6] is the sub-list for extension extendee
-	0, // [0:6] is the sub-list for field type_name
+	10, // 0: backupservice.FileRequest.file_info:type_name -> backupservice.FileInfo
+	13, // 1: backupservice.FileRequest.chunk_hash:type_name -> backupservice.ChunkHash
+	14, // 2: backupservice.FileRequest.chunk_data:type_name -> backupservice.ChunkData
+	15, // 3: backupservice.FileRequest.chunk:type_name -> backupservice.Chunk
+	16, // 4: backupservice.FileRequest.file_end:type_name -> backupservice.FileEnd
+	11, // 5: backupservice.FileRequest.batch:type_name -> backupservice.FileBatch
+	1,  // 6: backupservice.FileRequest.start:type_name -> backupservice.StreamStart
+	10, // 7: backupservice.FileBatch.files:type_name -> backupservice.FileInfo
+	18, // 8: backupservice.FileResponse.file_needed:type_name -> backupservice.FileNeeded
+	20, // 9: backupservice.FileResponse.chunk_needed:type_name -> backupservice.ChunkNeeded
+	21, // 10: backupservice.FileResponse.result:type_name -> backupservice.ProcessingResult
+	19, // 11: backupservice.FileResponse.needed_batch:type_name -> backupservice.FileNeededBatch
+	18, // 12: backupservice.FileNeededBatch.files:type_name -> backupservice.FileNeeded
+	0,  // 13: backupservice.BackupService.ProcessBackupStream:input_type -> backupservice.FileRequest
+	2,  // 14: backupservice.BackupService.GetStreamProgress:input_type -> backupservice.StreamProgressRequest
+	4,  // 15: backupservice.BackupService.RecordJobRun:input_type -> backupservice.JobRun
+	6,  // 16: backupservice.BackupService.HasContent:input_type -> backupservice.ContentQuery
+	8,  // 17: backupservice.BackupService.ListBackedUpFiles:input_type -> backupservice.BackedUpFilesRequest
+	11, // 18: backupservice.BackupService.PreviewFiles:input_type -> backupservice.FileBatch
+	17, // 19: backupservice.BackupService.ProcessBackupStream:output_type -> backupservice.FileResponse
+	3,  // 20: backupservice.BackupService.GetStreamProgress:output_type -> backupservice.StreamProgress
+	5,  // 21: backupservice.BackupService.RecordJobRun:output_type -> backupservice.JobRunRecorded
+	7,  // 22: backupservice.BackupService.HasContent:output_type -> backupservice.ContentKnown
+	9,  // 23: backupservice.BackupService.ListBackedUpFiles:output_type -> backupservice.BackedUpFile
+	12, // 24: backupservice.BackupService.PreviewFiles:output_type -> backupservice.FilePreview
+	19, // [19:25] is the sub-list for method output_type
+	13, // [13:19] is the sub-list for method input_type
+	13, // [13:13] is the sub-list for extension type_name
+	13, // [13:13] is the sub-list for extension extendee
+	0,  // [0:13] is the sub-list for field type_name
 }
 
 func init() { file_api_backup_proto_init() }
@@ -706,11 +1757,16 @@ func file_api_backup_proto_init() {
 		(*FileRequest_FileInfo)(nil),
 		(*FileRequest_ChunkHash)(nil),
 		(*FileRequest_ChunkData)(nil),
+		(*FileRequest_Chunk)(nil),
+		(*FileRequest_FileEnd)(nil),
+		(*FileRequest_Batch)(nil),
+		(*FileRequest_Start)(nil),
 	}
-	file_api_backup_proto_msgTypes[4].OneofWrappers = []any{
+	file_api_backup_proto_msgTypes[17].OneofWrappers = []any{
 		(*FileResponse_FileNeeded)(nil),
 		(*FileResponse_ChunkNeeded)(nil),
 		(*FileResponse_Result)(nil),
+		(*FileResponse_NeededBatch)(nil),
 	}
 	type x struct{}
 	out := protoimpl.TypeBuilder{
@@ -718,7 +1774,7 @@ func file_api_backup_proto_init() {
 			GoPackagePath: reflect.TypeOf(x{}).PkgPath(),
 			RawDescriptor: unsafe.Slice(unsafe.StringData(file_api_backup_proto_rawDesc), len(file_api_backup_proto_rawDesc)),
 			NumEnums:      0,
-			NumMessages:   8,
+			NumMessages:   22,
 			NumExtensions: 0,
 			NumServices:   1,
 		},
@@ -20,6 +20,11 @@ const _ = grpc.SupportPackageIsVersion9
 
 const (
 	BackupService_ProcessBackupStream_FullMethodName = "/backupservice.BackupService/ProcessBackupStream"
+	BackupService_GetStreamProgress_FullMethodName   = "/backupservice.BackupService/GetStreamProgress"
+	BackupService_RecordJobRun_FullMethodName        = "/backupservice.BackupService/RecordJobRun"
+	BackupService_HasContent_FullMethodName          = "/backupservice.BackupService/HasContent"
+	BackupService_ListBackedUpFiles_FullMethodName   = "/backupservice.BackupService/ListBackedUpFiles"
+	BackupService_PreviewFiles_FullMethodName        = "/backupservice.BackupService/PreviewFiles"
 )
 
 // BackupServiceClient is the client API for BackupService service.
@@ -27,6 +32,16 @@ const (
 // For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
 type BackupServiceClient interface {
 	ProcessBackupStream(ctx context.Context, opts ...grpc.CallOption) (grpc.BidiStreamingClient[FileRequest, FileResponse], error)
+	// GetStreamProgress tells how far earlier attempts of a resumable stream got
+	GetStreamProgress(ctx context.Context, in *StreamProgressRequest, opts ...grpc.CallOption) (*StreamProgress, error)
+	// RecordJobRun stores the summary of a backup run once all its streams ended
+	RecordJobRun(ctx context.Context, in *JobRun, opts ...grpc.CallOption) (*JobRunRecorded, error)
+	// HasContent tells whether the writer already stores some content, backed up from any host
+	HasContent(ctx context.Context, in *ContentQuery, opts ...grpc.CallOption) (*ContentKnown, error)
+	// ListBackedUpFiles streams the latest version of every file backed up from a host below a path
+	ListBackedUpFiles(ctx context.Context, in *BackedUpFilesRequest, opts ...grpc.CallOption) (grpc.ServerStreamingClient[BackedUpFile], error)
+	// PreviewFiles tells what backing up a batch of files would do, without recording anything
+	PreviewFiles(ctx context.Context, in *FileBatch, opts ...grpc.CallOption) (*FilePreview, error)
 }
 
 type backupServiceClient struct {
@@ -50,11 +65,80 @@ func (c *backupServiceClient) ProcessBackupStream(ctx context.Context, opts ...g
 // This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
 type BackupService_ProcessBackupStreamClient = grpc.BidiStreamingClient[FileRequest, FileResponse]
 
+func (c *backupServiceClient) GetStreamProgress(ctx context.Context, in *StreamProgressRequest, opts ...grpc.CallOption) (*StreamProgress, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(StreamProgress)
+	err := c.cc.Invoke(ctx, BackupService_GetStreamProgress_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *backupServiceClient) RecordJobRun(ctx context.Context, in *JobRun, opts ...grpc.CallOption) (*JobRunRecorded, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(JobRunRecorded)
+	err := c.cc.Invoke(ctx, BackupService_RecordJobRun_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *backupServiceClient) HasContent(ctx context.Context, in *ContentQuery, opts ...grpc.CallOption) (*ContentKnown, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(ContentKnown)
+	err := c.cc.Invoke(ctx, BackupService_HasContent_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *backupServiceClient) ListBackedUpFiles(ctx context.Context, in *BackedUpFilesRequest, opts ...grpc.CallOption) (grpc.ServerStreamingClient[BackedUpFile], error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	stream, err := c.cc.NewStream(ctx, &BackupService_ServiceDesc.Streams[1], BackupService_ListBackedUpFiles_FullMethodName, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &grpc.GenericClientStream[BackedUpFilesRequest, BackedUpFile]{ClientStream: stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type BackupService_ListBackedUpFilesClient = grpc.ServerStreamingClient[BackedUpFile]
+
+func (c *backupServiceClient) PreviewFiles(ctx context.Context, in *FileBatch, opts ...grpc.CallOption) (*FilePreview, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(FilePreview)
+	err := c.cc.Invoke(ctx, BackupService_PreviewFiles_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
 // BackupServiceServer is the server API for BackupService service.
 // All implementations must embed UnimplementedBackupServiceServer
 // for forward compatibility.
 type BackupServiceServer interface {
 	ProcessBackupStream(grpc.BidiStreamingServer[FileRequest, FileResponse]) error
+	// GetStreamProgress tells how far earlier attempts of a resumable stream got
+	GetStreamProgress(context.Context, *StreamProgressRequest) (*StreamProgress, error)
+	// RecordJobRun stores the summary of a backup run once all its streams ended
+	RecordJobRun(context.Context, *JobRun) (*JobRunRecorded, error)
+	// HasContent tells whether the writer already stores some content, backed up from any host
+	HasContent(context.Context, *ContentQuery) (*ContentKnown, error)
+	// ListBackedUpFiles streams the latest version of every file backed up from a host below a path
+	ListBackedUpFiles(*BackedUpFilesRequest, grpc.ServerStreamingServer[BackedUpFile]) error
+	// PreviewFiles tells what backing up a batch of files would do, without recording anything
+	PreviewFiles(context.Context, *FileBatch) (*FilePreview, error)
 	mustEmbedUnimplementedBackupServiceServer()
 }
 
@@ -68,6 +152,21 @@ type UnimplementedBackupServiceServer struct{}
 func (UnimplementedBackupServiceServer) ProcessBackupStream(grpc.BidiStreamingServer[FileRequest, FileResponse]) error {
 	return status.Errorf(codes.Unimplemented, "method ProcessBackupStream not implemented")
 }
+func (UnimplementedBackupServiceServer) GetStreamProgress(context.Context, *StreamProgressRequest) (*StreamProgress, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetStreamProgress not implemented")
+}
+func (UnimplementedBackupServiceServer) RecordJobRun(context.Context, *JobRun) (*JobRunRecorded, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method RecordJobRun not implemented")
+}
+func (UnimplementedBackupServiceServer) HasContent(context.Context, *ContentQuery) (*ContentKnown, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method HasContent not implemented")
+}
+func (UnimplementedBackupServiceServer) ListBackedUpFiles(*BackedUpFilesRequest, grpc.ServerStreamingServer[BackedUpFile]) error {
+	return status.Errorf(codes.Unimplemented, "method ListBackedUpFiles not implemented")
+}
+func (UnimplementedBackupServiceServer) PreviewFiles(context.Context, *FileBatch) (*FilePreview, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method PreviewFiles not implemented")
+}
 func (UnimplementedBackupServiceServer) mustEmbedUnimplementedBackupServiceServer() {}
 func (UnimplementedBackupServiceServer) testEmbeddedByValue()                       {}
 
@@ -96,13 +195,113 @@ func _BackupService_ProcessBackupStream_Handler(srv interface{}, stream grpc.Ser
 // This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
 type BackupService_ProcessBackupStreamServer = grpc.BidiStreamingServer[FileRequest, FileResponse]
 
+func _BackupService_GetStreamProgress_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(StreamProgressRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(BackupServiceServer).GetStreamProgress(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: BackupService_GetStreamProgress_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(BackupServiceServer).GetStreamProgress(ctx, req.(*StreamProgressRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _BackupService_RecordJobRun_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(JobRun)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(BackupServiceServer).RecordJobRun(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: BackupService_RecordJobRun_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(BackupServiceServer).RecordJobRun(ctx, req.(*JobRun))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _BackupService_HasContent_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ContentQuery)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(BackupServiceServer).HasContent(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: BackupService_HasContent_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(BackupServiceServer).HasContent(ctx, req.(*ContentQuery))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _BackupService_ListBackedUpFiles_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(BackedUpFilesRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(BackupServiceServer).ListBackedUpFiles(m, &grpc.GenericServerStream[BackedUpFilesRequest, BackedUpFile]{ServerStream: stream})
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type BackupService_ListBackedUpFilesServer = grpc.ServerStreamingServer[BackedUpFile]
+
+func _BackupService_PreviewFiles_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(FileBatch)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(BackupServiceServer).PreviewFiles(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: BackupService_PreviewFiles_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(BackupServiceServer).PreviewFiles(ctx, req.(*FileBatch))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
 // BackupService_ServiceDesc is the grpc.ServiceDesc for BackupService service.
 // It's only intended for direct use with grpc.RegisterService,
 // and not to be introspected or modified (even as a copy)
 var BackupService_ServiceDesc = grpc.ServiceDesc{
 	ServiceName: "backupservice.BackupService",
 	HandlerType: (*BackupServiceServer)(nil),
-	Methods:     []grpc.MethodDesc{},
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "GetStreamProgress",
+			Handler:    _BackupService_GetStreamProgress_Handler,
+		},
+		{
+			MethodName: "RecordJobRun",
+			Handler:    _BackupService_RecordJobRun_Handler,
+		},
+		{
+			MethodName: "HasContent",
+			Handler:    _BackupService_HasContent_Handler,
+		},
+		{
+			MethodName: "PreviewFiles",
+			Handler:    _BackupService_PreviewFiles_Handler,
+		},
+	},
 	Streams: []grpc.StreamDesc{
 		{
 			StreamName:    "ProcessBackupStream",
@@ -110,6 +309,11 @@ var BackupService_ServiceDesc = grpc.ServiceDesc{
 			ServerStreams: true,
 			ClientStreams: true,
 		},
+		{
+			StreamName:    "ListBackedUpFiles",
+			Handler:       _BackupService_ListBackedUpFiles_Handler,
+			ServerStreams: true,
+		},
 	},
 	Metadata: "api/backup.proto",
 }
@@ -14,6 +14,17 @@ var (
 	streams     int
 	debug       bool
 	quiet       bool
+	excludes    []string
+	includes    []string
+	stopOnError bool
+	skipErrors  bool
+	fileTimings bool
+	skipFSTypes []string
+	progressOut string
+	manifestOut string
+	oneFS       bool
+	incremental bool
+	dryRun      bool
 )
 
 // Arguments holds parsed command line arguments
@@ -24,10 +35,28 @@ type Arguments struct {
 	Streams      int
 	Debug        bool
 	Quiet        bool
+	Excludes     []string
+	Includes     []string
+	// StopStreamOnFileError is the config value unless overridden for this run
+	StopStreamOnFileError bool
+	// SkipFSTypes is the config list unless replaced for this run
+	SkipFSTypes []string
+	// RecordFileTimings is the config value unless enabled for this run
+	RecordFileTimings bool
+	// ProgressOutput is the config value unless set for this run
+	ProgressOutput string
+	// ManifestFile is the config value unless set for this run
+	ManifestFile string
+	// OneFileSystem keeps the scan on the filesystem of the source folder
+	OneFileSystem bool
+	// Incremental sends only the files changed since the writer's version, see config IncrementalFields
+	Incremental bool
+	// DryRun asks the writer what the run would do and reports it, without sending data or recording anything
+	DryRun bool
 }
 
 // parseArguments uses Cobra to parse command line arguments
-func parseArguments(conf *config.Config) (*Arguments, error) {
+func parseArguments(conf *config.Config, args []string) (*Arguments, error) {
 	cmd := &cobra.Command{
 		Use:   "brfs <source_folder>",
 		Short: "Backup tool for reading files",
@@ -40,12 +69,39 @@ func parseArguments(conf *config.Config) (*Arguments, error) {
 	cmd.Flags().IntVar(&streams, "streams", conf.DefaultStreams, "Number of streams")
 	cmd.Flags().BoolVar(&debug, "debug", false, "Enable debug logging")
 	cmd.Flags().BoolVar(&quiet, "quiet", false, "Suppress stdout logging")
+	cmd.Flags().StringArrayVar(&excludes, "exclude", nil, "Glob pattern of relative paths to skip, ** matches any directories (repeatable)")
+	cmd.Flags().StringArrayVar(&includes, "include", nil, "Glob pattern of relative files to back up, applied after excludes (repeatable)")
+	cmd.Flags().BoolVar(&stopOnError, "stop-on-error", false, "Stop a stream when a file can't be sent (overrides config StopStreamOnFileError)")
+	cmd.Flags().BoolVar(&skipErrors, "skip-errors", false, "Skip files that can't be sent (overrides config StopStreamOnFileError)")
+	cmd.MarkFlagsMutuallyExclusive("stop-on-error", "skip-errors")
+	cmd.Flags().StringArrayVar(&skipFSTypes, "skip-fs-type", nil, "Filesystem type of mounts to skip, \"bind\" for bind mounts (repeatable, replaces config SkipFSTypes)")
+	cmd.Flags().BoolVar(&fileTimings, "file-timings", false, "Log per-file phase durations at debug level (overrides config RecordFileTimings)")
+	cmd.Flags().StringVar(&progressOut, "progress", conf.ProgressOutput, "FIFO or Unix socket to write JSON progress events to (overrides config ProgressOutput)")
+	cmd.Flags().StringVar(&manifestOut, "manifest", conf.ManifestFile, "File to record completed files and the run summary in (overrides config ManifestFile)")
+	cmd.Flags().BoolVar(&oneFS, "one-file-system", false, "Don't descend into directories on other filesystems than the source folder")
+	cmd.Flags().BoolVar(&incremental, "incremental", false, "Send only files new or changed since the last backup, comparing config IncrementalFields")
+	cmd.Flags().BoolVar(&dryRun, "dry-run", false, "Report which files would be added, updated or skipped and the data to send, without backing up")
+	cmd.SetArgs(args)
 
 	// Parse arguments and flags
 	if err := cmd.Execute(); err != nil {
 		return nil, err
 	}
 
+	// Per-run override of the configured file error policy
+	stopStreamOnFileError := conf.StopStreamOnFileError
+	if stopOnError {
+		stopStreamOnFileError = true
+	}
+	if skipErrors {
+		stopStreamOnFileError = false
+	}
+
+	fsTypes := conf.SkipFSTypes
+	if cmd.Flags().Changed("skip-fs-type") {
+		fsTypes = skipFSTypes
+	}
+
 	// Get the source folder from parsed args
 	sourceFolder := cmd.Flags().Args()[0]
 
@@ -73,5 +129,16 @@ func parseArguments(conf *config.Config) (*Arguments, error) {
 		Streams:      streams,
 		Debug:        debug,
 		Quiet:        quiet,
+		Excludes:     excludes,
+		Includes:     includes,
+
+		StopStreamOnFileError: stopStreamOnFileError,
+		SkipFSTypes:           fsTypes,
+		RecordFileTimings:     conf.RecordFileTimings || fileTimings,
+		ProgressOutput:        progressOut,
+		ManifestFile:          manifestOut,
+		OneFileSystem:         oneFS,
+		Incremental:           incremental,
+		DryRun:                dryRun,
 	}, nil
 }
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/alex-sviridov/miniprotector/common/config"
+)
+
+func TestStopOnErrorOverride(t *testing.T) {
+	source := t.TempDir()
+
+	tests := []struct {
+		name       string
+		configured bool
+		args       []string
+		want       bool
+	}{
+		{"config true", true, nil, true},
+		{"config false", false, nil, false},
+		{"skip-errors overrides true", true, []string{"--skip-errors"}, false},
+		{"stop-on-error overrides false", false, []string{"--stop-on-error"}, true},
+		{"stop-on-error keeps true", true, []string{"--stop-on-error"}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conf := &config.Config{DefaultPort: 15722, DefaultStreams: 1, StopStreamOnFileError: tt.configured}
+
+			arguments, err := parseArguments(conf, append([]string{source}, tt.args...))
+			if err != nil {
+				t.Fatalf("Failed to parse arguments: %v", err)
+			}
+			if arguments.StopStreamOnFileError != tt.want {
+				t.Errorf("Expected StopStreamOnFileError %v, got %v", tt.want, arguments.StopStreamOnFileError)
+			}
+			if conf.StopStreamOnFileError != tt.configured {
+				t.Error("Configuration must not be modified by the override")
+			}
+		})
+	}
+}
+
+func TestStopOnErrorFlagsExclusive(t *testing.T) {
+	conf := &config.Config{DefaultPort: 15722, DefaultStreams: 1}
+
+	_, err := parseArguments(conf, []string{t.TempDir(), "--stop-on-error", "--skip-errors"})
+	if err == nil {
+		t.Error("Expected error when both --stop-on-error and --skip-errors are set")
+	}
+}
+
+func TestSkipFSTypesOverride(t *testing.T) {
+	source := t.TempDir()
+	conf := &config.Config{DefaultPort: 15722, DefaultStreams: 1, SkipFSTypes: []string{"proc", "tmpfs"}}
+
+	arguments, err := parseArguments(conf, []string{source})
+	if err != nil {
+		t.Fatalf("Failed to parse arguments: %v", err)
+	}
+	if strings.Join(arguments.SkipFSTypes, ",") != "proc,tmpfs" {
+		t.Errorf("Expected configured types, got %v", arguments.SkipFSTypes)
+	}
+
+	arguments, err = parseArguments(conf, []string{source, "--skip-fs-type", "overlay", "--skip-fs-type", "bind"})
+	if err != nil {
+		t.Fatalf("Failed to parse arguments: %v", err)
+	}
+	if strings.Join(arguments.SkipFSTypes, ",") != "overlay,bind" {
+		t.Errorf("Expected flag types to replace config, got %v", arguments.SkipFSTypes)
+	}
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"sync"
+)
+
+// inFlightBudget bounds the file data a stream has sent and the writer hasn't acknowledged yet.
+// Data of a file is acknowledged by the writer's result for it. A chunk waits until it fits in
+// the budget, except when only its own file has data in flight: a file larger than the budget
+// is then sent alone. A nil *inFlightBudget does nothing.
+type inFlightBudget struct {
+	limit int64
+	ready chan struct{} // Signalled when data is released or the budget is closed
+
+	mu     sync.Mutex
+	used   int64
+	byFile map[string]int64 // Bytes in flight by file id
+	closed bool
+}
+
+type budgetContextKey struct{}
+
+// withInFlightBudget returns a context carrying b for the stream functions
+func withInFlightBudget(ctx context.Context, b *inFlightBudget) context.Context {
+	return context.WithValue(ctx, budgetContextKey{}, b)
+}
+
+// inFlightBudgetFromContext returns the budget in ctx, nil if there is none
+func inFlightBudgetFromContext(ctx context.Context) *inFlightBudget {
+	b, _ := ctx.Value(budgetContextKey{}).(*inFlightBudget)
+	return b
+}
+
+// newInFlightBudget returns a budget of limit bytes, nil for no limit when limit isn't positive
+func newInFlightBudget(limit int64) *inFlightBudget {
+	if limit <= 0 {
+		return nil
+	}
+	return &inFlightBudget{limit: limit, ready: make(chan struct{}, 1), byFile: make(map[string]int64)}
+}
+
+// acquire waits until n more bytes of fileID can be sent and counts them as in flight.
+// It doesn't wait once the budget is closed, the stream is ending then.
+func (b *inFlightBudget) acquire(ctx context.Context, fileID string, n int64) error {
+	if b == nil {
+		return nil
+	}
+	for {
+		b.mu.Lock()
+		if b.closed || b.used+n <= b.limit || b.used == b.byFile[fileID] {
+			b.used += n
+			b.byFile[fileID] += n
+			b.mu.Unlock()
+			return nil
+		}
+		b.mu.Unlock()
+
+		select {
+		case <-b.ready:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// release frees the bytes of a file once the writer acknowledged it
+func (b *inFlightBudget) release(fileID string) {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	b.used -= b.byFile[fileID]
+	delete(b.byFile, fileID)
+	b.mu.Unlock()
+	b.signal()
+}
+
+// close stops acquire from waiting, no acknowledgement will come anymore
+func (b *inFlightBudget) close() {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	b.closed = true
+	b.mu.Unlock()
+	b.signal()
+}
+
+func (b *inFlightBudget) signal() {
+	select {
+	case b.ready <- struct{}{}:
+	default:
+	}
+}
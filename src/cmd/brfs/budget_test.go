@@ -0,0 +1,143 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	pb "github.com/alex-sviridov/miniprotector/api"
+	"github.com/alex-sviridov/miniprotector/common/chunker"
+	"github.com/alex-sviridov/miniprotector/common/config"
+	"github.com/alex-sviridov/miniprotector/common/files"
+)
+
+// slowAckWriter needs every file and acknowledges each one ackDelay after its FileEnd,
+// reading on meanwhile. It records the most data it held unacknowledged.
+type slowAckWriter struct {
+	pb.UnimplementedBackupServiceServer
+	ackDelay time.Duration
+
+	mu         sync.Mutex
+	data       map[string][]byte
+	unacked    int
+	maxUnacked int
+}
+
+func (sw *slowAckWriter) ProcessBackupStream(stream pb.BackupService_ProcessBackupStreamServer) error {
+	var sendMu sync.Mutex
+	send := func(response *pb.FileResponse) error {
+		sendMu.Lock()
+		defer sendMu.Unlock()
+		return stream.Send(response)
+	}
+	var acks sync.WaitGroup
+	defer acks.Wait()
+
+	for {
+		req, err := stream.Recv()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		switch r := req.RequestType.(type) {
+		case *pb.FileRequest_FileInfo:
+			fileInfo, err := files.DecodeFileInfo(r.FileInfo.Attributes)
+			if err != nil {
+				return err
+			}
+			answer := &pb.FileNeeded{FileId: r.FileInfo.FileId, Needed: true, Host: fileInfo.Host}
+			if err := send(&pb.FileResponse{StreamId: req.StreamId, ResponseType: &pb.FileResponse_FileNeeded{FileNeeded: answer}}); err != nil {
+				return err
+			}
+		case *pb.FileRequest_Chunk:
+			sw.mu.Lock()
+			sw.data[r.Chunk.FileId] = append(sw.data[r.Chunk.FileId], r.Chunk.Data...)
+			sw.unacked += len(r.Chunk.Data)
+			sw.maxUnacked = max(sw.maxUnacked, sw.unacked)
+			sw.mu.Unlock()
+		case *pb.FileRequest_FileEnd:
+			fileID, streamID := r.FileEnd.FileId, req.StreamId
+			acks.Add(1)
+			go func() {
+				defer acks.Done()
+				time.Sleep(sw.ackDelay)
+				sw.mu.Lock()
+				sw.unacked -= len(sw.data[fileID])
+				sw.mu.Unlock()
+				result := &pb.ProcessingResult{FileId: fileID, Success: true}
+				send(&pb.FileResponse{StreamId: streamID, ResponseType: &pb.FileResponse_Result{Result: result}})
+			}()
+		}
+	}
+}
+
+// runSlowAck backs up fileList to a slowAckWriter with the given budget and returns the writer
+func runSlowAck(t *testing.T, fileList []files.FileInfo, budget int64) *slowAckWriter {
+	t.Helper()
+	writer := &slowAckWriter{ackDelay: 20 * time.Millisecond, data: make(map[string][]byte)}
+	client := startTestWriter(t, writer)
+	ctx := newTransferContext(&config.Config{ConnectionTimeOutSec: 10, MaxInFlightBytes: budget})
+	if err := processStream(ctx, client, fileList, 1); err != nil {
+		t.Fatalf("processStream failed: %v", err)
+	}
+	return writer
+}
+
+func TestInFlightBudget(t *testing.T) {
+	root := t.TempDir()
+	contents := make(map[string][]byte)
+	for i := range 8 {
+		contents[filepath.Join(root, fmt.Sprintf("file%d", i))] = bytes.Repeat([]byte{byte(i)}, 100*1024)
+	}
+	large := filepath.Join(root, "large.bin")
+	contents[large] = bytes.Repeat([]byte("large"), chunker.DefaultChunkSize/4)
+	for path, data := range contents {
+		if err := os.WriteFile(path, data, 0600); err != nil {
+			t.Fatalf("Failed to write %s: %v", path, err)
+		}
+	}
+	fileList, _, err := files.Scan(root, files.ScanOptions{})
+	if err != nil {
+		t.Fatalf("Scan failed: %v", err)
+	}
+	var small []files.FileInfo
+	for _, file := range fileList {
+		if file.Path != large {
+			small = append(small, file)
+		}
+	}
+
+	// Without a budget the reader sends everything while the writer is slow to acknowledge
+	if writer := runSlowAck(t, small, 0); writer.maxUnacked <= 300*1024 {
+		t.Fatalf("Up to %d bytes were unacknowledged without a budget, the writer isn't slow enough", writer.maxUnacked)
+	}
+
+	const budget = 250 * 1024
+	writer := runSlowAck(t, small, budget)
+	if writer.maxUnacked > budget {
+		t.Errorf("Up to %d bytes were unacknowledged, expected at most %d", writer.maxUnacked, budget)
+	}
+	for _, file := range small {
+		if want, ok := contents[file.Path]; ok && !bytes.Equal(writer.data[file.GetId()], want) {
+			t.Errorf("Data of %s doesn't match the source", file.Path)
+		}
+	}
+
+	// A file larger than the budget is still sent, alone
+	writer = runSlowAck(t, fileList, budget)
+	if writer.maxUnacked > len(contents[large]) {
+		t.Errorf("Up to %d bytes were unacknowledged, expected at most the large file's %d", writer.maxUnacked, len(contents[large]))
+	}
+	for _, file := range fileList {
+		if file.Path == large && !bytes.Equal(writer.data[file.GetId()], contents[large]) {
+			t.Errorf("Data of %s doesn't match the source", file.Path)
+		}
+	}
+}
@@ -2,17 +2,106 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	"log/slog"
-	"time"
 
 	pb "github.com/alex-sviridov/miniprotector/api"
+	"github.com/alex-sviridov/miniprotector/common/chunker"
 	"github.com/alex-sviridov/miniprotector/common/config"
 	"github.com/alex-sviridov/miniprotector/common/files"
 	"github.com/alex-sviridov/miniprotector/common/logging"
+	"github.com/alex-sviridov/miniprotector/common/pool"
 )
 
+// errStreamNotRun is the result of a stream that never started
+var errStreamNotRun = errors.New("stream not run")
+
+// streamResult is how one stream of the run ended
+type streamResult struct {
+	streamID    int32
+	files       int
+	fileResults []fileResult // Files the writer answered for, or whose data was sent
+	err         error        // Why the stream failed, nil when it completed
+}
+
+// runStatus classifies a run by how its streams ended
+type runStatus int
+
+const (
+	runSucceeded runStatus = iota // Every stream completed, or there was nothing to send
+	runPartial                    // Some streams failed, others completed
+	runFailed                     // Every stream failed
+)
+
+// classifyStreams returns the status of a run and how many of its streams failed
+func classifyStreams(results []streamResult) (runStatus, int) {
+	failed := 0
+	for _, result := range results {
+		if result.err != nil {
+			failed++
+		}
+	}
+	switch {
+	case failed == 0:
+		return runSucceeded, 0
+	case failed == len(results):
+		return runFailed, failed
+	default:
+		return runPartial, failed
+	}
+}
+
+// processStreams runs one runStream per non-empty file list, all at the same time
+// The pool is deliberately unbounded: the number of lists, set by --streams, is what limits concurrency,
+// the pool only skips the streams not started once ctx is cancelled and waits for the others
+// Returns the result of every stream started, in stream order
+func processStreams(ctx context.Context, client pb.BackupServiceClient, streams [][]files.FileInfo) []streamResult {
+	logger := logging.GetLoggerFromContext(ctx)
+
+	var results []streamResult
+	for i, stream := range streams {
+		if len(stream) > 0 {
+			results = append(results, streamResult{streamID: int32(i + 1), files: len(stream)})
+		}
+	}
+
+	streamPool := pool.New(ctx, 0)
+	for i := range results {
+		// Each stream writes only its own result
+		result := &results[i]
+		stream := streams[result.streamID-1]
+		// The pool skips tasks once ctx is cancelled, those streams count as failed
+		result.err = errStreamNotRun
+		streamPool.Go(func(ctx context.Context) error {
+			fileResults := newFileResults()
+			result.err = runStream(withFileResults(ctx, fileResults), client, stream, result.streamID)
+			result.fileResults = fileResults.list()
+			if result.err != nil {
+				logger.Error("Stream failed", "streamID", result.streamID, "error", result.err)
+			}
+			return result.err
+		})
+	}
+
+	// Failures are already logged per stream
+	_ = streamPool.Wait()
+	return results
+}
+
+// streamError returns why the writer ended a stream when err is the io.EOF a send gets then,
+// the status the writer ended it with only comes from receiving
+func streamError(err error, received <-chan error) error {
+	if !errors.Is(err, io.EOF) {
+		return err
+	}
+	if recvErr := <-received; recvErr != nil {
+		return recvErr
+	}
+	return err
+}
+
 // ProcessStream is the main entry point for processing files
 func processStream(ctx context.Context, client pb.BackupServiceClient, fileList []files.FileInfo, streamID int32) error {
 
@@ -21,44 +110,54 @@ func processStream(ctx context.Context, client pb.BackupServiceClient, fileList
 
 	conf := config.GetConfigFromContext(ctx)
 
-	// Create stream with configured timeout
-	timeout := time.Duration(conf.ConnectionTimeOutSec) * time.Second
-	streamCtx, cancel := context.WithTimeout(ctx, timeout)
+	// A stream carries file data for as long as it takes: ConnectionTimeOutSec limits connecting,
+	// a dead writer is found by the HeartbeatSec keepalive and the writer caps the stream duration
+	streamCtx, cancel := context.WithCancel(ctx)
 	streamCtx = context.WithValue(streamCtx, logging.ContextKey, logger)
 	streamCtx = context.WithValue(streamCtx, "streamId", streamID)
 	defer cancel()
+	// Large files that may be linked are hashed before the stream opens, without a checksum cache
+	// configured their checksums are only kept for the stream
+	cache := checksumCacheFromContext(ctx)
+	if cache == nil {
+		cache = chunker.NewChecksumCache()
+		streamCtx = withChecksumCache(streamCtx, cache)
+	}
+	if err := hashCandidates(streamCtx, cache, fileList); err != nil {
+		return err
+	}
+	budget := newInFlightBudget(conf.MaxInFlightBytes)
+	streamCtx = withInFlightBudget(streamCtx, budget)
 
 	stream, err := client.ProcessBackupStream(streamCtx)
 	if err != nil {
 		return fmt.Errorf("failed to create stream: %w", err)
 	}
+	if err := startStream(streamCtx, stream); err != nil {
+		return err
+	}
+
+	// Responses are read concurrently with sending, file data goes out as the writer asks for it
+	decisions := newDecisionQueue()
+	received := make(chan error, 1)
+	go func() {
+		err := receiveResponses(streamCtx, stream, decisions)
+		budget.close()
+		received <- err
+	}()
+
+	sent, err := sendFilesMetadata(streamCtx, stream, fileList)
+	if err != nil {
+		return fmt.Errorf("file processing failed: %w", streamError(err, received))
+	}
 
-	if err := sendFilesMetadata(streamCtx, stream, fileList); err != nil {
-		return fmt.Errorf("file processing failed: %w", err)
+	if err := sendNeededFiles(streamCtx, stream, fileList, decisions, sent); err != nil {
+		return fmt.Errorf("file transfer failed: %w", streamError(err, received))
 	}
 
 	if err := stream.CloseSend(); err != nil {
 		return fmt.Errorf("failed to close send: %w", err)
 	}
 
-	for {
-		response, err := stream.Recv()
-		// with responce details
-		if err == io.EOF {
-			logger.Debug("Server stopped responding")
-			break
-		}
-		if err != nil {
-			return fmt.Errorf("failed to receive response: %w", err)
-		}
-		if response.StreamId != streamID {
-			return fmt.Errorf("stream ID mismatch: expected %d, received %d", streamID, response.StreamId)
-		}
-		// Handle response
-		if err := handleResponse(streamCtx, stream, response); err != nil {
-			return fmt.Errorf("failed to handle response: %w", err)
-		}
-	}
-
-	return nil
+	return <-received
 }
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+
+	pb "github.com/alex-sviridov/miniprotector/api"
+	"github.com/alex-sviridov/miniprotector/common/config"
+	"github.com/alex-sviridov/miniprotector/common/files"
+	"google.golang.org/grpc"
+)
+
+// fakeClient hands out fake streams and fails to open the ones listed in failStreams.
+// The other methods of the client aren't implemented.
+type fakeClient struct {
+	pb.BackupServiceClient
+	mu          sync.Mutex
+	opened      int
+	failStreams map[int32]bool
+}
+
+func (fc *fakeClient) ProcessBackupStream(ctx context.Context, opts ...grpc.CallOption) (grpc.BidiStreamingClient[pb.FileRequest, pb.FileResponse], error) {
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+	fc.opened++
+	if fc.failStreams[ctx.Value("streamId").(int32)] {
+		return nil, errors.New("writer unavailable")
+	}
+	return newAnsweringStream(), nil
+}
+
+func TestProcessStreams(t *testing.T) {
+	streams := [][]files.FileInfo{
+		{{Host: "host", Path: "/data/a"}},
+		{},
+		{{Host: "host", Path: "/data/b"}},
+		{{Host: "host", Path: "/data/c"}},
+	}
+	ctx := newTestContext(&config.Config{ConnectionTimeOutSec: 5})
+
+	client := &fakeClient{failStreams: map[int32]bool{3: true}}
+	results := processStreams(ctx, client, streams)
+	if len(results) != 3 {
+		t.Fatalf("Expected 3 streams started, empty one skipped, got %d", len(results))
+	}
+	for i, wantID := range []int32{1, 3, 4} {
+		if results[i].streamID != wantID || results[i].files != 1 {
+			t.Errorf("Result %d = %+v, expected stream %d with 1 file", i, results[i], wantID)
+		}
+		if failed := results[i].err != nil; failed != (wantID == 3) {
+			t.Errorf("Stream %d error = %v", wantID, results[i].err)
+		}
+	}
+	if status, failed := classifyStreams(results); status != runPartial || failed != 1 {
+		t.Errorf("Run classified as %v with %d failed, expected partial with 1", status, failed)
+	}
+	if client.opened != 3 {
+		t.Errorf("Expected 3 streams opened, got %d", client.opened)
+	}
+}
+
+func TestClassifyStreams(t *testing.T) {
+	failure := errors.New("stream failed")
+	tests := []struct {
+		name       string
+		errs       []error
+		wantStatus runStatus
+		wantFailed int
+	}{
+		{"no streams", nil, runSucceeded, 0},
+		{"all completed", []error{nil, nil}, runSucceeded, 0},
+		{"mixed", []error{nil, failure, nil, failure}, runPartial, 2},
+		{"all failed", []error{failure, failure, failure}, runFailed, 3},
+	}
+	for _, tt := range tests {
+		var results []streamResult
+		for i, err := range tt.errs {
+			results = append(results, streamResult{streamID: int32(i + 1), files: 1, err: err})
+		}
+		status, failed := classifyStreams(results)
+		if status != tt.wantStatus || failed != tt.wantFailed {
+			t.Errorf("%s: got status %v with %d failed, expected %v with %d", tt.name, status, failed, tt.wantStatus, tt.wantFailed)
+		}
+	}
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/alex-sviridov/miniprotector/common"
+	"github.com/alex-sviridov/miniprotector/common/config"
+	"github.com/alex-sviridov/miniprotector/common/logging"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/connectivity"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/keepalive"
+)
+
+// createConnectionWithRetry connects to the writer and waits until the connection is ready,
+// including the TLS handshake when configured. Failed attempts are retried with exponential backoff,
+// each attempt limited to ConnectionTimeOutSec.
+func createConnectionWithRetry(ctx context.Context, conf *config.Config, target string, creds credentials.TransportCredentials, maxAttempts int, baseDelay time.Duration) (*grpc.ClientConn, error) {
+	logger := logging.GetLoggerFromContext(ctx)
+
+	var conn *grpc.ClientConn
+	err := common.Retry(ctx, maxAttempts, baseDelay, func(ctx context.Context, attempt int) error {
+		var err error
+		conn, err = connectOnce(ctx, conf, target, creds)
+		if err != nil {
+			logger.Warn("Connection attempt failed", "target", target, "attempt", attempt, "error", err)
+		}
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to %s: %w", target, err)
+	}
+	return conn, nil
+}
+
+// connectOnce makes a single connection attempt and returns a ready connection
+func connectOnce(ctx context.Context, conf *config.Config, target string, creds credentials.TransportCredentials) (*grpc.ClientConn, error) {
+	if conf.ConnectionTimeOutSec > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, time.Duration(conf.ConnectionTimeOutSec)*time.Second)
+		defer cancel()
+	}
+
+	// Remember why the last dial failed, the connection state alone doesn't say
+	var (
+		mu      sync.Mutex
+		dialErr error
+	)
+	dialer := func(ctx context.Context, addr string) (net.Conn, error) {
+		c, err := (&net.Dialer{}).DialContext(ctx, "tcp", addr)
+		mu.Lock()
+		dialErr = err
+		mu.Unlock()
+		return c, err
+	}
+
+	options := []grpc.DialOption{grpc.WithTransportCredentials(creds), grpc.WithContextDialer(dialer)}
+	// Ping a writer idle for HeartbeatSec so NATs and firewalls keep the connection, and fail the
+	// streams of one that doesn't answer within as long again rather than waiting on it forever
+	if conf.HeartbeatSec > 0 {
+		heartbeat := time.Duration(conf.HeartbeatSec) * time.Second
+		options = append(options, grpc.WithKeepaliveParams(keepalive.ClientParameters{Time: heartbeat, Timeout: heartbeat, PermitWithoutStream: true}))
+	}
+	conn, err := grpc.NewClient(target, options...)
+	if err != nil {
+		return nil, err
+	}
+
+	conn.Connect()
+	for {
+		state := conn.GetState()
+		switch state {
+		case connectivity.Ready:
+			return conn, nil
+		case connectivity.TransientFailure, connectivity.Shutdown:
+			conn.Close()
+			mu.Lock()
+			defer mu.Unlock()
+			if dialErr != nil {
+				return nil, dialErr
+			}
+			return nil, fmt.Errorf("connection failed (%s)", state)
+		}
+		if !conn.WaitForStateChange(ctx, state) {
+			conn.Close()
+			return nil, fmt.Errorf("connection not ready: %w", ctx.Err())
+		}
+	}
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"log/slog"
+	"net"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/alex-sviridov/miniprotector/common/config"
+	"github.com/alex-sviridov/miniprotector/common/logging"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+)
+
+// refusingListener drops the first refuse accepted connections before passing any on
+type refusingListener struct {
+	net.Listener
+	refuse   int32
+	accepted atomic.Int32
+}
+
+func (l *refusingListener) Accept() (net.Conn, error) {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+		if l.accepted.Add(1) <= l.refuse {
+			conn.Close()
+			continue
+		}
+		return conn, nil
+	}
+}
+
+// startRefusingServer serves gRPC on localhost after refusing the first refuse connections
+func startRefusingServer(t *testing.T, refuse int32) (string, *refusingListener) {
+	t.Helper()
+	tcpListener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	listener := &refusingListener{Listener: tcpListener, refuse: refuse}
+
+	grpcServer := grpc.NewServer()
+	go grpcServer.Serve(listener)
+	t.Cleanup(grpcServer.Stop)
+	return tcpListener.Addr().String(), listener
+}
+
+func TestCreateConnectionWithRetry(t *testing.T) {
+	addr, listener := startRefusingServer(t, 2)
+	ctx := newTestContext(&config.Config{ConnectionTimeOutSec: 5})
+
+	conn, err := createConnectionWithRetry(ctx, config.GetConfigFromContext(ctx), addr, insecure.NewCredentials(), 5, 10*time.Millisecond)
+	if err != nil {
+		t.Fatalf("Expected connection after retries, got %v", err)
+	}
+	defer conn.Close()
+
+	if accepted := listener.accepted.Load(); accepted != 3 {
+		t.Errorf("Expected 3 connection attempts, server saw %d", accepted)
+	}
+}
+
+func TestCreateConnectionWithRetryGivesUp(t *testing.T) {
+	addr, listener := startRefusingServer(t, 100)
+	ctx := newTestContext(&config.Config{ConnectionTimeOutSec: 5})
+
+	_, err := createConnectionWithRetry(ctx, config.GetConfigFromContext(ctx), addr, insecure.NewCredentials(), 3, 10*time.Millisecond)
+	if err == nil {
+		t.Fatal("Expected error when every connection is refused")
+	}
+	if !strings.Contains(err.Error(), "3 attempts") || !strings.Contains(err.Error(), addr) {
+		t.Errorf("Expected error naming the target and attempt count, got %v", err)
+	}
+	if accepted := listener.accepted.Load(); accepted != 3 {
+		t.Errorf("Expected 3 connection attempts, server saw %d", accepted)
+	}
+}
+
+func TestCreateConnectionWithRetryCancelled(t *testing.T) {
+	addr, _ := startRefusingServer(t, 100)
+	ctx, cancel := context.WithCancel(newTestContext(&config.Config{ConnectionTimeOutSec: 5}))
+	time.AfterFunc(50*time.Millisecond, cancel)
+
+	start := time.Now()
+	_, err := createConnectionWithRetry(ctx, config.GetConfigFromContext(ctx), addr, insecure.NewCredentials(), 10, time.Second)
+	if err == nil || !strings.Contains(err.Error(), "context canceled") {
+		t.Errorf("Expected cancellation error, got %v", err)
+	}
+	if time.Since(start) > 2*time.Second {
+		t.Error("Retry kept going after cancellation")
+	}
+}
+
+func TestCreateConnectionClosedPort(t *testing.T) {
+	// Take a free port and close it, nothing listens there
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	addr := listener.Addr().String()
+	listener.Close()
+
+	var logs bytes.Buffer
+	conf := &config.Config{ConnectionTimeOutSec: 5}
+	ctx := context.WithValue(newTestContext(conf), logging.ContextKey, slog.New(slog.NewTextHandler(&logs, nil)))
+
+	start := time.Now()
+	_, err = createConnectionWithRetry(ctx, conf, addr, insecure.NewCredentials(), 3, 20*time.Millisecond)
+	if err == nil {
+		t.Fatal("Expected error connecting to a closed port")
+	}
+	if !strings.Contains(err.Error(), addr) || !strings.Contains(err.Error(), "3 attempts") || !strings.Contains(err.Error(), "connection refused") {
+		t.Errorf("Expected error naming the target, attempts and cause, got %v", err)
+	}
+	if attempts := strings.Count(logs.String(), "Connection attempt failed"); attempts != 3 {
+		t.Errorf("Logged %d failed attempts, expected 3", attempts)
+	}
+	// Two backoff waits of at least 20ms and 40ms, and no waiting for the connection timeout
+	if elapsed := time.Since(start); elapsed < 60*time.Millisecond || elapsed > 3*time.Second {
+		t.Errorf("Connection attempts took %v", elapsed)
+	}
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"context"
+	"sync"
+
+	pb "github.com/alex-sviridov/miniprotector/api"
+	"github.com/alex-sviridov/miniprotector/common/chunker"
+	"github.com/alex-sviridov/miniprotector/common/config"
+	"github.com/alex-sviridov/miniprotector/common/files"
+	"github.com/alex-sviridov/miniprotector/common/logging"
+)
+
+// sentContent is a file whose data was sent and whose result hasn't arrived yet
+type sentContent struct {
+	streamID int32
+	checksum string
+	path     string
+}
+
+// runDedup finds files of this run with the same content as a file already sent,
+// so that they are recorded as links to it instead of sending the data again.
+// Only regular files sharing their size with another file of the run are hashed before sending.
+// A file stored by the writer can be linked from any stream; one only sent so far can be linked
+// from its own stream, where the writer handles it first. A nil *runDedup does nothing.
+type runDedup struct {
+	sizes map[int64]int // Number of non-empty regular files of each size in the run
+
+	mu      sync.Mutex
+	stored  map[string]string      // Path of the first stored file, by checksum
+	pending map[string]sentContent // Files sent and not answered yet, by file id
+}
+
+type dedupContextKey struct{}
+
+// withDedup returns a context carrying d for the stream functions
+func withDedup(ctx context.Context, d *runDedup) context.Context {
+	return context.WithValue(ctx, dedupContextKey{}, d)
+}
+
+// dedupFromContext returns the run dedup in ctx, nil if there is none
+func dedupFromContext(ctx context.Context) *runDedup {
+	d, _ := ctx.Value(dedupContextKey{}).(*runDedup)
+	return d
+}
+
+// newRunDedup prepares deduplication of the files of one run
+func newRunDedup(items []files.FileInfo) *runDedup {
+	d := &runDedup{
+		sizes:   make(map[int64]int),
+		stored:  make(map[string]string),
+		pending: make(map[string]sentContent),
+	}
+	for _, item := range items {
+		if item.Mode.IsRegular() && item.Size > 0 {
+			d.sizes[item.Size]++
+		}
+	}
+	return d
+}
+
+// candidate tells whether a file may have the same content as another one of the run
+func (d *runDedup) candidate(file *files.FileInfo) bool {
+	return d != nil && file.Mode.IsRegular() && file.Size > 0 && d.sizes[file.Size] > 1
+}
+
+// sameAs returns the path of a file with this checksum that streamID can link to, empty if there is none
+func (d *runDedup) sameAs(streamID int32, checksum string) string {
+	if d == nil {
+		return ""
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if path, ok := d.stored[checksum]; ok {
+		return path
+	}
+	for _, sent := range d.pending {
+		if sent.streamID == streamID && sent.checksum == checksum {
+			return sent.path
+		}
+	}
+	return ""
+}
+
+// sent remembers the content of a file whose data was sent
+func (d *runDedup) sent(streamID int32, fileID, checksum, path string) {
+	if d == nil || checksum == "" {
+		return
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.pending[fileID] = sentContent{streamID: streamID, checksum: checksum, path: path}
+}
+
+// result makes a sent file available to every stream once the writer stored it
+func (d *runDedup) result(fileID string, success bool) {
+	if d == nil {
+		return
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	sent, ok := d.pending[fileID]
+	if !ok {
+		return
+	}
+	delete(d.pending, fileID)
+	if _, exists := d.stored[sent.checksum]; success && !exists {
+		d.stored[sent.checksum] = sent.path
+	}
+}
+
+// storedContent asks the writer whether it already stores the content of a file, backed up from
+// this host or another one, so that the file is recorded without sending its data again.
+// Every non-empty regular file is hashed before sending. A nil *storedContent asks nothing.
+type storedContent struct {
+	client pb.BackupServiceClient
+}
+
+type storedContentContextKey struct{}
+
+// withStoredContent returns a context carrying s for the stream functions
+func withStoredContent(ctx context.Context, s *storedContent) context.Context {
+	return context.WithValue(ctx, storedContentContextKey{}, s)
+}
+
+// storedContentFromContext returns the stored content lookup in ctx, nil if there is none
+func storedContentFromContext(ctx context.Context) *storedContent {
+	s, _ := ctx.Value(storedContentContextKey{}).(*storedContent)
+	return s
+}
+
+// candidate tells whether the writer is asked about the content of a file
+func (s *storedContent) candidate(file *files.FileInfo) bool {
+	return s != nil && file.Mode.IsRegular() && file.Size > 0
+}
+
+// known tells whether the writer stores content with this checksum and size.
+// A failed query, from a writer without HasContent for example, counts as unknown content.
+func (s *storedContent) known(ctx context.Context, checksum string, size int64) bool {
+	if s == nil {
+		return false
+	}
+	answer, err := s.client.HasContent(ctx, &pb.ContentQuery{Checksum: checksum, Size: size})
+	if err != nil {
+		logging.GetLoggerFromContext(ctx).Debug("Failed to ask the writer for stored content", "error", err)
+		return false
+	}
+	return answer.Known
+}
+
+type checksumCacheContextKey struct{}
+
+// withChecksumCache returns a context carrying the checksums kept between runs for the stream functions
+func withChecksumCache(ctx context.Context, c *chunker.ChecksumCache) context.Context {
+	return context.WithValue(ctx, checksumCacheContextKey{}, c)
+}
+
+// checksumCacheFromContext returns the checksum cache in ctx, nil if there is none
+func checksumCacheFromContext(ctx context.Context) *chunker.ChecksumCache {
+	c, _ := ctx.Value(checksumCacheContextKey{}).(*chunker.ChecksumCache)
+	return c
+}
+
+// fileChecksum hashes an open file for hashCandidates, replaceable in tests
+var fileChecksum = chunker.FileChecksum
+
+// hashCandidates hashes the files of a stream that linkToSent doesn't read whole and that may be
+// copies of other files of the run or of content the writer stores, before the stream opens: the
+// writer closes a stream without a message for StreamIdleTimeoutSec, and hashing a large file can
+// take longer. Each checksum goes to cache with the metadata the file had when hashed, files that
+// can't be read are left to the transfer.
+func hashCandidates(ctx context.Context, cache *chunker.ChecksumCache, fileList []files.FileInfo) error {
+	dedup := dedupFromContext(ctx)
+	stored := storedContentFromContext(ctx)
+	algo := config.GetConfigFromContext(ctx).HashAlgo
+	for i := range fileList {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		file := &fileList[i]
+		if readWhole(file) || (!dedup.candidate(file) && !stored.candidate(file)) {
+			continue
+		}
+		if _, ok := cache.Lookup(file, algo); ok {
+			continue
+		}
+		f, err := openScanned(file)
+		if err != nil {
+			continue
+		}
+		current, err := files.StatFile(f)
+		var checksum string
+		if err == nil {
+			checksum, err = fileChecksum(f, algo)
+		}
+		f.Close()
+		if err == nil {
+			cache.Store(&current, checksum)
+		}
+	}
+	return nil
+}
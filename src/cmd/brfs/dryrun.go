@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	pb "github.com/alex-sviridov/miniprotector/api"
+	"github.com/alex-sviridov/miniprotector/common/files"
+	"github.com/alex-sviridov/miniprotector/common/logging"
+)
+
+// Actions the writer answers to PreviewFiles
+const (
+	previewNew       = "new"
+	previewChanged   = "changed"
+	previewMetadata  = "metadata"
+	previewUnchanged = "unchanged"
+)
+
+// previewBatchSize is the number of files asked about at once, the writer's FileBatch limit
+const previewBatchSize = 1000
+
+// dryRunSummary is what backing up the scanned files would do
+type dryRunSummary struct {
+	newFiles, changed, metadataOnly, unchanged int
+	bytesToSend                                int64 // Size of the regular files whose data would be sent, before compression
+}
+
+// wouldAdd is the number of files a backup would add a version of
+func (d dryRunSummary) wouldAdd() int {
+	return d.newFiles + d.changed
+}
+
+// previewRun asks the writer what backing up items would do. Nothing is sent beyond the metadata
+// and nothing is recorded, by the writer or locally.
+func previewRun(ctx context.Context, client pb.BackupServiceClient, items []files.FileInfo) (dryRunSummary, error) {
+	var summary dryRunSummary
+	for start := 0; start < len(items); start += previewBatchSize {
+		batch := items[start:min(start+previewBatchSize, len(items))]
+		req := &pb.FileBatch{Files: make([]*pb.FileInfo, len(batch))}
+		for i := range batch {
+			attr, err := encodeFileInfo(&batch[i])
+			if err != nil {
+				return summary, fmt.Errorf("failed to encode file info of %s: %w", batch[i].Path, err)
+			}
+			req.Files[i] = &pb.FileInfo{FileId: batch[i].GetId(), Attributes: attr}
+		}
+		preview, err := client.PreviewFiles(ctx, req)
+		if err != nil {
+			return summary, fmt.Errorf("failed to preview files: %w", err)
+		}
+		if len(preview.Actions) != len(batch) {
+			return summary, fmt.Errorf("writer answered %d actions for %d files", len(preview.Actions), len(batch))
+		}
+		for i, action := range preview.Actions {
+			switch action {
+			case previewNew:
+				summary.newFiles++
+			case previewChanged:
+				summary.changed++
+			case previewMetadata:
+				summary.metadataOnly++
+			default:
+				summary.unchanged++
+			}
+			if (action == previewNew || action == previewChanged) && batch[i].Mode.IsRegular() {
+				summary.bytesToSend += batch[i].Size
+			}
+		}
+	}
+	return summary, nil
+}
+
+// reportDryRun logs what the run would have done
+func reportDryRun(ctx context.Context, summary dryRunSummary) {
+	logging.GetLoggerFromContext(ctx).Info("Dry run report",
+		"would_add", summary.wouldAdd(),
+		"new", summary.newFiles,
+		"changed", summary.changed,
+		"metadata_only", summary.metadataOnly,
+		"unchanged", summary.unchanged,
+		"bytes_to_send", summary.bytesToSend)
+}
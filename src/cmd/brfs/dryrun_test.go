@@ -0,0 +1,50 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/alex-sviridov/miniprotector/common/config"
+	"github.com/alex-sviridov/miniprotector/common/files"
+)
+
+func TestPreviewRun(t *testing.T) {
+	root, contents := writeSourceTree(t)
+	fileList, _, err := files.Scan(root, files.ScanOptions{})
+	if err != nil {
+		t.Fatalf("Scan failed: %v", err)
+	}
+	existing := filepath.Join(root, "small.txt")
+	writer, client := startRecordingWriter(t)
+	writer.existing = map[string]bool{existing: true}
+	ctx := newTransferContext(&config.Config{ConnectionTimeOutSec: 10})
+
+	summary, err := previewRun(ctx, client, fileList)
+	if err != nil {
+		t.Fatalf("previewRun failed: %v", err)
+	}
+	if summary.newFiles != len(fileList)-1 || summary.unchanged != 1 || summary.changed != 0 || summary.metadataOnly != 0 {
+		t.Errorf("Summary %+v, expected every file but %s new", summary, existing)
+	}
+	var wantBytes int64
+	for path, data := range contents {
+		if path != existing {
+			wantBytes += int64(len(data))
+		}
+	}
+	if summary.bytesToSend != wantBytes {
+		t.Errorf("%d bytes to send, expected %d", summary.bytesToSend, wantBytes)
+	}
+	if len(writer.metadata) != 0 || len(writer.ends) != 0 {
+		t.Fatalf("Dry run sent %d files and %d ends on a backup stream", len(writer.metadata), len(writer.ends))
+	}
+
+	// The real run adds what the dry run announced
+	results := processStreams(ctx, client, [][]files.FileInfo{fileList})
+	if len(results) != 1 || results[0].err != nil {
+		t.Fatalf("Stream failed: %+v", results)
+	}
+	if totals := totalFiles(results); totals.stored != int64(summary.wouldAdd()) {
+		t.Errorf("Backup stored %d files, the dry run announced %d", totals.stored, summary.wouldAdd())
+	}
+}
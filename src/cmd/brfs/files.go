@@ -4,6 +4,7 @@ import (
 	"context"
 	"log/slog"
 	"os"
+	"time"
 
 	"github.com/gofrs/flock"
 
@@ -30,37 +31,101 @@ type FileOpenHandle struct {
 	Lock *flock.Flock
 }
 
-func sendFilesMetadata(ctx context.Context, stream pb.BackupService_ProcessBackupStreamClient, fileList []files.FileInfo) error {
+// encodeFileInfo serializes file metadata for sending, replaceable in tests
+var encodeFileInfo = files.Encode
+
+// sendFilesMetadata sends metadata of every file in the list.
+// With ClientHashQueryBatchSize above 1, files are sent in FileBatch messages of up to that many files,
+// answered together by the writer. Otherwise each file goes in its own FileInfo message.
+// A file that fails to encode or send aborts the stream when StopStreamOnFileError is set,
+// otherwise it is logged and skipped; a failed batch send skips all its files.
+// With RecordFileTimings set, the duration of each phase is logged per file at debug level.
+// Returns how many files were sent.
+func sendFilesMetadata(ctx context.Context, stream pb.BackupService_ProcessBackupStreamClient, fileList []files.FileInfo) (int, error) {
 	conf := config.GetConfigFromContext(ctx)
 	logger := logging.GetLoggerFromContext(ctx)
 	streamId := ctx.Value("streamId").(int32)
+	batchSize := max(conf.ClientHashQueryBatchSize, 1)
+
+	// Files encoded and waiting to be sent
+	type pendingFile struct {
+		path   string
+		info   *pb.FileInfo
+		timer  *phaseTimer
+		logger *slog.Logger
+	}
+	batch := make([]pendingFile, 0, batchSize)
+
+	sent := 0
+	flush := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+		request := &pb.FileRequest{StreamId: streamId} // Simple stream ID
+		if batchSize == 1 {
+			request.RequestType = &pb.FileRequest_FileInfo{FileInfo: batch[0].info}
+		} else {
+			infos := make([]*pb.FileInfo, len(batch))
+			for i, file := range batch {
+				infos[i] = file.info
+			}
+			request.RequestType = &pb.FileRequest_Batch{Batch: &pb.FileBatch{Files: infos}}
+		}
+
+		start := time.Now()
+		err := stream.Send(request)
+		sendDuration := time.Since(start)
+		flushed := batch
+		batch = batch[:0]
+		if err != nil {
+			for _, file := range flushed {
+				file.logger.Error("Failed to send filename", "filename", file.path, "error", err)
+			}
+			if conf.StopStreamOnFileError {
+				return err
+			}
+			return nil
+		}
+		sent += len(flushed)
+		for _, file := range flushed {
+			file.timer.record(phaseSend, sendDuration)
+			file.timer.log(file.logger, "File timings")
+		}
+		return nil
+	}
+
 	for _, file := range fileList {
-		attr, err := files.Encode(&file)
+		timer := newPhaseTimer(conf.RecordFileTimings)
+		timer.record(phaseStat, file.StatDuration())
+		attr, err := encodeFileInfo(&file)
+		timer.lap(phaseEncode)
 		if err != nil {
 			logger.Error("Failed to encode file info", "filename", file.Path, "error", err)
 			if conf.StopStreamOnFileError {
-				return err
+				return sent, err
 			}
 			continue
 		}
 		flogger := logger.With(slog.String("file_path", file.Path))
 		flogger.Info("Sending file metadata")
-		request := &pb.FileRequest{
-			StreamId: streamId, // Simple stream ID
-			RequestType: &pb.FileRequest_FileInfo{
-				FileInfo: &pb.FileInfo{
-					FileId:     file.GetId(),
-					Attributes: attr,
-				},
+		batch = append(batch, pendingFile{
+			path: file.Path,
+			info: &pb.FileInfo{
+				FileId:     file.GetId(),
+				Attributes: attr,
+				HashAlgo:   conf.HashAlgo,
 			},
-		}
-
-		if err := stream.Send(request); err != nil {
-			flogger.Error("Failed to send filename", "filename", file.Path, "error", err)
-			if conf.StopStreamOnFileError {
-				return err
+			timer:  timer,
+			logger: flogger,
+		})
+		if len(batch) == batchSize {
+			if err := flush(); err != nil {
+				return sent, err
 			}
 		}
 	}
-	return nil
+	if err := flush(); err != nil {
+		return sent, err
+	}
+	return sent, nil
 }
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"testing"
+
+	pb "github.com/alex-sviridov/miniprotector/api"
+	"github.com/alex-sviridov/miniprotector/common"
+	"github.com/alex-sviridov/miniprotector/common/config"
+	"github.com/alex-sviridov/miniprotector/common/files"
+	"github.com/alex-sviridov/miniprotector/common/logging"
+	"google.golang.org/grpc"
+)
+
+// fakeStream records sent requests and fails sends for selected file ids
+// Streams made by newAnsweringStream also reply that no file is needed, like a writer that has them all
+type fakeStream struct {
+	grpc.ClientStream
+	sent     []*pb.FileRequest
+	failSend map[string]bool
+	replies  chan *pb.FileResponse
+}
+
+func newAnsweringStream() *fakeStream {
+	return &fakeStream{replies: make(chan *pb.FileResponse, 64)}
+}
+
+func (fs *fakeStream) Send(req *pb.FileRequest) error {
+	if fs.failSend[req.GetFileInfo().GetFileId()] {
+		return errors.New("send failed")
+	}
+	fs.sent = append(fs.sent, req)
+	if fi := req.GetFileInfo(); fi != nil && fs.replies != nil {
+		fs.replies <- &pb.FileResponse{
+			StreamId: req.StreamId,
+			ResponseType: &pb.FileResponse_FileNeeded{
+				FileNeeded: &pb.FileNeeded{FileId: fi.FileId, Needed: false, Host: "host"},
+			},
+		}
+	}
+	return nil
+}
+
+func (fs *fakeStream) Recv() (*pb.FileResponse, error) {
+	if fs.replies == nil {
+		return nil, io.EOF
+	}
+	if response, ok := <-fs.replies; ok {
+		return response, nil
+	}
+	return nil, io.EOF
+}
+
+func (fs *fakeStream) CloseSend() error {
+	if fs.replies != nil {
+		close(fs.replies)
+	}
+	return nil
+}
+
+// newTestContext builds a stream context the way processStream does
+func newTestContext(conf *config.Config) context.Context {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	ctx := context.WithValue(context.Background(), config.ContextKey, conf)
+	ctx = context.WithValue(ctx, logging.ContextKey, logger)
+	ctx = context.WithValue(ctx, common.HostnameContextKey, "host")
+	return context.WithValue(ctx, "streamId", int32(1))
+}
+
+func testFileList() []files.FileInfo {
+	return []files.FileInfo{
+		{Host: "host", Path: "/data/a", Name: "a"},
+		{Host: "host", Path: "/data/bad", Name: "bad"},
+		{Host: "host", Path: "/data/c", Name: "c"},
+	}
+}
+
+// failEncodingFor makes encodeFileInfo fail for one path until the test ends
+func failEncodingFor(t *testing.T, path string) {
+	original := encodeFileInfo
+	encodeFileInfo = func(fileInfo *files.FileInfo) ([]byte, error) {
+		if fileInfo.Path == path {
+			return nil, errors.New("encode failed")
+		}
+		return original(fileInfo)
+	}
+	t.Cleanup(func() { encodeFileInfo = original })
+}
+
+func TestSendFilesMetadataEncodeError(t *testing.T) {
+	failEncodingFor(t, "/data/bad")
+
+	t.Run("continue when StopStreamOnFileError is off", func(t *testing.T) {
+		stream := &fakeStream{}
+		ctx := newTestContext(&config.Config{StopStreamOnFileError: false})
+
+		if _, err := sendFilesMetadata(ctx, stream, testFileList()); err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+		if len(stream.sent) != 2 {
+			t.Fatalf("Expected 2 files sent, got %d", len(stream.sent))
+		}
+		if stream.sent[1].GetFileInfo().GetFileId() != (files.FileInfo{Host: "host", Path: "/data/c"}).GetId() {
+			t.Errorf("Expected the file after the failed one to be sent")
+		}
+	})
+
+	t.Run("stop when StopStreamOnFileError is on", func(t *testing.T) {
+		stream := &fakeStream{}
+		ctx := newTestContext(&config.Config{StopStreamOnFileError: true})
+
+		if _, err := sendFilesMetadata(ctx, stream, testFileList()); err == nil {
+			t.Fatal("Expected encode error")
+		}
+		if len(stream.sent) != 1 {
+			t.Errorf("Expected only the first file sent, got %d", len(stream.sent))
+		}
+	})
+}
+
+func TestSendFilesMetadataSendError(t *testing.T) {
+	badId := (files.FileInfo{Host: "host", Path: "/data/bad"}).GetId()
+
+	t.Run("continue when StopStreamOnFileError is off", func(t *testing.T) {
+		stream := &fakeStream{failSend: map[string]bool{badId: true}}
+		ctx := newTestContext(&config.Config{StopStreamOnFileError: false})
+
+		if _, err := sendFilesMetadata(ctx, stream, testFileList()); err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+		if len(stream.sent) != 2 {
+			t.Errorf("Expected 2 files sent, got %d", len(stream.sent))
+		}
+	})
+
+	t.Run("stop when StopStreamOnFileError is on", func(t *testing.T) {
+		stream := &fakeStream{failSend: map[string]bool{badId: true}}
+		ctx := newTestContext(&config.Config{StopStreamOnFileError: true})
+
+		if _, err := sendFilesMetadata(ctx, stream, testFileList()); err == nil {
+			t.Fatal("Expected send error")
+		}
+		if len(stream.sent) != 1 {
+			t.Errorf("Expected only the first file sent, got %d", len(stream.sent))
+		}
+	})
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+
+	pb "github.com/alex-sviridov/miniprotector/api"
+	"github.com/alex-sviridov/miniprotector/common"
+	"github.com/alex-sviridov/miniprotector/common/files"
+)
+
+// Fields an incremental run compares, see config IncrementalFields
+const (
+	incrementalSize  = "size"
+	incrementalMtime = "mtime"
+	incrementalCtime = "ctime"
+)
+
+// unchangedSince tells whether a scanned file matches the version the writer has on every field compared
+func unchangedSince(file *files.FileInfo, stored *pb.BackedUpFile, fields []string) bool {
+	for _, field := range fields {
+		switch field {
+		case incrementalSize:
+			if file.Size != stored.Size {
+				return false
+			}
+		case incrementalMtime:
+			if file.ModTime.UnixNano() != stored.ModTimeUnixNs {
+				return false
+			}
+		case incrementalCtime:
+			if file.ChangeTime.UnixNano() != stored.ChangeTimeUnixNs {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// skipUnchanged asks the writer for the files this host backed up below root and returns the scanned
+// files that are new or changed since, comparing fields, with the number of those left out.
+// A file whose content is unchanged but whose ctime changed is still sent, the writer then only
+// updates its metadata.
+func skipUnchanged(ctx context.Context, client pb.BackupServiceClient, root string, items []files.FileInfo, fields []string) ([]files.FileInfo, int, error) {
+	stream, err := client.ListBackedUpFiles(ctx, &pb.BackedUpFilesRequest{
+		Host: ctx.Value(common.HostnameContextKey).(string),
+		Path: root,
+	})
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to list backed up files: %w", err)
+	}
+	stored := make(map[string]*pb.BackedUpFile)
+	for {
+		file, err := stream.Recv()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, 0, fmt.Errorf("failed to list backed up files: %w", err)
+		}
+		stored[file.Path] = file
+	}
+
+	var changed []files.FileInfo
+	for i := range items {
+		if previous, ok := stored[items[i].Path]; !ok || !unchangedSince(&items[i], previous, fields) {
+			changed = append(changed, items[i])
+		}
+	}
+	return changed, len(items) - len(changed), nil
+}
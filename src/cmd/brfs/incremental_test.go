@@ -0,0 +1,80 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/alex-sviridov/miniprotector/common/config"
+	"github.com/alex-sviridov/miniprotector/common/files"
+)
+
+func TestSkipUnchanged(t *testing.T) {
+	root, contents := writeSourceTree(t)
+	fileList, _, err := files.Scan(root, files.ScanOptions{})
+	if err != nil {
+		t.Fatalf("Scan failed: %v", err)
+	}
+	_, client := startRecordingWriter(t)
+	ctx := newTransferContext(&config.Config{ConnectionTimeOutSec: 10})
+	fields := []string{incrementalSize, incrementalMtime, incrementalCtime}
+
+	// Nothing is backed up yet: every file is sent
+	changed, unchanged, err := skipUnchanged(ctx, client, root, fileList, fields)
+	if err != nil {
+		t.Fatalf("skipUnchanged failed: %v", err)
+	}
+	if len(changed) != len(fileList) || unchanged != 0 {
+		t.Fatalf("Got %d changed and %d unchanged before the first backup, expected all %d changed", len(changed), unchanged, len(fileList))
+	}
+	if err := processStream(ctx, client, changed, 1); err != nil {
+		t.Fatalf("processStream failed: %v", err)
+	}
+
+	// One file gets new content, another only new permissions
+	modified := filepath.Join(root, "small.txt")
+	if err := os.WriteFile(modified, []byte("hello again"), 0600); err != nil {
+		t.Fatalf("Failed to write %s: %v", modified, err)
+	}
+	later := time.Now().Add(time.Hour)
+	if err := os.Chtimes(modified, later, later); err != nil {
+		t.Fatalf("Failed to set times of %s: %v", modified, err)
+	}
+	chmodded := filepath.Join(root, "empty")
+	// Let the clock move on so the ctime differs even on coarse timestamps
+	time.Sleep(20 * time.Millisecond)
+	if err := os.Chmod(chmodded, 0640); err != nil {
+		t.Fatalf("Failed to chmod %s: %v", chmodded, err)
+	}
+	fileList, _, err = files.Scan(root, files.ScanOptions{})
+	if err != nil {
+		t.Fatalf("Scan failed: %v", err)
+	}
+
+	changedFiles := func(fields []string) []string {
+		t.Helper()
+		changed, unchanged, err := skipUnchanged(ctx, client, root, fileList, fields)
+		if err != nil {
+			t.Fatalf("skipUnchanged failed: %v", err)
+		}
+		if unchanged+len(changed) != len(fileList) {
+			t.Errorf("%d changed and %d unchanged files, expected %d in total", len(changed), unchanged, len(fileList))
+		}
+		var paths []string
+		for _, file := range changed {
+			if _, ok := contents[file.Path]; ok {
+				paths = append(paths, file.Path)
+			}
+		}
+		sort.Strings(paths)
+		return paths
+	}
+	if got := changedFiles(fields); len(got) != 2 || got[0] != chmodded || got[1] != modified {
+		t.Errorf("Changed files = %v, expected %s and %s", got, chmodded, modified)
+	}
+	if got := changedFiles([]string{incrementalSize, incrementalMtime}); len(got) != 1 || got[0] != modified {
+		t.Errorf("Changed files without ctime = %v, expected only %s", got, modified)
+	}
+}
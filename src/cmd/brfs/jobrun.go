@@ -0,0 +1,55 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"time"
+
+	pb "github.com/alex-sviridov/miniprotector/api"
+	"github.com/alex-sviridov/miniprotector/common"
+	"github.com/alex-sviridov/miniprotector/common/config"
+	"github.com/alex-sviridov/miniprotector/common/logging"
+)
+
+// newJobID returns the id of one backup run: when it started, followed by a random suffix
+// so runs started in the same second stay apart
+func newJobID(started time.Time) (string, error) {
+	suffix := make([]byte, 4)
+	if _, err := rand.Read(suffix); err != nil {
+		return "", fmt.Errorf("failed to generate job id: %w", err)
+	}
+	return started.UTC().Format("20060102T150405Z") + "-" + hex.EncodeToString(suffix), nil
+}
+
+// newJobRun summarises a run from the results of its streams, unchanged files left out by an incremental run
+// counting as skipped
+func newJobRun(ctx context.Context, started time.Time, scanned, unchanged int, results []streamResult, interrupted bool) *pb.JobRun {
+	totals := totalFiles(results)
+	_, failedStreams := classifyStreams(results)
+	return &pb.JobRun{
+		JobId:          jobIDFromContext(ctx),
+		Host:           ctx.Value(common.HostnameContextKey).(string),
+		StartedUnixMs:  started.UnixMilli(),
+		FinishedUnixMs: time.Now().UnixMilli(),
+		FilesScanned:   int64(scanned),
+		FilesStored:    totals.stored,
+		FilesSkipped:   totals.skipped + int64(unchanged),
+		FilesFailed:    totals.failed,
+		BytesSent:      totals.bytesSent,
+		Errors:         totals.failed + int64(failedStreams),
+		Interrupted:    interrupted,
+	}
+}
+
+// recordJobRun sends the summary of the run to the writer. It is sent even when the run was
+// interrupted, within ConnectionTimeOutSec; a failure is only logged.
+func recordJobRun(ctx context.Context, client pb.BackupServiceClient, run *pb.JobRun) {
+	conf := config.GetConfigFromContext(ctx)
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), time.Duration(conf.ConnectionTimeOutSec)*time.Second)
+	defer cancel()
+	if _, err := client.RecordJobRun(ctx, run); err != nil {
+		logging.GetLoggerFromContext(ctx).Warn("Failed to record the job run on the writer", "error", err)
+	}
+}
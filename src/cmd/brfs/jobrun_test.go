@@ -0,0 +1,56 @@
+package main
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/alex-sviridov/miniprotector/common"
+	"github.com/alex-sviridov/miniprotector/common/config"
+	"github.com/alex-sviridov/miniprotector/common/files"
+)
+
+func TestRecordJobRun(t *testing.T) {
+	root, contents := writeSourceTree(t)
+	fileList, _, err := files.Scan(root, files.ScanOptions{})
+	if err != nil {
+		t.Fatalf("Scan failed: %v", err)
+	}
+	existing := filepath.Join(root, "small.txt")
+	writer, client := startRecordingWriter(t)
+	writer.existing = map[string]bool{existing: true}
+
+	started := time.Now()
+	ctx := newTransferContext(&config.Config{ConnectionTimeOutSec: 10})
+	ctx = context.WithValue(ctx, "jobId", "job-1")
+	results := processStreams(ctx, client, files.SplitByStreams(fileList, 2))
+	recordJobRun(ctx, client, newJobRun(ctx, started, len(fileList), 0, results, false))
+
+	if len(writer.jobRuns) != 1 {
+		t.Fatalf("Writer got %d job runs, expected 1", len(writer.jobRuns))
+	}
+	run := writer.jobRuns[0]
+	var bytes int64
+	for path, data := range contents {
+		if path != existing {
+			bytes += int64(len(data))
+		}
+	}
+	if run.JobId != "job-1" || run.Host != common.GetHostname() {
+		t.Errorf("Job run of %q from %q, expected job-1 from this host", run.JobId, run.Host)
+	}
+	if run.FilesScanned != int64(len(fileList)) || run.FilesStored != int64(len(fileList)-1) || run.FilesSkipped != 1 {
+		t.Errorf("Job run counts %d scanned, %d stored, %d skipped, expected %d, %d, 1",
+			run.FilesScanned, run.FilesStored, run.FilesSkipped, len(fileList), len(fileList)-1)
+	}
+	if run.FilesFailed != 0 || run.Errors != 0 || run.Interrupted {
+		t.Errorf("Job run has %d failed files and %d errors, interrupted %v", run.FilesFailed, run.Errors, run.Interrupted)
+	}
+	if run.BytesSent != bytes {
+		t.Errorf("Job run sent %d bytes, expected %d", run.BytesSent, bytes)
+	}
+	if run.StartedUnixMs != started.UnixMilli() || run.FinishedUnixMs < run.StartedUnixMs {
+		t.Errorf("Job run from %d to %d, expected to start at %d", run.StartedUnixMs, run.FinishedUnixMs, started.UnixMilli())
+	}
+}
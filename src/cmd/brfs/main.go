@@ -5,50 +5,91 @@ import (
 	"context"
 	"fmt"
 	"os"
+	"os/signal"
+	"runtime"
+	"syscall"
+	"time"
 
 	"github.com/alex-sviridov/miniprotector/common"
+	"github.com/alex-sviridov/miniprotector/common/chunker"
 	"github.com/alex-sviridov/miniprotector/common/config"
 	"github.com/alex-sviridov/miniprotector/common/files"
 	"github.com/alex-sviridov/miniprotector/common/logging"
 
-	"sync"
-
 	pb "github.com/alex-sviridov/miniprotector/api"
-	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
 	"google.golang.org/grpc/credentials/insecure"
 )
 
+// Exit codes
+const (
+	exitOK          = 0
+	exitError       = 1
+	exitInterrupted = 2 // Stopped by SIGINT or SIGTERM, the manifest lists what completed
+	exitPartial     = 3 // Some streams failed, the others completed
+)
+
+// shutdownGrace is how long streams get to stop after SIGINT or SIGTERM
+const shutdownGrace = 5 * time.Second
+
 // main goes
 func main() {
+	os.Exit(run())
+}
+
+// run performs the backup and returns the exit code
+func run() int {
 
 	// Configuration constants
 	const (
 		configPath = "../.config/local.conf"
 		appName    = "brfs"
-		jobId      = "BackupJob"
 	)
 
+	// Each run is a job of its own, recorded by the writer under this id
+	started := time.Now()
+	jobId, err := newJobID(started)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		return exitError
+	}
+
 	// Put context variables
 	ctx := context.WithValue(context.Background(), "appName", appName)
 	ctx = context.WithValue(ctx, "jobId", jobId)
 
 	// Get configuration
 	conf, err := config.ParseConfig(configPath)
+	if err == nil {
+		err = config.ApplyEnvOverrides(conf)
+	}
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "Configuration error: %v\n", err)
-		os.Exit(1)
+		return exitError
 	}
 	ctx = context.WithValue(ctx, config.ContextKey, conf)
 
 	// Get arguments
-	arguments, err := parseArguments(conf)
+	arguments, err := parseArguments(conf, os.Args[1:])
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "Arguments error: %v\n", err)
-		os.Exit(1)
+		return exitError
 	}
+
+	// Apply per-run overrides to a copy of the configuration
+	runConf := *conf
+	runConf.StopStreamOnFileError = arguments.StopStreamOnFileError
+	runConf.RecordFileTimings = arguments.RecordFileTimings
+	ctx = context.WithValue(ctx, config.ContextKey, &runConf)
 	ctx = context.WithValue(ctx, "debugMode", arguments.Debug)
 	ctx = context.WithValue(ctx, "quietMode", arguments.Quiet)
 	ctx = context.WithValue(ctx, common.HostnameContextKey, common.GetHostname())
+	resumeToken, err := newResumeToken()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		return exitError
+	}
+	ctx = withResumeToken(ctx, resumeToken)
 
 	// Initialize logger
 	logger, logfile, _ := logging.NewLogger(ctx) // Never fails
@@ -59,6 +100,10 @@ func main() {
 	}()
 	ctx = context.WithValue(ctx, logging.ContextKey, logger)
 
+	for _, key := range conf.UnknownKeys {
+		logger.Warn("Unknown configuration key ignored", "key", key, "config", configPath)
+	}
+
 	logger.Info("Backup reader started",
 		"sourceFolder", arguments.SourceFolder,
 		"writerHost", arguments.WriterHost,
@@ -66,22 +111,78 @@ func main() {
 		"streamsCount", arguments.Streams,
 	)
 
-	// Get files list
-	items, err := files.ListRecursive(arguments.SourceFolder)
-	logger.Info("Directory scanned", "filesCount", len(items))
+	// Keep the walk and reads from starving interactive workloads
+	if err := lowerPriority(conf.IOPriorityClass, conf.NiceLevel); err != nil {
+		logger.Warn("Running with normal priority", "error", err)
+	}
+
+	// SIGINT and SIGTERM stop the scan or the streams, once streams run the manifest is still written
+	ctx, stop := signal.NotifyContext(ctx, os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	// Mounts of SkipFSTypes are only known from the Linux mount table, without it they're backed up
+	if len(arguments.SkipFSTypes) > 0 && runtime.GOOS == "linux" {
+		if _, err := files.ReadMounts(); err != nil {
+			logger.Warn("Filesystem types not skipped", "fs_types", arguments.SkipFSTypes, "error", err)
+		}
+	}
+
+	// Get files list, unreadable files are skipped
+	items, scanErrors, err := files.ScanContext(ctx, arguments.SourceFolder, files.ScanOptions{
+		SkipErrors:     true,
+		Excludes:       arguments.Excludes,
+		Includes:       arguments.Includes,
+		SkipFSTypes:    arguments.SkipFSTypes,
+		RecordTimings:  arguments.RecordFileTimings,
+		ExcludeMarker:  conf.NoBackupMarker,
+		IgnoreFile:     conf.BackupIgnoreFile,
+		OneFileSystem:  arguments.OneFileSystem,
+		FollowSymlinks: conf.FollowSymlinks,
+		MaxDepth:       conf.MaxScanDepth,
+		Progress: func(scanned int, current string) {
+			logger.Info("Scanning source", "scanned", scanned, "current", current)
+		},
+	})
+	if ctx.Err() != nil {
+		logger.Warn("Backup interrupted while scanning", "scanned", len(items))
+		return exitInterrupted
+	}
 	if err != nil {
 		logger.Error("Error", "error", err)
-		return
+		return exitError
 	}
+	for _, scanErr := range scanErrors {
+		logger.Warn("Skipping unreadable file", "path", scanErr.Path, "error", scanErr.Err)
+	}
+	logger.Info("Directory scanned", "filesCount", len(items), "skippedCount", len(scanErrors))
 
-	// Split into streams
-	streams := files.SplitByStreams(items, arguments.Streams)
-	logger.Info("Splitted by streams", "streamsCount", arguments.Streams, "filesCount", len(streams[0]))
+	// Checksums of files unchanged since the previous run are reused, those of files gone are dropped
+	var checksumCache *chunker.ChecksumCache
+	if conf.ChecksumCacheFile != "" {
+		checksumCache, err = chunker.LoadChecksumCache(conf.ChecksumCacheFile)
+		if err != nil {
+			logger.Warn("Checksum cache not loaded, starting an empty one", "error", err)
+			checksumCache = chunker.NewChecksumCache()
+		}
+		checksumCache.Retain(items)
+	}
 
 	// Connect to server
-	conn, err := grpc.NewClient(fmt.Sprintf("%s:%d", arguments.WriterHost, arguments.WriterPort), grpc.WithTransportCredentials(insecure.NewCredentials()))
+	creds, err := transportCredentials(conf)
+	if err != nil {
+		logger.Error("TLS configuration error", "error", err)
+		return exitError
+	}
+	target := fmt.Sprintf("%s:%d", arguments.WriterHost, arguments.WriterPort)
+	retryDelay := time.Duration(conf.ConnectRetryDelayMs) * time.Millisecond
+	conn, err := createConnectionWithRetry(ctx, conf, target, creds, conf.ConnectAttempts, retryDelay)
+	if err != nil && ctx.Err() != nil {
+		logger.Warn("Backup interrupted while connecting", "target", target)
+		return exitInterrupted
+	}
 	if err != nil {
-		logger.Error("Failed to connect: %v", err)
+		logger.Error("Writer unreachable", "target", target, "attempts", conf.ConnectAttempts, "error", err)
+		return exitError
 	}
 	defer conn.Close()
 
@@ -90,32 +191,137 @@ func main() {
 
 	logger.Info("Connected to server.")
 
-	// Process files concurrently using multiple streams
-	var wg sync.WaitGroup
-	streamErrorChan := make(chan error, len(streams))
-
-	for i, stream := range streams {
-		if len(stream) > 0 {
-			wg.Add(1)
-			go func(ctx context.Context, client pb.BackupServiceClient, stream []files.FileInfo, streamID int32) {
-				defer wg.Done()
-				if err := processStream(ctx, client, stream, streamID); err != nil {
-					logger.Error("Stream failed", "streamID", streamID, "error", err)
-					streamErrorChan <- err
-				}
-			}(ctx, client, stream, int32(i+1))
+	// An incremental run leaves out the files unchanged since the writer's version
+	scanned, unchanged := len(items), 0
+	if arguments.Incremental {
+		changed, skipped, err := skipUnchanged(ctx, client, arguments.SourceFolder, items, conf.IncrementalFields)
+		if err != nil {
+			logger.Warn("Incremental run not possible, sending every file", "error", err)
+		} else {
+			items, unchanged = changed, skipped
+			logger.Info("Unchanged files skipped", "skippedCount", unchanged, "filesCount", len(items), "fields", conf.IncrementalFields)
+		}
+	}
+
+	// A dry run stops once the writer said what it would do
+	if arguments.DryRun {
+		summary, err := previewRun(ctx, client, items)
+		if err != nil && ctx.Err() != nil {
+			logger.Warn("Dry run interrupted")
+			return exitInterrupted
+		}
+		if err != nil {
+			logger.Error("Dry run failed", "error", err)
+			return exitError
+		}
+		summary.unchanged += unchanged
+		reportDryRun(ctx, summary)
+		return exitOK
+	}
+
+	// Split into streams
+	var streams [][]files.FileInfo
+	switch conf.SplitStrategy {
+	case "count":
+		streams = files.SplitByStreams(items, arguments.Streams)
+	case "stable":
+		streams = files.SplitByStreamsStable(items, arguments.Streams)
+	case "category":
+		streams = files.SplitByCategory(items, arguments.Streams, conf.ExtensionCategories)
+	default:
+		streams = files.SplitBySize(items, arguments.Streams)
+	}
+	logger.Info("Splitted by streams", "streamsCount", arguments.Streams, "filesCount", len(streams[0]))
+
+	// Report progress to the configured FIFO or socket, if any
+	var bytesTotal int64
+	for _, item := range items {
+		if item.Mode.IsRegular() {
+			bytesTotal += item.Size
 		}
 	}
+	progress := startProgress(arguments.ProgressOutput, progressInterval, int64(len(items)), bytesTotal)
+	ctx = withProgress(ctx, progress)
+
+	// Record what the writer settled, written out even when the run is interrupted
+	manifest, err := openManifest(arguments.ManifestFile, conf.ManifestFsync)
+	if err != nil {
+		logger.Error("Manifest error", "error", err)
+		return exitError
+	}
+	ctx = withManifest(ctx, manifest)
+	if conf.DedupWithinRun {
+		ctx = withDedup(ctx, newRunDedup(items))
+	}
+	if conf.DedupAcrossHosts {
+		ctx = withStoredContent(ctx, &storedContent{client: client})
+	}
+	ctx = withChecksumCache(ctx, checksumCache)
+
+	// Process files concurrently using multiple streams
+	results, interrupted := runStreams(ctx, client, streams, shutdownGrace)
+	progress.finish()
+	if err := manifest.close(len(items), interrupted); err != nil {
+		logger.Error("Failed to write manifest", "error", err)
+	}
+	if err := checksumCache.Save(conf.ChecksumCacheFile); err != nil {
+		logger.Warn("Failed to save checksum cache", "path", conf.ChecksumCacheFile, "error", err)
+	}
+	reportFiles(ctx, results)
+	recordJobRun(ctx, client, newJobRun(ctx, started, scanned, unchanged, results, interrupted))
+
+	if interrupted {
+		logger.Warn("Backup interrupted", "manifest", arguments.ManifestFile)
+		return exitInterrupted
+	}
+	switch status, failed := classifyStreams(results); status {
+	case runFailed:
+		logger.Error("All streams failed", "streams", len(results))
+		return exitError
+	case runPartial:
+		logger.Error("Some streams failed", "failed", failed, "streams", len(results))
+		return exitPartial
+	default:
+		logger.Info("All streams completed successfully", "streams", len(results))
+		return exitOK
+	}
+}
+
+// runStreams runs processStreams until it returns or ctx is cancelled.
+// After cancellation the streams get grace to stop, those still running are abandoned and no results are returned.
+// interrupted tells whether ctx was cancelled before all streams completed.
+func runStreams(ctx context.Context, client pb.BackupServiceClient, streams [][]files.FileInfo, grace time.Duration) (results []streamResult, interrupted bool) {
+	logger := logging.GetLoggerFromContext(ctx)
+
+	done := make(chan []streamResult, 1)
+	go func() {
+		done <- processStreams(ctx, client, streams)
+	}()
+
+	select {
+	case results := <-done:
+		return results, ctx.Err() != nil
+	case <-ctx.Done():
+	}
 
-	// Wait for all streams to complete
-	wg.Wait()
-	close(streamErrorChan)
+	logger.Warn("Stopping streams", "reason", context.Cause(ctx), "grace", grace)
+	select {
+	case results := <-done:
+		return results, true
+	case <-time.After(grace):
+		logger.Error("Streams did not stop in time, abandoning them")
+		return nil, true
+	}
+}
 
-	if len(streamErrorChan) == len(streams) {
-		logger.Error("All streams failed")
-	} else if len(streamErrorChan) > 0 {
-		logger.Error("Some streams failed")
-	} else {
-		logger.Info("All streams completed successfully")
+// transportCredentials returns TLS credentials when the config provides a CA, plaintext otherwise
+func transportCredentials(conf *config.Config) (credentials.TransportCredentials, error) {
+	tlsConfig, err := common.ClientTLSConfig(conf)
+	if err != nil {
+		return nil, err
+	}
+	if tlsConfig == nil {
+		return insecure.NewCredentials(), nil
 	}
+	return credentials.NewTLS(tlsConfig), nil
 }
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/alex-sviridov/miniprotector/common/files"
+)
+
+// Manifest entry statuses
+const (
+	manifestStored    = "stored"    // Data sent and confirmed by the writer
+	manifestUnchanged = "unchanged" // Writer already had the file
+	manifestFailed    = "failed"    // Writer reported an error storing the file
+)
+
+// manifestEntry is one line of the manifest, written once the writer settled a file
+type manifestEntry struct {
+	Type     string `json:"type"` // Always "file"
+	Path     string `json:"path"`
+	Status   string `json:"status"`
+	Size     int64  `json:"size,omitempty"`
+	Checksum string `json:"checksum,omitempty"`
+	Error    string `json:"error,omitempty"`
+}
+
+// Manifest fsync policies, see config ManifestFsync
+const (
+	manifestSyncEntry = "entry" // Every entry is synced as it is written
+	manifestSyncBatch = "batch" // Entries are synced every manifestBatchSize entries
+	manifestSyncNone  = "none"  // Entries reach the file at close
+)
+
+// manifestBatchSize is the number of entries between syncs with the batch policy
+const manifestBatchSize = 100
+
+// manifestSummary is the last line of the manifest
+type manifestSummary struct {
+	Type        string    `json:"type"` // Always "summary"
+	Started     time.Time `json:"started"`
+	Finished    time.Time `json:"finished"`
+	FilesTotal  int       `json:"files_total"`
+	Stored      int       `json:"stored"`
+	Unchanged   int       `json:"unchanged"`
+	Failed      int       `json:"failed"`
+	Incomplete  int       `json:"incomplete"` // Sent but not confirmed by the writer
+	Interrupted bool      `json:"interrupted"`
+}
+
+// manifest records, as JSON lines, every file the writer settled during the run,
+// followed by a summary written by close, so a partial run shows what completed.
+// The fsync policy decides how many entries a crash can lose, close always syncs.
+// A nil *manifest does nothing.
+type manifest struct {
+	mu       sync.Mutex
+	file     *os.File
+	out      *bufio.Writer
+	fsync    string
+	unsynced int // Entries written since the last sync
+	started  time.Time
+	sent     map[string]manifestEntry // Files whose data was sent, by file id, until the writer answers
+	summary  manifestSummary
+	closed   bool
+	writeErr error // First write error, later entries are dropped
+}
+
+type manifestContextKey struct{}
+
+// withManifest returns a context carrying m for the stream functions
+func withManifest(ctx context.Context, m *manifest) context.Context {
+	return context.WithValue(ctx, manifestContextKey{}, m)
+}
+
+// manifestFromContext returns the manifest in ctx, nil if there is none
+func manifestFromContext(ctx context.Context) *manifest {
+	m, _ := ctx.Value(manifestContextKey{}).(*manifest)
+	return m
+}
+
+// openManifest creates or truncates the manifest file at path, syncing entries as fsync says
+// Returns nil when path is empty
+func openManifest(path, fsync string) (*manifest, error) {
+	if path == "" {
+		return nil, nil
+	}
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open manifest: %w", err)
+	}
+	return &manifest{
+		file:    file,
+		out:     bufio.NewWriter(file),
+		fsync:   fsync,
+		started: time.Now(),
+		sent:    make(map[string]manifestEntry),
+	}, nil
+}
+
+// unchanged records a file the writer didn't need
+func (m *manifest) unchanged(file *files.FileInfo) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.summary.Unchanged++
+	m.write(manifestEntry{Path: file.Path, Status: manifestUnchanged, Size: file.Size})
+}
+
+// dataSent remembers a file whose data was sent, it is recorded when the writer's result arrives
+func (m *manifest) dataSent(file *files.FileInfo, size int64, checksum string) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.sent[file.GetId()] = manifestEntry{Path: file.Path, Size: size, Checksum: checksum}
+}
+
+// result records the writer's result for a file whose data was sent
+func (m *manifest) result(fileID string, success bool, message string) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	entry, ok := m.sent[fileID]
+	if !ok {
+		return
+	}
+	delete(m.sent, fileID)
+	if success {
+		entry.Status = manifestStored
+		m.summary.Stored++
+	} else {
+		entry.Status = manifestFailed
+		entry.Error = message
+		m.summary.Failed++
+	}
+	m.write(entry)
+}
+
+// write appends an entry, the caller holds mu
+func (m *manifest) write(entry manifestEntry) {
+	if m.closed || m.writeErr != nil {
+		return
+	}
+	entry.Type = "file"
+	m.writeLine(entry)
+
+	m.unsynced++
+	if m.fsync == manifestSyncEntry || m.fsync == manifestSyncBatch && m.unsynced >= manifestBatchSize {
+		m.sync()
+	}
+}
+
+// sync flushes the written entries and syncs them to disk, the caller holds mu
+func (m *manifest) sync() {
+	err := m.out.Flush()
+	if err == nil {
+		err = m.file.Sync()
+	}
+	if err != nil && m.writeErr == nil {
+		m.writeErr = err
+	}
+	m.unsynced = 0
+}
+
+// writeLine encodes v as one JSON line, the caller holds mu
+func (m *manifest) writeLine(v any) {
+	line, err := json.Marshal(v)
+	if err == nil {
+		_, err = m.out.Write(append(line, '\n'))
+	}
+	if err != nil && m.writeErr == nil {
+		m.writeErr = err
+	}
+}
+
+// close writes the summary, flushes the manifest to disk and closes it.
+// Later calls to the other methods are ignored, so streams still running don't write past the summary.
+func (m *manifest) close(filesTotal int, interrupted bool) error {
+	if m == nil {
+		return nil
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.closed {
+		return nil
+	}
+	m.closed = true
+
+	summary := m.summary
+	summary.Type = "summary"
+	summary.Started = m.started
+	summary.Finished = time.Now()
+	summary.FilesTotal = filesTotal
+	summary.Incomplete = len(m.sent)
+	summary.Interrupted = interrupted
+	m.writeLine(summary)
+
+	err := m.writeErr
+	if flushErr := m.out.Flush(); err == nil {
+		err = flushErr
+	}
+	if syncErr := m.file.Sync(); err == nil {
+		err = syncErr
+	}
+	if closeErr := m.file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("failed to write manifest: %w", err)
+	}
+	return nil
+}
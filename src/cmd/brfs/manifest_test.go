@@ -0,0 +1,193 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/alex-sviridov/miniprotector/common/config"
+	"github.com/alex-sviridov/miniprotector/common/files"
+)
+
+// readManifest returns the file entries of a manifest by path, and its summary
+func readManifest(t *testing.T, path string) (map[string]manifestEntry, manifestSummary) {
+	t.Helper()
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatalf("Failed to open manifest: %v", err)
+	}
+	defer f.Close()
+
+	entries := make(map[string]manifestEntry)
+	var summary manifestSummary
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if summary.Type != "" {
+			t.Fatalf("Line after the summary: %s", scanner.Text())
+		}
+		var entry manifestEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			t.Fatalf("Invalid manifest line %q: %v", scanner.Text(), err)
+		}
+		switch entry.Type {
+		case "file":
+			entries[entry.Path] = entry
+		case "summary":
+			if err := json.Unmarshal(scanner.Bytes(), &summary); err != nil {
+				t.Fatalf("Invalid summary %q: %v", scanner.Text(), err)
+			}
+		default:
+			t.Fatalf("Unknown manifest line %q", scanner.Text())
+		}
+	}
+	if summary.Type == "" {
+		t.Fatal("Manifest has no summary")
+	}
+	return entries, summary
+}
+
+func TestInterruptedRunFlushesManifest(t *testing.T) {
+	root, _ := writeSourceTree(t)
+	fileList, _, err := files.Scan(root, files.ScanOptions{})
+	if err != nil {
+		t.Fatalf("Scan failed: %v", err)
+	}
+	path := filepath.Join(t.TempDir(), "backup.manifest")
+	manifest, err := openManifest(path, manifestSyncNone)
+	if err != nil {
+		t.Fatalf("Failed to open manifest: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(newTransferContext(&config.Config{ConnectionTimeOutSec: 10}))
+	defer cancel()
+	ctx = withManifest(ctx, manifest)
+
+	// The first file is already backed up. When the last one ends, the signal arrives
+	// once every earlier file was settled, and the writer never answers.
+	writer, client := startRecordingWriter(t)
+	writer.existing = map[string]bool{fileList[0].Path: true}
+	last := fileList[len(fileList)-1]
+	writer.onFileEnd = func(fileID string) {
+		if fileID != last.GetId() {
+			return
+		}
+		deadline := time.Now().Add(5 * time.Second)
+		for time.Now().Before(deadline) {
+			manifest.mu.Lock()
+			settled := manifest.summary.Stored + manifest.summary.Unchanged
+			manifest.mu.Unlock()
+			if settled == len(fileList)-1 {
+				break
+			}
+			time.Sleep(time.Millisecond)
+		}
+		cancel()
+		<-ctx.Done()
+	}
+
+	start := time.Now()
+	_, interrupted := runStreams(ctx, client, [][]files.FileInfo{fileList}, 2*time.Second)
+	if !interrupted {
+		t.Error("Cancelled run not reported as interrupted")
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("Streams took %v to stop", elapsed)
+	}
+	if err := manifest.close(len(fileList), interrupted); err != nil {
+		t.Fatalf("Failed to close manifest: %v", err)
+	}
+
+	entries, summary := readManifest(t, path)
+	if !summary.Interrupted || summary.FilesTotal != len(fileList) {
+		t.Errorf("Summary = %+v, expected interrupted with %d files", summary, len(fileList))
+	}
+	if summary.Unchanged != 1 || summary.Stored+summary.Incomplete != len(fileList)-1 || summary.Failed != 0 {
+		t.Errorf("Summary counts = %+v", summary)
+	}
+	for i, file := range fileList[:len(fileList)-1] {
+		entry, ok := entries[file.Path]
+		if !ok {
+			t.Errorf("Settled file %s missing from manifest", file.Path)
+			continue
+		}
+		want := manifestStored
+		if i == 0 {
+			want = manifestUnchanged
+		}
+		if entry.Status != want {
+			t.Errorf("%s recorded as %s, expected %s", file.Path, entry.Status, want)
+		}
+	}
+
+	// Streams abandoned after the grace period can't write past the summary
+	manifest.unchanged(&last)
+	if _, summary := readManifest(t, path); summary.Unchanged != 1 {
+		t.Errorf("Manifest changed after close")
+	}
+}
+
+// settledFiles returns the paths of the file entries that reached a manifest, as a resumed run would read them
+// after a crash: there is no summary and a last line cut short is ignored
+func settledFiles(t *testing.T, path string) []string {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("Failed to read manifest: %v", err)
+	}
+	var paths []string
+	for _, line := range bytes.SplitAfter(data, []byte("\n")) {
+		var entry manifestEntry
+		if !bytes.HasSuffix(line, []byte("\n")) || json.Unmarshal(line, &entry) != nil || entry.Type != "file" {
+			continue
+		}
+		paths = append(paths, entry.Path)
+	}
+	return paths
+}
+
+func TestManifestFsyncPolicy(t *testing.T) {
+	tests := []struct {
+		fsync   string
+		files   int
+		settled int // Entries on disk after a crash
+	}{
+		{manifestSyncEntry, 7, 7},
+		{manifestSyncBatch, manifestBatchSize + 7, manifestBatchSize},
+		{manifestSyncNone, 7, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.fsync, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "backup.manifest")
+			manifest, err := openManifest(path, tt.fsync)
+			if err != nil {
+				t.Fatalf("Failed to open manifest: %v", err)
+			}
+			for i := range tt.files {
+				file := &files.FileInfo{Host: "host1", Path: fmt.Sprintf("/data/file%d", i), Size: 1}
+				manifest.dataSent(file, 1, "checksum")
+				manifest.result(file.GetId(), true, "")
+			}
+
+			// The process dies here: the manifest is never closed
+			if settled := settledFiles(t, path); len(settled) != tt.settled {
+				t.Errorf("%d files settled after a crash, expected %d", len(settled), tt.settled)
+			} else if tt.settled > 0 && settled[tt.settled-1] != fmt.Sprintf("/data/file%d", tt.settled-1) {
+				t.Errorf("Last settled file is %s", settled[tt.settled-1])
+			}
+
+			// A clean shutdown writes every entry
+			if err := manifest.close(tt.files, false); err != nil {
+				t.Fatalf("Failed to close manifest: %v", err)
+			}
+			if entries, summary := readManifest(t, path); len(entries) != tt.files || summary.Stored != tt.files {
+				t.Errorf("Closed manifest has %d entries and summary %+v, expected %d files", len(entries), summary, tt.files)
+			}
+		})
+	}
+}
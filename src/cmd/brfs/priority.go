@@ -0,0 +1,13 @@
+package main
+
+import "errors"
+
+// IO scheduling classes accepted by IOPriorityClass
+const (
+	ioClassNone       = "none"
+	ioClassBestEffort = "best-effort"
+	ioClassIdle       = "idle"
+)
+
+// errPriorityUnsupported is returned where the platform can't lower the process priority
+var errPriorityUnsupported = errors.New("lowering process priority is not supported on this platform")
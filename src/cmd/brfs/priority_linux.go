@@ -0,0 +1,81 @@
+//go:build linux
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+
+	"golang.org/x/sys/unix"
+)
+
+// ioprio_set constants from linux/ioprio.h
+const (
+	ioprioWhoProcess      = 1
+	ioprioClassShift      = 13
+	ioprioClassBestEffort = 2
+	ioprioClassIdle       = 3
+	// ioprioBestEffortLowest is the lowest priority level within the best-effort class
+	ioprioBestEffortLowest = 7
+)
+
+// ioprioSet issues ioprio_set for one thread, replaceable in tests
+var ioprioSet = func(tid int, prio int) error {
+	_, _, errno := unix.Syscall(unix.SYS_IOPRIO_SET, ioprioWhoProcess, uintptr(tid), uintptr(prio))
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// ioprioValue converts an IOPriorityClass name to an ioprio_set value, 0 for none
+func ioprioValue(class string) (int, error) {
+	switch class {
+	case ioClassNone, "":
+		return 0, nil
+	case ioClassBestEffort:
+		return ioprioClassBestEffort<<ioprioClassShift | ioprioBestEffortLowest, nil
+	case ioClassIdle:
+		return ioprioClassIdle << ioprioClassShift, nil
+	default:
+		return 0, fmt.Errorf("unknown IO priority class %q", class)
+	}
+}
+
+// lowerPriority applies the IO scheduling class and nice level to every thread of the process.
+// Linux keeps both per thread, and threads started later inherit them from their creator,
+// so the walk and read goroutines run with reduced priority wherever they are scheduled.
+// A nice level of 0 leaves the CPU priority unchanged.
+func lowerPriority(class string, nice int) error {
+	prio, err := ioprioValue(class)
+	if err != nil {
+		return err
+	}
+	if prio == 0 && nice == 0 {
+		return nil
+	}
+
+	tasks, err := os.ReadDir("/proc/self/task")
+	if err != nil {
+		return fmt.Errorf("failed to list threads: %w", err)
+	}
+	for _, task := range tasks {
+		tid, err := strconv.Atoi(task.Name())
+		if err != nil {
+			continue
+		}
+		if prio != 0 {
+			if err := ioprioSet(tid, prio); err != nil && !errors.Is(err, unix.ESRCH) {
+				return fmt.Errorf("ioprio_set: %w", err)
+			}
+		}
+		if nice != 0 {
+			if err := unix.Setpriority(unix.PRIO_PROCESS, tid, nice); err != nil && !errors.Is(err, unix.ESRCH) {
+				return fmt.Errorf("setpriority: %w", err)
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,84 @@
+//go:build linux
+
+package main
+
+import (
+	"errors"
+	"runtime"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+// ioprioGet reads the IO priority of one thread
+func ioprioGet(tid int) (int, error) {
+	prio, _, errno := unix.Syscall(unix.SYS_IOPRIO_GET, ioprioWhoProcess, uintptr(tid), 0)
+	if errno != 0 {
+		return 0, errno
+	}
+	return int(prio), nil
+}
+
+// recordIoprioSet wraps ioprioSet for the duration of a test, recording the threads it is issued for
+func recordIoprioSet(t *testing.T) map[int]int {
+	issued := make(map[int]int)
+	original := ioprioSet
+	ioprioSet = func(tid int, prio int) error {
+		issued[tid] = prio
+		return original(tid, prio)
+	}
+	t.Cleanup(func() { ioprioSet = original })
+	return issued
+}
+
+func TestLowerPriorityIssuesIoprio(t *testing.T) {
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	tid := unix.Gettid()
+
+	before, err := ioprioGet(tid)
+	if errors.Is(err, unix.ENOSYS) {
+		t.Skip("ioprio syscalls not available")
+	}
+	if err != nil {
+		t.Fatalf("ioprio_get failed: %v", err)
+	}
+
+	issued := recordIoprioSet(t)
+	defer func() {
+		for thread := range issued {
+			ioprioSet(thread, before)
+		}
+	}()
+	if err := lowerPriority(ioClassIdle, 0); err != nil {
+		t.Fatalf("lowerPriority failed: %v", err)
+	}
+
+	want := ioprioClassIdle << ioprioClassShift
+	if prio, ok := issued[tid]; !ok || prio != want {
+		t.Errorf("ioprio_set for the current thread: issued %v, value %#x, expected %#x", ok, prio, want)
+	}
+	if len(issued) < 2 {
+		t.Errorf("ioprio_set issued for %d threads, expected every thread of the process", len(issued))
+	}
+	got, err := ioprioGet(tid)
+	if err != nil {
+		t.Fatalf("ioprio_get failed: %v", err)
+	}
+	if got != want {
+		t.Errorf("Thread IO priority = %#x, expected %#x", got, want)
+	}
+}
+
+func TestLowerPriorityNone(t *testing.T) {
+	issued := recordIoprioSet(t)
+	if err := lowerPriority(ioClassNone, 0); err != nil {
+		t.Fatalf("lowerPriority failed: %v", err)
+	}
+	if len(issued) != 0 {
+		t.Errorf("ioprio_set issued for %d threads with class none", len(issued))
+	}
+	if err := lowerPriority("urgent", 0); err == nil {
+		t.Error("Expected error for unknown IO priority class")
+	}
+}
@@ -0,0 +1,19 @@
+//go:build !linux
+
+package main
+
+import "fmt"
+
+// lowerPriority only validates the settings, reduced priority is implemented for Linux only
+func lowerPriority(class string, nice int) error {
+	switch class {
+	case ioClassNone, "":
+		if nice == 0 {
+			return nil
+		}
+	case ioClassBestEffort, ioClassIdle:
+	default:
+		return fmt.Errorf("unknown IO priority class %q", class)
+	}
+	return errPriorityUnsupported
+}
@@ -10,33 +10,58 @@ import (
 	"github.com/alex-sviridov/miniprotector/common/logging"
 )
 
-func handleResponse(ctx context.Context, stream pb.BackupService_ProcessBackupStreamClient, response *pb.FileResponse) error {
+func handleResponse(ctx context.Context, response *pb.FileResponse, decisions *decisionQueue) error {
 	logger := logging.GetLoggerFromContext(ctx)
 	switch r := response.ResponseType.(type) {
 	case *pb.FileResponse_FileNeeded:
 		if response.StreamId != ctx.Value("streamId").(int32) {
 			return fmt.Errorf("stream ID mismatch: expected %d, received %d", ctx.Value("streamId").(int32), response.StreamId)
 		}
-		if r.FileNeeded.Host != ctx.Value(common.HostnameContextKey).(string) {
-			return fmt.Errorf("wrong hostname recieved: expected %s, received %s", ctx.Value(common.HostnameContextKey).(string), r.FileNeeded.Host)
-		}
-		if err := handleFileInfoResponse(ctx, response); err != nil {
+		if err := handleFileInfoResponse(ctx, r.FileNeeded, decisions); err != nil {
 			return err
 		}
+	case *pb.FileResponse_NeededBatch:
+		for _, fileNeeded := range r.NeededBatch.Files {
+			if err := handleFileInfoResponse(ctx, fileNeeded, decisions); err != nil {
+				return err
+			}
+		}
+	case *pb.FileResponse_Result:
+		handleResultResponse(ctx, r.Result)
 	default:
 		logger.Error("Received unknown response type", "type", r)
 	}
 	return nil
 }
 
-func handleFileInfoResponse(ctx context.Context, resp *pb.FileResponse) error {
-	fi := resp.GetFileNeeded()
+// handleFileInfoResponse checks the writer's answer for one file and queues it for sendNeededFiles
+func handleFileInfoResponse(ctx context.Context, fi *pb.FileNeeded, decisions *decisionQueue) error {
 	streamId := ctx.Value("streamId").(int32)
+	if fi.Host != ctx.Value(common.HostnameContextKey).(string) {
+		return fmt.Errorf("wrong hostname recieved: expected %s, received %s", ctx.Value(common.HostnameContextKey).(string), fi.Host)
+	}
 
 	logger := logging.GetLoggerFromContext(ctx).
 		With(slog.String("file_id", fi.FileId)).
 		With(slog.Int("streamId", int(streamId)))
 	logger.Debug("Response", "needed", fi.Needed)
 
+	decisions.push(decision{fileID: fi.FileId, needed: fi.Needed})
 	return nil
 }
+
+// handleResultResponse logs whether the writer stored a file sent to it
+func handleResultResponse(ctx context.Context, result *pb.ProcessingResult) {
+	logger := logging.GetLoggerFromContext(ctx).
+		With(slog.String("file_id", result.FileId))
+	inFlightBudgetFromContext(ctx).release(result.FileId)
+	manifestFromContext(ctx).result(result.FileId, result.Success, result.Message)
+	fileResultsFromContext(ctx).result(result.FileId, result.Success, result.Message)
+	dedupFromContext(ctx).result(result.FileId, result.Success)
+	if result.Success {
+		settledIDsFromContext(ctx).add(result.FileId)
+		logger.Debug("File stored by writer")
+	} else {
+		logger.Error("Writer failed to store file", "error", result.Message)
+	}
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// progressInterval is how often progress events are emitted
+const progressInterval = 500 * time.Millisecond
+
+// progressEvent is one JSON line written to the progress output
+type progressEvent struct {
+	Time        time.Time `json:"time"`
+	FilesDone   int64     `json:"files_done"`
+	FilesTotal  int64     `json:"files_total"`
+	BytesDone   int64     `json:"bytes_done"`
+	BytesTotal  int64     `json:"bytes_total"`
+	CurrentFile string    `json:"current_file,omitempty"`
+	Done        bool      `json:"done"`
+}
+
+// progress counts backup progress and periodically writes it as JSON lines
+// to a FIFO or Unix socket for other programs to follow.
+// The output is opened without blocking and written with a deadline, events that can't be
+// delivered are dropped, so a consumer that isn't reading never slows the backup down.
+// A nil *progress does nothing.
+type progress struct {
+	path       string
+	interval   time.Duration
+	filesTotal int64
+	bytesTotal int64
+
+	filesDone atomic.Int64
+	bytesDone atomic.Int64
+	mu        sync.Mutex
+	current   string
+
+	out  io.WriteCloser
+	stop chan struct{}
+	done chan struct{}
+}
+
+type progressContextKey struct{}
+
+// withProgress returns a context carrying p for the stream functions
+func withProgress(ctx context.Context, p *progress) context.Context {
+	return context.WithValue(ctx, progressContextKey{}, p)
+}
+
+// progressFromContext returns the progress in ctx, nil if there is none
+func progressFromContext(ctx context.Context) *progress {
+	p, _ := ctx.Value(progressContextKey{}).(*progress)
+	return p
+}
+
+// startProgress starts emitting progress to path every interval until stopped
+// Returns nil when path is empty
+func startProgress(path string, interval time.Duration, filesTotal, bytesTotal int64) *progress {
+	if path == "" {
+		return nil
+	}
+	p := &progress{
+		path:       path,
+		interval:   interval,
+		filesTotal: filesTotal,
+		bytesTotal: bytesTotal,
+		stop:       make(chan struct{}),
+		done:       make(chan struct{}),
+	}
+	go p.run()
+	return p
+}
+
+// startFile records the file being transferred
+func (p *progress) startFile(path string) {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	p.current = path
+	p.mu.Unlock()
+}
+
+// addBytes counts file data sent
+func (p *progress) addBytes(n int64) {
+	if p != nil {
+		p.bytesDone.Add(n)
+	}
+}
+
+// fileDone counts a file the writer skipped or that was sent
+func (p *progress) fileDone() {
+	if p != nil {
+		p.filesDone.Add(1)
+	}
+}
+
+// finish emits a last event marked done and stops emitting
+func (p *progress) finish() {
+	if p == nil {
+		return
+	}
+	close(p.stop)
+	<-p.done
+}
+
+func (p *progress) run() {
+	defer close(p.done)
+	ticker := time.NewTicker(p.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			p.emit(false)
+		case <-p.stop:
+			p.emit(true)
+			if p.out != nil {
+				p.out.Close()
+			}
+			return
+		}
+	}
+}
+
+// emit writes the current state, opening the output first if needed
+func (p *progress) emit(done bool) {
+	if p.out == nil {
+		out, err := openProgressOutput(p.path, p.interval)
+		if err != nil {
+			return // No consumer yet
+		}
+		p.out = out
+	}
+
+	p.mu.Lock()
+	current := p.current
+	p.mu.Unlock()
+	line, err := json.Marshal(progressEvent{
+		Time:        time.Now(),
+		FilesDone:   p.filesDone.Load(),
+		FilesTotal:  p.filesTotal,
+		BytesDone:   p.bytesDone.Load(),
+		BytesTotal:  p.bytesTotal,
+		CurrentFile: current,
+		Done:        done,
+	})
+	if err != nil {
+		return
+	}
+
+	if d, ok := p.out.(interface{ SetWriteDeadline(time.Time) error }); ok {
+		d.SetWriteDeadline(time.Now().Add(p.interval))
+	}
+	if _, err := p.out.Write(append(line, '\n')); err != nil {
+		// Consumer went away or is stuck, reopen on the next event
+		p.out.Close()
+		p.out = nil
+	}
+}
+
+// openProgressOutput connects to a Unix socket or opens a FIFO for writing.
+// A FIFO is opened non-blocking, which fails while nobody has it open for reading.
+func openProgressOutput(path string, timeout time.Duration) (io.WriteCloser, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if info.Mode().Type() == os.ModeSocket {
+		return net.DialTimeout("unix", path, timeout)
+	}
+	return os.OpenFile(path, os.O_WRONLY|syscall.O_NONBLOCK, 0)
+}
@@ -0,0 +1,155 @@
+//go:build linux
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/alex-sviridov/miniprotector/common/config"
+	"github.com/alex-sviridov/miniprotector/common/files"
+)
+
+// readEvents decodes progress events from r until it is closed
+func readEvents(t *testing.T, r io.Reader) <-chan []progressEvent {
+	result := make(chan []progressEvent, 1)
+	go func() {
+		var events []progressEvent
+		scanner := bufio.NewScanner(r)
+		for scanner.Scan() {
+			var event progressEvent
+			if err := json.Unmarshal(scanner.Bytes(), &event); err != nil {
+				t.Errorf("Invalid progress line %q: %v", scanner.Text(), err)
+				continue
+			}
+			events = append(events, event)
+		}
+		result <- events
+	}()
+	return result
+}
+
+// makeFIFO creates a named pipe in a temporary directory
+func makeFIFO(t *testing.T) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "progress")
+	if err := syscall.Mkfifo(path, 0600); err != nil {
+		t.Fatalf("Failed to create FIFO: %v", err)
+	}
+	return path
+}
+
+func TestProgressToFIFO(t *testing.T) {
+	root, contents := writeSourceTree(t)
+	fileList, _, err := files.Scan(root, files.ScanOptions{})
+	if err != nil {
+		t.Fatalf("Scan failed: %v", err)
+	}
+	var bytesTotal int64
+	for _, data := range contents {
+		bytesTotal += int64(len(data))
+	}
+
+	fifo := makeFIFO(t)
+	opened := make(chan *os.File)
+	go func() {
+		// Blocks until the progress reporter opens the other end
+		f, err := os.Open(fifo)
+		if err != nil {
+			t.Errorf("Failed to open FIFO: %v", err)
+		}
+		opened <- f
+	}()
+
+	progress := startProgress(fifo, 10*time.Millisecond, int64(len(fileList)), bytesTotal)
+	reader := <-opened
+	if reader == nil {
+		t.FailNow()
+	}
+	defer reader.Close()
+	events := readEvents(t, reader)
+
+	_, client := startRecordingWriter(t)
+	ctx := withProgress(newTransferContext(&config.Config{ConnectionTimeOutSec: 10}), progress)
+	if err := processStream(ctx, client, fileList, 1); err != nil {
+		t.Fatalf("processStream failed: %v", err)
+	}
+	progress.finish()
+
+	got := <-events
+	if len(got) == 0 {
+		t.Fatal("No progress events received")
+	}
+	last := got[len(got)-1]
+	if !last.Done {
+		t.Error("Last event isn't marked done")
+	}
+	if last.FilesDone != int64(len(fileList)) || last.FilesTotal != int64(len(fileList)) {
+		t.Errorf("Files done %d of %d, expected %d of %d", last.FilesDone, last.FilesTotal, len(fileList), len(fileList))
+	}
+	if last.BytesDone != bytesTotal || last.BytesTotal != bytesTotal {
+		t.Errorf("Bytes done %d of %d, expected %d of %d", last.BytesDone, last.BytesTotal, bytesTotal, bytesTotal)
+	}
+	for i := 1; i < len(got); i++ {
+		if got[i].BytesDone < got[i-1].BytesDone || got[i].FilesDone < got[i-1].FilesDone {
+			t.Errorf("Progress went backwards between events %d and %d", i-1, i)
+		}
+	}
+}
+
+func TestProgressToUnixSocket(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "progress.sock")
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer listener.Close()
+
+	progress := startProgress(path, 10*time.Millisecond, 3, 100)
+	conn, err := listener.Accept()
+	if err != nil {
+		t.Fatalf("Failed to accept: %v", err)
+	}
+	defer conn.Close()
+	events := readEvents(t, conn)
+
+	progress.startFile("/data/a")
+	progress.addBytes(40)
+	progress.fileDone()
+	progress.finish()
+
+	got := <-events
+	if len(got) == 0 {
+		t.Fatal("No progress events received")
+	}
+	last := got[len(got)-1]
+	if !last.Done || last.FilesDone != 1 || last.BytesDone != 40 || last.CurrentFile != "/data/a" {
+		t.Errorf("Unexpected last event %+v", last)
+	}
+}
+
+func TestProgressWithoutConsumer(t *testing.T) {
+	// Nobody opens the FIFO for reading, emitting must not block
+	progress := startProgress(makeFIFO(t), 10*time.Millisecond, 1, 1)
+	progress.addBytes(1)
+	progress.fileDone()
+	time.Sleep(50 * time.Millisecond)
+
+	finished := make(chan struct{})
+	go func() {
+		progress.finish()
+		close(finished)
+	}()
+	select {
+	case <-finished:
+	case <-time.After(2 * time.Second):
+		t.Fatal("Progress reporter blocked without a consumer")
+	}
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+
+	"github.com/alex-sviridov/miniprotector/common/files"
+	"github.com/alex-sviridov/miniprotector/common/logging"
+)
+
+// File result statuses
+const (
+	resultStored  = "stored"  // Data sent and confirmed by the writer
+	resultSkipped = "skipped" // Writer already had the file
+	resultFailed  = "failed"  // Writer reported an error, or never answered for the data sent
+)
+
+// errNoResult is the error of a file whose data was sent without the writer answering
+var errNoResult = errors.New("no result from the writer")
+
+// fileResult is how one file of a stream ended
+type fileResult struct {
+	path      string
+	status    string
+	err       error // Why the file failed, the writer's message when it reported one
+	bytesSent int64 // File data sent, as compressed on the wire
+}
+
+// fileResults collects the results of the files of one stream, over all its attempts.
+// A nil *fileResults records nothing.
+type fileResults struct {
+	mu      sync.Mutex
+	pending map[string]fileResult // Files whose data was sent, by file id, until the writer answers
+	settled []fileResult
+}
+
+type fileResultsContextKey struct{}
+
+// withFileResults returns a context recording file results in r
+func withFileResults(ctx context.Context, r *fileResults) context.Context {
+	return context.WithValue(ctx, fileResultsContextKey{}, r)
+}
+
+// fileResultsFromContext returns the file results in ctx, nil if there are none
+func fileResultsFromContext(ctx context.Context) *fileResults {
+	r, _ := ctx.Value(fileResultsContextKey{}).(*fileResults)
+	return r
+}
+
+func newFileResults() *fileResults {
+	return &fileResults{pending: make(map[string]fileResult)}
+}
+
+// skipped records a file the writer didn't need
+func (r *fileResults) skipped(file *files.FileInfo) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.settled = append(r.settled, fileResult{path: file.Path, status: resultSkipped})
+}
+
+// sent remembers a file whose data was sent, its result is recorded when the writer answers.
+// A file sent again by a resumed attempt replaces the earlier one.
+func (r *fileResults) sent(file *files.FileInfo, bytesSent int64) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.pending[file.GetId()] = fileResult{path: file.Path, bytesSent: bytesSent}
+}
+
+// result records the writer's answer for a file whose data was sent
+func (r *fileResults) result(fileID string, success bool, message string) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	result, ok := r.pending[fileID]
+	if !ok {
+		return
+	}
+	delete(r.pending, fileID)
+	if success {
+		result.status = resultStored
+	} else {
+		result.status = resultFailed
+		result.err = errors.New(message)
+	}
+	r.settled = append(r.settled, result)
+}
+
+// list returns the results in the order the files settled,
+// followed by the files still waiting for the writer as failed
+func (r *fileResults) list() []fileResult {
+	if r == nil {
+		return nil
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	list := append([]fileResult(nil), r.settled...)
+	for _, result := range r.pending {
+		result.status = resultFailed
+		result.err = errNoResult
+		list = append(list, result)
+	}
+	return list
+}
+
+// runTotals counts the file results of every stream of a run
+type runTotals struct {
+	stored, skipped, failed int64
+	bytesSent               int64
+}
+
+func totalFiles(results []streamResult) runTotals {
+	var totals runTotals
+	for _, stream := range results {
+		for _, file := range stream.fileResults {
+			switch file.status {
+			case resultStored:
+				totals.stored++
+			case resultSkipped:
+				totals.skipped++
+			case resultFailed:
+				totals.failed++
+			}
+			totals.bytesSent += file.bytesSent
+		}
+	}
+	return totals
+}
+
+// reportFiles logs how many files of the run were stored, skipped and failed, with the data sent
+func reportFiles(ctx context.Context, results []streamResult) {
+	totals := totalFiles(results)
+	logging.GetLoggerFromContext(ctx).Info("Backup report",
+		"stored", totals.stored,
+		"skipped", totals.skipped,
+		"failed", totals.failed,
+		"bytes_sent", totals.bytesSent)
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+
+	"github.com/alex-sviridov/miniprotector/common/config"
+	"github.com/alex-sviridov/miniprotector/common/files"
+)
+
+func TestStreamFileResults(t *testing.T) {
+	root, contents := writeSourceTree(t)
+	fileList, _, err := files.Scan(root, files.ScanOptions{})
+	if err != nil {
+		t.Fatalf("Scan failed: %v", err)
+	}
+	existing := filepath.Join(root, "small.txt")
+	writer, client := startRecordingWriter(t)
+	writer.existing = map[string]bool{existing: true}
+
+	ctx := newTransferContext(&config.Config{ConnectionTimeOutSec: 10})
+	results := processStreams(ctx, client, [][]files.FileInfo{fileList})
+	if len(results) != 1 || results[0].err != nil {
+		t.Fatalf("Stream failed: %+v", results)
+	}
+
+	byPath := make(map[string]fileResult)
+	for _, result := range results[0].fileResults {
+		byPath[result.path] = result
+	}
+	if len(byPath) != len(fileList) {
+		t.Errorf("Got %d results, expected one for each of the %d files", len(byPath), len(fileList))
+	}
+	for _, file := range fileList {
+		result, ok := byPath[file.Path]
+		switch {
+		case !ok:
+			t.Errorf("No result for %s", file.Path)
+		case file.Path == existing:
+			if result.status != resultSkipped || result.bytesSent != 0 {
+				t.Errorf("Existing file %s = %+v, expected skipped without data", file.Path, result)
+			}
+		default:
+			if result.status != resultStored || result.err != nil {
+				t.Errorf("New file %s = %+v, expected stored", file.Path, result)
+			}
+			if want := int64(len(contents[file.Path])); result.bytesSent != want {
+				t.Errorf("%s sent %d bytes, expected %d", file.Path, result.bytesSent, want)
+			}
+		}
+	}
+}
+
+func TestFileResultsFailures(t *testing.T) {
+	failed := &files.FileInfo{Host: "host", Path: "/data/failed"}
+	unanswered := &files.FileInfo{Host: "host", Path: "/data/unanswered"}
+	results := newFileResults()
+	results.sent(failed, 10)
+	results.sent(unanswered, 20)
+	results.result(failed.GetId(), false, "disk full")
+
+	list := results.list()
+	if len(list) != 2 {
+		t.Fatalf("Got %d results, expected 2", len(list))
+	}
+	if list[0].path != failed.Path || list[0].status != resultFailed || list[0].err == nil || list[0].err.Error() != "disk full" {
+		t.Errorf("Failed file = %+v, expected the writer's message", list[0])
+	}
+	if list[1].path != unanswered.Path || list[1].status != resultFailed || !errors.Is(list[1].err, errNoResult) {
+		t.Errorf("Unanswered file = %+v, expected failed without result", list[1])
+	}
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	pb "github.com/alex-sviridov/miniprotector/api"
+	"github.com/alex-sviridov/miniprotector/common"
+	"github.com/alex-sviridov/miniprotector/common/config"
+	"github.com/alex-sviridov/miniprotector/common/files"
+	"github.com/alex-sviridov/miniprotector/common/logging"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+type resumeTokenContextKey struct{}
+
+// withResumeToken returns a context whose streams are resumable, token identifying the run to the writer
+func withResumeToken(ctx context.Context, token string) context.Context {
+	return context.WithValue(ctx, resumeTokenContextKey{}, token)
+}
+
+// resumeTokenFromContext returns the resume token of the run, empty when streams aren't resumable
+func resumeTokenFromContext(ctx context.Context) string {
+	token, _ := ctx.Value(resumeTokenContextKey{}).(string)
+	return token
+}
+
+// newResumeToken returns a random token for the streams of one run
+func newResumeToken() (string, error) {
+	token := make([]byte, 16)
+	if _, err := rand.Read(token); err != nil {
+		return "", fmt.Errorf("failed to generate resume token: %w", err)
+	}
+	return hex.EncodeToString(token), nil
+}
+
+// jobIDFromContext returns the backup job the streams belong to
+func jobIDFromContext(ctx context.Context) string {
+	jobID, _ := ctx.Value("jobId").(string)
+	return jobID
+}
+
+// settledIDs records the files of a stream the writer settled: stored, or answered as not needed.
+// The writer's saved progress stops at the first file not settled yet, the files settled after it
+// are only known here. A nil *settledIDs records nothing.
+type settledIDs struct {
+	mu  sync.Mutex
+	ids map[string]bool
+}
+
+type settledContextKey struct{}
+
+// withSettledIDs returns a context recording settled files in s
+func withSettledIDs(ctx context.Context, s *settledIDs) context.Context {
+	return context.WithValue(ctx, settledContextKey{}, s)
+}
+
+// settledIDsFromContext returns the settled files record in ctx, nil if there is none
+func settledIDsFromContext(ctx context.Context) *settledIDs {
+	s, _ := ctx.Value(settledContextKey{}).(*settledIDs)
+	return s
+}
+
+func (s *settledIDs) add(fileID string) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	s.ids[fileID] = true
+	s.mu.Unlock()
+}
+
+func (s *settledIDs) has(fileID string) bool {
+	if s == nil {
+		return false
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.ids[fileID]
+}
+
+// runStream runs processStream for a stream and, when it is cut off from the writer, resumes it up to
+// StreamResumeAttempts times after ConnectRetryDelayMs. A resumed attempt sends only the files the writer
+// hasn't committed; a file whose transfer was interrupted is sent again from its start.
+// Streams of a context without a resume token run once.
+func runStream(ctx context.Context, client pb.BackupServiceClient, fileList []files.FileInfo, streamID int32) error {
+	conf := config.GetConfigFromContext(ctx)
+	if resumeTokenFromContext(ctx) == "" || conf.StreamResumeAttempts <= 0 {
+		return processStream(ctx, client, fileList, streamID)
+	}
+	logger := logging.GetLoggerFromContext(ctx)
+	settled := &settledIDs{ids: make(map[string]bool)}
+	ctx = withSettledIDs(ctx, settled)
+	delay := time.Duration(conf.ConnectRetryDelayMs) * time.Millisecond
+
+	var err error
+	remaining := fileList
+	for attempt := 0; ; attempt++ {
+		if attempt > 0 {
+			select {
+			case <-time.After(delay):
+			case <-ctx.Done():
+				return err
+			}
+			remaining, err = remainingFiles(ctx, client, fileList, streamID, settled)
+		}
+		if err == nil {
+			err = processStream(ctx, client, remaining, streamID)
+		}
+		if err == nil || attempt == conf.StreamResumeAttempts || !resumable(err) || ctx.Err() != nil {
+			return err
+		}
+		logger.Warn("Stream cut off from the writer, resuming", "streamID", streamID, "attempt", attempt+1, "error", err)
+	}
+}
+
+// remainingFiles asks the writer how far a stream got and returns the files still to send:
+// those after the last one it committed, less those settled out of order
+func remainingFiles(ctx context.Context, client pb.BackupServiceClient, fileList []files.FileInfo, streamID int32, settled *settledIDs) ([]files.FileInfo, error) {
+	logger := logging.GetLoggerFromContext(ctx)
+	progress, err := client.GetStreamProgress(ctx, &pb.StreamProgressRequest{
+		Host:        ctx.Value(common.HostnameContextKey).(string),
+		JobId:       jobIDFromContext(ctx),
+		StreamId:    streamID,
+		ResumeToken: resumeTokenFromContext(ctx),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get stream progress: %w", err)
+	}
+
+	start := 0
+	if progress.LastFileId != "" {
+		start = -1
+		for i := range fileList {
+			if fileList[i].GetId() == progress.LastFileId {
+				start = i + 1
+				break
+			}
+		}
+		if start < 0 {
+			logger.Warn("Writer's progress doesn't match the stream, resuming from its first file",
+				"streamID", streamID, "last_file_id", progress.LastFileId)
+			start = 0
+		}
+	}
+	var remaining []files.FileInfo
+	for _, file := range fileList[start:] {
+		if !settled.has(file.GetId()) {
+			remaining = append(remaining, file)
+		}
+	}
+	logger.Info("Resuming stream", "streamID", streamID, "committed", progress.Committed, "remaining", len(remaining))
+	return remaining, nil
+}
+
+// resumable tells whether a stream failed on its connection to the writer, rather than on a file or
+// because the writer refused it, so that a new attempt may get further. Only transport and writer
+// status codes count: a local context that ended, by its deadline or a cancel, doesn't resume.
+func resumable(err error) bool {
+	if errors.Is(err, context.DeadlineExceeded) || errors.Is(err, context.Canceled) {
+		return false
+	}
+	s, ok := status.FromError(err)
+	if !ok {
+		return false
+	}
+	switch s.Code() {
+	case codes.Unavailable, codes.Aborted, codes.DeadlineExceeded:
+		return true
+	default:
+		return false
+	}
+}
+
+// startStream makes a stream resumable by telling the writer the job and resume token it belongs to.
+// Nothing is sent when the context has no resume token.
+func startStream(ctx context.Context, stream pb.BackupService_ProcessBackupStreamClient) error {
+	token := resumeTokenFromContext(ctx)
+	if token == "" {
+		return nil
+	}
+	err := stream.Send(&pb.FileRequest{
+		StreamId: ctx.Value("streamId").(int32),
+		RequestType: &pb.FileRequest_Start{Start: &pb.StreamStart{
+			JobId:       jobIDFromContext(ctx),
+			ResumeToken: token,
+			Host:        ctx.Value(common.HostnameContextKey).(string),
+		}},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to start stream: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	pb "github.com/alex-sviridov/miniprotector/api"
+	"github.com/alex-sviridov/miniprotector/common/config"
+	"github.com/alex-sviridov/miniprotector/common/files"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// resumingWriter asks for every file and commits each at its FileEnd. The first stream is cut off
+// at the FileEnd following killAfter committed files, that file isn't committed.
+type resumingWriter struct {
+	pb.UnimplementedBackupServiceServer
+	killAfter int
+	killWith  error // Status the stream is cut off with, Unavailable when nil
+
+	mu        sync.Mutex
+	killed    bool
+	starts    []*pb.StreamStart
+	metadata  []int    // Files whose metadata arrived, per stream
+	committed []string // File ids in commit order
+}
+
+func (rw *resumingWriter) ProcessBackupStream(stream pb.BackupService_ProcessBackupStreamServer) error {
+	rw.mu.Lock()
+	attempt := len(rw.metadata)
+	rw.metadata = append(rw.metadata, 0)
+	rw.mu.Unlock()
+	for {
+		req, err := stream.Recv()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		var response *pb.FileResponse
+		rw.mu.Lock()
+		switch r := req.RequestType.(type) {
+		case *pb.FileRequest_Start:
+			rw.starts = append(rw.starts, r.Start)
+		case *pb.FileRequest_FileInfo:
+			rw.metadata[attempt]++
+			fileInfo, err := files.DecodeFileInfo(r.FileInfo.Attributes)
+			if err != nil {
+				rw.mu.Unlock()
+				return err
+			}
+			response = &pb.FileResponse{
+				StreamId:     req.StreamId,
+				ResponseType: &pb.FileResponse_FileNeeded{FileNeeded: &pb.FileNeeded{FileId: r.FileInfo.FileId, Needed: true, Host: fileInfo.Host}},
+			}
+		case *pb.FileRequest_FileEnd:
+			if !rw.killed && len(rw.committed) == rw.killAfter {
+				rw.killed = true
+				rw.mu.Unlock()
+				if rw.killWith != nil {
+					return rw.killWith
+				}
+				return status.Error(codes.Unavailable, "writer restarting")
+			}
+			rw.committed = append(rw.committed, r.FileEnd.FileId)
+			response = &pb.FileResponse{
+				StreamId:     req.StreamId,
+				ResponseType: &pb.FileResponse_Result{Result: &pb.ProcessingResult{FileId: r.FileEnd.FileId, Success: true}},
+			}
+		}
+		rw.mu.Unlock()
+
+		if response != nil {
+			if err := stream.Send(response); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func (rw *resumingWriter) GetStreamProgress(ctx context.Context, req *pb.StreamProgressRequest) (*pb.StreamProgress, error) {
+	rw.mu.Lock()
+	defer rw.mu.Unlock()
+	progress := &pb.StreamProgress{Committed: int64(len(rw.committed))}
+	if len(rw.committed) > 0 {
+		progress.LastFileId = rw.committed[len(rw.committed)-1]
+	}
+	return progress, nil
+}
+
+func TestRunStreamResumes(t *testing.T) {
+	root := t.TempDir()
+	for i := range 6 {
+		if err := os.WriteFile(filepath.Join(root, fmt.Sprintf("file%d", i)), []byte(fmt.Sprintf("content %d", i)), 0600); err != nil {
+			t.Fatalf("Failed to write file: %v", err)
+		}
+	}
+	fileList, _, err := files.Scan(root, files.ScanOptions{})
+	if err != nil {
+		t.Fatalf("Scan failed: %v", err)
+	}
+
+	const killAfter = 3
+	writer := &resumingWriter{killAfter: killAfter}
+	client := startTestWriter(t, writer)
+	ctx := newTransferContext(&config.Config{ConnectionTimeOutSec: 10, StreamResumeAttempts: 1})
+	ctx = context.WithValue(ctx, "jobId", "job")
+	ctx = withResumeToken(ctx, "token")
+
+	if err := runStream(ctx, client, fileList, 1); err != nil {
+		t.Fatalf("runStream failed: %v", err)
+	}
+
+	if len(writer.metadata) != 2 {
+		t.Fatalf("Writer got %d stream attempts, expected 2", len(writer.metadata))
+	}
+	// The resumed attempt sends only the files not committed, the one cut off included
+	if writer.metadata[1] != len(fileList)-killAfter {
+		t.Errorf("Resumed attempt sent %d files, expected %d", writer.metadata[1], len(fileList)-killAfter)
+	}
+	committed := make(map[string]int)
+	for _, fileID := range writer.committed {
+		committed[fileID]++
+	}
+	for _, file := range fileList {
+		if committed[file.GetId()] != 1 {
+			t.Errorf("%s committed %d times, expected once", file.Path, committed[file.GetId()])
+		}
+	}
+	for _, start := range writer.starts {
+		if start.JobId != "job" || start.ResumeToken != "token" {
+			t.Errorf("Stream started with job %q and token %q", start.JobId, start.ResumeToken)
+		}
+	}
+	if len(writer.starts) != 2 {
+		t.Errorf("Writer got %d StreamStart, expected one per attempt", len(writer.starts))
+	}
+}
+
+func TestRunStreamStopsOnOtherErrors(t *testing.T) {
+	root, _ := writeSourceTree(t)
+	fileList, _, err := files.Scan(root, files.ScanOptions{})
+	if err != nil {
+		t.Fatalf("Scan failed: %v", err)
+	}
+	// A file that can't be read doesn't get better on a new attempt
+	if err := os.Remove(filepath.Join(root, "small.txt")); err != nil {
+		t.Fatalf("Failed to remove file: %v", err)
+	}
+
+	writer := &resumingWriter{killAfter: -1}
+	client := startTestWriter(t, writer)
+	ctx := newTransferContext(&config.Config{ConnectionTimeOutSec: 10, StreamResumeAttempts: 3, StopStreamOnFileError: true})
+	ctx = withResumeToken(ctx, "token")
+	if err := runStream(ctx, client, fileList, 1); err == nil {
+		t.Fatal("Expected the read error")
+	}
+	if len(writer.metadata) != 1 {
+		t.Errorf("Stream run %d times, expected once", len(writer.metadata))
+	}
+}
+
+func TestRunStreamNotResumedAfterMaxDuration(t *testing.T) {
+	root, _ := writeSourceTree(t)
+	fileList, _, err := files.Scan(root, files.ScanOptions{})
+	if err != nil {
+		t.Fatalf("Scan failed: %v", err)
+	}
+
+	// The writer ends a stream past MaxStreamDurationSec on purpose, a new attempt would only run long again
+	writer := &resumingWriter{killAfter: 1, killWith: status.Error(codes.ResourceExhausted, "stream exceeded maximum duration of 1s")}
+	client := startTestWriter(t, writer)
+	ctx := newTransferContext(&config.Config{StreamResumeAttempts: 3})
+	ctx = withResumeToken(ctx, "token")
+	if err := runStream(ctx, client, fileList, 1); status.Code(err) != codes.ResourceExhausted {
+		t.Fatalf("Expected the writer's ResourceExhausted, got %v", err)
+	}
+	if len(writer.metadata) != 1 {
+		t.Errorf("Stream run %d times, expected once", len(writer.metadata))
+	}
+}
+
+func TestResumable(t *testing.T) {
+	tests := []struct {
+		err  error
+		want bool
+	}{
+		{fmt.Errorf("failed to receive response: %w", status.Error(codes.Unavailable, "connection reset")), true},
+		{status.Error(codes.Aborted, "aborted"), true},
+		{status.Error(codes.DeadlineExceeded, "no message received for 30s"), true},
+		{status.Error(codes.ResourceExhausted, "stream exceeded maximum duration of 24h0m0s"), false},
+		{fmt.Errorf("wait: %w", context.DeadlineExceeded), false},
+		{fmt.Errorf("wait: %w", context.Canceled), false},
+		{status.Error(codes.PermissionDenied, "not allowed"), false},
+		{status.Error(codes.InvalidArgument, "bad batch"), false},
+		{errors.New("failed to read file"), false},
+	}
+	for _, tt := range tests {
+		if got := resumable(tt.err); got != tt.want {
+			t.Errorf("resumable(%v) = %v, expected %v", tt.err, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"log/slog"
+	"time"
+)
+
+// Phase names reported in per-file timing logs
+const (
+	phaseStat      = "stat"
+	phaseEncode    = "encode"
+	phaseSend      = "send"
+	phaseRead      = "read"
+	phaseHash      = "hash"
+	phaseChunkSend = "chunk_send"
+)
+
+// phaseTimer measures the processing phases of one file, a phase measured several times adds up.
+// A nil timer records nothing, so callers don't need to check whether timing is enabled.
+type phaseTimer struct {
+	start     time.Time
+	phases    []string
+	durations map[string]time.Duration
+}
+
+// newPhaseTimer starts timing a file when enabled
+func newPhaseTimer(enabled bool) *phaseTimer {
+	if !enabled {
+		return nil
+	}
+	return &phaseTimer{
+		start:     time.Now(),
+		durations: make(map[string]time.Duration),
+	}
+}
+
+// lap records the time since the previous lap under phase and restarts the clock
+func (pt *phaseTimer) lap(phase string) {
+	if pt == nil {
+		return
+	}
+	now := time.Now()
+	pt.record(phase, now.Sub(pt.start))
+	pt.start = now
+}
+
+// record adds a phase measured elsewhere, such as a send shared by a batch of files
+func (pt *phaseTimer) record(phase string, d time.Duration) {
+	if pt == nil {
+		return
+	}
+	if _, ok := pt.durations[phase]; !ok {
+		pt.phases = append(pt.phases, phase)
+	}
+	pt.durations[phase] += d
+}
+
+// log writes the recorded phase durations at debug level, in the order they were first recorded
+func (pt *phaseTimer) log(logger *slog.Logger, msg string) {
+	if pt == nil {
+		return
+	}
+	attrs := make([]any, len(pt.phases))
+	for i, phase := range pt.phases {
+		attrs[i] = slog.Duration(phase, pt.durations[phase])
+	}
+	logger.Debug(msg, attrs...)
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/alex-sviridov/miniprotector/common/config"
+	"github.com/alex-sviridov/miniprotector/common/files"
+	"github.com/alex-sviridov/miniprotector/common/logging"
+)
+
+// newLoggedTestContext is newTestContext with debug logs written as JSON lines to the returned buffer
+func newLoggedTestContext(conf *config.Config) (context.Context, *bytes.Buffer) {
+	var buf bytes.Buffer
+	logger := slog.New(slog.NewJSONHandler(&buf, &slog.HandlerOptions{Level: slog.LevelDebug}))
+	ctx := context.WithValue(newTestContext(conf), logging.ContextKey, logger)
+	return ctx, &buf
+}
+
+// timingRecords returns the log records with message msg keyed by file path
+func timingRecords(t *testing.T, buf *bytes.Buffer, msg string) map[string]map[string]any {
+	t.Helper()
+	records := make(map[string]map[string]any)
+	for _, line := range bytes.Split(bytes.TrimSpace(buf.Bytes()), []byte("\n")) {
+		var record map[string]any
+		if err := json.Unmarshal(line, &record); err != nil {
+			t.Fatalf("Failed to parse log line %q: %v", line, err)
+		}
+		if record["msg"] == msg {
+			records[record["file_path"].(string)] = record
+		}
+	}
+	return records
+}
+
+func TestFileTimings(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "sample.txt"), []byte("sample data"), 0644); err != nil {
+		t.Fatalf("Failed to create file: %v", err)
+	}
+
+	items, _, err := files.Scan(dir, files.ScanOptions{RecordTimings: true})
+	if err != nil {
+		t.Fatalf("Scan failed: %v", err)
+	}
+
+	ctx, buf := newLoggedTestContext(&config.Config{RecordFileTimings: true})
+	if _, err := sendFilesMetadata(ctx, &fakeStream{}, items); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	for i := range items {
+		if items[i].Mode.IsRegular() {
+			if err := sendFileData(ctx, &fakeStream{}, &items[i]); err != nil {
+				t.Fatalf("Failed to send data: %v", err)
+			}
+		}
+	}
+
+	phases := map[string][]string{
+		"File timings":      {phaseStat, phaseEncode, phaseSend},
+		"File data timings": {phaseRead, phaseHash, phaseChunkSend},
+	}
+	for msg, expected := range phases {
+		records := timingRecords(t, buf, msg)
+		record, ok := records[filepath.Join(dir, "sample.txt")]
+		if !ok {
+			t.Fatalf("No %q logged for sample file, got %v", msg, records)
+		}
+		for _, phase := range expected {
+			value, ok := record[phase].(float64)
+			if !ok {
+				t.Errorf("Phase %s missing from %q: %v", phase, msg, record)
+				continue
+			}
+			if value < 0 {
+				t.Errorf("Phase %s has negative duration %v", phase, value)
+			}
+		}
+	}
+}
+
+func TestFileTimingsDisabled(t *testing.T) {
+	ctx, buf := newLoggedTestContext(&config.Config{})
+	if _, err := sendFilesMetadata(ctx, &fakeStream{}, testFileList()); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if records := timingRecords(t, buf, "File timings"); len(records) != 0 {
+		t.Errorf("Expected no timings when disabled, got %d", len(records))
+	}
+}
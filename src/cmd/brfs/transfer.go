@@ -0,0 +1,384 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+
+	pb "github.com/alex-sviridov/miniprotector/api"
+	"github.com/alex-sviridov/miniprotector/common/chunker"
+	"github.com/alex-sviridov/miniprotector/common/config"
+	"github.com/alex-sviridov/miniprotector/common/files"
+	"github.com/alex-sviridov/miniprotector/common/logging"
+)
+
+// decision is the writer's answer to the metadata of one file
+type decision struct {
+	fileID string
+	needed bool
+}
+
+// decisionQueue passes decisions from the receiving goroutine to the sending one.
+// It is unbounded so that receiving never waits for sending: the writer blocks when
+// its replies aren't read, and it stops reading file data while blocked.
+type decisionQueue struct {
+	mu     sync.Mutex
+	ready  chan struct{} // Signalled when items are added or the queue is closed
+	items  []decision
+	closed bool
+	err    error
+}
+
+func newDecisionQueue() *decisionQueue {
+	return &decisionQueue{ready: make(chan struct{}, 1)}
+}
+
+func (q *decisionQueue) push(d decision) {
+	q.mu.Lock()
+	q.items = append(q.items, d)
+	q.mu.Unlock()
+	q.signal()
+}
+
+// close wakes up pop once the queued decisions are consumed, err tells why no more will come
+func (q *decisionQueue) close(err error) {
+	q.mu.Lock()
+	q.closed = true
+	q.err = err
+	q.mu.Unlock()
+	q.signal()
+}
+
+func (q *decisionQueue) signal() {
+	select {
+	case q.ready <- struct{}{}:
+	default:
+	}
+}
+
+// pop waits for the next decision
+func (q *decisionQueue) pop(ctx context.Context) (decision, error) {
+	for {
+		q.mu.Lock()
+		if len(q.items) > 0 {
+			d := q.items[0]
+			q.items = q.items[1:]
+			q.mu.Unlock()
+			return d, nil
+		}
+		if q.closed {
+			err := q.err
+			q.mu.Unlock()
+			if err == nil {
+				err = errors.New("writer closed the stream before answering all files")
+			}
+			return decision{}, err
+		}
+		q.mu.Unlock()
+
+		select {
+		case <-q.ready:
+		case <-ctx.Done():
+			return decision{}, ctx.Err()
+		}
+	}
+}
+
+// receiveResponses reads writer responses until the writer ends the stream,
+// queueing its decisions for sendNeededFiles
+func receiveResponses(ctx context.Context, stream pb.BackupService_ProcessBackupStreamClient, decisions *decisionQueue) error {
+	logger := logging.GetLoggerFromContext(ctx)
+	streamID := ctx.Value("streamId").(int32)
+	for {
+		response, err := stream.Recv()
+		if err == io.EOF {
+			logger.Debug("Server stopped responding")
+			decisions.close(nil)
+			return nil
+		}
+		if err != nil {
+			err = fmt.Errorf("failed to receive response: %w", err)
+			decisions.close(err)
+			return err
+		}
+		if response.StreamId != streamID {
+			err = fmt.Errorf("stream ID mismatch: expected %d, received %d", streamID, response.StreamId)
+			decisions.close(err)
+			return err
+		}
+		if err := handleResponse(ctx, response, decisions); err != nil {
+			err = fmt.Errorf("failed to handle response: %w", err)
+			decisions.close(err)
+			return err
+		}
+	}
+}
+
+// sendNeededFiles waits for the writer to answer each of the count files whose metadata was sent,
+// and sends the data of those it needs
+func sendNeededFiles(ctx context.Context, stream pb.BackupService_ProcessBackupStreamClient, fileList []files.FileInfo, decisions *decisionQueue, count int) error {
+	logger := logging.GetLoggerFromContext(ctx)
+	progress := progressFromContext(ctx)
+	manifest := manifestFromContext(ctx)
+
+	byID := make(map[string]*files.FileInfo, len(fileList))
+	for i := range fileList {
+		byID[fileList[i].GetId()] = &fileList[i]
+	}
+
+	for answered := 0; answered < count; answered++ {
+		d, err := decisions.pop(ctx)
+		if err != nil {
+			return err
+		}
+		if !d.needed {
+			if file, ok := byID[d.fileID]; ok {
+				manifest.unchanged(file)
+				fileResultsFromContext(ctx).skipped(file)
+			}
+			settledIDsFromContext(ctx).add(d.fileID)
+			progress.fileDone()
+			continue
+		}
+		file, ok := byID[d.fileID]
+		if !ok {
+			logger.Warn("Writer asked for a file that wasn't sent", "file_id", d.fileID)
+			continue
+		}
+		if err := sendFileData(ctx, stream, file); err != nil {
+			return err
+		}
+		progress.fileDone()
+	}
+	return nil
+}
+
+// sendFileData sends the content of a file as chunks followed by a FileEnd.
+// Files other than regular ones have no content, only the FileEnd is sent.
+// With MaxInFlightBytes set, chunks wait while the writer hasn't acknowledged that much data.
+// A file that can't be read aborts the stream when StopStreamOnFileError is set,
+// otherwise the writer is told to discard it.
+// With RecordFileTimings set, the time spent reading, hashing and sending chunks is logged at debug level.
+func sendFileData(ctx context.Context, stream pb.BackupService_ProcessBackupStreamClient, file *files.FileInfo) error {
+	conf := config.GetConfigFromContext(ctx)
+	streamID := ctx.Value("streamId").(int32)
+	fileID := file.GetId()
+	logger := logging.GetLoggerFromContext(ctx).With(slog.String("file_path", file.Path))
+	progress := progressFromContext(ctx)
+	budget := inFlightBudgetFromContext(ctx)
+	timer := newPhaseTimer(conf.RecordFileTimings)
+
+	logger.Info("Sending file data", "size", file.Size)
+	progress.startFile(file.Path)
+	end := &pb.FileEnd{FileId: fileID}
+	var bytesSent int64
+	if file.Mode.IsRegular() {
+		// The file is checked and read through one descriptor, so a file put at its path
+		// in between can't be sent as the scanned one
+		f, err := openScanned(file)
+		timer.lap(phaseRead)
+		linked := false
+		var read *readFile
+		if err == nil {
+			defer f.Close()
+			// A possible copy is hashed here, a small one is read at the same time
+			linked, read, err = linkToSent(ctx, f, file, end)
+			timer.lap(phaseHash)
+		}
+		if err == nil && !linked {
+			var sendErr error
+			var checksum string
+			var size int64
+			chunkFile := chunker.ChunkFile
+			if conf.HashWorkers > 1 {
+				chunkFile = func(f *os.File, chunkSize int, algo string, fn func(chunker.Chunk) error) (string, int64, error) {
+					return chunker.ChunkFileParallel(f, chunkSize, algo, conf.HashWorkers, fn)
+				}
+			}
+			// Holes of sparse files aren't sent, the writer gets the offset of each chunk of data
+			if file.IsSparse() {
+				chunkFile = chunker.ChunkSparseFile
+			}
+			if read != nil {
+				chunkFile = read.chunk
+			}
+			checksum, size, err = chunkFile(f, chunker.DefaultChunkSize, conf.HashAlgo, func(chunk chunker.Chunk) error {
+				timer.record(phaseRead, chunk.ReadTime)
+				timer.record(phaseHash, chunk.HashTime)
+				sendStart := time.Now()
+				defer func() { timer.record(phaseChunkSend, time.Since(sendStart)) }()
+				data, codec, err := chunker.Compress(conf.Compression, chunk.Data)
+				if err != nil {
+					sendErr = err
+					return err
+				}
+				// Waits for the writer to acknowledge earlier files when too much data is in flight
+				if err := budget.acquire(ctx, fileID, int64(len(data))); err != nil {
+					sendErr = err
+					return err
+				}
+				sendErr = stream.Send(&pb.FileRequest{
+					StreamId: streamID,
+					RequestType: &pb.FileRequest_Chunk{
+						Chunk: &pb.Chunk{
+							FileId:      fileID,
+							Offset:      chunk.Offset,
+							Data:        data,
+							Checksum:    chunk.Checksum,
+							Compression: codec,
+						},
+					},
+				})
+				progress.addBytes(int64(len(chunk.Data)))
+				bytesSent += int64(len(data))
+				return sendErr
+			})
+			if sendErr != nil {
+				return fmt.Errorf("failed to send data of %s: %w", file.Path, sendErr)
+			}
+			if err == nil {
+				// FileEnd carries the size actually read, the writer stores it over the scanned one
+				if size != file.Size {
+					logger.Warn("File size changed since scan", "scanned_size", file.Size, "read_size", size)
+				}
+				end.Size = size
+				end.Checksum = checksum
+				dedupFromContext(ctx).sent(streamID, fileID, checksum, file.Path)
+				if size == file.Size {
+					checksumCacheFromContext(ctx).Store(file, checksum)
+				}
+			}
+		}
+		if err != nil {
+			logger.Error("Failed to read file", "error", err)
+			if conf.StopStreamOnFileError {
+				return err
+			}
+			end.Error = err.Error()
+		}
+	}
+
+	// Registered before sending, the writer's result may arrive right after FileEnd
+	manifestFromContext(ctx).dataSent(file, end.Size, end.Checksum)
+	fileResultsFromContext(ctx).sent(file, bytesSent)
+	err := stream.Send(&pb.FileRequest{
+		StreamId:    streamID,
+		RequestType: &pb.FileRequest_FileEnd{FileEnd: end},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to send end of %s: %w", file.Path, err)
+	}
+	timer.log(logger, "File data timings")
+	return nil
+}
+
+// openScanned opens a regular file for reading and checks, through the open descriptor,
+// that it is still the file scanned: the same inode where the platform reports one
+func openScanned(file *files.FileInfo) (*os.File, error) {
+	f, err := os.Open(file.Path)
+	if err != nil {
+		return nil, err
+	}
+	current, err := files.StatFile(f)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	if file.Ino != 0 && (current.Dev != file.Dev || current.Ino != file.Ino) {
+		f.Close()
+		return nil, fmt.Errorf("%s was replaced by another file since the scan", file.Path)
+	}
+	if !current.Mode.IsRegular() {
+		f.Close()
+		return nil, fmt.Errorf("%s is no longer a regular file", file.Path)
+	}
+	return f, nil
+}
+
+// maxReadWhole bounds the files linkToSent keeps in memory while hashing them
+const maxReadWhole = 4 * chunker.DefaultChunkSize
+
+// readFile is a file linkToSent read whole, its chunks are sent from memory instead of reading it again
+type readFile struct {
+	chunks   []chunker.Chunk
+	checksum string
+	size     int64
+}
+
+// chunk passes the chunks already read to fn, it stands in for chunker.ChunkFile
+func (r *readFile) chunk(_ *os.File, _ int, _ string, fn func(chunker.Chunk) error) (string, int64, error) {
+	for _, c := range r.chunks {
+		if err := fn(c); err != nil {
+			return "", c.Offset, err
+		}
+	}
+	return r.checksum, r.size, nil
+}
+
+// readWhole tells whether linkToSent reads a file whole while hashing it, other files are hashed
+// by hashCandidates before their stream opens
+func readWhole(file *files.FileInfo) bool {
+	return !file.IsSparse() && file.Size <= maxReadWhole
+}
+
+// linkToSent hashes an open file that may be a copy of another one of the run, or of content the
+// writer already stores, and fills end to link to that content instead of sending the data: to a file
+// of the run with the same content sent before, otherwise to the writer's stored content.
+// Otherwise f is rewound for sending its data. A small file is chunked while being hashed and
+// returned, so its data is read once. A larger file was hashed before the stream opened: one changed
+// since isn't linked, hashing it now would leave the stream silent.
+func linkToSent(ctx context.Context, f *os.File, file *files.FileInfo, end *pb.FileEnd) (bool, *readFile, error) {
+	dedup := dedupFromContext(ctx)
+	stored := storedContentFromContext(ctx)
+	if !dedup.candidate(file) && !stored.candidate(file) {
+		return false, nil, nil
+	}
+	algo := config.GetConfigFromContext(ctx).HashAlgo
+	cache := checksumCacheFromContext(ctx)
+	var read *readFile
+	// A file unchanged since it was hashed, by hashCandidates or a previous run, isn't read here
+	checksum, cached := cache.Lookup(file, algo)
+	if !readWhole(file) {
+		current, err := files.StatFile(f)
+		if err != nil {
+			return false, nil, nil
+		}
+		if checksum, cached = cache.Lookup(&current, algo); !cached {
+			return false, nil, nil
+		}
+	}
+	if !cached {
+		var err error
+		// Read errors are left to the normal transfer, which reports them
+		read = &readFile{}
+		read.chunks, read.checksum, read.size, err = chunker.ChunkAndHashFile(f, algo)
+		checksum = read.checksum
+		if _, seekErr := f.Seek(0, io.SeekStart); seekErr != nil {
+			return false, nil, seekErr
+		}
+		if err != nil {
+			return false, nil, nil
+		}
+		if read.size == file.Size {
+			cache.Store(file, checksum)
+		}
+	}
+	logger := logging.GetLoggerFromContext(ctx).With(slog.String("file_path", file.Path))
+	if first := dedup.sameAs(ctx.Value("streamId").(int32), checksum); first != "" {
+		logger.Debug("Same content as a file already sent", "same_as", first)
+		end.SameAs = first
+	} else if stored.known(ctx, checksum, file.Size) {
+		logger.Debug("Content already stored by the writer")
+		end.StoredContent = true
+	} else {
+		return false, read, nil
+	}
+	end.Size = file.Size
+	end.Checksum = checksum
+	return true, nil, nil
+}
@@ -0,0 +1,692 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	pb "github.com/alex-sviridov/miniprotector/api"
+	"github.com/alex-sviridov/miniprotector/common"
+	"github.com/alex-sviridov/miniprotector/common/chunker"
+	"github.com/alex-sviridov/miniprotector/common/config"
+	"github.com/alex-sviridov/miniprotector/common/files"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+// recordingWriter asks for every file except those in existing, and keeps the data it receives, by file id
+type recordingWriter struct {
+	pb.UnimplementedBackupServiceServer
+	mu       sync.Mutex
+	existing map[string]bool // Paths already backed up
+	stored   map[string]bool // Checksums of content already stored, from any host
+	data     map[string][]byte
+	metadata map[string]*files.FileInfo // Files whose metadata arrived, by file id
+	ends     map[string]*pb.FileEnd
+	chunks   int
+	batches  []int        // Size of each FileBatch received
+	jobRuns  []*pb.JobRun // Summaries recorded
+	// onFileEnd, when set, is called with the file id of each FileEnd before its result is sent
+	onFileEnd func(fileID string)
+	// maxSilence is the longest a stream went without a message, from its start
+	maxSilence time.Duration
+}
+
+// answer tells whether the writer needs a file
+func (rw *recordingWriter) answer(fi *pb.FileInfo) (*pb.FileNeeded, error) {
+	fileInfo, err := files.DecodeFileInfo(fi.Attributes)
+	if err != nil {
+		return nil, err
+	}
+	rw.metadata[fi.FileId] = fileInfo
+	return &pb.FileNeeded{FileId: fi.FileId, Needed: !rw.existing[fileInfo.Path], Host: fileInfo.Host}, nil
+}
+
+func (rw *recordingWriter) ProcessBackupStream(stream pb.BackupService_ProcessBackupStreamServer) error {
+	last := time.Now()
+	for {
+		req, err := stream.Recv()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		var response *pb.FileResponse
+		rw.mu.Lock()
+		rw.maxSilence = max(rw.maxSilence, time.Since(last))
+		last = time.Now()
+		switch r := req.RequestType.(type) {
+		case *pb.FileRequest_FileInfo:
+			answer, err := rw.answer(r.FileInfo)
+			if err != nil {
+				rw.mu.Unlock()
+				return err
+			}
+			response = &pb.FileResponse{
+				StreamId:     req.StreamId,
+				ResponseType: &pb.FileResponse_FileNeeded{FileNeeded: answer},
+			}
+		case *pb.FileRequest_Batch:
+			rw.batches = append(rw.batches, len(r.Batch.Files))
+			answers := make([]*pb.FileNeeded, len(r.Batch.Files))
+			for i, fi := range r.Batch.Files {
+				answer, err := rw.answer(fi)
+				if err != nil {
+					rw.mu.Unlock()
+					return err
+				}
+				answers[i] = answer
+			}
+			response = &pb.FileResponse{
+				StreamId:     req.StreamId,
+				ResponseType: &pb.FileResponse_NeededBatch{NeededBatch: &pb.FileNeededBatch{Files: answers}},
+			}
+		case *pb.FileRequest_Chunk:
+			if _, ok := rw.data[r.Chunk.FileId]; !ok && r.Chunk.Offset == 0 {
+				rw.data[r.Chunk.FileId] = []byte{}
+			}
+			if r.Chunk.Offset != int64(len(rw.data[r.Chunk.FileId])) || r.Chunk.Checksum != chunker.Checksum(r.Chunk.Data) {
+				rw.mu.Unlock()
+				return errors.New("bad chunk")
+			}
+			rw.data[r.Chunk.FileId] = append(rw.data[r.Chunk.FileId], r.Chunk.Data...)
+			rw.chunks++
+		case *pb.FileRequest_FileEnd:
+			rw.ends[r.FileEnd.FileId] = r.FileEnd
+			response = &pb.FileResponse{
+				StreamId:     req.StreamId,
+				ResponseType: &pb.FileResponse_Result{Result: &pb.ProcessingResult{FileId: r.FileEnd.FileId, Success: true}},
+			}
+		}
+		rw.mu.Unlock()
+
+		if end := req.GetFileEnd(); end != nil && rw.onFileEnd != nil {
+			rw.onFileEnd(end.FileId)
+		}
+		if response != nil {
+			if err := stream.Send(response); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func (rw *recordingWriter) HasContent(ctx context.Context, req *pb.ContentQuery) (*pb.ContentKnown, error) {
+	rw.mu.Lock()
+	defer rw.mu.Unlock()
+	return &pb.ContentKnown{Known: rw.stored[req.Checksum]}, nil
+}
+
+// ListBackedUpFiles lists the files whose FileEnd arrived, whatever the host and path asked for
+func (rw *recordingWriter) ListBackedUpFiles(req *pb.BackedUpFilesRequest, stream pb.BackupService_ListBackedUpFilesServer) error {
+	rw.mu.Lock()
+	var list []*pb.BackedUpFile
+	for fileID := range rw.ends {
+		file := rw.metadata[fileID]
+		list = append(list, &pb.BackedUpFile{Path: file.Path, Size: file.Size, ModTimeUnixNs: file.ModTime.UnixNano(), ChangeTimeUnixNs: file.ChangeTime.UnixNano()})
+	}
+	rw.mu.Unlock()
+	for _, file := range list {
+		if err := stream.Send(file); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// PreviewFiles answers files already backed up as unchanged and the others as new, recording nothing
+func (rw *recordingWriter) PreviewFiles(ctx context.Context, req *pb.FileBatch) (*pb.FilePreview, error) {
+	rw.mu.Lock()
+	defer rw.mu.Unlock()
+	preview := &pb.FilePreview{}
+	for _, fi := range req.Files {
+		fileInfo, err := files.DecodeFileInfo(fi.Attributes)
+		if err != nil {
+			return nil, err
+		}
+		action := previewNew
+		if rw.existing[fileInfo.Path] {
+			action = previewUnchanged
+		}
+		preview.Actions = append(preview.Actions, action)
+	}
+	return preview, nil
+}
+
+func (rw *recordingWriter) RecordJobRun(ctx context.Context, run *pb.JobRun) (*pb.JobRunRecorded, error) {
+	rw.mu.Lock()
+	defer rw.mu.Unlock()
+	rw.jobRuns = append(rw.jobRuns, run)
+	return &pb.JobRunRecorded{}, nil
+}
+
+// startRecordingWriter serves a recordingWriter in memory and returns a client connected to it
+func startRecordingWriter(t *testing.T) (*recordingWriter, pb.BackupServiceClient) {
+	t.Helper()
+	writer := &recordingWriter{data: map[string][]byte{}, metadata: map[string]*files.FileInfo{}, ends: map[string]*pb.FileEnd{}}
+	return writer, startTestWriter(t, writer)
+}
+
+// startTestWriter serves writer in memory and returns a client connected to it
+func startTestWriter(t *testing.T, writer pb.BackupServiceServer) pb.BackupServiceClient {
+	t.Helper()
+	listener := bufconn.Listen(1 << 20)
+	server := grpc.NewServer()
+	pb.RegisterBackupServiceServer(server, writer)
+	go server.Serve(listener)
+	t.Cleanup(server.Stop)
+
+	conn, err := grpc.NewClient("passthrough:///bufnet",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+			return listener.DialContext(ctx)
+		}),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	)
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return pb.NewBackupServiceClient(conn)
+}
+
+// writeSourceTree creates a small directory to back up and returns it with the content of its files
+func writeSourceTree(t *testing.T) (string, map[string][]byte) {
+	t.Helper()
+	root := t.TempDir()
+	large := make([]byte, 2*chunker.DefaultChunkSize+100)
+	for i := range large {
+		large[i] = byte(i % 253)
+	}
+	contents := map[string][]byte{
+		filepath.Join(root, "small.txt"):        []byte("hello"),
+		filepath.Join(root, "empty"):            {},
+		filepath.Join(root, "sub", "large.bin"): large,
+	}
+	if err := os.Mkdir(filepath.Join(root, "sub"), 0700); err != nil {
+		t.Fatalf("Failed to create directory: %v", err)
+	}
+	for path, data := range contents {
+		if err := os.WriteFile(path, data, 0600); err != nil {
+			t.Fatalf("Failed to write %s: %v", path, err)
+		}
+	}
+	return root, contents
+}
+
+// newTransferContext is newTestContext for files scanned on this host
+func newTransferContext(conf *config.Config) context.Context {
+	return context.WithValue(newTestContext(conf), common.HostnameContextKey, common.GetHostname())
+}
+
+func TestProcessStreamTransfersData(t *testing.T) {
+	root, contents := writeSourceTree(t)
+	fileList, _, err := files.Scan(root, files.ScanOptions{})
+	if err != nil {
+		t.Fatalf("Scan failed: %v", err)
+	}
+
+	writer, client := startRecordingWriter(t)
+	ctx := newTransferContext(&config.Config{ConnectionTimeOutSec: 10})
+	if err := processStream(ctx, client, fileList, 1); err != nil {
+		t.Fatalf("processStream failed: %v", err)
+	}
+
+	if len(writer.ends) != len(fileList) {
+		t.Errorf("Writer got %d files, expected %d", len(writer.ends), len(fileList))
+	}
+	if writer.chunks != 4 {
+		t.Errorf("Writer got %d chunks, expected 4", writer.chunks)
+	}
+	for _, file := range fileList {
+		end, ok := writer.ends[file.GetId()]
+		if !ok {
+			t.Errorf("No FileEnd for %s", file.Path)
+			continue
+		}
+		want, isFile := contents[file.Path]
+		if !isFile {
+			if end.Size != 0 || end.Checksum != "" {
+				t.Errorf("Expected no data for %s", file.Path)
+			}
+			continue
+		}
+		if got := writer.data[file.GetId()]; !bytes.Equal(got, want) {
+			t.Errorf("Data of %s doesn't match the source", file.Path)
+		}
+		if end.Size != int64(len(want)) || end.Checksum != chunker.Checksum(want) {
+			t.Errorf("FileEnd of %s = %d bytes %s, expected %d bytes %s",
+				file.Path, end.Size, end.Checksum, len(want), chunker.Checksum(want))
+		}
+	}
+}
+
+func TestProcessStreamOutlastsConnectionTimeout(t *testing.T) {
+	root, _ := writeSourceTree(t)
+	fileList, _, err := files.Scan(root, files.ScanOptions{})
+	if err != nil {
+		t.Fatalf("Scan failed: %v", err)
+	}
+
+	// The connection timeout limits connecting, not how long a stream takes, and 0 leaves it unset
+	for _, timeout := range []int{1, 0} {
+		writer, client := startRecordingWriter(t)
+		var once sync.Once
+		writer.onFileEnd = func(string) {
+			once.Do(func() { time.Sleep(1200 * time.Millisecond) })
+		}
+		ctx := newTransferContext(&config.Config{ConnectionTimeOutSec: timeout})
+		if err := processStream(ctx, client, fileList, 1); err != nil {
+			t.Fatalf("ConnectionTimeOutSec=%d: processStream failed: %v", timeout, err)
+		}
+		if len(writer.ends) != len(fileList) {
+			t.Errorf("ConnectionTimeOutSec=%d: writer got %d files, expected %d", timeout, len(writer.ends), len(fileList))
+		}
+	}
+}
+
+func TestProcessStreamUnreadableFile(t *testing.T) {
+	root, _ := writeSourceTree(t)
+	fileList, _, err := files.Scan(root, files.ScanOptions{})
+	if err != nil {
+		t.Fatalf("Scan failed: %v", err)
+	}
+	// The file goes away between the scan and the transfer
+	removed := filepath.Join(root, "small.txt")
+	if err := os.Remove(removed); err != nil {
+		t.Fatalf("Failed to remove file: %v", err)
+	}
+
+	t.Run("continue when StopStreamOnFileError is off", func(t *testing.T) {
+		writer, client := startRecordingWriter(t)
+		ctx := newTransferContext(&config.Config{ConnectionTimeOutSec: 10})
+		if err := processStream(ctx, client, fileList, 1); err != nil {
+			t.Fatalf("processStream failed: %v", err)
+		}
+		if len(writer.ends) != len(fileList) {
+			t.Errorf("Writer got %d files, expected %d", len(writer.ends), len(fileList))
+		}
+		for _, file := range fileList {
+			end := writer.ends[file.GetId()]
+			if (file.Path == removed) != (end.GetError() != "") {
+				t.Errorf("FileEnd of %s has error %q", file.Path, end.GetError())
+			}
+		}
+	})
+
+	t.Run("stop when StopStreamOnFileError is on", func(t *testing.T) {
+		_, client := startRecordingWriter(t)
+		ctx := newTransferContext(&config.Config{ConnectionTimeOutSec: 10, StopStreamOnFileError: true})
+		if err := processStream(ctx, client, fileList, 1); err == nil {
+			t.Fatal("Expected read error")
+		}
+	})
+}
+
+func TestProcessStreamReplacedFile(t *testing.T) {
+	root, _ := writeSourceTree(t)
+	fileList, _, err := files.Scan(root, files.ScanOptions{})
+	if err != nil {
+		t.Fatalf("Scan failed: %v", err)
+	}
+	// Another file takes the path between the scan and the transfer
+	replaced := filepath.Join(root, "small.txt")
+	replacement := filepath.Join(root, "replacement.tmp")
+	if err := os.WriteFile(replacement, []byte("new content"), 0644); err != nil {
+		t.Fatalf("Failed to write file: %v", err)
+	}
+	if err := os.Rename(replacement, replaced); err != nil {
+		t.Fatalf("Failed to replace file: %v", err)
+	}
+
+	writer, client := startRecordingWriter(t)
+	ctx := newTransferContext(&config.Config{ConnectionTimeOutSec: 10})
+	if err := processStream(ctx, client, fileList, 1); err != nil {
+		t.Fatalf("processStream failed: %v", err)
+	}
+	for _, file := range fileList {
+		end := writer.ends[file.GetId()]
+		if file.Path == replaced && !strings.Contains(end.GetError(), "replaced") {
+			t.Errorf("FileEnd of replaced %s has error %q", file.Path, end.GetError())
+		}
+		if file.Path != replaced && end.GetError() != "" {
+			t.Errorf("FileEnd of %s has error %q", file.Path, end.GetError())
+		}
+	}
+}
+
+func TestProcessStreamSkipsUnchangedFiles(t *testing.T) {
+	root, contents := writeSourceTree(t)
+	fileList, _, err := files.Scan(root, files.ScanOptions{})
+	if err != nil {
+		t.Fatalf("Scan failed: %v", err)
+	}
+
+	unchanged := filepath.Join(root, "sub", "large.bin")
+	writer, client := startRecordingWriter(t)
+	writer.existing = map[string]bool{unchanged: true}
+	ctx := newTransferContext(&config.Config{ConnectionTimeOutSec: 10})
+	if err := processStream(ctx, client, fileList, 1); err != nil {
+		t.Fatalf("processStream failed: %v", err)
+	}
+
+	for _, file := range fileList {
+		_, sentData := writer.data[file.GetId()]
+		_, sentEnd := writer.ends[file.GetId()]
+		if file.Path == unchanged {
+			if sentData || sentEnd {
+				t.Errorf("Data of unchanged file %s was sent", file.Path)
+			}
+			continue
+		}
+		if !sentEnd {
+			t.Errorf("Needed file %s wasn't sent", file.Path)
+		}
+		if want := contents[file.Path]; len(want) > 0 && !bytes.Equal(writer.data[file.GetId()], want) {
+			t.Errorf("Data of %s doesn't match the source", file.Path)
+		}
+	}
+	if writer.chunks != 1 {
+		t.Errorf("Writer got %d chunks, expected only the small file's", writer.chunks)
+	}
+}
+
+func TestProcessStreamSkipsStoredContent(t *testing.T) {
+	root, contents := writeSourceTree(t)
+	fileList, _, err := files.Scan(root, files.ScanOptions{})
+	if err != nil {
+		t.Fatalf("Scan failed: %v", err)
+	}
+
+	// The large file's content was backed up from another host
+	large := filepath.Join(root, "sub", "large.bin")
+	writer, client := startRecordingWriter(t)
+	writer.stored = map[string]bool{chunker.Checksum(contents[large]): true}
+	ctx := newTransferContext(&config.Config{ConnectionTimeOutSec: 10})
+	ctx = withStoredContent(ctx, &storedContent{client: client})
+	if err := processStream(ctx, client, fileList, 1); err != nil {
+		t.Fatalf("processStream failed: %v", err)
+	}
+
+	for _, file := range fileList {
+		end, ok := writer.ends[file.GetId()]
+		if !ok {
+			t.Errorf("No FileEnd for %s", file.Path)
+			continue
+		}
+		if file.Path != large {
+			if end.StoredContent {
+				t.Errorf("%s marked as stored content", file.Path)
+			}
+			continue
+		}
+		if !end.StoredContent || end.Checksum != chunker.Checksum(contents[large]) || end.Size != int64(len(contents[large])) {
+			t.Errorf("FileEnd of %s = %v, expected stored content with its checksum and size", file.Path, end)
+		}
+		if _, sent := writer.data[file.GetId()]; sent {
+			t.Errorf("Data of %s sent although the writer stores it", file.Path)
+		}
+	}
+	if writer.chunks != 1 {
+		t.Errorf("Writer got %d chunks, expected only the small file's", writer.chunks)
+	}
+}
+
+func TestProcessStreamUsesChecksumCache(t *testing.T) {
+	root, contents := writeSourceTree(t)
+	fileList, _, err := files.Scan(root, files.ScanOptions{})
+	if err != nil {
+		t.Fatalf("Scan failed: %v", err)
+	}
+	large := filepath.Join(root, "sub", "large.bin")
+	var largeInfo files.FileInfo
+	for _, file := range fileList {
+		if file.Path == large {
+			largeInfo = file
+		}
+	}
+
+	// The first run caches the checksums of the files it sends
+	cache := chunker.NewChecksumCache()
+	_, client := startRecordingWriter(t)
+	ctx := withChecksumCache(newTransferContext(&config.Config{ConnectionTimeOutSec: 10}), cache)
+	ctx = withStoredContent(ctx, &storedContent{client: client})
+	if err := processStream(ctx, client, fileList, 1); err != nil {
+		t.Fatalf("processStream failed: %v", err)
+	}
+	if checksum, ok := cache.Lookup(&largeInfo, chunker.HashBLAKE3); !ok || checksum != chunker.Checksum(contents[large]) {
+		t.Fatalf("Cached checksum of %s = %q, %v, expected its content's", large, checksum, ok)
+	}
+
+	// The next run takes the checksum from the cache instead of reading the file
+	cache.Store(&largeInfo, "cached")
+	writer, client := startRecordingWriter(t)
+	writer.stored = map[string]bool{"cached": true}
+	ctx = withChecksumCache(newTransferContext(&config.Config{ConnectionTimeOutSec: 10}), cache)
+	ctx = withStoredContent(ctx, &storedContent{client: client})
+	if err := processStream(ctx, client, fileList, 1); err != nil {
+		t.Fatalf("processStream failed: %v", err)
+	}
+	if end := writer.ends[largeInfo.GetId()]; end == nil || !end.StoredContent || end.Checksum != "cached" {
+		t.Errorf("FileEnd of %s = %v, expected stored content with the cached checksum", large, end)
+	}
+}
+
+func TestProcessStreamBatchesMetadata(t *testing.T) {
+	root := t.TempDir()
+	for i := range 7 {
+		if err := os.WriteFile(filepath.Join(root, fmt.Sprintf("file%d", i)), []byte(fmt.Sprintf("content %d", i)), 0600); err != nil {
+			t.Fatalf("Failed to write file: %v", err)
+		}
+	}
+	fileList, _, err := files.Scan(root, files.ScanOptions{})
+	if err != nil {
+		t.Fatalf("Scan failed: %v", err)
+	}
+	var regular []files.FileInfo
+	for _, file := range fileList {
+		if file.Mode.IsRegular() {
+			regular = append(regular, file)
+		}
+	}
+
+	// Every other file is already backed up
+	writer, client := startRecordingWriter(t)
+	writer.existing = map[string]bool{}
+	for i := 0; i < len(regular); i += 2 {
+		writer.existing[regular[i].Path] = true
+	}
+
+	ctx := newTransferContext(&config.Config{ConnectionTimeOutSec: 10, ClientHashQueryBatchSize: 3})
+	if err := processStream(ctx, client, regular, 1); err != nil {
+		t.Fatalf("processStream failed: %v", err)
+	}
+
+	if fmt.Sprint(writer.batches) != "[3 3 1]" {
+		t.Errorf("Batch sizes = %v, expected [3 3 1]", writer.batches)
+	}
+	for _, file := range regular {
+		_, sent := writer.ends[file.GetId()]
+		if sent == writer.existing[file.Path] {
+			t.Errorf("%s sent = %v, already backed up = %v", file.Path, sent, writer.existing[file.Path])
+		}
+	}
+}
+
+// writeLargeCopies writes two large files with the same content and one of the same size with other
+// content, as dedup candidates linkToSent doesn't read whole, and returns their content by path
+func writeLargeCopies(t *testing.T) (string, map[string][]byte) {
+	t.Helper()
+	root := t.TempDir()
+	content := make([]byte, maxReadWhole+100)
+	for i := range content {
+		content[i] = byte(i % 251)
+	}
+	different := bytes.Clone(content)
+	different[0] ^= 0xff
+	sources := map[string][]byte{
+		filepath.Join(root, "original.bin"):  content,
+		filepath.Join(root, "copy.bin"):      content,
+		filepath.Join(root, "different.bin"): different,
+	}
+	for path, data := range sources {
+		if err := os.WriteFile(path, data, 0600); err != nil {
+			t.Fatalf("Failed to write %s: %v", path, err)
+		}
+	}
+	return root, sources
+}
+
+// slowFileChecksum makes hashing a file for hashCandidates take at least delay
+func slowFileChecksum(t *testing.T, delay time.Duration) {
+	t.Helper()
+	fileChecksum = func(f *os.File, algo string) (string, error) {
+		time.Sleep(delay)
+		return chunker.FileChecksum(f, algo)
+	}
+	t.Cleanup(func() { fileChecksum = chunker.FileChecksum })
+}
+
+func TestProcessStreamHashesLargeCopiesFirst(t *testing.T) {
+	root, sources := writeLargeCopies(t)
+	fileList, _, err := files.Scan(root, files.ScanOptions{})
+	if err != nil {
+		t.Fatalf("Scan failed: %v", err)
+	}
+	// Hashing takes longer than the writer waits for a message, it must happen before the stream opens
+	slowFileChecksum(t, 400*time.Millisecond)
+
+	writer, client := startRecordingWriter(t)
+	ctx := withDedup(newTransferContext(&config.Config{ConnectionTimeOutSec: 10}), newRunDedup(fileList))
+	if err := processStream(ctx, client, fileList, 1); err != nil {
+		t.Fatalf("processStream failed: %v", err)
+	}
+	if writer.maxSilence >= 300*time.Millisecond {
+		t.Errorf("Stream went %v without a message while hashing", writer.maxSilence)
+	}
+
+	var linked []string
+	for _, file := range fileList {
+		end := writer.ends[file.GetId()]
+		if end.GetSameAs() == "" {
+			continue
+		}
+		linked = append(linked, file.Path)
+		if !bytes.Equal(sources[end.SameAs], sources[file.Path]) || end.SameAs == file.Path {
+			t.Errorf("%s linked to %s, which has other content", file.Path, end.SameAs)
+		}
+		if _, ok := writer.data[file.GetId()]; ok {
+			t.Errorf("Data of linked file %s was sent", file.Path)
+		}
+	}
+	if len(linked) != 1 {
+		t.Errorf("Linked %v, expected one of the copies", linked)
+	}
+}
+
+func TestProcessStreamHashesLargeFilesFirstForStoredContent(t *testing.T) {
+	root, sources := writeLargeCopies(t)
+	fileList, _, err := files.Scan(root, files.ScanOptions{})
+	if err != nil {
+		t.Fatalf("Scan failed: %v", err)
+	}
+	slowFileChecksum(t, 400*time.Millisecond)
+
+	// The writer stores the content of the copies, not that of the other file
+	stored := chunker.Checksum(sources[filepath.Join(root, "copy.bin")])
+	writer, client := startRecordingWriter(t)
+	writer.stored = map[string]bool{stored: true}
+	ctx := newTransferContext(&config.Config{ConnectionTimeOutSec: 10})
+	ctx = withStoredContent(ctx, &storedContent{client: client})
+	if err := processStream(ctx, client, fileList, 1); err != nil {
+		t.Fatalf("processStream failed: %v", err)
+	}
+	if writer.maxSilence >= 300*time.Millisecond {
+		t.Errorf("Stream went %v without a message while hashing", writer.maxSilence)
+	}
+
+	for _, file := range fileList {
+		data, ok := sources[file.Path]
+		if !ok {
+			continue
+		}
+		end := writer.ends[file.GetId()]
+		_, sent := writer.data[file.GetId()]
+		if want := chunker.Checksum(data) == stored; end.StoredContent != want || sent == want {
+			t.Errorf("%s: stored content %v, data sent %v, expected stored content %v", file.Path, end.StoredContent, sent, want)
+		}
+	}
+}
+
+func TestProcessStreamLinksIdenticalFiles(t *testing.T) {
+	root := t.TempDir()
+	content := make([]byte, chunker.DefaultChunkSize+100)
+	for i := range content {
+		content[i] = byte(i % 251)
+	}
+	different := bytes.Clone(content)
+	different[0] ^= 0xff
+	sources := map[string][]byte{
+		filepath.Join(root, "original.bin"):  content,
+		filepath.Join(root, "copy.bin"):      content,
+		filepath.Join(root, "different.bin"): different,
+	}
+	for path, data := range sources {
+		if err := os.WriteFile(path, data, 0600); err != nil {
+			t.Fatalf("Failed to write %s: %v", path, err)
+		}
+	}
+	fileList, _, err := files.Scan(root, files.ScanOptions{})
+	if err != nil {
+		t.Fatalf("Scan failed: %v", err)
+	}
+
+	writer, client := startRecordingWriter(t)
+	ctx := withDedup(newTransferContext(&config.Config{ConnectionTimeOutSec: 10}), newRunDedup(fileList))
+	if err := processStream(ctx, client, fileList, 1); err != nil {
+		t.Fatalf("processStream failed: %v", err)
+	}
+
+	// Both copies share content, whichever was sent second links to the first
+	var sent, linked []string
+	for _, file := range fileList {
+		if _, ok := sources[file.Path]; !ok {
+			continue
+		}
+		end := writer.ends[file.GetId()]
+		if end.GetSameAs() != "" {
+			linked = append(linked, file.Path)
+			if _, ok := writer.data[file.GetId()]; ok {
+				t.Errorf("Data of linked file %s was sent", file.Path)
+			}
+			if end.Checksum != chunker.Checksum(content) || end.Size != int64(len(content)) {
+				t.Errorf("Linked FileEnd of %s = %d bytes %s", file.Path, end.Size, end.Checksum)
+			}
+			if !bytes.Equal(sources[end.SameAs], sources[file.Path]) || end.SameAs == file.Path {
+				t.Errorf("%s linked to %s, which has other content", file.Path, end.SameAs)
+			}
+			continue
+		}
+		sent = append(sent, file.Path)
+		if !bytes.Equal(writer.data[file.GetId()], sources[file.Path]) {
+			t.Errorf("Data of %s doesn't match the source", file.Path)
+		}
+	}
+	if len(linked) != 1 || len(sent) != 2 {
+		t.Errorf("Sent %v and linked %v, expected one of the copies linked", sent, linked)
+	}
+	if writer.chunks != 4 {
+		t.Errorf("Writer got %d chunks, expected 4 for the two distinct contents", writer.chunks)
+	}
+}
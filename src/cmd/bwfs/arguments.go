@@ -10,14 +10,14 @@ import (
 
 // Command line flags
 var (
-	port  int
+	ports []int
 	debug bool
 )
 
 // Arguments holds parsed command line arguments
 type Arguments struct {
 	StoragePath string
-	Port        int
+	Ports       []int
 	Debug       bool
 	Quiet       bool
 }
@@ -32,7 +32,7 @@ func parseArguments(conf *config.Config) (*Arguments, error) {
 	}
 
 	// Add flags
-	cmd.Flags().IntVar(&port, "port", conf.DefaultPort, "Port to listen on")
+	cmd.Flags().IntSliceVar(&ports, "port", []int{conf.DefaultPort}, "Port to listen on, repeat to listen on several ports")
 	cmd.Flags().BoolVar(&debug, "debug", false, "Enable debug logging")
 	cmd.Flags().BoolVar(&debug, "quiet", false, "Enable quiet mode")
 
@@ -44,14 +44,21 @@ func parseArguments(conf *config.Config) (*Arguments, error) {
 	// Get the storage path from parsed args
 	storagePath := cmd.Flags().Args()[0]
 
-	// Validate port
-	if err := common.ValidatePort(port); err != nil {
-		return nil, fmt.Errorf("port error: %w", err)
+	// Validate ports
+	seen := make(map[int]bool)
+	for _, port := range ports {
+		if err := common.ValidatePort(port); err != nil {
+			return nil, fmt.Errorf("port error: %w", err)
+		}
+		if seen[port] {
+			return nil, fmt.Errorf("port error: port %d given more than once", port)
+		}
+		seen[port] = true
 	}
 
 	return &Arguments{
 		StoragePath: storagePath,
-		Port:        port,
+		Ports:       ports,
 		Debug:       debug,
 	}, nil
 }
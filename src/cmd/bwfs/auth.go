@@ -0,0 +1,74 @@
+package main
+
+import (
+	"context"
+	"slices"
+
+	"github.com/alex-sviridov/miniprotector/common/config"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+// clientNames returns the names from the peer's verified client certificate, CN first and then DNS SANs
+// Returns nil for plaintext connections or when no client certificate was verified
+func clientNames(p *peer.Peer) []string {
+	tlsInfo, ok := p.AuthInfo.(credentials.TLSInfo)
+	if !ok || len(tlsInfo.State.VerifiedChains) == 0 || len(tlsInfo.State.VerifiedChains[0]) == 0 {
+		return nil
+	}
+
+	cert := tlsInfo.State.VerifiedChains[0][0]
+	var names []string
+	if cert.Subject.CommonName != "" {
+		names = append(names, cert.Subject.CommonName)
+	}
+	return append(names, cert.DNSNames...)
+}
+
+// authorizeClient checks the verified client names against AllowedClientHosts
+// An empty allowlist accepts every client
+func authorizeClient(conf *config.Config, names []string) error {
+	if len(conf.AllowedClientHosts) == 0 {
+		return nil
+	}
+	for _, name := range names {
+		if slices.Contains(conf.AllowedClientHosts, name) {
+			return nil
+		}
+	}
+	return status.Errorf(codes.PermissionDenied, "client %v is not allowed to push backups", names)
+}
+
+// callerNames returns clientNames for the peer of a call, nil without one
+func callerNames(ctx context.Context) []string {
+	if p, ok := peer.FromContext(ctx); ok && p.AuthInfo != nil {
+		return clientNames(p)
+	}
+	return nil
+}
+
+// authorizeHost checks that a client of an allowlist only sends or reads backups of its own host,
+// host must be one of its verified names
+// An empty allowlist accepts any host
+func authorizeHost(conf *config.Config, names []string, host string) error {
+	if len(conf.AllowedClientHosts) == 0 || slices.Contains(names, host) {
+		return nil
+	}
+	return status.Errorf(codes.PermissionDenied, "client %v is not allowed to act for host %q", names, host)
+}
+
+// authorizeCall runs authorizeClient for the peer of a unary call, and authorizeHost for the hosts it acts for
+func authorizeCall(ctx context.Context, conf *config.Config, hosts ...string) error {
+	names := callerNames(ctx)
+	if err := authorizeClient(conf, names); err != nil {
+		return err
+	}
+	for _, host := range hosts {
+		if err := authorizeHost(conf, names, host); err != nil {
+			return err
+		}
+	}
+	return nil
+}
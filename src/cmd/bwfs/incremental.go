@@ -0,0 +1,51 @@
+package main
+
+import (
+	"path/filepath"
+	"strings"
+
+	"github.com/alex-sviridov/miniprotector/common/wfs"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	pb "github.com/alex-sviridov/miniprotector/api"
+)
+
+// ListBackedUpFiles streams the latest version of every file a host backed up below a path,
+// so that an incremental run sends only the files changed since. A listing stops between files
+// when the reader goes away or the server shuts down, rather than walking the whole catalog.
+func (s *BackupStream) ListBackedUpFiles(req *pb.BackedUpFilesRequest, stream pb.BackupService_ListBackedUpFilesServer) error {
+	ctx := stream.Context()
+	if err := authorizeCall(ctx, s.config.Load(), req.Host); err != nil {
+		return err
+	}
+	if req.Host == "" || req.Path == "" {
+		return status.Error(codes.InvalidArgument, "listing without host or path")
+	}
+	prefix := strings.TrimSuffix(req.Path, string(filepath.Separator)) + string(filepath.Separator)
+	err := s.writer.ForEachFileForHost(req.Host, func(file *wfs.FileMetadata) error {
+		select {
+		case <-s.stopping:
+			return status.Error(codes.Unavailable, "server shutting down")
+		case <-ctx.Done():
+			return status.FromContextError(ctx.Err()).Err()
+		default:
+		}
+		if file.FileInfo.Path != req.Path && !strings.HasPrefix(file.FileInfo.Path, prefix) {
+			return nil
+		}
+		return stream.Send(&pb.BackedUpFile{
+			Path:             file.FileInfo.Path,
+			Size:             file.FileInfo.Size,
+			ModTimeUnixNs:    file.FileInfo.ModTime.UnixNano(),
+			ChangeTimeUnixNs: file.FileInfo.ChangeTime.UnixNano(),
+		})
+	})
+	if err != nil {
+		if _, ok := status.FromError(err); ok {
+			return err
+		}
+		return status.Errorf(codes.Internal, "failed to list files: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	pb "github.com/alex-sviridov/miniprotector/api"
+	"github.com/alex-sviridov/miniprotector/common/config"
+	"github.com/alex-sviridov/miniprotector/common/files"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestListBackedUpFiles(t *testing.T) {
+	root := t.TempDir()
+	// "data" is a prefix of "database" without being its parent
+	for _, dir := range []string{"data", "database"} {
+		if err := os.Mkdir(filepath.Join(root, dir), 0700); err != nil {
+			t.Fatalf("Failed to create directory: %v", err)
+		}
+		if err := os.WriteFile(filepath.Join(root, dir, "file.txt"), []byte(dir), 0600); err != nil {
+			t.Fatalf("Failed to write file: %v", err)
+		}
+	}
+	_, client := startTestBackupStream(t, &config.Config{})
+	fileList, _ := backupTree(t, client, root)
+
+	list := func(host, path string) (map[string]*pb.BackedUpFile, error) {
+		t.Helper()
+		stream, err := client.ListBackedUpFiles(context.Background(), &pb.BackedUpFilesRequest{Host: host, Path: path})
+		if err != nil {
+			t.Fatalf("ListBackedUpFiles failed: %v", err)
+		}
+		listed := make(map[string]*pb.BackedUpFile)
+		for {
+			file, err := stream.Recv()
+			if err == io.EOF {
+				return listed, nil
+			}
+			if err != nil {
+				return nil, err
+			}
+			listed[file.Path] = file
+		}
+	}
+
+	host := fileList[0].Host
+	dataDir := filepath.Join(root, "data")
+	listed, err := list(host, dataDir)
+	if err != nil {
+		t.Fatalf("Listing failed: %v", err)
+	}
+	for _, file := range fileList {
+		got, ok := listed[file.Path]
+		below := file.Path == dataDir || filepath.Dir(file.Path) == dataDir
+		switch {
+		case ok != below:
+			t.Errorf("%s listed = %v, expected %v", file.Path, ok, below)
+		case ok && (got.Size != file.Size || got.ModTimeUnixNs != file.ModTime.UnixNano() || got.ChangeTimeUnixNs != file.ChangeTime.UnixNano()):
+			t.Errorf("%s listed as %+v, expected the scanned size and times", file.Path, got)
+		}
+	}
+
+	if listed, err := list("other host", root); err != nil || len(listed) != 0 {
+		t.Errorf("Other host listed %d files (%v), expected none", len(listed), err)
+	}
+	if _, err := list(host, ""); status.Code(err) != codes.InvalidArgument {
+		t.Errorf("Listing without path = %v, expected InvalidArgument", err)
+	}
+}
+
+// listingStream collects a listing, calling onSend after each file
+type listingStream struct {
+	grpc.ServerStream
+	ctx    context.Context
+	sent   []*pb.BackedUpFile
+	onSend func()
+}
+
+func (ls *listingStream) Context() context.Context {
+	return ls.ctx
+}
+
+func (ls *listingStream) Send(file *pb.BackedUpFile) error {
+	ls.sent = append(ls.sent, file)
+	ls.onSend()
+	return nil
+}
+
+func TestListBackedUpFilesStops(t *testing.T) {
+	backupStream, _ := startTestBackupStream(t, &config.Config{})
+	for i := range 10 {
+		fileInfo := &files.FileInfo{Host: "host", Path: fmt.Sprintf("/data/%d", i), Mode: os.ModeDir | 0755, ModTime: time.Now()}
+		if err := backupStream.writer.AddFile(fileInfo, ""); err != nil {
+			t.Fatalf("Failed to add file: %v", err)
+		}
+	}
+	req := &pb.BackedUpFilesRequest{Host: "host", Path: "/data"}
+
+	// The reader goes away after the first file
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	stream := &listingStream{ctx: ctx, onSend: cancel}
+	if err := backupStream.ListBackedUpFiles(req, stream); status.Code(err) != codes.Canceled {
+		t.Errorf("Expected Canceled, got %v", err)
+	}
+	if len(stream.sent) != 1 {
+		t.Errorf("Sent %d files after the reader went away, expected 1", len(stream.sent))
+	}
+
+	// The server shuts down after the first file
+	stream = &listingStream{ctx: context.Background(), onSend: backupStream.stopStreams}
+	if err := backupStream.ListBackedUpFiles(req, stream); status.Code(err) != codes.Unavailable {
+		t.Errorf("Expected Unavailable, got %v", err)
+	}
+	if len(stream.sent) != 1 {
+		t.Errorf("Sent %d files after shutdown started, expected 1", len(stream.sent))
+	}
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"github.com/alex-sviridov/miniprotector/common/wfs"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	pb "github.com/alex-sviridov/miniprotector/api"
+)
+
+// RecordJobRun stores the summary a reader sends once all streams of a backup run ended
+func (s *BackupStream) RecordJobRun(ctx context.Context, req *pb.JobRun) (*pb.JobRunRecorded, error) {
+	if err := authorizeCall(ctx, s.config.Load(), req.Host); err != nil {
+		return nil, err
+	}
+	if req.Host == "" {
+		return nil, status.Error(codes.InvalidArgument, "job run without host")
+	}
+	if !validJobID(req.JobId) {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid job id %.64q", req.JobId)
+	}
+	err := s.writer.RecordJobRun(wfs.JobRun{
+		JobID:        req.JobId,
+		Host:         req.Host,
+		Started:      time.UnixMilli(req.StartedUnixMs),
+		Finished:     time.UnixMilli(req.FinishedUnixMs),
+		FilesScanned: req.FilesScanned,
+		FilesStored:  req.FilesStored,
+		FilesSkipped: req.FilesSkipped,
+		FilesFailed:  req.FilesFailed,
+		BytesSent:    req.BytesSent,
+		Errors:       req.Errors,
+		Interrupted:  req.Interrupted,
+	})
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to record job run: %v", err)
+	}
+	if s.jobs.finish(jobKey{req.Host, req.JobId}) {
+		s.dropStreamProgress(req.Host, req.JobId)
+	}
+	s.logger.Info("Job run recorded", "job_id", req.JobId, "host", req.Host,
+		"stored", req.FilesStored, "skipped", req.FilesSkipped, "failed", req.FilesFailed)
+	return &pb.JobRunRecorded{}, nil
+}
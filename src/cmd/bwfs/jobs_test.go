@@ -0,0 +1,63 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	pb "github.com/alex-sviridov/miniprotector/api"
+	"github.com/alex-sviridov/miniprotector/common/config"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestRecordJobRun(t *testing.T) {
+	backupStream, client := startTestBackupStream(t, &config.Config{})
+	started := time.Now().Add(-time.Minute).Truncate(time.Millisecond)
+	for i, jobID := range []string{"first", "second"} {
+		_, err := client.RecordJobRun(context.Background(), &pb.JobRun{
+			JobId:          jobID,
+			Host:           "host",
+			StartedUnixMs:  started.Add(time.Duration(i) * time.Second).UnixMilli(),
+			FinishedUnixMs: started.Add(time.Duration(i)*time.Second + 500*time.Millisecond).UnixMilli(),
+			FilesScanned:   10,
+			FilesStored:    6,
+			FilesSkipped:   3,
+			FilesFailed:    1,
+			BytesSent:      4096,
+			Errors:         1,
+		})
+		if err != nil {
+			t.Fatalf("RecordJobRun failed: %v", err)
+		}
+	}
+
+	run, err := backupStream.writer.GetJobRun("first")
+	if err != nil {
+		t.Fatalf("GetJobRun failed: %v", err)
+	}
+	if run.Host != "host" || !run.Started.Equal(started) || !run.Finished.Equal(started.Add(500*time.Millisecond)) {
+		t.Errorf("Job run from %q between %v and %v, expected host from %v", run.Host, run.Started, run.Finished, started)
+	}
+	if run.FilesScanned != 10 || run.FilesStored != 6 || run.FilesSkipped != 3 || run.FilesFailed != 1 || run.BytesSent != 4096 || run.Errors != 1 {
+		t.Errorf("Job run counts = %+v", run)
+	}
+	if _, err := backupStream.writer.GetJobRun("unknown"); err == nil {
+		t.Error("Expected an error for an unknown job")
+	}
+
+	runs, err := backupStream.writer.ListJobRuns("host")
+	if err != nil {
+		t.Fatalf("ListJobRuns failed: %v", err)
+	}
+	if len(runs) != 2 || runs[0].JobID != "first" || runs[1].JobID != "second" {
+		t.Errorf("Listed %+v, expected first and second in order", runs)
+	}
+	if runs, _ := backupStream.writer.ListJobRuns("other"); len(runs) != 0 {
+		t.Errorf("Listed %d runs of another host", len(runs))
+	}
+
+	if _, err := client.RecordJobRun(context.Background(), &pb.JobRun{Host: "host"}); status.Code(err) != codes.InvalidArgument {
+		t.Errorf("Expected InvalidArgument for a run without job id, got %v", err)
+	}
+}
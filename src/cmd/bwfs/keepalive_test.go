@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	pb "github.com/alex-sviridov/miniprotector/api"
+	"github.com/alex-sviridov/miniprotector/common/config"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+// stallingConn is a client connection that can go silent like one dropped by a NAT: once stalled,
+// nothing it sends arrives and nothing reaches it
+type stallingConn struct {
+	net.Conn
+	stalled, closed      chan struct{}
+	stallOnce, closeOnce sync.Once
+}
+
+func (c *stallingConn) stall() {
+	c.stallOnce.Do(func() { close(c.stalled) })
+}
+
+func (c *stallingConn) Close() error {
+	c.closeOnce.Do(func() { close(c.closed) })
+	return c.Conn.Close()
+}
+
+func (c *stallingConn) Read(b []byte) (int, error) {
+	select {
+	case <-c.stalled:
+		// Block until the client gives up, the data already on its way is lost
+		<-c.closed
+		return 0, net.ErrClosed
+	default:
+	}
+	return c.Conn.Read(b)
+}
+
+func (c *stallingConn) Write(b []byte) (int, error) {
+	select {
+	case <-c.stalled:
+		return len(b), nil
+	default:
+		return c.Conn.Write(b)
+	}
+}
+
+// trackedStream is a BackupStream reporting when its streams start and end
+type trackedStream struct {
+	*BackupStream
+	started, ended chan struct{}
+}
+
+func (ts *trackedStream) ProcessBackupStream(stream pb.BackupService_ProcessBackupStreamServer) error {
+	close(ts.started)
+	defer close(ts.ended)
+	return ts.BackupStream.ProcessBackupStream(stream)
+}
+
+func TestHeartbeatDropsStalledClient(t *testing.T) {
+	conf := &config.Config{HeartbeatSec: 1}
+	backupStream, err := NewBackupStream(newTestContext(conf), t.TempDir())
+	if err != nil {
+		t.Fatalf("Failed to create backup stream: %v", err)
+	}
+	defer backupStream.writer.Close()
+	grpcServer, err := newGRPCServer(conf)
+	if err != nil {
+		t.Fatalf("Failed to create server: %v", err)
+	}
+	service := &trackedStream{BackupStream: backupStream, started: make(chan struct{}), ended: make(chan struct{})}
+	pb.RegisterBackupServiceServer(grpcServer, service)
+	listener := bufconn.Listen(1024 * 1024)
+	go grpcServer.Serve(listener)
+	defer grpcServer.Stop()
+
+	conn := make(chan *stallingConn, 1)
+	client, err := grpc.NewClient("passthrough:///bufnet",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+			c, err := listener.DialContext(ctx)
+			if err != nil {
+				return nil, err
+			}
+			stalling := &stallingConn{Conn: c, stalled: make(chan struct{}), closed: make(chan struct{})}
+			select {
+			case conn <- stalling:
+			default:
+			}
+			return stalling, nil
+		}),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	)
+	if err != nil {
+		t.Fatalf("Failed to create client: %v", err)
+	}
+	defer client.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if _, err := pb.NewBackupServiceClient(client).ProcessBackupStream(ctx); err != nil {
+		t.Fatalf("Failed to open stream: %v", err)
+	}
+	select {
+	case <-service.started:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Stream handler did not start")
+	}
+
+	// The stream is idle and the client stops answering: the writer's pings go unanswered
+	(<-conn).stall()
+	select {
+	case <-service.ended:
+	case <-time.After(10 * time.Second):
+		t.Fatal("Stalled client's stream still open after 10s")
+	}
+}
@@ -4,6 +4,8 @@ import (
 	"context"
 	"fmt"
 	"os"
+	"os/signal"
+	"syscall"
 
 	"github.com/alex-sviridov/miniprotector/common/config"
 	"github.com/alex-sviridov/miniprotector/common/logging"
@@ -20,6 +22,9 @@ func main() {
 
 	// Get configuration
 	conf, err := config.ParseConfig(configPath)
+	if err == nil {
+		err = config.ApplyEnvOverrides(conf)
+	}
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "Configuration error: %v\n", err)
 		os.Exit(1)
@@ -45,13 +50,21 @@ func main() {
 	}()
 	ctx = context.WithValue(ctx, logging.ContextKey, logger)
 
+	for _, key := range conf.UnknownKeys {
+		logger.Warn("Unknown configuration key ignored", "key", key, "config", configPath)
+	}
+
 	logger.Info("Backup writer started",
 		"StoragePath", arguments.StoragePath,
-		"serverPort", arguments.Port,
+		"serverPorts", arguments.Ports,
 	)
 
+	// Shut down gracefully on interrupt or termination
+	ctx, stop := signal.NotifyContext(ctx, os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
 	// Start server
-	if err := startServer(ctx, arguments.Port, arguments.StoragePath); err != nil {
+	if err := startServer(ctx, arguments.Ports, arguments.StoragePath, configPath); err != nil {
 		logger.Error("Server failed", "error", err)
 		os.Exit(1)
 	}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/alex-sviridov/miniprotector/common/files"
+	"github.com/alex-sviridov/miniprotector/common/wfs"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	pb "github.com/alex-sviridov/miniprotector/api"
+)
+
+// Actions answered by PreviewFiles
+const (
+	previewNew       = "new"
+	previewChanged   = "changed"
+	previewMetadata  = "metadata"
+	previewUnchanged = "unchanged"
+)
+
+// PreviewFiles tells what backing up a batch of files would do, checking them against the catalog
+// like ProcessBackupStream does, for a dry run of the reader. Nothing is recorded: no file, metadata,
+// chunk or stream progress is written.
+func (s *BackupStream) PreviewFiles(ctx context.Context, req *pb.FileBatch) (*pb.FilePreview, error) {
+	conf := s.config.Load()
+	if err := authorizeCall(ctx, conf); err != nil {
+		return nil, err
+	}
+	if len(req.Files) > maxBatchFiles {
+		return nil, status.Errorf(codes.InvalidArgument, "batch of %d files exceeds the limit of %d", len(req.Files), maxBatchFiles)
+	}
+	fileInfos := make([]*files.FileInfo, len(req.Files))
+	for i, fi := range req.Files {
+		fileInfo, err := files.DecodeFileInfo(fi.Attributes)
+		if err != nil {
+			return nil, status.Errorf(codes.InvalidArgument, "invalid metadata of file %s: %v", fi.FileId, err)
+		}
+		if err := authorizeHost(conf, callerNames(ctx), fileInfo.Host); err != nil {
+			return nil, err
+		}
+		fileInfos[i] = fileInfo
+	}
+	actions, err := s.previewActions(fileInfos)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to look up files: %v", err)
+	}
+	return &pb.FilePreview{Actions: actions}, nil
+}
+
+// previewActions returns what a backup would do with each file
+func (s *BackupStream) previewActions(fileInfos []*files.FileInfo) ([]string, error) {
+	statuses, err := s.writer.FileStatuses(fileInfos)
+	if err != nil {
+		return nil, err
+	}
+	actions := make([]string, len(fileInfos))
+	for i, fileInfo := range fileInfos {
+		switch statuses[i] {
+		case wfs.FileUnchanged:
+			actions[i] = previewUnchanged
+		case wfs.FileMetadataChanged:
+			actions[i] = previewMetadata
+		default:
+			// No version with this modtime, any version at all makes it a change
+			previous, err := s.writer.GetFile(fileInfo.Path, fileInfo.Host)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", fileInfo.Path, err)
+			}
+			if previous == nil {
+				actions[i] = previewNew
+			} else {
+				actions[i] = previewChanged
+			}
+		}
+	}
+	return actions, nil
+}
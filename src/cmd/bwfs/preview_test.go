@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	pb "github.com/alex-sviridov/miniprotector/api"
+	"github.com/alex-sviridov/miniprotector/common/config"
+	"github.com/alex-sviridov/miniprotector/common/files"
+)
+
+// previewTree scans root and asks the writer what backing it up would do, returning the files by action
+func previewTree(t *testing.T, client pb.BackupServiceClient, root string) map[string][]string {
+	t.Helper()
+	fileList, _, err := files.Scan(root, files.ScanOptions{})
+	if err != nil {
+		t.Fatalf("Scan failed: %v", err)
+	}
+	batch := &pb.FileBatch{}
+	for i := range fileList {
+		attributes, err := files.Encode(&fileList[i])
+		if err != nil {
+			t.Fatalf("Failed to encode %s: %v", fileList[i].Path, err)
+		}
+		batch.Files = append(batch.Files, &pb.FileInfo{FileId: fileList[i].GetId(), Attributes: attributes})
+	}
+	preview, err := client.PreviewFiles(context.Background(), batch)
+	if err != nil {
+		t.Fatalf("PreviewFiles failed: %v", err)
+	}
+	if len(preview.Actions) != len(fileList) {
+		t.Fatalf("Got %d actions for %d files", len(preview.Actions), len(fileList))
+	}
+	byAction := make(map[string][]string)
+	for i, action := range preview.Actions {
+		byAction[action] = append(byAction[action], fileList[i].Path)
+	}
+	return byAction
+}
+
+func TestPreviewFiles(t *testing.T) {
+	root := t.TempDir()
+	modified := filepath.Join(root, "modified.txt")
+	chmodded := filepath.Join(root, "chmodded.txt")
+	for _, path := range []string{modified, chmodded, filepath.Join(root, "kept.txt")} {
+		if err := os.WriteFile(path, []byte(filepath.Base(path)), 0600); err != nil {
+			t.Fatalf("Failed to write %s: %v", path, err)
+		}
+	}
+	backupStream, client := startTestBackupStream(t, &config.Config{})
+	fileList, _, err := files.Scan(root, files.ScanOptions{})
+	if err != nil {
+		t.Fatalf("Scan failed: %v", err)
+	}
+	host := fileList[0].Host
+
+	// Before the first backup every file would be added, and the preview records none of them
+	byAction := previewTree(t, client, root)
+	if len(byAction[previewNew]) != 4 || len(byAction) != 1 {
+		t.Fatalf("Preview of a new tree = %v, expected the directory and 3 files as new", byAction)
+	}
+	if stored, err := backupStream.writer.ListFilesForHost(host); err != nil || len(stored) != 0 {
+		t.Fatalf("Writer holds %d files after a preview (%v), expected none", len(stored), err)
+	}
+	_, results := backupTree(t, client, root)
+	if len(results) != len(byAction[previewNew]) {
+		t.Errorf("Backup sent %d files, the preview announced %d", len(results), len(byAction[previewNew]))
+	}
+
+	// One file gets new content, another only new permissions
+	later := time.Now().Add(time.Hour)
+	if err := os.WriteFile(modified, []byte("new content"), 0600); err != nil {
+		t.Fatalf("Failed to write %s: %v", modified, err)
+	}
+	if err := os.Chtimes(modified, later, later); err != nil {
+		t.Fatalf("Failed to set times of %s: %v", modified, err)
+	}
+	// Let the clock move on so the ctime differs even on coarse timestamps
+	time.Sleep(20 * time.Millisecond)
+	if err := os.Chmod(chmodded, 0640); err != nil {
+		t.Fatalf("Failed to chmod %s: %v", chmodded, err)
+	}
+
+	byAction = previewTree(t, client, root)
+	if got := byAction[previewChanged]; len(got) != 1 || got[0] != modified {
+		t.Errorf("Changed files = %v, expected %s", got, modified)
+	}
+	if got := byAction[previewMetadata]; len(got) != 1 || got[0] != chmodded {
+		t.Errorf("Files with changed metadata = %v, expected %s", got, chmodded)
+	}
+	if len(byAction[previewUnchanged]) != 2 {
+		t.Errorf("Unchanged files = %v, expected the directory and kept.txt", byAction[previewUnchanged])
+	}
+	// The preview left the stored metadata alone
+	if stored, err := backupStream.writer.GetFile(chmodded, host); err != nil || stored == nil || stored.FileInfo.Mode.Perm() != 0600 {
+		t.Errorf("Stored version of %s = %+v (%v), expected the mode before the preview", chmodded, stored, err)
+	}
+
+	_, results = backupTree(t, client, root)
+	if len(results) != len(byAction[previewChanged]) {
+		t.Errorf("Backup sent %d files, the preview announced %d changed", len(results), len(byAction[previewChanged]))
+	}
+}
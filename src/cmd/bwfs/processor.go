@@ -3,17 +3,38 @@ package main
 import (
 	"log/slog"
 
+	"github.com/alex-sviridov/miniprotector/common/chunker"
 	"github.com/alex-sviridov/miniprotector/common/files"
+	"github.com/alex-sviridov/miniprotector/common/wfs"
 
 	pb "github.com/alex-sviridov/miniprotector/api"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 )
 
-func (s *BackupStream) handleResponse(stream pb.BackupService_ProcessBackupStreamServer, req *pb.FileRequest) error {
-	logger := *s.logger
+func (s *BackupStream) handleResponse(stream pb.BackupService_ProcessBackupStreamServer, state *streamState, req *pb.FileRequest) error {
+	logger := *state.logger
+
+	// Every response echoes the stream id, the client checks it: one stream, one id
+	if !state.identified {
+		state.streamID, state.identified = req.StreamId, true
+	} else if req.StreamId != state.streamID {
+		return status.Errorf(codes.InvalidArgument, "stream id changed from %d to %d", state.streamID, req.StreamId)
+	}
 
 	switch r := req.RequestType.(type) {
 	case *pb.FileRequest_FileInfo:
-		response, err := s.handleFileInfoRequest(req)
+		response, err := s.handleFileInfoRequest(state, req)
+		if err != nil {
+			return err
+		}
+		if err := stream.Send(response); err != nil {
+			logger.Error("Error sending response", "error", err)
+			return err
+		}
+
+	case *pb.FileRequest_Batch:
+		response, err := s.handleFileBatchRequest(state, req)
 		if err != nil {
 			return err
 		}
@@ -22,42 +43,67 @@ func (s *BackupStream) handleResponse(stream pb.BackupService_ProcessBackupStrea
 			return err
 		}
 
+	case *pb.FileRequest_Start:
+		if err := s.handleStreamStart(state, req); err != nil {
+			return err
+		}
+
+	case *pb.FileRequest_Chunk:
+		s.handleChunkRequest(state, req)
+
+	case *pb.FileRequest_FileEnd:
+		if err := stream.Send(s.handleFileEndRequest(state, req)); err != nil {
+			logger.Error("Error sending response", "error", err)
+			return err
+		}
+
 	default:
-		logger.Error("Received unknown message type", "message_type", r)
+		state.unknownMessages++
+		logger.Error("Received unknown message type", "message_type", r, "count", state.unknownMessages)
+		if limit := s.config.Load().MaxUnknownMessages; limit > 0 && state.unknownMessages > limit {
+			return status.Errorf(codes.InvalidArgument, "more than %d unknown messages received, closing stream", limit)
+		}
 	}
 	return nil
 }
 
-func (s *BackupStream) handleFileInfoRequest(req *pb.FileRequest) (*pb.FileResponse, error) {
+func (s *BackupStream) handleFileInfoRequest(state *streamState, req *pb.FileRequest) (*pb.FileResponse, error) {
 
 	fi := req.GetFileInfo()
 	clientStreamID := req.StreamId
-	logger := *s.logger.
+	logger := *state.logger.
 		With(slog.String("file_id", fi.FileId)).
 		With(slog.Int("streamId", int(clientStreamID)))
 
 	fileInfo, err := files.DecodeFileInfo(fi.Attributes)
 	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid metadata of file %s: %v", fi.FileId, err)
+	}
+	if err := authorizeHost(state.conf, state.clientNames, fileInfo.Host); err != nil {
 		return nil, err
 	}
+	if !chunker.ValidHashAlgo(fi.HashAlgo) {
+		return nil, status.Errorf(codes.InvalidArgument, "unsupported hash algorithm %q of file %s", fi.HashAlgo, fi.FileId)
+	}
 
-	s.filesProcessed++
+	fileNumber := s.filesProcessed.Add(1)
+	state.remember(fileInfo)
 	logger.Debug("Received filename",
-		"file_number", s.filesProcessed,
+		"file_number", fileNumber,
 		"attributes", fileInfo.Print())
 
-	fileExists, err := s.writer.FileExists(fileInfo)
+	status, err := s.writer.FileStatus(fileInfo)
 	if err != nil {
 		return nil, err
 	}
-
-	var needed bool
-	if fileExists {
-		needed = false
-		logger.Debug("File exists in database")
-	} else {
-		needed = true
-		logger.Debug("File doesn't exist in database")
+	state.announced = true
+	state.progress.arrived(fi.FileId)
+	needed, err := s.decideFile(state.pending, fi, fileInfo, status, &logger)
+	if err != nil {
+		return nil, err
+	}
+	if !needed {
+		s.settleFiles(state, fi.FileId)
 	}
 
 	// Send back a simple acknowledgment
@@ -73,3 +119,111 @@ func (s *BackupStream) handleFileInfoRequest(req *pb.FileRequest) (*pb.FileRespo
 	}
 	return response, nil
 }
+
+// decideFile acts on how a file compares to the stored versions and tells whether its data is needed
+// Files whose data is needed are expected as chunks, and recorded once their FileEnd arrives
+func (s *BackupStream) decideFile(pending uploads, fi *pb.FileInfo, fileInfo *files.FileInfo, status wfs.FileStatus, logger *slog.Logger) (bool, error) {
+	switch status {
+	case wfs.FileUnchanged:
+		logger.Debug("File exists in database")
+		return false, nil
+	case wfs.FileMetadataChanged:
+		if err := s.writer.UpdateMetadataOnly(fileInfo); err != nil {
+			return false, err
+		}
+		logger.Debug("File metadata changed, updated in database")
+		return false, nil
+	default:
+		logger.Debug("File doesn't exist in database")
+		u, err := s.newUpload(fileInfo, fi.HashAlgo)
+		if err != nil {
+			return false, err
+		}
+		pending[fi.FileId] = u
+		return true, nil
+	}
+}
+
+// maxBatchFiles bounds a FileBatch, keeping its existence query within SQLite's parameter limit
+const maxBatchFiles = 1000
+
+// handleFileBatchRequest answers the metadata of several files at once, checking them
+// against the database with a single query. New files other than regular ones carry no data,
+// they are recorded in a single transaction and answered as not needed.
+func (s *BackupStream) handleFileBatchRequest(state *streamState, req *pb.FileRequest) (*pb.FileResponse, error) {
+	batch := req.GetBatch().GetFiles()
+	if len(batch) > maxBatchFiles {
+		return nil, status.Errorf(codes.InvalidArgument, "batch of %d files exceeds the limit of %d", len(batch), maxBatchFiles)
+	}
+	logger := state.logger.With(slog.Int("streamId", int(req.StreamId)))
+
+	fileInfos := make([]*files.FileInfo, len(batch))
+	for i, fi := range batch {
+		fileInfo, err := files.DecodeFileInfo(fi.Attributes)
+		if err != nil {
+			return nil, status.Errorf(codes.InvalidArgument, "invalid metadata of file %s: %v", fi.FileId, err)
+		}
+		if err := authorizeHost(state.conf, state.clientNames, fileInfo.Host); err != nil {
+			return nil, err
+		}
+		if !chunker.ValidHashAlgo(fi.HashAlgo) {
+			return nil, status.Errorf(codes.InvalidArgument, "unsupported hash algorithm %q of file %s", fi.HashAlgo, fi.FileId)
+		}
+		fileInfos[i] = fileInfo
+	}
+
+	state.remember(fileInfos...)
+
+	statuses, err := s.writer.FileStatuses(fileInfos)
+	if err != nil {
+		return nil, err
+	}
+
+	fileIDs := make([]string, len(batch))
+	for i, fi := range batch {
+		fileIDs[i] = fi.FileId
+	}
+	state.announced = true
+	state.progress.arrived(fileIDs...)
+
+	answers := make([]*pb.FileNeeded, len(batch))
+	neededCount := 0
+	var settled []string
+	// New files without data are recorded together instead of waiting for their FileEnd
+	var records []*files.FileInfo
+	for i, fi := range batch {
+		s.filesProcessed.Add(1)
+		if statuses[i] == wfs.FileMissing && !fileInfos[i].Mode.IsRegular() {
+			records = append(records, fileInfos[i])
+			answers[i] = &pb.FileNeeded{FileId: fi.FileId, Host: fileInfos[i].Host}
+			settled = append(settled, fi.FileId)
+			continue
+		}
+		needed, err := s.decideFile(state.pending, fi, fileInfos[i], statuses[i], logger.With(slog.String("file_id", fi.FileId)))
+		if err != nil {
+			return nil, err
+		}
+		if needed {
+			neededCount++
+		} else {
+			settled = append(settled, fi.FileId)
+		}
+		answers[i] = &pb.FileNeeded{
+			FileId: fi.FileId,
+			Needed: needed,
+			Host:   fileInfos[i].Host,
+		}
+	}
+	if err := s.writer.AddFiles(records, make([]string, len(records))); err != nil {
+		return nil, err
+	}
+	s.settleFiles(state, settled...)
+	logger.Debug("Received file batch", "files", len(batch), "needed", neededCount, "recorded", len(records))
+
+	return &pb.FileResponse{
+		StreamId: req.StreamId,
+		ResponseType: &pb.FileResponse_NeededBatch{
+			NeededBatch: &pb.FileNeededBatch{Files: answers},
+		},
+	}, nil
+}
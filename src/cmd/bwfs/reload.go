@@ -0,0 +1,55 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+
+	"github.com/alex-sviridov/miniprotector/common/config"
+	"github.com/alex-sviridov/miniprotector/common/logging"
+)
+
+// watchConfig reloads the config file at path on every signal from reload until ctx is done.
+// A file that doesn't parse or validate is logged and the active config is kept.
+func (s *BackupStream) watchConfig(ctx context.Context, path string, reload <-chan os.Signal) {
+	logger := logging.GetLoggerFromContext(ctx)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-reload:
+			if err := s.reloadConfig(path); err != nil {
+				logger.Error("Config reload rejected, keeping the active config", "config", path, "error", err)
+				continue
+			}
+			logger.Info("Config reloaded", "config", path)
+		}
+	}
+}
+
+// reloadConfig reads the config file at path as at startup and swaps in a config with its
+// reloadable settings, used by the streams starting from then on. The other settings set up
+// the listeners, TLS and the storage, they keep their startup values until a restart.
+func (s *BackupStream) reloadConfig(path string) error {
+	next, err := config.ParseConfig(path)
+	if err == nil {
+		err = config.ApplyEnvOverrides(next)
+	}
+	if err != nil {
+		return err
+	}
+
+	current := s.config.Load()
+	if len(next.AllowedClientHosts) > 0 && current.TLSClientCAFile == "" {
+		return errors.New("AllowedClientHosts requires TLS with TLSClientCAFile")
+	}
+	conf := *current
+	conf.StreamIdleTimeoutSec = next.StreamIdleTimeoutSec
+	conf.MaxStreamDurationSec = next.MaxStreamDurationSec
+	conf.MaxUnknownMessages = next.MaxUnknownMessages
+	conf.ShutdownTimeoutSec = next.ShutdownTimeoutSec
+	conf.WriteBackupIndex = next.WriteBackupIndex
+	conf.AllowedClientHosts = next.AllowedClientHosts
+	s.config.Store(&conf)
+	return nil
+}
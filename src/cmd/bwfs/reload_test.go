@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/alex-sviridov/miniprotector/common/config"
+)
+
+func TestReloadConfigOnSignal(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "local.conf")
+	// The file is replaced whole, a reload never reads it half written
+	writeFile := func(content string) {
+		if err := os.WriteFile(path+".tmp", []byte(content), 0600); err != nil {
+			t.Fatalf("Failed to write config: %v", err)
+		}
+		if err := os.Rename(path+".tmp", path); err != nil {
+			t.Fatalf("Failed to replace config: %v", err)
+		}
+	}
+	writeFile("StreamIdleTimeoutSec=30\nInlineMaxSize=100\n")
+	conf, err := config.ParseConfig(path)
+	if err != nil {
+		t.Fatalf("ParseConfig failed: %v", err)
+	}
+	backupStream, _ := startTestBackupStream(t, conf)
+
+	ctx, cancel := context.WithCancel(newTestContext(conf))
+	defer cancel()
+	reload := make(chan os.Signal)
+	go backupStream.watchConfig(ctx, path, reload)
+
+	// waitFor polls the active config until check passes
+	waitFor := func(check func(*config.Config) bool) *config.Config {
+		t.Helper()
+		deadline := time.Now().Add(5 * time.Second)
+		for time.Now().Before(deadline) {
+			if active := backupStream.config.Load(); check(active) {
+				return active
+			}
+			time.Sleep(time.Millisecond)
+		}
+		t.Fatalf("Config not reloaded: %+v", backupStream.config.Load())
+		return nil
+	}
+
+	writeFile("StreamIdleTimeoutSec=5\nMaxUnknownMessages=2\nWriteBackupIndex=true\nInlineMaxSize=200\n")
+	reload <- syscall.SIGHUP
+	active := waitFor(func(c *config.Config) bool { return c.StreamIdleTimeoutSec == 5 })
+	if active.MaxUnknownMessages != 2 || !active.WriteBackupIndex {
+		t.Errorf("Reloadable settings not applied: %+v", active)
+	}
+	if active.InlineMaxSize != 100 {
+		t.Errorf("InlineMaxSize = %d, a storage setting must keep its startup value", active.InlineMaxSize)
+	}
+
+	// An invalid file is rejected, the previous config stays active
+	writeFile("StreamIdleTimeoutSec=soon\n")
+	reload <- syscall.SIGHUP
+	writeFile("AllowedClientHosts=host1\n")
+	reload <- syscall.SIGHUP
+	// The channel is unbuffered: this send waits until the rejected reloads are done
+	writeFile("StreamIdleTimeoutSec=7\n")
+	reload <- syscall.SIGHUP
+	active = waitFor(func(c *config.Config) bool { return c.StreamIdleTimeoutSec != 5 })
+	if active.StreamIdleTimeoutSec != 7 || len(active.AllowedClientHosts) != 0 {
+		t.Errorf("Rejected reload changed the config: %+v", active)
+	}
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/alex-sviridov/miniprotector/common/chunker"
+	"github.com/alex-sviridov/miniprotector/common/config"
+	"github.com/alex-sviridov/miniprotector/common/files"
+)
+
+func TestBackupAndRestoreTree(t *testing.T) {
+	root := filepath.Join(t.TempDir(), "source")
+	large := make([]byte, 2*chunker.DefaultChunkSize+100)
+	for i := range large {
+		large[i] = byte(i % 251)
+	}
+	for _, dir := range []string{root, filepath.Join(root, "sub"), filepath.Join(root, "locked")} {
+		if err := os.Mkdir(dir, 0750); err != nil {
+			t.Fatalf("Failed to create directory: %v", err)
+		}
+	}
+	contents := map[string][]byte{
+		"tiny.txt":      []byte("hello"),
+		"empty":         {},
+		"sub/large.bin": large,
+		"locked/secret": []byte("read only directory"),
+	}
+	for name, data := range contents {
+		if err := os.WriteFile(filepath.Join(root, name), data, 0640); err != nil {
+			t.Fatalf("Failed to write %s: %v", name, err)
+		}
+	}
+	if err := os.Chmod(filepath.Join(root, "tiny.txt"), 0604); err != nil {
+		t.Fatalf("Failed to chmod: %v", err)
+	}
+	if err := os.Symlink("sub/large.bin", filepath.Join(root, "link")); err != nil {
+		t.Fatalf("Failed to create symlink: %v", err)
+	}
+	if err := os.Chown(filepath.Join(root, "sub", "large.bin"), 1234, 5678); err != nil {
+		t.Fatalf("Failed to chown: %v", err)
+	}
+	past := time.Date(2024, 6, 1, 8, 30, 0, 123456000, time.UTC)
+	for _, name := range []string{"tiny.txt", "sub", "locked/secret", "locked"} {
+		if err := os.Chtimes(filepath.Join(root, name), past, past); err != nil {
+			t.Fatalf("Failed to set times: %v", err)
+		}
+	}
+	if err := os.Chmod(filepath.Join(root, "locked"), 0500); err != nil {
+		t.Fatalf("Failed to chmod: %v", err)
+	}
+
+	backupStream, client := startTestBackupStream(t, &config.Config{InlineMaxSize: 16})
+	fileList, results := backupTree(t, client, root)
+	for path, result := range results {
+		if !result.Success {
+			t.Fatalf("Writer failed to store %s: %s", path, result.Message)
+		}
+	}
+
+	target := t.TempDir()
+	if err := backupStream.writer.Restore(context.Background(), fileList[0].Host, root, target, time.Time{}); err != nil {
+		t.Fatalf("Restore failed: %v", err)
+	}
+
+	restoredRoot := filepath.Join(target, "source")
+	for _, source := range fileList {
+		rel, err := filepath.Rel(root, source.Path)
+		if err != nil {
+			t.Fatalf("Scanned path %s outside the source: %v", source.Path, err)
+		}
+		restored := filepath.Join(restoredRoot, rel)
+		original, err := os.Lstat(source.Path)
+		if err != nil {
+			t.Fatalf("Failed to stat %s: %v", source.Path, err)
+		}
+		info, err := os.Lstat(restored)
+		if err != nil {
+			t.Errorf("%s not restored: %v", rel, err)
+			continue
+		}
+		if info.Mode() != original.Mode() {
+			t.Errorf("%s: mode %v, expected %v", rel, info.Mode(), original.Mode())
+		}
+		originalStat, restoredStat := original.Sys().(*syscall.Stat_t), info.Sys().(*syscall.Stat_t)
+		if restoredStat.Uid != originalStat.Uid || restoredStat.Gid != originalStat.Gid {
+			t.Errorf("%s: owner %d:%d, expected %d:%d", rel, restoredStat.Uid, restoredStat.Gid, originalStat.Uid, originalStat.Gid)
+		}
+
+		switch {
+		case original.Mode()&os.ModeSymlink != 0:
+			want, _ := os.Readlink(source.Path)
+			if got, err := os.Readlink(restored); err != nil || got != want {
+				t.Errorf("%s: symlink to %q, expected %q", rel, got, want)
+			}
+		case original.Mode().IsRegular():
+			want, _ := os.ReadFile(source.Path)
+			if got, err := os.ReadFile(restored); err != nil || !bytes.Equal(got, want) {
+				t.Errorf("%s: content differs from the source: %v", rel, err)
+			}
+			fallthrough
+		default:
+			if !info.ModTime().Equal(original.ModTime()) {
+				t.Errorf("%s: mtime %v, expected %v", rel, info.ModTime(), original.ModTime())
+			}
+		}
+	}
+}
+
+func TestBackupAndRestoreSparseFile(t *testing.T) {
+	root := filepath.Join(t.TempDir(), "source")
+	if err := os.Mkdir(root, 0750); err != nil {
+		t.Fatalf("Failed to create directory: %v", err)
+	}
+	// Like a disk image: data between holes and a hole at the end, and a file that is only a hole
+	image := filepath.Join(root, "disk.img")
+	data := bytes.Repeat([]byte("data"), 64*1024)
+	f, err := os.Create(image)
+	if err != nil {
+		t.Fatalf("Failed to create file: %v", err)
+	}
+	_, err = f.WriteAt(data, 4*1024*1024)
+	if err == nil {
+		err = f.Truncate(16 * 1024 * 1024)
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		t.Fatalf("Failed to write sparse file: %v", err)
+	}
+	empty := filepath.Join(root, "empty.img")
+	if err := os.WriteFile(empty, nil, 0640); err != nil {
+		t.Fatalf("Failed to create file: %v", err)
+	}
+	if err := os.Truncate(empty, 8*1024*1024); err != nil {
+		t.Fatalf("Failed to truncate: %v", err)
+	}
+
+	backupStream, client := startTestBackupStream(t, &config.Config{InlineMaxSize: 16})
+	fileList, results := backupTree(t, client, root)
+	for _, file := range fileList {
+		if file.Mode.IsRegular() && !file.IsSparse() {
+			t.Skipf("%s isn't sparse, the filesystem of the test directory doesn't support holes", file.Path)
+		}
+	}
+	for path, result := range results {
+		if !result.Success {
+			t.Fatalf("Writer failed to store %s: %s", path, result.Message)
+		}
+	}
+
+	if issues, err := backupStream.writer.VerifyBackup(fileList[0].Host, true); err != nil || len(issues) != 0 {
+		t.Errorf("Verify found %v: %v", issues, err)
+	}
+
+	target := t.TempDir()
+	if err := backupStream.writer.Restore(context.Background(), fileList[0].Host, root, target, time.Time{}); err != nil {
+		t.Fatalf("Restore failed: %v", err)
+	}
+	for _, path := range []string{image, empty} {
+		restored := filepath.Join(target, "source", filepath.Base(path))
+		want, _ := os.ReadFile(path)
+		if got, err := os.ReadFile(restored); err != nil || !bytes.Equal(got, want) {
+			t.Errorf("%s: content differs from the source: %v", restored, err)
+		}
+		f, err := os.Open(restored)
+		if err != nil {
+			t.Fatalf("Failed to open %s: %v", restored, err)
+		}
+		info, err := files.StatFile(f)
+		f.Close()
+		if err != nil {
+			t.Fatalf("Failed to stat %s: %v", restored, err)
+		}
+		if !info.IsSparse() {
+			t.Errorf("%s restored with %d blocks allocated for %d bytes, expected holes", restored, info.Blocks, info.Size)
+		}
+	}
+}
+
+func TestRestoreHardLinks(t *testing.T) {
+	root := filepath.Join(t.TempDir(), "source")
+	if err := os.Mkdir(root, 0750); err != nil {
+		t.Fatalf("Failed to create directory: %v", err)
+	}
+	first, second := filepath.Join(root, "first"), filepath.Join(root, "second")
+	if err := os.WriteFile(first, bytes.Repeat([]byte("shared"), 1000), 0640); err != nil {
+		t.Fatalf("Failed to write file: %v", err)
+	}
+	if err := os.Link(first, second); err != nil {
+		t.Fatalf("Failed to create hard link: %v", err)
+	}
+
+	for _, restoreLinks := range []bool{true, false} {
+		backupStream, client := startTestBackupStream(t, &config.Config{RestoreHardLinks: restoreLinks})
+		fileList, _ := backupTree(t, client, root)
+
+		target := t.TempDir()
+		if err := backupStream.writer.Restore(context.Background(), fileList[0].Host, root, target, time.Time{}); err != nil {
+			t.Fatalf("Restore failed: %v", err)
+		}
+		var stats []*syscall.Stat_t
+		for _, name := range []string{"first", "second"} {
+			info, err := os.Stat(filepath.Join(target, "source", name))
+			if err != nil {
+				t.Fatalf("%s not restored: %v", name, err)
+			}
+			stats = append(stats, info.Sys().(*syscall.Stat_t))
+		}
+		if shared := stats[0].Ino == stats[1].Ino; shared != restoreLinks {
+			t.Errorf("With RestoreHardLinks=%v the restored files share an inode: %v", restoreLinks, shared)
+		}
+		if restoreLinks && stats[0].Nlink != 2 {
+			t.Errorf("Restored file has %d links, expected 2", stats[0].Nlink)
+		}
+	}
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"context"
+	"sync"
+
+	"github.com/alex-sviridov/miniprotector/common/wfs"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	pb "github.com/alex-sviridov/miniprotector/api"
+)
+
+// streamProgress tracks which files of a resumable stream are committed. Files settle out of order,
+// data of needed files arrives after the metadata of later ones, so the progress saved is the last
+// file of the run of settled files from the start of the stream.
+type streamProgress struct {
+	host, jobID, token string
+	streamID           int32
+	saved              wfs.StreamProgress // Over every attempt of the stream
+	order              []string           // Files after the saved one, in the order their metadata arrived
+	settled            map[string]bool    // Files of order that are committed
+}
+
+// maxJobIDLength bounds the job ids the writer accepts, they go to its logs and database
+const maxJobIDLength = 64
+
+// validJobID tells whether a job id is made of at most maxJobIDLength letters, digits, '.', '_' and '-'
+func validJobID(jobID string) bool {
+	if jobID == "" || len(jobID) > maxJobIDLength {
+		return false
+	}
+	for _, r := range jobID {
+		if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '.' || r == '_' || r == '-') {
+			return false
+		}
+	}
+	return true
+}
+
+// checkStreamIdentity returns an InvalidArgument error for the first invalid id naming a resumable stream
+func checkStreamIdentity(host, jobID string, streamID int32, token string) error {
+	switch {
+	case streamID <= 0:
+		return status.Errorf(codes.InvalidArgument, "stream id %d is not positive", streamID)
+	case !validJobID(jobID):
+		return status.Errorf(codes.InvalidArgument, "invalid job id %.64q", jobID)
+	case host == "":
+		return status.Error(codes.InvalidArgument, "no source host")
+	case token == "":
+		return status.Error(codes.InvalidArgument, "no resume token")
+	}
+	return nil
+}
+
+// handleStreamStart makes a stream resumable, continuing the progress of earlier attempts with the same resume token
+func (s *BackupStream) handleStreamStart(state *streamState, req *pb.FileRequest) error {
+	start := req.GetStart()
+	if err := checkStreamIdentity(start.Host, start.JobId, req.StreamId, start.ResumeToken); err != nil {
+		return err
+	}
+	if err := authorizeHost(state.conf, state.clientNames, start.Host); err != nil {
+		return err
+	}
+	if state.progress != nil {
+		return status.Error(codes.InvalidArgument, "stream already started")
+	}
+	if state.announced {
+		// The progress would leave out the files already announced, and a resume would skip the wrong ones
+		return status.Error(codes.InvalidArgument, "stream started after sending files")
+	}
+	saved, err := s.writer.GetStreamProgress(start.Host, start.JobId, req.StreamId, start.ResumeToken)
+	if err != nil {
+		return status.Errorf(codes.Internal, "failed to read stream progress: %v", err)
+	}
+	state.progress = &streamProgress{
+		host:     start.Host,
+		jobID:    start.JobId,
+		token:    start.ResumeToken,
+		streamID: req.StreamId,
+		saved:    saved,
+		settled:  make(map[string]bool),
+	}
+	s.jobs.open(jobKey{start.Host, start.JobId})
+	state.logger.Info("Resumable stream started", "job_id", start.JobId, "streamId", int(req.StreamId), "committed", saved.Committed)
+	return nil
+}
+
+// endStream counts a resumable stream ending, dropping the progress of its job
+// when the job's run is already recorded and this was its last open stream
+func (s *BackupStream) endStream(state *streamState) {
+	p := state.progress
+	if p != nil && s.jobs.close(jobKey{p.host, p.jobID}) {
+		s.dropStreamProgress(p.host, p.jobID)
+	}
+}
+
+// dropStreamProgress deletes the progress of a finished job, a failure is only logged
+func (s *BackupStream) dropStreamProgress(host, jobID string) {
+	if err := s.writer.DeleteStreamProgress(host, jobID); err != nil {
+		s.logger.Error("Failed to delete stream progress", "job_id", jobID, "host", host, "error", err)
+	}
+}
+
+// jobKey names a backup job of a host
+type jobKey struct {
+	host, jobID string
+}
+
+// activeJobs counts the open resumable streams of each job. The progress of a job's streams is
+// only needed until its run ends: it is dropped once the run is recorded and no stream of the job is open.
+type activeJobs struct {
+	mu       sync.Mutex
+	streams  map[jobKey]int
+	finished map[jobKey]bool // Jobs whose run was recorded while some of their streams were open
+}
+
+func newActiveJobs() *activeJobs {
+	return &activeJobs{streams: make(map[jobKey]int), finished: make(map[jobKey]bool)}
+}
+
+// open counts a stream of a job starting
+func (j *activeJobs) open(key jobKey) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.streams[key]++
+}
+
+// close counts a stream of a job ending and tells whether it was the last open one of a recorded job
+func (j *activeJobs) close(key jobKey) bool {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if j.streams[key]--; j.streams[key] > 0 {
+		return false
+	}
+	delete(j.streams, key)
+	finished := j.finished[key]
+	delete(j.finished, key)
+	return finished
+}
+
+// finish marks the run of a job recorded and tells whether none of its streams is open
+func (j *activeJobs) finish(key jobKey) bool {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if j.streams[key] > 0 {
+		j.finished[key] = true
+		return false
+	}
+	return true
+}
+
+// arrived adds files whose metadata was received, in order
+func (p *streamProgress) arrived(fileIDs ...string) {
+	if p != nil {
+		p.order = append(p.order, fileIDs...)
+	}
+}
+
+// settle marks a file committed: recorded by the writer, or not needed.
+// Returns whether the saved progress moved, it then needs saving.
+func (p *streamProgress) settle(fileID string) bool {
+	if p == nil {
+		return false
+	}
+	p.settled[fileID] = true
+	advanced := false
+	for len(p.order) > 0 && p.settled[p.order[0]] {
+		delete(p.settled, p.order[0])
+		p.saved.Committed++
+		p.saved.LastFileID = p.order[0]
+		p.order = p.order[1:]
+		advanced = true
+	}
+	return advanced
+}
+
+// settleFiles marks files of a stream committed and saves its progress when it moved.
+// A failure to save is logged, the stream goes on and a resumed attempt sends more files again.
+func (s *BackupStream) settleFiles(state *streamState, fileIDs ...string) {
+	p := state.progress
+	advanced := false
+	for _, fileID := range fileIDs {
+		if p.settle(fileID) {
+			advanced = true
+		}
+	}
+	if !advanced {
+		return
+	}
+	if err := s.writer.SaveStreamProgress(p.host, p.jobID, p.streamID, p.token, p.saved); err != nil {
+		state.logger.Error("Failed to save stream progress", "job_id", p.jobID, "streamId", int(p.streamID), "error", err)
+	}
+}
+
+// GetStreamProgress tells a reader resuming a stream how many of its files are committed
+func (s *BackupStream) GetStreamProgress(ctx context.Context, req *pb.StreamProgressRequest) (*pb.StreamProgress, error) {
+	if err := authorizeCall(ctx, s.config.Load(), req.Host); err != nil {
+		return nil, err
+	}
+	if err := checkStreamIdentity(req.Host, req.JobId, req.StreamId, req.ResumeToken); err != nil {
+		return nil, err
+	}
+	progress, err := s.writer.GetStreamProgress(req.Host, req.JobId, req.StreamId, req.ResumeToken)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to read stream progress: %v", err)
+	}
+	return &pb.StreamProgress{Committed: progress.Committed, LastFileId: progress.LastFileID}, nil
+}
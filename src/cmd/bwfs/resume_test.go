@@ -0,0 +1,300 @@
+package main
+
+import (
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	pb "github.com/alex-sviridov/miniprotector/api"
+	"github.com/alex-sviridov/miniprotector/common/chunker"
+	"github.com/alex-sviridov/miniprotector/common/config"
+	"github.com/alex-sviridov/miniprotector/common/files"
+	"github.com/alex-sviridov/miniprotector/common/wfs"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestStreamProgress(t *testing.T) {
+	root := t.TempDir()
+	kept := filepath.Join(root, "kept.txt")
+	if err := os.WriteFile(kept, []byte("backed up before"), 0600); err != nil {
+		t.Fatalf("Failed to write file: %v", err)
+	}
+	_, client := startTestBackupStream(t, &config.Config{})
+	backupTree(t, client, root)
+
+	added := filepath.Join(root, "added.txt")
+	if err := os.WriteFile(added, []byte("new content"), 0600); err != nil {
+		t.Fatalf("Failed to write file: %v", err)
+	}
+	fileList, _, err := files.Scan(root, files.ScanOptions{})
+	if err != nil {
+		t.Fatalf("Scan failed: %v", err)
+	}
+	byPath := make(map[string]*files.FileInfo)
+	for i := range fileList {
+		byPath[fileList[i].Path] = &fileList[i]
+	}
+	host := fileList[0].Host
+
+	progress := func(token string) *pb.StreamProgress {
+		t.Helper()
+		progress, err := client.GetStreamProgress(context.Background(), &pb.StreamProgressRequest{Host: host, JobId: "job", StreamId: 1, ResumeToken: token})
+		if err != nil {
+			t.Fatalf("GetStreamProgress failed: %v", err)
+		}
+		return progress
+	}
+	startStream := func() pb.BackupService_ProcessBackupStreamClient {
+		t.Helper()
+		stream, err := client.ProcessBackupStream(context.Background())
+		if err != nil {
+			t.Fatalf("Failed to open stream: %v", err)
+		}
+		start := &pb.StreamStart{JobId: "job", ResumeToken: "token", Host: host}
+		if err := stream.Send(&pb.FileRequest{StreamId: 1, RequestType: &pb.FileRequest_Start{Start: start}}); err != nil {
+			t.Fatalf("Failed to start stream: %v", err)
+		}
+		return stream
+	}
+	sendMetadata := func(stream pb.BackupService_ProcessBackupStreamClient, file *files.FileInfo) bool {
+		t.Helper()
+		attributes, err := files.Encode(file)
+		if err != nil {
+			t.Fatalf("Failed to encode %s: %v", file.Path, err)
+		}
+		err = stream.Send(&pb.FileRequest{StreamId: 1, RequestType: &pb.FileRequest_FileInfo{FileInfo: &pb.FileInfo{FileId: file.GetId(), Attributes: attributes}}})
+		if err != nil {
+			t.Fatalf("Failed to send metadata: %v", err)
+		}
+		resp, err := stream.Recv()
+		if err != nil {
+			t.Fatalf("Failed to receive answer: %v", err)
+		}
+		return resp.GetFileNeeded().GetNeeded()
+	}
+
+	// The new file is needed and the kept one isn't: only the new one's data is missing
+	stream := startStream()
+	if !sendMetadata(stream, byPath[added]) || sendMetadata(stream, byPath[kept]) {
+		t.Fatal("Expected only the added file to be needed")
+	}
+	if p := progress("token"); p.Committed != 0 {
+		t.Errorf("Committed %d files before the first one is stored, expected 0", p.Committed)
+	}
+
+	end := &pb.FileEnd{FileId: byPath[added].GetId()}
+	end.Checksum, end.Size, err = chunker.ChunkFileStream(added, chunker.DefaultChunkSize, chunker.HashBLAKE3, func(c chunker.Chunk) error {
+		chunk := &pb.Chunk{FileId: end.FileId, Offset: c.Offset, Data: c.Data, Checksum: c.Checksum}
+		return stream.Send(&pb.FileRequest{StreamId: 1, RequestType: &pb.FileRequest_Chunk{Chunk: chunk}})
+	})
+	if err != nil {
+		t.Fatalf("Failed to send data: %v", err)
+	}
+	if err := stream.Send(&pb.FileRequest{StreamId: 1, RequestType: &pb.FileRequest_FileEnd{FileEnd: end}}); err != nil {
+		t.Fatalf("Failed to send end: %v", err)
+	}
+	if resp, err := stream.Recv(); err != nil || !resp.GetResult().GetSuccess() {
+		t.Fatalf("Added file not stored: %v %v", resp, err)
+	}
+	if p := progress("token"); p.Committed != 2 || p.LastFileId != byPath[kept].GetId() {
+		t.Errorf("Progress = %d files up to %q, expected 2 up to the kept file", p.Committed, p.LastFileId)
+	}
+	stream.CloseSend()
+	stream.Recv()
+
+	// Another attempt of the stream continues the count, another run doesn't see it
+	stream = startStream()
+	if sendMetadata(stream, byPath[added]) {
+		t.Fatal("Expected the added file to be stored")
+	}
+	if p := progress("token"); p.Committed != 3 || p.LastFileId != byPath[added].GetId() {
+		t.Errorf("Progress = %d files up to %q, expected 3 up to the added file", p.Committed, p.LastFileId)
+	}
+	stream.CloseSend()
+	stream.Recv()
+	if p := progress("other run"); p.Committed != 0 || p.LastFileId != "" {
+		t.Errorf("Progress of another run = %d files up to %q, expected none", p.Committed, p.LastFileId)
+	}
+}
+
+func TestStreamStartAfterFiles(t *testing.T) {
+	_, client := startTestBackupStream(t, &config.Config{})
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	stream, err := client.ProcessBackupStream(ctx)
+	if err != nil {
+		t.Fatalf("Failed to open stream: %v", err)
+	}
+
+	// Data of a file never announced is refused without ending the stream
+	err = stream.Send(&pb.FileRequest{StreamId: 1, RequestType: &pb.FileRequest_FileEnd{FileEnd: &pb.FileEnd{FileId: "unknown"}}})
+	if err != nil {
+		t.Fatalf("Failed to send end: %v", err)
+	}
+	if resp, err := stream.Recv(); err != nil || resp.GetResult() == nil || resp.GetResult().Success {
+		t.Fatalf("Expected a failed result for the unknown file, got %v, %v", resp, err)
+	}
+
+	fileInfo := &files.FileInfo{Host: "host", Path: "/data/file", ModTime: time.Now()}
+	attributes, err := files.Encode(fileInfo)
+	if err != nil {
+		t.Fatalf("Failed to encode: %v", err)
+	}
+	err = stream.Send(&pb.FileRequest{StreamId: 1, RequestType: &pb.FileRequest_FileInfo{FileInfo: &pb.FileInfo{FileId: fileInfo.GetId(), Attributes: attributes}}})
+	if err != nil {
+		t.Fatalf("Failed to send metadata: %v", err)
+	}
+	if resp, err := stream.Recv(); err != nil || resp.GetFileNeeded() == nil {
+		t.Fatalf("Expected FileNeeded, got %v, %v", resp, err)
+	}
+
+	// Starting once files were announced would miscount the progress
+	start := &pb.StreamStart{JobId: "job", ResumeToken: "token", Host: "host"}
+	if err := stream.Send(&pb.FileRequest{StreamId: 1, RequestType: &pb.FileRequest_Start{Start: start}}); err != nil {
+		t.Fatalf("Failed to send start: %v", err)
+	}
+	if _, err := stream.Recv(); status.Code(err) != codes.InvalidArgument {
+		t.Errorf("Expected InvalidArgument for a late StreamStart, got %v", err)
+	}
+}
+
+func TestActiveJobs(t *testing.T) {
+	jobs := newActiveJobs()
+	key := jobKey{"host", "job"}
+	if !jobs.finish(jobKey{"host", "other"}) {
+		t.Error("Job without open streams not reported finished")
+	}
+
+	jobs.open(key)
+	jobs.open(key)
+	if jobs.finish(key) {
+		t.Error("Job with open streams reported finished")
+	}
+	if jobs.close(key) {
+		t.Error("First stream end reported as the last one")
+	}
+	if !jobs.close(key) {
+		t.Error("Last stream end of a recorded job not reported")
+	}
+	if len(jobs.streams) != 0 || len(jobs.finished) != 0 {
+		t.Errorf("Job still tracked after its last stream: %v %v", jobs.streams, jobs.finished)
+	}
+
+	// A job whose run isn't recorded keeps its progress when its streams end, to be resumed
+	jobs.open(key)
+	if jobs.close(key) {
+		t.Error("Stream end of a running job reported as finishing it")
+	}
+}
+
+func TestJobProgressDroppedAfterRun(t *testing.T) {
+	backupStream, client := startTestBackupStream(t, &config.Config{})
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	// A stream ending without StreamStart leaves nothing behind
+	stream, err := client.ProcessBackupStream(ctx)
+	if err != nil {
+		t.Fatalf("Failed to open stream: %v", err)
+	}
+	stream.CloseSend()
+	if _, err := stream.Recv(); err != io.EOF {
+		t.Fatalf("Expected the stream to end, got %v", err)
+	}
+
+	stream, err = client.ProcessBackupStream(ctx)
+	if err != nil {
+		t.Fatalf("Failed to open stream: %v", err)
+	}
+	start := &pb.StreamStart{JobId: "job", ResumeToken: "token", Host: "host"}
+	if err := stream.Send(&pb.FileRequest{StreamId: 1, RequestType: &pb.FileRequest_Start{Start: start}}); err != nil {
+		t.Fatalf("Failed to send start: %v", err)
+	}
+	// The answer to the metadata tells the start was handled
+	fileInfo := &files.FileInfo{Host: "host", Path: "/data/file", ModTime: time.Now()}
+	attributes, err := files.Encode(fileInfo)
+	if err != nil {
+		t.Fatalf("Failed to encode: %v", err)
+	}
+	err = stream.Send(&pb.FileRequest{StreamId: 1, RequestType: &pb.FileRequest_FileInfo{FileInfo: &pb.FileInfo{FileId: fileInfo.GetId(), Attributes: attributes}}})
+	if err != nil {
+		t.Fatalf("Failed to send metadata: %v", err)
+	}
+	if _, err := stream.Recv(); err != nil {
+		t.Fatalf("Failed to receive answer: %v", err)
+	}
+	saved := wfs.StreamProgress{Committed: 5, LastFileID: "last"}
+	if err := backupStream.writer.SaveStreamProgress("host", "job", 1, "token", saved); err != nil {
+		t.Fatalf("Failed to save progress: %v", err)
+	}
+	progress := func() wfs.StreamProgress {
+		t.Helper()
+		progress, err := backupStream.writer.GetStreamProgress("host", "job", 1, "token")
+		if err != nil {
+			t.Fatalf("Failed to read progress: %v", err)
+		}
+		return progress
+	}
+
+	// The run is recorded while its stream is still open: the progress stays until the stream ends
+	if _, err := client.RecordJobRun(ctx, &pb.JobRun{JobId: "job", Host: "host"}); err != nil {
+		t.Fatalf("RecordJobRun failed: %v", err)
+	}
+	if p := progress(); p != saved {
+		t.Errorf("Progress = %+v with the stream open, expected %+v", p, saved)
+	}
+	stream.CloseSend()
+	if _, err := stream.Recv(); err != io.EOF {
+		t.Fatalf("Expected the stream to end, got %v", err)
+	}
+	if p := progress(); p != (wfs.StreamProgress{}) {
+		t.Errorf("Progress = %+v after the job ended, expected none", p)
+	}
+}
+
+func TestStreamIdentityChecked(t *testing.T) {
+	_, client := startTestBackupStream(t, &config.Config{})
+	tests := []struct {
+		name     string
+		streamID int32
+		start    *pb.StreamStart
+	}{
+		{"colon in job id", 1, &pb.StreamStart{JobId: "job:2", ResumeToken: "token", Host: "host"}},
+		{"long job id", 1, &pb.StreamStart{JobId: strings.Repeat("j", maxJobIDLength+1), ResumeToken: "token", Host: "host"}},
+		{"no job id", 1, &pb.StreamStart{ResumeToken: "token", Host: "host"}},
+		{"negative stream id", -1, &pb.StreamStart{JobId: "job", ResumeToken: "token", Host: "host"}},
+		{"zero stream id", 0, &pb.StreamStart{JobId: "job", ResumeToken: "token", Host: "host"}},
+		{"no host", 1, &pb.StreamStart{JobId: "job", ResumeToken: "token"}},
+		{"no token", 1, &pb.StreamStart{JobId: "job", Host: "host"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+			stream, err := client.ProcessBackupStream(ctx)
+			if err != nil {
+				t.Fatalf("Failed to open stream: %v", err)
+			}
+			if err := stream.Send(&pb.FileRequest{StreamId: tt.streamID, RequestType: &pb.FileRequest_Start{Start: tt.start}}); err != nil {
+				t.Fatalf("Failed to send start: %v", err)
+			}
+			if _, err := stream.Recv(); status.Code(err) != codes.InvalidArgument {
+				t.Errorf("StreamStart: expected InvalidArgument, got %v", err)
+			}
+
+			req := &pb.StreamProgressRequest{Host: tt.start.Host, JobId: tt.start.JobId, StreamId: tt.streamID, ResumeToken: tt.start.ResumeToken}
+			if _, err := client.GetStreamProgress(ctx, req); status.Code(err) != codes.InvalidArgument {
+				t.Errorf("GetStreamProgress: expected InvalidArgument, got %v", err)
+			}
+		})
+	}
+
+	if !validJobID("20250101T100000Z-1a2b3c4d") {
+		t.Error("Job id generated by brfs refused")
+	}
+}
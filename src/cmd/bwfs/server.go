@@ -6,40 +6,117 @@ import (
 	"io"
 	"log/slog"
 	"net"
+	"os"
+	"os/signal"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
 
+	"github.com/alex-sviridov/miniprotector/common"
 	"github.com/alex-sviridov/miniprotector/common/config"
+	"github.com/alex-sviridov/miniprotector/common/files"
 	"github.com/alex-sviridov/miniprotector/common/logging"
 	"github.com/alex-sviridov/miniprotector/common/wfs"
 
 	pb "github.com/alex-sviridov/miniprotector/api"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/keepalive"
 	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
 )
 
 type BackupStream struct {
 	pb.UnimplementedBackupServiceServer
 	storagePath    string
-	config         *config.Config
+	config         atomic.Pointer[config.Config] // Replaced as a whole when the config file is reloaded
 	writer         *wfs.Writer
+	manifestKey    []byte // Signs a manifest of each stream, nil when SignedManifestKeyFile is unset
 	logger         *slog.Logger
-	filesProcessed int
+	filesProcessed atomic.Int64  // Files whose metadata arrived, over all streams
+	stopping       chan struct{} // Closed when the server shuts down
+	stopOnce       sync.Once
+	jobs           *activeJobs // Open resumable streams of each job
 }
 
 func NewBackupStream(ctx context.Context, storagePath string) (*BackupStream, error) {
 	logger := logging.GetLoggerFromContext(ctx)
 	conf := config.GetConfigFromContext(ctx)
 
+	var manifestKey []byte
+	if conf.SignedManifestKeyFile != "" {
+		key, err := wfs.LoadManifestKey(conf.SignedManifestKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		manifestKey = key
+	}
+
 	writer, err := wfs.NewWriter(ctx, storagePath)
 	if err != nil {
 		return nil, err
 	}
-	return &BackupStream{
-		logger:         logger,
-		config:         conf,
-		storagePath:    storagePath,
-		writer:         writer,
-		filesProcessed: 0,
-	}, nil
+	s := &BackupStream{
+		logger:      logger,
+		storagePath: storagePath,
+		writer:      writer,
+		manifestKey: manifestKey,
+		stopping:    make(chan struct{}),
+		jobs:        newActiveJobs(),
+	}
+	s.config.Store(conf)
+	return s, nil
+}
+
+// streamState is what ProcessBackupStream tracks for one client stream
+type streamState struct {
+	pending         uploads           // Files requested from the client and not finished yet
+	unknownMessages int               // Requests of a type the writer doesn't handle
+	writeIndex      bool              // WriteBackupIndex when the stream started
+	keepFiles       bool              // Whether seen is kept, for the backup index or the signed manifest
+	seen            []*files.FileInfo // Files whose metadata arrived
+	progress        *streamProgress   // Committed files of a resumable stream, nil until a StreamStart
+	logger          *slog.Logger      // The server's logger with the client of the stream
+	announced       bool              // Whether file metadata arrived, a StreamStart must come before any
+	streamID        int32             // Client's id of the stream, from its first request
+	identified      bool              // Whether streamID is set
+	conf            *config.Config    // Settings when the stream started
+	clientNames     []string          // Verified names of the client, files must be of one of them with AllowedClientHosts
+}
+
+// remember keeps the files of a stream for its backup index and signed manifest
+func (state *streamState) remember(fileInfos ...*files.FileInfo) {
+	if state.keepFiles {
+		state.seen = append(state.seen, fileInfos...)
+	}
+}
+
+// finishStream writes the backup index and signed manifest of a stream that ended normally
+func (s *BackupStream) finishStream(state *streamState) error {
+	if state.writeIndex {
+		path, err := s.writer.WriteIndex(state.seen)
+		if err != nil {
+			state.logger.Error("Failed to write backup index", "error", err)
+			return status.Errorf(codes.Internal, "failed to write backup index: %v", err)
+		}
+		state.logger.Info("Backup index written", "path", path, "files", len(state.seen))
+	}
+	if s.manifestKey != nil {
+		path, err := s.writer.WriteSignedManifest(state.seen, s.manifestKey)
+		if err != nil {
+			state.logger.Error("Failed to write signed manifest", "error", err)
+			return status.Errorf(codes.Internal, "failed to write signed manifest: %v", err)
+		}
+		state.logger.Info("Signed manifest written", "path", path, "files", len(state.seen))
+	}
+	return nil
+}
+
+// stopStreams asks running streams to end after the message they are handling
+func (s *BackupStream) stopStreams() {
+	s.stopOnce.Do(func() { close(s.stopping) })
 }
 
 // ProcessBackupStream handles the streaming connection
@@ -48,6 +125,7 @@ func (s *BackupStream) ProcessBackupStream(stream pb.BackupService_ProcessBackup
 
 	// Get client connection info ONCE at start
 	var clientAddr, clientAuthType string = "unknown", "none"
+	var clientCertNames []string
 
 	if peer, ok := peer.FromContext(streamCtx); ok {
 		clientAddr = peer.Addr.String()
@@ -55,57 +133,244 @@ func (s *BackupStream) ProcessBackupStream(stream pb.BackupService_ProcessBackup
 		// Add auth info if available
 		if peer.AuthInfo != nil {
 			clientAuthType = peer.AuthInfo.AuthType()
+			clientCertNames = clientNames(peer)
 		}
 	}
-	s.logger = s.logger.With(
+	logger := s.logger.With(
 		slog.String("client_addr", clientAddr),
 		slog.Any("grpc_auth_type", clientAuthType),
+		slog.Any("client_cert_names", clientCertNames),
 	)
 
-	s.logger.Info("New backup stream connected")
+	// Settings are read once, a reload applies to the streams starting after it
+	conf := s.config.Load()
+	if err := authorizeClient(conf, clientCertNames); err != nil {
+		logger.Warn("Rejected backup stream from client not in allowlist")
+		return err
+	}
+
+	logger.Info("New backup stream connected")
 
-	for {
-		// Receive a message from client
-		req, err := stream.Recv()
-		if err == io.EOF {
-			s.logger.Info("Client stopped sending",
-				"total_files", s.filesProcessed)
-			return nil
+	ctx := streamCtx
+	maxDuration := time.Duration(conf.MaxStreamDurationSec) * time.Second
+	if maxDuration > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(streamCtx, maxDuration)
+		defer cancel()
+	}
+
+	// Close streams where the client goes quiet, e.g. half-open connections
+	idleTimeout := time.Duration(conf.StreamIdleTimeoutSec) * time.Second
+	var idle <-chan time.Time
+	var idleTimer *time.Timer
+	if idleTimeout > 0 {
+		idleTimer = time.NewTimer(idleTimeout)
+		defer idleTimer.Stop()
+		idle = idleTimer.C
+	}
+
+	state := &streamState{
+		pending:     make(uploads),
+		writeIndex:  conf.WriteBackupIndex,
+		keepFiles:   conf.WriteBackupIndex || s.manifestKey != nil,
+		logger:      logger,
+		conf:        conf,
+		clientNames: clientCertNames,
+	}
+	defer func() {
+		if len(state.pending) > 0 {
+			logger.Warn("Stream ended with unfinished files, they are not recorded", "count", len(state.pending))
 		}
-		if err != nil {
-			s.logger.Error("Error receiving", "error", err)
-			return err
+	}()
+	defer s.endStream(state)
+
+	// Receive in background so the stream can be closed while Recv blocks
+	requests := make(chan *pb.FileRequest)
+	recvErrors := make(chan error, 1)
+	go func() {
+		for {
+			req, err := stream.Recv()
+			if err != nil {
+				recvErrors <- err
+				return
+			}
+			select {
+			case requests <- req:
+			case <-ctx.Done():
+				return
+			}
 		}
+	}()
 
-		if err := s.handleResponse(stream, req); err != nil {
+	for {
+		select {
+		case <-ctx.Done():
+			if streamCtx.Err() == nil {
+				logger.Error("Stream exceeded maximum duration, closing",
+					"max_duration", maxDuration,
+					"total_files", s.filesProcessed.Load())
+				// Not DeadlineExceeded, the reader would resume a stream ended on purpose
+				return status.Errorf(codes.ResourceExhausted, "stream exceeded maximum duration of %s", maxDuration)
+			}
+			logger.Warn("Client gone, closing stream",
+				"error", streamCtx.Err(),
+				"total_files", s.filesProcessed.Load())
+			return streamCtx.Err()
+		case err := <-recvErrors:
+			if err == io.EOF {
+				logger.Info("Client stopped sending",
+					"total_files", s.filesProcessed.Load())
+				return s.finishStream(state)
+			}
+			logger.Error("Error receiving", "error", err)
 			return err
+		case <-s.stopping:
+			logger.Info("Server shutting down, closing stream",
+				"total_files", s.filesProcessed.Load())
+			return status.Error(codes.Unavailable, "server shutting down")
+		case <-idle:
+			logger.Warn("No message from client within timeout, closing stream",
+				"timeout", idleTimeout,
+				"total_files", s.filesProcessed.Load())
+			return status.Errorf(codes.DeadlineExceeded, "no message received for %s", idleTimeout)
+		case req := <-requests:
+			if err := s.handleResponse(stream, state, req); err != nil {
+				return err
+			}
+			// Counted from the end of handling, a slow message doesn't use up the client's time;
+			// Reset also drops an expiry that happened meanwhile
+			if idleTimer != nil {
+				idleTimer.Reset(idleTimeout)
+			}
 		}
 	}
 }
 
-// startServer creates and starts the gRPC server on the specified port
-// Creates and connects BackupServer with storage
-// This is a blocking call that serves until an error occurs.
-func startServer(ctx context.Context, port int, storagePath string) error {
+// startServer creates and starts the gRPC server on the specified ports
+// Creates and connects BackupServer with storage, shared by all listeners,
+// and reloads its settings from configPath on SIGHUP.
+// This is a blocking call that serves until an error occurs on any listener.
+func startServer(ctx context.Context, ports []int, storagePath, configPath string) error {
 	logger := logging.GetLoggerFromContext(ctx)
-	// Create TCP listener
-	listener, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
-	if err != nil {
-		return fmt.Errorf("failed to listen on port %d: %w", port, err)
+	// Create TCP listeners
+	listeners := make([]net.Listener, 0, len(ports))
+	for _, port := range ports {
+		listener, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
+		if err != nil {
+			for _, l := range listeners {
+				l.Close()
+			}
+			return fmt.Errorf("failed to listen on port %d: %w", port, err)
+		}
+		listeners = append(listeners, listener)
+		logger.Info("Server starting", "port", port)
 	}
 
-	logger.Info("Server starting", "port", port)
-
 	// Create and configure gRPC server and Backup server
-	grpcServer := grpc.NewServer()
+	grpcServer, err := newGRPCServer(config.GetConfigFromContext(ctx))
+	if err != nil {
+		for _, l := range listeners {
+			l.Close()
+		}
+		return err
+	}
 	backupStream, err := NewBackupStream(ctx, storagePath)
 	if err != nil {
+		for _, l := range listeners {
+			l.Close()
+		}
 		return err
 	}
 	defer backupStream.writer.Close()
 	pb.RegisterBackupServiceServer(grpcServer, backupStream)
 
+	reload := make(chan os.Signal, 1)
+	signal.Notify(reload, syscall.SIGHUP)
+	defer signal.Stop(reload)
+	go backupStream.watchConfig(ctx, configPath, reload)
+
 	logger.Info("Server ready, accepting connections")
 
-	return grpcServer.Serve(listener)
+	return serveAll(ctx, grpcServer, backupStream, listeners)
+}
+
+// newGRPCServer creates the gRPC server, using TLS when the config provides a certificate
+// and requiring reader certificates when it provides a client CA
+func newGRPCServer(conf *config.Config) (*grpc.Server, error) {
+	tlsConfig, err := common.ServerTLSConfig(conf)
+	if err != nil {
+		return nil, err
+	}
+	if len(conf.AllowedClientHosts) > 0 && (tlsConfig == nil || conf.TLSClientCAFile == "") {
+		return nil, fmt.Errorf("AllowedClientHosts requires TLS with TLSClientCAFile")
+	}
+	options := keepaliveOptions(conf)
+	if tlsConfig != nil {
+		options = append(options, grpc.Creds(credentials.NewTLS(tlsConfig)))
+	}
+	return grpc.NewServer(options...), nil
+}
+
+// keepaliveOptions pings readers idle for HeartbeatSec and drops those that don't answer within
+// as long again, ending their streams. Readers may ping as often as every half HeartbeatSec,
+// even while no stream is open.
+func keepaliveOptions(conf *config.Config) []grpc.ServerOption {
+	if conf.HeartbeatSec <= 0 {
+		return nil
+	}
+	heartbeat := time.Duration(conf.HeartbeatSec) * time.Second
+	return []grpc.ServerOption{
+		grpc.KeepaliveParams(keepalive.ServerParameters{Time: heartbeat, Timeout: heartbeat}),
+		grpc.KeepaliveEnforcementPolicy(keepalive.EnforcementPolicy{MinTime: heartbeat / 2, PermitWithoutStream: true}),
+	}
+}
+
+// serveAll serves grpcServer on every listener concurrently
+// When one listener fails or ctx is done the server is shut down on all of them,
+// giving running streams up to ShutdownTimeoutSec to finish
+func serveAll(ctx context.Context, grpcServer *grpc.Server, backupStream *BackupStream, listeners []net.Listener) error {
+	serveErrors := make(chan error, len(listeners))
+	for _, listener := range listeners {
+		go func(l net.Listener) {
+			serveErrors <- grpcServer.Serve(l)
+		}(listener)
+	}
+
+	var err error
+	select {
+	case err = <-serveErrors:
+	case <-ctx.Done():
+	}
+
+	timeout := time.Duration(backupStream.config.Load().ShutdownTimeoutSec) * time.Second
+	backupStream.logger.Info("Server shutting down", "timeout", timeout)
+	if shutdown(grpcServer, timeout, backupStream.stopStreams) {
+		backupStream.logger.Info("All streams finished, shutdown complete")
+	} else {
+		backupStream.logger.Warn("Shutdown timed out, closed remaining streams")
+	}
+	return err
+}
+
+// shutdown stops accepting new streams, calls stopStreams to ask running ones to finish
+// and waits up to timeout for them before closing the rest.
+// Returns true when every stream finished in time.
+func shutdown(grpcServer *grpc.Server, timeout time.Duration, stopStreams func()) bool {
+	drained := make(chan struct{})
+	go func() {
+		grpcServer.GracefulStop()
+		close(drained)
+	}()
+	stopStreams()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-drained:
+		return true
+	case <-timer.C:
+		grpcServer.Stop()
+		<-drained
+		return false
+	}
 }
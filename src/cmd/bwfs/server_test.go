@@ -0,0 +1,473 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	pb "github.com/alex-sviridov/miniprotector/api"
+	"github.com/alex-sviridov/miniprotector/common/config"
+	"github.com/alex-sviridov/miniprotector/common/files"
+	"github.com/alex-sviridov/miniprotector/common/logging"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+// newTestContext builds the writer context the way main does
+func newTestContext(conf *config.Config) context.Context {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	ctx := context.WithValue(context.Background(), config.ContextKey, conf)
+	return context.WithValue(ctx, logging.ContextKey, logger)
+}
+
+// startTestServer serves a BackupStream over an in-memory listener and returns a connected client
+func startTestServer(t *testing.T, conf *config.Config) pb.BackupServiceClient {
+	t.Helper()
+	_, client := startTestBackupStream(t, conf)
+	return client
+}
+
+// startTestBackupStream is startTestServer also returning the served BackupStream
+func startTestBackupStream(t *testing.T, conf *config.Config) (*BackupStream, pb.BackupServiceClient) {
+	t.Helper()
+	backupStream, err := NewBackupStream(newTestContext(conf), t.TempDir())
+	if err != nil {
+		t.Fatalf("Failed to create backup stream: %v", err)
+	}
+
+	listener := bufconn.Listen(1024 * 1024)
+	grpcServer := grpc.NewServer()
+	pb.RegisterBackupServiceServer(grpcServer, backupStream)
+	go grpcServer.Serve(listener)
+
+	t.Cleanup(func() {
+		grpcServer.Stop()
+		backupStream.writer.Close()
+	})
+	return backupStream, dialTestListener(t, listener)
+}
+
+// dialTestListener connects a client to an in-memory listener, closed when the test ends
+func dialTestListener(t *testing.T, listener *bufconn.Listener) pb.BackupServiceClient {
+	t.Helper()
+	conn, err := grpc.NewClient("passthrough:///bufnet",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+			return listener.DialContext(ctx)
+		}),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	)
+	if err != nil {
+		t.Fatalf("Failed to create client: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return pb.NewBackupServiceClient(conn)
+}
+
+func TestMaxStreamDuration(t *testing.T) {
+	client := startTestServer(t, &config.Config{MaxStreamDurationSec: 1})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	// Open a stream and never send or close it
+	stream, err := client.ProcessBackupStream(ctx)
+	if err != nil {
+		t.Fatalf("Failed to open stream: %v", err)
+	}
+
+	start := time.Now()
+	_, err = stream.Recv()
+	if status.Code(err) != codes.ResourceExhausted {
+		t.Fatalf("Expected ResourceExhausted from writer, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("Writer took %v to terminate the stream", elapsed)
+	}
+}
+
+func TestStreamWithinMaxDuration(t *testing.T) {
+	client := startTestServer(t, &config.Config{MaxStreamDurationSec: 5})
+
+	stream, err := client.ProcessBackupStream(context.Background())
+	if err != nil {
+		t.Fatalf("Failed to open stream: %v", err)
+	}
+	if err := stream.CloseSend(); err != nil {
+		t.Fatalf("Failed to close send: %v", err)
+	}
+	if _, err := stream.Recv(); err != io.EOF {
+		t.Errorf("Expected clean end of stream, got %v", err)
+	}
+}
+
+// askFileNeeded sends one file's metadata on a new stream and returns the writer's answer
+func askFileNeeded(client pb.BackupServiceClient, fileInfo *files.FileInfo) (bool, error) {
+	attributes, err := files.Encode(fileInfo)
+	if err != nil {
+		return false, err
+	}
+
+	stream, err := client.ProcessBackupStream(context.Background())
+	if err != nil {
+		return false, err
+	}
+	err = stream.Send(&pb.FileRequest{
+		StreamId: 1,
+		RequestType: &pb.FileRequest_FileInfo{
+			FileInfo: &pb.FileInfo{FileId: fileInfo.Path, Attributes: attributes},
+		},
+	})
+	if err != nil {
+		return false, err
+	}
+	resp, err := stream.Recv()
+	if err != nil {
+		return false, err
+	}
+	if err := stream.CloseSend(); err != nil {
+		return false, err
+	}
+	return resp.GetFileNeeded().GetNeeded(), nil
+}
+
+func TestServeMultipleListeners(t *testing.T) {
+	backupStream, err := NewBackupStream(newTestContext(&config.Config{}), t.TempDir())
+	if err != nil {
+		t.Fatalf("Failed to create backup stream: %v", err)
+	}
+	defer backupStream.writer.Close()
+
+	modTime := time.Now().Truncate(time.Second)
+	stored := &files.FileInfo{Path: "/data/stored.txt", Name: "stored.txt", Host: "host1", ModTime: modTime}
+	if err := backupStream.writer.AddFile(stored, ""); err != nil {
+		t.Fatalf("Failed to add file: %v", err)
+	}
+
+	grpcServer := grpc.NewServer()
+	pb.RegisterBackupServiceServer(grpcServer, backupStream)
+	listeners := []net.Listener{bufconn.Listen(1024 * 1024), bufconn.Listen(1024 * 1024)}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	served := make(chan error, 1)
+	go func() { served <- serveAll(ctx, grpcServer, backupStream, listeners) }()
+
+	// Clients on both listeners query the same store at the same time
+	var wg sync.WaitGroup
+	for i, listener := range listeners {
+		client := dialTestListener(t, listener.(*bufconn.Listener))
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			needed, err := askFileNeeded(client, stored)
+			if err != nil {
+				t.Errorf("Listener %d: %v", i, err)
+				return
+			}
+			if needed {
+				t.Errorf("Listener %d: stored file reported as needed", i)
+			}
+
+			missing := &files.FileInfo{Path: fmt.Sprintf("/data/missing_%d.txt", i), Host: "host1", ModTime: modTime}
+			needed, err = askFileNeeded(client, missing)
+			if err != nil {
+				t.Errorf("Listener %d: %v", i, err)
+				return
+			}
+			if !needed {
+				t.Errorf("Listener %d: missing file reported as not needed", i)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	// Cancelling stops serving on every listener
+	cancel()
+	select {
+	case err := <-served:
+		if err != nil {
+			t.Errorf("Expected clean shutdown, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Server did not stop after cancellation")
+	}
+}
+
+func TestServeAllStopsOnListenerFailure(t *testing.T) {
+	backupStream, err := NewBackupStream(newTestContext(&config.Config{}), t.TempDir())
+	if err != nil {
+		t.Fatalf("Failed to create backup stream: %v", err)
+	}
+	defer backupStream.writer.Close()
+
+	grpcServer := grpc.NewServer()
+	healthy := bufconn.Listen(1024 * 1024)
+	broken := bufconn.Listen(1024 * 1024)
+	broken.Close()
+
+	done := make(chan error, 1)
+	go func() {
+		done <- serveAll(context.Background(), grpcServer, backupStream, []net.Listener{healthy, broken})
+	}()
+
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Error("Expected error from the failed listener")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("serveAll kept running after a listener failed")
+	}
+}
+
+func TestIdleStreamReaped(t *testing.T) {
+	client := startTestServer(t, &config.Config{StreamIdleTimeoutSec: 1})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	// Open a stream and never send anything
+	stream, err := client.ProcessBackupStream(ctx)
+	if err != nil {
+		t.Fatalf("Failed to open stream: %v", err)
+	}
+
+	start := time.Now()
+	_, err = stream.Recv()
+	if status.Code(err) != codes.DeadlineExceeded {
+		t.Fatalf("Expected DeadlineExceeded for idle stream, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 3*time.Second {
+		t.Errorf("Idle stream was reaped after %v, expected about 1s", elapsed)
+	}
+}
+
+func TestActiveStreamNotReaped(t *testing.T) {
+	client := startTestServer(t, &config.Config{StreamIdleTimeoutSec: 1})
+
+	stream, err := client.ProcessBackupStream(context.Background())
+	if err != nil {
+		t.Fatalf("Failed to open stream: %v", err)
+	}
+
+	// Each message refreshes the deadline, so a stream lasting longer than the timeout survives
+	modTime := time.Now().Truncate(time.Second)
+	for i := 0; i < 5; i++ {
+		attributes, err := files.Encode(&files.FileInfo{Path: fmt.Sprintf("/data/%d", i), Host: "host1", ModTime: modTime})
+		if err != nil {
+			t.Fatalf("Failed to encode: %v", err)
+		}
+		err = stream.Send(&pb.FileRequest{
+			StreamId: 1,
+			RequestType: &pb.FileRequest_FileInfo{
+				FileInfo: &pb.FileInfo{FileId: fmt.Sprint(i), Attributes: attributes},
+			},
+		})
+		if err != nil {
+			t.Fatalf("Send %d failed: %v", i, err)
+		}
+		if _, err := stream.Recv(); err != nil {
+			t.Fatalf("Recv %d failed: %v", i, err)
+		}
+		time.Sleep(400 * time.Millisecond)
+	}
+
+	if err := stream.CloseSend(); err != nil {
+		t.Fatalf("Failed to close send: %v", err)
+	}
+	if _, err := stream.Recv(); err != io.EOF {
+		t.Errorf("Expected clean end of stream, got %v", err)
+	}
+}
+
+func TestUnknownMessagesCloseStream(t *testing.T) {
+	client := startTestServer(t, &config.Config{MaxUnknownMessages: 3})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	stream, err := client.ProcessBackupStream(ctx)
+	if err != nil {
+		t.Fatalf("Failed to open stream: %v", err)
+	}
+
+	// Garbage up to the limit is tolerated, the stream still answers
+	garbage := &pb.FileRequest{StreamId: 1, RequestType: &pb.FileRequest_ChunkHash{ChunkHash: &pb.ChunkHash{FileId: "junk"}}}
+	for range 3 {
+		if err := stream.Send(garbage); err != nil {
+			t.Fatalf("Failed to send: %v", err)
+		}
+	}
+	fileInfo := &files.FileInfo{Host: "host1", Path: "/data/file", ModTime: time.Now()}
+	attributes, err := files.Encode(fileInfo)
+	if err != nil {
+		t.Fatalf("Failed to encode: %v", err)
+	}
+	err = stream.Send(&pb.FileRequest{
+		StreamId:    1,
+		RequestType: &pb.FileRequest_FileInfo{FileInfo: &pb.FileInfo{FileId: "file", Attributes: attributes}},
+	})
+	if err != nil {
+		t.Fatalf("Failed to send: %v", err)
+	}
+	if resp, err := stream.Recv(); err != nil || resp.GetFileNeeded() == nil {
+		t.Fatalf("Expected FileNeeded after tolerated garbage, got %v, %v", resp, err)
+	}
+
+	// One more, here without any request type, closes the stream
+	if err := stream.Send(&pb.FileRequest{StreamId: 1}); err != nil {
+		t.Fatalf("Failed to send: %v", err)
+	}
+	if _, err := stream.Recv(); status.Code(err) != codes.InvalidArgument {
+		t.Fatalf("Expected InvalidArgument, got %v", err)
+	}
+}
+
+func TestInvalidMetadataClosesStream(t *testing.T) {
+	client := startTestServer(t, &config.Config{})
+
+	for name, attributes := range map[string][]byte{"empty": nil, "FIL": []byte("FIL")} {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		stream, err := client.ProcessBackupStream(ctx)
+		if err != nil {
+			cancel()
+			t.Fatalf("Failed to open stream: %v", err)
+		}
+		err = stream.Send(&pb.FileRequest{
+			StreamId:    1,
+			RequestType: &pb.FileRequest_FileInfo{FileInfo: &pb.FileInfo{FileId: "file", Attributes: attributes}},
+		})
+		if err != nil {
+			cancel()
+			t.Fatalf("Failed to send: %v", err)
+		}
+		if _, err := stream.Recv(); status.Code(err) != codes.InvalidArgument {
+			t.Errorf("%s: expected InvalidArgument, got %v", name, err)
+		}
+		cancel()
+	}
+
+	// The writer survived and serves the next stream
+	if _, err := askFileNeeded(client, &files.FileInfo{Host: "host1", Path: "/data/file", ModTime: time.Now()}); err != nil {
+		t.Errorf("Stream after invalid metadata failed: %v", err)
+	}
+}
+
+func TestConcurrentStreams(t *testing.T) {
+	backupStream, client := startTestBackupStream(t, &config.Config{})
+	const streams, filesPerStream = 20, 5
+
+	// Run with -race: streams share the writer, its counters and the jobs of resumable streams
+	var wg sync.WaitGroup
+	errs := make(chan error, streams)
+	for i := range streams {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs <- backUpDirectories(client, fmt.Sprintf("job-%d", i%4), int32(i+1), filesPerStream)
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Error(err)
+		}
+	}
+	if got := backupStream.filesProcessed.Load(); got != streams*filesPerStream {
+		t.Errorf("Processed %d files, expected %d", got, streams*filesPerStream)
+	}
+}
+
+// backUpDirectories sends count new directories on a resumable stream and ends it
+func backUpDirectories(client pb.BackupServiceClient, jobID string, streamID int32, count int) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	stream, err := client.ProcessBackupStream(ctx)
+	if err != nil {
+		return err
+	}
+	start := &pb.StreamStart{JobId: jobID, ResumeToken: "token", Host: "host"}
+	if err := stream.Send(&pb.FileRequest{StreamId: streamID, RequestType: &pb.FileRequest_Start{Start: start}}); err != nil {
+		return err
+	}
+	for i := range count {
+		fileInfo := &files.FileInfo{Host: "host", Path: fmt.Sprintf("/data/%d/%d", streamID, i), Mode: os.ModeDir | 0755, ModTime: time.Now()}
+		attributes, err := files.Encode(fileInfo)
+		if err != nil {
+			return err
+		}
+		fileID := fileInfo.GetId()
+		err = stream.Send(&pb.FileRequest{StreamId: streamID, RequestType: &pb.FileRequest_FileInfo{FileInfo: &pb.FileInfo{FileId: fileID, Attributes: attributes}}})
+		if err != nil {
+			return err
+		}
+		resp, err := stream.Recv()
+		if err != nil {
+			return err
+		}
+		if resp.StreamId != streamID || !resp.GetFileNeeded().GetNeeded() {
+			return fmt.Errorf("stream %d: unexpected answer %v", streamID, resp)
+		}
+		if err := stream.Send(&pb.FileRequest{StreamId: streamID, RequestType: &pb.FileRequest_FileEnd{FileEnd: &pb.FileEnd{FileId: fileID}}}); err != nil {
+			return err
+		}
+		if resp, err := stream.Recv(); err != nil || !resp.GetResult().GetSuccess() {
+			return fmt.Errorf("stream %d: directory not stored: %v, %v", streamID, resp, err)
+		}
+	}
+	if err := stream.CloseSend(); err != nil {
+		return err
+	}
+	if _, err := stream.Recv(); err != io.EOF {
+		return fmt.Errorf("stream %d: expected the end, got %v", streamID, err)
+	}
+	return nil
+}
+
+func TestResponsesEchoStreamID(t *testing.T) {
+	client := startTestServer(t, &config.Config{})
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	stream, err := client.ProcessBackupStream(ctx)
+	if err != nil {
+		t.Fatalf("Failed to open stream: %v", err)
+	}
+
+	fileInfo := &files.FileInfo{Host: "host", Path: "/data/dir", Mode: os.ModeDir | 0755, ModTime: time.Now()}
+	attributes, err := files.Encode(fileInfo)
+	if err != nil {
+		t.Fatalf("Failed to encode: %v", err)
+	}
+	for _, req := range []*pb.FileRequest{
+		{StreamId: 7, RequestType: &pb.FileRequest_FileInfo{FileInfo: &pb.FileInfo{FileId: "dir", Attributes: attributes}}},
+		{StreamId: 7, RequestType: &pb.FileRequest_FileEnd{FileEnd: &pb.FileEnd{FileId: "dir"}}},
+		{StreamId: 7, RequestType: &pb.FileRequest_Batch{Batch: &pb.FileBatch{Files: []*pb.FileInfo{{FileId: "dir", Attributes: attributes}}}}},
+	} {
+		if err := stream.Send(req); err != nil {
+			t.Fatalf("Failed to send: %v", err)
+		}
+		resp, err := stream.Recv()
+		if err != nil {
+			t.Fatalf("%T: failed to receive: %v", req.RequestType, err)
+		}
+		if resp.StreamId != req.StreamId {
+			t.Errorf("%T answered on stream %d, expected %d", req.RequestType, resp.StreamId, req.StreamId)
+		}
+	}
+
+	// Another id on the same stream is refused
+	if err := stream.Send(&pb.FileRequest{StreamId: 8, RequestType: &pb.FileRequest_FileInfo{FileInfo: &pb.FileInfo{FileId: "dir", Attributes: attributes}}}); err != nil {
+		t.Fatalf("Failed to send: %v", err)
+	}
+	if _, err := stream.Recv(); status.Code(err) != codes.InvalidArgument {
+		t.Errorf("Expected InvalidArgument for a changed stream id, got %v", err)
+	}
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	pb "github.com/alex-sviridov/miniprotector/api"
+	"github.com/alex-sviridov/miniprotector/common/config"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+// slowService is a backup service whose streams ignore shutdown requests
+type slowService struct {
+	pb.UnimplementedBackupServiceServer
+	started chan struct{}
+	delay   time.Duration // How long a stream runs, zero means until the client goes away
+}
+
+func (s *slowService) ProcessBackupStream(stream pb.BackupService_ProcessBackupStreamServer) error {
+	close(s.started)
+	if s.delay == 0 {
+		<-stream.Context().Done()
+		return nil
+	}
+	time.Sleep(s.delay)
+	return nil
+}
+
+// startSlowStream serves service and opens one stream to it, returning once the handler runs
+func startSlowStream(t *testing.T, service *slowService) *grpc.Server {
+	t.Helper()
+	listener := bufconn.Listen(1024 * 1024)
+	grpcServer := grpc.NewServer()
+	pb.RegisterBackupServiceServer(grpcServer, service)
+	go grpcServer.Serve(listener)
+	t.Cleanup(grpcServer.Stop)
+
+	client := dialTestListener(t, listener)
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	stream, err := client.ProcessBackupStream(ctx)
+	if err != nil {
+		t.Fatalf("Failed to open stream: %v", err)
+	}
+	go stream.Recv()
+
+	select {
+	case <-service.started:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Stream handler did not start")
+	}
+	return grpcServer
+}
+
+func TestShutdownWaitsForStreams(t *testing.T) {
+	const delay = 300 * time.Millisecond
+	grpcServer := startSlowStream(t, &slowService{started: make(chan struct{}), delay: delay})
+
+	start := time.Now()
+	if !shutdown(grpcServer, 5*time.Second, func() {}) {
+		t.Error("Expected clean drain when the stream finishes within the timeout")
+	}
+	if elapsed := time.Since(start); elapsed < delay/2 {
+		t.Errorf("Shutdown returned after %v, before the running stream finished", elapsed)
+	}
+}
+
+func TestShutdownTimeout(t *testing.T) {
+	grpcServer := startSlowStream(t, &slowService{started: make(chan struct{})})
+
+	start := time.Now()
+	if shutdown(grpcServer, 100*time.Millisecond, func() {}) {
+		t.Error("Expected forced shutdown when the stream outlives the timeout")
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("Shutdown took %v despite a 100ms timeout", elapsed)
+	}
+}
+
+func TestShutdownStopsIdleStreams(t *testing.T) {
+	backupStream, err := NewBackupStream(newTestContext(&config.Config{ShutdownTimeoutSec: 5}), t.TempDir())
+	if err != nil {
+		t.Fatalf("Failed to create backup stream: %v", err)
+	}
+	defer backupStream.writer.Close()
+
+	grpcServer := grpc.NewServer()
+	pb.RegisterBackupServiceServer(grpcServer, backupStream)
+	listener := bufconn.Listen(1024 * 1024)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	served := make(chan error, 1)
+	go func() { served <- serveAll(ctx, grpcServer, backupStream, []net.Listener{listener}) }()
+
+	// An open stream between messages is asked to stop instead of holding up shutdown
+	stream, err := dialTestListener(t, listener).ProcessBackupStream(context.Background())
+	if err != nil {
+		t.Fatalf("Failed to open stream: %v", err)
+	}
+	recvErr := make(chan error, 1)
+	go func() {
+		_, err := stream.Recv()
+		recvErr <- err
+	}()
+
+	time.Sleep(50 * time.Millisecond)
+	start := time.Now()
+	cancel()
+
+	select {
+	case err := <-served:
+		if err != nil {
+			t.Errorf("Expected clean shutdown, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Server did not shut down")
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("Shutdown waited %v for an idle stream", elapsed)
+	}
+	if err := <-recvErr; status.Code(err) != codes.Unavailable {
+		t.Errorf("Expected Unavailable for the stopped stream, got %v", err)
+	}
+}
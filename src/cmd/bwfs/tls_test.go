@@ -0,0 +1,306 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	pb "github.com/alex-sviridov/miniprotector/api"
+	"github.com/alex-sviridov/miniprotector/common"
+	"github.com/alex-sviridov/miniprotector/common/config"
+	"github.com/alex-sviridov/miniprotector/common/files"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/status"
+)
+
+// testCA is a throwaway certificate authority for TLS tests
+type testCA struct {
+	cert    *x509.Certificate
+	key     *ecdsa.PrivateKey
+	certPEM []byte
+}
+
+// newTestCA creates a self-signed CA certificate
+func newTestCA(t *testing.T, name string) *testCA {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate CA key: %v", err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("Failed to create CA certificate: %v", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("Failed to parse CA certificate: %v", err)
+	}
+
+	return &testCA{
+		cert:    cert,
+		key:     key,
+		certPEM: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+	}
+}
+
+// issue signs a leaf certificate for commonName and returns it with its key in PEM form
+func (ca *testCA) issue(t *testing.T, commonName string, usage x509.ExtKeyUsage) ([]byte, []byte) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: commonName},
+		DNSNames:     []string{commonName},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatalf("Failed to create certificate: %v", err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("Failed to marshal key: %v", err)
+	}
+
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+}
+
+// writeTestFile stores data in dir and returns its path
+func writeTestFile(t *testing.T, dir, name string, data []byte) string {
+	t.Helper()
+	path := filepath.Join(dir, name)
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		t.Fatalf("Failed to write %s: %v", name, err)
+	}
+	return path
+}
+
+// startTLSServer serves a BackupStream with conf over TCP on localhost and returns its address
+func startTLSServer(t *testing.T, conf *config.Config) string {
+	t.Helper()
+	grpcServer, err := newGRPCServer(conf)
+	if err != nil {
+		t.Fatalf("Failed to create server: %v", err)
+	}
+	backupStream, err := NewBackupStream(newTestContext(conf), t.TempDir())
+	if err != nil {
+		t.Fatalf("Failed to create backup stream: %v", err)
+	}
+	pb.RegisterBackupServiceServer(grpcServer, backupStream)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	go grpcServer.Serve(listener)
+
+	t.Cleanup(func() {
+		grpcServer.Stop()
+		backupStream.writer.Close()
+	})
+	return listener.Addr().String()
+}
+
+// dialTLS returns a client connected to addr with the client side of conf
+func dialTLS(t *testing.T, addr string, conf *config.Config) pb.BackupServiceClient {
+	t.Helper()
+	tlsConfig, err := common.ClientTLSConfig(conf)
+	if err != nil {
+		t.Fatalf("Failed to build client TLS config: %v", err)
+	}
+	conn, err := grpc.NewClient(addr, grpc.WithTransportCredentials(credentials.NewTLS(tlsConfig)))
+	if err != nil {
+		t.Fatalf("Failed to create client: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return pb.NewBackupServiceClient(conn)
+}
+
+// openTLSStream connects to addr with the client side of conf and opens a backup stream
+func openTLSStream(t *testing.T, addr string, conf *config.Config) (pb.BackupService_ProcessBackupStreamClient, error) {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	t.Cleanup(cancel)
+	return dialTLS(t, addr, conf).ProcessBackupStream(ctx)
+}
+
+func TestTLSStream(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCA(t, "test-ca")
+	certPEM, keyPEM := ca.issue(t, "localhost", x509.ExtKeyUsageServerAuth)
+
+	conf := &config.Config{
+		TLSCertFile: writeTestFile(t, dir, "server.crt", certPEM),
+		TLSKeyFile:  writeTestFile(t, dir, "server.key", keyPEM),
+		TLSCAFile:   writeTestFile(t, dir, "ca.crt", ca.certPEM),
+	}
+	addr := startTLSServer(t, conf)
+
+	stream, err := openTLSStream(t, addr, conf)
+	if err != nil {
+		t.Fatalf("Failed to open stream over TLS: %v", err)
+	}
+	if err := stream.CloseSend(); err != nil {
+		t.Fatalf("Failed to close send: %v", err)
+	}
+	if _, err := stream.Recv(); err != io.EOF {
+		t.Errorf("Expected clean end of stream, got %v", err)
+	}
+}
+
+func TestTLSHandshakeFailure(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCA(t, "test-ca")
+	certPEM, keyPEM := ca.issue(t, "localhost", x509.ExtKeyUsageServerAuth)
+	addr := startTLSServer(t, &config.Config{
+		TLSCertFile: writeTestFile(t, dir, "server.crt", certPEM),
+		TLSKeyFile:  writeTestFile(t, dir, "server.key", keyPEM),
+	})
+
+	// Client trusts a different CA than the one that signed the server certificate
+	otherCA := newTestCA(t, "other-ca")
+	clientConf := &config.Config{TLSCAFile: writeTestFile(t, dir, "other-ca.crt", otherCA.certPEM)}
+
+	stream, err := openTLSStream(t, addr, clientConf)
+	if err == nil {
+		_, err = stream.Recv()
+	}
+	if err == nil {
+		t.Fatal("Expected handshake failure with untrusted server certificate")
+	}
+	if !strings.Contains(err.Error(), "handshake failed") || !strings.Contains(err.Error(), "certificate") {
+		t.Errorf("Expected a clear certificate handshake error, got %v", err)
+	}
+}
+
+func TestMutualTLSAllowlist(t *testing.T) {
+	dir := t.TempDir()
+	serverCA := newTestCA(t, "server-ca")
+	readersCA := newTestCA(t, "readers-ca")
+	serverCert, serverKey := serverCA.issue(t, "localhost", x509.ExtKeyUsageServerAuth)
+
+	serverCAFile := writeTestFile(t, dir, "server-ca.crt", serverCA.certPEM)
+	addr := startTLSServer(t, &config.Config{
+		TLSCertFile:        writeTestFile(t, dir, "server.crt", serverCert),
+		TLSKeyFile:         writeTestFile(t, dir, "server.key", serverKey),
+		TLSClientCAFile:    writeTestFile(t, dir, "readers-ca.crt", readersCA.certPEM),
+		AllowedClientHosts: []string{"reader1"},
+	})
+
+	// readerConf returns a client configuration presenting a certificate for name
+	readerConf := func(name string) *config.Config {
+		cert, key := readersCA.issue(t, name, x509.ExtKeyUsageClientAuth)
+		return &config.Config{
+			TLSCAFile:   serverCAFile,
+			TLSCertFile: writeTestFile(t, dir, name+".crt", cert),
+			TLSKeyFile:  writeTestFile(t, dir, name+".key", key),
+		}
+	}
+
+	t.Run("authorized client", func(t *testing.T) {
+		stream, err := openTLSStream(t, addr, readerConf("reader1"))
+		if err != nil {
+			t.Fatalf("Failed to open stream: %v", err)
+		}
+		if err := stream.CloseSend(); err != nil {
+			t.Fatalf("Failed to close send: %v", err)
+		}
+		if _, err := stream.Recv(); err != io.EOF {
+			t.Errorf("Expected clean end of stream, got %v", err)
+		}
+	})
+
+	t.Run("client not in allowlist", func(t *testing.T) {
+		stream, err := openTLSStream(t, addr, readerConf("reader2"))
+		if err != nil {
+			t.Fatalf("Failed to open stream: %v", err)
+		}
+		if _, err := stream.Recv(); status.Code(err) != codes.PermissionDenied {
+			t.Errorf("Expected PermissionDenied, got %v", err)
+		}
+	})
+
+	t.Run("host of another client", func(t *testing.T) {
+		client := dialTLS(t, addr, readerConf("reader1"))
+		if _, err := askFileNeeded(client, &files.FileInfo{Host: "reader1", Path: "/data/own", Name: "own"}); err != nil {
+			t.Fatalf("Expected the client's own file to be accepted, got %v", err)
+		}
+		if _, err := askFileNeeded(client, &files.FileInfo{Host: "reader2", Path: "/data/other", Name: "other"}); status.Code(err) != codes.PermissionDenied {
+			t.Errorf("File of another host: expected PermissionDenied, got %v", err)
+		}
+
+		stream, err := client.ProcessBackupStream(context.Background())
+		if err != nil {
+			t.Fatalf("Failed to open stream: %v", err)
+		}
+		start := &pb.StreamStart{Host: "reader2", JobId: "job-1", ResumeToken: "token"}
+		if err := stream.Send(&pb.FileRequest{StreamId: 1, RequestType: &pb.FileRequest_Start{Start: start}}); err != nil {
+			t.Fatalf("Failed to send stream start: %v", err)
+		}
+		if _, err := stream.Recv(); status.Code(err) != codes.PermissionDenied {
+			t.Errorf("Stream start for another host: expected PermissionDenied, got %v", err)
+		}
+
+		ctx := context.Background()
+		progress := &pb.StreamProgressRequest{Host: "reader2", JobId: "job-1", StreamId: 1, ResumeToken: "token"}
+		if _, err := client.GetStreamProgress(ctx, progress); status.Code(err) != codes.PermissionDenied {
+			t.Errorf("Progress of another host: expected PermissionDenied, got %v", err)
+		}
+		listing, err := client.ListBackedUpFiles(ctx, &pb.BackedUpFilesRequest{Host: "reader2", Path: "/data"})
+		if err == nil {
+			_, err = listing.Recv()
+		}
+		if status.Code(err) != codes.PermissionDenied {
+			t.Errorf("Listing of another host: expected PermissionDenied, got %v", err)
+		}
+	})
+
+	t.Run("client without certificate", func(t *testing.T) {
+		stream, err := openTLSStream(t, addr, &config.Config{TLSCAFile: serverCAFile})
+		if err == nil {
+			_, err = stream.Recv()
+		}
+		if err == nil || err == io.EOF {
+			t.Errorf("Expected connection failure without client certificate, got %v", err)
+		}
+	})
+}
+
+func TestAllowlistRequiresClientCA(t *testing.T) {
+	if _, err := newGRPCServer(&config.Config{AllowedClientHosts: []string{"reader1"}}); err == nil {
+		t.Error("Expected error for allowlist without client certificate verification")
+	}
+}
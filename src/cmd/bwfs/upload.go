@@ -0,0 +1,235 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"hash"
+	"log/slog"
+
+	"github.com/alex-sviridov/miniprotector/common/chunker"
+	"github.com/alex-sviridov/miniprotector/common/files"
+	"github.com/alex-sviridov/miniprotector/common/wfs"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	pb "github.com/alex-sviridov/miniprotector/api"
+)
+
+// upload tracks a file being received, from the FileNeeded reply to its FileEnd.
+// Small files are buffered to be stored inline, larger ones go to the chunk store as chunks arrive.
+type upload struct {
+	fileInfo *files.FileInfo
+	next     int64     // End of the data received so far, the next chunk starts there or after a hole
+	algo     string    // Algorithm of the checksums of the file
+	hash     hash.Hash // Hash of all data received so far
+	chunks   []wfs.ChunkRef
+	inline   bool // Data is buffered in content until FileEnd
+	content  []byte
+	err      error // First error, the rest of the file is ignored and it is not recorded
+}
+
+// uploads holds the files of one stream that were requested and not finished yet, by file id
+type uploads map[string]*upload
+
+// newUpload starts receiving the data of a file hashed with algo, empty meaning blake3
+func (s *BackupStream) newUpload(fileInfo *files.FileInfo, algo string) (*upload, error) {
+	if algo == "" {
+		algo = chunker.HashBLAKE3
+	}
+	hash, err := chunker.NewHasher(algo, 0)
+	if err != nil {
+		return nil, err
+	}
+	return &upload{
+		fileInfo: fileInfo,
+		algo:     algo,
+		hash:     hash,
+		inline:   fileInfo.Mode.IsRegular() && s.writer.StoresInline(fileInfo.Size),
+	}, nil
+}
+
+// addChunk decompresses and verifies a chunk and stores or buffers its data.
+// A chunk starting past the end of the previous one leaves a hole in between.
+func (s *BackupStream) addChunk(u *upload, chunk *pb.Chunk) error {
+	if chunk.Offset < u.next {
+		return fmt.Errorf("chunk at offset %d, expected %d or after", chunk.Offset, u.next)
+	}
+	if algo := chunker.ChecksumAlgo(chunk.Checksum); algo != u.algo {
+		return fmt.Errorf("chunk checksum made by %s, expected %s", algo, u.algo)
+	}
+	data, err := chunker.Decompress(chunk.Compression, chunk.Data)
+	if err != nil {
+		return err
+	}
+	if err := s.addHole(u, chunk.Offset); err != nil {
+		return err
+	}
+	if u.inline && u.next+int64(len(data)) > int64(s.config.Load().InlineMaxSize) {
+		// The file grew past the inline limit, keep it as chunks after all
+		if err := s.flushInline(u); err != nil {
+			return err
+		}
+	}
+	if u.inline {
+		actual, err := chunker.ChecksumWith(u.algo, data)
+		if err != nil {
+			return err
+		}
+		if actual != chunk.Checksum {
+			return fmt.Errorf("chunk checksum mismatch: expected %s, got %s", chunk.Checksum, actual)
+		}
+		u.content = append(u.content, data...)
+	} else {
+		if err := s.writer.StoreChunk(chunk.Checksum, data); err != nil {
+			return err
+		}
+	}
+	u.chunks = append(u.chunks, wfs.ChunkRef{Offset: chunk.Offset, Size: int64(len(data)), Checksum: chunk.Checksum})
+	u.hash.Write(data)
+	u.next += int64(len(data))
+	return nil
+}
+
+// addHole accounts for a hole from the end of the data received up to offset.
+// Holes aren't stored, chunk offsets record them, but inline content keeps them as zeros.
+func (s *BackupStream) addHole(u *upload, offset int64) error {
+	if offset == u.next {
+		return nil
+	}
+	if u.inline && offset > int64(s.config.Load().InlineMaxSize) {
+		if err := s.flushInline(u); err != nil {
+			return err
+		}
+	}
+	if u.inline {
+		u.content = append(u.content, make([]byte, offset-u.next)...)
+	}
+	chunker.WriteZeros(u.hash, offset-u.next)
+	u.next = offset
+	return nil
+}
+
+// flushInline moves buffered data of an upload to the chunk store
+func (s *BackupStream) flushInline(u *upload) error {
+	for _, ref := range u.chunks {
+		data := u.content[ref.Offset : ref.Offset+ref.Size]
+		if err := s.writer.StoreChunk(ref.Checksum, data); err != nil {
+			return err
+		}
+	}
+	u.inline = false
+	u.content = nil
+	return nil
+}
+
+// finish checks the received data against the FileEnd summary and records the file
+func (s *BackupStream) finish(u *upload, end *pb.FileEnd, logger *slog.Logger) error {
+	if !u.fileInfo.Mode.IsRegular() {
+		return s.writer.AddFile(u.fileInfo, "")
+	}
+	if end.SameAs != "" {
+		// Content already stored for another file of this run
+		if u.next != 0 {
+			return fmt.Errorf("received %d bytes for a file linked to %s", u.next, end.SameAs)
+		}
+		u.fileInfo.Size = end.Size
+		return s.writer.AddFileLinked(u.fileInfo, end.Checksum, end.SameAs)
+	}
+	if end.StoredContent {
+		// Content already stored for any file, from any host
+		if u.next != 0 {
+			return fmt.Errorf("received %d bytes for a file with stored content", u.next)
+		}
+		u.fileInfo.Size = end.Size
+		return s.writer.AddFileByChecksum(u.fileInfo, end.Checksum)
+	}
+	// The file may end with a hole
+	if end.Size < u.next {
+		return fmt.Errorf("received %d bytes, reader sent %d", u.next, end.Size)
+	}
+	if err := s.addHole(u, end.Size); err != nil {
+		return err
+	}
+	if actual := chunker.FormatChecksum(u.algo, u.hash.Sum(nil)); actual != end.Checksum {
+		return fmt.Errorf("file checksum mismatch: expected %s, got %s", end.Checksum, actual)
+	}
+	// The file changed size between the scan and the read, record the size of the data stored
+	if end.Size != u.fileInfo.Size {
+		logger.Warn("File size changed since scan, storing received size",
+			"path", u.fileInfo.Path,
+			"scanned_size", u.fileInfo.Size,
+			"received_size", end.Size)
+		u.fileInfo.Size = end.Size
+	}
+	if u.inline {
+		return s.writer.AddFileInline(u.fileInfo, end.Checksum, u.content)
+	}
+	return s.writer.AddFileChunks(u.fileInfo, end.Checksum, u.chunks)
+}
+
+func (s *BackupStream) handleChunkRequest(state *streamState, req *pb.FileRequest) {
+	chunk := req.GetChunk()
+	u, ok := state.pending[chunk.FileId]
+	if !ok {
+		state.logger.Warn("Received chunk of a file that wasn't requested",
+			"file_id", chunk.FileId,
+			"streamId", req.StreamId)
+		return
+	}
+	if u.err != nil {
+		return
+	}
+	if err := s.addChunk(u, chunk); err != nil {
+		u.err = err
+	}
+}
+
+func (s *BackupStream) handleFileEndRequest(state *streamState, req *pb.FileRequest) *pb.FileResponse {
+	pending := state.pending
+	end := req.GetFileEnd()
+	logger := state.logger.
+		With(slog.String("file_id", end.FileId)).
+		With(slog.Int("streamId", int(req.StreamId)))
+
+	result := &pb.ProcessingResult{FileId: end.FileId}
+	u, ok := pending[end.FileId]
+	delete(pending, end.FileId)
+	switch {
+	case !ok:
+		result.Message = "file wasn't requested"
+	case end.Error != "":
+		result.Message = "reader failed: " + end.Error
+	case u.err != nil:
+		result.Message = u.err.Error()
+	default:
+		if err := s.finish(u, end, logger); err != nil {
+			result.Message = err.Error()
+		} else {
+			result.Success = true
+		}
+	}
+
+	if result.Success {
+		logger.Debug("File stored", "size", end.Size, "chunks", len(u.chunks), "inline", u.inline)
+		s.settleFiles(state, end.FileId)
+	} else {
+		logger.Error("File not stored", "error", result.Message)
+	}
+	return &pb.FileResponse{
+		StreamId:     req.StreamId,
+		ResponseType: &pb.FileResponse_Result{Result: result},
+	}
+}
+
+// HasContent tells a reader whether content is already stored, so a file with it can be recorded
+// with a FileEnd marked stored_content instead of sending its data
+func (s *BackupStream) HasContent(ctx context.Context, req *pb.ContentQuery) (*pb.ContentKnown, error) {
+	if err := authorizeCall(ctx, s.config.Load()); err != nil {
+		return nil, err
+	}
+	known, err := s.writer.HasContent(req.Checksum, req.Size)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to look up content: %v", err)
+	}
+	return &pb.ContentKnown{Known: known}, nil
+}
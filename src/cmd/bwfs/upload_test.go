@@ -0,0 +1,736 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	pb "github.com/alex-sviridov/miniprotector/api"
+	"github.com/alex-sviridov/miniprotector/common/chunker"
+	"github.com/alex-sviridov/miniprotector/common/config"
+	"github.com/alex-sviridov/miniprotector/common/files"
+	"github.com/alex-sviridov/miniprotector/common/wfs"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// sendFile plays the reader for one file: sends its metadata and, when the writer asks for it,
+// its data, skipping the holes of sparse files. Returns the writer's result, nil when the file wasn't needed.
+// corrupt is applied to each chunk before sending.
+func sendFile(t *testing.T, stream pb.BackupService_ProcessBackupStreamClient, file *files.FileInfo, corrupt func(*pb.Chunk)) *pb.ProcessingResult {
+	t.Helper()
+	return sendFileHashed(t, stream, file, "", corrupt)
+}
+
+// sendFileHashed is sendFile with the checksums made by algo
+func sendFileHashed(t *testing.T, stream pb.BackupService_ProcessBackupStreamClient, file *files.FileInfo, algo string, corrupt func(*pb.Chunk)) *pb.ProcessingResult {
+	t.Helper()
+	attributes, err := files.Encode(file)
+	if err != nil {
+		t.Fatalf("Failed to encode %s: %v", file.Path, err)
+	}
+	fileID := file.GetId()
+	err = stream.Send(&pb.FileRequest{
+		StreamId:    1,
+		RequestType: &pb.FileRequest_FileInfo{FileInfo: &pb.FileInfo{FileId: fileID, Attributes: attributes, HashAlgo: algo}},
+	})
+	if err != nil {
+		t.Fatalf("Failed to send metadata: %v", err)
+	}
+	resp, err := stream.Recv()
+	if err != nil {
+		t.Fatalf("Failed to receive answer: %v", err)
+	}
+	if !resp.GetFileNeeded().GetNeeded() {
+		return nil
+	}
+
+	end := &pb.FileEnd{FileId: fileID}
+	if file.Mode.IsRegular() {
+		f, err := os.Open(file.Path)
+		if err != nil {
+			t.Fatalf("Failed to open %s: %v", file.Path, err)
+		}
+		defer f.Close()
+		chunkFile := chunker.ChunkFile
+		if file.IsSparse() {
+			chunkFile = chunker.ChunkSparseFile
+		}
+		end.Checksum, end.Size, err = chunkFile(f, chunker.DefaultChunkSize, algo, func(c chunker.Chunk) error {
+			chunk := &pb.Chunk{FileId: fileID, Offset: c.Offset, Data: c.Data, Checksum: c.Checksum}
+			if corrupt != nil {
+				corrupt(chunk)
+			}
+			return stream.Send(&pb.FileRequest{StreamId: 1, RequestType: &pb.FileRequest_Chunk{Chunk: chunk}})
+		})
+		if err != nil {
+			t.Fatalf("Failed to send data of %s: %v", file.Path, err)
+		}
+	}
+	if err := stream.Send(&pb.FileRequest{StreamId: 1, RequestType: &pb.FileRequest_FileEnd{FileEnd: end}}); err != nil {
+		t.Fatalf("Failed to send end of %s: %v", file.Path, err)
+	}
+	resp, err = stream.Recv()
+	if err != nil {
+		t.Fatalf("Failed to receive result: %v", err)
+	}
+	if resp.GetResult() == nil {
+		t.Fatalf("Expected a result for %s, got %v", file.Path, resp)
+	}
+	return resp.GetResult()
+}
+
+// backupTree scans root and sends every file on one stream, returning the scanned files and results by path
+func backupTree(t *testing.T, client pb.BackupServiceClient, root string) ([]files.FileInfo, map[string]*pb.ProcessingResult) {
+	t.Helper()
+	fileList, _, err := files.Scan(root, files.ScanOptions{})
+	if err != nil {
+		t.Fatalf("Scan failed: %v", err)
+	}
+	stream, err := client.ProcessBackupStream(context.Background())
+	if err != nil {
+		t.Fatalf("Failed to open stream: %v", err)
+	}
+	results := make(map[string]*pb.ProcessingResult)
+	for i := range fileList {
+		if result := sendFile(t, stream, &fileList[i], nil); result != nil {
+			results[fileList[i].Path] = result
+		}
+	}
+	if err := stream.CloseSend(); err != nil {
+		t.Fatalf("Failed to close send: %v", err)
+	}
+	return fileList, results
+}
+
+func TestBackupDirectory(t *testing.T) {
+	root := t.TempDir()
+	large := make([]byte, 2*chunker.DefaultChunkSize+100)
+	for i := range large {
+		large[i] = byte(i % 251)
+	}
+	contents := map[string][]byte{
+		filepath.Join(root, "tiny.txt"):         []byte("hello"),
+		filepath.Join(root, "empty"):            {},
+		filepath.Join(root, "sub", "large.bin"): large,
+	}
+	if err := os.Mkdir(filepath.Join(root, "sub"), 0700); err != nil {
+		t.Fatalf("Failed to create directory: %v", err)
+	}
+	for path, data := range contents {
+		if err := os.WriteFile(path, data, 0600); err != nil {
+			t.Fatalf("Failed to write %s: %v", path, err)
+		}
+	}
+
+	backupStream, client := startTestBackupStream(t, &config.Config{InlineMaxSize: 16})
+	fileList, results := backupTree(t, client, root)
+
+	if len(results) != len(fileList) {
+		t.Fatalf("Writer asked for %d of %d files", len(results), len(fileList))
+	}
+	for path, result := range results {
+		if !result.Success {
+			t.Errorf("Writer failed to store %s: %s", path, result.Message)
+		}
+	}
+	for path, want := range contents {
+		var got bytes.Buffer
+		if err := backupStream.writer.ReadFile(path, fileList[0].Host, &got); err != nil {
+			t.Fatalf("Failed to read back %s: %v", path, err)
+		}
+		if !bytes.Equal(got.Bytes(), want) {
+			t.Errorf("Stored content of %s doesn't match the source", path)
+		}
+	}
+	if _, inline, _ := backupStream.writer.ReadInline(filepath.Join(root, "tiny.txt"), fileList[0].Host); !inline {
+		t.Error("Expected the tiny file to be stored inline")
+	}
+
+	// Everything is recorded, a second run sends nothing
+	if _, results := backupTree(t, client, root); len(results) != 0 {
+		t.Errorf("Writer asked for %d files already backed up", len(results))
+	}
+}
+
+func TestBackupHashAlgorithms(t *testing.T) {
+	root := t.TempDir()
+	large := make([]byte, chunker.DefaultChunkSize+100)
+	for i := range large {
+		large[i] = byte(i % 251)
+	}
+	contents := map[string][]byte{
+		filepath.Join(root, "tiny.txt"):  []byte("hello"),
+		filepath.Join(root, "large.bin"): large,
+	}
+	for path, data := range contents {
+		if err := os.WriteFile(path, data, 0600); err != nil {
+			t.Fatalf("Failed to write %s: %v", path, err)
+		}
+	}
+	fileList, _, err := files.Scan(root, files.ScanOptions{})
+	if err != nil {
+		t.Fatalf("Scan failed: %v", err)
+	}
+
+	for _, algo := range []string{chunker.HashSHA256, chunker.HashSHA512} {
+		t.Run(algo, func(t *testing.T) {
+			backupStream, client := startTestBackupStream(t, &config.Config{InlineMaxSize: 16})
+			stream, err := client.ProcessBackupStream(context.Background())
+			if err != nil {
+				t.Fatalf("Failed to open stream: %v", err)
+			}
+			for i := range fileList {
+				if result := sendFileHashed(t, stream, &fileList[i], algo, nil); result == nil || !result.Success {
+					t.Errorf("Writer failed to store %s: %v", fileList[i].Path, result)
+				}
+			}
+			stream.CloseSend()
+
+			for path, want := range contents {
+				var got bytes.Buffer
+				if err := backupStream.writer.ReadFile(path, fileList[0].Host, &got); err != nil {
+					t.Fatalf("Failed to read back %s: %v", path, err)
+				}
+				if !bytes.Equal(got.Bytes(), want) {
+					t.Errorf("Stored content of %s doesn't match the source", path)
+				}
+			}
+			stored, err := backupStream.writer.ListFilesForHost(fileList[0].Host)
+			if err != nil {
+				t.Fatalf("Failed to list files: %v", err)
+			}
+			for _, file := range stored {
+				if _, ok := contents[file.FileInfo.Path]; ok && chunker.ChecksumAlgo(file.Checksum) != algo {
+					t.Errorf("%s stored with checksum %s, expected %s", file.FileInfo.Path, file.Checksum, algo)
+				}
+			}
+		})
+	}
+
+	t.Run("mismatched chunks", func(t *testing.T) {
+		_, client := startTestBackupStream(t, &config.Config{})
+		stream, err := client.ProcessBackupStream(context.Background())
+		if err != nil {
+			t.Fatalf("Failed to open stream: %v", err)
+		}
+		defer stream.CloseSend()
+		// Chunks hashed with blake3 for a file announced as sha256
+		for i := range fileList {
+			if !fileList[i].Mode.IsRegular() {
+				continue
+			}
+			result := sendFileHashed(t, stream, &fileList[i], chunker.HashSHA256, func(chunk *pb.Chunk) {
+				chunk.Checksum = chunker.Checksum(chunk.Data)
+			})
+			if result == nil || result.Success {
+				t.Errorf("Writer accepted %s with blake3 chunks: %v", fileList[i].Path, result)
+			}
+		}
+	})
+
+	t.Run("unknown", func(t *testing.T) {
+		_, client := startTestBackupStream(t, &config.Config{})
+		stream, err := client.ProcessBackupStream(context.Background())
+		if err != nil {
+			t.Fatalf("Failed to open stream: %v", err)
+		}
+		attributes, err := files.Encode(&fileList[0])
+		if err != nil {
+			t.Fatalf("Failed to encode: %v", err)
+		}
+		err = stream.Send(&pb.FileRequest{
+			StreamId:    1,
+			RequestType: &pb.FileRequest_FileInfo{FileInfo: &pb.FileInfo{FileId: fileList[0].GetId(), Attributes: attributes, HashAlgo: "md5"}},
+		})
+		if err != nil {
+			t.Fatalf("Failed to send metadata: %v", err)
+		}
+		if _, err := stream.Recv(); status.Code(err) != codes.InvalidArgument {
+			t.Errorf("Expected InvalidArgument for an unknown algorithm, got %v", err)
+		}
+	})
+}
+
+func TestBackupRejectsCorruptChunk(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "file.bin")
+	if err := os.WriteFile(path, bytes.Repeat([]byte("data"), 100), 0600); err != nil {
+		t.Fatalf("Failed to write file: %v", err)
+	}
+	fileList, _, err := files.Scan(path, files.ScanOptions{})
+	if err != nil || len(fileList) != 1 {
+		t.Fatalf("Scan failed: %v", err)
+	}
+
+	for _, inlineMax := range []int{0, 1024} {
+		client := startTestServer(t, &config.Config{InlineMaxSize: inlineMax})
+		stream, err := client.ProcessBackupStream(context.Background())
+		if err != nil {
+			t.Fatalf("Failed to open stream: %v", err)
+		}
+
+		result := sendFile(t, stream, &fileList[0], func(chunk *pb.Chunk) { chunk.Data[0] ^= 0xff })
+		if result == nil || result.Success {
+			t.Fatalf("Expected corrupt file to be rejected with InlineMaxSize=%d, got %v", inlineMax, result)
+		}
+		stream.CloseSend()
+
+		// The file wasn't recorded, the writer still needs it
+		needed, err := askFileNeeded(client, &fileList[0])
+		if err != nil {
+			t.Fatalf("Failed to ask for file: %v", err)
+		}
+		if !needed {
+			t.Errorf("Rejected file was recorded with InlineMaxSize=%d", inlineMax)
+		}
+	}
+}
+
+func TestBackupCompressedChunks(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "file.txt")
+	if err := os.WriteFile(path, bytes.Repeat([]byte("compressible "), 100), 0600); err != nil {
+		t.Fatalf("Failed to write file: %v", err)
+	}
+	fileList, _, err := files.Scan(path, files.ScanOptions{})
+	if err != nil || len(fileList) != 1 {
+		t.Fatalf("Scan failed: %v", err)
+	}
+
+	for _, inlineMax := range []int{0, 4096} {
+		client := startTestServer(t, &config.Config{InlineMaxSize: inlineMax, Compression: chunker.CompressionGzip})
+		stream, err := client.ProcessBackupStream(context.Background())
+		if err != nil {
+			t.Fatalf("Failed to open stream: %v", err)
+		}
+
+		result := sendFile(t, stream, &fileList[0], func(chunk *pb.Chunk) {
+			data, codec, err := chunker.Compress(chunker.CompressionGzip, chunk.Data)
+			if err != nil || codec != chunker.CompressionGzip {
+				t.Fatalf("Failed to compress chunk: %v", err)
+			}
+			chunk.Data, chunk.Compression = data, codec
+		})
+		if result == nil || !result.Success {
+			t.Fatalf("Expected compressed file to be stored with InlineMaxSize=%d, got %v", inlineMax, result)
+		}
+		stream.CloseSend()
+
+		needed, err := askFileNeeded(client, &fileList[0])
+		if err != nil {
+			t.Fatalf("Failed to ask for file: %v", err)
+		}
+		if needed {
+			t.Errorf("Compressed file wasn't recorded with InlineMaxSize=%d", inlineMax)
+		}
+	}
+}
+
+func TestBackupSkipsUnchangedFiles(t *testing.T) {
+	root := t.TempDir()
+	for _, name := range []string{"kept.txt", "changed.txt"} {
+		if err := os.WriteFile(filepath.Join(root, name), []byte("version 1 of "+name), 0600); err != nil {
+			t.Fatalf("Failed to write %s: %v", name, err)
+		}
+	}
+	backupStream, client := startTestBackupStream(t, &config.Config{})
+	backupTree(t, client, root)
+
+	// Only the modification time identifies a new version
+	changed := filepath.Join(root, "changed.txt")
+	if err := os.WriteFile(changed, []byte("version 2"), 0600); err != nil {
+		t.Fatalf("Failed to rewrite file: %v", err)
+	}
+	later := time.Now().Add(time.Hour)
+	if err := os.Chtimes(changed, later, later); err != nil {
+		t.Fatalf("Failed to change mtime: %v", err)
+	}
+
+	fileList, results := backupTree(t, client, root)
+	if len(results) != 1 || results[changed] == nil {
+		t.Fatalf("Expected only the changed file to be requested, got %v", results)
+	}
+	if !results[changed].Success {
+		t.Fatalf("Writer failed to store changed file: %s", results[changed].Message)
+	}
+	var got bytes.Buffer
+	if err := backupStream.writer.ReadFile(changed, fileList[0].Host, &got); err != nil {
+		t.Fatalf("Failed to read back changed file: %v", err)
+	}
+	if got.String() != "version 2" {
+		t.Errorf("Latest stored version is %q", got.String())
+	}
+}
+
+func TestFileBatchNeeded(t *testing.T) {
+	client := startTestServer(t, &config.Config{})
+	modTime := time.Now().Truncate(time.Second)
+	var batch []*files.FileInfo
+	for i := range 7 {
+		batch = append(batch, &files.FileInfo{Host: "host1", Path: fmt.Sprintf("/data/file%d", i), ModTime: modTime})
+	}
+	stream, err := client.ProcessBackupStream(context.Background())
+	if err != nil {
+		t.Fatalf("Failed to open stream: %v", err)
+	}
+	// Back up files 1, 4 and 5 first, as directories so there is no data to send
+	for _, i := range []int{1, 4, 5} {
+		backedUp := *batch[i]
+		backedUp.Mode = fs.ModeDir | 0700
+		if result := sendFile(t, stream, &backedUp, nil); result == nil || !result.Success {
+			t.Fatalf("Failed to back up %s: %v", batch[i].Path, result)
+		}
+	}
+
+	// Batches of 3, 3 and 1
+	var needed []bool
+	for start := 0; start < len(batch); start += 3 {
+		var infos []*pb.FileInfo
+		for _, fileInfo := range batch[start:min(start+3, len(batch))] {
+			attributes, err := files.Encode(fileInfo)
+			if err != nil {
+				t.Fatalf("Failed to encode: %v", err)
+			}
+			infos = append(infos, &pb.FileInfo{FileId: fileInfo.Path, Attributes: attributes})
+		}
+		err := stream.Send(&pb.FileRequest{StreamId: 1, RequestType: &pb.FileRequest_Batch{Batch: &pb.FileBatch{Files: infos}}})
+		if err != nil {
+			t.Fatalf("Failed to send batch: %v", err)
+		}
+		resp, err := stream.Recv()
+		if err != nil {
+			t.Fatalf("Failed to receive answer: %v", err)
+		}
+		answers := resp.GetNeededBatch().GetFiles()
+		if len(answers) != len(infos) {
+			t.Fatalf("Got %d answers for a batch of %d", len(answers), len(infos))
+		}
+		for i, answer := range answers {
+			if answer.FileId != infos[i].FileId {
+				t.Errorf("Answer %d is for %s, expected %s", i, answer.FileId, infos[i].FileId)
+			}
+			needed = append(needed, answer.Needed)
+		}
+	}
+	stream.CloseSend()
+
+	want := []bool{true, false, true, true, false, false, true}
+	if fmt.Sprint(needed) != fmt.Sprint(want) {
+		t.Errorf("Needed = %v, expected %v", needed, want)
+	}
+}
+
+func TestFileBatchRecordsDirectories(t *testing.T) {
+	backupStream, client := startTestBackupStream(t, &config.Config{})
+	modTime := time.Now().Truncate(time.Second)
+	batch := []*files.FileInfo{
+		{Host: "host1", Path: "/data", Mode: fs.ModeDir | 0755, ModTime: modTime},
+		{Host: "host1", Path: "/data/file", Mode: 0644, ModTime: modTime},
+		{Host: "host1", Path: "/data/link", Mode: fs.ModeSymlink | 0777, SymlinkTarget: "file", ModTime: modTime},
+	}
+	var infos []*pb.FileInfo
+	for _, fileInfo := range batch {
+		attributes, err := files.Encode(fileInfo)
+		if err != nil {
+			t.Fatalf("Failed to encode: %v", err)
+		}
+		infos = append(infos, &pb.FileInfo{FileId: fileInfo.Path, Attributes: attributes})
+	}
+	stream, err := client.ProcessBackupStream(context.Background())
+	if err != nil {
+		t.Fatalf("Failed to open stream: %v", err)
+	}
+	err = stream.Send(&pb.FileRequest{StreamId: 1, RequestType: &pb.FileRequest_Batch{Batch: &pb.FileBatch{Files: infos}}})
+	if err != nil {
+		t.Fatalf("Failed to send batch: %v", err)
+	}
+	resp, err := stream.Recv()
+	if err != nil {
+		t.Fatalf("Failed to receive answer: %v", err)
+	}
+	stream.CloseSend()
+
+	var needed []bool
+	for _, answer := range resp.GetNeededBatch().GetFiles() {
+		needed = append(needed, answer.Needed)
+	}
+	if want := []bool{false, true, false}; fmt.Sprint(needed) != fmt.Sprint(want) {
+		t.Errorf("Needed = %v, expected %v", needed, want)
+	}
+	// Recorded straight from the batch, without waiting for a FileEnd
+	for _, path := range []string{"/data", "/data/link"} {
+		stored, err := backupStream.writer.GetFile(path, "host1")
+		if err != nil || stored == nil {
+			t.Fatalf("%s wasn't recorded: %v", path, err)
+		}
+	}
+	if stored, _ := backupStream.writer.GetFile("/data/link", "host1"); stored.FileInfo.SymlinkTarget != "file" {
+		t.Errorf("Symlink target = %q, expected %q", stored.FileInfo.SymlinkTarget, "file")
+	}
+}
+
+func TestBackupUpdatesChangedMetadata(t *testing.T) {
+	root := t.TempDir()
+	path := filepath.Join(root, "file.txt")
+	if err := os.WriteFile(path, []byte("content"), 0644); err != nil {
+		t.Fatalf("Failed to write file: %v", err)
+	}
+	backupStream, client := startTestBackupStream(t, &config.Config{})
+	backupTree(t, client, root)
+
+	// chmod bumps ctime without touching mtime
+	time.Sleep(10 * time.Millisecond)
+	if err := os.Chmod(path, 0600); err != nil {
+		t.Fatalf("Failed to chmod: %v", err)
+	}
+
+	fileList, results := backupTree(t, client, root)
+	if len(results) != 0 {
+		t.Errorf("Writer asked again for %d files whose content didn't change", len(results))
+	}
+	for i := range fileList {
+		status, err := backupStream.writer.FileStatus(&fileList[i])
+		if err != nil {
+			t.Fatalf("Failed to check file status: %v", err)
+		}
+		if status != wfs.FileUnchanged {
+			t.Errorf("%s still has outdated metadata stored, status %v", fileList[i].Path, status)
+		}
+	}
+}
+
+func TestBackupFileResizedAfterScan(t *testing.T) {
+	for _, tc := range []struct {
+		name      string
+		inlineMax int
+		resize    func(path string) error
+	}{
+		{"grown inline", 1024, func(path string) error { return appendFile(path, bytes.Repeat([]byte("more"), 10)) }},
+		{"grown chunked", 0, func(path string) error { return appendFile(path, bytes.Repeat([]byte("more"), 10)) }},
+		{"shrunk", 0, func(path string) error { return os.Truncate(path, 7) }},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "log.txt")
+			if err := os.WriteFile(path, bytes.Repeat([]byte("data"), 25), 0600); err != nil {
+				t.Fatalf("Failed to write file: %v", err)
+			}
+			fileList, _, err := files.Scan(path, files.ScanOptions{})
+			if err != nil || len(fileList) != 1 {
+				t.Fatalf("Scan failed: %v", err)
+			}
+			if err := tc.resize(path); err != nil {
+				t.Fatalf("Failed to resize file: %v", err)
+			}
+
+			backupStream, client := startTestBackupStream(t, &config.Config{InlineMaxSize: tc.inlineMax})
+			stream, err := client.ProcessBackupStream(context.Background())
+			if err != nil {
+				t.Fatalf("Failed to open stream: %v", err)
+			}
+			result := sendFile(t, stream, &fileList[0], nil)
+			stream.CloseSend()
+			if result == nil || !result.Success {
+				t.Fatalf("Resized file not stored: %v", result)
+			}
+
+			var content bytes.Buffer
+			if err := backupStream.writer.ReadFile(path, fileList[0].Host, &content); err != nil {
+				t.Fatalf("Failed to read back file: %v", err)
+			}
+			stored, err := backupStream.writer.GetFile(path, fileList[0].Host)
+			if err != nil || stored == nil {
+				t.Fatalf("Failed to get stored metadata: %v", err)
+			}
+			if stored.FileInfo.Size != int64(content.Len()) {
+				t.Errorf("Stored size %d, transferred %d bytes", stored.FileInfo.Size, content.Len())
+			}
+		})
+	}
+}
+
+// appendFile adds data at the end of an existing file
+func appendFile(path string, data []byte) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = f.Write(data)
+	return err
+}
+
+func TestBackupLinkedFile(t *testing.T) {
+	root := t.TempDir()
+	large := bytes.Repeat([]byte("large content "), chunker.DefaultChunkSize/8)
+	backupStream, client := startTestBackupStream(t, &config.Config{InlineMaxSize: 16})
+
+	for name, content := range map[string][]byte{"inline": []byte("hello"), "chunked": large} {
+		t.Run(name, func(t *testing.T) {
+			original := filepath.Join(root, name+"-original")
+			copyPath := filepath.Join(root, name+"-copy")
+			for _, path := range []string{original, copyPath} {
+				if err := os.WriteFile(path, content, 0600); err != nil {
+					t.Fatalf("Failed to write %s: %v", path, err)
+				}
+			}
+			fileList, _, err := files.Scan(original, files.ScanOptions{})
+			if err != nil || len(fileList) != 1 {
+				t.Fatalf("Scan failed: %v", err)
+			}
+			copyList, _, err := files.Scan(copyPath, files.ScanOptions{})
+			if err != nil || len(copyList) != 1 {
+				t.Fatalf("Scan failed: %v", err)
+			}
+
+			stream, err := client.ProcessBackupStream(context.Background())
+			if err != nil {
+				t.Fatalf("Failed to open stream: %v", err)
+			}
+			defer stream.CloseSend()
+			if result := sendFile(t, stream, &fileList[0], nil); result == nil || !result.Success {
+				t.Fatalf("Original not stored: %v", result)
+			}
+
+			// The copy only gets a FileEnd pointing at the original
+			result := sendLinkedFile(t, stream, &copyList[0], original, chunker.Checksum(content))
+			if !result.Success {
+				t.Fatalf("Linked file not stored: %s", result.Message)
+			}
+			var got bytes.Buffer
+			if err := backupStream.writer.ReadFile(copyPath, copyList[0].Host, &got); err != nil {
+				t.Fatalf("Failed to read back linked file: %v", err)
+			}
+			if !bytes.Equal(got.Bytes(), content) {
+				t.Error("Linked file content doesn't match the original")
+			}
+
+			// Links to files that weren't stored fail
+			missing := copyList[0]
+			missing.Path = filepath.Join(root, name+"-other-copy")
+			if result := sendLinkedFile(t, stream, &missing, filepath.Join(root, "not-stored"), chunker.Checksum(content)); result.Success {
+				t.Error("Link to a file that wasn't stored succeeded")
+			}
+		})
+	}
+}
+
+// sendLinkedFile sends the metadata of a file and, if the writer needs it, a FileEnd linking it to sameAs
+func sendLinkedFile(t *testing.T, stream pb.BackupService_ProcessBackupStreamClient, file *files.FileInfo, sameAs, checksum string) *pb.ProcessingResult {
+	t.Helper()
+	attributes, err := files.Encode(file)
+	if err != nil {
+		t.Fatalf("Failed to encode %s: %v", file.Path, err)
+	}
+	fileID := file.GetId()
+	requests := []*pb.FileRequest{
+		{StreamId: 1, RequestType: &pb.FileRequest_FileInfo{FileInfo: &pb.FileInfo{FileId: fileID, Attributes: attributes}}},
+		{StreamId: 1, RequestType: &pb.FileRequest_FileEnd{FileEnd: &pb.FileEnd{FileId: fileID, Size: file.Size, Checksum: checksum, SameAs: sameAs}}},
+	}
+	if err := stream.Send(requests[0]); err != nil {
+		t.Fatalf("Failed to send metadata: %v", err)
+	}
+	if resp, err := stream.Recv(); err != nil || !resp.GetFileNeeded().GetNeeded() {
+		t.Fatalf("Writer didn't ask for %s: %v", file.Path, err)
+	}
+	if err := stream.Send(requests[1]); err != nil {
+		t.Fatalf("Failed to send end: %v", err)
+	}
+	resp, err := stream.Recv()
+	if err != nil {
+		t.Fatalf("Failed to receive result: %v", err)
+	}
+	return resp.GetResult()
+}
+
+// countChunkFiles returns the number of chunk files in a storage
+func countChunkFiles(t *testing.T, storagePath string) int {
+	t.Helper()
+	count := 0
+	err := filepath.WalkDir(filepath.Join(storagePath, "chunks"), func(path string, d fs.DirEntry, err error) error {
+		if err == nil && d.Type().IsRegular() {
+			count++
+		}
+		return err
+	})
+	if err != nil {
+		t.Fatalf("Failed to walk chunks: %v", err)
+	}
+	return count
+}
+
+func TestDedupAcrossHosts(t *testing.T) {
+	root := t.TempDir()
+	path := filepath.Join(root, "shared.bin")
+	content := bytes.Repeat([]byte("shared between hosts "), chunker.DefaultChunkSize/10)
+	if err := os.WriteFile(path, content, 0600); err != nil {
+		t.Fatalf("Failed to write file: %v", err)
+	}
+	fileList, _, err := files.Scan(root, files.ScanOptions{})
+	if err != nil {
+		t.Fatalf("Scan failed: %v", err)
+	}
+	var scanned *files.FileInfo
+	for i := range fileList {
+		if fileList[i].Path == path {
+			scanned = &fileList[i]
+		}
+	}
+	backupStream, client := startTestBackupStream(t, &config.Config{})
+	stream, err := client.ProcessBackupStream(context.Background())
+	if err != nil {
+		t.Fatalf("Failed to open stream: %v", err)
+	}
+
+	alpha := *scanned
+	alpha.Host = "alpha"
+	if result := sendFile(t, stream, &alpha, nil); result == nil || !result.Success {
+		t.Fatalf("File from alpha not stored: %v", result)
+	}
+	chunkFiles := countChunkFiles(t, backupStream.storagePath)
+
+	// The same content from another host is recorded without sending it
+	checksum := chunker.Checksum(content)
+	known, err := client.HasContent(context.Background(), &pb.ContentQuery{Checksum: checksum, Size: int64(len(content))})
+	if err != nil || !known.Known {
+		t.Fatalf("HasContent = %v, %v, expected the content from alpha", known, err)
+	}
+	beta := *scanned
+	beta.Host = "beta"
+	attributes, err := files.Encode(&beta)
+	if err != nil {
+		t.Fatalf("Failed to encode file: %v", err)
+	}
+	err = stream.Send(&pb.FileRequest{StreamId: 1, RequestType: &pb.FileRequest_FileInfo{FileInfo: &pb.FileInfo{FileId: beta.GetId(), Attributes: attributes}}})
+	if err != nil {
+		t.Fatalf("Failed to send metadata: %v", err)
+	}
+	if resp, err := stream.Recv(); err != nil || !resp.GetFileNeeded().GetNeeded() {
+		t.Fatalf("Expected the file from beta to be needed, got %v %v", resp, err)
+	}
+	end := &pb.FileEnd{FileId: beta.GetId(), Size: int64(len(content)), Checksum: checksum, StoredContent: true}
+	if err := stream.Send(&pb.FileRequest{StreamId: 1, RequestType: &pb.FileRequest_FileEnd{FileEnd: end}}); err != nil {
+		t.Fatalf("Failed to send end: %v", err)
+	}
+	if resp, err := stream.Recv(); err != nil || !resp.GetResult().GetSuccess() {
+		t.Fatalf("File from beta not recorded: %v %v", resp, err)
+	}
+	stream.CloseSend()
+
+	if count := countChunkFiles(t, backupStream.storagePath); count != chunkFiles {
+		t.Errorf("Storage has %d chunk files after the second host, expected %d", count, chunkFiles)
+	}
+	var restored bytes.Buffer
+	if err := backupStream.writer.ReadFile(path, "beta", &restored); err != nil {
+		t.Fatalf("Failed to read file from beta: %v", err)
+	}
+	if !bytes.Equal(restored.Bytes(), content) {
+		t.Error("Content recorded for beta doesn't match")
+	}
+	if known, err := client.HasContent(context.Background(), &pb.ContentQuery{Checksum: checksum, Size: 1}); err != nil || known.Known {
+		t.Errorf("HasContent with another size = %v, %v, expected unknown", known, err)
+	}
+}
@@ -0,0 +1,149 @@
+package chunker
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/alex-sviridov/miniprotector/common/files"
+)
+
+// openFile opens files for hashing, tests replace it to count the files read
+var openFile = os.Open
+
+// cacheEntry is the checksum of a file as it was when hashed
+type cacheEntry struct {
+	Size       int64  `json:"size"`
+	ModTime    int64  `json:"mtime_ns"`
+	ChangeTime int64  `json:"ctime_ns"`
+	Checksum   string `json:"checksum"` // See FormatChecksum, it names the algorithm
+}
+
+// ChecksumCache holds the checksums of files by path, each valid while the file keeps the size,
+// mtime and ctime it had when hashed. It is safe for concurrent use, and a nil *ChecksumCache
+// holds nothing.
+type ChecksumCache struct {
+	mu      sync.Mutex
+	entries map[string]cacheEntry
+}
+
+// NewChecksumCache returns an empty cache
+func NewChecksumCache() *ChecksumCache {
+	return &ChecksumCache{entries: make(map[string]cacheEntry)}
+}
+
+// LoadChecksumCache reads a cache saved at path, an empty one when there is no such file
+func LoadChecksumCache(path string) (*ChecksumCache, error) {
+	cache := NewChecksumCache()
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return cache, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &cache.entries); err != nil {
+		return nil, fmt.Errorf("invalid checksum cache %s: %w", path, err)
+	}
+	if cache.entries == nil {
+		cache.entries = make(map[string]cacheEntry)
+	}
+	return cache, nil
+}
+
+// Save writes the cache to path, replacing it at once so a crash leaves the previous one intact
+func (c *ChecksumCache) Save(path string) error {
+	if c == nil {
+		return nil
+	}
+	c.mu.Lock()
+	data, err := json.Marshal(c.entries)
+	c.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// Lookup returns the checksum made by algo of a file whose size, mtime and ctime haven't changed since it was hashed
+func (c *ChecksumCache) Lookup(fileInfo *files.FileInfo, algo string) (string, bool) {
+	if c == nil {
+		return "", false
+	}
+	if algo == "" {
+		algo = HashBLAKE3
+	}
+	c.mu.Lock()
+	entry, ok := c.entries[fileInfo.Path]
+	c.mu.Unlock()
+	if !ok || entry.Size != fileInfo.Size ||
+		entry.ModTime != fileInfo.ModTime.UnixNano() ||
+		entry.ChangeTime != fileInfo.ChangeTime.UnixNano() ||
+		ChecksumAlgo(entry.Checksum) != algo {
+		return "", false
+	}
+	return entry.Checksum, true
+}
+
+// Store records the checksum of a file with the metadata it was hashed with, replacing any earlier one
+func (c *ChecksumCache) Store(fileInfo *files.FileInfo, checksum string) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries[fileInfo.Path] = cacheEntry{
+		Size:       fileInfo.Size,
+		ModTime:    fileInfo.ModTime.UnixNano(),
+		ChangeTime: fileInfo.ChangeTime.UnixNano(),
+		Checksum:   checksum,
+	}
+}
+
+// Retain drops the entries of files other than items, those deleted or left out of the run
+func (c *ChecksumCache) Retain(items []files.FileInfo) {
+	if c == nil {
+		return
+	}
+	keep := make(map[string]bool, len(items))
+	for i := range items {
+		keep[items[i].Path] = true
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for path := range c.entries {
+		if !keep[path] {
+			delete(c.entries, path)
+		}
+	}
+}
+
+// CachedChecksum returns the checksum made by algo of a scanned file, taken from cache while the file
+// has the size, mtime and ctime of fileInfo; otherwise the file is read and its checksum cached.
+func CachedChecksum(cache *ChecksumCache, fileInfo *files.FileInfo, algo string) (string, error) {
+	if checksum, ok := cache.Lookup(fileInfo, algo); ok {
+		return checksum, nil
+	}
+	checksum, err := CalculateFileChecksum(fileInfo.Path, algo)
+	if err != nil {
+		return "", err
+	}
+	cache.Store(fileInfo, checksum)
+	return checksum, nil
+}
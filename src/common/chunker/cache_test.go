@@ -0,0 +1,99 @@
+package chunker
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/alex-sviridov/miniprotector/common/files"
+)
+
+func TestCachedChecksum(t *testing.T) {
+	path, data := writeFile(t, 2*DefaultChunkSize+5)
+	opened := 0
+	openFile = func(name string) (*os.File, error) {
+		opened++
+		return os.Open(name)
+	}
+	t.Cleanup(func() { openFile = os.Open })
+
+	now := time.Now()
+	fileInfo := &files.FileInfo{Path: path, Size: int64(len(data)), ModTime: now, ChangeTime: now}
+	cache := NewChecksumCache()
+
+	checksum, err := CachedChecksum(cache, fileInfo, HashBLAKE3)
+	if err != nil {
+		t.Fatalf("CachedChecksum failed: %v", err)
+	}
+	if checksum != Checksum(data) || opened != 1 {
+		t.Fatalf("First run: checksum %s after %d opens, expected %s after one", checksum, opened, Checksum(data))
+	}
+
+	// Same metadata, the file isn't opened again
+	if again, err := CachedChecksum(cache, fileInfo, HashBLAKE3); err != nil || again != checksum || opened != 1 {
+		t.Errorf("Second run: checksum %s (%v) after %d opens, expected the cached one without opening", again, err, opened)
+	}
+
+	// A saved cache serves the next run
+	cachePath := filepath.Join(t.TempDir(), "checksums.json")
+	if err := cache.Save(cachePath); err != nil {
+		t.Fatalf("Save failed: %v", err)
+	}
+	loaded, err := LoadChecksumCache(cachePath)
+	if err != nil {
+		t.Fatalf("LoadChecksumCache failed: %v", err)
+	}
+	if again, err := CachedChecksum(loaded, fileInfo, HashBLAKE3); err != nil || again != checksum || opened != 1 {
+		t.Errorf("Run with the loaded cache: checksum %s (%v) after %d opens, expected the cached one without opening", again, err, opened)
+	}
+
+	// Any change of metadata or algorithm reads the file again
+	changes := map[string]func(fi *files.FileInfo){
+		"size":  func(fi *files.FileInfo) { fi.Size++ },
+		"mtime": func(fi *files.FileInfo) { fi.ModTime = fi.ModTime.Add(time.Second) },
+		"ctime": func(fi *files.FileInfo) { fi.ChangeTime = fi.ChangeTime.Add(time.Nanosecond) },
+	}
+	for name, change := range changes {
+		changed := *fileInfo
+		change(&changed)
+		before := opened
+		if _, err := CachedChecksum(loaded, &changed, HashBLAKE3); err != nil || opened != before+1 {
+			t.Errorf("Changed %s: %d opens (%v), expected the file to be read again", name, opened-before, err)
+		}
+	}
+	before := opened
+	if sum, err := CachedChecksum(loaded, fileInfo, HashSHA256); err != nil || opened != before+1 || ChecksumAlgo(sum) != HashSHA256 {
+		t.Errorf("Other algorithm: checksum %s (%v) after %d opens, expected a sha256 one read from the file", sum, err, opened-before)
+	}
+
+	// Nothing is cached without a cache
+	before = opened
+	for range 2 {
+		if _, err := CachedChecksum(nil, fileInfo, HashBLAKE3); err != nil {
+			t.Fatalf("CachedChecksum without a cache failed: %v", err)
+		}
+	}
+	if opened != before+2 {
+		t.Errorf("Without a cache the file was opened %d times, expected 2", opened-before)
+	}
+}
+
+func TestChecksumCacheRetain(t *testing.T) {
+	cache := NewChecksumCache()
+	kept := files.FileInfo{Path: "/data/kept", Size: 1}
+	cache.Store(&kept, "k")
+	cache.Store(&files.FileInfo{Path: "/data/deleted", Size: 1}, "d")
+	cache.Retain([]files.FileInfo{kept})
+
+	if _, ok := cache.Lookup(&kept, HashBLAKE3); !ok {
+		t.Error("Expected the retained entry to be kept")
+	}
+	if len(cache.entries) != 1 {
+		t.Errorf("Cache holds %d entries, expected 1", len(cache.entries))
+	}
+
+	if loaded, err := LoadChecksumCache(filepath.Join(t.TempDir(), "missing.json")); err != nil || len(loaded.entries) != 0 {
+		t.Errorf("Loading a missing cache = %v (%v), expected an empty one", loaded, err)
+	}
+}
@@ -0,0 +1,254 @@
+package chunker
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+)
+
+// writeFile creates a file with size bytes of non-repeating content
+func writeFile(t testing.TB, size int) (string, []byte) {
+	t.Helper()
+	data := make([]byte, size)
+	for i := range data {
+		data[i] = byte(i*7 + i/251)
+	}
+	path := filepath.Join(t.TempDir(), "data")
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		t.Fatalf("Failed to write test file: %v", err)
+	}
+	return path, data
+}
+
+func TestChunkFileStream(t *testing.T) {
+	tests := []struct {
+		name      string
+		size      int
+		chunkSize int
+		chunks    int
+	}{
+		{"empty", 0, 4, 0},
+		{"smaller than chunk", 3, 4, 1},
+		{"exact multiple", 8, 4, 2},
+		{"partial last chunk", 10, 4, 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path, data := writeFile(t, tt.size)
+
+			var got []byte
+			var count int
+			checksum, size, err := ChunkFileStream(path, tt.chunkSize, HashBLAKE3, func(c Chunk) error {
+				if c.Offset != int64(len(got)) {
+					t.Errorf("Chunk %d offset = %d, want %d", count, c.Offset, len(got))
+				}
+				if c.Checksum != Checksum(c.Data) {
+					t.Errorf("Chunk %d checksum doesn't match its data", count)
+				}
+				got = append(got, c.Data...)
+				count++
+				return nil
+			})
+			if err != nil {
+				t.Fatalf("ChunkFileStream failed: %v", err)
+			}
+			if count != tt.chunks {
+				t.Errorf("Got %d chunks, want %d", count, tt.chunks)
+			}
+			if size != int64(tt.size) {
+				t.Errorf("Size = %d, want %d", size, tt.size)
+			}
+			if !bytes.Equal(got, data) {
+				t.Error("Reassembled chunks don't match the file")
+			}
+			if checksum != Checksum(data) {
+				t.Error("Whole file checksum doesn't match the content")
+			}
+		})
+	}
+}
+
+func TestChunkFileStreamCallbackError(t *testing.T) {
+	path, _ := writeFile(t, 10)
+	stop := errors.New("stop")
+
+	calls := 0
+	_, _, err := ChunkFileStream(path, 4, HashBLAKE3, func(Chunk) error {
+		calls++
+		return stop
+	})
+	if !errors.Is(err, stop) {
+		t.Fatalf("Expected callback error, got %v", err)
+	}
+	if calls != 1 {
+		t.Errorf("Callback called %d times after failing, want 1", calls)
+	}
+}
+
+// collectChunks chunks the file at path with chunkFile, keeping a copy of every chunk
+func collectChunks(t *testing.T, path string, chunkFile func(*os.File, func(Chunk) error) (string, int64, error)) ([]Chunk, string, int64) {
+	t.Helper()
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatalf("Failed to open %s: %v", path, err)
+	}
+	defer f.Close()
+	var chunks []Chunk
+	checksum, size, err := chunkFile(f, func(c Chunk) error {
+		c.Data = bytes.Clone(c.Data)
+		chunks = append(chunks, c)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Chunking %s failed: %v", path, err)
+	}
+	return chunks, checksum, size
+}
+
+func TestChunkFileParallel(t *testing.T) {
+	for _, fileSize := range []int{0, 3, 4 * 1024, 10*1024 + 1, 37*1024 + 5} {
+		path, data := writeFile(t, fileSize)
+		for _, algo := range []string{HashBLAKE3, HashSHA256} {
+			serial, serialSum, serialSize := collectChunks(t, path, func(f *os.File, fn func(Chunk) error) (string, int64, error) {
+				return ChunkFile(f, 1024, algo, fn)
+			})
+			for _, workers := range []int{1, 2, 4, 7} {
+				// Repeated runs give the same chunks, in the same order, as ChunkFile
+				for run := 0; run < 3; run++ {
+					chunks, sum, size := collectChunks(t, path, func(f *os.File, fn func(Chunk) error) (string, int64, error) {
+						return ChunkFileParallel(f, 1024, algo, workers, fn)
+					})
+					if sum != serialSum || size != serialSize || size != int64(len(data)) {
+						t.Fatalf("%d bytes, %s, %d workers: checksum %s and size %d, expected %s and %d",
+							fileSize, algo, workers, sum, size, serialSum, serialSize)
+					}
+					if len(chunks) != len(serial) {
+						t.Fatalf("%d bytes, %s, %d workers: %d chunks, expected %d", fileSize, algo, workers, len(chunks), len(serial))
+					}
+					for i := range chunks {
+						if chunks[i].Offset != serial[i].Offset || chunks[i].Checksum != serial[i].Checksum || !bytes.Equal(chunks[i].Data, serial[i].Data) {
+							t.Fatalf("%d bytes, %s, %d workers: chunk %d differs from ChunkFile's", fileSize, algo, workers, i)
+						}
+					}
+				}
+			}
+		}
+	}
+
+	path, _ := writeFile(t, 10*1024)
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatalf("Failed to open %s: %v", path, err)
+	}
+	defer f.Close()
+	stop := errors.New("stop")
+	calls := 0
+	_, size, err := ChunkFileParallel(f, 1024, HashBLAKE3, 4, func(Chunk) error {
+		calls++
+		if calls == 2 {
+			return stop
+		}
+		return nil
+	})
+	if !errors.Is(err, stop) || calls != 2 || size != 1024 {
+		t.Errorf("Failing callback: error %v after %d calls at %d, expected the callback error after 2 at 1024", err, calls, size)
+	}
+}
+
+// benchmarkChunkFile chunks a 64 MiB file with the given number of hashing workers
+func benchmarkChunkFile(b *testing.B, workers int) {
+	path, data := writeFile(b, 64*1024*1024)
+	b.SetBytes(int64(len(data)))
+	b.ResetTimer()
+	for range b.N {
+		f, err := os.Open(path)
+		if err != nil {
+			b.Fatal(err)
+		}
+		if _, _, err := ChunkFileParallel(f, DefaultChunkSize, HashBLAKE3, workers, func(Chunk) error { return nil }); err != nil {
+			b.Fatal(err)
+		}
+		f.Close()
+	}
+}
+
+func BenchmarkChunkFileSerial(b *testing.B) {
+	benchmarkChunkFile(b, 1)
+}
+
+func BenchmarkChunkFileParallel(b *testing.B) {
+	benchmarkChunkFile(b, max(runtime.NumCPU(), 2))
+}
+
+func TestCalculateFileChecksum(t *testing.T) {
+	path, data := writeFile(t, 3*DefaultChunkSize+17)
+
+	checksum, err := CalculateFileChecksum(path, HashBLAKE3)
+	if err != nil {
+		t.Fatalf("CalculateFileChecksum failed: %v", err)
+	}
+	if checksum != Checksum(data) {
+		t.Error("Checksum doesn't match the content")
+	}
+
+	streamed, _, err := ChunkFileStream(path, DefaultChunkSize, HashBLAKE3, func(Chunk) error { return nil })
+	if err != nil {
+		t.Fatalf("ChunkFileStream failed: %v", err)
+	}
+	if streamed != checksum {
+		t.Error("ChunkFileStream and CalculateFileChecksum disagree")
+	}
+}
+
+func TestMissingFile(t *testing.T) {
+	if _, err := CalculateFileChecksum(filepath.Join(t.TempDir(), "missing"), HashBLAKE3); err == nil {
+		t.Error("Expected error for a missing file")
+	}
+	if _, _, err := ChunkFileStream(filepath.Join(t.TempDir(), "missing"), 4, HashBLAKE3, func(Chunk) error { return nil }); err == nil {
+		t.Error("Expected error for a missing file")
+	}
+}
+
+func TestChunkAndHash(t *testing.T) {
+	for _, size := range []int{0, 10, DefaultChunkSize, 2*DefaultChunkSize + 3} {
+		path, data := writeFile(t, size)
+		chunks, checksum, total, err := ChunkAndHash(path, HashBLAKE3)
+		if err != nil {
+			t.Fatalf("ChunkAndHash failed: %v", err)
+		}
+		if want, err := CalculateFileChecksum(path, HashBLAKE3); err != nil || checksum != want {
+			t.Errorf("Size %d: checksum %s, CalculateFileChecksum gives %s (%v)", size, checksum, want, err)
+		}
+		if total != int64(size) {
+			t.Errorf("Size %d: read %d bytes", size, total)
+		}
+
+		var streamed []Chunk
+		if _, _, err := ChunkFileStream(path, DefaultChunkSize, HashBLAKE3, func(c Chunk) error {
+			streamed = append(streamed, Chunk{Offset: c.Offset, Checksum: c.Checksum})
+			return nil
+		}); err != nil {
+			t.Fatalf("ChunkFileStream failed: %v", err)
+		}
+		if len(chunks) != len(streamed) {
+			t.Fatalf("Size %d: got %d chunks, ChunkFileStream gives %d", size, len(chunks), len(streamed))
+		}
+		var joined []byte
+		for i, c := range chunks {
+			if c.Offset != streamed[i].Offset || c.Checksum != streamed[i].Checksum {
+				t.Errorf("Size %d: chunk %d at %d with %s, expected %d with %s", size, i, c.Offset, c.Checksum, streamed[i].Offset, streamed[i].Checksum)
+			}
+			joined = append(joined, c.Data...)
+		}
+		if !bytes.Equal(joined, data) {
+			t.Errorf("Size %d: chunk data doesn't add up to the file", size)
+		}
+	}
+
+	if _, _, _, err := ChunkAndHash(filepath.Join(t.TempDir(), "missing"), HashBLAKE3); err == nil {
+		t.Error("Expected an error for a missing file")
+	}
+}
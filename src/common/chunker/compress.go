@@ -0,0 +1,78 @@
+package chunker
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+)
+
+// Compression codecs for chunk data
+const (
+	CompressionNone = "none"
+	CompressionGzip = "gzip"
+)
+
+// maxDecompressedSize bounds decompressed chunks, no chunk sent uncompressed could be larger
+// than gRPC's default message limit
+const maxDecompressedSize = 4 << 20
+
+// ValidCompression reports whether codec is supported, empty meaning none
+func ValidCompression(codec string) bool {
+	switch codec {
+	case "", CompressionNone, CompressionGzip:
+		return true
+	}
+	return false
+}
+
+// Compress compresses data with codec and returns the result with the codec actually used.
+// Data is returned as is, with CompressionNone, when compression doesn't make it smaller.
+func Compress(codec string, data []byte) ([]byte, string, error) {
+	switch codec {
+	case "", CompressionNone:
+		return data, CompressionNone, nil
+	case CompressionGzip:
+		var buf bytes.Buffer
+		zw, err := gzip.NewWriterLevel(&buf, gzip.BestSpeed)
+		if err != nil {
+			return nil, "", err
+		}
+		if _, err := zw.Write(data); err != nil {
+			return nil, "", fmt.Errorf("failed to compress chunk: %w", err)
+		}
+		if err := zw.Close(); err != nil {
+			return nil, "", fmt.Errorf("failed to compress chunk: %w", err)
+		}
+		if buf.Len() >= len(data) {
+			return data, CompressionNone, nil
+		}
+		return buf.Bytes(), CompressionGzip, nil
+	default:
+		return nil, "", fmt.Errorf("unsupported compression %q", codec)
+	}
+}
+
+// Decompress reverses Compress for data compressed with codec
+func Decompress(codec string, data []byte) ([]byte, error) {
+	switch codec {
+	case "", CompressionNone:
+		return data, nil
+	case CompressionGzip:
+		zr, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, fmt.Errorf("failed to decompress chunk: %w", err)
+		}
+		defer zr.Close()
+		out, err := io.ReadAll(io.LimitReader(zr, maxDecompressedSize+1))
+		if err != nil {
+			return nil, fmt.Errorf("failed to decompress chunk: %w", err)
+		}
+		if len(out) > maxDecompressedSize {
+			return nil, fmt.Errorf("decompressed chunk exceeds %d bytes", maxDecompressedSize)
+		}
+		return out, nil
+	default:
+		return nil, fmt.Errorf("unsupported compression %q", codec)
+	}
+}
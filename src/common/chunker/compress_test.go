@@ -0,0 +1,49 @@
+package chunker
+
+import (
+	"bytes"
+	"crypto/rand"
+	"testing"
+)
+
+func TestCompressRoundTrip(t *testing.T) {
+	random := make([]byte, DefaultChunkSize)
+	if _, err := rand.Read(random); err != nil {
+		t.Fatalf("Failed to generate random data: %v", err)
+	}
+	tests := []struct {
+		name      string
+		data      []byte
+		wantCodec string
+	}{
+		{"compressible", bytes.Repeat([]byte("log line with repeated text\n"), 10000), CompressionGzip},
+		{"random", random, CompressionNone},
+		{"empty", []byte{}, CompressionNone},
+	}
+	for _, tt := range tests {
+		compressed, codec, err := Compress(CompressionGzip, tt.data)
+		if err != nil {
+			t.Fatalf("%s: compress failed: %v", tt.name, err)
+		}
+		if codec != tt.wantCodec {
+			t.Errorf("%s: codec %q, expected %q", tt.name, codec, tt.wantCodec)
+		}
+		if codec == CompressionGzip && len(compressed) >= len(tt.data) {
+			t.Errorf("%s: compressed %d bytes into %d", tt.name, len(tt.data), len(compressed))
+		}
+		restored, err := Decompress(codec, compressed)
+		if err != nil {
+			t.Fatalf("%s: decompress failed: %v", tt.name, err)
+		}
+		if !bytes.Equal(restored, tt.data) {
+			t.Errorf("%s: round trip changed the data", tt.name)
+		}
+	}
+
+	if _, _, err := Compress("lz4", []byte("data")); err == nil {
+		t.Error("Expected an error for an unknown codec")
+	}
+	if _, err := Decompress(CompressionGzip, []byte("not gzip")); err == nil {
+		t.Error("Expected an error decompressing invalid data")
+	}
+}
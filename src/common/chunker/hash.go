@@ -0,0 +1,88 @@
+package chunker
+
+import (
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"strings"
+
+	"lukechampine.com/blake3"
+)
+
+// Hash algorithms for chunk and file checksums
+const (
+	HashBLAKE3 = "blake3"
+	HashSHA256 = "sha256"
+	HashSHA512 = "sha512"
+)
+
+// ValidHashAlgo reports whether algo is supported, empty meaning blake3
+func ValidHashAlgo(algo string) bool {
+	switch algo {
+	case "", HashBLAKE3, HashSHA256, HashSHA512:
+		return true
+	}
+	return false
+}
+
+// NewHasher returns a hash of algo, empty meaning blake3. Size is the digest length in bytes,
+// 0 for the default of the algorithm. Only blake3 has a variable length.
+func NewHasher(algo string, size int) (hash.Hash, error) {
+	switch algo {
+	case "", HashBLAKE3:
+		if size == 0 {
+			size = 32
+		}
+		if size < 0 || size > 64 {
+			return nil, fmt.Errorf("invalid %s digest size %d", HashBLAKE3, size)
+		}
+		return blake3.New(size, nil), nil
+	case HashSHA256:
+		if size != 0 && size != sha256.Size {
+			return nil, fmt.Errorf("invalid %s digest size %d", algo, size)
+		}
+		return sha256.New(), nil
+	case HashSHA512:
+		if size != 0 && size != sha512.Size {
+			return nil, fmt.Errorf("invalid %s digest size %d", algo, size)
+		}
+		return sha512.New(), nil
+	}
+	return nil, fmt.Errorf("unsupported hash algorithm %q", algo)
+}
+
+// FormatChecksum returns the checksum of a digest made by algo.
+// Blake3 checksums are plain hex, as they were before other algorithms existed, the others
+// are prefixed with the algorithm name and a dash so checksums of different algorithms never match.
+func FormatChecksum(algo string, sum []byte) string {
+	if algo == "" || algo == HashBLAKE3 {
+		return hex.EncodeToString(sum)
+	}
+	return algo + "-" + hex.EncodeToString(sum)
+}
+
+// SplitChecksum returns the algorithm that made a checksum and its hex encoded digest
+func SplitChecksum(checksum string) (algo, digest string) {
+	if algo, digest, ok := strings.Cut(checksum, "-"); ok {
+		return algo, digest
+	}
+	return HashBLAKE3, checksum
+}
+
+// ChecksumAlgo returns the algorithm that made a checksum
+func ChecksumAlgo(checksum string) string {
+	algo, _ := SplitChecksum(checksum)
+	return algo
+}
+
+// ChecksumWith returns the checksum of data made by algo
+func ChecksumWith(algo string, data []byte) (string, error) {
+	h, err := NewHasher(algo, 0)
+	if err != nil {
+		return "", err
+	}
+	h.Write(data)
+	return FormatChecksum(algo, h.Sum(nil)), nil
+}
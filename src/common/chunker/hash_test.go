@@ -0,0 +1,86 @@
+package chunker
+
+import (
+	"testing"
+)
+
+func TestChecksumWith(t *testing.T) {
+	tests := []struct {
+		algo string
+		want string
+	}{
+		{HashBLAKE3, "6437b3ac38465133ffb63b75273a8db548c558465d79db03fd359c6cd5bd9d85"},
+		{"", "6437b3ac38465133ffb63b75273a8db548c558465d79db03fd359c6cd5bd9d85"},
+		{HashSHA256, "sha256-ba7816bf8f01cfea414140de5dae2223b00361a396177a9cb410ff61f20015ad"},
+		{HashSHA512, "sha512-ddaf35a193617abacc417349ae20413112e6fa4e89a97ea20a9eeee64b55d39a2192992a274fc1a836ba3c23a3feebbd454d4423643ce80e2a9ac94fa54ca49f"},
+	}
+	for _, tt := range tests {
+		got, err := ChecksumWith(tt.algo, []byte("abc"))
+		if err != nil {
+			t.Fatalf("ChecksumWith(%q) failed: %v", tt.algo, err)
+		}
+		if got != tt.want {
+			t.Errorf("ChecksumWith(%q) = %s, expected %s", tt.algo, got, tt.want)
+		}
+		if algo := ChecksumAlgo(got); tt.algo != "" && algo != tt.algo {
+			t.Errorf("ChecksumAlgo(%s) = %s, expected %s", got, algo, tt.algo)
+		}
+	}
+	if Checksum([]byte("abc")) != tests[0].want {
+		t.Error("Checksum doesn't match the blake3 checksum")
+	}
+	if _, err := ChecksumWith("md5", []byte("abc")); err == nil {
+		t.Error("Expected an error for an unsupported algorithm")
+	}
+}
+
+func TestNewHasherSize(t *testing.T) {
+	h, err := NewHasher(HashBLAKE3, 64)
+	if err != nil {
+		t.Fatalf("NewHasher failed: %v", err)
+	}
+	if h.Size() != 64 {
+		t.Errorf("Digest size %d, expected 64", h.Size())
+	}
+	for _, tt := range []struct {
+		algo string
+		size int
+	}{{HashBLAKE3, 65}, {HashSHA256, 64}, {HashSHA512, 32}} {
+		if _, err := NewHasher(tt.algo, tt.size); err == nil {
+			t.Errorf("Expected an error for %s with %d bytes", tt.algo, tt.size)
+		}
+	}
+}
+
+func TestChunkFileHashAlgo(t *testing.T) {
+	path, data := writeFile(t, 10)
+	for _, algo := range []string{HashBLAKE3, HashSHA256, HashSHA512} {
+		var chunks []Chunk
+		checksum, _, err := ChunkFileStream(path, 4, algo, func(c Chunk) error {
+			chunks = append(chunks, Chunk{Offset: c.Offset, Checksum: c.Checksum})
+			want, _ := ChecksumWith(algo, c.Data)
+			if c.Checksum != want {
+				t.Errorf("%s chunk at %d has checksum %s, expected %s", algo, c.Offset, c.Checksum, want)
+			}
+			return nil
+		})
+		if err != nil {
+			t.Fatalf("ChunkFileStream failed: %v", err)
+		}
+		if want, _ := ChecksumWith(algo, data); checksum != want {
+			t.Errorf("%s file checksum %s, expected %s", algo, checksum, want)
+		}
+		if whole, err := CalculateFileChecksum(path, algo); err != nil || whole != checksum {
+			t.Errorf("CalculateFileChecksum = %s (%v), expected %s", whole, err, checksum)
+		}
+		if len(chunks) != 3 {
+			t.Errorf("%s: got %d chunks, expected 3", algo, len(chunks))
+		}
+	}
+	// The same content hashed with different algorithms never matches
+	blake, _ := ChecksumWith(HashBLAKE3, data)
+	sha, _ := ChecksumWith(HashSHA256, data)
+	if blake == sha || ChecksumAlgo(sha) == ChecksumAlgo(blake) {
+		t.Errorf("Checksums %s and %s of different algorithms look alike", blake, sha)
+	}
+}
@@ -0,0 +1,87 @@
+package chunker
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+// errHolesUnsupported is returned by nextData when the filesystem can't report holes
+var errHolesUnsupported = errors.New("filesystem doesn't report holes")
+
+// zeros is read by WriteZeros, never written
+var zeros = make([]byte, 64*1024)
+
+// WriteZeros writes n zero bytes to w, the content of a hole
+func WriteZeros(w io.Writer, n int64) error {
+	for n > 0 {
+		part := min(n, int64(len(zeros)))
+		if _, err := w.Write(zeros[:part]); err != nil {
+			return err
+		}
+		n -= part
+	}
+	return nil
+}
+
+// ChunkSparseFile is ChunkFile for a file with holes, read from its start: only the ranges holding
+// data are read and passed to fn, a hole is the gap between the end of a chunk and the offset of the next one,
+// or after the last chunk up to the returned size. The checksum covers the whole content, holes as zeros,
+// so it matches ChunkFile on the same file. Where holes can't be found the whole file is read like ChunkFile.
+func ChunkSparseFile(f *os.File, chunkSize int, algo string, fn func(Chunk) error) (checksum string, size int64, err error) {
+	if chunkSize <= 0 {
+		return "", 0, fmt.Errorf("invalid chunk size %d", chunkSize)
+	}
+	end, err := f.Seek(0, io.SeekEnd)
+	if err != nil {
+		return "", 0, fmt.Errorf("failed to read %s: %w", f.Name(), err)
+	}
+	whole, err := NewHasher(algo, 0)
+	if err != nil {
+		return "", 0, err
+	}
+	part, _ := NewHasher(algo, 0)
+	buf := make([]byte, chunkSize)
+	for size < end {
+		data, hole, err := nextData(f, size, end)
+		if errors.Is(err, errHolesUnsupported) && size == 0 {
+			if _, err := f.Seek(0, io.SeekStart); err != nil {
+				return "", 0, fmt.Errorf("failed to read %s: %w", f.Name(), err)
+			}
+			return ChunkFile(f, chunkSize, algo, fn)
+		}
+		if err != nil {
+			return "", size, fmt.Errorf("failed to read %s: %w", f.Name(), err)
+		}
+		WriteZeros(whole, data-size)
+		size = data
+		if _, err := f.Seek(data, io.SeekStart); err != nil {
+			return "", size, fmt.Errorf("failed to read %s: %w", f.Name(), err)
+		}
+		for size < hole {
+			readStart := time.Now()
+			n, err := io.ReadFull(f, buf[:min(int64(chunkSize), hole-size)])
+			if n > 0 {
+				data := buf[:n]
+				hashStart := time.Now()
+				whole.Write(data)
+				chunk := Chunk{Offset: size, Data: data, Checksum: chunkChecksum(part, algo, data), ReadTime: hashStart.Sub(readStart)}
+				chunk.HashTime = time.Since(hashStart)
+				if err := fn(chunk); err != nil {
+					return "", size, err
+				}
+				size += int64(n)
+			}
+			// The file was truncated while being read, it ends here
+			if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+				return FormatChecksum(algo, whole.Sum(nil)), size, nil
+			}
+			if err != nil {
+				return "", size, fmt.Errorf("failed to read %s: %w", f.Name(), err)
+			}
+		}
+	}
+	return FormatChecksum(algo, whole.Sum(nil)), size, nil
+}
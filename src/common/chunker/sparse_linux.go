@@ -0,0 +1,28 @@
+package chunker
+
+import (
+	"errors"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// nextData returns the range [data, hole) holding the first data of f at or after offset,
+// data is end when only a hole is left
+func nextData(f *os.File, offset, end int64) (data, hole int64, err error) {
+	data, err = f.Seek(offset, unix.SEEK_DATA)
+	if errors.Is(err, unix.ENXIO) {
+		return end, end, nil
+	}
+	if errors.Is(err, unix.EINVAL) {
+		return 0, 0, errHolesUnsupported
+	}
+	if err != nil {
+		return 0, 0, err
+	}
+	hole, err = f.Seek(data, unix.SEEK_HOLE)
+	if err != nil {
+		return 0, 0, err
+	}
+	return data, min(hole, end), nil
+}
@@ -0,0 +1,60 @@
+package chunker
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+func TestChunkSparseFile(t *testing.T) {
+	const size = 8 * 1024 * 1024
+	path := filepath.Join(t.TempDir(), "sparse")
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatalf("Failed to create test file: %v", err)
+	}
+	defer f.Close()
+	data := bytes.Repeat([]byte("x"), 100*1024)
+	if _, err := f.WriteAt(data, 2*1024*1024); err != nil {
+		t.Fatalf("Failed to write test file: %v", err)
+	}
+	if err := f.Truncate(size); err != nil {
+		t.Fatalf("Failed to truncate test file: %v", err)
+	}
+	var stat syscall.Stat_t
+	if err := syscall.Fstat(int(f.Fd()), &stat); err != nil || stat.Blocks*512 >= size {
+		t.Skip("The filesystem of the test directory doesn't support holes")
+	}
+
+	var sent int64
+	checksum, total, err := ChunkSparseFile(f, 64*1024, HashBLAKE3, func(c Chunk) error {
+		// Only the data is read, filesystems may allocate it in whole blocks around the write
+		if c.Offset+int64(len(c.Data)) <= 1024*1024 || c.Offset >= 4*1024*1024 {
+			t.Errorf("Chunk at %d read from a hole", c.Offset)
+		}
+		if c.Checksum != Checksum(c.Data) {
+			t.Errorf("Chunk at %d has checksum %s of other data", c.Offset, c.Checksum)
+		}
+		sent += int64(len(c.Data))
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("ChunkSparseFile failed: %v", err)
+	}
+	if total != size {
+		t.Errorf("Size = %d, expected %d", total, size)
+	}
+	if sent < int64(len(data)) || sent >= size/2 {
+		t.Errorf("Read %d bytes of data, expected about %d", sent, len(data))
+	}
+
+	// Holes are hashed as zeros, the checksum is the one of the whole content
+	if _, err := f.Seek(0, 0); err != nil {
+		t.Fatalf("Failed to rewind: %v", err)
+	}
+	if want, err := FileChecksum(f, HashBLAKE3); err != nil || checksum != want {
+		t.Errorf("Checksum = %s, expected %s of the whole content: %v", checksum, want, err)
+	}
+}
@@ -0,0 +1,10 @@
+//go:build !linux
+
+package chunker
+
+import "os"
+
+// nextData finds holes with SEEK_DATA and SEEK_HOLE, only used on Linux
+func nextData(f *os.File, offset, end int64) (data, hole int64, err error) {
+	return 0, 0, errHolesUnsupported
+}
@@ -3,8 +3,10 @@ package config
 import (
 	"bufio"
 	"context"
+	"errors"
 	"fmt"
 	"os"
+	"runtime"
 	"strconv"
 	"strings"
 )
@@ -14,11 +16,66 @@ type Config struct {
 	DefaultPort              int
 	DefaultStreams           int
 	LogFolder                string
+	LogMaxSizeMB             int    // Size a log file is rotated at, 0 = never rotated
+	LogLevel                 string // debug, info, warn or error, empty for info or debug with --debug
+	LogTarget                string // file to log into logfolder, syslog to log to the system log instead
 	ClientHashQueryBatchSize int
+	MaxInFlightBytes         int64 // File data a stream sends ahead of the writer's acknowledgements, 0 = unlimited
 	ConnectionTimeOutSec     int
+	ConnectAttempts          int
+	ConnectRetryDelayMs      int
+	StreamResumeAttempts     int
+	HeartbeatSec             int // Idle seconds before a connection is checked with a keepalive ping, 0 = never
 	StopStreamOnFileError    bool
+	RecordFileTimings        bool
+	DedupWithinRun           bool
+	DedupAcrossHosts         bool   // Ask the writer for the content of each file before sending it
+	ChecksumCacheFile        string // File keeping the checksums of files between runs, empty = disabled
+	SkipFSTypes              []string
+	NoBackupMarker           string
+	BackupIgnoreFile         string   // Name of the per-directory files of gitignore-style exclude rules, empty = disabled
+	FollowSymlinks           bool     // Back up symlinked directories as directories, each walked once
+	MaxScanDepth             int      // Levels below the source folder the scan goes down to, 0 = unlimited
+	IncrementalFields        []string // Fields an incremental run compares with the writer's version: size, mtime, ctime
+	ProgressOutput           string
+	ManifestFile             string
+	ManifestFsync            string // When manifest entries are synced to disk: entry, batch or none
+	IOPriorityClass          string
+	NiceLevel                int
+	SplitStrategy            string
+	ExtensionCategories      map[string]string // Lowercase extension without the dot to category
+	MaxConcurrentFsync       int
+	MaxStreamDurationSec     int
+	StreamIdleTimeoutSec     int // bwfs closes a stream without a message for this long, 0 = never
+	InlineMaxSize            int
+	Compression              string // Chunk codec over the wire and in the chunk store: none or gzip
+	HashAlgo                 string // Algorithm of chunk and file checksums: blake3, sha256 or sha512
+	HashWorkers              int    // Goroutines hashing the chunks of a file brfs sends, 1 = serial
+	ChunkEncryptionKeyFile   string // Passphrase encrypting stored chunks, empty for plaintext chunks
+	RestoreConflictPolicy    string // What restoring does with existing files: fail, overwrite, skip or rename
+	RestoreHardLinks         bool   // Restore files backed up as hard links to the same data as hard links again
+	WriteBackupIndex         bool
+	SignedManifestKeyFile    string
+	SQLiteJournalMode        string
+	SQLiteSynchronous        string
+	SQLiteBusyTimeoutMs      int
+	ShutdownTimeoutSec       int
+	MaxUnknownMessages       int
+	TLSCertFile              string
+	TLSKeyFile               string
+	TLSCAFile                string
+	TLSClientCAFile          string
+	AllowedClientHosts       []string
+	StrictUnknownKeys        bool     // Fail on keys this version doesn't know instead of ignoring them
+	UnknownKeys              []string // Keys of the file this version doesn't know, ignored unless StrictUnknownKeys
 }
 
+// DefaultPortNumber is the writer port used when the config file doesn't set default_port
+const DefaultPortNumber = 15722
+
+// errUnknownKey is returned for settings this version doesn't know
+var errUnknownKey = errors.New("unknown configuration key")
+
 type contextKey string
 
 const ContextKey contextKey = "config"
@@ -31,17 +88,62 @@ func GetConfigFromContext(ctx context.Context) *Config {
 	return config
 }
 
-// ParseConfig reads configuration from the specified config file
-// Returns error if config file doesn't exist or required fields are missing
-func ParseConfig(configPath string) (*Config, error) {
+// Option adjusts how ParseConfig reads a config file
+type Option func(*parseOptions)
+
+type parseOptions struct {
+	required []string
+}
+
+// RequireFields makes ParseConfig fail when any of the given keys is missing from the file,
+// instead of using its default
+func RequireFields(keys ...string) Option {
+	return func(o *parseOptions) {
+		o.required = append(o.required, keys...)
+	}
+}
+
+// ParseConfig reads configuration from the specified config file.
+// Settings missing from the file get their defaults: default_port is DefaultPortNumber,
+// default_streams the number of CPUs, and an empty logfolder logs to stdout only.
+// Keys this version doesn't know are ignored and listed in UnknownKeys, so the caller can
+// warn about them, unless the file sets StrictUnknownKeys=true.
+// Returns error if the config file doesn't exist, a value is malformed, a key is unknown
+// with StrictUnknownKeys, or a field required with RequireFields is missing.
+func ParseConfig(configPath string, opts ...Option) (*Config, error) {
+	var options parseOptions
+	for _, opt := range opts {
+		opt(&options)
+	}
+
 	file, err := os.Open(configPath)
 	if err != nil {
 		return nil, fmt.Errorf("failed to open config file %s: %w", configPath, err)
 	}
 	defer file.Close()
 
-	config := &Config{}
+	// Defaults for settings that are optional in the file
+	config := &Config{
+		DefaultPort:           DefaultPortNumber,
+		DefaultStreams:        runtime.NumCPU(),
+		LogTarget:             "file",
+		IOPriorityClass:       "idle",
+		SplitStrategy:         "size",
+		ConnectAttempts:       3,
+		ConnectRetryDelayMs:   500,
+		StreamResumeAttempts:  3,
+		HeartbeatSec:          30,
+		IncrementalFields:     []string{"size", "mtime", "ctime"},
+		NoBackupMarker:        ".nobackup",
+		BackupIgnoreFile:      ".backupignore",
+		ManifestFsync:         "batch",
+		Compression:           "none",
+		HashAlgo:              "blake3",
+		HashWorkers:           1,
+		RestoreConflictPolicy: "fail",
+	}
 	foundFields := make(map[string]bool)
+	var unknownErr error // First unknown key, an error with StrictUnknownKeys
 
 	scanner := bufio.NewScanner(file)
 	lineNum := 0
@@ -63,53 +165,29 @@ func ParseConfig(configPath string) (*Config, error) {
 		key := strings.TrimSpace(parts[0])
 		value := strings.TrimSpace(parts[1])
 
-		switch key {
-		case "default_port":
-			port, err := strconv.Atoi(value)
-			if err != nil {
-				return nil, fmt.Errorf("invalid default_port value at line %d: %s", lineNum, value)
-			}
-			config.DefaultPort = port
-			foundFields["default_port"] = true
-		case "default_streams":
-			streams, err := strconv.Atoi(value)
-			if err != nil {
-				return nil, fmt.Errorf("invalid default_streams value at line %d: %s", lineNum, value)
-			}
-			config.DefaultStreams = streams
-			foundFields["default_streams"] = true
-		case "logfolder":
-			config.LogFolder = value
-			foundFields["logfolder"] = true
-		case "ClientHashQueryBatchSize":
-			number, err := strconv.Atoi(value)
-			if err != nil {
-				return nil, fmt.Errorf("invalid ClientHashQueryBatchSize value at line %d: %s", lineNum, value)
+		err := setField(config, key, value)
+		if errors.Is(err, errUnknownKey) {
+			config.UnknownKeys = append(config.UnknownKeys, key)
+			if unknownErr == nil {
+				unknownErr = fmt.Errorf("line %d: %w", lineNum, err)
 			}
-			config.ClientHashQueryBatchSize = number
-			foundFields["ClientHashQueryBatchSize"] = true
-		case "ConnectionTimeOutSec":
-			number, err := strconv.Atoi(value)
-			if err != nil {
-				return nil, fmt.Errorf("invalid ConnectionTimeOutSec value at line %d: %s", lineNum, value)
-			}
-			config.ConnectionTimeOutSec = number
-			foundFields["ConnectionTimeOutSec"] = true
-		case "StopStreamOnFileError":
-			config.StopStreamOnFileError = value == "true"
-			foundFields["StopStreamOnFileError"] = true
-		default:
-			return nil, fmt.Errorf("unknown configuration key at line %d: %s", lineNum, key)
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", lineNum, err)
 		}
+		foundFields[key] = true
 	}
 
 	if err := scanner.Err(); err != nil {
 		return nil, fmt.Errorf("error reading config file: %w", err)
 	}
+	// Checked once the whole file is read, StrictUnknownKeys may come after an unknown key
+	if config.StrictUnknownKeys && unknownErr != nil {
+		return nil, unknownErr
+	}
 
-	// Validate required fields
-	requiredFields := []string{"default_port", "default_streams", "logfolder"}
-	for _, field := range requiredFields {
+	for _, field := range options.required {
 		if !foundFields[field] {
 			return nil, fmt.Errorf("missing required configuration field: %s", field)
 		}
@@ -117,3 +195,285 @@ func ParseConfig(configPath string) (*Config, error) {
 
 	return config, nil
 }
+
+// setField sets the setting named key from its text value, validated as in a config file
+func setField(config *Config, key, value string) error {
+	switch key {
+	case "default_port":
+		port, err := strconv.Atoi(value)
+		if err != nil {
+			return fmt.Errorf("invalid default_port value: %s", value)
+		}
+		config.DefaultPort = port
+	case "default_streams":
+		streams, err := strconv.Atoi(value)
+		if err != nil {
+			return fmt.Errorf("invalid default_streams value: %s", value)
+		}
+		config.DefaultStreams = streams
+	case "logfolder":
+		config.LogFolder = value
+	case "log_level":
+		level := strings.ToLower(value)
+		switch level {
+		case "", "debug", "info", "warn", "error":
+		default:
+			return fmt.Errorf("invalid log_level value: %s", value)
+		}
+		config.LogLevel = level
+	case "log_target":
+		if value != "file" && value != "syslog" {
+			return fmt.Errorf("invalid log_target value: %s", value)
+		}
+		config.LogTarget = value
+	case "LogMaxSizeMB":
+		number, err := strconv.Atoi(value)
+		if err != nil || number < 0 {
+			return fmt.Errorf("invalid LogMaxSizeMB value: %s", value)
+		}
+		config.LogMaxSizeMB = number
+	case "ClientHashQueryBatchSize":
+		number, err := strconv.Atoi(value)
+		if err != nil {
+			return fmt.Errorf("invalid ClientHashQueryBatchSize value: %s", value)
+		}
+		config.ClientHashQueryBatchSize = number
+	case "MaxInFlightBytes":
+		number, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || number < 0 {
+			return fmt.Errorf("invalid MaxInFlightBytes value: %s", value)
+		}
+		config.MaxInFlightBytes = number
+	case "ConnectionTimeOutSec":
+		number, err := strconv.Atoi(value)
+		if err != nil {
+			return fmt.Errorf("invalid ConnectionTimeOutSec value: %s", value)
+		}
+		config.ConnectionTimeOutSec = number
+	case "ConnectAttempts":
+		number, err := strconv.Atoi(value)
+		if err != nil || number < 1 {
+			return fmt.Errorf("invalid ConnectAttempts value: %s", value)
+		}
+		config.ConnectAttempts = number
+	case "ConnectRetryDelayMs":
+		number, err := strconv.Atoi(value)
+		if err != nil || number < 0 {
+			return fmt.Errorf("invalid ConnectRetryDelayMs value: %s", value)
+		}
+		config.ConnectRetryDelayMs = number
+	case "StreamResumeAttempts":
+		number, err := strconv.Atoi(value)
+		if err != nil || number < 0 {
+			return fmt.Errorf("invalid StreamResumeAttempts value: %s", value)
+		}
+		config.StreamResumeAttempts = number
+	case "HeartbeatSec":
+		number, err := strconv.Atoi(value)
+		if err != nil || number < 0 {
+			return fmt.Errorf("invalid HeartbeatSec value: %s", value)
+		}
+		config.HeartbeatSec = number
+	case "StopStreamOnFileError":
+		config.StopStreamOnFileError = value == "true"
+	case "RecordFileTimings":
+		config.RecordFileTimings = value == "true"
+	case "DedupWithinRun":
+		config.DedupWithinRun = value == "true"
+	case "DedupAcrossHosts":
+		config.DedupAcrossHosts = value == "true"
+	case "ChecksumCacheFile":
+		config.ChecksumCacheFile = value
+	case "SkipFSTypes":
+		config.SkipFSTypes = splitList(value)
+	case "NoBackupMarker":
+		config.NoBackupMarker = value
+	case "BackupIgnoreFile":
+		if strings.ContainsAny(value, `/\`) {
+			return fmt.Errorf("invalid BackupIgnoreFile value: %s", value)
+		}
+		config.BackupIgnoreFile = value
+	case "FollowSymlinks":
+		config.FollowSymlinks = value == "true"
+	case "MaxScanDepth":
+		number, err := strconv.Atoi(value)
+		if err != nil || number < 0 {
+			return fmt.Errorf("invalid MaxScanDepth value: %s", value)
+		}
+		config.MaxScanDepth = number
+	case "ProgressOutput":
+		config.ProgressOutput = value
+	case "ManifestFile":
+		config.ManifestFile = value
+	case "IncrementalFields":
+		fields := splitList(value)
+		if len(fields) == 0 {
+			return fmt.Errorf("invalid IncrementalFields value: %s", value)
+		}
+		for _, field := range fields {
+			if field != "size" && field != "mtime" && field != "ctime" {
+				return fmt.Errorf("invalid IncrementalFields value: %s", value)
+			}
+		}
+		config.IncrementalFields = fields
+	case "ManifestFsync":
+		if value != "entry" && value != "batch" && value != "none" {
+			return fmt.Errorf("invalid ManifestFsync value: %s", value)
+		}
+		config.ManifestFsync = value
+	case "IOPriorityClass":
+		if value != "idle" && value != "best-effort" && value != "none" {
+			return fmt.Errorf("invalid IOPriorityClass value: %s", value)
+		}
+		config.IOPriorityClass = value
+	case "NiceLevel":
+		number, err := strconv.Atoi(value)
+		if err != nil || number < 0 || number > 19 {
+			return fmt.Errorf("invalid NiceLevel value: %s", value)
+		}
+		config.NiceLevel = number
+	case "SplitStrategy":
+		if value != "size" && value != "count" && value != "category" && value != "stable" {
+			return fmt.Errorf("invalid SplitStrategy value: %s", value)
+		}
+		config.SplitStrategy = value
+	case "ExtensionCategories":
+		categories, err := parseCategories(value)
+		if err != nil {
+			return fmt.Errorf("invalid ExtensionCategories value: %w", err)
+		}
+		config.ExtensionCategories = categories
+	case "MaxConcurrentFsync":
+		number, err := strconv.Atoi(value)
+		if err != nil || number < 0 {
+			return fmt.Errorf("invalid MaxConcurrentFsync value: %s", value)
+		}
+		config.MaxConcurrentFsync = number
+	case "MaxStreamDurationSec":
+		number, err := strconv.Atoi(value)
+		if err != nil || number < 0 {
+			return fmt.Errorf("invalid MaxStreamDurationSec value: %s", value)
+		}
+		config.MaxStreamDurationSec = number
+	case "StreamIdleTimeoutSec":
+		number, err := strconv.Atoi(value)
+		if err != nil || number < 0 {
+			return fmt.Errorf("invalid StreamIdleTimeoutSec value: %s", value)
+		}
+		config.StreamIdleTimeoutSec = number
+	case "ShutdownTimeoutSec":
+		number, err := strconv.Atoi(value)
+		if err != nil || number < 0 {
+			return fmt.Errorf("invalid ShutdownTimeoutSec value: %s", value)
+		}
+		config.ShutdownTimeoutSec = number
+	case "MaxUnknownMessages":
+		number, err := strconv.Atoi(value)
+		if err != nil || number < 0 {
+			return fmt.Errorf("invalid MaxUnknownMessages value: %s", value)
+		}
+		config.MaxUnknownMessages = number
+	case "InlineMaxSize":
+		number, err := strconv.Atoi(value)
+		if err != nil || number < 0 {
+			return fmt.Errorf("invalid InlineMaxSize value: %s", value)
+		}
+		config.InlineMaxSize = number
+	case "Compression":
+		if value == "zstd" {
+			return errors.New("unsupported Compression value: zstd is not available in this build, use gzip")
+		}
+		if value != "none" && value != "gzip" {
+			return fmt.Errorf("invalid Compression value: %s", value)
+		}
+		config.Compression = value
+	case "HashAlgo":
+		if value != "blake3" && value != "sha256" && value != "sha512" {
+			return fmt.Errorf("invalid HashAlgo value: %s", value)
+		}
+		config.HashAlgo = value
+	case "HashWorkers":
+		number, err := strconv.Atoi(value)
+		if err != nil || number < 1 {
+			return fmt.Errorf("invalid HashWorkers value: %s", value)
+		}
+		config.HashWorkers = number
+	case "RestoreConflictPolicy":
+		if value != "fail" && value != "overwrite" && value != "skip" && value != "rename" {
+			return fmt.Errorf("invalid RestoreConflictPolicy value: %s", value)
+		}
+		config.RestoreConflictPolicy = value
+	case "RestoreHardLinks":
+		config.RestoreHardLinks = value == "true"
+	case "ChunkEncryptionKeyFile":
+		config.ChunkEncryptionKeyFile = value
+	case "WriteBackupIndex":
+		config.WriteBackupIndex = value == "true"
+	case "SignedManifestKeyFile":
+		config.SignedManifestKeyFile = value
+	case "SQLiteJournalMode":
+		mode := strings.ToUpper(value)
+		switch mode {
+		case "WAL", "DELETE", "TRUNCATE", "PERSIST", "MEMORY", "OFF":
+		default:
+			return fmt.Errorf("invalid SQLiteJournalMode value: %s", value)
+		}
+		config.SQLiteJournalMode = mode
+	case "SQLiteSynchronous":
+		level := strings.ToUpper(value)
+		switch level {
+		case "OFF", "NORMAL", "FULL", "EXTRA":
+		default:
+			return fmt.Errorf("invalid SQLiteSynchronous value: %s", value)
+		}
+		config.SQLiteSynchronous = level
+	case "SQLiteBusyTimeoutMs":
+		number, err := strconv.Atoi(value)
+		if err != nil || number < 0 {
+			return fmt.Errorf("invalid SQLiteBusyTimeoutMs value: %s", value)
+		}
+		config.SQLiteBusyTimeoutMs = number
+	case "TLSCertFile":
+		config.TLSCertFile = value
+	case "TLSKeyFile":
+		config.TLSKeyFile = value
+	case "TLSCAFile":
+		config.TLSCAFile = value
+	case "TLSClientCAFile":
+		config.TLSClientCAFile = value
+	case "AllowedClientHosts":
+		config.AllowedClientHosts = splitList(value)
+	case "StrictUnknownKeys":
+		config.StrictUnknownKeys = value == "true"
+	default:
+		return fmt.Errorf("%w: %s", errUnknownKey, key)
+	}
+	return nil
+}
+
+// parseCategories parses a comma-separated list of ext:category pairs
+// Extensions are lowercased and may be given with or without the leading dot
+func parseCategories(value string) (map[string]string, error) {
+	categories := make(map[string]string)
+	for _, item := range splitList(value) {
+		ext, category, ok := strings.Cut(item, ":")
+		ext = strings.ToLower(strings.TrimPrefix(strings.TrimSpace(ext), "."))
+		category = strings.TrimSpace(category)
+		if !ok || ext == "" || category == "" {
+			return nil, fmt.Errorf("expected ext:category, got %q", item)
+		}
+		categories[ext] = category
+	}
+	return categories, nil
+}
+
+// splitList parses a comma-separated value, dropping blank items
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
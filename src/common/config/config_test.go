@@ -0,0 +1,125 @@
+package config
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+// writeConfig writes content to a config file and returns its path
+func writeConfig(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "local.conf")
+	if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatalf("Failed to write config: %v", err)
+	}
+	return path
+}
+
+func TestParseConfigDefaults(t *testing.T) {
+	for name, content := range map[string]string{
+		"empty":   "",
+		"minimal": "# Only the streams\ndefault_streams=2\n",
+	} {
+		t.Run(name, func(t *testing.T) {
+			conf, err := ParseConfig(writeConfig(t, content))
+			if err != nil {
+				t.Fatalf("ParseConfig failed: %v", err)
+			}
+			if conf.DefaultPort != DefaultPortNumber {
+				t.Errorf("DefaultPort = %d, expected %d", conf.DefaultPort, DefaultPortNumber)
+			}
+			wantStreams := runtime.NumCPU()
+			if name == "minimal" {
+				wantStreams = 2
+			}
+			if conf.DefaultStreams != wantStreams {
+				t.Errorf("DefaultStreams = %d, expected %d", conf.DefaultStreams, wantStreams)
+			}
+			if conf.LogFolder != "" {
+				t.Errorf("LogFolder = %q, expected none", conf.LogFolder)
+			}
+			if conf.SplitStrategy != "size" || conf.ConnectAttempts != 3 || conf.Compression != "none" {
+				t.Errorf("Optional settings not defaulted: %+v", conf)
+			}
+		})
+	}
+}
+
+func TestParseConfigRequireFields(t *testing.T) {
+	path := writeConfig(t, "default_port=1234\n")
+	if _, err := ParseConfig(path, RequireFields("default_port")); err != nil {
+		t.Errorf("ParseConfig failed with the required field present: %v", err)
+	}
+	if _, err := ParseConfig(path, RequireFields("default_port", "logfolder")); err == nil {
+		t.Error("Expected an error for a missing required field")
+	}
+}
+
+func TestParseConfigRejectsMalformedValues(t *testing.T) {
+	for _, content := range []string{"default_port=http\n", "default_streams=many\n", "no equals sign\n"} {
+		if _, err := ParseConfig(writeConfig(t, content)); err == nil {
+			t.Errorf("Expected an error for %q", content)
+		}
+	}
+}
+
+func TestParseConfigUnknownKeys(t *testing.T) {
+	content := "default_port=1234\nSettingFromANewerVersion=42\ndefault_streams=3\n"
+	conf, err := ParseConfig(writeConfig(t, content))
+	if err != nil {
+		t.Fatalf("ParseConfig failed on an unknown key: %v", err)
+	}
+	if conf.DefaultPort != 1234 || conf.DefaultStreams != 3 {
+		t.Errorf("Known keys not parsed around the unknown one: port %d, streams %d", conf.DefaultPort, conf.DefaultStreams)
+	}
+	if len(conf.UnknownKeys) != 1 || conf.UnknownKeys[0] != "SettingFromANewerVersion" {
+		t.Errorf("UnknownKeys = %v", conf.UnknownKeys)
+	}
+
+	// Strict mode fails even when set after the unknown key
+	_, err = ParseConfig(writeConfig(t, content+"StrictUnknownKeys=true\n"))
+	if !errors.Is(err, errUnknownKey) {
+		t.Errorf("Expected an unknown key error in strict mode, got %v", err)
+	}
+}
+
+// The sample config, commented out settings included, parses strictly with this parser
+func TestParseConfigSampleConfig(t *testing.T) {
+	sample, err := os.ReadFile("../../../.config/local.conf")
+	if err != nil {
+		t.Fatalf("Failed to read the sample config: %v", err)
+	}
+	content := "StrictUnknownKeys=true\n"
+	for line := range strings.Lines(string(sample)) {
+		setting := strings.TrimPrefix(strings.TrimSpace(line), "#")
+		if key, _, ok := strings.Cut(setting, "="); ok && !strings.ContainsAny(key, " \t") {
+			content += setting + "\n"
+		}
+	}
+	if _, err := ParseConfig(writeConfig(t, content)); err != nil {
+		t.Errorf("Sample config doesn't parse: %v", err)
+	}
+}
+
+// Every Config field is read from a setting, so a field can't be added without its key
+func TestConfigFieldsHaveKeys(t *testing.T) {
+	keys := make(map[string]bool)
+	for _, o := range envOverrides {
+		keys[strings.ToLower(strings.ReplaceAll(o.key, "_", ""))] = true
+	}
+	fields := reflect.TypeFor[Config]()
+	for i := range fields.NumField() {
+		name := fields.Field(i).Name
+		if name == "UnknownKeys" {
+			continue // Filled by ParseConfig, not a setting
+		}
+		if !keys[strings.ToLower(name)] {
+			t.Errorf("Config field %s has no configuration key", name)
+		}
+	}
+}
@@ -0,0 +1,90 @@
+package config
+
+import (
+	"fmt"
+	"os"
+)
+
+// EnvPrefix starts the name of every environment variable overriding a setting
+const EnvPrefix = "MINIPROTECTOR_"
+
+// envOverrides maps each setting to the environment variable overriding it, without EnvPrefix
+var envOverrides = []struct {
+	key string
+	env string
+}{
+	{"default_port", "DEFAULT_PORT"},
+	{"default_streams", "DEFAULT_STREAMS"},
+	{"logfolder", "LOGFOLDER"},
+	{"LogMaxSizeMB", "LOG_MAX_SIZE_MB"},
+	{"log_level", "LOG_LEVEL"},
+	{"log_target", "LOG_TARGET"},
+	{"ClientHashQueryBatchSize", "CLIENT_HASH_QUERY_BATCH_SIZE"},
+	{"MaxInFlightBytes", "MAX_IN_FLIGHT_BYTES"},
+	{"ConnectionTimeOutSec", "CONNECTION_TIMEOUT_SEC"},
+	{"ConnectAttempts", "CONNECT_ATTEMPTS"},
+	{"ConnectRetryDelayMs", "CONNECT_RETRY_DELAY_MS"},
+	{"StreamResumeAttempts", "STREAM_RESUME_ATTEMPTS"},
+	{"HeartbeatSec", "HEARTBEAT_SEC"},
+	{"StopStreamOnFileError", "STOP_STREAM_ON_FILE_ERROR"},
+	{"RecordFileTimings", "RECORD_FILE_TIMINGS"},
+	{"DedupWithinRun", "DEDUP_WITHIN_RUN"},
+	{"DedupAcrossHosts", "DEDUP_ACROSS_HOSTS"},
+	{"ChecksumCacheFile", "CHECKSUM_CACHE_FILE"},
+	{"SkipFSTypes", "SKIP_FS_TYPES"},
+	{"NoBackupMarker", "NO_BACKUP_MARKER"},
+	{"BackupIgnoreFile", "BACKUP_IGNORE_FILE"},
+	{"FollowSymlinks", "FOLLOW_SYMLINKS"},
+	{"MaxScanDepth", "MAX_SCAN_DEPTH"},
+	{"IncrementalFields", "INCREMENTAL_FIELDS"},
+	{"ProgressOutput", "PROGRESS_OUTPUT"},
+	{"ManifestFile", "MANIFEST_FILE"},
+	{"ManifestFsync", "MANIFEST_FSYNC"},
+	{"IOPriorityClass", "IO_PRIORITY_CLASS"},
+	{"NiceLevel", "NICE_LEVEL"},
+	{"SplitStrategy", "SPLIT_STRATEGY"},
+	{"ExtensionCategories", "EXTENSION_CATEGORIES"},
+	{"MaxConcurrentFsync", "MAX_CONCURRENT_FSYNC"},
+	{"MaxStreamDurationSec", "MAX_STREAM_DURATION_SEC"},
+	{"StreamIdleTimeoutSec", "STREAM_IDLE_TIMEOUT_SEC"},
+	{"ShutdownTimeoutSec", "SHUTDOWN_TIMEOUT_SEC"},
+	{"MaxUnknownMessages", "MAX_UNKNOWN_MESSAGES"},
+	{"InlineMaxSize", "INLINE_MAX_SIZE"},
+	{"Compression", "COMPRESSION"},
+	{"HashAlgo", "HASH_ALGO"},
+	{"HashWorkers", "HASH_WORKERS"},
+	{"RestoreConflictPolicy", "RESTORE_CONFLICT_POLICY"},
+	{"RestoreHardLinks", "RESTORE_HARD_LINKS"},
+	{"ChunkEncryptionKeyFile", "CHUNK_ENCRYPTION_KEY_FILE"},
+	{"WriteBackupIndex", "WRITE_BACKUP_INDEX"},
+	{"SignedManifestKeyFile", "SIGNED_MANIFEST_KEY_FILE"},
+	{"SQLiteJournalMode", "SQLITE_JOURNAL_MODE"},
+	{"SQLiteSynchronous", "SQLITE_SYNCHRONOUS"},
+	{"SQLiteBusyTimeoutMs", "SQLITE_BUSY_TIMEOUT_MS"},
+	{"TLSCertFile", "TLS_CERT_FILE"},
+	{"TLSKeyFile", "TLS_KEY_FILE"},
+	{"TLSCAFile", "TLS_CA_FILE"},
+	{"TLSClientCAFile", "TLS_CLIENT_CA_FILE"},
+	{"AllowedClientHosts", "ALLOWED_CLIENT_HOSTS"},
+	{"StrictUnknownKeys", "STRICT_UNKNOWN_KEYS"},
+}
+
+// ApplyEnvOverrides sets every setting whose environment variable is set, see envOverrides,
+// over the value read from the config file. Values are validated as in the file.
+// A variable set to an empty value overrides too, e.g. MINIPROTECTOR_LOGFOLDER= logs to stdout only.
+func ApplyEnvOverrides(conf *Config) error {
+	for _, o := range envOverrides {
+		value, ok := os.LookupEnv(EnvPrefix + o.env)
+		if !ok {
+			continue
+		}
+		if err := setField(conf, o.key, value); err != nil {
+			return fmt.Errorf("environment variable %s%s: %w", EnvPrefix, o.env, err)
+		}
+	}
+	// StrictUnknownKeys set from the environment applies to the file already read
+	if conf.StrictUnknownKeys && len(conf.UnknownKeys) > 0 {
+		return fmt.Errorf("%w: %s", errUnknownKey, conf.UnknownKeys[0])
+	}
+	return nil
+}
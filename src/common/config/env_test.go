@@ -0,0 +1,80 @@
+package config
+
+import (
+	"bufio"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestApplyEnvOverrides(t *testing.T) {
+	conf, err := ParseConfig(writeConfig(t, "default_port=1234\nlogfolder=/var/log/miniprotector\nSplitStrategy=count\n"))
+	if err != nil {
+		t.Fatalf("ParseConfig failed: %v", err)
+	}
+	t.Setenv("MINIPROTECTOR_DEFAULT_PORT", "4321")
+	t.Setenv("MINIPROTECTOR_LOGFOLDER", "")
+	t.Setenv("MINIPROTECTOR_SKIP_FS_TYPES", "proc, tmpfs")
+	t.Setenv("MINIPROTECTOR_WRITE_BACKUP_INDEX", "true")
+	if err := ApplyEnvOverrides(conf); err != nil {
+		t.Fatalf("ApplyEnvOverrides failed: %v", err)
+	}
+
+	if conf.DefaultPort != 4321 {
+		t.Errorf("DefaultPort = %d, expected the environment's 4321", conf.DefaultPort)
+	}
+	if conf.LogFolder != "" {
+		t.Errorf("LogFolder = %q, expected the environment's empty value", conf.LogFolder)
+	}
+	if len(conf.SkipFSTypes) != 2 || conf.SkipFSTypes[0] != "proc" || conf.SkipFSTypes[1] != "tmpfs" {
+		t.Errorf("SkipFSTypes = %v, expected [proc tmpfs]", conf.SkipFSTypes)
+	}
+	if !conf.WriteBackupIndex {
+		t.Error("WriteBackupIndex not set from the environment")
+	}
+	// Settings without a variable keep the file's value
+	if conf.SplitStrategy != "count" {
+		t.Errorf("SplitStrategy = %q, expected the file's count", conf.SplitStrategy)
+	}
+}
+
+func TestApplyEnvOverridesValidates(t *testing.T) {
+	for env, value := range map[string]string{
+		"MINIPROTECTOR_DEFAULT_PORT":   "http",
+		"MINIPROTECTOR_SPLIT_STRATEGY": "random",
+		"MINIPROTECTOR_NICE_LEVEL":     "20",
+	} {
+		t.Run(env, func(t *testing.T) {
+			t.Setenv(env, value)
+			conf := &Config{}
+			if err := ApplyEnvOverrides(conf); err == nil || !strings.Contains(err.Error(), env) {
+				t.Errorf("Expected an error naming %s, got %v", env, err)
+			}
+		})
+	}
+}
+
+// Every setting of the sample config can be overridden from the environment
+func TestEnvOverridesCoverSampleConfig(t *testing.T) {
+	file, err := os.Open("../../../.config/local.conf")
+	if err != nil {
+		t.Fatalf("Failed to open the sample config: %v", err)
+	}
+	defer file.Close()
+
+	known := make(map[string]bool)
+	for _, o := range envOverrides {
+		known[o.key] = true
+	}
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimPrefix(strings.TrimSpace(scanner.Text()), "#")
+		key, _, ok := strings.Cut(line, "=")
+		if !ok || strings.ContainsAny(key, " \t") {
+			continue // Comment text, not a commented out setting
+		}
+		if !known[key] {
+			t.Errorf("Setting %s has no environment variable", key)
+		}
+	}
+}
@@ -0,0 +1,117 @@
+//go:build linux
+
+package files
+
+import (
+	"bytes"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+// posixACL builds a system.posix_acl_access value granting read access to uid
+func posixACL(uid uint32) []byte {
+	const (
+		aclVersion  = 2
+		aclUserObj  = 0x01
+		aclUser     = 0x02
+		aclGroupObj = 0x04
+		aclMask     = 0x10
+		aclOther    = 0x20
+		undefinedId = 0xffffffff
+	)
+	entries := []struct {
+		tag  uint16
+		perm uint16
+		id   uint32
+	}{
+		{aclUserObj, 6, undefinedId},
+		{aclUser, 4, uid},
+		{aclGroupObj, 4, undefinedId},
+		{aclMask, 4, undefinedId},
+		{aclOther, 0, undefinedId},
+	}
+
+	acl := binary.LittleEndian.AppendUint32(nil, aclVersion)
+	for _, entry := range entries {
+		acl = binary.LittleEndian.AppendUint16(acl, entry.tag)
+		acl = binary.LittleEndian.AppendUint16(acl, entry.perm)
+		acl = binary.LittleEndian.AppendUint32(acl, entry.id)
+	}
+	return acl
+}
+
+func TestACLRoundTrip(t *testing.T) {
+	root := t.TempDir()
+	source := filepath.Join(root, "source.txt")
+	target := filepath.Join(root, "target.txt")
+	createFiles(t, root, "source.txt", "target.txt")
+
+	acl := posixACL(1234)
+	if err := unix.Setxattr(source, aclAccessXattr, acl, 0); err != nil {
+		t.Skipf("POSIX ACLs not supported here: %v", err)
+	}
+
+	fileInfo, err := getFileInfo(source)
+	if err != nil {
+		t.Fatalf("Failed to get file info: %v", err)
+	}
+	if fileInfo.ACL == nil {
+		t.Fatal("Expected ACL to be captured")
+	}
+
+	encoded, err := Encode(&fileInfo)
+	if err != nil {
+		t.Fatalf("Failed to encode: %v", err)
+	}
+	decoded, err := DecodeFileInfo(encoded)
+	if err != nil {
+		t.Fatalf("Failed to decode: %v", err)
+	}
+
+	if err := RestoreACL(target, decoded.ACL); err != nil {
+		t.Fatalf("Failed to restore ACL: %v", err)
+	}
+	restored, err := lgetxattr(target, aclAccessXattr)
+	if err != nil {
+		t.Fatalf("Failed to read restored ACL: %v", err)
+	}
+	if !bytes.Equal(restored, acl) {
+		t.Errorf("Restored ACL differs from the original")
+	}
+}
+
+func TestACLDefaultOnDirectory(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "dir")
+	if err := os.Mkdir(dir, 0755); err != nil {
+		t.Fatalf("Failed to create dir: %v", err)
+	}
+	acl := posixACL(1234)
+	if err := unix.Setxattr(dir, aclDefaultXattr, acl, 0); err != nil {
+		t.Skipf("POSIX ACLs not supported here: %v", err)
+	}
+
+	captured := getACL(fileRef{path: dir})
+	if len(captured) == 0 || captured[0] != aclKindDefault {
+		t.Fatalf("Expected default ACL to be captured, got %v", captured)
+	}
+}
+
+func TestACLAbsent(t *testing.T) {
+	root := t.TempDir()
+	createFiles(t, root, "plain.txt")
+	path := filepath.Join(root, "plain.txt")
+
+	if acl := getACL(fileRef{path: path}); acl != nil {
+		t.Errorf("Expected nil ACL for plain file, got %v", acl)
+	}
+	if err := RestoreACL(path, nil); err != nil {
+		t.Errorf("Expected no error restoring empty ACL, got %v", err)
+	}
+	if err := RestoreACL(path, []byte{'a', 0, 0, 0, 9}); err == nil {
+		t.Error("Expected error for truncated ACL data")
+	}
+}
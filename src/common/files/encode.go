@@ -2,22 +2,54 @@ package files
 
 import (
 	"bytes"
+	"encoding/binary"
 	"encoding/gob"
+	"errors"
+	"fmt"
+	"hash/crc32"
 )
 
-// Encode serializes FileInfo to an efficient gob-encoded string
+// ErrCorruptedFileInfo is returned when an encoded FileInfo fails its checksum
+var ErrCorruptedFileInfo = errors.New("file info payload is corrupted")
+
+// ErrIncompatibleProtocol is returned when an encoded FileInfo comes from another protocol version
+var ErrIncompatibleProtocol = errors.New("incompatible protocol version")
+
+// ProtocolVersion is the version byte leading encoded FileInfo.
+// Bump it whenever a change to FileInfo makes the gob encoding unreadable by the other side,
+// including a renamed field, which gob would silently drop.
+const ProtocolVersion byte = 2
+
+// checksumSize is the length of the CRC32 trailer appended to encoded FileInfo
+const checksumSize = 4
+
+// Encode serializes FileInfo to the protocol version byte and an efficient gob-encoded string,
+// followed by a big-endian CRC32 of both
 func Encode(fileInfo *FileInfo) ([]byte, error) {
-	var buf bytes.Buffer
-	enc := gob.NewEncoder(&buf)
+	buf := bytes.NewBuffer([]byte{ProtocolVersion})
+	enc := gob.NewEncoder(buf)
 	if err := enc.Encode(fileInfo); err != nil {
 		return nil, err
 	}
-	return buf.Bytes(), nil
+	return binary.BigEndian.AppendUint32(buf.Bytes(), crc32.ChecksumIEEE(buf.Bytes())), nil
 }
 
-// DecodeFileInfo deserializes FileInfo from gob-encoded string
+// DecodeFileInfo verifies the checksum and the protocol version and deserializes FileInfo from gob-encoded string
 func DecodeFileInfo(data []byte) (fileInfo *FileInfo, err error) {
-	buf := bytes.NewBuffer(data)
+	if len(data) < 1+checksumSize {
+		return nil, fmt.Errorf("%w: payload too short (%d bytes)", ErrCorruptedFileInfo, len(data))
+	}
+	payload := data[:len(data)-checksumSize]
+	expected := binary.BigEndian.Uint32(data[len(data)-checksumSize:])
+	if actual := crc32.ChecksumIEEE(payload); actual != expected {
+		return nil, fmt.Errorf("%w: checksum %08x, expected %08x", ErrCorruptedFileInfo, actual, expected)
+	}
+
+	if payload[0] != ProtocolVersion {
+		return nil, fmt.Errorf("%w: file info of version %d, expected %d", ErrIncompatibleProtocol, payload[0], ProtocolVersion)
+	}
+
+	buf := bytes.NewBuffer(payload[1:])
 	dec := gob.NewDecoder(buf)
 	err = dec.Decode(&fileInfo)
 	return fileInfo, err
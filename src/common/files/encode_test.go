@@ -0,0 +1,108 @@
+package files
+
+import (
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"testing"
+	"time"
+)
+
+func testFileInfo() FileInfo {
+	return FileInfo{
+		Host:    "host",
+		Path:    "/data/file.txt",
+		Name:    "file.txt",
+		Size:    1024,
+		Mode:    0644,
+		ModTime: time.Unix(1700000000, 0),
+	}
+}
+
+func TestEncodeDecode(t *testing.T) {
+	fileInfo := testFileInfo()
+	encoded, err := Encode(&fileInfo)
+	if err != nil {
+		t.Fatalf("Failed to encode: %v", err)
+	}
+
+	decoded, err := DecodeFileInfo(encoded)
+	if err != nil {
+		t.Fatalf("Failed to decode: %v", err)
+	}
+	if decoded.GetId() != fileInfo.GetId() || decoded.Size != fileInfo.Size {
+		t.Errorf("Decoded %+v differs from %+v", decoded, fileInfo)
+	}
+}
+
+func TestDecodeDetectsCorruption(t *testing.T) {
+	fileInfo := testFileInfo()
+	encoded, err := Encode(&fileInfo)
+	if err != nil {
+		t.Fatalf("Failed to encode: %v", err)
+	}
+
+	// Flip one byte of every position in turn, including the checksum itself
+	for i := range encoded {
+		corrupted := append([]byte(nil), encoded...)
+		corrupted[i] ^= 0x01
+
+		_, err := DecodeFileInfo(corrupted)
+		if !errors.Is(err, ErrCorruptedFileInfo) {
+			t.Fatalf("Byte %d: expected corruption error, got %v", i, err)
+		}
+	}
+
+	if _, err := DecodeFileInfo(encoded[:2]); !errors.Is(err, ErrCorruptedFileInfo) {
+		t.Errorf("Expected corruption error for truncated payload, got %v", err)
+	}
+}
+
+func TestDecodeRejectsOtherVersion(t *testing.T) {
+	fileInfo := testFileInfo()
+	encoded, err := Encode(&fileInfo)
+	if err != nil {
+		t.Fatalf("Failed to encode: %v", err)
+	}
+	if encoded[0] != ProtocolVersion {
+		t.Fatalf("Encoded payload starts with %d, expected version %d", encoded[0], ProtocolVersion)
+	}
+
+	// A payload from another version, with a valid checksum
+	other := append([]byte{ProtocolVersion + 1}, encoded[1:len(encoded)-checksumSize]...)
+	other = binary.BigEndian.AppendUint32(other, crc32.ChecksumIEEE(other))
+	_, err = DecodeFileInfo(other)
+	if !errors.Is(err, ErrIncompatibleProtocol) {
+		t.Errorf("Expected incompatible protocol error, got %v", err)
+	}
+	if errors.Is(err, ErrCorruptedFileInfo) {
+		t.Errorf("Version mismatch reported as corruption: %v", err)
+	}
+}
+
+func TestDecodeShortInput(t *testing.T) {
+	fileInfo := testFileInfo()
+	encoded, err := Encode(&fileInfo)
+	if err != nil {
+		t.Fatalf("Failed to encode: %v", err)
+	}
+	// Garbage behind a valid version and checksum reaches the gob decoder
+	garbage := []byte{ProtocolVersion, 0xff, 0x00, 0x13}
+	garbage = binary.BigEndian.AppendUint32(garbage, crc32.ChecksumIEEE(garbage))
+
+	for name, data := range map[string][]byte{
+		"nil":      nil,
+		"empty":    {},
+		"FIL":      []byte("FIL"),
+		"checksum": encoded[len(encoded)-checksumSize:],
+		"garbage":  garbage,
+	} {
+		if fileInfo, err := DecodeFileInfo(data); err == nil {
+			t.Errorf("%s: decoded %+v, expected an error", name, fileInfo)
+		}
+	}
+
+	if decoded, err := DecodeFileInfo(encoded); err != nil || decoded.Path != fileInfo.Path {
+		t.Errorf("Valid payload decoded to %+v, %v", decoded, err)
+	}
+}
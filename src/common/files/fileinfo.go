@@ -3,6 +3,7 @@ package files
 import (
 	"fmt"
 	"io/fs"
+	"os"
 	"time"
 )
 
@@ -19,11 +20,37 @@ type FileInfo struct {
 	Group         uint32      // Unix GID, Windows primary group SID hash
 	ModTime       time.Time
 	AccessTime    time.Time
-	CTime         time.Time // Unix: change time, Windows: creation time
+	ChangeTime    time.Time // Unix: change time, Windows: creation time
 	SymlinkTarget string
+	Dev           uint64 // Device id of the filesystem holding the file
+	Ino           uint64 // Inode number, (Dev, Ino) identifies hard links to the same data
+	Nlink         uint32 // Number of hard links
+	Blocks        int64  // Allocated 512-byte blocks, fewer than Size needs for a sparse file
 	// Platform-specific fields
-	Attributes []byte // Platform-specific attributes (Windows file attributes, Unix extended attributes, etc.)
-	ACL        []byte // Platform-specific ACL data (Unix extended ACLs or Windows Security Descriptor)
+	Attributes []byte            // Windows file attributes, little endian, nil on Unix where Xattrs holds the extended attributes
+	ACL        []byte            // Platform-specific ACL data (Unix extended ACLs or Windows Security Descriptor)
+	Xattrs     map[string][]byte // Extended attributes (user.*, security.*, ...) except ACLs
+
+	statDuration  time.Duration // Local only, not sent to the writer
+	skippedXattrs []error       // Local only, extended attributes that couldn't be read, logged by the scan
+}
+
+// StatFile returns the metadata of an open file, read from the file itself rather than its path,
+// so it matches the data read through f even when the path is replaced meanwhile
+func StatFile(f *os.File) (FileInfo, error) {
+	return getFileInfoFromFd(f)
+}
+
+// IsSparse reports whether a regular file has less storage allocated than its size: it has holes,
+// ranges that read as zeros without being stored
+func (fi *FileInfo) IsSparse() bool {
+	return fi.Mode.IsRegular() && fi.Blocks*512 < fi.Size
+}
+
+// StatDuration returns how long reading the metadata took during the scan
+// It is zero unless the scan was run with ScanOptions.RecordTimings
+func (fi *FileInfo) StatDuration() time.Duration {
+	return fi.statDuration
 }
 
 // File type mapping from fs.FileMode to single character representation
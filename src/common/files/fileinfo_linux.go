@@ -3,6 +3,8 @@
 package files
 
 import (
+	"encoding/binary"
+	"errors"
 	"fmt"
 	"io/fs"
 	"os"
@@ -16,10 +18,69 @@ import (
 func getFileInfo(path string) (FileInfo, error) {
 	// print current path
 	info, err := os.Lstat(path)
+	if errors.Is(err, unix.ENAMETOOLONG) {
+		return FileInfo{}, fmt.Errorf("path of %d bytes exceeds the system limit of %d: %w", len(path), unix.PathMax, err)
+	}
 	if err != nil {
-		return FileInfo{}, fmt.Errorf("os.Lstat(path): %v", err)
+		return FileInfo{}, fmt.Errorf("os.Lstat(path): %w", err)
 	}
+	return newFileInfo(path, info, fileRef{path: path})
+}
 
+// getFileInfoFromFd returns the metadata of an open file, read through its descriptor so it
+// describes the file being read even if another one was put at its path since it was opened
+func getFileInfoFromFd(f *os.File) (FileInfo, error) {
+	info, err := f.Stat() // fstat on the descriptor
+	if err != nil {
+		return FileInfo{}, err
+	}
+	return newFileInfo(f.Name(), info, fileRef{path: f.Name(), fd: f})
+}
+
+// fileRef is the file whose ACLs, extended attributes and symlink target are read:
+// path without following symlinks, or the open descriptor fd when set
+type fileRef struct {
+	path string
+	fd   *os.File
+}
+
+// getxattr is unix.Lgetxattr or unix.Fgetxattr on the file
+func (ref fileRef) getxattr(name string, dest []byte) (int, error) {
+	if ref.fd != nil {
+		return unix.Fgetxattr(int(ref.fd.Fd()), name, dest)
+	}
+	return unix.Lgetxattr(ref.path, name, dest)
+}
+
+// listxattr is unix.Llistxattr or unix.Flistxattr on the file
+func (ref fileRef) listxattr(dest []byte) (int, error) {
+	if ref.fd != nil {
+		return unix.Flistxattr(int(ref.fd.Fd()), dest)
+	}
+	return unix.Llistxattr(ref.path, dest)
+}
+
+// readlink returns the target of the file, a symlink
+// Through a descriptor readlinkat with an empty path reads the link the descriptor refers to
+func (ref fileRef) readlink() (string, error) {
+	if ref.fd == nil {
+		// os.Readlink grows its buffer until the target fits, however long
+		return os.Readlink(ref.path)
+	}
+	for size := 256; ; size *= 2 {
+		buf := make([]byte, size)
+		n, err := unix.Readlinkat(int(ref.fd.Fd()), "", buf)
+		if err != nil {
+			return "", err
+		}
+		if n < size {
+			return string(buf[:n]), nil
+		}
+	}
+}
+
+// newFileInfo builds the FileInfo of path from its stat result, reading the rest from ref
+func newFileInfo(path string, info fs.FileInfo, ref fileRef) (FileInfo, error) {
 	stat, ok := info.Sys().(*syscall.Stat_t)
 	if !ok {
 		return FileInfo{}, fmt.Errorf("info.Sys().(*syscall.Stat_t): %v", unix.ENOSYS)
@@ -34,13 +95,23 @@ func getFileInfo(path string) (FileInfo, error) {
 		Group:      stat.Gid,
 		ModTime:    info.ModTime(),
 		AccessTime: time.Unix(stat.Atim.Sec, stat.Atim.Nsec),
-		CTime:      time.Unix(stat.Ctim.Sec, stat.Ctim.Nsec),
-		ACL:        getACL(path), // Extract platform-specific ACLs
+		ChangeTime: time.Unix(stat.Ctim.Sec, stat.Ctim.Nsec),
+		Dev:        uint64(stat.Dev),
+		Ino:        stat.Ino,
+		Nlink:      uint32(stat.Nlink),
+		Blocks:     stat.Blocks,
+		ACL:        getACL(ref), // Extract platform-specific ACLs
+	}
+
+	// Extended attributes are optional, a failure to list them doesn't fail the file
+	if xattrs, skipped, err := getXattrs(ref); err == nil {
+		fileInfo.Xattrs = xattrs
+		fileInfo.skippedXattrs = skipped
 	}
 
 	// Read symlink target if it's a symbolic link
 	if info.Mode()&fs.ModeSymlink != 0 {
-		if target, err := os.Readlink(path); err == nil {
+		if target, err := ref.readlink(); err == nil {
 			fileInfo.SymlinkTarget = target
 		}
 	}
@@ -48,9 +119,95 @@ func getFileInfo(path string) (FileInfo, error) {
 	return fileInfo, nil
 }
 
-// getACL extracts platform-specific ACL data
-func getACL(path string) []byte {
-	// Unix/Linux: This would require the 'acl' package or syscalls to getxattr
-	// Implementation would use getxattr with "system.posix_acl_access" and "system.posix_acl_default"
+// POSIX ACL extended attributes
+const (
+	aclAccessXattr  = "system.posix_acl_access"
+	aclDefaultXattr = "system.posix_acl_default"
+)
+
+// ACL data is a sequence of records: one kind byte ('a' access, 'd' default),
+// a big-endian uint32 length and the raw xattr value
+const (
+	aclKindAccess  = 'a'
+	aclKindDefault = 'd'
+)
+
+// getACL extracts POSIX access and default ACLs
+// Returns nil when the file has no ACLs or the filesystem doesn't support them
+func getACL(ref fileRef) []byte {
+	var acl []byte
+	for _, kind := range []byte{aclKindAccess, aclKindDefault} {
+		value, err := ref.xattr(aclXattrName(kind))
+		if err != nil || len(value) == 0 {
+			continue
+		}
+		acl = append(acl, kind)
+		acl = binary.BigEndian.AppendUint32(acl, uint32(len(value)))
+		acl = append(acl, value...)
+	}
+	return acl
+}
+
+// RestoreACL applies ACL data captured by getACL to path
+func RestoreACL(path string, acl []byte) error {
+	for len(acl) > 0 {
+		if len(acl) < 5 {
+			return fmt.Errorf("truncated ACL data for %s", path)
+		}
+		kind := acl[0]
+		size := binary.BigEndian.Uint32(acl[1:5])
+		acl = acl[5:]
+		if uint32(len(acl)) < size {
+			return fmt.Errorf("truncated ACL data for %s", path)
+		}
+		if kind != aclKindAccess && kind != aclKindDefault {
+			return fmt.Errorf("unknown ACL kind %q for %s", kind, path)
+		}
+
+		if err := unix.Lsetxattr(path, aclXattrName(kind), acl[:size], 0); err != nil {
+			return fmt.Errorf("failed to set %s on %s: %w", aclXattrName(kind), path, err)
+		}
+		acl = acl[size:]
+	}
 	return nil
 }
+
+func aclXattrName(kind byte) string {
+	if kind == aclKindDefault {
+		return aclDefaultXattr
+	}
+	return aclAccessXattr
+}
+
+// lgetxattr reads an extended attribute without following symlinks
+// Missing attributes return nil without error
+func lgetxattr(path, name string) ([]byte, error) {
+	return fileRef{path: path}.xattr(name)
+}
+
+// xattr reads an extended attribute of the file, nil without error when it is missing
+func (ref fileRef) xattr(name string) ([]byte, error) {
+	for {
+		size, err := ref.getxattr(name, nil)
+		if err == unix.ENODATA || err == unix.ENOTSUP {
+			return nil, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if size == 0 {
+			return nil, nil
+		}
+
+		value := make([]byte, size)
+		size, err = ref.getxattr(name, value)
+		if err == unix.ERANGE {
+			// Attribute grew between the calls, retry
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		return value[:size], nil
+	}
+}
@@ -0,0 +1,131 @@
+package files
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+// mkdirDeep creates nested directories named name below root, going on from each one by
+// descriptor, so the full path can grow past PATH_MAX. Returns the path of the deepest one.
+func mkdirDeep(t *testing.T, root, name string, depth int) string {
+	t.Helper()
+	fd, err := unix.Open(root, unix.O_RDONLY|unix.O_DIRECTORY, 0)
+	if err != nil {
+		t.Fatalf("Failed to open %s: %v", root, err)
+	}
+	path := root
+	for range depth {
+		if err := unix.Mkdirat(fd, name, 0755); err != nil {
+			t.Fatalf("Failed to create directory: %v", err)
+		}
+		next, err := unix.Openat(fd, name, unix.O_RDONLY|unix.O_DIRECTORY, 0)
+		unix.Close(fd)
+		if err != nil {
+			t.Fatalf("Failed to open directory: %v", err)
+		}
+		fd = next
+		path += "/" + name
+	}
+	unix.Close(fd)
+	return path
+}
+
+func TestGetFileInfoLongPaths(t *testing.T) {
+	root := t.TempDir()
+	name := strings.Repeat("d", 200)
+
+	// Just below PATH_MAX the path is read as any other
+	near := mkdirDeep(t, root, name, (unix.PathMax-len(root)-50)/(len(name)+1))
+	if _, err := getFileInfo(near); err != nil {
+		t.Errorf("Failed to read a path of %d bytes: %v", len(near), err)
+	}
+
+	// Past it the error says so
+	long := mkdirDeep(t, root, name+"x", (unix.PathMax/(len(name)+2))+1)
+	_, err := getFileInfo(long)
+	if !errors.Is(err, unix.ENAMETOOLONG) {
+		t.Fatalf("Expected ENAMETOOLONG for a path of %d bytes, got %v", len(long), err)
+	}
+	if !strings.Contains(err.Error(), "exceeds the system limit") {
+		t.Errorf("Error doesn't explain the limit: %v", err)
+	}
+
+	// A scan skipping errors reports the entries out of reach and keeps the others
+	_, scanErrors, err := Scan(root, ScanOptions{SkipErrors: true})
+	if err != nil {
+		t.Fatalf("Scan failed: %v", err)
+	}
+	if len(scanErrors) == 0 || !errors.Is(scanErrors[0].Err, unix.ENAMETOOLONG) {
+		t.Errorf("Expected a ScanError for the long path, got %v", scanErrors)
+	}
+}
+
+func TestGetFileInfoLongSymlinkTarget(t *testing.T) {
+	// Longer than the usual buffer sizes, up to the PATH_MAX limit on targets
+	target := strings.Repeat("t/", (unix.PathMax-2)/2)
+	link := filepath.Join(t.TempDir(), "link")
+	if err := os.Symlink(target, link); err != nil {
+		t.Fatalf("Failed to create symlink: %v", err)
+	}
+	info, err := getFileInfo(link)
+	if err != nil {
+		t.Fatalf("getFileInfo failed: %v", err)
+	}
+	if info.SymlinkTarget != target {
+		t.Errorf("Symlink target read as %d bytes, expected %d", len(info.SymlinkTarget), len(target))
+	}
+}
+
+func TestStatFileAfterPathReplaced(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "data.txt")
+	if err := os.WriteFile(path, []byte("original"), 0644); err != nil {
+		t.Fatalf("Failed to write file: %v", err)
+	}
+	// Extended attributes tell the files apart where the filesystem keeps them
+	withXattrs := unix.Setxattr(path, "user.origin", []byte("original"), 0) == nil
+	scanned, err := getFileInfo(path)
+	if err != nil {
+		t.Fatalf("getFileInfo failed: %v", err)
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatalf("Failed to open file: %v", err)
+	}
+	defer f.Close()
+
+	// Another file takes the path once the original is open
+	replacement := filepath.Join(dir, "replacement.txt")
+	if err := os.WriteFile(replacement, []byte("a different, longer content"), 0600); err != nil {
+		t.Fatalf("Failed to write file: %v", err)
+	}
+	if withXattrs {
+		if err := unix.Setxattr(replacement, "user.origin", []byte("replacement"), 0); err != nil {
+			t.Fatalf("Failed to set xattr: %v", err)
+		}
+	}
+	if err := os.Rename(replacement, path); err != nil {
+		t.Fatalf("Failed to replace file: %v", err)
+	}
+
+	info, err := StatFile(f)
+	if err != nil {
+		t.Fatalf("StatFile failed: %v", err)
+	}
+	if info.Ino != scanned.Ino || info.Size != scanned.Size || info.Mode != scanned.Mode || info.Path != path {
+		t.Errorf("StatFile = %+v, expected the original file %+v", info, scanned)
+	}
+	if withXattrs && string(info.Xattrs["user.origin"]) != "original" {
+		t.Errorf("StatFile read xattrs %q, expected those of the original file", info.Xattrs)
+	}
+	data, err := io.ReadAll(f)
+	if err != nil || string(data) != "original" {
+		t.Errorf("Read %q through the descriptor, expected the original content: %v", data, err)
+	}
+}
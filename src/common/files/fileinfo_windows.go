@@ -3,19 +3,33 @@
 package files
 
 import (
+	"fmt"
 	"io/fs"
 	"os"
+	"syscall"
 	"time"
-
-	"golang.org/x/sys/windows"
 )
 
-// getWindowsFileInfo extracts detailed file information on Windows systems
+// getFileInfo extracts detailed file information on Windows systems
 func getFileInfo(path string) (FileInfo, error) {
 	info, err := os.Lstat(path)
 	if err != nil {
 		return FileInfo{}, err
 	}
+	return newFileInfo(path, info)
+}
+
+// getFileInfoFromFd returns the metadata of an open file, read through its handle
+func getFileInfoFromFd(f *os.File) (FileInfo, error) {
+	info, err := f.Stat()
+	if err != nil {
+		return FileInfo{}, err
+	}
+	return newFileInfo(f.Name(), info)
+}
+
+// newFileInfo builds the FileInfo of path from its stat result
+func newFileInfo(path string, info fs.FileInfo) (FileInfo, error) {
 
 	fileInfo := FileInfo{
 		Path:    path,
@@ -26,8 +40,8 @@ func getFileInfo(path string) (FileInfo, error) {
 		ACL:     getACL(path), // Extract platform-specific ACLs
 	}
 
-	// Extract Windows-specific information
-	if winStat, ok := info.Sys().(*windows.Win32FileAttributeData); ok {
+	// Extract Windows-specific information, os.Lstat and File.Stat report it as the syscall type
+	if winStat, ok := info.Sys().(*syscall.Win32FileAttributeData); ok {
 		// Store Windows attributes as 4 bytes
 		attrs := make([]byte, 4)
 		attrs[0] = byte(winStat.FileAttributes)
@@ -38,13 +52,19 @@ func getFileInfo(path string) (FileInfo, error) {
 
 		// Convert Windows FILETIME to time.Time
 		fileInfo.AccessTime = time.Unix(0, winStat.LastAccessTime.Nanoseconds())
-		fileInfo.CTime = time.Unix(0, winStat.CreationTime.Nanoseconds()) // Creation time as CTime
+		fileInfo.ChangeTime = time.Unix(0, winStat.CreationTime.Nanoseconds()) // Creation time as ChangeTime
 	} else {
 		// Fallback for cases where Win32FileAttributeData is not available
 		fileInfo.AccessTime = info.ModTime() // Best we can do
-		fileInfo.CTime = info.ModTime()
+		fileInfo.ChangeTime = info.ModTime()
 	}
 
+	// Allocated blocks aren't read on Windows, files count as fully allocated
+	fileInfo.Blocks = (fileInfo.Size + 511) / 512
+
+	// Dev, Ino and Nlink need an open handle (GetFileInformationByHandle), left as 0
+	// so hard links are not detected on Windows
+
 	// Windows doesn't have traditional Unix owner/group, set to 0
 	fileInfo.Owner = 0
 	fileInfo.Group = 0
@@ -65,3 +85,11 @@ func getACL(path string) []byte {
 	// Implementation would use syscall to advapi32.dll GetNamedSecurityInfoW
 	return nil
 }
+
+// RestoreACL applies ACL data captured by getACL to path
+func RestoreACL(path string, acl []byte) error {
+	if len(acl) == 0 {
+		return nil
+	}
+	return fmt.Errorf("restoring ACLs is not supported on Windows: %s", path)
+}
@@ -0,0 +1,49 @@
+//go:build windows
+
+package files
+
+import (
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+func TestGetFileInfoWindowsFields(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "data.txt")
+	if err := os.WriteFile(path, []byte("hello"), 0600); err != nil {
+		t.Fatalf("Failed to write file: %v", err)
+	}
+	fileInfo, err := getFileInfo(path)
+	if err != nil {
+		t.Fatalf("getFileInfo failed: %v", err)
+	}
+	if !fileInfo.Mode.IsRegular() || fileInfo.Size != 5 || fileInfo.Name != "data.txt" {
+		t.Errorf("Got mode %v, size %d and name %s, expected a 5 byte regular data.txt", fileInfo.Mode, fileInfo.Size, fileInfo.Name)
+	}
+	// The attributes and times come from the Win32 data, not the fallback copying the mtime
+	if len(fileInfo.Attributes) != 4 {
+		t.Fatalf("Got %d bytes of attributes, expected 4", len(fileInfo.Attributes))
+	}
+	if attrs := binary.LittleEndian.Uint32(fileInfo.Attributes); attrs&syscall.FILE_ATTRIBUTE_DIRECTORY != 0 {
+		t.Errorf("File attributes %#x mark a directory", attrs)
+	}
+	if fileInfo.ChangeTime.IsZero() || fileInfo.AccessTime.IsZero() {
+		t.Errorf("Creation time %v and access time %v, expected both set", fileInfo.ChangeTime, fileInfo.AccessTime)
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatalf("Failed to open file: %v", err)
+	}
+	defer f.Close()
+	opened, err := StatFile(f)
+	if err != nil {
+		t.Fatalf("StatFile failed: %v", err)
+	}
+	if string(opened.Attributes) != string(fileInfo.Attributes) || !opened.ChangeTime.Equal(fileInfo.ChangeTime) {
+		t.Errorf("StatFile gives attributes %v and time %v, getFileInfo %v and %v",
+			opened.Attributes, opened.ChangeTime, fileInfo.Attributes, fileInfo.ChangeTime)
+	}
+}
@@ -0,0 +1,42 @@
+package files
+
+import "testing"
+
+func TestMatchGlob(t *testing.T) {
+	tests := []struct {
+		pattern string
+		path    string
+		want    bool
+	}{
+		{"*.tmp", "a.tmp", true},
+		{"*.tmp", "dir/a.tmp", false},
+		{"**/*.tmp", "a.tmp", true},
+		{"**/*.tmp", "dir/sub/a.tmp", true},
+		{"**/node_modules", "node_modules", true},
+		{"**/node_modules", "web/app/node_modules", true},
+		{"**/node_modules", "web/node_modules/pkg", false},
+		{"cache/**", "cache/a/b", true},
+		{"cache/**", "cache", true},
+		{"src/**/test/*.go", "src/test/a.go", true},
+		{"src/**/test/*.go", "src/x/y/test/a.go", true},
+		{"src/**/test/*.go", "src/x/y/test/sub/a.go", false},
+		{"**/**/*.log", "a/b.log", true},
+		{"dir/file?.txt", "dir/file1.txt", true},
+		{"dir/[ab].txt", "dir/c.txt", false},
+	}
+
+	for _, tt := range tests {
+		if got := matchGlob(tt.pattern, tt.path); got != tt.want {
+			t.Errorf("matchGlob(%q, %q) = %v, want %v", tt.pattern, tt.path, got, tt.want)
+		}
+	}
+}
+
+func TestValidatePatterns(t *testing.T) {
+	if err := validatePatterns([]string{"**/*.go", "a/[bc]/d"}); err != nil {
+		t.Errorf("Expected valid patterns, got %v", err)
+	}
+	if err := validatePatterns([]string{"a/[bc"}); err == nil {
+		t.Error("Expected error for malformed pattern")
+	}
+}
@@ -0,0 +1,32 @@
+package files
+
+// inodeKey identifies file data on a device
+type inodeKey struct {
+	dev uint64
+	ino uint64
+}
+
+// DetectHardLinks groups regular files that are hard links to the same data.
+// The result maps the first path of each group (in input order) to the other paths
+// sharing its (Dev, Ino), so the data can be stored once and the rest recorded as links.
+// Directories, symlinks and files with a single link are never grouped.
+func DetectHardLinks(files []FileInfo) map[string][]string {
+	primary := make(map[inodeKey]string)
+	links := make(map[string][]string)
+
+	for _, file := range files {
+		if !file.Mode.IsRegular() || file.Nlink < 2 || file.Ino == 0 {
+			continue
+		}
+
+		key := inodeKey{dev: file.Dev, ino: file.Ino}
+		first, seen := primary[key]
+		if !seen {
+			primary[key] = file.Path
+			continue
+		}
+		links[first] = append(links[first], file.Path)
+	}
+
+	return links
+}
@@ -0,0 +1,53 @@
+package files
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestDetectHardLinks(t *testing.T) {
+	root := t.TempDir()
+	original := filepath.Join(root, "a.txt")
+	link := filepath.Join(root, "sub", "b.txt")
+	createFiles(t, root, "a.txt", "sub/other.txt")
+	if err := os.Link(original, link); err != nil {
+		t.Skipf("Hard links not supported: %v", err)
+	}
+	if err := os.Symlink(original, filepath.Join(root, "symlink")); err != nil {
+		t.Fatalf("Failed to create symlink: %v", err)
+	}
+
+	items, err := ListRecursive(root)
+	if err != nil {
+		t.Fatalf("ListRecursive failed: %v", err)
+	}
+
+	byPath := indexByPath(items)
+	if byPath[original].Nlink != 2 || byPath[original].Ino != byPath[link].Ino {
+		t.Fatalf("Expected shared inode with 2 links, got %+v and %+v", byPath[original], byPath[link])
+	}
+
+	groups := DetectHardLinks(items)
+	if len(groups) != 1 {
+		t.Fatalf("Expected 1 hard link group, got %v", groups)
+	}
+	if paths := groups[original]; len(paths) != 1 || paths[0] != link {
+		t.Errorf("Expected %s to be linked from %s, got %v", link, original, groups)
+	}
+}
+
+func TestDetectHardLinksIgnoresDirsAndSymlinks(t *testing.T) {
+	items := []FileInfo{
+		{Path: "/a", Mode: os.ModeDir, Dev: 1, Ino: 10, Nlink: 3},
+		{Path: "/a/.", Mode: os.ModeDir, Dev: 1, Ino: 10, Nlink: 3},
+		{Path: "/l1", Mode: os.ModeSymlink, Dev: 1, Ino: 20, Nlink: 2},
+		{Path: "/l2", Mode: os.ModeSymlink, Dev: 1, Ino: 20, Nlink: 2},
+		{Path: "/f1", Dev: 1, Ino: 30, Nlink: 2},
+		{Path: "/f2", Dev: 2, Ino: 30, Nlink: 2}, // Same inode on another device
+	}
+
+	if groups := DetectHardLinks(items); len(groups) != 0 {
+		t.Errorf("Expected no groups, got %v", groups)
+	}
+}
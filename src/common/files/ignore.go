@@ -0,0 +1,105 @@
+package files
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// ignoreRule is one pattern of an ignore file, see ScanOptions.IgnoreFile
+type ignoreRule struct {
+	dir     string // Directory holding the ignore file, the pattern is relative to it
+	pattern string // Glob pattern, see matchGlob
+	negate  bool   // Re-includes what earlier rules excluded
+	dirOnly bool   // Written with a trailing slash, matches directories only
+}
+
+// readIgnoreFile returns the rules of the ignore file called name in dir, none when there is no such file
+func readIgnoreFile(dir, name string) ([]ignoreRule, error) {
+	f, err := os.Open(filepath.Join(dir, name))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	rules, err := parseIgnoreRules(dir, f)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", f.Name(), err)
+	}
+	return rules, nil
+}
+
+// parseIgnoreRules reads rules in gitignore syntax: one pattern per line, blank lines and lines
+// starting with # are skipped, ! negates a pattern and a trailing slash restricts it to directories.
+// A pattern with a slash at its start or in the middle is relative to dir, one without
+// matches at any depth below it. A backslash escapes a leading # or !.
+func parseIgnoreRules(dir string, r io.Reader) ([]ignoreRule, error) {
+	var rules []ignoreRule
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimRight(scanner.Text(), " \t\r")
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		rule := ignoreRule{dir: dir}
+		if strings.HasPrefix(text, "!") {
+			rule.negate = true
+			text = text[1:]
+		} else if strings.HasPrefix(text, `\#`) || strings.HasPrefix(text, `\!`) {
+			text = text[1:]
+		}
+		if strings.HasSuffix(text, "/") {
+			rule.dirOnly = true
+			text = strings.TrimRight(text, "/")
+		}
+		if strings.Contains(text, "/") {
+			text = strings.TrimPrefix(text, "/")
+		} else {
+			text = "**/" + text
+		}
+		if text == "" || text == "**/" {
+			continue
+		}
+		if err := validatePatterns([]string{text}); err != nil {
+			return nil, fmt.Errorf("line %d: %w", line, err)
+		}
+		rule.pattern = text
+		rules = append(rules, rule)
+	}
+	return rules, scanner.Err()
+}
+
+// layerIgnoreRules returns the rules of a directory: those of its parent followed by its own,
+// which take precedence. The parent's rules are left as they are.
+func layerIgnoreRules(parent, own []ignoreRule) []ignoreRule {
+	if len(own) == 0 {
+		return parent
+	}
+	return append(slices.Clip(parent), own...)
+}
+
+// ignored reports whether rules exclude path, the last rule matching it deciding
+func ignored(rules []ignoreRule, path string, isDir bool) bool {
+	excluded := false
+	for _, rule := range rules {
+		if rule.dirOnly && !isDir {
+			continue
+		}
+		rel, err := filepath.Rel(rule.dir, path)
+		if err != nil {
+			continue
+		}
+		if matchGlob(rule.pattern, filepath.ToSlash(rel)) {
+			excluded = !rule.negate
+		}
+	}
+	return excluded
+}
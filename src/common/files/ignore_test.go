@@ -0,0 +1,111 @@
+package files
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// writeIgnoreFile writes the lines of a .backupignore in dir below root
+func writeIgnoreFile(t *testing.T, root, dir string, lines ...string) {
+	t.Helper()
+	path := filepath.Join(root, dir, ".backupignore")
+	if err := os.WriteFile(path, []byte(strings.Join(lines, "\n")+"\n"), 0644); err != nil {
+		t.Fatalf("Failed to write %s: %v", path, err)
+	}
+}
+
+func TestScanIgnoreFiles(t *testing.T) {
+	root := t.TempDir()
+	createFiles(t, root,
+		"notes.txt",
+		"debug.log",
+		"build/out.bin",
+		"build/keep.txt",
+		"src/main.go",
+		"src/trace.log",
+		"src/build/generated.go",
+		"src/vendor/lib.go",
+		"src/docs/important.log",
+		"src/docs/build.txt",
+		"other/build",
+		"other/tmp/scratch.txt",
+	)
+	writeIgnoreFile(t, root, ".",
+		"# Logs and build output anywhere",
+		"*.log",
+		"build/",
+		"",
+		"/other/tmp",
+	)
+	// Negation in a child overrides the parent, anchored patterns are relative to their directory
+	writeIgnoreFile(t, root, "src",
+		"/vendor",
+		"!docs/important.log",
+	)
+	// Rules inside a pruned directory are never read, nothing in it comes back
+	writeIgnoreFile(t, root, "build", "!keep.txt")
+
+	items, _, err := Scan(root, ScanOptions{IgnoreFile: ".backupignore", Excludes: []string{"notes.txt"}})
+	if err != nil {
+		t.Fatalf("Scan failed: %v", err)
+	}
+	var got []string
+	for path := range relPaths(t, root, items) {
+		got = append(got, path)
+	}
+	sort.Strings(got)
+	want := []string{
+		".",
+		".backupignore",
+		"other",
+		"other/build", // A file, the pattern with a trailing slash only matches directories
+		"src",
+		"src/.backupignore",
+		"src/docs",
+		"src/docs/build.txt",
+		"src/docs/important.log",
+		"src/main.go",
+	}
+	if strings.Join(got, " ") != strings.Join(want, " ") {
+		t.Errorf("Scanned %v\nexpected %v", got, want)
+	}
+
+	// Without an ignore file name the rules aren't read
+	items, _, err = Scan(root, ScanOptions{})
+	if err != nil {
+		t.Fatalf("Scan failed: %v", err)
+	}
+	if got := relPaths(t, root, items); !got["build/out.bin"] || !got["src/trace.log"] {
+		t.Error("Expected ignore files to be disregarded when no name is set")
+	}
+}
+
+func TestParseIgnoreRules(t *testing.T) {
+	rules, err := parseIgnoreRules("/data", strings.NewReader("# comment\n\n*.tmp  \n!keep.tmp\ncache/\n/top\nsub/*.o\n\\#hash\n"))
+	if err != nil {
+		t.Fatalf("parseIgnoreRules failed: %v", err)
+	}
+	want := []ignoreRule{
+		{dir: "/data", pattern: "**/*.tmp"},
+		{dir: "/data", pattern: "**/keep.tmp", negate: true},
+		{dir: "/data", pattern: "**/cache", dirOnly: true},
+		{dir: "/data", pattern: "top"},
+		{dir: "/data", pattern: "sub/*.o"},
+		{dir: "/data", pattern: "**/#hash"},
+	}
+	if len(rules) != len(want) {
+		t.Fatalf("Got %d rules %+v, expected %d", len(rules), rules, len(want))
+	}
+	for i := range want {
+		if rules[i] != want[i] {
+			t.Errorf("Rule %d = %+v, expected %+v", i, rules[i], want[i])
+		}
+	}
+
+	if _, err := parseIgnoreRules("/data", strings.NewReader("ok\n[bad\n")); err == nil || !strings.Contains(err.Error(), "line 2") {
+		t.Errorf("Expected an error naming line 2, got %v", err)
+	}
+}
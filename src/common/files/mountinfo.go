@@ -0,0 +1,115 @@
+package files
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// FSTypeBind is the pseudo filesystem type matching bind mounts, whatever their real type
+const FSTypeBind = "bind"
+
+// mountInfoPath is the mount table read when skipping filesystem types, replaceable in tests
+var mountInfoPath = "/proc/self/mountinfo"
+
+// MountInfo describes one mount from /proc/self/mountinfo
+type MountInfo struct {
+	MountPoint string // Where the filesystem is mounted
+	Root       string // Directory of the filesystem exposed at MountPoint
+	FSType     string // Filesystem type, e.g. ext4, overlay, tmpfs
+	Source     string // Device or other mount source
+}
+
+// IsBind reports whether the mount exposes a subdirectory of its filesystem, as bind mounts do
+func (m MountInfo) IsBind() bool {
+	return m.Root != "/"
+}
+
+// ReadMounts returns the mounts visible to the current process
+func ReadMounts() ([]MountInfo, error) {
+	file, err := os.Open(mountInfoPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read mount table: %w", err)
+	}
+	defer file.Close()
+	return parseMountInfo(file)
+}
+
+// parseMountInfo parses the mountinfo format described in proc(5):
+// id parent major:minor root mountpoint options [optional...] - fstype source superoptions
+func parseMountInfo(r io.Reader) ([]MountInfo, error) {
+	var mounts []MountInfo
+	scanner := bufio.NewScanner(r)
+	lineNum := 0
+	for scanner.Scan() {
+		lineNum++
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			continue
+		}
+
+		separator := -1
+		for i := 6; i < len(fields); i++ {
+			if fields[i] == "-" {
+				separator = i
+				break
+			}
+		}
+		if len(fields) < 5 || separator < 0 || separator+2 >= len(fields) {
+			return nil, fmt.Errorf("invalid mountinfo line %d: %s", lineNum, scanner.Text())
+		}
+
+		mounts = append(mounts, MountInfo{
+			Root:       unescapeMountPath(fields[3]),
+			MountPoint: unescapeMountPath(fields[4]),
+			FSType:     fields[separator+1],
+			Source:     unescapeMountPath(fields[separator+2]),
+		})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read mount table: %w", err)
+	}
+	return mounts, nil
+}
+
+// unescapeMountPath decodes the octal escapes (\040 for space etc.) used in mountinfo paths
+func unescapeMountPath(s string) string {
+	if !strings.Contains(s, `\`) {
+		return s
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+3 < len(s) {
+			if code, err := strconv.ParseUint(s[i+1:i+4], 8, 8); err == nil {
+				b.WriteByte(byte(code))
+				i += 3
+				continue
+			}
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
+
+// skippedMountPoints returns the mount points whose filesystem type is in fsTypes, mapped to that type
+// A bind mount is also matched by FSTypeBind
+func skippedMountPoints(mounts []MountInfo, fsTypes []string) map[string]string {
+	skip := make(map[string]bool, len(fsTypes))
+	for _, fsType := range fsTypes {
+		skip[fsType] = true
+	}
+
+	result := make(map[string]string)
+	for _, mount := range mounts {
+		switch {
+		case skip[mount.FSType]:
+			result[mount.MountPoint] = mount.FSType
+		case skip[FSTypeBind] && mount.IsBind():
+			result[mount.MountPoint] = FSTypeBind
+		}
+	}
+	return result
+}
@@ -0,0 +1,165 @@
+package files
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const mountInfoFixture = `22 1 8:1 / / rw,relatime shared:1 - ext4 /dev/sda1 rw
+23 22 0:21 / /proc rw,nosuid,nodev,noexec,relatime shared:12 - proc proc rw
+24 22 0:22 / /sys rw,nosuid,nodev,noexec,relatime shared:7 - sysfs sysfs rw
+25 22 0:23 / /run rw,nosuid,nodev - tmpfs tmpfs rw,mode=755
+26 22 0:45 / /var/lib/docker/overlay2/abc/merged rw,relatime - overlay overlay rw,lowerdir=/l,upperdir=/u,workdir=/w
+27 22 8:1 /srv/data /mnt/my\040data rw,relatime shared:1 - ext4 /dev/sda1 rw
+`
+
+func TestParseMountInfo(t *testing.T) {
+	mounts, err := parseMountInfo(strings.NewReader(mountInfoFixture))
+	if err != nil {
+		t.Fatalf("Failed to parse mountinfo: %v", err)
+	}
+	if len(mounts) != 6 {
+		t.Fatalf("Expected 6 mounts, got %d", len(mounts))
+	}
+
+	expected := []MountInfo{
+		{MountPoint: "/", Root: "/", FSType: "ext4", Source: "/dev/sda1"},
+		{MountPoint: "/proc", Root: "/", FSType: "proc", Source: "proc"},
+		{MountPoint: "/sys", Root: "/", FSType: "sysfs", Source: "sysfs"},
+		{MountPoint: "/run", Root: "/", FSType: "tmpfs", Source: "tmpfs"},
+		{MountPoint: "/var/lib/docker/overlay2/abc/merged", Root: "/", FSType: "overlay", Source: "overlay"},
+		{MountPoint: "/mnt/my data", Root: "/srv/data", FSType: "ext4", Source: "/dev/sda1"},
+	}
+	for i, want := range expected {
+		if mounts[i] != want {
+			t.Errorf("Mount %d: expected %+v, got %+v", i, want, mounts[i])
+		}
+	}
+
+	if mounts[0].IsBind() || !mounts[5].IsBind() {
+		t.Error("Only the mount exposing /srv/data should be a bind mount")
+	}
+}
+
+func TestParseMountInfoInvalid(t *testing.T) {
+	if _, err := parseMountInfo(strings.NewReader("22 1 8:1 / / rw,relatime ext4 /dev/sda1 rw\n")); err == nil {
+		t.Error("Expected error for line without separator")
+	}
+}
+
+// useMountTable points the scanner at a mountinfo file with the given mounts until the test ends
+// Each mount is "mountpoint root fstype"
+func useMountTable(t *testing.T, mounts ...[3]string) {
+	t.Helper()
+	var b strings.Builder
+	for i, m := range mounts {
+		mountPoint := strings.ReplaceAll(m[0], " ", `\040`)
+		fmt.Fprintf(&b, "%d 1 0:%d %s %s rw,relatime - %s source rw\n", 30+i, 50+i, m[1], mountPoint, m[2])
+	}
+
+	path := filepath.Join(t.TempDir(), "mountinfo")
+	if err := os.WriteFile(path, []byte(b.String()), 0644); err != nil {
+		t.Fatalf("Failed to write mountinfo: %v", err)
+	}
+
+	original := mountInfoPath
+	mountInfoPath = path
+	t.Cleanup(func() { mountInfoPath = original })
+}
+
+func TestScanSkipFSTypes(t *testing.T) {
+	root := t.TempDir()
+	createFiles(t, root,
+		"disk/keep.txt",
+		"container rootfs/layer.txt",
+		"run/tmp.txt",
+		"proc/status",
+		"shared/bound.txt",
+		"plain/file.txt",
+	)
+
+	useMountTable(t,
+		[3]string{"/", "/", "ext4"},
+		[3]string{filepath.Join(root, "disk"), "/", "ext4"},
+		[3]string{filepath.Join(root, "container rootfs"), "/", "overlay"},
+		[3]string{filepath.Join(root, "run"), "/", "tmpfs"},
+		[3]string{filepath.Join(root, "proc"), "/", "proc"},
+		[3]string{filepath.Join(root, "shared"), "/exported", "ext4"},
+	)
+
+	tests := []struct {
+		name    string
+		fsTypes []string
+		want    []string
+	}{
+		{
+			name:    "no types skipped",
+			fsTypes: nil,
+			want: []string{".", "container rootfs", "container rootfs/layer.txt", "disk", "disk/keep.txt",
+				"plain", "plain/file.txt", "proc", "proc/status", "run", "run/tmp.txt", "shared", "shared/bound.txt"},
+		},
+		{
+			name:    "pseudo and overlay filesystems",
+			fsTypes: []string{"overlay", "tmpfs", "proc", "sysfs"},
+			want:    []string{".", "disk", "disk/keep.txt", "plain", "plain/file.txt", "shared", "shared/bound.txt"},
+		},
+		{
+			name:    "bind mounts",
+			fsTypes: []string{FSTypeBind},
+			want: []string{".", "container rootfs", "container rootfs/layer.txt", "disk", "disk/keep.txt",
+				"plain", "plain/file.txt", "proc", "proc/status", "run", "run/tmp.txt"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			items, _, err := Scan(root, ScanOptions{SkipFSTypes: tt.fsTypes})
+			if err != nil {
+				t.Fatalf("Scan failed: %v", err)
+			}
+			got := relPaths(t, root, items)
+			if len(got) != len(tt.want) {
+				t.Errorf("Expected %d paths, got %v", len(tt.want), got)
+			}
+			for _, path := range tt.want {
+				if !got[path] {
+					t.Errorf("Expected %s in scan result", path)
+				}
+			}
+		})
+	}
+}
+
+func TestScanSkipFSTypesKeepsSourceMount(t *testing.T) {
+	root := t.TempDir()
+	createFiles(t, root, "file.txt")
+	useMountTable(t, [3]string{root, "/", "tmpfs"})
+
+	items, _, err := Scan(root, ScanOptions{SkipFSTypes: []string{"tmpfs"}})
+	if err != nil {
+		t.Fatalf("Scan failed: %v", err)
+	}
+	if len(items) != 2 {
+		t.Errorf("Expected source mount to be scanned, got %d items", len(items))
+	}
+}
+
+func TestScanSkipFSTypesWithoutMountTable(t *testing.T) {
+	original := mountInfoPath
+	mountInfoPath = filepath.Join(t.TempDir(), "missing")
+	defer func() { mountInfoPath = original }()
+
+	// The scan goes on without skipping any mount
+	root := t.TempDir()
+	createFiles(t, root, "run/tmp.txt", "file.txt")
+	items, _, err := Scan(root, ScanOptions{SkipFSTypes: []string{"tmpfs"}})
+	if err != nil {
+		t.Fatalf("Scan failed without a mount table: %v", err)
+	}
+	if got := relPaths(t, root, items); len(got) != 4 || !got["run/tmp.txt"] {
+		t.Errorf("Scanned %v, expected every entry", got)
+	}
+}
@@ -1,39 +1,469 @@
 package files
 
 import (
+	"context"
 	"fmt"
+	"hash/fnv"
 	"io/fs"
+	"log/slog"
 	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
 
 	"os"
 
 	"github.com/alex-sviridov/miniprotector/common"
+	"github.com/alex-sviridov/miniprotector/common/logging"
 )
 
+// ScanError describes a file or directory that could not be scanned
+type ScanError struct {
+	Path string
+	Err  error
+}
+
+func (e ScanError) Error() string {
+	return fmt.Sprintf("%s: %v", e.Path, e.Err)
+}
+
+func (e ScanError) Unwrap() error {
+	return e.Err
+}
+
+// getFileInfoFn is the metadata reader used by the walk, replaceable in tests
+var getFileInfoFn = getFileInfo
+
+// scanProgressInterval is the least time between two ScanOptions.Progress calls, replaceable in tests
+var scanProgressInterval = 5 * time.Second
+
+// ScanOptions controls how a directory tree is walked
+type ScanOptions struct {
+	// SkipErrors collects unreadable paths as ScanError instead of failing the walk
+	SkipErrors bool
+	// Excludes are glob patterns matched against paths relative to the source path.
+	// Excluded directories are not descended into.
+	Excludes []string
+	// Includes, when non-empty, is an allowlist of glob patterns applied after Excludes.
+	// It filters files only, directories are still walked to find included files.
+	Includes []string
+	// SkipFSTypes prunes mount points below the source path whose filesystem type is listed,
+	// e.g. overlay, tmpfs, proc, sysfs, or FSTypeBind for bind mounts. Mounts are read from
+	// /proc/self/mountinfo: where it can't be read, as on platforms other than Linux, nothing is pruned.
+	SkipFSTypes []string
+	// RecordTimings measures how long reading each file's metadata takes, see FileInfo.StatDuration
+	RecordTimings bool
+	// ExcludeMarker skips directories below the source path containing a file with this name,
+	// such as .nobackup. Empty disables the check.
+	ExcludeMarker string
+	// IgnoreFile names the files holding gitignore-style rules, such as .backupignore, read in each
+	// directory walked. Their patterns are relative to their directory and apply below it, rules of
+	// deeper directories taking precedence, and an ignored directory is not descended into.
+	// They apply on top of Excludes. Empty disables them.
+	IgnoreFile string
+	// FollowSymlinks lists symlinks to directories as the directory they point to, and walks it.
+	// Directories already walked aren't walked again through a symlink, which breaks cycles.
+	// Other symlinks are listed as symlinks.
+	FollowSymlinks bool
+	// MaxDepth limits the walk to entries at most MaxDepth levels below the source path:
+	// directories at that level are listed without their content. 0 means no limit.
+	MaxDepth int
+	// OneFileSystem stays on the filesystem of the source path, like tar --one-file-system:
+	// directories on another device are listed but not descended into
+	OneFileSystem bool
+	// Progress, when set, is called during the walk with the number of entries found so far and
+	// the path just read, at most once per scanProgressInterval, and once more when the walk ends
+	Progress func(scanned int, current string)
+}
+
 // ListRecursive traverses directory tree and returns file information
 func ListRecursive(sourcePath string) ([]FileInfo, error) {
+	items, _, err := Scan(sourcePath, ScanOptions{})
+	return items, err
+}
+
+// ListRecursiveSkipErrors traverses directory tree like ListRecursive, but files and
+// directories that can't be read are collected as ScanError and the walk continues.
+// The returned error is non-nil only when the source path itself can't be scanned.
+func ListRecursiveSkipErrors(sourcePath string) ([]FileInfo, []ScanError, error) {
+	return Scan(sourcePath, ScanOptions{SkipErrors: true})
+}
+
+// ListRecursiveWithProgress traverses directory tree like ListRecursive, reporting the entries
+// found so far to progress periodically and once at the end, see ScanOptions.Progress
+func ListRecursiveWithProgress(sourcePath string, progress func(scanned int, current string)) ([]FileInfo, error) {
+	items, _, err := Scan(sourcePath, ScanOptions{Progress: progress})
+	return items, err
+}
+
+// ListRecursiveOneFS traverses directory tree like ListRecursive without crossing into
+// other filesystems, see ScanOptions.OneFileSystem
+func ListRecursiveOneFS(sourcePath string) ([]FileInfo, error) {
+	items, _, err := Scan(sourcePath, ScanOptions{OneFileSystem: true})
+	return items, err
+}
+
+// ListRecursiveFiltered traverses directory tree returning only paths allowed by
+// the exclude and include glob patterns, see ScanOptions
+func ListRecursiveFiltered(sourcePath string, excludes, includes []string) ([]FileInfo, error) {
+	items, _, err := Scan(sourcePath, ScanOptions{Excludes: excludes, Includes: includes})
+	return items, err
+}
+
+// ListRecursiveCtx traverses directory tree like ListRecursive, stopping with ctx's error once ctx is done
+func ListRecursiveCtx(ctx context.Context, sourcePath string) ([]FileInfo, error) {
+	items, _, err := ScanContext(ctx, sourcePath, ScanOptions{})
+	return items, err
+}
+
+// Scan walks sourcePath according to the options and returns file information
+func Scan(sourcePath string, opts ScanOptions) ([]FileInfo, []ScanError, error) {
+	return ScanContext(context.Background(), sourcePath, opts)
+}
+
+// ScanContext is Scan checking ctx before each entry: once ctx is done the walk stops
+// and returns ctx's error, with the entries found until then. Skipped entries are logged
+// at debug level to the logger of ctx.
+func ScanContext(ctx context.Context, sourcePath string, opts ScanOptions) ([]FileInfo, []ScanError, error) {
+	logger := logging.GetLoggerFromContext(ctx)
 	if _, err := os.Stat(sourcePath); os.IsNotExist(err) {
-		return nil, fmt.Errorf("source path does not exist: %s", sourcePath)
+		return nil, nil, fmt.Errorf("source path does not exist: %s", sourcePath)
+	}
+	if err := validatePatterns(opts.Excludes); err != nil {
+		return nil, nil, fmt.Errorf("invalid exclude: %w", err)
 	}
+	if err := validatePatterns(opts.Includes); err != nil {
+		return nil, nil, fmt.Errorf("invalid include: %w", err)
+	}
+
+	// Without a mount table, on platforms other than Linux or without /proc, no mount is skipped
+	var skipMounts map[string]string
+	if len(opts.SkipFSTypes) > 0 {
+		mounts, err := ReadMounts()
+		if err != nil {
+			logger.Debug("Not skipping filesystem types", "error", err)
+		} else {
+			skipMounts = skippedMountPoints(mounts, opts.SkipFSTypes)
+		}
+	}
+
 	var items []FileInfo
+	var scanErrors []ScanError
 	hostname := common.GetHostname()
+	var lastPath string
+	lastProgress := time.Now()
+	var rootDev uint64
+
+	// Rules of the ignore files applying to the content of each directory walked, by path
+	var ignores map[string][]ignoreRule
+	if opts.IgnoreFile != "" {
+		ignores = make(map[string][]ignoreRule)
+	}
+
+	// Directories already walked, so a followed symlink leading back to one isn't walked again
+	var visited map[dirKey]bool
+	if opts.FollowSymlinks {
+		visited = make(map[dirKey]bool)
+	}
 
-	err := filepath.WalkDir(sourcePath, func(path string, d fs.DirEntry, err error) error {
+	var visit fs.WalkDirFunc
+	visit = func(path string, d fs.DirEntry, err error) error {
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return ctxErr
+		}
 		if err != nil {
-			return fmt.Errorf("failed to walk dir %s: %w", sourcePath, err)
+			if !opts.SkipErrors || path == sourcePath {
+				return fmt.Errorf("failed to walk dir %s: %w", path, err)
+			}
+			scanErrors = append(scanErrors, ScanError{Path: path, Err: err})
+			return nil
 		}
 
-		fileInfo, err := getFileInfo(path)
-		fileInfo.Host = hostname
+		depth := 0
+		if path != sourcePath {
+			relPath, err := filepath.Rel(sourcePath, path)
+			if err != nil {
+				return fmt.Errorf("failed to get relative path %s: %w", path, err)
+			}
+			relPath = filepath.ToSlash(relPath)
+			depth = strings.Count(relPath, "/") + 1
+			if matchAny(opts.Excludes, relPath) {
+				if d.IsDir() {
+					return fs.SkipDir
+				}
+				return nil
+			}
+			if ignores != nil && ignored(ignores[filepath.Dir(path)], path, d.IsDir()) {
+				if d.IsDir() {
+					return fs.SkipDir
+				}
+				return nil
+			}
+			if len(opts.Includes) > 0 && !d.IsDir() && !matchAny(opts.Includes, relPath) {
+				return nil
+			}
+			if d.IsDir() && opts.ExcludeMarker != "" {
+				if _, err := os.Lstat(filepath.Join(path, opts.ExcludeMarker)); err == nil {
+					logger.Debug("Skipping directory with exclude marker", "path", path, "marker", opts.ExcludeMarker)
+					return fs.SkipDir
+				}
+			}
+			if d.IsDir() && len(skipMounts) > 0 {
+				absPath, err := filepath.Abs(path)
+				if err != nil {
+					return fmt.Errorf("failed to get absolute path %s: %w", path, err)
+				}
+				if fsType, ok := skipMounts[absPath]; ok {
+					logger.Debug("Skipping mount", "path", path, "fs_type", fsType)
+					return fs.SkipDir
+				}
+			}
+		}
+
+		var start time.Time
+		if opts.RecordTimings {
+			start = time.Now()
+		}
+		fileInfo, err := getFileInfoFn(path)
 		if err != nil {
-			return fmt.Errorf("failed to get file info %s: %w", path, err)
+			if !opts.SkipErrors || path == sourcePath {
+				return fmt.Errorf("failed to get file info %s: %w", path, err)
+			}
+			scanErrors = append(scanErrors, ScanError{Path: path, Err: err})
+			if d.IsDir() {
+				return fs.SkipDir
+			}
+			return nil
+		}
+
+		// A followed symlink to a directory is listed as that directory, under the link's path
+		followed := false
+		if opts.FollowSymlinks && fileInfo.Mode&fs.ModeSymlink != 0 {
+			if target, ok := followDirLink(path, visited, logger); ok {
+				fileInfo = target
+				followed = true
+			}
+		}
+		if opts.FollowSymlinks && fileInfo.Mode.IsDir() {
+			visited[newDirKey(path, fileInfo)] = true
+		}
+
+		for _, err := range fileInfo.skippedXattrs {
+			logger.Debug("Skipping unreadable extended attribute", "path", path, "error", err)
+		}
+
+		fileInfo.Host = hostname
+		if opts.RecordTimings {
+			fileInfo.statDuration = time.Since(start)
 		}
 
 		items = append(items, fileInfo)
+		if path == sourcePath {
+			rootDev = fileInfo.Dev
+		}
+		if opts.Progress != nil {
+			lastPath = path
+			if now := time.Now(); now.Sub(lastProgress) >= scanProgressInterval {
+				opts.Progress(len(items), path)
+				lastProgress = now
+			}
+		}
+
+		if !d.IsDir() && !followed {
+			return nil
+		}
+		// Directories past the depth limit or on another filesystem are listed, not descended into
+		if opts.MaxDepth > 0 && depth >= opts.MaxDepth {
+			logger.Debug("Skipping directory content past the maximum depth", "path", path, "max_depth", opts.MaxDepth)
+			return skipDir(d)
+		}
+		if opts.OneFileSystem && fileInfo.Dev != rootDev {
+			logger.Debug("Skipping other filesystem", "path", path)
+			return skipDir(d)
+		}
+		if ignores != nil {
+			rules, err := readIgnoreFile(path, opts.IgnoreFile)
+			if err != nil {
+				if !opts.SkipErrors {
+					return fmt.Errorf("failed to read ignore file: %w", err)
+				}
+				scanErrors = append(scanErrors, ScanError{Path: filepath.Join(path, opts.IgnoreFile), Err: err})
+			}
+			ignores[filepath.Clean(path)] = layerIgnoreRules(ignores[filepath.Dir(path)], rules)
+		}
+		if followed {
+			return walkDirLink(path, visit)
+		}
 		return nil
-	})
+	}
 
-	return items, err
+	err := filepath.WalkDir(sourcePath, visit)
+	if err == nil && opts.Progress != nil {
+		opts.Progress(len(items), lastPath)
+	}
+
+	return items, scanErrors, err
+}
+
+// skipDir is what a walk function returns to leave the content of entry d out
+func skipDir(d fs.DirEntry) error {
+	if d.IsDir() {
+		return fs.SkipDir
+	}
+	return nil
+}
+
+// dirKey identifies a directory by device and inode, or by its real path where
+// the platform doesn't report inodes
+type dirKey struct {
+	dev, ino uint64
+	path     string
+}
+
+func newDirKey(path string, info FileInfo) dirKey {
+	if info.Ino != 0 {
+		return dirKey{dev: info.Dev, ino: info.Ino}
+	}
+	real, err := filepath.EvalSymlinks(path)
+	if err != nil {
+		real = path
+	}
+	return dirKey{path: real}
+}
+
+// followDirLink returns the metadata of the directory the symlink at path points to,
+// with the link's path and name. It returns false, and the link stays a symlink,
+// when the link is broken, doesn't point to a directory, or points to one already visited.
+func followDirLink(path string, visited map[dirKey]bool, logger *slog.Logger) (FileInfo, bool) {
+	real, err := filepath.EvalSymlinks(path)
+	if err != nil {
+		return FileInfo{}, false
+	}
+	target, err := getFileInfoFn(real)
+	if err != nil || !target.Mode.IsDir() {
+		return FileInfo{}, false
+	}
+	if visited[newDirKey(real, target)] {
+		logger.Debug("Not following symlink to a directory already visited", "path", path, "target", real)
+		return FileInfo{}, false
+	}
+	target.Path = path
+	target.Name = filepath.Base(path)
+	return target, true
+}
+
+// walkDirLink walks the content of the directory behind the symlink at path, under the link's path
+func walkDirLink(path string, visit fs.WalkDirFunc) error {
+	entries, err := os.ReadDir(path)
+	if err != nil {
+		return visit(path, nil, err)
+	}
+	for _, entry := range entries {
+		if err := filepath.WalkDir(filepath.Join(path, entry.Name()), visit); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ListRecursiveParallel traverses directory tree using a pool of workers and returns file information.
+// Result order is not preserved. At most workers directories are open at the same time.
+func ListRecursiveParallel(sourcePath string, workers int) ([]FileInfo, error) {
+	if workers <= 0 {
+		return nil, fmt.Errorf("workers count must be positive, got: %d", workers)
+	}
+
+	if _, err := os.Stat(sourcePath); os.IsNotExist(err) {
+		return nil, fmt.Errorf("source path does not exist: %s", sourcePath)
+	}
+
+	rootInfo, err := getFileInfoFn(sourcePath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get file info %s: %w", sourcePath, err)
+	}
+	hostname := common.GetHostname()
+	rootInfo.Host = hostname
+
+	var (
+		wg       sync.WaitGroup
+		mu       sync.Mutex
+		items    = []FileInfo{rootInfo}
+		firstErr error
+	)
+	// Each worker holds a slot while its directory is open
+	slots := make(chan struct{}, workers)
+
+	failed := func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return firstErr != nil
+	}
+
+	var scanDir func(dir string)
+	scanDir = func(dir string) {
+		defer wg.Done()
+		if failed() {
+			return
+		}
+
+		slots <- struct{}{}
+		found, subdirs, err := readDirInfo(dir, hostname)
+		<-slots
+
+		mu.Lock()
+		if err != nil {
+			if firstErr == nil {
+				firstErr = err
+			}
+			mu.Unlock()
+			return
+		}
+		items = append(items, found...)
+		mu.Unlock()
+
+		for _, subdir := range subdirs {
+			wg.Add(1)
+			go scanDir(subdir)
+		}
+	}
+
+	if rootInfo.Mode.IsDir() {
+		wg.Add(1)
+		go scanDir(sourcePath)
+	}
+	wg.Wait()
+
+	if firstErr != nil {
+		return nil, firstErr
+	}
+	return items, nil
+}
+
+// readDirInfo returns file information for all entries of a single directory
+// together with the paths of its subdirectories
+func readDirInfo(dir string, hostname string) ([]FileInfo, []string, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to walk dir %s: %w", dir, err)
+	}
+
+	items := make([]FileInfo, 0, len(entries))
+	var subdirs []string
+	for _, entry := range entries {
+		path := filepath.Join(dir, entry.Name())
+		fileInfo, err := getFileInfoFn(path)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to get file info %s: %w", path, err)
+		}
+		fileInfo.Host = hostname
+		items = append(items, fileInfo)
+
+		if entry.IsDir() {
+			subdirs = append(subdirs, path)
+		}
+	}
+	return items, subdirs, nil
 }
 
 // SplitByStreams divides files into the specified number of streams for parallel processing
@@ -60,3 +490,118 @@ func SplitByStreams(files []FileInfo, streams int) [][]FileInfo {
 
 	return result
 }
+
+// SplitByStreamsStable divides files into the specified number of streams by a hash of their path,
+// so a file lands in the same stream on every run with the same number of streams, whatever order
+// it was scanned in and whatever other files came and went. Files are sorted by path within a stream.
+func SplitByStreamsStable(files []FileInfo, streams int) [][]FileInfo {
+	if streams <= 0 {
+		return nil
+	}
+
+	result := make([][]FileInfo, streams)
+	for _, file := range files {
+		stream := pathStream(file.Path, streams)
+		result[stream] = append(result[stream], file)
+	}
+	for _, stream := range result {
+		sort.Slice(stream, func(i, j int) bool {
+			return stream[i].Path < stream[j].Path
+		})
+	}
+
+	return result
+}
+
+// pathStream returns the stream of a path out of streams, by its FNV-1a hash
+func pathStream(path string, streams int) int {
+	h := fnv.New64a()
+	h.Write([]byte(path))
+	return int(h.Sum64() % uint64(streams))
+}
+
+// SplitBySize divides files into the specified number of streams with roughly equal total bytes.
+// Files are taken largest first and each goes to the stream with the smallest total so far.
+func SplitBySize(files []FileInfo, streams int) [][]FileInfo {
+	if streams <= 0 {
+		return nil
+	}
+
+	sorted := make([]FileInfo, len(files))
+	copy(sorted, files)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].Size > sorted[j].Size
+	})
+
+	result := make([][]FileInfo, streams)
+	totals := make([]int64, streams)
+	for _, file := range sorted {
+		smallest := 0
+		for i := 1; i < streams; i++ {
+			if totals[i] < totals[smallest] {
+				smallest = i
+			}
+		}
+		result[smallest] = append(result[smallest], file)
+		totals[smallest] += file.Size
+	}
+
+	return result
+}
+
+// SplitByCategory divides files into streams by the category of their extension, so that
+// each category goes to its own streams. categories maps lowercase extensions without the dot
+// to category names. Categories are ordered by name, followed by one for all other files,
+// and category i owns the streams whose index modulo the number of categories is i;
+// with fewer streams than categories, category i shares stream i modulo streams.
+// Files of a category are dealt round-robin over its streams.
+func SplitByCategory(files []FileInfo, streams int, categories map[string]string) [][]FileInfo {
+	if streams <= 0 {
+		return nil
+	}
+
+	names := make([]string, 0, len(categories))
+	index := make(map[string]int)
+	for _, name := range categories {
+		if _, ok := index[name]; !ok {
+			index[name] = 0
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	for i, name := range names {
+		index[name] = i
+	}
+	groups := len(names) + 1 // The last group holds files of unmapped extensions
+
+	// Streams owned by each group
+	owned := make([][]int, groups)
+	if streams >= groups {
+		for s := 0; s < streams; s++ {
+			owned[s%groups] = append(owned[s%groups], s)
+		}
+	} else {
+		for g := range owned {
+			owned[g] = []int{g % streams}
+		}
+	}
+
+	result := make([][]FileInfo, streams)
+	next := make([]int, groups)
+	for _, file := range files {
+		group := len(names)
+		if name, ok := categories[FileExtension(file.Path)]; ok {
+			group = index[name]
+		}
+		stream := owned[group][next[group]%len(owned[group])]
+		next[group]++
+		result[stream] = append(result[stream], file)
+	}
+
+	return result
+}
+
+// FileExtension returns the lowercase extension of a path without the dot, empty if it has none
+func FileExtension(path string) string {
+	return strings.ToLower(strings.TrimPrefix(filepath.Ext(path), "."))
+}
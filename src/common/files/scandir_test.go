@@ -0,0 +1,902 @@
+package files
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alex-sviridov/miniprotector/common/logging"
+)
+
+// createTestTree creates dirs*subdirs directories with filesPerDir files each
+func createTestTree(tb testing.TB, root string, dirs, subdirs, filesPerDir int) int {
+	count := 0
+	for i := 0; i < dirs; i++ {
+		for j := 0; j < subdirs; j++ {
+			dir := filepath.Join(root, fmt.Sprintf("dir_%d", i), fmt.Sprintf("sub_%d", j))
+			if err := os.MkdirAll(dir, 0755); err != nil {
+				tb.Fatalf("Failed to create dir: %v", err)
+			}
+			for k := 0; k < filesPerDir; k++ {
+				path := filepath.Join(dir, fmt.Sprintf("file_%d.txt", k))
+				if err := os.WriteFile(path, []byte(path), 0644); err != nil {
+					tb.Fatalf("Failed to create file: %v", err)
+				}
+				count++
+			}
+		}
+	}
+	return count
+}
+
+// indexByPath maps scan results by their path
+func indexByPath(items []FileInfo) map[string]FileInfo {
+	result := make(map[string]FileInfo, len(items))
+	for _, item := range items {
+		result[item.Path] = item
+	}
+	return result
+}
+
+func TestListRecursiveParallel(t *testing.T) {
+	root := t.TempDir()
+	createTestTree(t, root, 5, 4, 10)
+	if err := os.Symlink(filepath.Join(root, "dir_0"), filepath.Join(root, "link")); err != nil {
+		t.Fatalf("Failed to create symlink: %v", err)
+	}
+
+	// First scan settles directory access times
+	if _, err := ListRecursive(root); err != nil {
+		t.Fatalf("Failed to warm up: %v", err)
+	}
+
+	serial, err := ListRecursive(root)
+	if err != nil {
+		t.Fatalf("ListRecursive failed: %v", err)
+	}
+
+	for _, workers := range []int{1, 4, 16} {
+		parallel, err := ListRecursiveParallel(root, workers)
+		if err != nil {
+			t.Fatalf("ListRecursiveParallel(%d) failed: %v", workers, err)
+		}
+
+		if len(parallel) != len(serial) {
+			t.Fatalf("Expected %d items with %d workers, got %d", len(serial), workers, len(parallel))
+		}
+
+		expected := indexByPath(serial)
+		for path, item := range indexByPath(parallel) {
+			if !reflect.DeepEqual(expected[path], item) {
+				t.Errorf("Metadata mismatch for %s with %d workers", path, workers)
+			}
+		}
+	}
+}
+
+func TestListRecursiveParallelErrors(t *testing.T) {
+	if _, err := ListRecursiveParallel(filepath.Join(t.TempDir(), "missing"), 4); err == nil {
+		t.Error("Expected error for non-existent source path")
+	}
+
+	if _, err := ListRecursiveParallel(t.TempDir(), 0); err == nil {
+		t.Error("Expected error for zero workers")
+	}
+}
+
+// setupBenchTree creates a synthetic 100k-file tree for scan benchmarks
+func setupBenchTree(b *testing.B) string {
+	b.Helper()
+	root := b.TempDir()
+	createTestTree(b, root, 100, 10, 100)
+	return root
+}
+
+func BenchmarkListRecursive(b *testing.B) {
+	root := setupBenchTree(b)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := ListRecursive(root); err != nil {
+			b.Fatalf("ListRecursive failed: %v", err)
+		}
+	}
+}
+
+func BenchmarkListRecursiveParallel(b *testing.B) {
+	root := setupBenchTree(b)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := ListRecursiveParallel(root, 16); err != nil {
+			b.Fatalf("ListRecursiveParallel failed: %v", err)
+		}
+	}
+}
+
+func TestListRecursiveSkipErrors(t *testing.T) {
+	root := t.TempDir()
+	total := createTestTree(t, root, 2, 2, 3)
+	badFile := filepath.Join(root, "dir_0", "sub_0", "file_1.txt")
+	badDir := filepath.Join(root, "dir_1", "sub_1")
+
+	// Fail metadata reads for one file and one directory
+	original := getFileInfoFn
+	getFileInfoFn = func(path string) (FileInfo, error) {
+		if path == badFile || path == badDir {
+			return FileInfo{}, os.ErrPermission
+		}
+		return original(path)
+	}
+	defer func() { getFileInfoFn = original }()
+
+	if _, err := ListRecursive(root); err == nil {
+		t.Error("Expected ListRecursive to fail on unreadable file")
+	}
+
+	items, scanErrors, err := ListRecursiveSkipErrors(root)
+	if err != nil {
+		t.Fatalf("Expected no fatal error, got %v", err)
+	}
+
+	if len(scanErrors) != 2 {
+		t.Fatalf("Expected 2 scan errors, got %d", len(scanErrors))
+	}
+	for _, scanErr := range scanErrors {
+		if scanErr.Path != badFile && scanErr.Path != badDir {
+			t.Errorf("Unexpected scan error path %s", scanErr.Path)
+		}
+		if !errors.Is(scanErr, os.ErrPermission) {
+			t.Errorf("Expected permission error, got %v", scanErr.Err)
+		}
+	}
+
+	// root + 2 dirs + 4 subdirs + files, minus the bad file, the bad dir and its 3 files
+	expected := 1 + 2 + 4 + total - 1 - 1 - 3
+	if len(items) != expected {
+		t.Errorf("Expected %d items, got %d", expected, len(items))
+	}
+	for _, item := range items {
+		if item.Path == badFile || filepath.Dir(item.Path) == badDir {
+			t.Errorf("Unreadable path %s should not be returned", item.Path)
+		}
+	}
+}
+
+func TestListRecursiveSkipErrorsUnreadableDir(t *testing.T) {
+	if os.Geteuid() == 0 {
+		t.Skip("Permissions are not enforced for root")
+	}
+
+	root := t.TempDir()
+	createTestTree(t, root, 2, 1, 2)
+	locked := filepath.Join(root, "dir_0")
+	if err := os.Chmod(locked, 0); err != nil {
+		t.Fatalf("Failed to chmod: %v", err)
+	}
+	defer os.Chmod(locked, 0755)
+
+	items, scanErrors, err := ListRecursiveSkipErrors(root)
+	if err != nil {
+		t.Fatalf("Expected no fatal error, got %v", err)
+	}
+	if len(scanErrors) != 1 || scanErrors[0].Path != locked {
+		t.Fatalf("Expected one scan error for %s, got %v", locked, scanErrors)
+	}
+
+	// root, both dirs and the readable subtree are still returned
+	if len(items) != 1+2+1+2 {
+		t.Errorf("Expected 6 items, got %d", len(items))
+	}
+}
+
+func TestListRecursiveSkipErrorsRoot(t *testing.T) {
+	root := t.TempDir()
+
+	original := getFileInfoFn
+	getFileInfoFn = func(path string) (FileInfo, error) {
+		return FileInfo{}, os.ErrPermission
+	}
+	defer func() { getFileInfoFn = original }()
+
+	if _, _, err := ListRecursiveSkipErrors(root); err == nil {
+		t.Error("Expected fatal error for unreadable root")
+	}
+}
+
+// relPaths returns scan results as paths relative to root
+func relPaths(t *testing.T, root string, items []FileInfo) map[string]bool {
+	result := make(map[string]bool, len(items))
+	for _, item := range items {
+		rel, err := filepath.Rel(root, item.Path)
+		if err != nil {
+			t.Fatalf("Failed to get relative path: %v", err)
+		}
+		result[filepath.ToSlash(rel)] = true
+	}
+	return result
+}
+
+// createFiles creates empty files and their parent directories under root
+func createFiles(t *testing.T, root string, paths ...string) {
+	for _, path := range paths {
+		fullPath := filepath.Join(root, path)
+		if err := os.MkdirAll(filepath.Dir(fullPath), 0755); err != nil {
+			t.Fatalf("Failed to create dir: %v", err)
+		}
+		if err := os.WriteFile(fullPath, nil, 0644); err != nil {
+			t.Fatalf("Failed to create file: %v", err)
+		}
+	}
+}
+
+func TestListRecursiveFilteredPrunesDirectories(t *testing.T) {
+	root := t.TempDir()
+	createFiles(t, root,
+		"app/main.go",
+		"app/node_modules/lib/index.js",
+		"web/node_modules/pkg/a.js",
+		"web/site.js",
+		"tmp.tmp",
+		"web/cache.tmp",
+	)
+
+	// Count metadata reads below excluded directories
+	visitedExcluded := 0
+	original := getFileInfoFn
+	getFileInfoFn = func(path string) (FileInfo, error) {
+		if filepath.Base(filepath.Dir(path)) == "node_modules" {
+			visitedExcluded++
+		}
+		return original(path)
+	}
+	defer func() { getFileInfoFn = original }()
+
+	items, err := ListRecursiveFiltered(root, []string{"**/node_modules", "**/*.tmp"}, nil)
+	if err != nil {
+		t.Fatalf("ListRecursiveFiltered failed: %v", err)
+	}
+
+	got := relPaths(t, root, items)
+	for _, path := range []string{".", "app", "app/main.go", "web", "web/site.js"} {
+		if !got[path] {
+			t.Errorf("Expected %s to be returned", path)
+		}
+	}
+	for _, path := range []string{"app/node_modules", "web/node_modules", "tmp.tmp", "web/cache.tmp"} {
+		if got[path] {
+			t.Errorf("Expected %s to be excluded", path)
+		}
+	}
+	if len(got) != 5 {
+		t.Errorf("Expected 5 items, got %d: %v", len(got), got)
+	}
+	if visitedExcluded != 0 {
+		t.Errorf("Expected excluded directories to be pruned, %d entries were read", visitedExcluded)
+	}
+}
+
+func TestScanSkipsMarkedDirectories(t *testing.T) {
+	root := t.TempDir()
+	createFiles(t, root,
+		"data/keep.txt",
+		"data/cache/.nobackup",
+		"data/cache/blob.bin",
+		"data/cache/nested/deep.bin",
+		"data/sibling/file.txt",
+		".nobackup",
+	)
+
+	// Skipped directories are logged to the logger of the context
+	var logs bytes.Buffer
+	logger := slog.New(slog.NewTextHandler(&logs, &slog.HandlerOptions{Level: slog.LevelDebug}))
+	ctx := context.WithValue(context.Background(), logging.ContextKey, logger)
+	items, _, err := ScanContext(ctx, root, ScanOptions{ExcludeMarker: ".nobackup"})
+	if err != nil {
+		t.Fatalf("Scan failed: %v", err)
+	}
+	if !strings.Contains(logs.String(), "Skipping directory with exclude marker") {
+		t.Errorf("Expected the skipped directory to be logged, got %q", logs.String())
+	}
+	got := relPaths(t, root, items)
+	// A marker in the source folder itself doesn't exclude the whole backup
+	for _, path := range []string{".", ".nobackup", "data", "data/keep.txt", "data/sibling", "data/sibling/file.txt"} {
+		if !got[path] {
+			t.Errorf("Expected %s to be returned", path)
+		}
+	}
+	for path := range got {
+		if path == "data/cache" || filepath.Dir(path) == "data/cache" || filepath.Dir(filepath.Dir(path)) == "data/cache" {
+			t.Errorf("Expected %s to be excluded by the marker", path)
+		}
+	}
+
+	// Without a marker name nothing is skipped
+	items, _, err = Scan(root, ScanOptions{})
+	if err != nil {
+		t.Fatalf("Scan failed: %v", err)
+	}
+	if got := relPaths(t, root, items); !got["data/cache/nested/deep.bin"] {
+		t.Error("Expected marked directory to be scanned when no marker is set")
+	}
+}
+
+func TestListRecursiveFilteredIncludes(t *testing.T) {
+	root := t.TempDir()
+	createFiles(t, root,
+		"docs/a.pdf",
+		"docs/b.txt",
+		"docs/draft/c.pdf",
+		"d.pdf",
+	)
+
+	// Excludes take precedence over includes
+	items, err := ListRecursiveFiltered(root, []string{"docs/draft"}, []string{"**/*.pdf"})
+	if err != nil {
+		t.Fatalf("ListRecursiveFiltered failed: %v", err)
+	}
+
+	got := relPaths(t, root, items)
+	for _, path := range []string{".", "docs", "docs/a.pdf", "d.pdf"} {
+		if !got[path] {
+			t.Errorf("Expected %s to be returned", path)
+		}
+	}
+	for _, path := range []string{"docs/b.txt", "docs/draft", "docs/draft/c.pdf"} {
+		if got[path] {
+			t.Errorf("Expected %s to be filtered out", path)
+		}
+	}
+
+	// An excluded file stays excluded even if it matches an include
+	items, err = ListRecursiveFiltered(root, []string{"d.pdf"}, []string{"**/*.pdf"})
+	if err != nil {
+		t.Fatalf("ListRecursiveFiltered failed: %v", err)
+	}
+	if relPaths(t, root, items)["d.pdf"] {
+		t.Error("Expected exclude to win over include")
+	}
+}
+
+func TestListRecursiveFilteredInvalidPattern(t *testing.T) {
+	if _, err := ListRecursiveFiltered(t.TempDir(), []string{"[a"}, nil); err == nil {
+		t.Error("Expected error for invalid exclude pattern")
+	}
+}
+
+func TestListRecursiveEdgeCases(t *testing.T) {
+	walks := map[string]func(string) ([]FileInfo, error){
+		"serial": ListRecursive,
+		"parallel": func(path string) ([]FileInfo, error) {
+			return ListRecursiveParallel(path, 4)
+		},
+	}
+
+	for name, walk := range walks {
+		t.Run(name, func(t *testing.T) {
+			// Empty directory returns only the root
+			root := t.TempDir()
+			items, err := walk(root)
+			if err != nil {
+				t.Fatalf("Unexpected error for empty dir: %v", err)
+			}
+			if len(items) != 1 || items[0].Path != root || !items[0].Mode.IsDir() {
+				t.Errorf("Expected only the root for empty dir, got %v", items)
+			}
+
+			// A single file as source returns the file
+			createFiles(t, root, "single.txt")
+			single := filepath.Join(root, "single.txt")
+			items, err = walk(single)
+			if err != nil {
+				t.Fatalf("Unexpected error for single file: %v", err)
+			}
+			if len(items) != 1 || items[0].Path != single || items[0].Host == "" {
+				t.Errorf("Expected the single file with host set, got %v", items)
+			}
+
+			// Missing source path is an error and returns no items
+			items, err = walk(filepath.Join(root, "missing"))
+			if err == nil || items != nil {
+				t.Errorf("Expected error and no items for missing path, got %v, %v", items, err)
+			}
+		})
+	}
+}
+
+// Both walks read metadata with the platform getFileInfo, there is no other stat path to drift from it
+func TestListRecursiveUsesPlatformFileInfo(t *testing.T) {
+	root := t.TempDir()
+	createFiles(t, root, "a.txt", "sub/b.txt", "sub/deeper/c.txt")
+	for name, walk := range map[string]func(string) ([]FileInfo, error){
+		"serial":   ListRecursive,
+		"parallel": func(path string) ([]FileInfo, error) { return ListRecursiveParallel(path, 2) },
+	} {
+		t.Run(name, func(t *testing.T) {
+			items, err := walk(root)
+			if err != nil {
+				t.Fatalf("Walk failed: %v", err)
+			}
+			if len(items) != 6 {
+				t.Errorf("Expected 6 entries, got %d", len(items))
+			}
+			for _, item := range items {
+				want, err := getFileInfo(item.Path)
+				if err != nil {
+					t.Fatalf("getFileInfo failed: %v", err)
+				}
+				want.Host = item.Host
+				want.AccessTime = item.AccessTime // Reading directories updates it
+				if !reflect.DeepEqual(item, want) {
+					t.Errorf("%s: walk returned %+v, getFileInfo %+v", item.Path, item, want)
+				}
+			}
+		})
+	}
+}
+
+// Symlink targets read concurrently by the parallel walk don't mix, run with -race
+func TestListRecursiveParallelSymlinkTargets(t *testing.T) {
+	root := t.TempDir()
+	want := make(map[string]string)
+	for i := range 8 {
+		dir := filepath.Join(root, fmt.Sprintf("dir_%d", i))
+		if err := os.Mkdir(dir, 0755); err != nil {
+			t.Fatalf("Failed to create dir: %v", err)
+		}
+		for j := range 50 {
+			// Targets of different lengths, a shared buffer would leave the tail of a longer one
+			target := fmt.Sprintf("target_%d_%d_%s", i, j, strings.Repeat("x", (i*50+j)%300))
+			link := filepath.Join(dir, fmt.Sprintf("link_%d", j))
+			if err := os.Symlink(target, link); err != nil {
+				t.Fatalf("Failed to create symlink: %v", err)
+			}
+			want[link] = target
+		}
+	}
+
+	for range 5 {
+		items, err := ListRecursiveParallel(root, 8)
+		if err != nil {
+			t.Fatalf("ListRecursiveParallel failed: %v", err)
+		}
+		for _, item := range items {
+			if target, ok := want[item.Path]; ok && item.SymlinkTarget != target {
+				t.Fatalf("%s read with target %q, expected %q", item.Path, item.SymlinkTarget, target)
+			}
+		}
+	}
+}
+
+func TestListRecursiveWithProgress(t *testing.T) {
+	root := t.TempDir()
+	total := createTestTree(t, root, 3, 3, 20)
+
+	var calls, last int
+	var lastPath string
+	check := func(scanned int, current string) {
+		calls++
+		if scanned < last {
+			t.Errorf("Progress went back from %d to %d", last, scanned)
+		}
+		last, lastPath = scanned, current
+	}
+
+	// Every entry is reported without a delay between calls
+	defer func(interval time.Duration) { scanProgressInterval = interval }(scanProgressInterval)
+	scanProgressInterval = 0
+	items, err := ListRecursiveWithProgress(root, check)
+	if err != nil {
+		t.Fatalf("ListRecursiveWithProgress failed: %v", err)
+	}
+	if calls < len(items) {
+		t.Errorf("Progress called %d times for %d entries", calls, len(items))
+	}
+	if last != len(items) || lastPath == "" {
+		t.Errorf("Last progress reported %d entries at %q, expected %d", last, lastPath, len(items))
+	}
+	// The root, 3 dirs, 9 subdirs and the files
+	if len(items) != 1+3+9+total {
+		t.Errorf("Expected %d entries, got %d", 1+3+9+total, len(items))
+	}
+
+	// Calls are rate limited, the final count is still reported
+	scanProgressInterval = time.Hour
+	calls, last = 0, 0
+	if _, err := ListRecursiveWithProgress(root, check); err != nil {
+		t.Fatalf("ListRecursiveWithProgress failed: %v", err)
+	}
+	if calls != 1 || last != len(items) {
+		t.Errorf("Rate limited progress called %d times with %d entries, expected once with %d", calls, last, len(items))
+	}
+}
+
+func TestListRecursiveOneFS(t *testing.T) {
+	root := t.TempDir()
+	createFiles(t, root, "local.txt", "mnt/remote.txt", "mnt/deeper/remote.txt", "other/local.txt")
+	mount := filepath.Join(root, "mnt")
+
+	// Everything below mnt is on another device, as if a filesystem was mounted there
+	original := getFileInfoFn
+	getFileInfoFn = func(path string) (FileInfo, error) {
+		info, err := original(path)
+		info.Dev = 1
+		if path == mount || strings.HasPrefix(path, mount+string(filepath.Separator)) {
+			info.Dev = 2
+		}
+		return info, err
+	}
+	defer func() { getFileInfoFn = original }()
+
+	items, err := ListRecursiveOneFS(root)
+	if err != nil {
+		t.Fatalf("ListRecursiveOneFS failed: %v", err)
+	}
+	found := indexByPath(items)
+	// The mount point itself is listed, like tar does
+	for _, path := range []string{root, filepath.Join(root, "local.txt"), mount, filepath.Join(root, "other", "local.txt")} {
+		if _, ok := found[path]; !ok {
+			t.Errorf("%s missing from the scan", path)
+		}
+	}
+	if len(items) != 5 {
+		t.Errorf("Expected 5 entries on the source filesystem, got %d: %v", len(items), items)
+	}
+
+	// Without the option the other filesystem is walked
+	if items, err := ListRecursive(root); err != nil || len(items) != 8 {
+		t.Errorf("ListRecursive returned %d entries, expected 8: %v", len(items), err)
+	}
+}
+
+func TestScanFollowSymlinks(t *testing.T) {
+	root := t.TempDir()
+	createFiles(t, root, "a/file.txt", "a/b/deep.txt", "other/shared.txt")
+	// A loop back to an ancestor, a link to a directory outside a, and a link to a file
+	links := map[string]string{
+		"a/b/up":      filepath.Join(root, "a"),
+		"a/elsewhere": filepath.Join(root, "other"),
+		"a/filelink":  filepath.Join(root, "a", "file.txt"),
+	}
+	for link, target := range links {
+		if err := os.Symlink(target, filepath.Join(root, link)); err != nil {
+			t.Fatalf("Failed to create symlink: %v", err)
+		}
+	}
+	source := filepath.Join(root, "a")
+
+	done := make(chan struct{})
+	var items []FileInfo
+	var err error
+	go func() {
+		defer close(done)
+		items, _, err = Scan(source, ScanOptions{FollowSymlinks: true})
+	}()
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("Scan following symlinks didn't terminate")
+	}
+	if err != nil {
+		t.Fatalf("Scan failed: %v", err)
+	}
+
+	found := indexByPath(items)
+	// The loop is kept as a symlink, the other directory is walked under the link
+	if up := found[filepath.Join(source, "b", "up")]; up.Mode&os.ModeSymlink == 0 {
+		t.Errorf("Link to an ancestor listed as %v, expected a symlink", up.Mode)
+	}
+	if elsewhere := found[filepath.Join(source, "elsewhere")]; !elsewhere.Mode.IsDir() || elsewhere.Name != "elsewhere" {
+		t.Errorf("Followed link listed as %+v, expected a directory", elsewhere)
+	}
+	if _, ok := found[filepath.Join(source, "elsewhere", "shared.txt")]; !ok {
+		t.Error("Content of the followed directory missing")
+	}
+	if filelink := found[filepath.Join(source, "filelink")]; filelink.Mode&os.ModeSymlink == 0 {
+		t.Error("Link to a file not kept as a symlink")
+	}
+	// a, file.txt, b, deep.txt, up, elsewhere, shared.txt, filelink
+	if len(items) != 8 {
+		t.Errorf("Expected 8 entries, got %d", len(items))
+	}
+
+	// Without following, every link is a symlink
+	items, _, err = Scan(source, ScanOptions{})
+	if err != nil {
+		t.Fatalf("Scan failed: %v", err)
+	}
+	if len(items) != 7 || indexByPath(items)[filepath.Join(source, "elsewhere")].Mode&os.ModeSymlink == 0 {
+		t.Errorf("Scan without following returned %d entries", len(items))
+	}
+}
+
+func TestScanMaxDepth(t *testing.T) {
+	root := t.TempDir()
+	createFiles(t, root, "top.txt", "one/mid.txt", "one/two/deep.txt")
+	items, _, err := Scan(root, ScanOptions{MaxDepth: 1})
+	if err != nil {
+		t.Fatalf("Scan failed: %v", err)
+	}
+	found := indexByPath(items)
+	if _, ok := found[filepath.Join(root, "one")]; !ok {
+		t.Error("Directory at the maximum depth missing")
+	}
+	if len(items) != 3 {
+		t.Errorf("Expected the root, top.txt and one, got %d entries", len(items))
+	}
+}
+
+func TestSplitByStreams(t *testing.T) {
+	files := make([]FileInfo, 7)
+	for i := range files {
+		files[i].Path = fmt.Sprintf("/file_%d", i)
+	}
+
+	tests := []struct {
+		name    string
+		files   []FileInfo
+		streams int
+		sizes   []int
+	}{
+		{"even split", files[:6], 3, []int{2, 2, 2}},
+		{"remainder goes first", files, 3, []int{3, 2, 2}},
+		{"more streams than files", files[:2], 4, []int{1, 1, 0, 0}},
+		{"empty input", nil, 3, []int{0, 0, 0}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result := SplitByStreams(tt.files, tt.streams)
+			if len(result) != tt.streams {
+				t.Fatalf("Expected %d streams, got %d", tt.streams, len(result))
+			}
+			total := 0
+			for i, stream := range result {
+				if len(stream) != tt.sizes[i] {
+					t.Errorf("Stream %d: expected %d files, got %d", i, tt.sizes[i], len(stream))
+				}
+				total += len(stream)
+			}
+			if total != len(tt.files) {
+				t.Errorf("Expected %d files in total, got %d", len(tt.files), total)
+			}
+		})
+	}
+
+	if result := SplitByStreams(files, 0); result != nil {
+		t.Errorf("Expected nil for zero streams, got %v", result)
+	}
+}
+
+func TestSplitByStreamsStable(t *testing.T) {
+	files := make([]FileInfo, 200)
+	for i := range files {
+		files[i].Path = fmt.Sprintf("/data/dir_%d/file_%d", i%7, i)
+	}
+	const streams = 4
+
+	// streamOf maps each path to its stream, checking the order within streams on the way
+	streamOf := func(result [][]FileInfo) map[string]int {
+		t.Helper()
+		if len(result) != streams {
+			t.Fatalf("Expected %d streams, got %d", streams, len(result))
+		}
+		assigned := make(map[string]int)
+		for i, stream := range result {
+			for j, file := range stream {
+				if j > 0 && stream[j-1].Path >= file.Path {
+					t.Errorf("Stream %d is not sorted by path: %s before %s", i, stream[j-1].Path, file.Path)
+				}
+				assigned[file.Path] = i
+			}
+		}
+		return assigned
+	}
+
+	want := streamOf(SplitByStreamsStable(files, streams))
+	if len(want) != len(files) {
+		t.Fatalf("Expected %d files in total, got %d", len(files), len(want))
+	}
+	for i, stream := range SplitByStreamsStable(files, streams) {
+		if len(stream) == 0 {
+			t.Errorf("Stream %d got no files", i)
+		}
+	}
+
+	rng := rand.New(rand.NewSource(1))
+	for run := 0; run < 5; run++ {
+		shuffled := make([]FileInfo, len(files))
+		copy(shuffled, files)
+		rng.Shuffle(len(shuffled), func(i, j int) { shuffled[i], shuffled[j] = shuffled[j], shuffled[i] })
+		// Files coming and going don't move the others
+		shuffled = shuffled[run:]
+
+		got := streamOf(SplitByStreamsStable(shuffled, streams))
+		if len(got) != len(shuffled) {
+			t.Fatalf("Run %d: expected %d files in total, got %d", run, len(shuffled), len(got))
+		}
+		for path, stream := range got {
+			if want[path] != stream {
+				t.Errorf("Run %d: %s went to stream %d, expected %d", run, path, stream, want[path])
+			}
+		}
+	}
+
+	if result := SplitByStreamsStable(files, 0); result != nil {
+		t.Errorf("Expected nil for zero streams, got %v", result)
+	}
+}
+
+func TestSplitBySize(t *testing.T) {
+	// Skewed sizes: a few large files and many small ones
+	var files []FileInfo
+	for i := 0; i < 10; i++ {
+		files = append(files, FileInfo{Path: fmt.Sprintf("/large_%d", i), Size: int64(i+1) << 26})
+	}
+	for i := 0; i < 200; i++ {
+		files = append(files, FileInfo{Path: fmt.Sprintf("/small_%d", i), Size: int64(i+1) << 20})
+	}
+
+	result := SplitBySize(files, 4)
+	if len(result) != 4 {
+		t.Fatalf("Expected 4 streams, got %d", len(result))
+	}
+
+	seen := make(map[string]bool)
+	var minTotal, maxTotal int64
+	for i, stream := range result {
+		var total int64
+		for _, file := range stream {
+			if seen[file.Path] {
+				t.Errorf("File %s assigned twice", file.Path)
+			}
+			seen[file.Path] = true
+			total += file.Size
+		}
+		if i == 0 || total < minTotal {
+			minTotal = total
+		}
+		if total > maxTotal {
+			maxTotal = total
+		}
+	}
+
+	if len(seen) != len(files) {
+		t.Errorf("Expected %d files, got %d", len(files), len(seen))
+	}
+	if ratio := float64(maxTotal) / float64(minTotal); ratio > 1.1 {
+		t.Errorf("Streams unbalanced: max/min bytes ratio %.2f", ratio)
+	}
+}
+
+func TestSplitBySizeEdgeCases(t *testing.T) {
+	if result := SplitBySize(nil, 0); result != nil {
+		t.Errorf("Expected nil for zero streams, got %v", result)
+	}
+
+	result := SplitBySize(nil, 3)
+	if len(result) != 3 {
+		t.Fatalf("Expected 3 empty streams, got %d", len(result))
+	}
+
+	files := []FileInfo{{Path: "/a", Size: 10}, {Path: "/b", Size: 20}}
+	result = SplitBySize(files, 3)
+	if len(result[0]) != 1 || result[0][0].Path != "/b" || len(result[1]) != 1 || len(result[2]) != 0 {
+		t.Errorf("Unexpected split for fewer files than streams: %v", result)
+	}
+	if files[0].Path != "/a" {
+		t.Error("Input order must not be modified")
+	}
+}
+
+func TestSplitByCategory(t *testing.T) {
+	categories := map[string]string{
+		"pdf":    "documents",
+		"docx":   "documents",
+		"db":     "databases",
+		"sqlite": "databases",
+	}
+	var files []FileInfo
+	for i := 0; i < 4; i++ {
+		files = append(files,
+			FileInfo{Path: fmt.Sprintf("/docs/report_%d.pdf", i)},
+			FileInfo{Path: fmt.Sprintf("/docs/letter_%d.DOCX", i)},
+			FileInfo{Path: fmt.Sprintf("/data/app_%d.sqlite", i)},
+			FileInfo{Path: fmt.Sprintf("/other/notes_%d.txt", i)},
+			FileInfo{Path: fmt.Sprintf("/other/Makefile_%d", i)},
+		)
+	}
+
+	// Groups by name: databases, documents, then other files
+	result := SplitByCategory(files, 6, categories)
+	if len(result) != 6 {
+		t.Fatalf("Expected 6 streams, got %d", len(result))
+	}
+	designated := map[string][]int{
+		"databases": {0, 3},
+		"documents": {1, 4},
+		"":          {2, 5},
+	}
+	total := 0
+	for group, streams := range designated {
+		for _, stream := range streams {
+			if len(result[stream]) == 0 {
+				t.Errorf("Stream %d of category %q is empty", stream, group)
+			}
+			for _, file := range result[stream] {
+				if got := categories[FileExtension(file.Path)]; got != group {
+					t.Errorf("Stream %d of category %q got %s from category %q", stream, group, file.Path, got)
+				}
+			}
+			total += len(result[stream])
+		}
+	}
+	if total != len(files) {
+		t.Errorf("Expected %d files in total, got %d", len(files), total)
+	}
+	// Round-robin within a category
+	if len(result[1]) != 4 || len(result[4]) != 4 {
+		t.Errorf("Documents not dealt evenly: %d and %d files", len(result[1]), len(result[4]))
+	}
+
+	// With fewer streams than categories, categories share streams
+	result = SplitByCategory(files, 2, categories)
+	for _, file := range result[0] {
+		if categories[FileExtension(file.Path)] == "documents" {
+			t.Errorf("Document %s in stream 0, expected stream 1", file.Path)
+		}
+	}
+	if len(result[0])+len(result[1]) != len(files) {
+		t.Errorf("Files lost with fewer streams than categories")
+	}
+
+	if result := SplitByCategory(files, 0, categories); result != nil {
+		t.Errorf("Expected nil for zero streams, got %v", result)
+	}
+}
+
+func TestListRecursiveCtxCancelled(t *testing.T) {
+	root := t.TempDir()
+	for i := range 50 {
+		if err := os.WriteFile(filepath.Join(root, fmt.Sprintf("file%02d", i)), nil, 0600); err != nil {
+			t.Fatalf("Failed to write file: %v", err)
+		}
+	}
+
+	// Cancel while reading the fifth entry
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	reads := 0
+	original := getFileInfoFn
+	getFileInfoFn = func(path string) (FileInfo, error) {
+		if reads++; reads == 5 {
+			cancel()
+		}
+		return original(path)
+	}
+	defer func() { getFileInfoFn = original }()
+
+	items, err := ListRecursiveCtx(ctx, root)
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("Expected context.Canceled, got %v", err)
+	}
+	if reads != 5 {
+		t.Errorf("Read %d entries, expected the walk to stop after the fifth", reads)
+	}
+	if len(items) != 5 {
+		t.Errorf("Returned %d entries, expected the 5 found before cancellation", len(items))
+	}
+
+	if items, err := ListRecursiveCtx(context.Background(), root); err != nil || len(items) != 51 {
+		t.Errorf("Uncancelled walk found %d entries (%v), expected 51", len(items), err)
+	}
+}
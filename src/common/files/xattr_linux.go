@@ -0,0 +1,87 @@
+//go:build linux
+
+package files
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// GetXattrs returns the extended attributes of path without following symlinks.
+// POSIX ACL attributes are left out since they are captured in FileInfo.ACL.
+// Attributes that can't be read are skipped.
+func GetXattrs(path string) (map[string][]byte, error) {
+	attrs, _, err := getXattrs(fileRef{path: path})
+	return attrs, err
+}
+
+// getXattrs is GetXattrs for ref, also returning why each attribute skipped couldn't be read
+func getXattrs(ref fileRef) (attrs map[string][]byte, skipped []error, err error) {
+	names, err := listXattrs(ref)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	for _, name := range names {
+		if strings.HasPrefix(name, "system.posix_acl_") {
+			continue
+		}
+		value, err := ref.xattr(name)
+		if err != nil {
+			skipped = append(skipped, fmt.Errorf("xattr %s: %w", name, err))
+			continue
+		}
+		if attrs == nil {
+			attrs = make(map[string][]byte)
+		}
+		attrs[name] = value
+	}
+	return attrs, skipped, nil
+}
+
+// SetXattrs sets extended attributes on path without following symlinks
+func SetXattrs(path string, attrs map[string][]byte) error {
+	for name, value := range attrs {
+		if err := unix.Lsetxattr(path, name, value, 0); err != nil {
+			return fmt.Errorf("failed to set xattr %s on %s: %w", name, path, err)
+		}
+	}
+	return nil
+}
+
+// listXattrs returns the extended attribute names of ref
+func listXattrs(ref fileRef) ([]string, error) {
+	for {
+		size, err := ref.listxattr(nil)
+		if err == unix.ENOTSUP {
+			return nil, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to list xattrs of %s: %w", ref.path, err)
+		}
+		if size == 0 {
+			return nil, nil
+		}
+
+		buf := make([]byte, size)
+		size, err = ref.listxattr(buf)
+		if err == unix.ERANGE {
+			// Attributes were added between the calls, retry
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to list xattrs of %s: %w", ref.path, err)
+		}
+
+		var names []string
+		for _, name := range bytes.Split(buf[:size], []byte{0}) {
+			if len(name) > 0 {
+				names = append(names, string(name))
+			}
+		}
+		return names, nil
+	}
+}
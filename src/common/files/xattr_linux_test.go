@@ -0,0 +1,76 @@
+//go:build linux
+
+package files
+
+import (
+	"bytes"
+	"errors"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestXattrRoundTrip(t *testing.T) {
+	root := t.TempDir()
+	createFiles(t, root, "source.txt", "target.txt")
+	source := filepath.Join(root, "source.txt")
+	target := filepath.Join(root, "target.txt")
+
+	err := SetXattrs(source, map[string][]byte{"user.comment": []byte("keep me")})
+	if errors.Is(err, unix.ENOTSUP) {
+		t.Skipf("User xattrs not supported here: %v", err)
+	}
+	if err != nil {
+		t.Fatalf("Failed to set xattr: %v", err)
+	}
+
+	fileInfo, err := getFileInfo(source)
+	if err != nil {
+		t.Fatalf("Failed to get file info: %v", err)
+	}
+	if !bytes.Equal(fileInfo.Xattrs["user.comment"], []byte("keep me")) {
+		t.Fatalf("Expected user.comment to be captured, got %v", fileInfo.Xattrs)
+	}
+
+	encoded, err := Encode(&fileInfo)
+	if err != nil {
+		t.Fatalf("Failed to encode: %v", err)
+	}
+	decoded, err := DecodeFileInfo(encoded)
+	if err != nil {
+		t.Fatalf("Failed to decode: %v", err)
+	}
+	if !bytes.Equal(decoded.Xattrs["user.comment"], []byte("keep me")) {
+		t.Fatalf("Expected user.comment to survive encoding, got %v", decoded.Xattrs)
+	}
+
+	if err := SetXattrs(target, decoded.Xattrs); err != nil {
+		t.Fatalf("Failed to restore xattrs: %v", err)
+	}
+	restored, err := GetXattrs(target)
+	if err != nil {
+		t.Fatalf("Failed to read restored xattrs: %v", err)
+	}
+	if !bytes.Equal(restored["user.comment"], []byte("keep me")) {
+		t.Errorf("Expected restored user.comment, got %v", restored)
+	}
+}
+
+func TestXattrsExcludeACL(t *testing.T) {
+	root := t.TempDir()
+	createFiles(t, root, "file.txt")
+	path := filepath.Join(root, "file.txt")
+
+	if err := unix.Setxattr(path, aclAccessXattr, posixACL(1234), 0); err != nil {
+		t.Skipf("POSIX ACLs not supported here: %v", err)
+	}
+
+	attrs, err := GetXattrs(path)
+	if err != nil {
+		t.Fatalf("Failed to get xattrs: %v", err)
+	}
+	if _, ok := attrs[aclAccessXattr]; ok {
+		t.Error("ACL attribute should be left to FileInfo.ACL")
+	}
+}
@@ -0,0 +1,18 @@
+//go:build windows
+
+package files
+
+import "fmt"
+
+// GetXattrs returns the extended attributes of path, Windows has none to capture
+func GetXattrs(path string) (map[string][]byte, error) {
+	return nil, nil
+}
+
+// SetXattrs sets extended attributes on path
+func SetXattrs(path string, attrs map[string][]byte) error {
+	if len(attrs) == 0 {
+		return nil
+	}
+	return fmt.Errorf("extended attributes are not supported on Windows: %s", path)
+}
@@ -7,6 +7,7 @@ import (
 	"log/slog"
 	"os"
 	"path/filepath"
+	"sync/atomic"
 	"time"
 
 	"github.com/alex-sviridov/miniprotector/common/config"
@@ -16,22 +17,61 @@ type contextKey string
 
 const ContextKey contextKey = "logger"
 
+// GetLoggerFromContext returns the logger stored under ContextKey,
+// slog's default logger when there is none so that callers can always log
 func GetLoggerFromContext(ctx context.Context) *slog.Logger {
 	logger, ok := ctx.Value(ContextKey).(*slog.Logger)
-	if !ok {
-		return nil
+	if !ok || logger == nil {
+		return slog.Default()
 	}
 	return logger
 }
 
+// LogFileError reports that the log file can no longer be written
+type LogFileError struct {
+	Path string
+	Err  error
+}
+
+func (e *LogFileError) Error() string {
+	return fmt.Sprintf("log file %s is not writable: %v", e.Path, e.Err)
+}
+
+func (e *LogFileError) Unwrap() error {
+	return e.Err
+}
+
+// fileState is shared by all handlers derived from one logger
+// so a failed log file is reported and abandoned only once
+type fileState struct {
+	path   string
+	failed atomic.Bool
+}
+
+// syslogState is shared by all handlers derived from one logger
+// so a failing syslog is reported only once
+type syslogState struct {
+	reported atomic.Bool
+}
+
 type multiHandler struct {
 	consoleHandler slog.Handler
 	fileHandler    slog.Handler
+	syslogHandler  slog.Handler
+	// fallbackHandler receives records the file or syslog couldn't take when there is no console output
+	fallbackHandler slog.Handler
+	file            *fileState
+	syslog          *syslogState
+}
+
+func (mh *multiHandler) fileFailed() bool {
+	return mh.file != nil && mh.file.failed.Load()
 }
 
 func (mh *multiHandler) Enabled(ctx context.Context, level slog.Level) bool {
 	return (mh.consoleHandler != nil && mh.consoleHandler.Enabled(ctx, level)) ||
-		(mh.fileHandler != nil && mh.fileHandler.Enabled(ctx, level))
+		(mh.fileHandler != nil && mh.fileHandler.Enabled(ctx, level)) ||
+		(mh.syslogHandler != nil && mh.syslogHandler.Enabled(ctx, level))
 }
 
 func (mh *multiHandler) Handle(ctx context.Context, record slog.Record) error {
@@ -41,55 +81,121 @@ func (mh *multiHandler) Handle(ctx context.Context, record slog.Record) error {
 		}
 	}
 	if mh.fileHandler != nil && mh.fileHandler.Enabled(ctx, record.Level) {
+		if mh.fileFailed() {
+			return mh.handleFallback(ctx, record)
+		}
 		if err := mh.fileHandler.Handle(ctx, record.Clone()); err != nil {
-			return err
+			mh.degrade(ctx, err)
+			return mh.handleFallback(ctx, record)
+		}
+	}
+	if mh.syslogHandler != nil && mh.syslogHandler.Enabled(ctx, record.Level) {
+		// Syslog is tried for every record, the writer reconnects once the daemon is back
+		if err := mh.syslogHandler.Handle(ctx, record.Clone()); err != nil {
+			mh.reportSyslog(ctx, err)
+			return mh.handleFallback(ctx, record)
 		}
 	}
 	return nil
 }
 
+// degrade stops writing to the log file and reports it once on the console
+func (mh *multiHandler) degrade(ctx context.Context, err error) {
+	if !mh.file.failed.CompareAndSwap(false, true) {
+		return
+	}
+	warning := slog.NewRecord(time.Now(), slog.LevelWarn, "Log file unavailable, logging to console only", 0)
+	warning.AddAttrs(slog.Any("error", &LogFileError{Path: mh.file.path, Err: err}))
+	if mh.consoleHandler != nil {
+		mh.consoleHandler.Handle(ctx, warning)
+	} else if mh.fallbackHandler != nil {
+		mh.fallbackHandler.Handle(ctx, warning)
+	}
+}
+
+// reportSyslog reports once on the console that syslog can't be written
+func (mh *multiHandler) reportSyslog(ctx context.Context, err error) {
+	if !mh.syslog.reported.CompareAndSwap(false, true) {
+		return
+	}
+	warning := slog.NewRecord(time.Now(), slog.LevelWarn, "Syslog unavailable, records are missing from it", 0)
+	warning.AddAttrs(slog.Any("error", err))
+	if mh.consoleHandler != nil {
+		mh.consoleHandler.Handle(ctx, warning)
+	} else if mh.fallbackHandler != nil {
+		mh.fallbackHandler.Handle(ctx, warning)
+	}
+}
+
+// handleFallback writes a record the log file or syslog couldn't take when console output is off
+func (mh *multiHandler) handleFallback(ctx context.Context, record slog.Record) error {
+	if mh.consoleHandler != nil || mh.fallbackHandler == nil {
+		return nil
+	}
+	return mh.fallbackHandler.Handle(ctx, record.Clone())
+}
+
 func (mh *multiHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
-	newHandler := &multiHandler{}
+	newHandler := &multiHandler{file: mh.file, syslog: mh.syslog}
 	if mh.consoleHandler != nil {
 		newHandler.consoleHandler = mh.consoleHandler.WithAttrs(attrs)
 	}
 	if mh.fileHandler != nil {
 		newHandler.fileHandler = mh.fileHandler.WithAttrs(attrs)
 	}
+	if mh.syslogHandler != nil {
+		newHandler.syslogHandler = mh.syslogHandler.WithAttrs(attrs)
+	}
+	if mh.fallbackHandler != nil {
+		newHandler.fallbackHandler = mh.fallbackHandler.WithAttrs(attrs)
+	}
 	return newHandler
 }
 
 func (mh *multiHandler) WithGroup(name string) slog.Handler {
-	newHandler := &multiHandler{}
+	newHandler := &multiHandler{file: mh.file, syslog: mh.syslog}
 	if mh.consoleHandler != nil {
 		newHandler.consoleHandler = mh.consoleHandler.WithGroup(name)
 	}
 	if mh.fileHandler != nil {
 		newHandler.fileHandler = mh.fileHandler.WithGroup(name)
 	}
+	if mh.syslogHandler != nil {
+		newHandler.syslogHandler = mh.syslogHandler.WithGroup(name)
+	}
+	if mh.fallbackHandler != nil {
+		newHandler.fallbackHandler = mh.fallbackHandler.WithGroup(name)
+	}
 	return newHandler
 }
 
-func getLevel(debugMode bool) slog.Level {
+// getLevel returns the configured log_level, or Debug in debug mode and Info otherwise when it is unset
+func getLevel(logLevel string, debugMode bool) slog.Level {
+	switch logLevel {
+	case "debug":
+		return slog.LevelDebug
+	case "info":
+		return slog.LevelInfo
+	case "warn":
+		return slog.LevelWarn
+	case "error":
+		return slog.LevelError
+	}
 	if debugMode {
 		return slog.LevelDebug
 	}
 	return slog.LevelInfo
 }
 
-func NewLogger(ctx context.Context) (*slog.Logger, io.Closer, error) {
-	conf := config.GetConfigFromContext(ctx)
-
-	level := getLevel(ctx.Value("debugMode").(bool))
-	quietMode := ctx.Value("quietMode").(bool)
-	appName := ctx.Value("appName").(string)
-
-	var logFile *os.File
+// newMultiHandler builds console (logfmt) and file (JSON) handlers for the given writers,
+// next to the syslog handler if not nil
+// Either writer may be nil; records are discarded when there is no output
+func newMultiHandler(console io.Writer, file io.Writer, filePath string, syslog slog.Handler, level slog.Level) *multiHandler {
 	handler := &multiHandler{}
 
 	// Console output (logfmt format, only if not quiet)
-	if !quietMode {
-		handler.consoleHandler = slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{
+	if console != nil {
+		handler.consoleHandler = slog.NewTextHandler(console, &slog.HandlerOptions{
 			Level:     level,
 			AddSource: level == slog.LevelDebug,
 			ReplaceAttr: func(groups []string, a slog.Attr) slog.Attr {
@@ -101,23 +207,77 @@ func NewLogger(ctx context.Context) (*slog.Logger, io.Closer, error) {
 		})
 	}
 
+	if file != nil {
+		handler.fileHandler = slog.NewJSONHandler(file, &slog.HandlerOptions{
+			Level:     level,
+			AddSource: level == slog.LevelDebug,
+		})
+		handler.file = &fileState{path: filePath}
+	}
+	if syslog != nil {
+		handler.syslogHandler = syslog
+		handler.syslog = &syslogState{}
+	}
+	// Without console output, logs go to stderr if the file or syslog fails later
+	if console == nil && (file != nil || syslog != nil) {
+		handler.fallbackHandler = slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: level})
+	}
+
+	// Fallback to discard if no handlers
+	if handler.consoleHandler == nil && handler.fileHandler == nil && handler.syslogHandler == nil {
+		handler.consoleHandler = slog.NewTextHandler(io.Discard, &slog.HandlerOptions{Level: level})
+	}
+	return handler
+}
+
+func NewLogger(ctx context.Context) (*slog.Logger, io.Closer, error) {
+	// Set by main, a context without them gets an info level logger writing to the console
+	conf := config.GetConfigFromContext(ctx)
+	if conf == nil {
+		conf = &config.Config{}
+	}
+	debugMode, _ := ctx.Value("debugMode").(bool)
+	quietMode, _ := ctx.Value("quietMode").(bool)
+	appName, _ := ctx.Value("appName").(string)
+	level := getLevel(conf.LogLevel, debugMode)
+
+	var console io.Writer
+	if !quietMode {
+		console = os.Stdout
+	}
+
+	// Syslog output instead of the file with log_target=syslog, the file is used if syslog is unavailable
+	var syslog slog.Handler
+	var syslogWriter io.Closer
+	var syslogErr error
+	if conf.LogTarget == "syslog" {
+		syslog, syslogWriter, syslogErr = newSyslogHandler("", "", appName, level)
+	}
+
 	// File output (JSON format, optional - don't fail if unavailable)
-	if conf.LogFolder != "" {
+	// Rotated past LogMaxSizeMB into <file>.1, <file>.2...
+	var logFile *rotatingFile
+	var logPath string
+	if conf.LogFolder != "" && syslog == nil {
 		if err := os.MkdirAll(conf.LogFolder, 0755); err == nil {
 			filename := fmt.Sprintf("%s-%s.%d.log", appName, time.Now().Format("2006-01-02"), os.Getpid())
-			if file, err := os.OpenFile(filepath.Join(conf.LogFolder, filename), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644); err == nil {
-				handler.fileHandler = slog.NewJSONHandler(file, &slog.HandlerOptions{
-					Level:     level,
-					AddSource: level == slog.LevelDebug,
-				})
+			logPath = filepath.Join(conf.LogFolder, filename)
+			if file, err := openRotatingFile(logPath, int64(conf.LogMaxSizeMB)*1024*1024); err == nil {
 				logFile = file
 			}
 		}
 	}
 
-	// Fallback to discard if no handlers
-	if handler.consoleHandler == nil && handler.fileHandler == nil {
-		handler.consoleHandler = slog.NewTextHandler(io.Discard, &slog.HandlerOptions{Level: level})
+	var handler *multiHandler
+	var closer io.Closer
+	if logFile != nil {
+		handler = newMultiHandler(console, logFile, logPath, nil, level)
+		closer = logFile
+	} else {
+		handler = newMultiHandler(console, nil, "", syslog, level)
+		if syslog != nil {
+			closer = syslogWriter
+		}
 	}
 
 	logger := slog.New(handler).With(
@@ -125,9 +285,12 @@ func NewLogger(ctx context.Context) (*slog.Logger, io.Closer, error) {
 		slog.Int("pid", os.Getpid()),
 	)
 
-	if jobId := ctx.Value("jobId"); jobId != nil {
-		logger = logger.With(slog.String("job_id", jobId.(string)))
+	if jobId, _ := ctx.Value("jobId").(string); jobId != "" {
+		logger = logger.With(slog.String("job_id", jobId))
+	}
+	if syslogErr != nil {
+		logger.Warn("Syslog unavailable, logging to the log folder and console", "error", syslogErr)
 	}
 
-	return logger, logFile, nil
+	return logger, closer, nil
 }
@@ -0,0 +1,182 @@
+package logging
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/alex-sviridov/miniprotector/common/config"
+)
+
+func TestFileFailureFallsBackToConsole(t *testing.T) {
+	logPath := filepath.Join(t.TempDir(), "test.log")
+	file, err := os.OpenFile(logPath, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatalf("Failed to open log file: %v", err)
+	}
+
+	var console bytes.Buffer
+	logger := slog.New(newMultiHandler(&console, file, logPath, nil, slog.LevelInfo)).With("app", "test")
+
+	logger.Info("before failure")
+
+	// Make the file unwritable mid-run
+	file.Close()
+
+	logger.Info("after failure")
+	logger.With("stream", 1).Info("derived logger")
+
+	output := console.String()
+	for _, msg := range []string{"before failure", "after failure", "derived logger"} {
+		if !strings.Contains(output, msg) {
+			t.Errorf("Expected console output to contain %q", msg)
+		}
+	}
+	if count := strings.Count(output, "Log file unavailable"); count != 1 {
+		t.Errorf("Expected degradation to be reported once, got %d", count)
+	}
+	if !strings.Contains(output, logPath) {
+		t.Error("Expected degradation warning to name the log file")
+	}
+
+	data, err := os.ReadFile(logPath)
+	if err != nil {
+		t.Fatalf("Failed to read log file: %v", err)
+	}
+	if !strings.Contains(string(data), "before failure") {
+		t.Error("Expected record written before failure in log file")
+	}
+}
+
+func TestLogFileErrorUnwraps(t *testing.T) {
+	err := &LogFileError{Path: "/tmp/x.log", Err: os.ErrClosed}
+	if !strings.Contains(err.Error(), "/tmp/x.log") {
+		t.Errorf("Expected path in error message, got %q", err.Error())
+	}
+	if err.Unwrap() != os.ErrClosed {
+		t.Error("Expected LogFileError to unwrap to the write error")
+	}
+}
+
+func TestLogFileRotation(t *testing.T) {
+	logPath := filepath.Join(t.TempDir(), "test.log")
+	file, err := openRotatingFile(logPath, 1024)
+	if err != nil {
+		t.Fatalf("Failed to open log file: %v", err)
+	}
+	logger := slog.New(newMultiHandler(nil, file, logPath, nil, slog.LevelInfo)).With("app", "test")
+	const records = 100
+	for i := range records {
+		logger.Info("record", "number", i, "padding", strings.Repeat("x", 50))
+	}
+	if err := file.Close(); err != nil {
+		t.Fatalf("Failed to close log file: %v", err)
+	}
+
+	paths, err := filepath.Glob(logPath + "*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(paths) < 2 {
+		t.Fatalf("Expected the log to be rotated, found %v", paths)
+	}
+	seen := make(map[int]bool)
+	for _, path := range paths {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatalf("Failed to read log file: %v", err)
+		}
+		if len(data) > 1024 {
+			t.Errorf("%s is %d bytes, above the rotation size", path, len(data))
+		}
+		for line := range strings.Lines(string(data)) {
+			var record struct {
+				Number int `json:"number"`
+			}
+			if err := json.Unmarshal([]byte(line), &record); err != nil {
+				t.Fatalf("Invalid JSON record in %s: %q", path, line)
+			}
+			seen[record.Number] = true
+		}
+	}
+	if len(seen) != records {
+		t.Errorf("Found %d of the %d records across %d files", len(seen), records, len(paths))
+	}
+}
+
+func TestLogLevelWarnDropsInfo(t *testing.T) {
+	level := getLevel("warn", true)
+	if level != slog.LevelWarn {
+		t.Fatalf("getLevel(warn) = %v, expected warn even in debug mode", level)
+	}
+	if got := getLevel("", true); got != slog.LevelDebug {
+		t.Errorf("getLevel unset in debug mode = %v, expected debug", got)
+	}
+	if got := getLevel("", false); got != slog.LevelInfo {
+		t.Errorf("getLevel unset = %v, expected info", got)
+	}
+
+	logPath := filepath.Join(t.TempDir(), "test.log")
+	file, err := os.OpenFile(logPath, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatalf("Failed to open log file: %v", err)
+	}
+	defer file.Close()
+	var console bytes.Buffer
+	logger := slog.New(newMultiHandler(&console, file, logPath, nil, level))
+	logger.Info("info record")
+	logger.Warn("warn record")
+	logger.Error("error record")
+
+	data, err := os.ReadFile(logPath)
+	if err != nil {
+		t.Fatalf("Failed to read log file: %v", err)
+	}
+	for name, output := range map[string]string{"console": console.String(), "file": string(data)} {
+		if strings.Contains(output, "info record") {
+			t.Errorf("Info record written to the %s at warn level", name)
+		}
+		if !strings.Contains(output, "warn record") || !strings.Contains(output, "error record") {
+			t.Errorf("Warn and error records missing from the %s: %q", name, output)
+		}
+	}
+}
+
+func TestLoggerFromPartialContext(t *testing.T) {
+	// Only the config: no app name, debug or quiet flag, nor job id
+	ctx := context.WithValue(context.Background(), config.ContextKey, &config.Config{})
+	logger, closer, err := NewLogger(ctx)
+	if err != nil {
+		t.Fatalf("NewLogger failed: %v", err)
+	}
+	if closer != nil {
+		defer closer.Close()
+	}
+	logger.Debug("dropped at info level", "key", "value")
+
+	ctx = context.WithValue(ctx, "jobId", 42)
+	if _, _, err := NewLogger(ctx); err != nil {
+		t.Fatalf("NewLogger with a job id of another type failed: %v", err)
+	}
+
+	// Nothing at all, not even the config
+	logger, closer, err = NewLogger(context.Background())
+	if err != nil {
+		t.Fatalf("NewLogger without a config failed: %v", err)
+	}
+	if closer != nil {
+		defer closer.Close()
+	}
+	logger.Info("logged without a config")
+
+	if logger := GetLoggerFromContext(context.Background()); logger == nil {
+		t.Error("No logger for a context without one")
+	} else {
+		logger.Info("logged through the default logger")
+	}
+}
@@ -0,0 +1,94 @@
+package logging
+
+import (
+	"fmt"
+	"os"
+	"sync"
+)
+
+// rotatingFile is a log file that is rotated once it would grow past maxSize bytes:
+// it is closed, renamed to <path>.<n> with the next free sequence number, and a new
+// file is opened at path. Writes are never split, so every JSON record stays on one line
+// of one file. maxSize 0 disables rotation.
+type rotatingFile struct {
+	mu      sync.Mutex
+	path    string
+	maxSize int64
+	file    *os.File
+	size    int64
+	nextSeq int // Lowest sequence number that may be free for the next rotation
+}
+
+// openRotatingFile opens the log file at path for appending
+func openRotatingFile(path string, maxSize int64) (*rotatingFile, error) {
+	r := &rotatingFile{path: path, maxSize: maxSize, nextSeq: 1}
+	if err := r.open(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *rotatingFile) open() error {
+	file, err := os.OpenFile(r.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	r.file = file
+	r.size = info.Size()
+	return nil
+}
+
+func (r *rotatingFile) Write(p []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.file == nil {
+		return 0, os.ErrClosed
+	}
+	// A record larger than maxSize still gets a file of its own
+	if r.maxSize > 0 && r.size > 0 && r.size+int64(len(p)) > r.maxSize {
+		if err := r.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := r.file.Write(p)
+	r.size += int64(n)
+	return n, err
+}
+
+// rotate moves the current file aside and opens a new one, the caller holds mu
+func (r *rotatingFile) rotate() error {
+	err := r.file.Close()
+	r.file = nil
+	if err != nil {
+		return err
+	}
+	for {
+		rotated := fmt.Sprintf("%s.%d", r.path, r.nextSeq)
+		r.nextSeq++
+		// Files left by an earlier rotation of the same path are kept
+		if _, err := os.Lstat(rotated); err == nil {
+			continue
+		}
+		if err := os.Rename(r.path, rotated); err != nil {
+			return err
+		}
+		return r.open()
+	}
+}
+
+// Close closes the current file, writes are synchronous so nothing is left to flush
+func (r *rotatingFile) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.file == nil {
+		return nil
+	}
+	err := r.file.Close()
+	r.file = nil
+	return err
+}
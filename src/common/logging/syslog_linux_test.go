@@ -0,0 +1,53 @@
+package logging
+
+import (
+	"bytes"
+	"log/slog"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSyslogHandler(t *testing.T) {
+	// A fake syslog daemon
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer conn.Close()
+
+	syslog, closer, err := newSyslogHandler("udp", conn.LocalAddr().String(), "bwfs", slog.LevelInfo)
+	if err != nil {
+		t.Fatalf("Failed to connect to syslog: %v", err)
+	}
+	defer closer.Close()
+	var console bytes.Buffer
+	logger := slog.New(newMultiHandler(&console, nil, "", syslog, slog.LevelInfo)).With("app", "bwfs")
+	logger.Debug("below the level")
+	logger.Warn("disk almost full", "free_mb", 12)
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 4096)
+	n, _, err := conn.ReadFrom(buf)
+	if err != nil {
+		t.Fatalf("No record received: %v", err)
+	}
+	message := string(buf[:n])
+	// Priority 28 is facility daemon (3) with severity warning (4)
+	if !strings.HasPrefix(message, "<28>") {
+		t.Errorf("Record sent with priority %q, expected <28>", message[:min(len(message), 4)])
+	}
+	for _, want := range []string{"bwfs", "disk almost full", "free_mb=12", "app=bwfs"} {
+		if !strings.Contains(message, want) {
+			t.Errorf("Syslog record %q doesn't contain %q", message, want)
+		}
+	}
+	if strings.Contains(message, "below the level") {
+		t.Error("Debug record sent to syslog at info level")
+	}
+	// Console output is kept next to syslog
+	if !strings.Contains(console.String(), "disk almost full") {
+		t.Error("Record missing from the console")
+	}
+}
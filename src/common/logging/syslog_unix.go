@@ -0,0 +1,86 @@
+//go:build !windows
+
+package logging
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"log/syslog"
+)
+
+// syslogHandler writes records to syslog as logfmt text, with the priority matching their level.
+// syslog stamps records itself, so the time is left out.
+type syslogHandler struct {
+	byPriority [4]slog.Handler // Debug, Info, Warning and Err handlers
+}
+
+// priorityWriter writes each record with one of the syslog.Writer level methods
+type priorityWriter func(string) error
+
+func (f priorityWriter) Write(p []byte) (int, error) {
+	if err := f(string(p)); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// newSyslogHandler connects to syslog, the local daemon or journald when network is empty,
+// and returns a handler writing records of level and above tagged with tag
+func newSyslogHandler(network, raddr, tag string, level slog.Level) (slog.Handler, io.Closer, error) {
+	w, err := syslog.Dial(network, raddr, syslog.LOG_INFO|syslog.LOG_DAEMON, tag)
+	if err != nil {
+		return nil, nil, err
+	}
+	opts := &slog.HandlerOptions{
+		Level: level,
+		ReplaceAttr: func(groups []string, a slog.Attr) slog.Attr {
+			if a.Key == slog.TimeKey && len(groups) == 0 {
+				return slog.Attr{}
+			}
+			return a
+		},
+	}
+	h := &syslogHandler{}
+	for i, write := range []priorityWriter{w.Debug, w.Info, w.Warning, w.Err} {
+		h.byPriority[i] = slog.NewTextHandler(write, opts)
+	}
+	return h, w, nil
+}
+
+// priority returns the index in byPriority of the handler for level
+func priority(level slog.Level) int {
+	switch {
+	case level >= slog.LevelError:
+		return 3
+	case level >= slog.LevelWarn:
+		return 2
+	case level >= slog.LevelInfo:
+		return 1
+	}
+	return 0
+}
+
+func (h *syslogHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return h.byPriority[0].Enabled(ctx, level)
+}
+
+func (h *syslogHandler) Handle(ctx context.Context, record slog.Record) error {
+	return h.byPriority[priority(record.Level)].Handle(ctx, record)
+}
+
+func (h *syslogHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	newHandler := &syslogHandler{}
+	for i, handler := range h.byPriority {
+		newHandler.byPriority[i] = handler.WithAttrs(attrs)
+	}
+	return newHandler
+}
+
+func (h *syslogHandler) WithGroup(name string) slog.Handler {
+	newHandler := &syslogHandler{}
+	for i, handler := range h.byPriority {
+		newHandler.byPriority[i] = handler.WithGroup(name)
+	}
+	return newHandler
+}
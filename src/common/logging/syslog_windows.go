@@ -0,0 +1,14 @@
+//go:build windows
+
+package logging
+
+import (
+	"errors"
+	"io"
+	"log/slog"
+)
+
+// newSyslogHandler fails, there is no syslog on Windows
+func newSyslogHandler(network, raddr, tag string, level slog.Level) (slog.Handler, io.Closer, error) {
+	return nil, nil, errors.New("syslog is not available on Windows")
+}
@@ -0,0 +1,85 @@
+// Package pool runs tasks on a bounded number of goroutines.
+package pool
+
+import (
+	"context"
+	"errors"
+	"sync"
+)
+
+// Pool runs submitted tasks concurrently, at most size at a time, and collects their errors
+type Pool struct {
+	ctx   context.Context
+	slots chan struct{}
+	wg    sync.WaitGroup
+
+	mu        sync.Mutex
+	errs      []error
+	cancelled bool
+}
+
+// New creates a pool running at most size tasks at once, size of zero or less means no limit
+// Once ctx is done, tasks not yet started are skipped and running tasks see the cancellation through their context
+func New(ctx context.Context, size int) *Pool {
+	p := &Pool{ctx: ctx}
+	if size > 0 {
+		p.slots = make(chan struct{}, size)
+	}
+	return p
+}
+
+// Go runs task in the pool, blocking while all slots are busy
+func (p *Pool) Go(task func(ctx context.Context) error) {
+	if p.slots != nil {
+		select {
+		case p.slots <- struct{}{}:
+		case <-p.ctx.Done():
+			p.skip()
+			return
+		}
+	}
+	if p.ctx.Err() != nil {
+		p.release()
+		p.skip()
+		return
+	}
+
+	p.wg.Add(1)
+	go func() {
+		defer p.wg.Done()
+		defer p.release()
+		if err := task(p.ctx); err != nil {
+			p.mu.Lock()
+			p.errs = append(p.errs, err)
+			p.mu.Unlock()
+		}
+	}()
+}
+
+// Wait blocks until every started task has finished
+// It returns the task errors joined together, plus the context error if tasks were skipped
+func (p *Pool) Wait() error {
+	p.wg.Wait()
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	errs := p.errs
+	if p.cancelled {
+		errs = append(errs, p.ctx.Err())
+	}
+	return errors.Join(errs...)
+}
+
+// release frees the slot taken by a task
+func (p *Pool) release() {
+	if p.slots != nil {
+		<-p.slots
+	}
+}
+
+// skip records that a task was not started because the context is done
+func (p *Pool) skip() {
+	p.mu.Lock()
+	p.cancelled = true
+	p.mu.Unlock()
+}
@@ -0,0 +1,147 @@
+package pool
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestPoolBound(t *testing.T) {
+	const size = 3
+	p := New(context.Background(), size)
+
+	var running, maxRunning, completed atomic.Int32
+	for i := 0; i < 20; i++ {
+		p.Go(func(ctx context.Context) error {
+			current := running.Add(1)
+			for {
+				observed := maxRunning.Load()
+				if current <= observed || maxRunning.CompareAndSwap(observed, current) {
+					break
+				}
+			}
+			time.Sleep(5 * time.Millisecond)
+			running.Add(-1)
+			completed.Add(1)
+			return nil
+		})
+	}
+
+	if err := p.Wait(); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if completed.Load() != 20 {
+		t.Errorf("Expected 20 completed tasks, got %d", completed.Load())
+	}
+	if maxRunning.Load() > size {
+		t.Errorf("Expected at most %d concurrent tasks, saw %d", size, maxRunning.Load())
+	}
+	if maxRunning.Load() < 2 {
+		t.Errorf("Expected tasks to run concurrently, saw at most %d", maxRunning.Load())
+	}
+}
+
+func TestPoolErrors(t *testing.T) {
+	p := New(context.Background(), 2)
+	errOdd := errors.New("odd task failed")
+
+	var completed atomic.Int32
+	for i := 0; i < 6; i++ {
+		p.Go(func(ctx context.Context) error {
+			completed.Add(1)
+			if i%2 == 1 {
+				return fmt.Errorf("task %d: %w", i, errOdd)
+			}
+			return nil
+		})
+	}
+
+	err := p.Wait()
+	if !errors.Is(err, errOdd) {
+		t.Fatalf("Expected joined task errors, got %v", err)
+	}
+	if joined, ok := err.(interface{ Unwrap() []error }); !ok || len(joined.Unwrap()) != 3 {
+		t.Errorf("Expected 3 errors, got %v", err)
+	}
+	// A failing task doesn't stop the others
+	if completed.Load() != 6 {
+		t.Errorf("Expected all 6 tasks to run, got %d", completed.Load())
+	}
+}
+
+func TestPoolCancellation(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	p := New(ctx, 1)
+
+	started := make(chan struct{})
+	var sawCancel atomic.Bool
+	p.Go(func(ctx context.Context) error {
+		close(started)
+		<-ctx.Done()
+		sawCancel.Store(true)
+		return nil
+	})
+
+	<-started
+	var skippedRan atomic.Bool
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		cancel()
+	}()
+	// The pool is full, so this blocks until cancellation and is skipped
+	p.Go(func(ctx context.Context) error {
+		skippedRan.Store(true)
+		return nil
+	})
+
+	err := p.Wait()
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("Expected cancellation error, got %v", err)
+	}
+	if !sawCancel.Load() {
+		t.Error("Running task should see the cancelled context")
+	}
+	if skippedRan.Load() {
+		t.Error("Task submitted after cancellation should not run")
+	}
+
+	// Tasks submitted to a cancelled pool are skipped right away
+	p.Go(func(ctx context.Context) error {
+		skippedRan.Store(true)
+		return nil
+	})
+	if err := p.Wait(); !errors.Is(err, context.Canceled) || skippedRan.Load() {
+		t.Errorf("Expected task to be skipped, got %v", err)
+	}
+}
+
+func TestPoolUnbounded(t *testing.T) {
+	p := New(context.Background(), 0)
+
+	const tasks = 10
+	release := make(chan struct{})
+	var running atomic.Int32
+	for i := 0; i < tasks; i++ {
+		p.Go(func(ctx context.Context) error {
+			running.Add(1)
+			<-release
+			return nil
+		})
+	}
+
+	// All tasks must be able to run at once
+	deadline := time.Now().Add(5 * time.Second)
+	for running.Load() < tasks && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	close(release)
+	if err := p.Wait(); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if running.Load() != tasks {
+		t.Errorf("Expected %d tasks running together, got %d", tasks, running.Load())
+	}
+}
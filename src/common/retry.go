@@ -0,0 +1,45 @@
+package common
+
+import (
+	"context"
+	"fmt"
+	"math/rand/v2"
+	"time"
+)
+
+// Retry calls fn until it succeeds or maxAttempts calls have failed.
+// After the n-th failure it waits baseDelay*2^(n-1) plus up to 50% random jitter,
+// giving up early when ctx is done. The returned error wraps the last failure and reports the attempt count.
+func Retry(ctx context.Context, maxAttempts int, baseDelay time.Duration, fn func(ctx context.Context, attempt int) error) error {
+	if maxAttempts < 1 {
+		maxAttempts = 1
+	}
+
+	var lastErr error
+	for attempt := 1; attempt <= maxAttempts; attempt++ {
+		if lastErr = fn(ctx, attempt); lastErr == nil {
+			return nil
+		}
+		if attempt == maxAttempts {
+			break
+		}
+
+		timer := time.NewTimer(backoffDelay(baseDelay, attempt))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return fmt.Errorf("gave up after %d attempts: %w (last error: %w)", attempt, ctx.Err(), lastErr)
+		case <-timer.C:
+		}
+	}
+	return fmt.Errorf("failed after %d attempts: %w", maxAttempts, lastErr)
+}
+
+// backoffDelay returns the wait after the given failed attempt, doubling each time with jitter
+func backoffDelay(baseDelay time.Duration, attempt int) time.Duration {
+	if baseDelay <= 0 {
+		return 0
+	}
+	delay := baseDelay << min(attempt-1, 16)
+	return delay + time.Duration(rand.Int64N(int64(delay)/2+1))
+}
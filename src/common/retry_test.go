@@ -0,0 +1,83 @@
+package common
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRetrySucceedsAfterFailures(t *testing.T) {
+	calls := 0
+	err := Retry(context.Background(), 5, time.Millisecond, func(ctx context.Context, attempt int) error {
+		calls++
+		if attempt != calls {
+			t.Errorf("Expected attempt %d, got %d", calls, attempt)
+		}
+		if calls < 3 {
+			return errors.New("transient")
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Expected success, got %v", err)
+	}
+	if calls != 3 {
+		t.Errorf("Expected 3 calls, got %d", calls)
+	}
+}
+
+func TestRetryWrapsLastError(t *testing.T) {
+	lastErr := errors.New("attempt 4 failed")
+	calls := 0
+	err := Retry(context.Background(), 4, time.Millisecond, func(ctx context.Context, attempt int) error {
+		calls++
+		if attempt == 4 {
+			return lastErr
+		}
+		return errors.New("earlier failure")
+	})
+	if calls != 4 {
+		t.Errorf("Expected 4 calls, got %d", calls)
+	}
+	if !errors.Is(err, lastErr) {
+		t.Errorf("Expected error wrapping the last failure, got %v", err)
+	}
+	if err == nil || !strings.Contains(err.Error(), "4 attempts") {
+		t.Errorf("Expected error to report the attempt count, got %v", err)
+	}
+}
+
+func TestRetryStopsOnCancel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	calls := 0
+	start := time.Now()
+	err := Retry(ctx, 10, time.Hour, func(ctx context.Context, attempt int) error {
+		calls++
+		cancel()
+		return errors.New("failed")
+	})
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("Expected cancellation error, got %v", err)
+	}
+	if calls != 1 {
+		t.Errorf("Expected 1 call before cancellation, got %d", calls)
+	}
+	if time.Since(start) > time.Second {
+		t.Error("Retry kept waiting after cancellation")
+	}
+}
+
+func TestBackoffDelay(t *testing.T) {
+	base := 100 * time.Millisecond
+	for attempt := 1; attempt <= 5; attempt++ {
+		want := base << (attempt - 1)
+		for i := 0; i < 20; i++ {
+			delay := backoffDelay(base, attempt)
+			if delay < want || delay > want+want/2 {
+				t.Fatalf("Attempt %d: delay %v outside [%v, %v]", attempt, delay, want, want+want/2)
+			}
+		}
+	}
+}
@@ -0,0 +1,84 @@
+package common
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+
+	"github.com/alex-sviridov/miniprotector/common/config"
+)
+
+// ServerTLSConfig builds the writer TLS configuration from TLSCertFile and TLSKeyFile
+// Returns nil when TLS is not configured and the server should stay plaintext
+func ServerTLSConfig(conf *config.Config) (*tls.Config, error) {
+	if conf.TLSCertFile == "" && conf.TLSKeyFile == "" {
+		return nil, nil
+	}
+	if conf.TLSCertFile == "" || conf.TLSKeyFile == "" {
+		return nil, fmt.Errorf("TLS requires both TLSCertFile and TLSKeyFile")
+	}
+
+	cert, err := tls.LoadX509KeyPair(conf.TLSCertFile, conf.TLSKeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load TLS certificate: %w", err)
+	}
+
+	tlsConfig := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+
+	// Only readers with a certificate signed by the client CA may connect
+	if conf.TLSClientCAFile != "" {
+		pool, err := loadCertPool(conf.TLSClientCAFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.ClientCAs = pool
+		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return tlsConfig, nil
+}
+
+// ClientTLSConfig builds the reader TLS configuration trusting the CA from TLSCAFile
+// TLSCertFile and TLSKeyFile, when set, are presented as the client certificate
+// Returns nil when TLS is not configured and the client should stay plaintext
+func ClientTLSConfig(conf *config.Config) (*tls.Config, error) {
+	if conf.TLSCAFile == "" {
+		return nil, nil
+	}
+
+	pool, err := loadCertPool(conf.TLSCAFile)
+	if err != nil {
+		return nil, err
+	}
+
+	tlsConfig := &tls.Config{
+		RootCAs:    pool,
+		MinVersion: tls.VersionTLS12,
+	}
+
+	if conf.TLSCertFile != "" || conf.TLSKeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(conf.TLSCertFile, conf.TLSKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load TLS client certificate: %w", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	return tlsConfig, nil
+}
+
+// loadCertPool reads PEM encoded CA certificates from path
+func loadCertPool(path string) (*x509.CertPool, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read CA file: %w", err)
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("no valid certificates in CA file %s", path)
+	}
+	return pool, nil
+}
@@ -0,0 +1,41 @@
+package common
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/alex-sviridov/miniprotector/common/config"
+)
+
+func TestTLSConfigNotConfigured(t *testing.T) {
+	serverConfig, err := ServerTLSConfig(&config.Config{})
+	if err != nil || serverConfig != nil {
+		t.Errorf("Expected plaintext server, got %v, %v", serverConfig, err)
+	}
+	clientConfig, err := ClientTLSConfig(&config.Config{})
+	if err != nil || clientConfig != nil {
+		t.Errorf("Expected plaintext client, got %v, %v", clientConfig, err)
+	}
+}
+
+func TestTLSConfigErrors(t *testing.T) {
+	dir := t.TempDir()
+	garbage := filepath.Join(dir, "garbage.pem")
+	if err := os.WriteFile(garbage, []byte("not a certificate"), 0600); err != nil {
+		t.Fatalf("Failed to write file: %v", err)
+	}
+
+	if _, err := ServerTLSConfig(&config.Config{TLSCertFile: garbage}); err == nil {
+		t.Error("Expected error for certificate without key")
+	}
+	if _, err := ServerTLSConfig(&config.Config{TLSCertFile: garbage, TLSKeyFile: garbage}); err == nil {
+		t.Error("Expected error for invalid key pair")
+	}
+	if _, err := ClientTLSConfig(&config.Config{TLSCAFile: garbage}); err == nil {
+		t.Error("Expected error for CA file without certificates")
+	}
+	if _, err := ClientTLSConfig(&config.Config{TLSCAFile: filepath.Join(dir, "missing.pem")}); err == nil {
+		t.Error("Expected error for missing CA file")
+	}
+}
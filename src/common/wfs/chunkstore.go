@@ -0,0 +1,238 @@
+package wfs
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/alex-sviridov/miniprotector/common/chunker"
+)
+
+// chunkStore keeps chunk data content-addressed under <storagePath>/chunks.
+// A chunk lives in chunks/<first two hex digits of its checksum>/<checksum>,
+// so identical chunks of different files or versions are stored once.
+// A compressed chunk has the extension of its codec, see chunkExtensions,
+// followed by encryptedExtension when it is encrypted.
+type chunkStore struct {
+	root        string
+	fsync       *fsyncLimiter
+	compression string       // Codec for new chunks, chunks it doesn't shrink are stored raw
+	cipher      *chunkCipher // Encrypts new chunks and decrypts stored ones, nil for plaintext storage
+}
+
+// chunkFile is where and how a chunk is stored
+type chunkFile struct {
+	path      string
+	codec     string
+	encrypted bool
+}
+
+// chunkExtensions maps each codec to the extension of the chunk files it compressed
+var chunkExtensions = map[string]string{
+	chunker.CompressionNone: "",
+	chunker.CompressionGzip: ".gz",
+}
+
+func newChunkStore(storagePath string, fsync *fsyncLimiter, compression string) (*chunkStore, error) {
+	if !chunker.ValidCompression(compression) {
+		return nil, fmt.Errorf("unsupported compression %q", compression)
+	}
+	root := filepath.Join(storagePath, "chunks")
+	if err := os.MkdirAll(root, 0700); err != nil {
+		return nil, fmt.Errorf("failed to create chunk directory %s: %w", root, err)
+	}
+	return &chunkStore{root: root, fsync: fsync, compression: compression}, nil
+}
+
+// path returns where the chunk with the given checksum is stored uncompressed
+func (cs *chunkStore) path(checksum string) (string, error) {
+	algo, digest := chunker.SplitChecksum(checksum)
+	if algo == "" || !chunker.ValidHashAlgo(algo) || len(digest) < 2 {
+		return "", fmt.Errorf("invalid chunk checksum %q", checksum)
+	}
+	if _, err := hex.DecodeString(digest); err != nil {
+		return "", fmt.Errorf("invalid chunk checksum %q", checksum)
+	}
+	return filepath.Join(cs.root, digest[:2], checksum), nil
+}
+
+// locate returns the file holding a stored chunk.
+// The error wraps fs.ErrNotExist when the chunk isn't stored.
+func (cs *chunkStore) locate(checksum string) (chunkFile, error) {
+	raw, err := cs.path(checksum)
+	if err != nil {
+		return chunkFile{}, err
+	}
+	for codec, ext := range chunkExtensions {
+		for _, encrypted := range []bool{false, true} {
+			path := raw + ext
+			if encrypted {
+				path += encryptedExtension
+			}
+			if _, err := os.Stat(path); err == nil {
+				return chunkFile{path: path, codec: codec, encrypted: encrypted}, nil
+			} else if !errors.Is(err, fs.ErrNotExist) {
+				return chunkFile{}, fmt.Errorf("failed to check chunk %s: %w", checksum, err)
+			}
+		}
+	}
+	return chunkFile{}, fmt.Errorf("chunk %s: %w", checksum, fs.ErrNotExist)
+}
+
+// put stores data under checksum after verifying it, unless the chunk is already stored.
+// Data is compressed, then encrypted when the store has a cipher.
+// It is written to a temporary file, synced and renamed, so a stored chunk is always complete.
+func (cs *chunkStore) put(checksum string, data []byte) error {
+	actual, err := chunker.ChecksumWith(chunker.ChecksumAlgo(checksum), data)
+	if err != nil {
+		return err
+	}
+	if actual != checksum {
+		return fmt.Errorf("chunk checksum mismatch: expected %s, got %s", checksum, actual)
+	}
+	stored, err := cs.locate(checksum)
+	if err == nil {
+		// Mark the chunk as in use so collect doesn't remove it before the file is recorded
+		now := time.Now()
+		if err := os.Chtimes(stored.path, now, now); err != nil {
+			return fmt.Errorf("failed to touch chunk %s: %w", checksum, err)
+		}
+		return nil
+	}
+	if !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+
+	data, codec, err := chunker.Compress(cs.compression, data)
+	if err != nil {
+		return err
+	}
+	path, err := cs.path(checksum)
+	if err != nil {
+		return err
+	}
+	path += chunkExtensions[codec]
+	if cs.cipher != nil {
+		if data, err = cs.cipher.seal(data, checksum); err != nil {
+			return fmt.Errorf("failed to encrypt chunk %s: %w", checksum, err)
+		}
+		path += encryptedExtension
+	}
+
+	dir := filepath.Dir(path)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return fmt.Errorf("failed to create chunk directory %s: %w", dir, err)
+	}
+	tmp, err := os.CreateTemp(dir, checksum+".tmp*")
+	if err != nil {
+		return fmt.Errorf("failed to create chunk file: %w", err)
+	}
+	defer os.Remove(tmp.Name()) // No-op once renamed
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write chunk %s: %w", checksum, err)
+	}
+	if err := cs.fsync.sync(tmp); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to sync chunk %s: %w", checksum, err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to close chunk %s: %w", checksum, err)
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return fmt.Errorf("failed to store chunk %s: %w", checksum, err)
+	}
+	// The chunk is only durable once its directory entry is
+	if err := cs.fsync.syncDir(dir); err != nil {
+		return fmt.Errorf("failed to sync chunk directory %s: %w", dir, err)
+	}
+	return nil
+}
+
+// get returns the data of a stored chunk, decrypted, decompressed and verified not to be corrupted on disk
+func (cs *chunkStore) get(checksum string) ([]byte, error) {
+	file, err := cs.locate(checksum)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read chunk: %w", err)
+	}
+	return cs.read(file, checksum)
+}
+
+// read returns the data of a chunk file and checks it against checksum
+func (cs *chunkStore) read(file chunkFile, checksum string) ([]byte, error) {
+	stored, err := os.ReadFile(file.path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read chunk %s: %w", checksum, err)
+	}
+	if file.encrypted {
+		if cs.cipher == nil {
+			return nil, fmt.Errorf("chunk %s is encrypted and no key is configured", checksum)
+		}
+		if stored, err = cs.cipher.open(stored, checksum); err != nil {
+			return nil, fmt.Errorf("failed to decrypt chunk %s: %w", checksum, err)
+		}
+	}
+	data, err := chunker.Decompress(file.codec, stored)
+	if err != nil {
+		return nil, fmt.Errorf("chunk %s is corrupted: %w", checksum, err)
+	}
+	actual, err := chunker.ChecksumWith(chunker.ChecksumAlgo(checksum), data)
+	if err != nil {
+		return nil, err
+	}
+	if actual != checksum {
+		return nil, fmt.Errorf("chunk %s is corrupted, content hashes to %s", checksum, actual)
+	}
+	return data, nil
+}
+
+// collect removes stored chunks for which referenced returns false.
+// Chunks written or reused at or after before are kept, they may belong to a file
+// still being received and not recorded yet.
+// Leftover temporary files older than before are removed too.
+func (cs *chunkStore) collect(referenced func(checksum string) bool, before time.Time) (removed int, err error) {
+	err = filepath.WalkDir(cs.root, func(path string, d os.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			return nil
+		}
+		name := d.Name()
+		if !strings.Contains(name, ".tmp") && referenced(chunkChecksum(name)) {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		if !info.ModTime().Before(before) {
+			return nil
+		}
+		if err := os.Remove(path); err != nil {
+			return fmt.Errorf("failed to remove chunk %s: %w", name, err)
+		}
+		if !strings.Contains(name, ".tmp") {
+			removed++
+		}
+		return nil
+	})
+	return removed, err
+}
+
+// chunkChecksum returns the checksum of the chunk stored in the file with this name
+func chunkChecksum(name string) string {
+	name = strings.TrimSuffix(name, encryptedExtension)
+	for _, ext := range chunkExtensions {
+		if ext != "" && strings.HasSuffix(name, ext) {
+			return strings.TrimSuffix(name, ext)
+		}
+	}
+	return name
+}
@@ -0,0 +1,162 @@
+package wfs
+
+import (
+	"bytes"
+	"crypto/rand"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/alex-sviridov/miniprotector/common/chunker"
+	"github.com/alex-sviridov/miniprotector/common/config"
+	"github.com/alex-sviridov/miniprotector/common/files"
+)
+
+func TestChunkStoreLayout(t *testing.T) {
+	store, err := newChunkStore(t.TempDir(), newFsyncLimiter(0), "")
+	if err != nil {
+		t.Fatalf("Failed to create chunk store: %v", err)
+	}
+	data := []byte("chunk data")
+	checksum := chunker.Checksum(data)
+
+	if err := store.put(checksum, data); err != nil {
+		t.Fatalf("Failed to store chunk: %v", err)
+	}
+	// Storing the same chunk again is a no-op
+	if err := store.put(checksum, data); err != nil {
+		t.Fatalf("Failed to store duplicate chunk: %v", err)
+	}
+
+	stored, err := os.ReadFile(filepath.Join(store.root, checksum[:2], checksum))
+	if err != nil {
+		t.Fatalf("Chunk not at its content address: %v", err)
+	}
+	if !bytes.Equal(stored, data) {
+		t.Error("Stored chunk doesn't match the data")
+	}
+	entries, _ := os.ReadDir(filepath.Join(store.root, checksum[:2]))
+	if len(entries) != 1 {
+		t.Errorf("Expected only the chunk file, found %d entries", len(entries))
+	}
+}
+
+func TestChunkStoreCompression(t *testing.T) {
+	store, err := newChunkStore(t.TempDir(), newFsyncLimiter(0), chunker.CompressionGzip)
+	if err != nil {
+		t.Fatalf("Failed to create chunk store: %v", err)
+	}
+	random := make([]byte, 64*1024)
+	rand.Read(random)
+	stored := make(map[string]bool)
+
+	for _, test := range []struct {
+		name string
+		data []byte
+		file string // Extension of the stored chunk
+	}{
+		{"compressible", bytes.Repeat([]byte("compressible data "), 4096), ".gz"},
+		{"random", random, ""},
+	} {
+		checksum := chunker.Checksum(test.data)
+		if err := store.put(checksum, test.data); err != nil {
+			t.Fatalf("Failed to store %s chunk: %v", test.name, err)
+		}
+		path, _ := store.path(checksum)
+		info, err := os.Stat(path + test.file)
+		if err != nil {
+			t.Fatalf("The %s chunk isn't stored as %q: %v", test.name, test.file, err)
+		}
+		if test.file != "" && info.Size() >= int64(len(test.data)) {
+			t.Errorf("Compressed %s chunk is %d bytes, no smaller than %d", test.name, info.Size(), len(test.data))
+		}
+		data, err := store.get(checksum)
+		if err != nil {
+			t.Fatalf("Failed to read %s chunk: %v", test.name, err)
+		}
+		if !bytes.Equal(data, test.data) {
+			t.Errorf("The %s chunk doesn't round-trip", test.name)
+		}
+		// Garbage collection matches the chunk by checksum whatever its extension
+		stored[checksum] = true
+		removed, err := store.collect(func(c string) bool { return stored[c] }, time.Now().Add(time.Hour))
+		if err != nil || removed != 0 {
+			t.Errorf("Collect removed %d referenced chunks: %v", removed, err)
+		}
+	}
+
+	// Chunks stored raw before compression was enabled stay readable
+	raw, err := newChunkStore(filepath.Dir(store.root), newFsyncLimiter(0), chunker.CompressionNone)
+	if err != nil {
+		t.Fatalf("Failed to reopen chunk store: %v", err)
+	}
+	data := bytes.Repeat([]byte("compressible data "), 4096)
+	if _, err := raw.get(chunker.Checksum(data)); err != nil {
+		t.Errorf("Failed to read a compressed chunk without compression enabled: %v", err)
+	}
+}
+
+func TestChunkStoreRejectsBadData(t *testing.T) {
+	store, err := newChunkStore(t.TempDir(), newFsyncLimiter(0), "")
+	if err != nil {
+		t.Fatalf("Failed to create chunk store: %v", err)
+	}
+	if err := store.put(chunker.Checksum([]byte("expected")), []byte("actual")); err == nil {
+		t.Error("Expected error storing data that doesn't match its checksum")
+	}
+	if err := store.put("../../etc", nil); err == nil {
+		t.Error("Expected error for a checksum that isn't hex")
+	}
+
+	// A chunk corrupted on disk is detected on read
+	data := []byte("chunk data")
+	checksum := chunker.Checksum(data)
+	if err := store.put(checksum, data); err != nil {
+		t.Fatalf("Failed to store chunk: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(store.root, checksum[:2], checksum), []byte("garbage"), 0600); err != nil {
+		t.Fatalf("Failed to corrupt chunk: %v", err)
+	}
+	if _, err := store.get(checksum); err == nil {
+		t.Error("Expected error reading a corrupted chunk")
+	}
+}
+
+func TestReadFileFromChunks(t *testing.T) {
+	writer := setupTestWriter(t, &config.Config{})
+	parts := [][]byte{[]byte("first part, "), []byte("second part, "), []byte("first part, ")}
+
+	var content []byte
+	var chunks []ChunkRef
+	for _, part := range parts {
+		checksum := chunker.Checksum(part)
+		if err := writer.StoreChunk(checksum, part); err != nil {
+			t.Fatalf("Failed to store chunk: %v", err)
+		}
+		chunks = append(chunks, ChunkRef{Offset: int64(len(content)), Size: int64(len(part)), Checksum: checksum})
+		content = append(content, part...)
+	}
+
+	fileInfo := &files.FileInfo{Host: "host1", Path: "/data/file.txt", Name: "file.txt", Size: int64(len(content)), ModTime: time.Now()}
+	if err := writer.AddFileChunks(fileInfo, chunker.Checksum(content), chunks); err != nil {
+		t.Fatalf("Failed to add file: %v", err)
+	}
+
+	var out bytes.Buffer
+	if err := writer.ReadFile(fileInfo.Path, fileInfo.Host, &out); err != nil {
+		t.Fatalf("ReadFile failed: %v", err)
+	}
+	if !bytes.Equal(out.Bytes(), content) {
+		t.Errorf("ReadFile = %q, expected %q", out.Bytes(), content)
+	}
+
+	// A wrong whole-file checksum is reported
+	fileInfo.ModTime = fileInfo.ModTime.Add(time.Second)
+	if err := writer.AddFileChunks(fileInfo, chunker.Checksum([]byte("other")), chunks); err != nil {
+		t.Fatalf("Failed to add file: %v", err)
+	}
+	if err := writer.ReadFile(fileInfo.Path, fileInfo.Host, &bytes.Buffer{}); err == nil {
+		t.Error("Expected checksum error")
+	}
+}
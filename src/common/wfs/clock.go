@@ -0,0 +1,76 @@
+package wfs
+
+import (
+	"database/sql"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// storedTimeLayouts are the layouts the sqlite3 driver parses DATETIME text with, it writes the first
+var storedTimeLayouts = []string{
+	"2006-01-02 15:04:05.999999999-07:00",
+	"2006-01-02T15:04:05.999999999-07:00",
+	"2006-01-02 15:04:05.999999999",
+	"2006-01-02T15:04:05.999999999",
+	"2006-01-02 15:04:05",
+	"2006-01-02T15:04:05",
+	"2006-01-02 15:04",
+	"2006-01-02T15:04",
+	"2006-01-02",
+}
+
+// backupClock hands out strictly increasing backup times, so versions of a file
+// added in quick succession or after the wall clock steps backwards never collide
+// on UNIQUE(path, source_host, backup_time)
+type backupClock struct {
+	mu   sync.Mutex
+	last time.Time
+	now  func() time.Time // Wall clock, replaceable in tests
+}
+
+func newBackupClock() *backupClock {
+	return &backupClock{now: time.Now}
+}
+
+// seed makes the clock hand out times after latest, when it is past the last one handed out
+func (c *backupClock) seed(latest time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if latest.After(c.last) {
+		c.last = latest.Round(0)
+	}
+}
+
+// next returns the current wall time, or 1µs after the previous result if the clock hasn't moved past it
+func (c *backupClock) next() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	// Drop the monotonic reading, comparisons must use the wall time that gets stored
+	now := c.now().Round(0)
+	if !now.After(c.last) {
+		now = c.last.Add(time.Microsecond)
+	}
+	c.last = now
+	return now
+}
+
+// seedClock starts the backup clock after the latest backup time stored, so versions added after
+// a restart with the wall clock behind it don't collide with earlier ones
+func (fdb *fileDB) seedClock() error {
+	var latest sql.NullString // MAX loses the column type, the driver returns the stored text
+	if err := fdb.db.QueryRow(`SELECT MAX(backup_time) FROM files`).Scan(&latest); err != nil {
+		return fmt.Errorf("failed to read the latest backup time: %w", err)
+	}
+	if !latest.Valid {
+		return nil
+	}
+	for _, layout := range storedTimeLayouts {
+		if t, err := time.ParseInLocation(layout, latest.String, time.UTC); err == nil {
+			fdb.clock.seed(t)
+			return nil
+		}
+	}
+	return fmt.Errorf("invalid latest backup time %q", latest.String)
+}
@@ -0,0 +1,37 @@
+package wfs
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBackupClock(t *testing.T) {
+	base := time.Date(2025, 1, 1, 12, 0, 0, 0, time.UTC)
+	readings := []time.Time{
+		base,
+		base,                       // Clock didn't advance
+		base.Add(-time.Hour),       // Clock stepped backwards
+		base.Add(time.Second),      // Clock moved on
+		base.Add(time.Millisecond), // Behind the last result again
+	}
+
+	clock := newBackupClock()
+	i := 0
+	clock.now = func() time.Time {
+		reading := readings[i]
+		i++
+		return reading
+	}
+
+	var previous time.Time
+	for range readings {
+		got := clock.next()
+		if !got.After(previous) {
+			t.Fatalf("Expected %v to be after %v", got, previous)
+		}
+		previous = got
+	}
+	if !previous.Equal(base.Add(time.Second + time.Microsecond)) {
+		t.Errorf("Expected clock to continue from its last result, got %v", previous)
+	}
+}
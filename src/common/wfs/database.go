@@ -7,6 +7,7 @@ import (
 	"log/slog"
 	"os"
 	"path/filepath"
+	"strings"
 	"time"
 
 	"github.com/alex-sviridov/miniprotector/common/config"
@@ -14,6 +15,18 @@ import (
 	_ "github.com/mattn/go-sqlite3"
 )
 
+// ChunkRef locates a piece of file data in the chunk store
+type ChunkRef struct {
+	Offset   int64  `json:"offset"`
+	Size     int64  `json:"size"`
+	Checksum string `json:"checksum"`
+}
+
+// execer is implemented by both *sql.DB and *sql.Tx
+type execer interface {
+	Exec(query string, args ...any) (sql.Result, error)
+}
+
 // FileMetadata represents file information stored in the database
 // This extends your FileInfo with database-specific fields
 type FileMetadata struct {
@@ -23,6 +36,10 @@ type FileMetadata struct {
 	BackupTime        time.Time      `json:"backup_time"`
 	Checksum          string         `json:"checksum"`
 	MetadataUpdatedAt time.Time      `json:"metadata_updated_at"`
+	// FileType is the type character of FileInfo.GetType when the version was stored
+	FileType string `json:"file_type"`
+	// DeletedAt is when the file was found deleted at the source, zero while it exists
+	DeletedAt time.Time `json:"deleted_at,omitempty"`
 }
 
 // fileDB provides SQLite operations for file metadata
@@ -30,6 +47,33 @@ type fileDB struct {
 	db     *sql.DB
 	config *config.Config
 	logger *slog.Logger
+	clock  *backupClock
+}
+
+// SQLite settings used when the config leaves them unset
+const (
+	defaultJournalMode   = "WAL"
+	defaultSynchronous   = "NORMAL"
+	defaultBusyTimeoutMs = 5000
+)
+
+// sqliteDSN adds the connection settings to the database path. They go in the DSN rather than
+// in PRAGMA statements run after opening, as the driver applies them to every pooled connection.
+// Transactions take the write lock when they begin, a deferred one upgrading from a read lock
+// fails with SQLITE_BUSY without waiting for the busy timeout.
+func sqliteDSN(dbPath string, conf *config.Config) string {
+	journalMode, synchronous, busyTimeout := defaultJournalMode, defaultSynchronous, defaultBusyTimeoutMs
+	if conf.SQLiteJournalMode != "" {
+		journalMode = conf.SQLiteJournalMode
+	}
+	if conf.SQLiteSynchronous != "" {
+		synchronous = conf.SQLiteSynchronous
+	}
+	if conf.SQLiteBusyTimeoutMs > 0 {
+		busyTimeout = conf.SQLiteBusyTimeoutMs
+	}
+	return fmt.Sprintf("%s?_journal_mode=%s&_synchronous=%s&_busy_timeout=%d&_txlock=immediate",
+		dbPath, journalMode, synchronous, busyTimeout)
 }
 
 // newDB creates a new fileDB instance and initializes the database
@@ -49,13 +93,14 @@ func newDB(config *config.Config, logger *slog.Logger, dbPath string) (*fileDB,
 		dbPath = filepath.Join(dbPath, "wfs.db")
 	}
 
-	db, err := sql.Open("sqlite3", dbPath)
+	db, err := sql.Open("sqlite3", sqliteDSN(dbPath, config))
 	if err != nil {
 		return nil, fmt.Errorf("failed to open database: %w", err)
 	}
 
 	// Test the connection
 	if err := db.Ping(); err != nil {
+		db.Close()
 		return nil, fmt.Errorf("failed to ping database: %w", err)
 	}
 
@@ -63,90 +108,460 @@ func newDB(config *config.Config, logger *slog.Logger, dbPath string) (*fileDB,
 		db:     db,
 		config: config,
 		logger: logger,
+		clock:  newBackupClock(),
 	}
 
-	// Initialize the schema
-	if err := fileDB.initSchema(); err != nil {
+	// Create the schema or upgrade it from an older version
+	if err := fileDB.migrate(); err != nil {
+		db.Close()
 		return nil, fmt.Errorf("failed to initialize schema: %w", err)
 	}
+	if err := fileDB.seedClock(); err != nil {
+		db.Close()
+		return nil, err
+	}
 
 	return fileDB, nil
 }
 
-// initSchema creates the files table if it doesn't exist
-func (fdb *fileDB) initSchema() error {
-	createTableSQL := `
-	CREATE TABLE IF NOT EXISTS files (
-		id INTEGER PRIMARY KEY AUTOINCREMENT,
-		path TEXT NOT NULL,
-		name TEXT NOT NULL,
-		size INTEGER NOT NULL,
-		mode INTEGER NOT NULL,
-		owner INTEGER NOT NULL,
-		group_id INTEGER NOT NULL,
-		modtime DATETIME NOT NULL,
-		access_time DATETIME NOT NULL,
-		ctime DATETIME NOT NULL,
-		acl TEXT NOT NULL DEFAULT '{}',
-		source_host TEXT NOT NULL,
-		backup_time DATETIME NOT NULL,
-		checksum TEXT DEFAULT '',
-		metadata_updated_at DATETIME DEFAULT CURRENT_TIMESTAMP,
-		UNIQUE(path, source_host, backup_time)
-	);
-
-	CREATE INDEX IF NOT EXISTS idx_path_sourcehost ON files(path, source_host);
-	CREATE INDEX IF NOT EXISTS idx_path_sourcehost_modtime ON files(path, source_host, modtime);
-	CREATE INDEX IF NOT EXISTS idx_checksum ON files(checksum);
-	`
+// AddFile inserts a new file record into the database
+func (fdb *fileDB) addFile(fileInfo *files.FileInfo, checksum string) (*FileMetadata, error) {
+	return fdb.addFileWithContent(fileInfo, checksum, nil)
+}
 
-	_, err := fdb.db.Exec(createTableSQL)
-	return err
+// addFileWithContent inserts a new file record, keeping content inline in the database
+// A nil content means the file data is stored outside the database
+func (fdb *fileDB) addFileWithContent(fileInfo *files.FileInfo, checksum string, content []byte) (*FileMetadata, error) {
+	return fdb.insertFile(fdb.db, fileInfo, checksum, content)
 }
 
-// AddFile inserts a new file record into the database
-func (fdb *fileDB) addFile(fileInfo *files.FileInfo, checksum string) error {
-	// Serialize ACL to JSON
-	aclJSON, err := json.Marshal(fileInfo.ACL)
+// addFiles inserts several file records, whose data is stored outside the database, in one transaction.
+// checksums[i] is the checksum of files[i]. Either every file is recorded or none is.
+func (fdb *fileDB) addFiles(fileInfos []*files.FileInfo, checksums []string) error {
+	if len(checksums) != len(fileInfos) {
+		return fmt.Errorf("got %d checksums for %d files", len(checksums), len(fileInfos))
+	}
+	if len(fileInfos) == 0 {
+		return nil
+	}
+
+	tx, err := fdb.db.Begin()
 	if err != nil {
-		return fmt.Errorf("failed to serialize ACL: %w", err)
+		return fmt.Errorf("failed to begin transaction: %w", err)
 	}
+	defer tx.Rollback()
 
-	query := `
+	stmt, err := tx.Prepare(insertFileQuery)
+	if err != nil {
+		return fmt.Errorf("failed to prepare file insert: %w", err)
+	}
+	defer stmt.Close()
+
+	for i, fileInfo := range fileInfos {
+		if _, err := fdb.insertFileWith(stmt.Exec, fileInfo, checksums[i], nil); err != nil {
+			return fmt.Errorf("failed to add %s: %w", fileInfo.Path, err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit %d files: %w", len(fileInfos), err)
+	}
+	return nil
+}
+
+// addFileWithChunks inserts a new file record together with the chunks holding its data, in file order
+func (fdb *fileDB) addFileWithChunks(fileInfo *files.FileInfo, checksum string, chunks []ChunkRef) (*FileMetadata, error) {
+	tx, err := fdb.db.Begin()
+	if err != nil {
+		return nil, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	file, err := fdb.insertFile(tx, fileInfo, checksum, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	stmt, err := tx.Prepare(`INSERT INTO file_chunks (file_id, seq, chunk_offset, size, checksum) VALUES (?, ?, ?, ?, ?)`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to prepare chunk insert: %w", err)
+	}
+	defer stmt.Close()
+
+	for i, chunk := range chunks {
+		if _, err := stmt.Exec(file.ID, i, chunk.Offset, chunk.Size, chunk.Checksum); err != nil {
+			return nil, fmt.Errorf("failed to insert chunk %d of %s: %w", i, fileInfo.Path, err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("failed to commit file %s: %w", fileInfo.Path, err)
+	}
+	return file, nil
+}
+
+// insertFileQuery adds one file version, see insertFileWith for the arguments
+const insertFileQuery = `
 	INSERT INTO files (
 		backup_time, source_host, path, name, size, mode, owner, group_id, 
-		modtime, access_time, ctime, acl, checksum, metadata_updated_at
-	) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+		modtime, access_time, ctime, acl, file_type, symlink_target, checksum, content, metadata_updated_at,
+		dev, ino, nlink
+	) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
 	`
 
-	now := time.Now()
-	result, err := fdb.db.Exec(query,
+// insertFile writes a file record through db, which may be a transaction
+func (fdb *fileDB) insertFile(db execer, fileInfo *files.FileInfo, checksum string, content []byte) (*FileMetadata, error) {
+	return fdb.insertFileWith(func(args ...any) (sql.Result, error) {
+		return db.Exec(insertFileQuery, args...)
+	}, fileInfo, checksum, content)
+}
+
+// insertFileWith writes a file record by running insertFileQuery through exec,
+// either directly or as a prepared statement
+func (fdb *fileDB) insertFileWith(exec func(args ...any) (sql.Result, error), fileInfo *files.FileInfo, checksum string, content []byte) (*FileMetadata, error) {
+	// Serialize ACL to JSON
+	aclJSON, err := json.Marshal(fileInfo.ACL)
+	if err != nil {
+		return nil, fmt.Errorf("failed to serialize ACL: %w", err)
+	}
+
+	// Bind NULL explicitly, an empty file stored inline has non-nil empty content
+	var contentArg any
+	if content != nil {
+		contentArg = content
+	}
+
+	now := fdb.clock.next()
+	fileType := string(fileInfo.GetType())
+	result, err := exec(
 		now, fileInfo.Host, fileInfo.Path, fileInfo.Name, fileInfo.Size, fileInfo.Mode,
-		fileInfo.Owner, fileInfo.Group, fileInfo.ModTime, fileInfo.AccessTime, fileInfo.CTime,
-		string(aclJSON), checksum, now,
+		fileInfo.Owner, fileInfo.Group, fileInfo.ModTime, fileInfo.AccessTime, fileInfo.ChangeTime,
+		string(aclJSON), fileType, fileInfo.SymlinkTarget, checksum, contentArg, now,
+		int64(fileInfo.Dev), int64(fileInfo.Ino), fileInfo.Nlink,
 	)
 	if err != nil {
-		return fmt.Errorf("failed to insert file: %w", err)
+		return nil, fmt.Errorf("failed to insert file: %w", err)
 	}
 
-	_, err = result.LastInsertId()
+	id, err := result.LastInsertId()
 	if err != nil {
-		return fmt.Errorf("failed to get last insert ID: %w", err)
+		return nil, fmt.Errorf("failed to get last insert ID: %w", err)
 	}
 
+	return &FileMetadata{
+		ID:                id,
+		FileInfo:          *fileInfo,
+		SourceHost:        fileInfo.Host,
+		BackupTime:        now,
+		Checksum:          checksum,
+		MetadataUpdatedAt: now,
+		FileType:          fileType,
+	}, nil
+}
+
+// getContent returns the inline content of the latest version of a file
+// ok is false when that version keeps its data outside the database
+func (fdb *fileDB) getContent(path, host string) (content []byte, ok bool, err error) {
+	query := `
+	SELECT content IS NOT NULL, content
+	FROM files
+	WHERE path = ? AND source_host = ?
+	ORDER BY backup_time DESC
+	LIMIT 1
+	`
+
+	err = fdb.db.QueryRow(query, path, host).Scan(&ok, &content)
+	if err == sql.ErrNoRows {
+		return nil, false, fmt.Errorf("file not found: %s", path)
+	}
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to get file content: %w", err)
+	}
+	if ok && content == nil {
+		content = []byte{}
+	}
+	return content, ok, nil
+}
+
+// getContentByID returns the inline content of a file version, ok is false when its data is in chunks
+func (fdb *fileDB) getContentByID(id int64) (content []byte, ok bool, err error) {
+	err = fdb.db.QueryRow(`SELECT content IS NOT NULL, content FROM files WHERE id = ?`, id).Scan(&ok, &content)
+	if err == sql.ErrNoRows {
+		return nil, false, fmt.Errorf("file version %d not found", id)
+	}
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to get file content: %w", err)
+	}
+	if ok && content == nil {
+		content = []byte{}
+	}
+	return content, ok, nil
+}
+
+// getChunks returns the chunks of a file version in file order
+func (fdb *fileDB) getChunks(fileID int64) ([]ChunkRef, error) {
+	query := `SELECT chunk_offset, size, checksum FROM file_chunks WHERE file_id = ? ORDER BY seq`
+
+	rows, err := fdb.db.Query(query, fileID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query chunks: %w", err)
+	}
+	defer rows.Close()
+
+	var chunks []ChunkRef
+	for rows.Next() {
+		var chunk ChunkRef
+		if err := rows.Scan(&chunk.Offset, &chunk.Size, &chunk.Checksum); err != nil {
+			return nil, fmt.Errorf("failed to scan chunk row: %w", err)
+		}
+		chunks = append(chunks, chunk)
+	}
+	return chunks, rows.Err()
+}
+
+// pruneVersions deletes old versions of every path of a host, with their chunk lists, in a single
+// transaction. A version is deleted when it is not among the keepLast most recent versions of its
+// path, or when it was backed up before olderThan. keepLast below 1 and a zero olderThan disable
+// their rule. The latest version of a path is never deleted. Returns the number of versions deleted.
+func (fdb *fileDB) pruneVersions(host string, keepLast int, olderThan time.Time) (int, error) {
+	var rules []string
+	args := []any{host}
+	if keepLast > 0 {
+		rules = append(rules, "version > ?")
+		args = append(args, keepLast)
+	}
+	if !olderThan.IsZero() {
+		// Compared as julian days, stored times may carry different UTC offsets
+		rules = append(rules, "julianday(backup_time) < julianday(?)")
+		args = append(args, olderThan)
+	}
+	if len(rules) == 0 {
+		return 0, nil
+	}
+
+	oldVersions := `
+	SELECT id FROM (
+		SELECT id, backup_time, ROW_NUMBER() OVER (PARTITION BY path ORDER BY backup_time DESC) AS version
+		FROM files WHERE source_host = ?
+	) WHERE version > 1 AND (` + strings.Join(rules, " OR ") + `)`
+
+	tx, err := fdb.db.Begin()
+	if err != nil {
+		return 0, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`DELETE FROM file_chunks WHERE file_id IN (`+oldVersions+`)`, args...); err != nil {
+		return 0, fmt.Errorf("failed to delete file chunks: %w", err)
+	}
+	result, err := tx.Exec(`DELETE FROM files WHERE id IN (`+oldVersions+`)`, args...)
+	if err != nil {
+		return 0, fmt.Errorf("failed to delete file versions: %w", err)
+	}
+	deleted, err := result.RowsAffected()
+	if err != nil {
+		return 0, fmt.Errorf("failed to get affected rows: %w", err)
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, fmt.Errorf("failed to commit prune: %w", err)
+	}
+	return int(deleted), nil
+}
+
+// referencedChunks returns the checksums of all chunks used by any recorded file version
+func (fdb *fileDB) referencedChunks() (map[string]bool, error) {
+	rows, err := fdb.db.Query(`SELECT DISTINCT checksum FROM file_chunks`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query chunks: %w", err)
+	}
+	defer rows.Close()
+
+	referenced := make(map[string]bool)
+	for rows.Next() {
+		var checksum string
+		if err := rows.Scan(&checksum); err != nil {
+			return nil, fmt.Errorf("failed to scan chunk row: %w", err)
+		}
+		referenced[checksum] = true
+	}
+	return referenced, rows.Err()
+}
+
+// expectAffected returns an error if the statement didn't change any row
+func expectAffected(result sql.Result, path string) error {
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("failed to get affected rows: %w", err)
+	}
+	if rows == 0 {
+		return fmt.Errorf("file not found: %s", path)
+	}
 	return nil
 }
 
-// FileExists checks if a file with the given path exists in the database for a specific host
+// FileStatus tells how a file compares to the versions stored for it
+type FileStatus int
+
+const (
+	// FileMissing means no version has this modtime, the data is needed
+	FileMissing FileStatus = iota
+	// FileUnchanged means the latest version with this modtime also has the same ctime
+	FileUnchanged
+	// FileMetadataChanged means the modtime matches but the ctime doesn't:
+	// only metadata such as mode or owner changed, see UpdateMetadataOnly
+	FileMetadataChanged
+)
+
+// statusFor compares a stored ctime with the one of a file found with the same modtime
+func statusFor(stored, current time.Time) FileStatus {
+	if stored.Equal(current) {
+		return FileUnchanged
+	}
+	return FileMetadataChanged
+}
+
+// FileExists checks if a file with the given path, modtime and ctime exists in the database for a specific host
 func (fdb *fileDB) fileExists(fileinfo *files.FileInfo) (bool, error) {
-	query := `SELECT COUNT(*) FROM files WHERE source_host = ? AND path = ? AND modtime = ?`
+	status, err := fdb.fileStatus(fileinfo)
+	return status == FileUnchanged, err
+}
 
-	var count int
-	err := fdb.db.QueryRow(query, fileinfo.Host, fileinfo.Path, fileinfo.ModTime).Scan(&count)
+// fileStatus compares a file with the latest stored version having the same host, path and modtime
+func (fdb *fileDB) fileStatus(fileinfo *files.FileInfo) (FileStatus, error) {
+	query := `
+	SELECT ctime FROM files
+	WHERE source_host = ? AND path = ? AND modtime = ? AND deleted_at IS NULL
+	ORDER BY backup_time DESC
+	LIMIT 1
+	`
+
+	var ctime time.Time
+	err := fdb.db.QueryRow(query, fileinfo.Host, fileinfo.Path, fileinfo.ModTime).Scan(&ctime)
+	if err == sql.ErrNoRows {
+		return FileMissing, nil
+	}
 	if err != nil {
-		return false, fmt.Errorf("failed to check file existence: %w", err)
+		return FileMissing, fmt.Errorf("failed to check file existence: %w", err)
 	}
-	return count > 0, nil
+	return statusFor(ctime, fileinfo.ChangeTime), nil
+}
+
+// filesExist checks a batch of files with a single query, see fileExists
+// The result has one entry per file, in the same order
+func (fdb *fileDB) filesExist(fileInfos []*files.FileInfo) ([]bool, error) {
+	statuses, err := fdb.filesStatus(fileInfos)
+	if err != nil {
+		return nil, err
+	}
+	exists := make([]bool, len(statuses))
+	for i, status := range statuses {
+		exists[i] = status == FileUnchanged
+	}
+	return exists, nil
+}
+
+// filesStatus is fileStatus for a batch of files, resolved with a single query
+// The result has one entry per file, in the same order
+func (fdb *fileDB) filesStatus(fileInfos []*files.FileInfo) ([]FileStatus, error) {
+	statuses := make([]FileStatus, len(fileInfos))
+	if len(fileInfos) == 0 {
+		return statuses, nil
+	}
+
+	values := make([]string, len(fileInfos))
+	args := make([]any, 0, 3*len(fileInfos))
+	for i, fileInfo := range fileInfos {
+		values[i] = "(?, ?, ?)"
+		args = append(args, fileInfo.Host, fileInfo.Path, fileInfo.ModTime)
+	}
+	// Ordered so that the latest version of each file is read last
+	query := `SELECT source_host, path, modtime, ctime FROM files
+	WHERE (source_host, path, modtime) IN (VALUES ` + strings.Join(values, ", ") + `) AND deleted_at IS NULL
+	ORDER BY backup_time`
+
+	rows, err := fdb.db.Query(query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to check file existence: %w", err)
+	}
+	defer rows.Close()
+
+	type fileKey struct {
+		host, path string
+		modTime    int64
+	}
+	found := make(map[fileKey]time.Time)
+	for rows.Next() {
+		var key fileKey
+		var modTime, ctime time.Time
+		if err := rows.Scan(&key.host, &key.path, &modTime, &ctime); err != nil {
+			return nil, fmt.Errorf("failed to check file existence: %w", err)
+		}
+		key.modTime = modTime.UnixNano()
+		found[key] = ctime
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to check file existence: %w", err)
+	}
+
+	for i, fileInfo := range fileInfos {
+		if ctime, ok := found[fileKey{fileInfo.Host, fileInfo.Path, fileInfo.ModTime.UnixNano()}]; ok {
+			statuses[i] = statusFor(ctime, fileInfo.ChangeTime)
+		}
+	}
+	return statuses, nil
+}
+
+// updateMetadata overwrites the metadata of the latest version with the same host, path and modtime,
+// keeping its data, checksum and backup time
+func (fdb *fileDB) updateMetadata(fileInfo *files.FileInfo) error {
+	aclJSON, err := json.Marshal(fileInfo.ACL)
+	if err != nil {
+		return fmt.Errorf("failed to serialize ACL: %w", err)
+	}
+
+	query := `
+	UPDATE files SET
+		name = ?, mode = ?, owner = ?, group_id = ?, access_time = ?, ctime = ?, acl = ?, metadata_updated_at = ?,
+		dev = ?, ino = ?, nlink = ?
+	WHERE id = (
+		SELECT id FROM files
+		WHERE source_host = ? AND path = ? AND modtime = ? AND deleted_at IS NULL
+		ORDER BY backup_time DESC
+		LIMIT 1
+	)
+	`
+
+	result, err := fdb.db.Exec(query,
+		fileInfo.Name, fileInfo.Mode, fileInfo.Owner, fileInfo.Group, fileInfo.AccessTime,
+		fileInfo.ChangeTime, string(aclJSON), time.Now(),
+		int64(fileInfo.Dev), int64(fileInfo.Ino), fileInfo.Nlink,
+		fileInfo.Host, fileInfo.Path, fileInfo.ModTime,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to update file metadata: %w", err)
+	}
+	return expectAffected(result, fileInfo.Path)
+}
+
+// cachedChecksum returns the checksum recorded for a file with the same host, path, modtime and size
+// Any change of modtime or size misses, so stale checksums are never returned
+func (fdb *fileDB) cachedChecksum(fileInfo *files.FileInfo) (string, bool, error) {
+	query := `
+	SELECT checksum FROM files
+	WHERE source_host = ? AND path = ? AND modtime = ? AND size = ? AND checksum != ''
+	ORDER BY backup_time DESC
+	LIMIT 1
+	`
+
+	var checksum string
+	err := fdb.db.QueryRow(query, fileInfo.Host, fileInfo.Path, fileInfo.ModTime, fileInfo.Size).Scan(&checksum)
+	if err == sql.ErrNoRows {
+		return "", false, nil
+	}
+	if err != nil {
+		return "", false, fmt.Errorf("failed to look up cached checksum: %w", err)
+	}
+	return checksum, true, nil
 }
 
 // FileExistsByChecksum checks if a file with the given checksum exists in the database
@@ -167,10 +582,21 @@ func (fdb *fileDB) fileExistsByChecksum(checksum string) (bool, error) {
 }
 
 // GetFile retrieves the latest file metadata by path and host
+// Returns nil when the file was deleted at the source, see getFileIncludingDeleted
 func (fdb *fileDB) getFile(path, host string) (*FileMetadata, error) {
+	file, err := fdb.getFileIncludingDeleted(path, host)
+	if err != nil || file == nil || !file.DeletedAt.IsZero() {
+		return nil, err
+	}
+	return file, nil
+}
+
+// getFileIncludingDeleted retrieves the latest file metadata by path and host,
+// even when the file was deleted at the source since that version was stored
+func (fdb *fileDB) getFileIncludingDeleted(path, host string) (*FileMetadata, error) {
 	query := `
 	SELECT id, path, name, size, mode, owner, group_id, modtime, access_time, ctime, acl,
-	       source_host, backup_time, checksum, metadata_updated_at
+	       file_type, symlink_target, source_host, backup_time, checksum, metadata_updated_at, deleted_at, dev, ino, nlink
 	FROM files 
 	WHERE path = ? AND source_host = ?
 	ORDER BY backup_time DESC
@@ -188,7 +614,7 @@ func (fdb *fileDB) getFileByChecksum(checksum string) (*FileMetadata, error) {
 
 	query := `
 	SELECT id, path, name, size, mode, owner, group_id, modtime, access_time, ctime, acl,
-	       source_host, backup_time, checksum, metadata_updated_at
+	       file_type, symlink_target, source_host, backup_time, checksum, metadata_updated_at, deleted_at, dev, ino, nlink
 	FROM files 
 	WHERE checksum = ? AND checksum != ''
 	ORDER BY backup_time DESC
@@ -198,10 +624,276 @@ func (fdb *fileDB) getFileByChecksum(checksum string) (*FileMetadata, error) {
 	return fdb.scanFileRow(fdb.db.QueryRow(query, checksum))
 }
 
+// forEachLatestFile calls fn with the latest version of every path stored for a host
+// and not deleted at the source, ordered by path. Rows are streamed, so memory use doesn't depend on the catalog size.
+func (fdb *fileDB) forEachLatestFile(host string, fn func(*FileMetadata) error) error {
+	query := `
+	SELECT id, path, name, size, mode, owner, group_id, modtime, access_time, ctime, acl,
+	       file_type, symlink_target, source_host, backup_time, checksum, metadata_updated_at, deleted_at, dev, ino, nlink
+	FROM files f
+	WHERE source_host = ? AND deleted_at IS NULL AND backup_time = (
+		SELECT MAX(backup_time) FROM files WHERE source_host = f.source_host AND path = f.path
+	)
+	ORDER BY path
+	`
+
+	rows, err := fdb.db.Query(query, host)
+	if err != nil {
+		return fmt.Errorf("failed to query files: %w", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		file, err := fdb.scanFileRow(rows)
+		if err != nil {
+			return err
+		}
+		if err := fn(file); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+// listFilesForHost returns the latest version of every path stored for a host and not deleted, ordered by path
+// forEachVersion calls fn for every stored version of every file of a host, deleted ones included,
+// ordered by path and backup time
+func (fdb *fileDB) forEachVersion(host string, fn func(*FileMetadata) error) error {
+	query := `
+	SELECT id, path, name, size, mode, owner, group_id, modtime, access_time, ctime, acl,
+	       file_type, symlink_target, source_host, backup_time, checksum, metadata_updated_at, deleted_at, dev, ino, nlink
+	FROM files
+	WHERE source_host = ?
+	ORDER BY path, julianday(backup_time)
+	`
+
+	rows, err := fdb.db.Query(query, host)
+	if err != nil {
+		return fmt.Errorf("failed to query files: %w", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		file, err := fdb.scanFileRow(rows)
+		if err != nil {
+			return err
+		}
+		if err := fn(file); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+// The whole list is kept in memory, forEachLatestFile streams it instead
+func (fdb *fileDB) listFilesForHost(host string) ([]FileMetadata, error) {
+	var list []FileMetadata
+	err := fdb.forEachLatestFile(host, func(file *FileMetadata) error {
+		list = append(list, *file)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return list, nil
+}
+
+// markDeleted records that a file no longer exists at the source.
+// Every stored version is marked, so the file counts as missing if it comes back,
+// while its versions stay available for restoring to an earlier point in time.
+func (fdb *fileDB) markDeleted(path, host string, deletedAt time.Time) error {
+	result, err := fdb.db.Exec(
+		`UPDATE files SET deleted_at = ? WHERE path = ? AND source_host = ? AND deleted_at IS NULL`,
+		deletedAt, path, host,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to mark file deleted: %w", err)
+	}
+	return expectAffected(result, path)
+}
+
+// saveStreamProgress records how far a stream of a job got, replacing what an earlier run of the job recorded
+func (fdb *fileDB) saveStreamProgress(host, jobID string, streamID int32, token string, progress StreamProgress) error {
+	_, err := fdb.db.Exec(
+		`INSERT INTO stream_progress (source_host, job_id, stream_id, resume_token, committed, last_file_id, updated_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT(source_host, job_id, stream_id) DO UPDATE SET
+			resume_token = excluded.resume_token,
+			committed = excluded.committed,
+			last_file_id = excluded.last_file_id,
+			updated_at = excluded.updated_at`,
+		host, jobID, streamID, token, progress.Committed, progress.LastFileID, time.Now(),
+	)
+	if err != nil {
+		return fmt.Errorf("failed to save stream progress: %w", err)
+	}
+	return nil
+}
+
+// getStreamProgress returns how far a stream of a job got, zero when nothing was recorded for that resume token
+func (fdb *fileDB) getStreamProgress(host, jobID string, streamID int32, token string) (StreamProgress, error) {
+	var progress StreamProgress
+	err := fdb.db.QueryRow(
+		`SELECT committed, last_file_id FROM stream_progress
+		WHERE source_host = ? AND job_id = ? AND stream_id = ? AND resume_token = ?`,
+		host, jobID, streamID, token,
+	).Scan(&progress.Committed, &progress.LastFileID)
+	if err == sql.ErrNoRows {
+		return StreamProgress{}, nil
+	}
+	if err != nil {
+		return StreamProgress{}, fmt.Errorf("failed to get stream progress: %w", err)
+	}
+	return progress, nil
+}
+
+// deleteStreamProgress drops the progress of every stream of a job
+func (fdb *fileDB) deleteStreamProgress(host, jobID string) error {
+	_, err := fdb.db.Exec(`DELETE FROM stream_progress WHERE source_host = ? AND job_id = ?`, host, jobID)
+	if err != nil {
+		return fmt.Errorf("failed to delete stream progress: %w", err)
+	}
+	return nil
+}
+
+// jobRunColumns are the job_runs columns scanJobRun reads, in order
+const jobRunColumns = `job_id, source_host, started_at, finished_at, files_scanned, files_stored,
+	files_skipped, files_failed, bytes_sent, errors, interrupted`
+
+// recordJobRun stores the summary of a backup run, replacing one recorded earlier for the same job
+func (fdb *fileDB) recordJobRun(run JobRun) error {
+	_, err := fdb.db.Exec(
+		`INSERT OR REPLACE INTO job_runs (`+jobRunColumns+`) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		run.JobID, run.Host, run.Started, run.Finished, run.FilesScanned, run.FilesStored,
+		run.FilesSkipped, run.FilesFailed, run.BytesSent, run.Errors, run.Interrupted,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to record job run: %w", err)
+	}
+	return nil
+}
+
+// scanJobRun reads a row of jobRunColumns
+func scanJobRun(row interface{ Scan(...any) error }) (JobRun, error) {
+	var run JobRun
+	err := row.Scan(&run.JobID, &run.Host, &run.Started, &run.Finished, &run.FilesScanned, &run.FilesStored,
+		&run.FilesSkipped, &run.FilesFailed, &run.BytesSent, &run.Errors, &run.Interrupted)
+	return run, err
+}
+
+// getJobRun returns the summary of a backup run
+func (fdb *fileDB) getJobRun(jobID string) (*JobRun, error) {
+	run, err := scanJobRun(fdb.db.QueryRow(`SELECT `+jobRunColumns+` FROM job_runs WHERE job_id = ?`, jobID))
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("job run not found: %s", jobID)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get job run: %w", err)
+	}
+	return &run, nil
+}
+
+// listJobRuns returns the summaries of the backup runs of a host, oldest first
+func (fdb *fileDB) listJobRuns(host string) ([]JobRun, error) {
+	rows, err := fdb.db.Query(`SELECT `+jobRunColumns+` FROM job_runs WHERE source_host = ? ORDER BY started_at, job_id`, host)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list job runs: %w", err)
+	}
+	defer rows.Close()
+
+	var runs []JobRun
+	for rows.Next() {
+		run, err := scanJobRun(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan job run: %w", err)
+		}
+		runs = append(runs, run)
+	}
+	return runs, rows.Err()
+}
+
+// filesAt returns, in path order, the version of root and of every file below it that was current
+// for a host at the given time: the last one backed up by then, unless it was already deleted
+func (fdb *fileDB) filesAt(host, root string, at time.Time) ([]FileMetadata, error) {
+	query := `
+	SELECT id, path, name, size, mode, owner, group_id, modtime, access_time, ctime, acl,
+	       file_type, symlink_target, source_host, backup_time, checksum, metadata_updated_at, deleted_at, dev, ino, nlink
+	FROM (
+		SELECT id, path, name, size, mode, owner, group_id, modtime, access_time, ctime, acl,
+		       file_type, symlink_target, source_host, backup_time, checksum, metadata_updated_at, deleted_at, dev, ino, nlink,
+		       ROW_NUMBER() OVER (PARTITION BY path ORDER BY julianday(backup_time) DESC) AS version
+		FROM files
+		WHERE source_host = ? AND (path = ? OR substr(path, 1, length(?)) = ?)
+		  AND julianday(backup_time) <= julianday(?)
+	)
+	WHERE version = 1 AND (deleted_at IS NULL OR julianday(deleted_at) > julianday(?))
+	ORDER BY path
+	`
+
+	prefix := strings.TrimSuffix(root, "/") + "/"
+	rows, err := fdb.db.Query(query, host, root, prefix, prefix, at, at)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query files: %w", err)
+	}
+	defer rows.Close()
+
+	var list []FileMetadata
+	for rows.Next() {
+		file, err := fdb.scanFileRow(rows)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, *file)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to query files: %w", err)
+	}
+	return list, nil
+}
+
+// listDeletedSince returns the latest version of every path of a host deleted at or after since, ordered by path
+func (fdb *fileDB) listDeletedSince(host string, since time.Time) ([]FileMetadata, error) {
+	query := `
+	SELECT id, path, name, size, mode, owner, group_id, modtime, access_time, ctime, acl,
+	       file_type, symlink_target, source_host, backup_time, checksum, metadata_updated_at, deleted_at, dev, ino, nlink
+	FROM files f
+	WHERE source_host = ? AND deleted_at >= ? AND backup_time = (
+		SELECT MAX(backup_time) FROM files WHERE source_host = f.source_host AND path = f.path
+	)
+	ORDER BY path
+	`
+
+	rows, err := fdb.db.Query(query, host, since)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query deleted files: %w", err)
+	}
+	defer rows.Close()
+
+	var list []FileMetadata
+	for rows.Next() {
+		file, err := fdb.scanFileRow(rows)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, *file)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to query deleted files: %w", err)
+	}
+	return list, nil
+}
+
+// rowScanner is implemented by both *sql.Row and *sql.Rows
+type rowScanner interface {
+	Scan(dest ...any) error
+}
+
 // scanFileRow is a helper function to scan a file row
-func (fdb *fileDB) scanFileRow(row *sql.Row) (*FileMetadata, error) {
+func (fdb *fileDB) scanFileRow(row rowScanner) (*FileMetadata, error) {
 	var file FileMetadata
 	var aclJSON string
+	var deletedAt sql.NullTime
+	var dev, ino int64 // Stored as the signed bit pattern, SQLite integers are 64-bit signed
 
 	err := row.Scan(
 		&file.ID,
@@ -213,12 +905,18 @@ func (fdb *fileDB) scanFileRow(row *sql.Row) (*FileMetadata, error) {
 		&file.FileInfo.Group,
 		&file.FileInfo.ModTime,
 		&file.FileInfo.AccessTime,
-		&file.FileInfo.CTime,
+		&file.FileInfo.ChangeTime,
 		&aclJSON,
+		&file.FileType,
+		&file.FileInfo.SymlinkTarget,
 		&file.SourceHost,
 		&file.BackupTime,
 		&file.Checksum,
 		&file.MetadataUpdatedAt,
+		&deletedAt,
+		&dev,
+		&ino,
+		&file.FileInfo.Nlink,
 	)
 
 	if err != nil {
@@ -233,6 +931,16 @@ func (fdb *fileDB) scanFileRow(row *sql.Row) (*FileMetadata, error) {
 		return nil, fmt.Errorf("failed to deserialize ACL: %w", err)
 	}
 
+	if deletedAt.Valid {
+		file.DeletedAt = deletedAt.Time
+	}
+	file.FileInfo.Dev, file.FileInfo.Ino = uint64(dev), uint64(ino)
+
+	// Rows stored before the type was recorded get it from the mode
+	if file.FileType == "" {
+		file.FileType = string(file.FileInfo.GetType())
+	}
+
 	return &file, nil
 }
 
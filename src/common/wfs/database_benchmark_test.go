@@ -14,21 +14,21 @@ import (
 var testBaseTime = time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
 
 // setupPerfTestDB creates a temporary database for performance testing
-func setupPerfTestDB(tb testing.TB) (*FileDB, func()) {
+func setupPerfTestDB(tb testing.TB) (*fileDB, func()) {
 	tmpDir, err := os.MkdirTemp("", "filedb_perf_test_*")
 	if err != nil {
 		tb.Fatalf("Failed to create temp dir: %v", err)
 	}
 
 	dbPath := filepath.Join(tmpDir, "perf_test.db")
-	db, err := NewFileDB(dbPath)
+	db, err := newTestDB(dbPath)
 	if err != nil {
 		os.RemoveAll(tmpDir)
 		tb.Fatalf("Failed to create test database: %v", err)
 	}
 
 	cleanup := func() {
-		db.Close()
+		db.close()
 		os.RemoveAll(tmpDir)
 	}
 
@@ -44,9 +44,9 @@ func createPerfTestFileInfo(id int) files.FileInfo {
 		Mode:       0644,
 		Owner:      1000,
 		Group:      1000,
-        ModTime:    testBaseTime.Add(-time.Duration(id) * time.Minute),
-        AccessTime: testBaseTime.Add(-time.Duration(id) * time.Second),
-        CTime:      testBaseTime.Add(-time.Duration(id) * time.Hour),
+		ModTime:    testBaseTime.Add(-time.Duration(id) * time.Minute),
+		AccessTime: testBaseTime.Add(-time.Duration(id) * time.Second),
+		ChangeTime: testBaseTime.Add(-time.Duration(id) * time.Hour),
 		ACL:        nil,
 	}
 }
@@ -75,7 +75,8 @@ func TestConcurrentWrites(t *testing.T) {
 				fileInfo := createPerfTestFileInfo(fileID)
 				checksum := fmt.Sprintf("checksum_%d", fileID)
 
-				_, err := db.AddFile(host, fileInfo, checksum)
+				fileInfo.Host = host
+				_, err := db.addFile(&fileInfo, checksum)
 				if err != nil {
 					mu.Lock()
 					errors = append(errors, err)
@@ -101,7 +102,8 @@ func TestConcurrentWrites(t *testing.T) {
 	// Verify all files were added
 	for i := 0; i < totalFiles; i++ {
 		fileInfo := createPerfTestFileInfo(i)
-		exists, err := db.FileExists(fileInfo.Path, host, fileInfo.ModTime, fileInfo.CTime)
+		fileInfo.Host = host
+		exists, err := db.fileExists(&fileInfo)
 		if err != nil {
 			t.Fatalf("Failed to check file existence: %v", err)
 		}
@@ -122,7 +124,8 @@ func TestConcurrentReads(t *testing.T) {
 	for i := 0; i < numFiles; i++ {
 		fileInfo := createPerfTestFileInfo(i)
 		checksum := fmt.Sprintf("checksum_%d", i)
-		_, err := db.AddFile(host, fileInfo, checksum)
+		fileInfo.Host = host
+		_, err := db.addFile(&fileInfo, checksum)
 		if err != nil {
 			t.Fatalf("Failed to add file %d: %v", i, err)
 		}
@@ -147,7 +150,7 @@ func TestConcurrentReads(t *testing.T) {
 				fileID := (goroutineID*readsPerGoroutine + j) % numFiles
 				fileInfo := createPerfTestFileInfo(fileID)
 
-				metadata, err := db.GetFile(fileInfo.Path, host)
+				metadata, err := db.getFile(fileInfo.Path, host)
 				if err != nil {
 					mu.Lock()
 					errors = append(errors, err)
@@ -194,7 +197,8 @@ func TestMixedReadWrites(t *testing.T) {
 	for i := 0; i < initialFiles; i++ {
 		fileInfo := createPerfTestFileInfo(i)
 		checksum := fmt.Sprintf("initial_checksum_%d", i)
-		_, err := db.AddFile(host, fileInfo, checksum)
+		fileInfo.Host = host
+		_, err := db.addFile(&fileInfo, checksum)
 		if err != nil {
 			t.Fatalf("Failed to add initial file %d: %v", i, err)
 		}
@@ -218,7 +222,7 @@ func TestMixedReadWrites(t *testing.T) {
 				fileID := j % initialFiles
 				fileInfo := createPerfTestFileInfo(fileID)
 
-				metadata, err := db.GetFile(fileInfo.Path, host)
+				metadata, err := db.getFile(fileInfo.Path, host)
 				if err != nil {
 					mu.Lock()
 					errors = append(errors, fmt.Errorf("reader %d: %v", readerID, err))
@@ -250,7 +254,8 @@ func TestMixedReadWrites(t *testing.T) {
 				fileInfo := createPerfTestFileInfo(fileID)
 				checksum := fmt.Sprintf("writer_%d_checksum_%d", writerID, j)
 
-				_, err := db.AddFile(host, fileInfo, checksum)
+				fileInfo.Host = host
+				_, err := db.addFile(&fileInfo, checksum)
 				if err != nil {
 					mu.Lock()
 					errors = append(errors, fmt.Errorf("writer %d: %v", writerID, err))
@@ -306,7 +311,8 @@ func TestConcurrentChecksumOperations(t *testing.T) {
 				checksum := fmt.Sprintf("checksum_%d", fileID)
 
 				// Add file
-				_, err := db.AddFile(host, fileInfo, checksum)
+				fileInfo.Host = host
+				_, err := db.addFile(&fileInfo, checksum)
 				if err != nil {
 					mu.Lock()
 					errors = append(errors, fmt.Errorf("goroutine %d: add file: %v", goroutineID, err))
@@ -315,7 +321,7 @@ func TestConcurrentChecksumOperations(t *testing.T) {
 				}
 
 				// Check if checksum exists
-				exists, err := db.FileExistsByChecksum(checksum)
+				exists, err := db.fileExistsByChecksum(checksum)
 				if err != nil {
 					mu.Lock()
 					errors = append(errors, fmt.Errorf("goroutine %d: checksum exists: %v", goroutineID, err))
@@ -333,7 +339,7 @@ func TestConcurrentChecksumOperations(t *testing.T) {
 				mu.Unlock()
 
 				// Get file by checksum
-				metadata, err := db.GetFileByChecksum(checksum)
+				metadata, err := db.getFileByChecksum(checksum)
 				if err != nil {
 					mu.Lock()
 					errors = append(errors, fmt.Errorf("goroutine %d: get by checksum: %v", goroutineID, err))
@@ -379,13 +385,38 @@ func BenchmarkSingleAddFile(b *testing.B) {
 		fileInfo := createPerfTestFileInfo(i)
 		checksum := fmt.Sprintf("benchmark_checksum_%d", i)
 
-		_, err := db.AddFile(host, fileInfo, checksum)
+		fileInfo.Host = host
+		_, err := db.addFile(&fileInfo, checksum)
 		if err != nil {
 			b.Fatalf("Failed to add file: %v", err)
 		}
 	}
 }
 
+// BenchmarkBatchAddFiles inserts files in batches of 1000 with addFiles, compare with BenchmarkSingleAddFile
+func BenchmarkBatchAddFiles(b *testing.B) {
+	db, cleanup := setupPerfTestDB(b)
+	defer cleanup()
+
+	host := "benchmark-host"
+	const batchSize = 1000
+
+	b.ResetTimer()
+	for start := 0; start < b.N; start += batchSize {
+		var batch []*files.FileInfo
+		var checksums []string
+		for i := start; i < min(start+batchSize, b.N); i++ {
+			fileInfo := createPerfTestFileInfo(i)
+			fileInfo.Host = host
+			batch = append(batch, &fileInfo)
+			checksums = append(checksums, fmt.Sprintf("benchmark_checksum_%d", i))
+		}
+		if err := db.addFiles(batch, checksums); err != nil {
+			b.Fatalf("Failed to add files: %v", err)
+		}
+	}
+}
+
 func BenchmarkSingleGetFile(b *testing.B) {
 	db, cleanup := setupPerfTestDB(b)
 	defer cleanup()
@@ -396,7 +427,8 @@ func BenchmarkSingleGetFile(b *testing.B) {
 	for i := 0; i < b.N; i++ {
 		fileInfo := createPerfTestFileInfo(i)
 		checksum := fmt.Sprintf("benchmark_checksum_%d", i)
-		_, err := db.AddFile(host, fileInfo, checksum)
+		fileInfo.Host = host
+		_, err := db.addFile(&fileInfo, checksum)
 		if err != nil {
 			b.Fatalf("Failed to add file: %v", err)
 		}
@@ -405,7 +437,7 @@ func BenchmarkSingleGetFile(b *testing.B) {
 	b.ResetTimer()
 	for i := 0; i < b.N; i++ {
 		fileInfo := createPerfTestFileInfo(i)
-		_, err := db.GetFile(fileInfo.Path, host)
+		_, err := db.getFile(fileInfo.Path, host)
 		if err != nil {
 			b.Fatalf("Failed to get file: %v", err)
 		}
@@ -425,7 +457,8 @@ func BenchmarkConcurrentWrites(b *testing.B) {
 			fileInfo := createPerfTestFileInfo(i)
 			checksum := fmt.Sprintf("benchmark_checksum_%d", i)
 
-			_, err := db.AddFile(host, fileInfo, checksum)
+			fileInfo.Host = host
+			_, err := db.addFile(&fileInfo, checksum)
 			if err != nil {
 				b.Fatalf("Failed to add file: %v", err)
 			}
@@ -445,7 +478,8 @@ func BenchmarkConcurrentReads(b *testing.B) {
 	for i := 0; i < numFiles; i++ {
 		fileInfo := createPerfTestFileInfo(i)
 		checksum := fmt.Sprintf("benchmark_checksum_%d", i)
-		_, err := db.AddFile(host, fileInfo, checksum)
+		fileInfo.Host = host
+		_, err := db.addFile(&fileInfo, checksum)
 		if err != nil {
 			b.Fatalf("Failed to add file: %v", err)
 		}
@@ -458,7 +492,7 @@ func BenchmarkConcurrentReads(b *testing.B) {
 			fileID := i % numFiles
 			fileInfo := createPerfTestFileInfo(fileID)
 
-			_, err := db.GetFile(fileInfo.Path, host)
+			_, err := db.getFile(fileInfo.Path, host)
 			if err != nil {
 				b.Fatalf("Failed to get file: %v", err)
 			}
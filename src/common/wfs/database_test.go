@@ -1,30 +1,44 @@
 package wfs
 
 import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
 	"os"
 	"path/filepath"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
+	"github.com/alex-sviridov/miniprotector/common/config"
 	"github.com/alex-sviridov/miniprotector/common/files"
 )
 
+// newTestDB opens a database with an empty configuration and a discarding logger
+func newTestDB(dbPath string) (*fileDB, error) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	return newDB(&config.Config{}, logger, dbPath)
+}
+
 // setupTestDB creates a temporary database for testing
-func setupTestDB(t *testing.T) (*FileDB, func()) {
+func setupTestDB(t *testing.T) (*fileDB, func()) {
 	tmpDir, err := os.MkdirTemp("", "filedb_test_*")
 	if err != nil {
 		t.Fatalf("Failed to create temp dir: %v", err)
 	}
 
 	dbPath := filepath.Join(tmpDir, "test.db")
-	db, err := NewFileDB(dbPath)
+	db, err := newTestDB(dbPath)
 	if err != nil {
 		os.RemoveAll(tmpDir)
 		t.Fatalf("Failed to create test database: %v", err)
 	}
 
 	cleanup := func() {
-		db.Close()
+		db.close()
 		os.RemoveAll(tmpDir)
 	}
 
@@ -42,7 +56,7 @@ func createTestFileInfo() files.FileInfo {
 		Group:      1000,
 		ModTime:    time.Now().Truncate(time.Second), // Truncate to avoid precision issues
 		AccessTime: time.Now().Truncate(time.Second),
-		CTime:      time.Now().Truncate(time.Second),
+		ChangeTime: time.Now().Truncate(time.Second),
 		ACL:        nil,
 	}
 }
@@ -56,11 +70,11 @@ func TestNewFileDB(t *testing.T) {
 		defer os.RemoveAll(tmpDir)
 
 		dbPath := filepath.Join(tmpDir, "test.db")
-		db, err := NewFileDB(dbPath)
+		db, err := newTestDB(dbPath)
 		if err != nil {
 			t.Fatalf("Expected no error, got %v", err)
 		}
-		defer db.Close()
+		defer db.close()
 
 		// Check if database file was created
 		if _, err := os.Stat(dbPath); os.IsNotExist(err) {
@@ -75,11 +89,11 @@ func TestNewFileDB(t *testing.T) {
 		}
 		defer os.RemoveAll(tmpDir)
 
-		db, err := NewFileDB(tmpDir)
+		db, err := newTestDB(tmpDir)
 		if err != nil {
 			t.Fatalf("Expected no error, got %v", err)
 		}
-		defer db.Close()
+		defer db.close()
 
 		// Check if default database file was created
 		expectedPath := filepath.Join(tmpDir, "wfs.db")
@@ -96,11 +110,11 @@ func TestNewFileDB(t *testing.T) {
 		defer os.RemoveAll(tmpDir)
 
 		dbPath := filepath.Join(tmpDir, "subdir", "test.db")
-		db, err := NewFileDB(dbPath)
+		db, err := newTestDB(dbPath)
 		if err != nil {
 			t.Fatalf("Expected no error, got %v", err)
 		}
-		defer db.Close()
+		defer db.close()
 
 		// Check if database file was created
 		if _, err := os.Stat(dbPath); os.IsNotExist(err) {
@@ -117,7 +131,8 @@ func TestAddFile(t *testing.T) {
 	host := "test-host"
 	checksum := "abc123"
 
-	metadata, err := db.AddFile(host, fileInfo, checksum)
+	fileInfo.Host = host
+	metadata, err := db.addFile(&fileInfo, checksum)
 	if err != nil {
 		t.Fatalf("Failed to add file: %v", err)
 	}
@@ -143,6 +158,126 @@ func TestAddFile(t *testing.T) {
 	}
 }
 
+func TestAddFiles(t *testing.T) {
+	db, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	var batch []*files.FileInfo
+	var checksums []string
+	for i := range 3 {
+		fileInfo := createTestFileInfo()
+		fileInfo.Host = "test-host"
+		fileInfo.Path = fmt.Sprintf("/test/path/file%d.txt", i)
+		batch = append(batch, &fileInfo)
+		checksums = append(checksums, fmt.Sprintf("checksum%d", i))
+	}
+	if err := db.addFiles(batch, checksums); err != nil {
+		t.Fatalf("Failed to add files: %v", err)
+	}
+	for i, fileInfo := range batch {
+		stored, err := db.getFile(fileInfo.Path, "test-host")
+		if err != nil || stored == nil {
+			t.Fatalf("%s wasn't recorded: %v", fileInfo.Path, err)
+		}
+		if stored.Checksum != checksums[i] {
+			t.Errorf("Checksum of %s = %q, expected %q", fileInfo.Path, stored.Checksum, checksums[i])
+		}
+	}
+
+	if err := db.addFiles(batch, checksums[:1]); err == nil {
+		t.Error("Expected an error for mismatched checksums")
+	}
+}
+
+func TestAddFilesRollsBack(t *testing.T) {
+	db, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	// Fail the insert of one file in the middle of the batch
+	_, err := db.db.Exec(`CREATE TRIGGER reject_bad BEFORE INSERT ON files WHEN NEW.path = '/test/bad'
+		BEGIN SELECT RAISE(ABORT, 'rejected by test'); END`)
+	if err != nil {
+		t.Fatalf("Failed to create trigger: %v", err)
+	}
+
+	var batch []*files.FileInfo
+	for _, path := range []string{"/test/good1", "/test/bad", "/test/good2"} {
+		fileInfo := createTestFileInfo()
+		fileInfo.Host = "test-host"
+		fileInfo.Path = path
+		batch = append(batch, &fileInfo)
+	}
+	err = db.addFiles(batch, make([]string, len(batch)))
+	if err == nil {
+		t.Fatal("Expected the batch to fail")
+	}
+	if !strings.Contains(err.Error(), "/test/bad") {
+		t.Errorf("Error doesn't name the failing file: %v", err)
+	}
+
+	var count int
+	if err := db.db.QueryRow(`SELECT COUNT(*) FROM files`).Scan(&count); err != nil {
+		t.Fatalf("Failed to count files: %v", err)
+	}
+	if count != 0 {
+		t.Errorf("Expected the whole batch to be rolled back, %d files remain", count)
+	}
+}
+
+func TestConcurrentAddFileNoBusy(t *testing.T) {
+	dbPath := filepath.Join(t.TempDir(), "wfs.db")
+	// Two handles on the same file compete like separate processes, on top of each handle's own pool
+	var handles []*fileDB
+	for range 2 {
+		db, err := newTestDB(dbPath)
+		if err != nil {
+			t.Fatalf("Failed to open database: %v", err)
+		}
+		defer db.close()
+		handles = append(handles, db)
+	}
+
+	var journalMode string
+	if err := handles[0].db.QueryRow(`PRAGMA journal_mode`).Scan(&journalMode); err != nil {
+		t.Fatalf("Failed to read journal mode: %v", err)
+	}
+	if journalMode != "wal" {
+		t.Errorf("Journal mode = %q, expected wal", journalMode)
+	}
+
+	const writers, filesPerWriter = 20, 50
+	var wg sync.WaitGroup
+	errs := make(chan error, writers*filesPerWriter)
+	for w := range writers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			db := handles[w%len(handles)]
+			for i := range filesPerWriter {
+				fileInfo := createTestFileInfo()
+				fileInfo.Host = "test-host"
+				fileInfo.Path = fmt.Sprintf("/test/writer%d/file%d", w, i)
+				if _, err := db.addFile(&fileInfo, ""); err != nil {
+					errs <- err
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		t.Errorf("Concurrent addFile failed: %v", err)
+	}
+	var count int
+	if err := handles[0].db.QueryRow(`SELECT COUNT(*) FROM files`).Scan(&count); err != nil {
+		t.Fatalf("Failed to count files: %v", err)
+	}
+	if count != writers*filesPerWriter {
+		t.Errorf("Stored %d files, expected %d", count, writers*filesPerWriter)
+	}
+}
+
 func TestFileExists(t *testing.T) {
 	db, cleanup := setupTestDB(t)
 	defer cleanup()
@@ -150,9 +285,10 @@ func TestFileExists(t *testing.T) {
 	fileInfo := createTestFileInfo()
 	host := "test-host"
 	checksum := "abc123"
+	fileInfo.Host = host
 
 	// File should not exist initially
-	exists, err := db.FileExists(fileInfo.Path, host, fileInfo.ModTime, fileInfo.CTime)
+	exists, err := db.fileExists(&fileInfo)
 	if err != nil {
 		t.Fatalf("Failed to check file existence: %v", err)
 	}
@@ -161,13 +297,13 @@ func TestFileExists(t *testing.T) {
 	}
 
 	// Add the file
-	_, err = db.AddFile(host, fileInfo, checksum)
+	_, err = db.addFile(&fileInfo, checksum)
 	if err != nil {
 		t.Fatalf("Failed to add file: %v", err)
 	}
 
 	// File should exist now
-	exists, err = db.FileExists(fileInfo.Path, host, fileInfo.ModTime, fileInfo.CTime)
+	exists, err = db.fileExists(&fileInfo)
 	if err != nil {
 		t.Fatalf("Failed to check file existence: %v", err)
 	}
@@ -176,7 +312,9 @@ func TestFileExists(t *testing.T) {
 	}
 
 	// Different host should not have the file
-	exists, err = db.FileExists(fileInfo.Path, "different-host", fileInfo.ModTime, fileInfo.CTime)
+	otherHostFile := fileInfo
+	otherHostFile.Host = "different-host"
+	exists, err = db.fileExists(&otherHostFile)
 	if err != nil {
 		t.Fatalf("Failed to check file existence: %v", err)
 	}
@@ -185,6 +323,109 @@ func TestFileExists(t *testing.T) {
 	}
 }
 
+func TestUpdateMetadataOnly(t *testing.T) {
+	db, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	fileInfo := createTestFileInfo()
+	fileInfo.Host = "test-host"
+	if _, err := db.addFile(&fileInfo, "abc123"); err != nil {
+		t.Fatalf("Failed to add file: %v", err)
+	}
+
+	// chmod changes the mode and bumps ctime, mtime stays
+	chmodded := fileInfo
+	chmodded.Mode = 0600
+	chmodded.ChangeTime = fileInfo.ChangeTime.Add(time.Minute)
+
+	status, err := db.fileStatus(&chmodded)
+	if err != nil {
+		t.Fatalf("Failed to check file status: %v", err)
+	}
+	if status != FileMetadataChanged {
+		t.Fatalf("Expected FileMetadataChanged, got %v", status)
+	}
+	if exists, _ := db.fileExists(&chmodded); exists {
+		t.Error("File with changed ctime reported as already backed up")
+	}
+	if statuses, _ := db.filesStatus([]*files.FileInfo{&chmodded}); statuses[0] != FileMetadataChanged {
+		t.Errorf("Batch status = %v, expected FileMetadataChanged", statuses[0])
+	}
+
+	if err := db.updateMetadata(&chmodded); err != nil {
+		t.Fatalf("Failed to update metadata: %v", err)
+	}
+	stored, err := db.getFile(fileInfo.Path, fileInfo.Host)
+	if err != nil {
+		t.Fatalf("Failed to get file: %v", err)
+	}
+	if stored.FileInfo.Mode != 0600 || !stored.FileInfo.ChangeTime.Equal(chmodded.ChangeTime) {
+		t.Errorf("Stored mode %v ctime %v, expected %v %v", stored.FileInfo.Mode, stored.FileInfo.ChangeTime, chmodded.Mode, chmodded.ChangeTime)
+	}
+	if stored.Checksum != "abc123" {
+		t.Errorf("Checksum changed to %q", stored.Checksum)
+	}
+
+	var versions int
+	if err := db.db.QueryRow(`SELECT COUNT(*) FROM files WHERE path = ?`, fileInfo.Path).Scan(&versions); err != nil {
+		t.Fatalf("Failed to count versions: %v", err)
+	}
+	if versions != 1 {
+		t.Errorf("Expected the row to be updated in place, found %d versions", versions)
+	}
+	if status, _ := db.fileStatus(&chmodded); status != FileUnchanged {
+		t.Errorf("Expected FileUnchanged after update, got %v", status)
+	}
+
+	missing := createTestFileInfo()
+	missing.Path = "/test/missing"
+	if err := db.updateMetadata(&missing); err == nil {
+		t.Error("Expected error updating a file that isn't stored")
+	}
+}
+
+func TestFilesExist(t *testing.T) {
+	db, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	modTime := time.Now()
+	var batch []*files.FileInfo
+	for i := range 5 {
+		batch = append(batch, &files.FileInfo{
+			Host:    "test-host",
+			Path:    fmt.Sprintf("/data/file%d", i),
+			Name:    fmt.Sprintf("file%d", i),
+			ModTime: modTime,
+		})
+	}
+	for _, i := range []int{0, 2, 3} {
+		if _, err := db.addFile(batch[i], ""); err != nil {
+			t.Fatalf("Failed to add file: %v", err)
+		}
+	}
+	// Same path with a newer modtime, and same path from another host, are different files
+	newer := *batch[3]
+	newer.ModTime = modTime.Add(time.Second)
+	otherHost := *batch[2]
+	otherHost.Host = "other-host"
+	batch = append(batch, &newer, &otherHost)
+
+	exists, err := db.filesExist(batch)
+	if err != nil {
+		t.Fatalf("Failed to check files existence: %v", err)
+	}
+	want := []bool{true, false, true, true, false, false, false}
+	for i := range want {
+		if exists[i] != want[i] {
+			t.Errorf("File %d (%s) exists = %v, expected %v", i, batch[i].Path, exists[i], want[i])
+		}
+	}
+
+	if exists, err := db.filesExist(nil); err != nil || len(exists) != 0 {
+		t.Errorf("Empty batch = %v, %v", exists, err)
+	}
+}
+
 func TestFileExistsByChecksum(t *testing.T) {
 	db, cleanup := setupTestDB(t)
 	defer cleanup()
@@ -194,7 +435,7 @@ func TestFileExistsByChecksum(t *testing.T) {
 	checksum := "abc123"
 
 	// File should not exist initially
-	exists, err := db.FileExistsByChecksum(checksum)
+	exists, err := db.fileExistsByChecksum(checksum)
 	if err != nil {
 		t.Fatalf("Failed to check file existence by checksum: %v", err)
 	}
@@ -203,7 +444,7 @@ func TestFileExistsByChecksum(t *testing.T) {
 	}
 
 	// Empty checksum should return false
-	exists, err = db.FileExistsByChecksum("")
+	exists, err = db.fileExistsByChecksum("")
 	if err != nil {
 		t.Fatalf("Failed to check file existence by checksum: %v", err)
 	}
@@ -212,13 +453,14 @@ func TestFileExistsByChecksum(t *testing.T) {
 	}
 
 	// Add the file
-	_, err = db.AddFile(host, fileInfo, checksum)
+	fileInfo.Host = host
+	_, err = db.addFile(&fileInfo, checksum)
 	if err != nil {
 		t.Fatalf("Failed to add file: %v", err)
 	}
 
 	// File should exist now
-	exists, err = db.FileExistsByChecksum(checksum)
+	exists, err = db.fileExistsByChecksum(checksum)
 	if err != nil {
 		t.Fatalf("Failed to check file existence by checksum: %v", err)
 	}
@@ -227,7 +469,7 @@ func TestFileExistsByChecksum(t *testing.T) {
 	}
 
 	// Different checksum should not exist
-	exists, err = db.FileExistsByChecksum("different123")
+	exists, err = db.fileExistsByChecksum("different123")
 	if err != nil {
 		t.Fatalf("Failed to check file existence by checksum: %v", err)
 	}
@@ -245,7 +487,7 @@ func TestGetFile(t *testing.T) {
 	checksum := "abc123"
 
 	// File should not exist initially
-	metadata, err := db.GetFile(fileInfo.Path, host)
+	metadata, err := db.getFile(fileInfo.Path, host)
 	if err != nil {
 		t.Fatalf("Failed to get file: %v", err)
 	}
@@ -254,13 +496,14 @@ func TestGetFile(t *testing.T) {
 	}
 
 	// Add the file
-	addedMetadata, err := db.AddFile(host, fileInfo, checksum)
+	fileInfo.Host = host
+	addedMetadata, err := db.addFile(&fileInfo, checksum)
 	if err != nil {
 		t.Fatalf("Failed to add file: %v", err)
 	}
 
 	// Get the file
-	retrievedMetadata, err := db.GetFile(fileInfo.Path, host)
+	retrievedMetadata, err := db.getFile(fileInfo.Path, host)
 	if err != nil {
 		t.Fatalf("Failed to get file: %v", err)
 	}
@@ -295,7 +538,7 @@ func TestGetFileByChecksum(t *testing.T) {
 	checksum := "abc123"
 
 	// File should not exist initially
-	metadata, err := db.GetFileByChecksum(checksum)
+	metadata, err := db.getFileByChecksum(checksum)
 	if err != nil {
 		t.Fatalf("Failed to get file by checksum: %v", err)
 	}
@@ -304,7 +547,7 @@ func TestGetFileByChecksum(t *testing.T) {
 	}
 
 	// Empty checksum should return nil
-	metadata, err = db.GetFileByChecksum("")
+	metadata, err = db.getFileByChecksum("")
 	if err != nil {
 		t.Fatalf("Failed to get file by checksum: %v", err)
 	}
@@ -313,13 +556,14 @@ func TestGetFileByChecksum(t *testing.T) {
 	}
 
 	// Add the file
-	addedMetadata, err := db.AddFile(host, fileInfo, checksum)
+	fileInfo.Host = host
+	addedMetadata, err := db.addFile(&fileInfo, checksum)
 	if err != nil {
 		t.Fatalf("Failed to add file: %v", err)
 	}
 
 	// Get the file by checksum
-	retrievedMetadata, err := db.GetFileByChecksum(checksum)
+	retrievedMetadata, err := db.getFileByChecksum(checksum)
 	if err != nil {
 		t.Fatalf("Failed to get file by checksum: %v", err)
 	}
@@ -336,6 +580,63 @@ func TestGetFileByChecksum(t *testing.T) {
 	}
 }
 
+// updateFile replaces the stored metadata of a single file version
+// The writer never changes a stored version, only these tests do
+func (fdb *fileDB) updateFile(path, host string, backupTime time.Time, fileInfo *files.FileInfo, checksum string) error {
+	aclJSON, err := json.Marshal(fileInfo.ACL)
+	if err != nil {
+		return fmt.Errorf("failed to serialize ACL: %w", err)
+	}
+
+	query := `
+	UPDATE files SET
+		name = ?, size = ?, mode = ?, owner = ?, group_id = ?, modtime = ?,
+		access_time = ?, ctime = ?, acl = ?, file_type = ?, symlink_target = ?, checksum = ?, metadata_updated_at = ?,
+		dev = ?, ino = ?, nlink = ?
+	WHERE path = ? AND source_host = ? AND backup_time = ?
+	`
+
+	result, err := fdb.db.Exec(query,
+		fileInfo.Name, fileInfo.Size, fileInfo.Mode, fileInfo.Owner, fileInfo.Group,
+		fileInfo.ModTime, fileInfo.AccessTime, fileInfo.ChangeTime, string(aclJSON),
+		string(fileInfo.GetType()), fileInfo.SymlinkTarget, checksum, time.Now(),
+		int64(fileInfo.Dev), int64(fileInfo.Ino), fileInfo.Nlink,
+		path, host, backupTime,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to update file: %w", err)
+	}
+	return expectAffected(result, path)
+}
+
+// deleteFile removes a single file version and its chunk list from the database
+// Chunk data stays in the chunk store, the writer never removes versions
+func (fdb *fileDB) deleteFile(path, host string, backupTime time.Time) error {
+	tx, err := fdb.db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	chunksQuery := `
+	DELETE FROM file_chunks WHERE file_id IN (
+		SELECT id FROM files WHERE path = ? AND source_host = ? AND backup_time = ?
+	)`
+	if _, err := tx.Exec(chunksQuery, path, host, backupTime); err != nil {
+		return fmt.Errorf("failed to delete file chunks: %w", err)
+	}
+
+	query := `DELETE FROM files WHERE path = ? AND source_host = ? AND backup_time = ?`
+	result, err := tx.Exec(query, path, host, backupTime)
+	if err != nil {
+		return fmt.Errorf("failed to delete file: %w", err)
+	}
+	if err := expectAffected(result, path); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
 func TestUpdateFile(t *testing.T) {
 	db, cleanup := setupTestDB(t)
 	defer cleanup()
@@ -345,7 +646,8 @@ func TestUpdateFile(t *testing.T) {
 	checksum := "abc123"
 
 	// Add the file
-	addedMetadata, err := db.AddFile(host, fileInfo, checksum)
+	fileInfo.Host = host
+	addedMetadata, err := db.addFile(&fileInfo, checksum)
 	if err != nil {
 		t.Fatalf("Failed to add file: %v", err)
 	}
@@ -356,13 +658,13 @@ func TestUpdateFile(t *testing.T) {
 	updatedFileInfo.Mode = 0755
 	updatedChecksum := "def456"
 
-	err = db.UpdateFile(fileInfo.Path, host, addedMetadata.BackupTime, updatedFileInfo, updatedChecksum)
+	err = db.updateFile(fileInfo.Path, host, addedMetadata.BackupTime, &updatedFileInfo, updatedChecksum)
 	if err != nil {
 		t.Fatalf("Failed to update file: %v", err)
 	}
 
 	// Get the updated file
-	retrievedMetadata, err := db.GetFile(fileInfo.Path, host)
+	retrievedMetadata, err := db.getFile(fileInfo.Path, host)
 	if err != nil {
 		t.Fatalf("Failed to get updated file: %v", err)
 	}
@@ -383,7 +685,7 @@ func TestUpdateFile(t *testing.T) {
 	}
 
 	// Try to update non-existent file
-	err = db.UpdateFile("/non/existent/path", host, addedMetadata.BackupTime, updatedFileInfo, updatedChecksum)
+	err = db.updateFile("/non/existent/path", host, addedMetadata.BackupTime, &updatedFileInfo, updatedChecksum)
 	if err == nil {
 		t.Error("Expected error when updating non-existent file")
 	}
@@ -398,13 +700,14 @@ func TestDeleteFile(t *testing.T) {
 	checksum := "abc123"
 
 	// Add the file
-	addedMetadata, err := db.AddFile(host, fileInfo, checksum)
+	fileInfo.Host = host
+	addedMetadata, err := db.addFile(&fileInfo, checksum)
 	if err != nil {
 		t.Fatalf("Failed to add file: %v", err)
 	}
 
 	// Verify file exists
-	exists, err := db.FileExists(fileInfo.Path, host, fileInfo.ModTime, fileInfo.CTime)
+	exists, err := db.fileExists(&fileInfo)
 	if err != nil {
 		t.Fatalf("Failed to check file existence: %v", err)
 	}
@@ -413,13 +716,13 @@ func TestDeleteFile(t *testing.T) {
 	}
 
 	// Delete the file
-	err = db.DeleteFile(fileInfo.Path, host, addedMetadata.BackupTime)
+	err = db.deleteFile(fileInfo.Path, host, addedMetadata.BackupTime)
 	if err != nil {
 		t.Fatalf("Failed to delete file: %v", err)
 	}
 
 	// Verify file no longer exists
-	retrievedMetadata, err := db.GetFile(fileInfo.Path, host)
+	retrievedMetadata, err := db.getFile(fileInfo.Path, host)
 	if err != nil {
 		t.Fatalf("Failed to get file after deletion: %v", err)
 	}
@@ -428,7 +731,7 @@ func TestDeleteFile(t *testing.T) {
 	}
 
 	// Try to delete non-existent file
-	err = db.DeleteFile("/non/existent/path", host, addedMetadata.BackupTime)
+	err = db.deleteFile("/non/existent/path", host, addedMetadata.BackupTime)
 	if err == nil {
 		t.Error("Expected error when deleting non-existent file")
 	}
@@ -447,7 +750,8 @@ func TestMultipleFiles(t *testing.T) {
 		fileInfo.Name = "file" + string(rune('0'+i)) + ".txt"
 		checksum := "checksum" + string(rune('0'+i))
 
-		_, err := db.AddFile(host, fileInfo, checksum)
+		fileInfo.Host = host
+		_, err := db.addFile(&fileInfo, checksum)
 		if err != nil {
 			t.Fatalf("Failed to add file %d: %v", i, err)
 		}
@@ -456,7 +760,7 @@ func TestMultipleFiles(t *testing.T) {
 	// Verify all files exist
 	for i := 0; i < 3; i++ {
 		path := filepath.Join("/test", "file"+string(rune('0'+i))+".txt")
-		metadata, err := db.GetFile(path, host)
+		metadata, err := db.getFile(path, host)
 		if err != nil {
 			t.Fatalf("Failed to get file %d: %v", i, err)
 		}
@@ -470,14 +774,287 @@ func TestClose(t *testing.T) {
 	db, cleanup := setupTestDB(t)
 	defer cleanup()
 
-	err := db.Close()
+	err := db.close()
 	if err != nil {
 		t.Errorf("Failed to close database: %v", err)
 	}
 
 	// Second close should not error
-	err = db.Close()
+	err = db.close()
 	if err != nil {
 		t.Errorf("Second close should not error: %v", err)
 	}
 }
+
+func TestSymlinkRoundTrip(t *testing.T) {
+	db, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	fileInfo := createTestFileInfo()
+	fileInfo.Host = "test-host"
+	fileInfo.Path = "/test/path/link"
+	fileInfo.Name = "link"
+	fileInfo.Mode = fs.ModeSymlink | 0777
+	fileInfo.Size = 0
+	fileInfo.SymlinkTarget = "../target/file.txt"
+	if _, err := db.addFile(&fileInfo, ""); err != nil {
+		t.Fatalf("Failed to add symlink: %v", err)
+	}
+
+	stored, err := db.getFile(fileInfo.Path, fileInfo.Host)
+	if err != nil || stored == nil {
+		t.Fatalf("Failed to get symlink: %v", err)
+	}
+	if stored.FileInfo.SymlinkTarget != fileInfo.SymlinkTarget {
+		t.Errorf("Expected target %q, got %q", fileInfo.SymlinkTarget, stored.FileInfo.SymlinkTarget)
+	}
+	if stored.FileType != "l" || stored.FileInfo.GetType() != 'l' {
+		t.Errorf("Expected symlink type, got %q with mode %v", stored.FileType, stored.FileInfo.Mode)
+	}
+}
+
+func TestScannedChangeTimeStored(t *testing.T) {
+	db, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	path := filepath.Join(t.TempDir(), "file.txt")
+	if err := os.WriteFile(path, []byte("content"), 0600); err != nil {
+		t.Fatalf("Failed to write file: %v", err)
+	}
+	scanned, _, err := files.Scan(path, files.ScanOptions{})
+	if err != nil || len(scanned) != 1 {
+		t.Fatalf("Scan failed: %v", err)
+	}
+	fileInfo := scanned[0]
+	if fileInfo.ChangeTime.IsZero() {
+		t.Fatal("Scan left the change time unset")
+	}
+	fileInfo.Host = "test-host"
+	if _, err := db.addFile(&fileInfo, ""); err != nil {
+		t.Fatalf("Failed to add file: %v", err)
+	}
+
+	stored, err := db.getFile(fileInfo.Path, fileInfo.Host)
+	if err != nil || stored == nil {
+		t.Fatalf("Failed to get file: %v", err)
+	}
+	if !stored.FileInfo.ChangeTime.Equal(fileInfo.ChangeTime) {
+		t.Errorf("Stored change time %v, scanned %v", stored.FileInfo.ChangeTime, fileInfo.ChangeTime)
+	}
+}
+
+func TestAddFileAfterRestartWithClockBehind(t *testing.T) {
+	dbPath := filepath.Join(t.TempDir(), "test.db")
+	db, err := newTestDB(dbPath)
+	if err != nil {
+		t.Fatalf("Failed to create test database: %v", err)
+	}
+	ahead := time.Now().Add(time.Hour)
+	db.clock.now = func() time.Time { return ahead }
+	fileInfo := createTestFileInfo()
+	first, err := db.addFile(&fileInfo, "v1")
+	if err != nil {
+		t.Fatalf("Failed to add first version: %v", err)
+	}
+	db.close()
+
+	// After the restart the wall clock reads the exact time of the stored version, then earlier
+	db, err = newTestDB(dbPath)
+	if err != nil {
+		t.Fatalf("Failed to reopen test database: %v", err)
+	}
+	defer db.close()
+	readings := []time.Time{ahead, ahead.Add(-time.Minute)}
+	db.clock.now = func() time.Time {
+		reading := readings[0]
+		readings = readings[1:]
+		return reading
+	}
+	previous := first.BackupTime
+	for _, checksum := range []string{"v2", "v3"} {
+		version, err := db.addFile(&fileInfo, checksum)
+		if err != nil {
+			t.Fatalf("Failed to add version %s with the clock behind the stored one: %v", checksum, err)
+		}
+		if !version.BackupTime.After(previous) {
+			t.Errorf("Version %s backed up at %v, expected after %v", checksum, version.BackupTime, previous)
+		}
+		previous = version.BackupTime
+	}
+}
+
+func TestAddFileVersionsSameInstant(t *testing.T) {
+	db, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	// Freeze the clock, then step it backwards
+	frozen := time.Now()
+	db.clock.now = func() time.Time { return frozen }
+
+	fileInfo := createTestFileInfo()
+	first, err := db.addFile(&fileInfo, "v1")
+	if err != nil {
+		t.Fatalf("Failed to add first version: %v", err)
+	}
+	second, err := db.addFile(&fileInfo, "v2")
+	if err != nil {
+		t.Fatalf("Failed to add second version in the same instant: %v", err)
+	}
+
+	frozen = frozen.Add(-time.Minute)
+	third, err := db.addFile(&fileInfo, "v3")
+	if err != nil {
+		t.Fatalf("Failed to add version after the clock stepped back: %v", err)
+	}
+
+	if !second.BackupTime.After(first.BackupTime) || !third.BackupTime.After(second.BackupTime) {
+		t.Errorf("Expected increasing backup times, got %v, %v, %v", first.BackupTime, second.BackupTime, third.BackupTime)
+	}
+
+	latest, err := db.getFile(fileInfo.Path, fileInfo.Host)
+	if err != nil {
+		t.Fatalf("Failed to get file: %v", err)
+	}
+	if latest.Checksum != "v3" {
+		t.Errorf("Expected latest version v3, got %s", latest.Checksum)
+	}
+}
+
+func TestListFilesForHost(t *testing.T) {
+	db, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	add := func(host, path string, size int64) {
+		t.Helper()
+		fileInfo := createTestFileInfo()
+		fileInfo.Host = host
+		fileInfo.Path = path
+		fileInfo.Size = size
+		if _, err := db.addFile(&fileInfo, ""); err != nil {
+			t.Fatalf("Failed to add %s: %v", path, err)
+		}
+	}
+	add("host-a", "/data/b.txt", 1)
+	add("host-a", "/data/a.txt", 1)
+	add("host-a", "/data/a.txt", 2) // Newer version of a.txt
+	add("host-a", "/data/c.txt", 1)
+	add("host-b", "/data/z.txt", 1)
+
+	list, err := db.listFilesForHost("host-a")
+	if err != nil {
+		t.Fatalf("Failed to list files: %v", err)
+	}
+	var paths []string
+	for _, file := range list {
+		paths = append(paths, file.FileInfo.Path)
+		if file.SourceHost != "host-a" {
+			t.Errorf("%s listed for host %s", file.FileInfo.Path, file.SourceHost)
+		}
+	}
+	if fmt.Sprint(paths) != "[/data/a.txt /data/b.txt /data/c.txt]" {
+		t.Errorf("Unexpected files listed: %v", paths)
+	}
+	if len(list) > 0 && list[0].FileInfo.Size != 2 {
+		t.Errorf("Expected latest version of a.txt, got size %d", list[0].FileInfo.Size)
+	}
+
+	// Iteration stops at the first callback error
+	stop := fmt.Errorf("stop")
+	visited := 0
+	err = db.forEachLatestFile("host-a", func(*FileMetadata) error {
+		visited++
+		return stop
+	})
+	if err != stop || visited != 1 {
+		t.Errorf("Expected iteration to stop after 1 file with its error, got %d files, %v", visited, err)
+	}
+
+	list, err = db.listFilesForHost("unknown-host")
+	if err != nil {
+		t.Fatalf("Failed to list files of empty host: %v", err)
+	}
+	if len(list) != 0 {
+		t.Errorf("Expected no files for empty host, got %d", len(list))
+	}
+}
+
+func TestMarkDeleted(t *testing.T) {
+	db, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	fileInfo := createTestFileInfo()
+	fileInfo.Host = "test-host"
+	if _, err := db.addFile(&fileInfo, "v1"); err != nil {
+		t.Fatalf("Failed to add file: %v", err)
+	}
+	if _, err := db.addFile(&fileInfo, "v2"); err != nil {
+		t.Fatalf("Failed to add second version: %v", err)
+	}
+	kept := createTestFileInfo()
+	kept.Host = "test-host"
+	kept.Path = "/test/path/kept.txt"
+	if _, err := db.addFile(&kept, "kept"); err != nil {
+		t.Fatalf("Failed to add file: %v", err)
+	}
+
+	before := time.Now().Add(-time.Hour)
+	deletedAt := time.Now().Truncate(time.Second)
+	if err := db.markDeleted(fileInfo.Path, fileInfo.Host, deletedAt); err != nil {
+		t.Fatalf("Failed to mark file deleted: %v", err)
+	}
+	if err := db.markDeleted(fileInfo.Path, fileInfo.Host, deletedAt); err == nil {
+		t.Error("Expected error marking an already deleted file")
+	}
+	if err := db.markDeleted("/test/missing", fileInfo.Host, deletedAt); err == nil {
+		t.Error("Expected error marking an unknown file")
+	}
+
+	// Normal queries no longer see the file
+	if file, err := db.getFile(fileInfo.Path, fileInfo.Host); err != nil || file != nil {
+		t.Errorf("getFile returned deleted file: %v, %v", file, err)
+	}
+	if status, _ := db.fileStatus(&fileInfo); status != FileMissing {
+		t.Errorf("Deleted file has status %v, expected FileMissing", status)
+	}
+	if statuses, _ := db.filesStatus([]*files.FileInfo{&fileInfo, &kept}); statuses[0] != FileMissing || statuses[1] != FileUnchanged {
+		t.Errorf("Batch statuses = %v, expected [FileMissing FileUnchanged]", statuses)
+	}
+	list, err := db.listFilesForHost(fileInfo.Host)
+	if err != nil {
+		t.Fatalf("Failed to list files: %v", err)
+	}
+	if len(list) != 1 || list[0].FileInfo.Path != kept.Path {
+		t.Errorf("Listing should only hold %s, got %v", kept.Path, list)
+	}
+
+	// but it is still there when asked for
+	file, err := db.getFileIncludingDeleted(fileInfo.Path, fileInfo.Host)
+	if err != nil || file == nil {
+		t.Fatalf("Failed to get deleted file: %v", err)
+	}
+	if file.Checksum != "v2" || !file.DeletedAt.Equal(deletedAt) {
+		t.Errorf("Deleted file = checksum %s deleted at %v, expected v2 at %v", file.Checksum, file.DeletedAt, deletedAt)
+	}
+
+	deleted, err := db.listDeletedSince(fileInfo.Host, before)
+	if err != nil {
+		t.Fatalf("Failed to list deleted files: %v", err)
+	}
+	if len(deleted) != 1 || deleted[0].FileInfo.Path != fileInfo.Path || deleted[0].Checksum != "v2" {
+		t.Errorf("Expected latest version of %s in deleted listing, got %v", fileInfo.Path, deleted)
+	}
+	if deleted, _ := db.listDeletedSince(fileInfo.Host, deletedAt.Add(time.Second)); len(deleted) != 0 {
+		t.Errorf("Expected no files deleted after %v, got %d", deletedAt, len(deleted))
+	}
+
+	// A file coming back is stored again and no longer listed as deleted
+	if _, err := db.addFile(&fileInfo, "v3"); err != nil {
+		t.Fatalf("Failed to add restored file: %v", err)
+	}
+	if file, _ := db.getFile(fileInfo.Path, fileInfo.Host); file == nil || file.Checksum != "v3" {
+		t.Errorf("Expected restored version v3, got %v", file)
+	}
+	if deleted, _ := db.listDeletedSince(fileInfo.Host, before); len(deleted) != 0 {
+		t.Errorf("Restored file still listed as deleted")
+	}
+}
@@ -0,0 +1,154 @@
+package wfs
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+// encryptionFile holds the key derivation parameters of an encrypted chunk store, under the storage path
+const encryptionFile = "encryption.json"
+
+// encryptedExtension is appended to the name of encrypted chunk files, after the codec extension
+const encryptedExtension = ".enc"
+
+// keyDerivationIterations is the PBKDF2 cost for new chunk stores, replaceable in tests
+var keyDerivationIterations = 600000
+
+// passphraseCheck is encrypted with the derived key and stored with the parameters,
+// so a wrong passphrase is detected when the store is opened rather than on the first read
+var passphraseCheck = []byte("miniprotector chunk store")
+
+// encryptionParams describes how the chunk key is derived from the passphrase
+type encryptionParams struct {
+	KDF        string `json:"kdf"`
+	Iterations int    `json:"iterations"`
+	Salt       []byte `json:"salt"`
+	Check      []byte `json:"check"` // passphraseCheck sealed with the derived key
+}
+
+// chunkCipher encrypts chunk data with AES-256-GCM. Every chunk gets a random nonce, stored before
+// the ciphertext; the chunk checksum is authenticated with it so a chunk can't be swapped for another.
+type chunkCipher struct {
+	aead cipher.AEAD
+}
+
+// LoadChunkPassphrase reads the passphrase encrypting stored chunks from a file, without its trailing newline
+func LoadChunkPassphrase(path string) ([]byte, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read chunk encryption key: %w", err)
+	}
+	passphrase := bytes.TrimRight(data, "\r\n")
+	if len(passphrase) == 0 {
+		return nil, fmt.Errorf("chunk encryption key file %s is empty", path)
+	}
+	return passphrase, nil
+}
+
+// openChunkCipher derives the chunk key of the store at storagePath from passphrase.
+// The first time, a random salt is generated and saved with the parameters in encryption.json.
+func openChunkCipher(storagePath string, passphrase []byte) (*chunkCipher, error) {
+	path := filepath.Join(storagePath, encryptionFile)
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return createChunkCipher(path, passphrase)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read encryption parameters: %w", err)
+	}
+	var params encryptionParams
+	if err := json.Unmarshal(data, &params); err != nil {
+		return nil, fmt.Errorf("failed to read encryption parameters %s: %w", path, err)
+	}
+	if params.KDF != "pbkdf2-sha256" {
+		return nil, fmt.Errorf("unsupported key derivation %q in %s", params.KDF, path)
+	}
+	c, err := deriveChunkCipher(passphrase, &params)
+	if err != nil {
+		return nil, err
+	}
+	if check, err := c.open(params.Check, ""); err != nil || !bytes.Equal(check, passphraseCheck) {
+		return nil, errors.New("wrong chunk encryption key for this storage")
+	}
+	return c, nil
+}
+
+// createChunkCipher sets up encryption of a new chunk store, saving its parameters at path
+func createChunkCipher(path string, passphrase []byte) (*chunkCipher, error) {
+	params := encryptionParams{KDF: "pbkdf2-sha256", Iterations: keyDerivationIterations, Salt: make([]byte, 16)}
+	if _, err := rand.Read(params.Salt); err != nil {
+		return nil, fmt.Errorf("failed to generate salt: %w", err)
+	}
+	c, err := deriveChunkCipher(passphrase, &params)
+	if err != nil {
+		return nil, err
+	}
+	if params.Check, err = c.seal(passphraseCheck, ""); err != nil {
+		return nil, err
+	}
+	data, err := json.Marshal(&params)
+	if err != nil {
+		return nil, err
+	}
+	// O_EXCL: another writer starting on the same storage must not replace the salt
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create encryption parameters: %w", err)
+	}
+	_, err = file.Write(data)
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(path)
+		return nil, fmt.Errorf("failed to write encryption parameters %s: %w", path, err)
+	}
+	return c, nil
+}
+
+func deriveChunkCipher(passphrase []byte, params *encryptionParams) (*chunkCipher, error) {
+	key, err := pbkdf2.Key(sha256.New, string(passphrase), params.Salt, params.Iterations, 32)
+	if err != nil {
+		return nil, fmt.Errorf("failed to derive chunk key: %w", err)
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &chunkCipher{aead: aead}, nil
+}
+
+// seal encrypts the data of the chunk with the given checksum
+func (c *chunkCipher) seal(data []byte, checksum string) ([]byte, error) {
+	nonce := make([]byte, c.aead.NonceSize(), c.aead.NonceSize()+len(data)+c.aead.Overhead())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, fmt.Errorf("failed to generate nonce: %w", err)
+	}
+	return c.aead.Seal(nonce, nonce, data, []byte(checksum)), nil
+}
+
+// open decrypts data sealed for the chunk with the given checksum
+func (c *chunkCipher) open(sealed []byte, checksum string) ([]byte, error) {
+	if len(sealed) < c.aead.NonceSize() {
+		return nil, errors.New("encrypted chunk is truncated")
+	}
+	nonce, ciphertext := sealed[:c.aead.NonceSize()], sealed[c.aead.NonceSize():]
+	return c.aead.Open(nil, nonce, ciphertext, []byte(checksum))
+}
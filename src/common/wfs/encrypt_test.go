@@ -0,0 +1,109 @@
+package wfs
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/alex-sviridov/miniprotector/common/chunker"
+	"github.com/alex-sviridov/miniprotector/common/config"
+	"github.com/alex-sviridov/miniprotector/common/logging"
+)
+
+// openEncryptedWriter opens a writer on storagePath encrypting chunks with passphrase
+func openEncryptedWriter(t *testing.T, storagePath, passphrase string) (*Writer, error) {
+	t.Helper()
+	keyFile := filepath.Join(t.TempDir(), "chunk.key")
+	if err := os.WriteFile(keyFile, []byte(passphrase+"\n"), 0600); err != nil {
+		t.Fatalf("Failed to write key file: %v", err)
+	}
+	conf := &config.Config{ChunkEncryptionKeyFile: keyFile, Compression: chunker.CompressionGzip}
+	ctx := context.WithValue(context.Background(), config.ContextKey, conf)
+	ctx = context.WithValue(ctx, logging.ContextKey, slog.New(slog.NewTextHandler(io.Discard, nil)))
+	return NewWriter(ctx, storagePath)
+}
+
+func TestEncryptedChunks(t *testing.T) {
+	// The full key derivation cost isn't needed to test encryption
+	defer func(iterations int) { keyDerivationIterations = iterations }(keyDerivationIterations)
+	keyDerivationIterations = 1000
+
+	storagePath := t.TempDir()
+	writer, err := openEncryptedWriter(t, storagePath, "correct horse battery staple")
+	if err != nil {
+		t.Fatalf("Failed to create writer: %v", err)
+	}
+	random := make([]byte, 64*1024)
+	rand.Read(random)
+	chunks := [][]byte{bytes.Repeat([]byte("plaintext "), 1000), random}
+	for _, data := range chunks {
+		if err := writer.StoreChunk(chunker.Checksum(data), data); err != nil {
+			t.Fatalf("Failed to store chunk: %v", err)
+		}
+	}
+
+	for _, data := range chunks {
+		checksum := chunker.Checksum(data)
+		file, err := writer.chunks.locate(checksum)
+		if err != nil {
+			t.Fatalf("Chunk not stored: %v", err)
+		}
+		if !file.encrypted {
+			t.Errorf("Chunk stored in plaintext as %s", file.path)
+		}
+		stored, err := os.ReadFile(file.path)
+		if err != nil {
+			t.Fatalf("Failed to read chunk file: %v", err)
+		}
+		if bytes.Contains(stored, data[:64]) {
+			t.Error("Encrypted chunk file contains the plaintext")
+		}
+		read, err := writer.chunks.get(checksum)
+		if err != nil {
+			t.Fatalf("Failed to read chunk with the key: %v", err)
+		}
+		if !bytes.Equal(read, data) {
+			t.Error("Chunk doesn't round-trip with the key")
+		}
+
+		// Without the key the chunk can't be read
+		if _, err := ReadChunk(storagePath, checksum); err == nil {
+			t.Error("Expected an error reading an encrypted chunk without the key")
+		}
+	}
+
+	// The same chunk sealed twice gets a new nonce
+	first, err := writer.chunks.cipher.seal(chunks[0], chunker.Checksum(chunks[0]))
+	if err != nil {
+		t.Fatalf("Failed to seal chunk: %v", err)
+	}
+	second, err := writer.chunks.cipher.seal(chunks[0], chunker.Checksum(chunks[0]))
+	if err != nil {
+		t.Fatalf("Failed to seal chunk: %v", err)
+	}
+	if bytes.Equal(first[:12], second[:12]) {
+		t.Error("Nonce reused for the same chunk")
+	}
+	// A chunk doesn't decrypt as another one
+	if _, err := writer.chunks.cipher.open(first, chunker.Checksum(chunks[1])); err == nil {
+		t.Error("Expected an error opening a chunk under another checksum")
+	}
+	writer.Close()
+
+	if _, err := openEncryptedWriter(t, storagePath, "wrong passphrase"); err == nil {
+		t.Error("Expected an error opening the storage with a wrong passphrase")
+	}
+	writer, err = openEncryptedWriter(t, storagePath, "correct horse battery staple")
+	if err != nil {
+		t.Fatalf("Failed to reopen writer: %v", err)
+	}
+	defer writer.Close()
+	if read, err := writer.chunks.get(chunker.Checksum(random)); err != nil || !bytes.Equal(read, random) {
+		t.Errorf("Failed to read chunk after reopening: %v", err)
+	}
+}
@@ -0,0 +1,111 @@
+package wfs
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"time"
+)
+
+// Catalog export formats supported by ExportCatalog
+const (
+	CatalogCSV  = "csv"
+	CatalogJSON = "json"
+)
+
+// CatalogEntry is a single file of an exported catalog
+type CatalogEntry struct {
+	Path       string    `json:"path"`
+	Size       int64     `json:"size"`
+	Mode       string    `json:"mode"`
+	Owner      uint32    `json:"owner"`
+	Group      uint32    `json:"group"`
+	ModTime    time.Time `json:"mtime"`
+	Checksum   string    `json:"checksum"`
+	BackupTime time.Time `json:"backup_time"`
+}
+
+var catalogHeader = []string{"path", "size", "mode", "owner", "group", "mtime", "checksum", "backup_time"}
+
+func newCatalogEntry(file *FileMetadata) CatalogEntry {
+	return CatalogEntry{
+		Path:       file.FileInfo.Path,
+		Size:       file.FileInfo.Size,
+		Mode:       file.FileInfo.Mode.String(),
+		Owner:      file.FileInfo.Owner,
+		Group:      file.FileInfo.Group,
+		ModTime:    file.FileInfo.ModTime,
+		Checksum:   file.Checksum,
+		BackupTime: file.BackupTime,
+	}
+}
+
+// ExportCatalog writes the latest version of every file stored for a host
+// as CSV (with a header row) or as a JSON array, streaming rows from the database
+func (w *Writer) ExportCatalog(host string, out io.Writer, format string) error {
+	switch format {
+	case CatalogCSV:
+		return w.exportCSV(host, out)
+	case CatalogJSON:
+		return w.exportJSON(host, out)
+	default:
+		return fmt.Errorf("unsupported catalog format: %s", format)
+	}
+}
+
+func (w *Writer) exportCSV(host string, out io.Writer) error {
+	csvWriter := csv.NewWriter(out)
+	if err := csvWriter.Write(catalogHeader); err != nil {
+		return fmt.Errorf("failed to write catalog header: %w", err)
+	}
+
+	err := w.db.forEachLatestFile(host, func(file *FileMetadata) error {
+		entry := newCatalogEntry(file)
+		return csvWriter.Write([]string{
+			entry.Path,
+			strconv.FormatInt(entry.Size, 10),
+			entry.Mode,
+			strconv.FormatUint(uint64(entry.Owner), 10),
+			strconv.FormatUint(uint64(entry.Group), 10),
+			entry.ModTime.Format(time.RFC3339Nano),
+			entry.Checksum,
+			entry.BackupTime.Format(time.RFC3339Nano),
+		})
+	})
+	if err != nil {
+		return fmt.Errorf("failed to export catalog: %w", err)
+	}
+
+	csvWriter.Flush()
+	return csvWriter.Error()
+}
+
+func (w *Writer) exportJSON(host string, out io.Writer) error {
+	if _, err := io.WriteString(out, "["); err != nil {
+		return err
+	}
+
+	first := true
+	err := w.db.forEachLatestFile(host, func(file *FileMetadata) error {
+		data, err := json.Marshal(newCatalogEntry(file))
+		if err != nil {
+			return err
+		}
+		if !first {
+			if _, err := io.WriteString(out, ",\n"); err != nil {
+				return err
+			}
+		}
+		first = false
+		_, err = out.Write(data)
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("failed to export catalog: %w", err)
+	}
+
+	_, err = io.WriteString(out, "]\n")
+	return err
+}
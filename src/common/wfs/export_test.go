@@ -0,0 +1,109 @@
+package wfs
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/alex-sviridov/miniprotector/common/config"
+)
+
+// populateCatalog stores two versions of one file, another file and a file of a different host
+func populateCatalog(t *testing.T, writer *Writer) {
+	fileInfo := createTestFileInfo()
+	fileInfo.Host = "test-host"
+	fileInfo.Path = "/data/b.txt"
+	if err := writer.AddFile(&fileInfo, "old"); err != nil {
+		t.Fatalf("Failed to add file: %v", err)
+	}
+	fileInfo.Size = 4096
+	fileInfo.ModTime = fileInfo.ModTime.Add(time.Hour)
+	if err := writer.AddFile(&fileInfo, "new"); err != nil {
+		t.Fatalf("Failed to add file: %v", err)
+	}
+
+	fileInfo.Path = "/data/a.txt"
+	fileInfo.Size = 10
+	if err := writer.AddFile(&fileInfo, "a-sum"); err != nil {
+		t.Fatalf("Failed to add file: %v", err)
+	}
+
+	fileInfo.Host = "other-host"
+	fileInfo.Path = "/data/c.txt"
+	if err := writer.AddFile(&fileInfo, "c-sum"); err != nil {
+		t.Fatalf("Failed to add file: %v", err)
+	}
+}
+
+func TestExportCatalogCSV(t *testing.T) {
+	writer := setupTestWriter(t, &config.Config{})
+	populateCatalog(t, writer)
+
+	var buf bytes.Buffer
+	if err := writer.ExportCatalog("test-host", &buf, CatalogCSV); err != nil {
+		t.Fatalf("Failed to export catalog: %v", err)
+	}
+
+	records, err := csv.NewReader(&buf).ReadAll()
+	if err != nil {
+		t.Fatalf("Failed to parse CSV: %v", err)
+	}
+	if len(records) != 3 {
+		t.Fatalf("Expected header and 2 rows, got %d records", len(records))
+	}
+	if records[0][0] != "path" || records[0][7] != "backup_time" {
+		t.Errorf("Unexpected header %v", records[0])
+	}
+	if records[1][0] != "/data/a.txt" || records[1][6] != "a-sum" {
+		t.Errorf("Unexpected first row %v", records[1])
+	}
+	if records[2][0] != "/data/b.txt" || records[2][1] != "4096" || records[2][6] != "new" {
+		t.Errorf("Expected latest version of b.txt, got %v", records[2])
+	}
+	if _, err := time.Parse(time.RFC3339Nano, records[2][5]); err != nil {
+		t.Errorf("Failed to parse mtime: %v", err)
+	}
+}
+
+func TestExportCatalogJSON(t *testing.T) {
+	writer := setupTestWriter(t, &config.Config{})
+	populateCatalog(t, writer)
+
+	var buf bytes.Buffer
+	if err := writer.ExportCatalog("test-host", &buf, CatalogJSON); err != nil {
+		t.Fatalf("Failed to export catalog: %v", err)
+	}
+
+	var entries []CatalogEntry
+	if err := json.Unmarshal(buf.Bytes(), &entries); err != nil {
+		t.Fatalf("Failed to parse JSON: %v", err)
+	}
+	if len(entries) != 2 {
+		t.Fatalf("Expected 2 entries, got %d", len(entries))
+	}
+	if entries[1].Path != "/data/b.txt" || entries[1].Size != 4096 || entries[1].Checksum != "new" {
+		t.Errorf("Expected latest version of b.txt, got %+v", entries[1])
+	}
+	if entries[0].Mode != "-rw-r--r--" {
+		t.Errorf("Expected mode -rw-r--r--, got %s", entries[0].Mode)
+	}
+}
+
+func TestExportCatalogEmptyAndInvalid(t *testing.T) {
+	writer := setupTestWriter(t, &config.Config{})
+
+	var buf bytes.Buffer
+	if err := writer.ExportCatalog("no-host", &buf, CatalogJSON); err != nil {
+		t.Fatalf("Failed to export empty catalog: %v", err)
+	}
+	var entries []CatalogEntry
+	if err := json.Unmarshal(buf.Bytes(), &entries); err != nil || len(entries) != 0 {
+		t.Errorf("Expected empty JSON array, got %q (%v)", buf.String(), err)
+	}
+
+	if err := writer.ExportCatalog("no-host", &buf, "xml"); err == nil {
+		t.Error("Expected error for unsupported format")
+	}
+}
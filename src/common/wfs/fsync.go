@@ -0,0 +1,49 @@
+package wfs
+
+import (
+	"os"
+	"runtime"
+)
+
+// syncer flushes written data to stable storage, *os.File satisfies it
+type syncer interface {
+	Sync() error
+}
+
+// fsyncLimiter bounds the number of fsync operations running at once across the writer
+// so that many streams syncing together don't overwhelm the storage
+type fsyncLimiter struct {
+	slots chan struct{}
+}
+
+// newFsyncLimiter creates a limiter allowing up to limit concurrent fsyncs
+// A limit of zero or less means fsyncs are not throttled
+func newFsyncLimiter(limit int) *fsyncLimiter {
+	if limit <= 0 {
+		return &fsyncLimiter{}
+	}
+	return &fsyncLimiter{slots: make(chan struct{}, limit)}
+}
+
+// sync waits for a free slot and flushes f
+func (l *fsyncLimiter) sync(f syncer) error {
+	if l.slots != nil {
+		l.slots <- struct{}{}
+		defer func() { <-l.slots }()
+	}
+	return f.Sync()
+}
+
+// syncDir waits for a free slot and flushes the directory at path, so that the entries created
+// or renamed in it survive a crash. Windows can't sync a directory, there it does nothing.
+func (l *fsyncLimiter) syncDir(path string) error {
+	if runtime.GOOS == "windows" {
+		return nil
+	}
+	dir, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+	return l.sync(dir)
+}
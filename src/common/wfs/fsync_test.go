@@ -0,0 +1,102 @@
+package wfs
+
+import (
+	"path/filepath"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// countingSyncer records how many syncs run at the same time
+type countingSyncer struct {
+	current atomic.Int32
+	max     atomic.Int32
+	total   atomic.Int32
+}
+
+func (cs *countingSyncer) Sync() error {
+	running := cs.current.Add(1)
+	for {
+		max := cs.max.Load()
+		if running <= max || cs.max.CompareAndSwap(max, running) {
+			break
+		}
+	}
+	time.Sleep(5 * time.Millisecond)
+	cs.current.Add(-1)
+	cs.total.Add(1)
+	return nil
+}
+
+func TestFsyncLimiter(t *testing.T) {
+	for _, limit := range []int{1, 3} {
+		limiter := newFsyncLimiter(limit)
+		cs := &countingSyncer{}
+
+		var wg sync.WaitGroup
+		for i := 0; i < 20; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				if err := limiter.sync(cs); err != nil {
+					t.Errorf("Unexpected sync error: %v", err)
+				}
+			}()
+		}
+		wg.Wait()
+
+		if cs.total.Load() != 20 {
+			t.Errorf("Expected 20 syncs, got %d", cs.total.Load())
+		}
+		if cs.max.Load() > int32(limit) {
+			t.Errorf("Expected at most %d concurrent syncs, got %d", limit, cs.max.Load())
+		}
+	}
+}
+
+func TestFsyncLimiterUnlimited(t *testing.T) {
+	limiter := newFsyncLimiter(0)
+	cs := &countingSyncer{}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			limiter.sync(cs)
+		}()
+	}
+	wg.Wait()
+
+	if cs.total.Load() != 10 {
+		t.Errorf("Expected 10 syncs, got %d", cs.total.Load())
+	}
+}
+
+func TestFsyncLimiterSyncDir(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("Windows can't sync a directory")
+	}
+	limiter := newFsyncLimiter(1)
+	dir := t.TempDir()
+
+	// With the only slot taken, syncing the directory waits for it
+	limiter.slots <- struct{}{}
+	done := make(chan error, 1)
+	go func() { done <- limiter.syncDir(dir) }()
+	select {
+	case err := <-done:
+		t.Fatalf("syncDir returned %v while the limiter was full", err)
+	case <-time.After(20 * time.Millisecond):
+	}
+	<-limiter.slots
+	if err := <-done; err != nil {
+		t.Errorf("syncDir failed: %v", err)
+	}
+
+	if err := limiter.syncDir(filepath.Join(dir, "missing")); err == nil {
+		t.Error("Expected an error for a missing directory")
+	}
+}
@@ -0,0 +1,186 @@
+package wfs
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/alex-sviridov/miniprotector/common/files"
+)
+
+// indexFormat and indexVersion identify backup index files, see WriteIndex
+const (
+	indexFormat  = "wfs-index"
+	indexVersion = 1
+)
+
+// indexHeader is the first line of a backup index
+type indexHeader struct {
+	Format  string    `json:"format"`
+	Version int       `json:"version"`
+	Created time.Time `json:"created"`
+}
+
+// IndexEntry is one file of a backup index, enough to list it and find its data without the database.
+// Data is either Content, for files stored inline, or Chunks, each read with ReadChunk and placed at its
+// offset; the ranges of Size not covered by a chunk are holes of a sparse file and read as zeros.
+type IndexEntry struct {
+	Host          string      `json:"host"`
+	Path          string      `json:"path"`
+	FileType      string      `json:"file_type"`
+	Size          int64       `json:"size"`
+	Mode          fs.FileMode `json:"mode"`
+	Owner         uint32      `json:"owner"`
+	Group         uint32      `json:"group"`
+	ModTime       time.Time   `json:"mtime"`
+	SymlinkTarget string      `json:"symlink_target,omitempty"`
+	Checksum      string      `json:"checksum,omitempty"`
+	BackupTime    time.Time   `json:"backup_time"`
+	Chunks        []ChunkRef  `json:"chunks,omitempty"`
+	Content       []byte      `json:"content,omitempty"`
+}
+
+// WriteIndex writes a backup index listing the latest stored version of each of fileInfos
+// into <storagePath>/index, and returns its path. Files never stored are left out.
+// The index is a JSON line header followed by one IndexEntry per line, read it with ReadIndex.
+func (w *Writer) WriteIndex(fileInfos []*files.FileInfo) (string, error) {
+	dir := filepath.Join(w.storagePath, "index")
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return "", fmt.Errorf("failed to create index directory %s: %w", dir, err)
+	}
+	created := time.Now()
+	file, err := os.CreateTemp(dir, created.Format("20060102T150405")+"-*.jsonl")
+	if err != nil {
+		return "", fmt.Errorf("failed to create backup index: %w", err)
+	}
+	path := file.Name()
+
+	out := bufio.NewWriter(file)
+	err = w.writeIndex(out, created, fileInfos)
+	if err == nil {
+		err = out.Flush()
+	}
+	if err == nil {
+		err = w.syncFile(file)
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(path)
+		return "", fmt.Errorf("failed to write backup index %s: %w", path, err)
+	}
+	return path, nil
+}
+
+func (w *Writer) writeIndex(out io.Writer, created time.Time, fileInfos []*files.FileInfo) error {
+	encoder := json.NewEncoder(out)
+	if err := encoder.Encode(indexHeader{Format: indexFormat, Version: indexVersion, Created: created}); err != nil {
+		return err
+	}
+
+	written := make(map[[2]string]bool, len(fileInfos))
+	for _, fileInfo := range fileInfos {
+		key := [2]string{fileInfo.Host, fileInfo.Path}
+		if written[key] {
+			continue
+		}
+		written[key] = true
+
+		entry, err := w.indexEntry(fileInfo.Path, fileInfo.Host)
+		if err != nil {
+			return err
+		}
+		if entry == nil {
+			continue
+		}
+		if err := encoder.Encode(entry); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// indexEntry describes the latest version of a file, nil if it isn't stored
+func (w *Writer) indexEntry(path, host string) (*IndexEntry, error) {
+	file, err := w.db.getFile(path, host)
+	if err != nil || file == nil {
+		return nil, err
+	}
+	entry := &IndexEntry{
+		Host:          file.SourceHost,
+		Path:          file.FileInfo.Path,
+		FileType:      file.FileType,
+		Size:          file.FileInfo.Size,
+		Mode:          file.FileInfo.Mode,
+		Owner:         file.FileInfo.Owner,
+		Group:         file.FileInfo.Group,
+		ModTime:       file.FileInfo.ModTime,
+		SymlinkTarget: file.FileInfo.SymlinkTarget,
+		Checksum:      file.Checksum,
+		BackupTime:    file.BackupTime,
+	}
+
+	content, inline, err := w.db.getContent(path, host)
+	if err != nil {
+		return nil, err
+	}
+	if inline {
+		entry.Content = content
+		return entry, nil
+	}
+	entry.Chunks, err = w.db.getChunks(file.ID)
+	if err != nil {
+		return nil, err
+	}
+	return entry, nil
+}
+
+// ReadIndex calls fn for every file of a backup index written by WriteIndex
+func ReadIndex(in io.Reader, fn func(*IndexEntry) error) error {
+	decoder := json.NewDecoder(in)
+	var header indexHeader
+	if err := decoder.Decode(&header); err != nil {
+		return fmt.Errorf("failed to read index header: %w", err)
+	}
+	if header.Format != indexFormat {
+		return fmt.Errorf("not a backup index")
+	}
+	if header.Version > indexVersion {
+		return fmt.Errorf("backup index version %d is newer than the supported version %d", header.Version, indexVersion)
+	}
+
+	for {
+		var entry IndexEntry
+		err := decoder.Decode(&entry)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read index entry: %w", err)
+		}
+		if err := fn(&entry); err != nil {
+			return err
+		}
+	}
+}
+
+// ChunkPath returns the file holding the chunk with the given checksum under storagePath,
+// and the codec it was compressed with
+func ChunkPath(storagePath, checksum string) (path, codec string, err error) {
+	store := chunkStore{root: filepath.Join(storagePath, "chunks")}
+	file, err := store.locate(checksum)
+	return file.path, file.codec, err
+}
+
+// ReadChunk returns the decompressed data of a chunk stored under storagePath, verified against its checksum.
+// Encrypted chunks can only be read through a Writer configured with their key.
+func ReadChunk(storagePath, checksum string) ([]byte, error) {
+	store := chunkStore{root: filepath.Join(storagePath, "chunks")}
+	return store.get(checksum)
+}
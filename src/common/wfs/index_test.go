@@ -0,0 +1,107 @@
+package wfs
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/alex-sviridov/miniprotector/common/chunker"
+	"github.com/alex-sviridov/miniprotector/common/config"
+	"github.com/alex-sviridov/miniprotector/common/files"
+)
+
+func TestIndexLocatesFilesWithoutDatabase(t *testing.T) {
+	writer := setupTestWriter(t, &config.Config{InlineMaxSize: 16})
+	modTime := time.Now().Truncate(time.Second)
+
+	// One file in two chunks, one inline and a directory
+	parts := [][]byte{bytes.Repeat([]byte("a"), 100), bytes.Repeat([]byte("b"), 50)}
+	var chunks []ChunkRef
+	var offset int64
+	for _, part := range parts {
+		checksum := chunker.Checksum(part)
+		if err := writer.StoreChunk(checksum, part); err != nil {
+			t.Fatalf("Failed to store chunk: %v", err)
+		}
+		chunks = append(chunks, ChunkRef{Offset: offset, Size: int64(len(part)), Checksum: checksum})
+		offset += int64(len(part))
+	}
+	content := bytes.Join(parts, nil)
+	large := &files.FileInfo{Host: "host1", Path: "/data/large.bin", Name: "large.bin", Size: offset, Mode: 0644, ModTime: modTime}
+	if err := writer.AddFileChunks(large, chunker.Checksum(content), chunks); err != nil {
+		t.Fatalf("Failed to add chunked file: %v", err)
+	}
+	tiny := &files.FileInfo{Host: "host1", Path: "/data/tiny.txt", Name: "tiny.txt", Size: 5, Mode: 0644, ModTime: modTime}
+	if err := writer.AddFileInline(tiny, chunker.Checksum([]byte("hello")), []byte("hello")); err != nil {
+		t.Fatalf("Failed to add inline file: %v", err)
+	}
+	dir := &files.FileInfo{Host: "host1", Path: "/data", Name: "data", Mode: os.ModeDir | 0755, ModTime: modTime}
+	if err := writer.AddFile(dir, ""); err != nil {
+		t.Fatalf("Failed to add directory: %v", err)
+	}
+	missing := &files.FileInfo{Host: "host1", Path: "/data/missing", ModTime: modTime}
+
+	indexPath, err := writer.WriteIndex([]*files.FileInfo{dir, large, tiny, large, missing})
+	if err != nil {
+		t.Fatalf("Failed to write index: %v", err)
+	}
+
+	// From here on only the index and the chunk store are used
+	storagePath := writer.storagePath
+	writer.Close()
+	if err := os.Remove(filepath.Join(storagePath, "wfs.db")); err != nil {
+		t.Fatalf("Failed to remove database: %v", err)
+	}
+
+	index, err := os.Open(indexPath)
+	if err != nil {
+		t.Fatalf("Failed to open index: %v", err)
+	}
+	defer index.Close()
+
+	restored := make(map[string][]byte)
+	var paths []string
+	err = ReadIndex(index, func(entry *IndexEntry) error {
+		paths = append(paths, entry.Path)
+		if len(entry.Chunks) == 0 {
+			restored[entry.Path] = entry.Content
+			return nil
+		}
+		var data []byte
+		for _, chunk := range entry.Chunks {
+			part, err := ReadChunk(storagePath, chunk.Checksum)
+			if err != nil {
+				return err
+			}
+			data = append(data, part...)
+		}
+		if chunker.Checksum(data) != entry.Checksum {
+			t.Errorf("Content of %s doesn't match the indexed checksum", entry.Path)
+		}
+		restored[entry.Path] = data
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Failed to read index: %v", err)
+	}
+
+	// Duplicates and files never stored are left out
+	if want := []string{"/data", "/data/large.bin", "/data/tiny.txt"}; len(paths) != len(want) || paths[0] != want[0] || paths[1] != want[1] || paths[2] != want[2] {
+		t.Errorf("Indexed paths = %v, expected %v", paths, want)
+	}
+	if !bytes.Equal(restored["/data/large.bin"], content) {
+		t.Errorf("Chunked file restored as %d bytes, expected %d", len(restored["/data/large.bin"]), len(content))
+	}
+	if string(restored["/data/tiny.txt"]) != "hello" {
+		t.Errorf("Inline file restored as %q", restored["/data/tiny.txt"])
+	}
+}
+
+func TestReadIndexRejectsOtherFiles(t *testing.T) {
+	err := ReadIndex(bytes.NewReader([]byte(`{"format":"something-else"}`+"\n")), func(*IndexEntry) error { return nil })
+	if err == nil {
+		t.Error("Expected an error for a file that isn't a backup index")
+	}
+}
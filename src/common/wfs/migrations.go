@@ -0,0 +1,207 @@
+package wfs
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+// migration upgrades the database schema from version-1 to version
+type migration struct {
+	version     int
+	description string
+	apply       func(tx *sql.Tx) error
+}
+
+// migrations are applied in order, each in its own transaction.
+// Databases created before schema_version existed may already have some of the
+// later tables and columns, so every step has to tolerate its changes being present.
+// Append new steps at the end, never edit or reorder released ones.
+var migrations = []migration{
+	{1, "files table", func(tx *sql.Tx) error {
+		_, err := tx.Exec(`
+		CREATE TABLE IF NOT EXISTS files (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			path TEXT NOT NULL,
+			name TEXT NOT NULL,
+			size INTEGER NOT NULL,
+			mode INTEGER NOT NULL,
+			owner INTEGER NOT NULL,
+			group_id INTEGER NOT NULL,
+			modtime DATETIME NOT NULL,
+			access_time DATETIME NOT NULL,
+			ctime DATETIME NOT NULL,
+			acl TEXT NOT NULL DEFAULT '{}',
+			source_host TEXT NOT NULL,
+			backup_time DATETIME NOT NULL,
+			checksum TEXT DEFAULT '',
+			metadata_updated_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+			UNIQUE(path, source_host, backup_time)
+		);
+
+		CREATE INDEX IF NOT EXISTS idx_path_sourcehost ON files(path, source_host);
+		CREATE INDEX IF NOT EXISTS idx_path_sourcehost_modtime ON files(path, source_host, modtime);
+		CREATE INDEX IF NOT EXISTS idx_checksum ON files(checksum);
+		`)
+		return err
+	}},
+	{2, "inline content", func(tx *sql.Tx) error {
+		return ensureColumn(tx, "files", "content", "BLOB")
+	}},
+	{3, "file chunks", func(tx *sql.Tx) error {
+		_, err := tx.Exec(`
+		CREATE TABLE IF NOT EXISTS file_chunks (
+			file_id INTEGER NOT NULL REFERENCES files(id),
+			seq INTEGER NOT NULL,
+			chunk_offset INTEGER NOT NULL,
+			size INTEGER NOT NULL,
+			checksum TEXT NOT NULL,
+			PRIMARY KEY(file_id, seq)
+		);
+
+		CREATE INDEX IF NOT EXISTS idx_chunk_checksum ON file_chunks(checksum);
+		`)
+		return err
+	}},
+	{4, "file type and symlink target", func(tx *sql.Tx) error {
+		if err := ensureColumn(tx, "files", "file_type", "TEXT NOT NULL DEFAULT ''"); err != nil {
+			return err
+		}
+		return ensureColumn(tx, "files", "symlink_target", "TEXT NOT NULL DEFAULT ''")
+	}},
+	{5, "deleted files", func(tx *sql.Tx) error {
+		return ensureColumn(tx, "files", "deleted_at", "DATETIME")
+	}},
+	{6, "hard link identity", func(tx *sql.Tx) error {
+		for _, column := range []string{"dev", "ino", "nlink"} {
+			if err := ensureColumn(tx, "files", column, "INTEGER NOT NULL DEFAULT 0"); err != nil {
+				return err
+			}
+		}
+		return nil
+	}},
+	{7, "stream progress", func(tx *sql.Tx) error {
+		_, err := tx.Exec(`
+		CREATE TABLE IF NOT EXISTS stream_progress (
+			source_host TEXT NOT NULL,
+			job_id TEXT NOT NULL,
+			stream_id INTEGER NOT NULL,
+			resume_token TEXT NOT NULL,
+			committed INTEGER NOT NULL,
+			last_file_id TEXT NOT NULL,
+			updated_at DATETIME NOT NULL,
+			PRIMARY KEY(source_host, job_id, stream_id)
+		);
+		`)
+		return err
+	}},
+	{8, "job runs", func(tx *sql.Tx) error {
+		_, err := tx.Exec(`
+		CREATE TABLE IF NOT EXISTS job_runs (
+			job_id TEXT PRIMARY KEY,
+			source_host TEXT NOT NULL,
+			started_at DATETIME NOT NULL,
+			finished_at DATETIME NOT NULL,
+			files_scanned INTEGER NOT NULL,
+			files_stored INTEGER NOT NULL,
+			files_skipped INTEGER NOT NULL,
+			files_failed INTEGER NOT NULL,
+			bytes_sent INTEGER NOT NULL,
+			errors INTEGER NOT NULL,
+			interrupted BOOLEAN NOT NULL
+		);
+		CREATE INDEX IF NOT EXISTS idx_job_runs_host ON job_runs(source_host, started_at);
+		`)
+		return err
+	}},
+}
+
+// schemaVersion is the version of the schema this binary creates and understands
+func schemaVersion() int {
+	return migrations[len(migrations)-1].version
+}
+
+// migrate brings the database schema to the latest version.
+// Returns an error without touching the database if it was created by a newer binary.
+func (fdb *fileDB) migrate() error {
+	_, err := fdb.db.Exec(`CREATE TABLE IF NOT EXISTS schema_version (
+		version INTEGER PRIMARY KEY,
+		applied_at DATETIME NOT NULL
+	)`)
+	if err != nil {
+		return fmt.Errorf("failed to create schema_version table: %w", err)
+	}
+
+	current, err := fdb.currentSchemaVersion()
+	if err != nil {
+		return err
+	}
+	if current > schemaVersion() {
+		return fmt.Errorf("database schema version %d is newer than the supported version %d", current, schemaVersion())
+	}
+
+	for _, m := range migrations {
+		if m.version <= current {
+			continue
+		}
+		if err := fdb.applyMigration(m); err != nil {
+			return fmt.Errorf("migration to version %d (%s) failed: %w", m.version, m.description, err)
+		}
+		fdb.logger.Info("Database schema upgraded", "version", m.version, "description", m.description)
+	}
+	return nil
+}
+
+// currentSchemaVersion returns the highest applied migration, 0 for a new or unversioned database
+func (fdb *fileDB) currentSchemaVersion() (int, error) {
+	var version int
+	if err := fdb.db.QueryRow(`SELECT COALESCE(MAX(version), 0) FROM schema_version`).Scan(&version); err != nil {
+		return 0, fmt.Errorf("failed to read schema version: %w", err)
+	}
+	return version, nil
+}
+
+// applyMigration runs one migration and records its version in the same transaction
+func (fdb *fileDB) applyMigration(m migration) error {
+	tx, err := fdb.db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	if err := m.apply(tx); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`INSERT INTO schema_version (version, applied_at) VALUES (?, ?)`, m.version, time.Now()); err != nil {
+		return fmt.Errorf("failed to record schema version: %w", err)
+	}
+	return tx.Commit()
+}
+
+// ensureColumn adds a column to an existing table unless it is already there
+func ensureColumn(tx *sql.Tx, table, column, definition string) error {
+	rows, err := tx.Query(fmt.Sprintf("SELECT name FROM pragma_table_info('%s')", table))
+	if err != nil {
+		return fmt.Errorf("failed to read columns of %s: %w", table, err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return fmt.Errorf("failed to read columns of %s: %w", table, err)
+		}
+		if name == column {
+			return nil
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("failed to read columns of %s: %w", table, err)
+	}
+	rows.Close()
+
+	if _, err := tx.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", table, column, definition)); err != nil {
+		return fmt.Errorf("failed to add column %s.%s: %w", table, column, err)
+	}
+	return nil
+}
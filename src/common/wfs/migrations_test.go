@@ -0,0 +1,164 @@
+package wfs
+
+import (
+	"database/sql"
+	"io/fs"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// createV1Database creates a database with the schema from before schema_version existed
+func createV1Database(t *testing.T, dbPath string) *sql.DB {
+	t.Helper()
+	db, err := sql.Open("sqlite3", dbPath)
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	_, err = db.Exec(`CREATE TABLE files (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		path TEXT NOT NULL, name TEXT NOT NULL, size INTEGER NOT NULL, mode INTEGER NOT NULL,
+		owner INTEGER NOT NULL, group_id INTEGER NOT NULL, modtime DATETIME NOT NULL,
+		access_time DATETIME NOT NULL, ctime DATETIME NOT NULL, acl TEXT NOT NULL DEFAULT '{}',
+		source_host TEXT NOT NULL, backup_time DATETIME NOT NULL, checksum TEXT DEFAULT '',
+		metadata_updated_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		UNIQUE(path, source_host, backup_time)
+	);
+	CREATE INDEX idx_path_sourcehost ON files(path, source_host);
+	CREATE INDEX idx_path_sourcehost_modtime ON files(path, source_host, modtime);
+	CREATE INDEX idx_checksum ON files(checksum);`)
+	if err != nil {
+		db.Close()
+		t.Fatalf("Failed to create v1 schema: %v", err)
+	}
+	return db
+}
+
+// storedSchemaVersion reads the version recorded in a database
+func storedSchemaVersion(t *testing.T, db *fileDB) int {
+	t.Helper()
+	version, err := db.currentSchemaVersion()
+	if err != nil {
+		t.Fatalf("Failed to read schema version: %v", err)
+	}
+	return version
+}
+
+func TestMigrateNewDatabase(t *testing.T) {
+	db, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	if version := storedSchemaVersion(t, db); version != schemaVersion() {
+		t.Errorf("New database at version %d, expected %d", version, schemaVersion())
+	}
+	var applied int
+	if err := db.db.QueryRow(`SELECT COUNT(*) FROM schema_version`).Scan(&applied); err != nil {
+		t.Fatalf("Failed to count migrations: %v", err)
+	}
+	if applied != len(migrations) {
+		t.Errorf("Recorded %d migrations, expected %d", applied, len(migrations))
+	}
+}
+
+func TestMigrateV1Database(t *testing.T) {
+	dbPath := filepath.Join(t.TempDir(), "v1.db")
+	old := createV1Database(t, dbPath)
+	modtime := time.Now().Truncate(time.Second)
+	_, err := old.Exec(`INSERT INTO files (path, name, size, mode, owner, group_id, modtime, access_time, ctime, acl, source_host, backup_time, checksum)
+	VALUES
+		('/old/file.txt', 'file.txt', 42, ?, 1000, 1000, ?, ?, ?, 'null', 'old-host', ?, 'abc123'),
+		('/old/link', 'link', 0, ?, 0, 0, ?, ?, ?, 'null', 'old-host', ?, '')`,
+		fs.FileMode(0644), modtime, modtime, modtime, modtime,
+		fs.ModeSymlink|0777, modtime, modtime, modtime, modtime)
+	old.Close()
+	if err != nil {
+		t.Fatalf("Failed to insert v1 rows: %v", err)
+	}
+
+	db, err := newTestDB(dbPath)
+	if err != nil {
+		t.Fatalf("Failed to open v1 database: %v", err)
+	}
+	defer func() { db.close() }()
+	if version := storedSchemaVersion(t, db); version != schemaVersion() {
+		t.Errorf("Migrated database at version %d, expected %d", version, schemaVersion())
+	}
+
+	// Rows stored by v1 are all still there
+	stored, err := db.getFile("/old/file.txt", "old-host")
+	if err != nil || stored == nil {
+		t.Fatalf("Failed to read v1 file: %v", err)
+	}
+	if stored.FileInfo.Size != 42 || stored.Checksum != "abc123" || !stored.FileInfo.ModTime.Equal(modtime) {
+		t.Errorf("v1 file changed by migration: %+v", stored)
+	}
+	link, err := db.getFile("/old/link", "old-host")
+	if err != nil || link == nil {
+		t.Fatalf("Failed to read v1 symlink: %v", err)
+	}
+	if link.FileType != "l" || link.FileInfo.SymlinkTarget != "" {
+		t.Errorf("v1 symlink read back with type %q, target %q", link.FileType, link.FileInfo.SymlinkTarget)
+	}
+
+	// Tables and columns added since v1 are usable
+	fileInfo := createTestFileInfo()
+	if _, err := db.addFileWithContent(&fileInfo, "", []byte("data")); err != nil {
+		t.Fatalf("Failed to add file with content: %v", err)
+	}
+	if _, err := db.addFileWithChunks(&fileInfo, "def456", []ChunkRef{{Offset: 0, Size: 4, Checksum: "def456"}}); err != nil {
+		t.Fatalf("Failed to add file with chunks: %v", err)
+	}
+
+	// Reopening applies nothing
+	db.close()
+	db, err = newTestDB(dbPath)
+	if err != nil {
+		t.Fatalf("Failed to reopen database: %v", err)
+	}
+	var applied int
+	if err := db.db.QueryRow(`SELECT COUNT(*) FROM schema_version`).Scan(&applied); err != nil {
+		t.Fatalf("Failed to count migrations: %v", err)
+	}
+	if applied != len(migrations) {
+		t.Errorf("Recorded %d migrations after reopening, expected %d", applied, len(migrations))
+	}
+}
+
+func TestMigrateUnversionedDatabaseWithNewerColumns(t *testing.T) {
+	// Databases upgraded by ensureColumn before schema_version existed already have some columns
+	dbPath := filepath.Join(t.TempDir(), "unversioned.db")
+	old := createV1Database(t, dbPath)
+	_, err := old.Exec(`ALTER TABLE files ADD COLUMN content BLOB`)
+	old.Close()
+	if err != nil {
+		t.Fatalf("Failed to add content column: %v", err)
+	}
+
+	db, err := newTestDB(dbPath)
+	if err != nil {
+		t.Fatalf("Failed to open unversioned database: %v", err)
+	}
+	defer db.close()
+	if version := storedSchemaVersion(t, db); version != schemaVersion() {
+		t.Errorf("Migrated database at version %d, expected %d", version, schemaVersion())
+	}
+}
+
+func TestMigrateRejectsNewerDatabase(t *testing.T) {
+	dbPath := filepath.Join(t.TempDir(), "newer.db")
+	db, err := newTestDB(dbPath)
+	if err != nil {
+		t.Fatalf("Failed to create database: %v", err)
+	}
+	_, err = db.db.Exec(`INSERT INTO schema_version (version, applied_at) VALUES (?, ?)`, schemaVersion()+1, time.Now())
+	db.close()
+	if err != nil {
+		t.Fatalf("Failed to record newer version: %v", err)
+	}
+
+	_, err = newTestDB(dbPath)
+	if err == nil || !strings.Contains(err.Error(), "newer") {
+		t.Fatalf("Expected error opening a newer database, got %v", err)
+	}
+}
@@ -0,0 +1,326 @@
+package wfs
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/alex-sviridov/miniprotector/common/files"
+)
+
+// restoreModeBits are the mode bits applied to restored files
+const restoreModeBits = fs.ModePerm | fs.ModeSetuid | fs.ModeSetgid | fs.ModeSticky
+
+// Restore conflict policies, what to do when a restored file or symlink already exists in the target directory
+const (
+	ConflictFail      = "fail"      // Stop the restore with an error
+	ConflictOverwrite = "overwrite" // Replace the existing file
+	ConflictSkip      = "skip"      // Keep the existing file, the backed up one isn't restored
+	ConflictRename    = "rename"    // Restore alongside as <name>.restored, or <name>.restored.<n> if that exists too
+)
+
+// Restore recreates path and everything below it, as backed up from host, inside targetDir.
+// The versions restored are those current at atTime, the latest ones when atTime is zero.
+// The last element of path is kept, restoring /data/docs into /tmp/r creates /tmp/r/docs.
+// File content is verified against the stored checksums. Mode, times and ACLs are restored,
+// ownership only when running as root. Files and symlinks that already exist in targetDir are
+// handled according to RestoreConflictPolicy; existing directories are restored into, and keep
+// their own metadata with ConflictSkip. With RestoreHardLinks, files that were hard links to the
+// same data when backed up are restored as one file and hard links to it.
+// Named pipes, sockets and devices are skipped.
+func (w *Writer) Restore(ctx context.Context, host, path, targetDir string, atTime time.Time) error {
+	if atTime.IsZero() {
+		atTime = time.Now()
+	}
+	root := filepath.Clean(path)
+	versions, err := w.db.filesAt(host, root, atTime)
+	if err != nil {
+		return err
+	}
+	if len(versions) == 0 {
+		return fmt.Errorf("nothing backed up under %s for %s at %s", root, host, atTime.Format(time.RFC3339))
+	}
+	if err := os.MkdirAll(targetDir, 0700); err != nil {
+		return fmt.Errorf("failed to create restore directory %s: %w", targetDir, err)
+	}
+
+	targets := make([]string, len(versions))
+	for i := range versions {
+		targets[i], err = restoreTarget(targetDir, filepath.Dir(root), versions[i].FileInfo.Path)
+		if err != nil {
+			return err
+		}
+	}
+
+	// Parents sort before their children: directories exist before their content is written.
+	// Symlinks are created once everything else is, so nothing is written through one.
+	policy := w.conf.RestoreConflictPolicy
+	linked := make(map[hardLinkKey]int) // First restored member of each hard link group
+	var links []int
+	for i := range versions {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		file := &versions[i]
+		switch mode := file.FileInfo.Mode; {
+		case mode.IsDir():
+			if _, err := os.Lstat(targets[i]); err == nil && policy == ConflictSkip {
+				targets[i] = ""
+				continue
+			}
+			if err := os.MkdirAll(targets[i], 0700); err != nil {
+				return fmt.Errorf("failed to create directory %s: %w", targets[i], err)
+			}
+		case mode.IsRegular():
+			if targets[i], err = w.conflictTarget(policy, targets[i]); err != nil {
+				return err
+			}
+			if targets[i] == "" {
+				continue
+			}
+			key, grouped := hardLinkGroup(&file.FileInfo, file.Checksum)
+			if first, ok := linked[key]; grouped && ok && w.conf.RestoreHardLinks {
+				if err := restoreHardLink(targets[first], targets[i], policy == ConflictOverwrite); err != nil {
+					return err
+				}
+				continue
+			}
+			if err := w.restoreContent(file, targets[i], policy == ConflictOverwrite); err != nil {
+				return err
+			}
+			if grouped {
+				linked[key] = i
+			}
+		case mode&fs.ModeSymlink != 0:
+			links = append(links, i)
+		default:
+			w.logger.Warn("Skipping special file", "path", file.FileInfo.Path, "mode", mode.String())
+			targets[i] = ""
+		}
+	}
+	for _, i := range links {
+		if err := os.MkdirAll(filepath.Dir(targets[i]), 0700); err != nil {
+			return fmt.Errorf("failed to create directory for %s: %w", targets[i], err)
+		}
+		if targets[i], err = w.conflictTarget(policy, targets[i]); err != nil {
+			return err
+		}
+		if targets[i] == "" {
+			continue
+		}
+		if err := restoreSymlink(versions[i].FileInfo.SymlinkTarget, targets[i], policy == ConflictOverwrite); err != nil {
+			return err
+		}
+	}
+
+	// Children first, so restoring a directory's content doesn't change its times
+	// and read-only directories are only made so once filled
+	for i := len(versions) - 1; i >= 0; i-- {
+		if targets[i] == "" {
+			continue
+		}
+		if err := restoreMetadata(&versions[i].FileInfo, targets[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// restoreTarget maps a stored path below base to its place in targetDir
+func restoreTarget(targetDir, base, path string) (string, error) {
+	rel, err := filepath.Rel(base, filepath.Clean(path))
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("stored path %s is outside %s", path, base)
+	}
+	return filepath.Join(targetDir, rel), nil
+}
+
+// conflictTarget applies the conflict policy to a file about to be restored at target.
+// It returns where to restore the file, empty when it is skipped.
+func (w *Writer) conflictTarget(policy, target string) (string, error) {
+	if _, err := os.Lstat(target); errors.Is(err, fs.ErrNotExist) {
+		return target, nil
+	} else if err != nil {
+		return "", fmt.Errorf("failed to check %s: %w", target, err)
+	}
+	switch policy {
+	case ConflictOverwrite:
+		return target, nil
+	case ConflictSkip:
+		w.logger.Info("Keeping existing file", "path", target)
+		return "", nil
+	case ConflictRename:
+		for n := 0; ; n++ {
+			renamed := target + ".restored"
+			if n > 0 {
+				renamed += "." + strconv.Itoa(n)
+			}
+			if _, err := os.Lstat(renamed); errors.Is(err, fs.ErrNotExist) {
+				w.logger.Info("Restoring alongside existing file", "path", target, "restored_as", renamed)
+				return renamed, nil
+			} else if err != nil {
+				return "", fmt.Errorf("failed to check %s: %w", renamed, err)
+			}
+		}
+	default:
+		return "", fmt.Errorf("%s already exists", target)
+	}
+}
+
+// restoreContent writes the content of a file version to a new file at target, with the holes of a sparse file left unallocated.
+// With replace, the content is written next to target and renamed over an existing file once complete.
+func (w *Writer) restoreContent(file *FileMetadata, target string, replace bool) error {
+	if err := os.MkdirAll(filepath.Dir(target), 0700); err != nil {
+		return fmt.Errorf("failed to create directory for %s: %w", target, err)
+	}
+	var out *os.File
+	var err error
+	if replace {
+		out, err = os.CreateTemp(filepath.Dir(target), "."+filepath.Base(target)+".restore*")
+	} else {
+		out, err = os.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to create %s: %w", target, err)
+	}
+	restored := &sparseFile{file: out, buffered: bufio.NewWriter(out)}
+	err = w.readVersion(file, restored)
+	if err == nil {
+		err = restored.finish()
+	}
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil && replace {
+		err = os.Rename(out.Name(), target)
+	}
+	if err != nil {
+		os.Remove(out.Name())
+		return fmt.Errorf("failed to restore %s: %w", file.FileInfo.Path, err)
+	}
+	return nil
+}
+
+// sparseFile writes restored content to a file, leaving holes where the backed up file had them
+type sparseFile struct {
+	file     *os.File
+	buffered *bufio.Writer
+	size     int64 // Content written or skipped so far
+}
+
+func (s *sparseFile) Write(p []byte) (int, error) {
+	n, err := s.buffered.Write(p)
+	s.size += int64(n)
+	return n, err
+}
+
+// skip leaves a hole of n bytes by seeking past them
+func (s *sparseFile) skip(n int64) error {
+	if n <= 0 {
+		return nil
+	}
+	if err := s.buffered.Flush(); err != nil {
+		return err
+	}
+	if _, err := s.file.Seek(n, io.SeekCurrent); err != nil {
+		return err
+	}
+	s.size += n
+	return nil
+}
+
+// finish writes the buffered content and sets the file size, a hole at the end isn't written otherwise
+func (s *sparseFile) finish() error {
+	if err := s.buffered.Flush(); err != nil {
+		return err
+	}
+	return s.file.Truncate(s.size)
+}
+
+// hardLinkKey identifies the data shared by hard links of one backup
+type hardLinkKey struct {
+	dev, ino uint64
+	checksum string
+}
+
+// hardLinkGroup returns the key of the hard link group of a regular file version, false if it had a single link.
+// The checksum is part of the key so versions backed up at different times are only linked when their content matches.
+func hardLinkGroup(fileInfo *files.FileInfo, checksum string) (hardLinkKey, bool) {
+	if fileInfo.Nlink < 2 || fileInfo.Ino == 0 {
+		return hardLinkKey{}, false
+	}
+	return hardLinkKey{dev: fileInfo.Dev, ino: fileInfo.Ino, checksum: checksum}, true
+}
+
+// restoreHardLink creates target as a hard link to an already restored file, replacing an existing file with replace
+func restoreHardLink(existing, target string, replace bool) error {
+	if err := os.MkdirAll(filepath.Dir(target), 0700); err != nil {
+		return fmt.Errorf("failed to create directory for %s: %w", target, err)
+	}
+	path := target
+	if replace {
+		path = filepath.Join(filepath.Dir(target), "."+filepath.Base(target)+".restore-link")
+		os.Remove(path)
+	}
+	if err := os.Link(existing, path); err != nil {
+		return fmt.Errorf("failed to link %s to %s: %w", target, existing, err)
+	}
+	if replace {
+		if err := os.Rename(path, target); err != nil {
+			os.Remove(path)
+			return fmt.Errorf("failed to replace %s with a hard link: %w", target, err)
+		}
+	}
+	return nil
+}
+
+// restoreSymlink creates a symlink at target, replacing an existing file with replace
+func restoreSymlink(linkTarget, target string, replace bool) error {
+	path := target
+	if replace {
+		path = filepath.Join(filepath.Dir(target), "."+filepath.Base(target)+".restore-link")
+		os.Remove(path)
+	}
+	if err := os.Symlink(linkTarget, path); err != nil {
+		return fmt.Errorf("failed to create symlink %s: %w", target, err)
+	}
+	if replace {
+		if err := os.Rename(path, target); err != nil {
+			os.Remove(path)
+			return fmt.Errorf("failed to replace %s with a symlink: %w", target, err)
+		}
+	}
+	return nil
+}
+
+// restoreMetadata applies the stored ownership, mode, ACL and times to a restored file.
+// Symlinks only get their ownership, the others apply to the file they point to.
+func restoreMetadata(fileInfo *files.FileInfo, target string) error {
+	if runtime.GOOS != "windows" && os.Geteuid() == 0 {
+		if err := os.Lchown(target, int(fileInfo.Owner), int(fileInfo.Group)); err != nil {
+			return fmt.Errorf("failed to restore owner of %s: %w", target, err)
+		}
+	}
+	if fileInfo.Mode&fs.ModeSymlink != 0 {
+		return nil
+	}
+	if err := os.Chmod(target, fileInfo.Mode&restoreModeBits); err != nil {
+		return fmt.Errorf("failed to restore mode of %s: %w", target, err)
+	}
+	if err := files.RestoreACL(target, fileInfo.ACL); err != nil {
+		return err
+	}
+	if err := os.Chtimes(target, fileInfo.AccessTime, fileInfo.ModTime); err != nil {
+		return fmt.Errorf("failed to restore times of %s: %w", target, err)
+	}
+	return nil
+}
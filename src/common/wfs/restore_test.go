@@ -0,0 +1,123 @@
+package wfs
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/alex-sviridov/miniprotector/common/config"
+	"github.com/alex-sviridov/miniprotector/common/files"
+)
+
+func TestRestoreAsOfTime(t *testing.T) {
+	writer := setupTestWriter(t, &config.Config{})
+	base := time.Date(2025, 3, 1, 12, 0, 0, 0, time.UTC)
+	writer.db.clock.now = func() time.Time { return base }
+
+	dir := &files.FileInfo{Host: "host1", Path: "/data", Name: "data", Mode: os.ModeDir | 0755, ModTime: base}
+	if err := writer.AddFile(dir, ""); err != nil {
+		t.Fatalf("Failed to add directory: %v", err)
+	}
+	file := &files.FileInfo{Host: "host1", Path: "/data/file", Name: "file", Mode: 0644, ModTime: base}
+	addChunkedVersion(t, writer, file, []byte("first"))
+	gone := &files.FileInfo{Host: "host1", Path: "/data/gone", Name: "gone", Mode: 0644, ModTime: base}
+	addChunkedVersion(t, writer, gone, []byte("deleted later"))
+	// Shares the prefix without being below /data
+	sibling := &files.FileInfo{Host: "host1", Path: "/database", Name: "database", Mode: 0644, ModTime: base}
+	addChunkedVersion(t, writer, sibling, []byte("not restored"))
+
+	// A day later the file changes and gone is removed at the source
+	writer.db.clock.now = func() time.Time { return base.Add(24 * time.Hour) }
+	addChunkedVersion(t, writer, file, []byte("second"))
+	if err := writer.MarkDeleted("/data/gone", "host1", base.Add(24*time.Hour)); err != nil {
+		t.Fatalf("Failed to mark deleted: %v", err)
+	}
+
+	tests := []struct {
+		name     string
+		at       time.Time
+		content  string
+		restored bool // Whether gone is restored
+	}{
+		{"before the change", base.Add(time.Hour), "first", true},
+		{"latest", time.Time{}, "second", false},
+	}
+	for _, tt := range tests {
+		target := t.TempDir()
+		if err := writer.Restore(context.Background(), "host1", "/data", target, tt.at); err != nil {
+			t.Fatalf("%s: restore failed: %v", tt.name, err)
+		}
+		content, err := os.ReadFile(filepath.Join(target, "data", "file"))
+		if err != nil || string(content) != tt.content {
+			t.Errorf("%s: file content = %q, %v; expected %q", tt.name, content, err, tt.content)
+		}
+		if _, err := os.Stat(filepath.Join(target, "data", "gone")); (err == nil) != tt.restored {
+			t.Errorf("%s: gone restored = %v, expected %v", tt.name, err == nil, tt.restored)
+		}
+		if _, err := os.Stat(filepath.Join(target, "database")); err == nil {
+			t.Errorf("%s: file outside the restored path was restored", tt.name)
+		}
+	}
+
+	if err := writer.Restore(context.Background(), "host1", "/data", t.TempDir(), base.Add(-time.Hour)); err == nil {
+		t.Error("Expected an error restoring from before the first backup")
+	}
+}
+
+func TestRestoreConflictPolicy(t *testing.T) {
+	tests := []struct {
+		policy  string
+		wantErr bool
+		want    map[string]string // Content of the files in the restored directory
+	}{
+		{policy: ConflictFail, wantErr: true, want: map[string]string{"file": "local"}},
+		{policy: ConflictOverwrite, want: map[string]string{"file": "backed up"}},
+		{policy: ConflictSkip, want: map[string]string{"file": "local"}},
+		{policy: ConflictRename, want: map[string]string{"file": "local", "file.restored": "backed up"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.policy, func(t *testing.T) {
+			writer := setupTestWriter(t, &config.Config{RestoreConflictPolicy: tt.policy})
+			file := &files.FileInfo{Host: "host1", Path: "/data/file", Name: "file", Mode: 0640, ModTime: time.Now()}
+			addChunkedVersion(t, writer, file, []byte("backed up"))
+
+			target := t.TempDir()
+			existing := filepath.Join(target, "data", "file")
+			if err := os.MkdirAll(filepath.Dir(existing), 0755); err != nil {
+				t.Fatalf("Failed to create directory: %v", err)
+			}
+			if err := os.WriteFile(existing, []byte("local"), 0600); err != nil {
+				t.Fatalf("Failed to write file: %v", err)
+			}
+
+			err := writer.Restore(context.Background(), "host1", "/data", target, time.Time{})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Restore error = %v, expected error: %v", err, tt.wantErr)
+			}
+			entries, err := os.ReadDir(filepath.Dir(existing))
+			if err != nil {
+				t.Fatalf("Failed to list restored directory: %v", err)
+			}
+			if len(entries) != len(tt.want) {
+				t.Errorf("Restored directory has %d entries, expected %d", len(entries), len(tt.want))
+			}
+			for name, want := range tt.want {
+				content, err := os.ReadFile(filepath.Join(filepath.Dir(existing), name))
+				if err != nil || string(content) != want {
+					t.Errorf("%s = %q (%v), expected %q", name, content, err, want)
+				}
+			}
+			if tt.policy == ConflictOverwrite {
+				info, err := os.Stat(existing)
+				if err != nil {
+					t.Fatalf("Failed to stat overwritten file: %v", err)
+				}
+				if info.Mode().Perm() != 0640 {
+					t.Errorf("Overwritten file has mode %v, expected the backed up 0640", info.Mode().Perm())
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,53 @@
+package wfs
+
+import (
+	"fmt"
+	"time"
+)
+
+// PruneKeepLast deletes all but the n most recent versions of every path backed up from host.
+// All versions are deleted in one transaction. Chunks used only by deleted versions stay on
+// disk until CollectChunks removes them.
+func (w *Writer) PruneKeepLast(host string, n int) (deleted int, err error) {
+	if n < 1 {
+		return 0, fmt.Errorf("must keep at least one version, got %d", n)
+	}
+	deleted, err = w.db.pruneVersions(host, n, time.Time{})
+	if err != nil {
+		return 0, err
+	}
+	w.logger.Info("Pruned file versions", "host", host, "keep_last", n, "deleted", deleted)
+	return deleted, nil
+}
+
+// PruneVersions deletes, for every path backed up from host, the versions beyond the keepLast
+// most recent ones and the versions backed up before olderThan. keepLast of 0 and a zero olderThan
+// disable their rule. The latest version of a path is always kept, so a file that stopped
+// changing long ago still has one. Chunks are left for CollectChunks, as with PruneKeepLast.
+func (w *Writer) PruneVersions(host string, keepLast int, olderThan time.Time) (removed int, err error) {
+	if keepLast < 0 {
+		return 0, fmt.Errorf("number of versions to keep can't be negative, got %d", keepLast)
+	}
+	removed, err = w.db.pruneVersions(host, keepLast, olderThan)
+	if err != nil {
+		return 0, err
+	}
+	w.logger.Info("Pruned file versions", "host", host, "keep_last", keepLast, "older_than", olderThan, "deleted", removed)
+	return removed, nil
+}
+
+// CollectChunks removes chunks that no recorded file version uses any more.
+// Chunks stored or reused at or after before are kept, pass a time earlier than the start
+// of any stream still running so chunks of files not recorded yet survive.
+func (w *Writer) CollectChunks(before time.Time) (removed int, err error) {
+	referenced, err := w.db.referencedChunks()
+	if err != nil {
+		return 0, err
+	}
+	removed, err = w.chunks.collect(func(checksum string) bool { return referenced[checksum] }, before)
+	if err != nil {
+		return removed, fmt.Errorf("failed to collect chunks: %w", err)
+	}
+	w.logger.Info("Collected unused chunks", "removed", removed)
+	return removed, nil
+}
@@ -0,0 +1,197 @@
+package wfs
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/alex-sviridov/miniprotector/common/chunker"
+	"github.com/alex-sviridov/miniprotector/common/config"
+	"github.com/alex-sviridov/miniprotector/common/files"
+)
+
+// addChunkedVersion stores parts as chunks and records them as a new version of fileInfo
+func addChunkedVersion(t *testing.T, writer *Writer, fileInfo *files.FileInfo, parts ...[]byte) []byte {
+	t.Helper()
+	var content []byte
+	var chunks []ChunkRef
+	for _, part := range parts {
+		checksum := chunker.Checksum(part)
+		if err := writer.StoreChunk(checksum, part); err != nil {
+			t.Fatalf("Failed to store chunk: %v", err)
+		}
+		chunks = append(chunks, ChunkRef{Offset: int64(len(content)), Size: int64(len(part)), Checksum: checksum})
+		content = append(content, part...)
+	}
+	fileInfo.Size = int64(len(content))
+	if err := writer.AddFileChunks(fileInfo, chunker.Checksum(content), chunks); err != nil {
+		t.Fatalf("Failed to add file version: %v", err)
+	}
+	return content
+}
+
+// chunkExists reports whether a chunk is still in the store
+func chunkExists(writer *Writer, data []byte) bool {
+	checksum := chunker.Checksum(data)
+	_, err := os.Stat(filepath.Join(writer.chunks.root, checksum[:2], checksum))
+	return err == nil
+}
+
+func TestPruneKeepLast(t *testing.T) {
+	writer := setupTestWriter(t, &config.Config{})
+	shared := []byte("header shared by every version")
+	modTime := time.Now().Truncate(time.Second)
+
+	var own [][]byte
+	var latest []byte
+	for i := range 5 {
+		part := []byte(fmt.Sprintf("content of version %d", i))
+		own = append(own, part)
+		fileInfo := &files.FileInfo{Host: "host1", Path: "/data/file", Name: "file", ModTime: modTime.Add(time.Duration(i) * time.Second)}
+		latest = addChunkedVersion(t, writer, fileInfo, shared, part)
+	}
+	// Another path with a single version is left alone
+	other := &files.FileInfo{Host: "host1", Path: "/data/other", Name: "other", ModTime: modTime}
+	addChunkedVersion(t, writer, other, []byte("other file"))
+
+	deleted, err := writer.PruneKeepLast("host1", 2)
+	if err != nil {
+		t.Fatalf("PruneKeepLast failed: %v", err)
+	}
+	if deleted != 3 {
+		t.Errorf("Deleted %d versions, expected 3", deleted)
+	}
+
+	removed, err := writer.CollectChunks(time.Now().Add(time.Second))
+	if err != nil {
+		t.Fatalf("CollectChunks failed: %v", err)
+	}
+	if removed != 3 {
+		t.Errorf("Collected %d chunks, expected the 3 used only by pruned versions", removed)
+	}
+	for i, part := range own {
+		if kept := chunkExists(writer, part); kept != (i >= 3) {
+			t.Errorf("Chunk of version %d kept = %v", i, kept)
+		}
+	}
+	if !chunkExists(writer, shared) {
+		t.Error("Chunk shared with kept versions was collected")
+	}
+
+	var out bytes.Buffer
+	if err := writer.ReadFile("/data/file", "host1", &out); err != nil {
+		t.Fatalf("Failed to read latest version: %v", err)
+	}
+	if !bytes.Equal(out.Bytes(), latest) {
+		t.Error("Latest version changed after pruning")
+	}
+	if err := writer.ReadFile("/data/other", "host1", &bytes.Buffer{}); err != nil {
+		t.Errorf("Other file damaged by pruning: %v", err)
+	}
+
+	if _, err := writer.PruneKeepLast("host1", 0); err == nil {
+		t.Error("Expected error keeping no versions")
+	}
+}
+
+func TestCollectChunksKeepsRecent(t *testing.T) {
+	writer := setupTestWriter(t, &config.Config{})
+	data := []byte("chunk of a file still being received")
+	if err := writer.StoreChunk(chunker.Checksum(data), data); err != nil {
+		t.Fatalf("Failed to store chunk: %v", err)
+	}
+
+	// Not referenced yet, but newer than the cutoff
+	removed, err := writer.CollectChunks(time.Now().Add(-time.Minute))
+	if err != nil {
+		t.Fatalf("CollectChunks failed: %v", err)
+	}
+	if removed != 0 || !chunkExists(writer, data) {
+		t.Error("Recently stored chunk was collected")
+	}
+}
+
+func TestPruneVersions(t *testing.T) {
+	now := time.Now()
+	// Versions of /data/file backed up 50, 40, 30, 20 and 10 days ago, /data/old only once 100 days ago
+	setup := func(t *testing.T) *Writer {
+		writer := setupTestWriter(t, &config.Config{})
+		backupTime := now.AddDate(0, 0, -100)
+		writer.db.clock.now = func() time.Time { return backupTime }
+		old := &files.FileInfo{Host: "host1", Path: "/data/old", Name: "old"}
+		if err := writer.AddFile(old, ""); err != nil {
+			t.Fatalf("Failed to add file: %v", err)
+		}
+		for days := 50; days > 0; days -= 10 {
+			backupTime = now.AddDate(0, 0, -days)
+			fileInfo := &files.FileInfo{Host: "host1", Path: "/data/file", Name: "file", ModTime: backupTime}
+			if err := writer.AddFile(fileInfo, fmt.Sprint(days)); err != nil {
+				t.Fatalf("Failed to add version: %v", err)
+			}
+		}
+		// Other hosts are left alone
+		other := &files.FileInfo{Host: "host2", Path: "/data/file", Name: "file"}
+		if err := writer.AddFile(other, ""); err != nil {
+			t.Fatalf("Failed to add file: %v", err)
+		}
+		return writer
+	}
+	// remaining lists the checksums of the stored versions of /data/file, newest first
+	remaining := func(t *testing.T, writer *Writer) string {
+		rows, err := writer.db.db.Query(`SELECT checksum FROM files WHERE path = '/data/file' AND source_host = 'host1' ORDER BY backup_time DESC`)
+		if err != nil {
+			t.Fatalf("Failed to query versions: %v", err)
+		}
+		defer rows.Close()
+		var checksums []string
+		for rows.Next() {
+			var checksum string
+			rows.Scan(&checksum)
+			checksums = append(checksums, checksum)
+		}
+		return fmt.Sprint(checksums)
+	}
+
+	tests := []struct {
+		name      string
+		keepLast  int
+		olderThan time.Time
+		removed   int
+		versions  string
+	}{
+		{"keep last", 3, time.Time{}, 2, "[10 20 30]"},
+		{"age cutoff", 0, now.AddDate(0, 0, -25), 3, "[10 20]"},
+		{"either rule", 4, now.AddDate(0, 0, -35), 2, "[10 20 30]"},
+		{"cutoff after every version", 0, now, 4, "[10]"},
+		{"no rule", 0, time.Time{}, 0, "[10 20 30 40 50]"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			writer := setup(t)
+			removed, err := writer.PruneVersions("host1", tt.keepLast, tt.olderThan)
+			if err != nil {
+				t.Fatalf("PruneVersions failed: %v", err)
+			}
+			if removed != tt.removed {
+				t.Errorf("Removed %d versions, expected %d", removed, tt.removed)
+			}
+			if got := remaining(t, writer); got != tt.versions {
+				t.Errorf("Remaining versions %s, expected %s", got, tt.versions)
+			}
+			// Single and latest versions survive any cutoff
+			for _, file := range []struct{ path, host string }{{"/data/old", "host1"}, {"/data/file", "host2"}} {
+				if stored, _ := writer.GetFile(file.path, file.host); stored == nil {
+					t.Errorf("%s of %s was pruned", file.path, file.host)
+				}
+			}
+		})
+	}
+
+	writer := setup(t)
+	if _, err := writer.PruneVersions("host1", -1, time.Time{}); err == nil {
+		t.Error("Expected error for negative keepLast")
+	}
+}
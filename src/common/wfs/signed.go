@@ -0,0 +1,217 @@
+package wfs
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/alex-sviridov/miniprotector/common/chunker"
+	"github.com/alex-sviridov/miniprotector/common/files"
+)
+
+// minManifestKeySize is the shortest HMAC key accepted for signed manifests
+const minManifestKeySize = 16
+
+// ErrManifestSignature is returned when a signed manifest doesn't match its signature
+var ErrManifestSignature = errors.New("manifest signature mismatch")
+
+// SignedManifest lists the files of a backup with their checksums, signed with HMAC-SHA256
+// so that tampering with the manifest or with a restored tree can be detected
+type SignedManifest struct {
+	Created   time.Time      `json:"created"`
+	Files     []ManifestFile `json:"files"`
+	Signature string         `json:"signature"` // Hex HMAC-SHA256 of the manifest encoded with an empty Signature
+}
+
+// ManifestFile is one file of a signed manifest
+type ManifestFile struct {
+	Host          string `json:"host"`
+	Path          string `json:"path"`
+	FileType      string `json:"file_type"`
+	Size          int64  `json:"size"`
+	Checksum      string `json:"checksum,omitempty"` // BLAKE3 of the content of regular files
+	SymlinkTarget string `json:"symlink_target,omitempty"`
+}
+
+// TamperIssue is a difference found between a signed manifest and a restored tree
+type TamperIssue struct {
+	Path    string // Path in the restored tree
+	Problem string
+}
+
+// LoadManifestKey reads the HMAC key used to sign manifests from a file
+func LoadManifestKey(path string) ([]byte, error) {
+	key, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read manifest key: %w", err)
+	}
+	if len(key) < minManifestKeySize {
+		return nil, fmt.Errorf("manifest key %s is shorter than %d bytes", path, minManifestKeySize)
+	}
+	return key, nil
+}
+
+// WriteSignedManifest writes a manifest of the latest stored version of each of fileInfos,
+// signed with key, into <storagePath>/manifests and returns its path. Files never stored are left out.
+func (w *Writer) WriteSignedManifest(fileInfos []*files.FileInfo, key []byte) (string, error) {
+	manifest := SignedManifest{Created: time.Now()}
+	written := make(map[[2]string]bool, len(fileInfos))
+	for _, fileInfo := range fileInfos {
+		k := [2]string{fileInfo.Host, fileInfo.Path}
+		if written[k] {
+			continue
+		}
+		written[k] = true
+
+		file, err := w.db.getFile(fileInfo.Path, fileInfo.Host)
+		if err != nil {
+			return "", err
+		}
+		if file == nil {
+			continue
+		}
+		manifest.Files = append(manifest.Files, ManifestFile{
+			Host:          file.SourceHost,
+			Path:          file.FileInfo.Path,
+			FileType:      file.FileType,
+			Size:          file.FileInfo.Size,
+			Checksum:      file.Checksum,
+			SymlinkTarget: file.FileInfo.SymlinkTarget,
+		})
+	}
+	if err := manifest.Sign(key); err != nil {
+		return "", err
+	}
+
+	dir := filepath.Join(w.storagePath, "manifests")
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return "", fmt.Errorf("failed to create manifest directory %s: %w", dir, err)
+	}
+	out, err := os.CreateTemp(dir, manifest.Created.Format("20060102T150405")+"-*.json")
+	if err != nil {
+		return "", fmt.Errorf("failed to create signed manifest: %w", err)
+	}
+	path := out.Name()
+	err = json.NewEncoder(out).Encode(&manifest)
+	if err == nil {
+		err = w.syncFile(out)
+	}
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(path)
+		return "", fmt.Errorf("failed to write signed manifest %s: %w", path, err)
+	}
+	return path, nil
+}
+
+// ReadSignedManifest decodes a manifest written by WriteSignedManifest and checks its signature
+func ReadSignedManifest(in io.Reader, key []byte) (*SignedManifest, error) {
+	var manifest SignedManifest
+	if err := json.NewDecoder(in).Decode(&manifest); err != nil {
+		return nil, fmt.Errorf("failed to read signed manifest: %w", err)
+	}
+	expected, err := manifest.signature(key)
+	if err != nil {
+		return nil, err
+	}
+	actual, err := hex.DecodeString(manifest.Signature)
+	if err != nil || !hmac.Equal(actual, expected) {
+		return nil, ErrManifestSignature
+	}
+	return &manifest, nil
+}
+
+// Sign sets the signature of the manifest
+func (m *SignedManifest) Sign(key []byte) error {
+	signature, err := m.signature(key)
+	if err != nil {
+		return err
+	}
+	m.Signature = hex.EncodeToString(signature)
+	return nil
+}
+
+// signature computes the HMAC of the manifest encoded without its signature
+func (m *SignedManifest) signature(key []byte) ([]byte, error) {
+	if len(key) < minManifestKeySize {
+		return nil, fmt.Errorf("manifest key is shorter than %d bytes", minManifestKeySize)
+	}
+	unsigned := *m
+	unsigned.Signature = ""
+	data, err := json.Marshal(&unsigned)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode manifest: %w", err)
+	}
+	mac := hmac.New(sha256.New, key)
+	mac.Write(data)
+	return mac.Sum(nil), nil
+}
+
+// VerifyTree compares a restored tree with the manifest. Files of the manifest below sourceRoot
+// are expected at the same place below restoredRoot, with the recorded type, size, content and
+// symlink target. Every difference is reported, files outside sourceRoot are ignored.
+func (m *SignedManifest) VerifyTree(sourceRoot, restoredRoot string) []TamperIssue {
+	sourceRoot = filepath.Clean(sourceRoot)
+	var issues []TamperIssue
+	for _, file := range m.Files {
+		rel, err := filepath.Rel(sourceRoot, filepath.Clean(file.Path))
+		if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			continue
+		}
+		path := filepath.Join(restoredRoot, rel)
+		if problem := verifyManifestFile(&file, path); problem != "" {
+			issues = append(issues, TamperIssue{Path: path, Problem: problem})
+		}
+	}
+	return issues
+}
+
+// verifyManifestFile describes how the file at path differs from its manifest entry, empty if it doesn't
+func verifyManifestFile(file *ManifestFile, path string) string {
+	info, err := os.Lstat(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return "missing"
+	}
+	if err != nil {
+		return err.Error()
+	}
+	if fileType := string(files.FileInfo{Mode: info.Mode()}.GetType()); fileType != file.FileType {
+		return fmt.Sprintf("type %s, expected %s", fileType, file.FileType)
+	}
+	switch {
+	case info.Mode().IsRegular():
+		if info.Size() != file.Size {
+			return fmt.Sprintf("size %d, expected %d", info.Size(), file.Size)
+		}
+		if file.Checksum == "" {
+			return ""
+		}
+		checksum, err := chunker.CalculateFileChecksum(path, chunker.ChecksumAlgo(file.Checksum))
+		if err != nil {
+			return err.Error()
+		}
+		if checksum != file.Checksum {
+			return fmt.Sprintf("checksum %s, expected %s", checksum, file.Checksum)
+		}
+	case info.Mode()&fs.ModeSymlink != 0:
+		target, err := os.Readlink(path)
+		if err != nil {
+			return err.Error()
+		}
+		if target != file.SymlinkTarget {
+			return fmt.Sprintf("symlink to %s, expected %s", target, file.SymlinkTarget)
+		}
+	}
+	return ""
+}
@@ -0,0 +1,74 @@
+package wfs
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alex-sviridov/miniprotector/common/config"
+	"github.com/alex-sviridov/miniprotector/common/files"
+)
+
+func TestSignedManifestDetectsTampering(t *testing.T) {
+	writer := setupTestWriter(t, &config.Config{})
+	key := []byte("0123456789abcdef-test-key")
+	modTime := time.Now().Truncate(time.Second)
+
+	dir := &files.FileInfo{Host: "host1", Path: "/data", Name: "data", Mode: os.ModeDir | 0755, ModTime: modTime}
+	if err := writer.AddFile(dir, ""); err != nil {
+		t.Fatalf("Failed to add directory: %v", err)
+	}
+	report := &files.FileInfo{Host: "host1", Path: "/data/report.txt", Name: "report.txt", Mode: 0644, ModTime: modTime}
+	addChunkedVersion(t, writer, report, []byte("quarterly "), []byte("numbers"))
+	notes := &files.FileInfo{Host: "host1", Path: "/data/notes.txt", Name: "notes.txt", Mode: 0644, ModTime: modTime}
+	addChunkedVersion(t, writer, notes, []byte("unchanged notes"))
+
+	manifestPath, err := writer.WriteSignedManifest([]*files.FileInfo{dir, report, notes}, key)
+	if err != nil {
+		t.Fatalf("Failed to write signed manifest: %v", err)
+	}
+	data, err := os.ReadFile(manifestPath)
+	if err != nil {
+		t.Fatalf("Failed to read manifest: %v", err)
+	}
+	manifest, err := ReadSignedManifest(bytes.NewReader(data), key)
+	if err != nil {
+		t.Fatalf("Failed to verify manifest signature: %v", err)
+	}
+
+	target := t.TempDir()
+	if err := writer.Restore(context.Background(), "host1", "/data", target, time.Time{}); err != nil {
+		t.Fatalf("Restore failed: %v", err)
+	}
+	restoredRoot := filepath.Join(target, "data")
+	if issues := manifest.VerifyTree("/data", restoredRoot); len(issues) != 0 {
+		t.Fatalf("Untouched tree reported as tampered: %v", issues)
+	}
+
+	// Same size, different content
+	tampered := filepath.Join(restoredRoot, "report.txt")
+	if err := os.WriteFile(tampered, []byte("quarterly NUMBERS"), 0644); err != nil {
+		t.Fatalf("Failed to tamper with file: %v", err)
+	}
+	issues := manifest.VerifyTree("/data", restoredRoot)
+	if len(issues) != 1 || issues[0].Path != tampered || !strings.HasPrefix(issues[0].Problem, "checksum") {
+		t.Errorf("Issues = %v, expected a checksum mismatch for %s", issues, tampered)
+	}
+
+	// A manifest edited to match the tampered file no longer matches its signature
+	edited := bytes.Replace(data, []byte(`"size":17`), []byte(`"size":18`), 1)
+	if bytes.Equal(edited, data) {
+		t.Fatal("Test manifest doesn't contain the expected size")
+	}
+	if _, err := ReadSignedManifest(bytes.NewReader(edited), key); !errors.Is(err, ErrManifestSignature) {
+		t.Errorf("Edited manifest: got %v, expected %v", err, ErrManifestSignature)
+	}
+	if _, err := ReadSignedManifest(bytes.NewReader(data), []byte("another-key-of-16-bytes")); !errors.Is(err, ErrManifestSignature) {
+		t.Errorf("Wrong key: got %v, expected %v", err, ErrManifestSignature)
+	}
+}
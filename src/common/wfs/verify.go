@@ -0,0 +1,127 @@
+package wfs
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"time"
+
+	"github.com/alex-sviridov/miniprotector/common/chunker"
+)
+
+// VerifyProblem is the kind of problem VerifyBackup found with a stored file
+type VerifyProblem string
+
+const (
+	VerifyMissingChunk     VerifyProblem = "missing chunk"     // A chunk of the file isn't in the store
+	VerifyCorruptChunk     VerifyProblem = "corrupt chunk"     // A chunk has the wrong size or content
+	VerifyChecksumMismatch VerifyProblem = "checksum mismatch" // The stored data doesn't match the file checksum
+)
+
+// VerifyIssue is a problem with one stored file version
+type VerifyIssue struct {
+	Path       string
+	BackupTime time.Time
+	Problem    VerifyProblem
+	Chunk      string // Checksum of the chunk concerned, empty for problems with the whole file
+	Detail     string
+}
+
+// VerifyBackup checks that every stored version of every file of a host can be restored:
+// each chunk it references is in the store with the recorded size. With checkData the data is also
+// read back, each chunk and the whole content checked against their BLAKE3 checksums.
+// All problems found are returned, the error is only set when the check itself failed.
+func (w *Writer) VerifyBackup(host string, checkData bool) ([]VerifyIssue, error) {
+	var issues []VerifyIssue
+	err := w.db.forEachVersion(host, func(file *FileMetadata) error {
+		fileIssues, err := w.verifyVersion(file, checkData)
+		issues = append(issues, fileIssues...)
+		return err
+	})
+	if err != nil {
+		return issues, fmt.Errorf("failed to verify backup of %s: %w", host, err)
+	}
+	return issues, nil
+}
+
+// verifyVersion checks the data of one file version
+func (w *Writer) verifyVersion(file *FileMetadata, checkData bool) ([]VerifyIssue, error) {
+	if !file.FileInfo.Mode.IsRegular() {
+		return nil, nil
+	}
+	issue := func(problem VerifyProblem, chunk, detail string) VerifyIssue {
+		return VerifyIssue{Path: file.FileInfo.Path, BackupTime: file.BackupTime, Problem: problem, Chunk: chunk, Detail: detail}
+	}
+
+	algo := chunker.ChecksumAlgo(file.Checksum)
+	hash, err := chunker.NewHasher(algo, 0)
+	if err != nil {
+		return nil, err
+	}
+	content, inline, err := w.db.getContentByID(file.ID)
+	if err != nil {
+		return nil, err
+	}
+	var issues []VerifyIssue
+	if inline {
+		hash.Write(content)
+	} else {
+		chunks, err := w.db.getChunks(file.ID)
+		if err != nil {
+			return nil, err
+		}
+		// Holes of sparse files hash as zeros
+		var offset int64
+		for _, ref := range chunks {
+			chunker.WriteZeros(hash, ref.Offset-offset)
+			if problem, detail := w.verifyChunk(ref, checkData, hash); problem != "" {
+				issues = append(issues, issue(problem, ref.Checksum, detail))
+			}
+			offset = ref.Offset + ref.Size
+		}
+		chunker.WriteZeros(hash, file.FileInfo.Size-offset)
+	}
+
+	// A damaged chunk already explains a wrong checksum
+	if checkData && len(issues) == 0 && file.Checksum != "" {
+		if actual := chunker.FormatChecksum(algo, hash.Sum(nil)); actual != file.Checksum {
+			issues = append(issues, issue(VerifyChecksumMismatch, "", fmt.Sprintf("stored data hashes to %s, expected %s", actual, file.Checksum)))
+		}
+	}
+	return issues, nil
+}
+
+// verifyChunk checks one chunk of a file, adding its data to hash when checkData is set
+func (w *Writer) verifyChunk(ref ChunkRef, checkData bool, hash io.Writer) (VerifyProblem, string) {
+	file, err := w.chunks.locate(ref.Checksum)
+	if errors.Is(err, fs.ErrNotExist) {
+		return VerifyMissingChunk, err.Error()
+	}
+	if err != nil {
+		return VerifyCorruptChunk, err.Error()
+	}
+	// Compressed and encrypted chunks only have a known size once read back
+	if file.codec == chunker.CompressionNone && !file.encrypted {
+		info, err := os.Stat(file.path)
+		if err != nil {
+			return VerifyMissingChunk, err.Error()
+		}
+		if info.Size() != ref.Size {
+			return VerifyCorruptChunk, fmt.Sprintf("%d bytes, expected %d", info.Size(), ref.Size)
+		}
+	}
+	if !checkData {
+		return "", ""
+	}
+	data, err := w.chunks.read(file, ref.Checksum)
+	if err != nil {
+		return VerifyCorruptChunk, err.Error()
+	}
+	if int64(len(data)) != ref.Size {
+		return VerifyCorruptChunk, fmt.Sprintf("%d bytes, expected %d", len(data), ref.Size)
+	}
+	hash.Write(data)
+	return "", ""
+}
@@ -0,0 +1,81 @@
+package wfs
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/alex-sviridov/miniprotector/common/chunker"
+	"github.com/alex-sviridov/miniprotector/common/config"
+	"github.com/alex-sviridov/miniprotector/common/files"
+)
+
+func TestVerifyBackup(t *testing.T) {
+	writer := setupTestWriter(t, &config.Config{InlineMaxSize: 16})
+	modTime := time.Now().Truncate(time.Second)
+
+	corrupted := []byte("chunk to corrupt")
+	removed := []byte("chunk to remove")
+	healthy := &files.FileInfo{Host: "host1", Path: "/data/healthy", Mode: 0644, ModTime: modTime}
+	addChunkedVersion(t, writer, healthy, []byte("healthy chunk"))
+	damaged := &files.FileInfo{Host: "host1", Path: "/data/damaged", Mode: 0644, ModTime: modTime}
+	addChunkedVersion(t, writer, damaged, []byte("intact part"), corrupted)
+	lost := &files.FileInfo{Host: "host1", Path: "/data/lost", Mode: 0644, ModTime: modTime}
+	addChunkedVersion(t, writer, lost, removed)
+	tiny := &files.FileInfo{Host: "host1", Path: "/data/tiny", Mode: 0644, Size: 5, ModTime: modTime}
+	if err := writer.AddFileInline(tiny, chunker.Checksum([]byte("hello")), []byte("hello")); err != nil {
+		t.Fatalf("Failed to add inline file: %v", err)
+	}
+
+	if issues, err := writer.VerifyBackup("host1", true); err != nil || len(issues) != 0 {
+		t.Fatalf("Healthy backup: issues %v, error %v", issues, err)
+	}
+
+	// Same size, different content: only found when reading the data
+	corruptedPath, _ := writer.chunks.path(chunker.Checksum(corrupted))
+	if err := os.WriteFile(corruptedPath, []byte("CHUNK TO CORRUPT"), 0600); err != nil {
+		t.Fatalf("Failed to corrupt chunk: %v", err)
+	}
+	removedPath, _ := writer.chunks.path(chunker.Checksum(removed))
+	if err := os.Remove(removedPath); err != nil {
+		t.Fatalf("Failed to remove chunk: %v", err)
+	}
+	if _, err := writer.db.db.Exec(`UPDATE files SET content = ? WHERE path = '/data/tiny'`, []byte("jello")); err != nil {
+		t.Fatalf("Failed to alter inline content: %v", err)
+	}
+
+	issues, err := writer.VerifyBackup("host1", false)
+	if err != nil {
+		t.Fatalf("VerifyBackup failed: %v", err)
+	}
+	if len(issues) != 1 || issues[0].Path != "/data/lost" || issues[0].Problem != VerifyMissingChunk {
+		t.Errorf("Without data check: issues %+v, expected the missing chunk of /data/lost", issues)
+	}
+
+	issues, err = writer.VerifyBackup("host1", true)
+	if err != nil {
+		t.Fatalf("VerifyBackup failed: %v", err)
+	}
+	found := make(map[string]VerifyProblem)
+	for _, issue := range issues {
+		found[issue.Path] = issue.Problem
+	}
+	want := map[string]VerifyProblem{
+		"/data/damaged": VerifyCorruptChunk,
+		"/data/lost":    VerifyMissingChunk,
+		"/data/tiny":    VerifyChecksumMismatch,
+	}
+	if len(issues) != len(want) {
+		t.Errorf("Got %d issues, expected %d: %+v", len(issues), len(want), issues)
+	}
+	for path, problem := range want {
+		if found[path] != problem {
+			t.Errorf("%s: problem %q, expected %q", path, found[path], problem)
+		}
+	}
+	for _, issue := range issues {
+		if issue.Path == "/data/damaged" && issue.Chunk != chunker.Checksum(corrupted) {
+			t.Errorf("Corrupt chunk reported as %s", issue.Chunk)
+		}
+	}
+}
@@ -3,19 +3,25 @@ package wfs
 import (
 	"context"
 	"fmt"
+	"io"
 	"log/slog"
 	"os"
 	"path/filepath"
+	"time"
 
+	"github.com/alex-sviridov/miniprotector/common/chunker"
 	"github.com/alex-sviridov/miniprotector/common/config"
 	"github.com/alex-sviridov/miniprotector/common/files"
 	"github.com/alex-sviridov/miniprotector/common/logging"
 )
 
 type Writer struct {
-	conf   *config.Config
-	logger *slog.Logger
-	db     *fileDB
+	conf        *config.Config
+	logger      *slog.Logger
+	storagePath string
+	db          *fileDB
+	fsync       *fsyncLimiter
+	chunks      *chunkStore
 }
 
 func NewWriter(ctx context.Context, storagePath string) (*Writer, error) {
@@ -34,10 +40,29 @@ func NewWriter(ctx context.Context, storagePath string) (*Writer, error) {
 	if err != nil {
 		return nil, fmt.Errorf("failed to initialize database: %w", err)
 	}
+	fsync := newFsyncLimiter(conf.MaxConcurrentFsync)
+	chunks, err := newChunkStore(storagePath, fsync, conf.Compression)
+	if err != nil {
+		db.close()
+		return nil, err
+	}
+	if conf.ChunkEncryptionKeyFile != "" {
+		passphrase, err := LoadChunkPassphrase(conf.ChunkEncryptionKeyFile)
+		if err == nil {
+			chunks.cipher, err = openChunkCipher(storagePath, passphrase)
+		}
+		if err != nil {
+			db.close()
+			return nil, err
+		}
+	}
 	return &Writer{
-		conf:   conf,
-		logger: logger,
-		db:     db,
+		conf:        conf,
+		logger:      logger,
+		storagePath: storagePath,
+		db:          db,
+		fsync:       fsync,
+		chunks:      chunks,
 	}, nil
 }
 
@@ -45,10 +70,312 @@ func (w *Writer) Close() error {
 	return w.db.close()
 }
 
+// syncFile flushes a stored file to disk, throttled by MaxConcurrentFsync
+func (w *Writer) syncFile(f syncer) error {
+	return w.fsync.sync(f)
+}
+
 func (w *Writer) FileExists(fileInfo *files.FileInfo) (bool, error) {
 	return w.db.fileExists(fileInfo)
 }
 
+// FilesExist is FileExists for several files at once, answered with a single database query
+func (w *Writer) FilesExist(fileInfos []*files.FileInfo) ([]bool, error) {
+	return w.db.filesExist(fileInfos)
+}
+
+// FileStatus tells whether a file is already stored, missing, or stored with outdated metadata
+func (w *Writer) FileStatus(fileInfo *files.FileInfo) (FileStatus, error) {
+	return w.db.fileStatus(fileInfo)
+}
+
+// FileStatuses is FileStatus for several files at once, answered with a single database query
+func (w *Writer) FileStatuses(fileInfos []*files.FileInfo) ([]FileStatus, error) {
+	return w.db.filesStatus(fileInfos)
+}
+
+// UpdateMetadataOnly records new metadata of a file whose content didn't change,
+// for files reported as FileMetadataChanged. No new version is created.
+func (w *Writer) UpdateMetadataOnly(fileInfo *files.FileInfo) error {
+	return w.db.updateMetadata(fileInfo)
+}
+
+// CachedChecksum returns the checksum of a file already backed up with the same host, path,
+// modtime and size, so unchanged files don't need to be hashed again
+// Lookup errors are logged and reported as a miss
+func (w *Writer) CachedChecksum(fileInfo *files.FileInfo) (string, bool) {
+	checksum, ok, err := w.db.cachedChecksum(fileInfo)
+	if err != nil {
+		w.logger.Warn("Checksum cache lookup failed", "path", fileInfo.Path, "error", err)
+		return "", false
+	}
+	return checksum, ok
+}
+
+// GetFile returns the metadata of the latest version of a file, nil if it was never backed up
+func (w *Writer) GetFile(path, host string) (*FileMetadata, error) {
+	return w.db.getFile(path, host)
+}
+
+// ListFilesForHost returns the latest version of every path backed up from a host, ordered by path.
+// Compared with a new scan it tells which files were deleted at the source.
+// For large catalogs use ForEachFileForHost, which doesn't load all rows at once.
+func (w *Writer) ListFilesForHost(host string) ([]FileMetadata, error) {
+	return w.db.listFilesForHost(host)
+}
+
+// ForEachFileForHost calls fn with the latest version of every path backed up from a host,
+// ordered by path, streaming rows from the database. An error from fn stops the iteration.
+func (w *Writer) ForEachFileForHost(host string, fn func(*FileMetadata) error) error {
+	return w.db.forEachLatestFile(host, fn)
+}
+
+// MarkDeleted records that a file backed up from a host no longer exists there.
+// Its versions are kept, but it stops being returned by GetFile and the file listings.
+func (w *Writer) MarkDeleted(path, host string, deletedAt time.Time) error {
+	return w.db.markDeleted(path, host, deletedAt)
+}
+
+// StreamProgress is how far a resumable backup stream got: its first Committed files,
+// in the order sent and up to the one with LastFileID, are recorded
+type StreamProgress struct {
+	Committed  int64
+	LastFileID string
+}
+
+// SaveStreamProgress records the progress of a stream of a backup job from host, identified by the
+// stream id and the resume token of the run. Only the latest run of a job and stream is kept.
+func (w *Writer) SaveStreamProgress(host, jobID string, streamID int32, token string, progress StreamProgress) error {
+	return w.db.saveStreamProgress(host, jobID, streamID, token, progress)
+}
+
+// GetStreamProgress returns the progress saved for a stream, zero when none was saved with this resume token
+func (w *Writer) GetStreamProgress(host, jobID string, streamID int32, token string) (StreamProgress, error) {
+	return w.db.getStreamProgress(host, jobID, streamID, token)
+}
+
+// DeleteStreamProgress drops the progress saved for the streams of a job, once none of them can be resumed
+func (w *Writer) DeleteStreamProgress(host, jobID string) error {
+	return w.db.deleteStreamProgress(host, jobID)
+}
+
+// JobRun is the summary of one backup run, recorded by the reader once all its streams ended
+type JobRun struct {
+	JobID        string
+	Host         string
+	Started      time.Time
+	Finished     time.Time
+	FilesScanned int64
+	FilesStored  int64 // Data sent and stored
+	FilesSkipped int64 // Already backed up, nothing sent
+	FilesFailed  int64
+	BytesSent    int64 // File data sent, as compressed on the wire
+	Errors       int64 // Failed files and failed streams
+	Interrupted  bool
+}
+
+// RecordJobRun stores the summary of a backup run, replacing one recorded earlier for the same job
+func (w *Writer) RecordJobRun(run JobRun) error {
+	return w.db.recordJobRun(run)
+}
+
+// GetJobRun returns the summary of a backup run
+func (w *Writer) GetJobRun(jobID string) (*JobRun, error) {
+	return w.db.getJobRun(jobID)
+}
+
+// ListJobRuns returns the summaries of the backup runs of a host, oldest first
+func (w *Writer) ListJobRuns(host string) ([]JobRun, error) {
+	return w.db.listJobRuns(host)
+}
+
+// ListDeletedSince returns the last version of every file of a host deleted at or after since
+func (w *Writer) ListDeletedSince(host string, since time.Time) ([]FileMetadata, error) {
+	return w.db.listDeletedSince(host, since)
+}
+
 func (w *Writer) AddFile(fileInfo *files.FileInfo, checksum string) error {
-	return w.db.addFile(fileInfo, checksum)
+	_, err := w.db.addFile(fileInfo, checksum)
+	return err
+}
+
+// AddFiles records several files without data, such as directories, in a single transaction.
+// checksums[i] is the checksum of fileInfos[i]. When one file fails none of them is recorded.
+func (w *Writer) AddFiles(fileInfos []*files.FileInfo, checksums []string) error {
+	return w.db.addFiles(fileInfos, checksums)
+}
+
+// StoresInline reports whether a file of this size keeps its content in the database
+// instead of in chunk files, see InlineMaxSize
+func (w *Writer) StoresInline(size int64) bool {
+	return w.conf.InlineMaxSize > 0 && size >= 0 && size <= int64(w.conf.InlineMaxSize)
+}
+
+// AddFileInline records a file together with its content, for files accepted by StoresInline
+func (w *Writer) AddFileInline(fileInfo *files.FileInfo, checksum string, content []byte) error {
+	if !w.StoresInline(int64(len(content))) {
+		return fmt.Errorf("content of %s is %d bytes, above inline limit of %d", fileInfo.Path, len(content), w.conf.InlineMaxSize)
+	}
+	if int64(len(content)) != fileInfo.Size {
+		return fmt.Errorf("content of %s is %d bytes, expected %d", fileInfo.Path, len(content), fileInfo.Size)
+	}
+	if content == nil {
+		content = []byte{}
+	}
+	_, err := w.db.addFileWithContent(fileInfo, checksum, content)
+	return err
+}
+
+// ReadInline returns the content of the latest version of a file stored inline
+// ok is false when the file data is kept in chunk files instead
+func (w *Writer) ReadInline(path, host string) (content []byte, ok bool, err error) {
+	return w.db.getContent(path, host)
+}
+
+// StoreChunk saves a piece of file data in the chunk store after checking it against its checksum
+// Chunks already in the store are not written again
+func (w *Writer) StoreChunk(checksum string, data []byte) error {
+	return w.chunks.put(checksum, data)
+}
+
+// AddFileChunks records a file whose data was saved with StoreChunk, chunks in file order
+func (w *Writer) AddFileChunks(fileInfo *files.FileInfo, checksum string, chunks []ChunkRef) error {
+	_, err := w.db.addFileWithChunks(fileInfo, checksum, chunks)
+	return err
+}
+
+// AddFileLinked records a file with the same content as the latest version of sourcePath on the same host,
+// sharing its inline content or chunks instead of receiving the data again
+func (w *Writer) AddFileLinked(fileInfo *files.FileInfo, checksum, sourcePath string) error {
+	source, err := w.db.getFile(sourcePath, fileInfo.Host)
+	if err != nil {
+		return err
+	}
+	if source == nil {
+		return fmt.Errorf("linked file not found: %s", sourcePath)
+	}
+	if source.Checksum != checksum || source.FileInfo.Size != fileInfo.Size {
+		return fmt.Errorf("content of %s changed, expected %d bytes %s, stored %d bytes %s",
+			sourcePath, fileInfo.Size, checksum, source.FileInfo.Size, source.Checksum)
+	}
+	return w.addFileSharing(fileInfo, checksum, source)
+}
+
+// HasContent tells whether content with this checksum and size is stored, backed up from any host
+func (w *Writer) HasContent(checksum string, size int64) (bool, error) {
+	source, err := w.db.getFileByChecksum(checksum)
+	if err != nil || source == nil {
+		return false, err
+	}
+	return source.FileInfo.Size == size, nil
+}
+
+// AddFileByChecksum records a file whose content is already stored for another file, from any host,
+// sharing its inline content or chunks instead of receiving the data again
+func (w *Writer) AddFileByChecksum(fileInfo *files.FileInfo, checksum string) error {
+	source, err := w.db.getFileByChecksum(checksum)
+	if err != nil {
+		return err
+	}
+	if source == nil || source.FileInfo.Size != fileInfo.Size {
+		return fmt.Errorf("no stored content of %d bytes with checksum %s", fileInfo.Size, checksum)
+	}
+	return w.addFileSharing(fileInfo, checksum, source)
+}
+
+// addFileSharing records a file with the inline content or chunks of the stored version source
+func (w *Writer) addFileSharing(fileInfo *files.FileInfo, checksum string, source *FileMetadata) error {
+	content, inline, err := w.db.getContentByID(source.ID)
+	if err != nil {
+		return err
+	}
+	if inline {
+		_, err = w.db.addFileWithContent(fileInfo, checksum, content)
+		return err
+	}
+	chunks, err := w.db.getChunks(source.ID)
+	if err != nil {
+		return err
+	}
+	_, err = w.db.addFileWithChunks(fileInfo, checksum, chunks)
+	return err
+}
+
+// ReadFile writes the content of the latest version of a file to out,
+// reassembled from inline content or chunks and verified against the stored checksum
+func (w *Writer) ReadFile(path, host string, out io.Writer) error {
+	file, err := w.db.getFile(path, host)
+	if err != nil {
+		return err
+	}
+	if file == nil {
+		return fmt.Errorf("file not found: %s", path)
+	}
+	return w.readVersion(file, out)
+}
+
+// holeWriter is an output that can leave a hole instead of writing zeros, see restoreContent
+type holeWriter interface {
+	io.Writer
+	skip(n int64) error
+}
+
+// readVersion writes the content of one file version to out, verified against its checksum.
+// Holes of sparse files, the gaps between chunks and after the last one, are written as zeros
+// unless out is a holeWriter.
+func (w *Writer) readVersion(file *FileMetadata, out io.Writer) error {
+	path := file.FileInfo.Path
+	algo := chunker.ChecksumAlgo(file.Checksum)
+	hash, err := chunker.NewHasher(algo, 0)
+	if err != nil {
+		return fmt.Errorf("content of %s: %w", path, err)
+	}
+	holes, sparse := out.(holeWriter)
+	out = io.MultiWriter(out, hash)
+	hole := func(n int64) error {
+		if !sparse {
+			return chunker.WriteZeros(out, n)
+		}
+		chunker.WriteZeros(hash, n)
+		return holes.skip(n)
+	}
+
+	content, inline, err := w.db.getContentByID(file.ID)
+	if err != nil {
+		return err
+	}
+	if inline {
+		if _, err := out.Write(content); err != nil {
+			return fmt.Errorf("failed to write %s: %w", path, err)
+		}
+	} else {
+		chunks, err := w.db.getChunks(file.ID)
+		if err != nil {
+			return err
+		}
+		var offset int64
+		for _, chunk := range chunks {
+			data, err := w.chunks.get(chunk.Checksum)
+			if err != nil {
+				return err
+			}
+			if err := hole(chunk.Offset - offset); err != nil {
+				return fmt.Errorf("failed to write %s: %w", path, err)
+			}
+			if _, err := out.Write(data); err != nil {
+				return fmt.Errorf("failed to write %s: %w", path, err)
+			}
+			offset = chunk.Offset + int64(len(data))
+		}
+		if err := hole(file.FileInfo.Size - offset); err != nil {
+			return fmt.Errorf("failed to write %s: %w", path, err)
+		}
+	}
+
+	if file.Checksum != "" {
+		if actual := chunker.FormatChecksum(algo, hash.Sum(nil)); actual != file.Checksum {
+			return fmt.Errorf("content of %s doesn't match its checksum: expected %s, got %s", path, file.Checksum, actual)
+		}
+	}
+	return nil
 }
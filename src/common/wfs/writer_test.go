@@ -0,0 +1,142 @@
+package wfs
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"log/slog"
+	"testing"
+	"time"
+
+	"github.com/alex-sviridov/miniprotector/common/config"
+	"github.com/alex-sviridov/miniprotector/common/files"
+	"github.com/alex-sviridov/miniprotector/common/logging"
+)
+
+// setupTestWriter creates a Writer over a temporary storage directory
+func setupTestWriter(t *testing.T, conf *config.Config) *Writer {
+	t.Helper()
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	ctx := context.WithValue(context.Background(), config.ContextKey, conf)
+	ctx = context.WithValue(ctx, logging.ContextKey, logger)
+
+	writer, err := NewWriter(ctx, t.TempDir())
+	if err != nil {
+		t.Fatalf("Failed to create writer: %v", err)
+	}
+	t.Cleanup(func() { writer.Close() })
+	return writer
+}
+
+func TestInlineContent(t *testing.T) {
+	writer := setupTestWriter(t, &config.Config{InlineMaxSize: 16})
+	modTime := time.Now().Truncate(time.Second)
+
+	tiny := &files.FileInfo{Host: "host1", Path: "/data/tiny.txt", Name: "tiny.txt", Size: 5, ModTime: modTime}
+	if !writer.StoresInline(tiny.Size) {
+		t.Fatal("Expected tiny file to be stored inline")
+	}
+	if err := writer.AddFileInline(tiny, "", []byte("hello")); err != nil {
+		t.Fatalf("Failed to add inline file: %v", err)
+	}
+
+	empty := &files.FileInfo{Host: "host1", Path: "/data/empty.txt", Name: "empty.txt", ModTime: modTime}
+	if err := writer.AddFileInline(empty, "", nil); err != nil {
+		t.Fatalf("Failed to add empty inline file: %v", err)
+	}
+
+	large := &files.FileInfo{Host: "host1", Path: "/data/large.bin", Name: "large.bin", Size: 1024, ModTime: modTime}
+	if writer.StoresInline(large.Size) {
+		t.Fatal("Expected large file to be stored as chunks")
+	}
+	if err := writer.AddFileInline(large, "", make([]byte, 1024)); err == nil {
+		t.Error("Expected error adding content above the inline limit")
+	}
+	if err := writer.AddFile(large, ""); err != nil {
+		t.Fatalf("Failed to add large file: %v", err)
+	}
+
+	tests := []struct {
+		path   string
+		want   []byte
+		wantOK bool
+	}{
+		{"/data/tiny.txt", []byte("hello"), true},
+		{"/data/empty.txt", []byte{}, true},
+		{"/data/large.bin", nil, false},
+	}
+	for _, tt := range tests {
+		content, ok, err := writer.ReadInline(tt.path, "host1")
+		if err != nil {
+			t.Fatalf("ReadInline(%s) failed: %v", tt.path, err)
+		}
+		if ok != tt.wantOK || !bytes.Equal(content, tt.want) {
+			t.Errorf("ReadInline(%s) = %q, %v; expected %q, %v", tt.path, content, ok, tt.want, tt.wantOK)
+		}
+	}
+
+	if _, _, err := writer.ReadInline("/data/missing", "host1"); err == nil {
+		t.Error("Expected error for unknown file")
+	}
+}
+
+func TestInlineContentSizeMismatch(t *testing.T) {
+	writer := setupTestWriter(t, &config.Config{InlineMaxSize: 16})
+	fileInfo := &files.FileInfo{Host: "host1", Path: "/data/a", Name: "a", Size: 10}
+	if err := writer.AddFileInline(fileInfo, "", []byte("short")); err == nil {
+		t.Error("Expected error when content length differs from file size")
+	}
+}
+
+func TestInlineDisabled(t *testing.T) {
+	writer := setupTestWriter(t, &config.Config{})
+	if writer.StoresInline(0) || writer.StoresInline(1) {
+		t.Error("Expected nothing stored inline with InlineMaxSize 0")
+	}
+}
+
+func TestCachedChecksum(t *testing.T) {
+	writer := setupTestWriter(t, &config.Config{})
+	modTime := time.Now().Truncate(time.Second)
+	fileInfo := &files.FileInfo{Host: "host1", Path: "/data/file", Name: "file", Size: 100, ModTime: modTime}
+
+	if _, ok := writer.CachedChecksum(fileInfo); ok {
+		t.Fatal("Expected a miss before the file is backed up")
+	}
+	if err := writer.AddFile(fileInfo, "checksum-v1"); err != nil {
+		t.Fatalf("Failed to add file: %v", err)
+	}
+
+	unchanged := *fileInfo
+	if checksum, ok := writer.CachedChecksum(&unchanged); !ok || checksum != "checksum-v1" {
+		t.Errorf("Unchanged file: got %q, %v; expected a hit", checksum, ok)
+	}
+
+	modified := *fileInfo
+	modified.ModTime = modTime.Add(time.Second)
+	if _, ok := writer.CachedChecksum(&modified); ok {
+		t.Error("Expected a miss after mtime changed")
+	}
+	resized := *fileInfo
+	resized.Size = 200
+	if _, ok := writer.CachedChecksum(&resized); ok {
+		t.Error("Expected a miss after size changed")
+	}
+
+	// The new version replaces the cached checksum
+	if err := writer.AddFile(&modified, "checksum-v2"); err != nil {
+		t.Fatalf("Failed to add file: %v", err)
+	}
+	if checksum, ok := writer.CachedChecksum(&modified); !ok || checksum != "checksum-v2" {
+		t.Errorf("Modified file: got %q, %v; expected the new checksum", checksum, ok)
+	}
+
+	// Files recorded without a checksum aren't cached
+	dir := &files.FileInfo{Host: "host1", Path: "/data/dir", Name: "dir", ModTime: modTime}
+	if err := writer.AddFile(dir, ""); err != nil {
+		t.Fatalf("Failed to add file: %v", err)
+	}
+	if _, ok := writer.CachedChecksum(dir); ok {
+		t.Error("Expected a miss for a file without checksum")
+	}
+}
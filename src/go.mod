@@ -9,10 +9,12 @@ require (
 	golang.org/x/sys v0.34.0
 	google.golang.org/grpc v1.74.2
 	google.golang.org/protobuf v1.36.6
+	lukechampine.com/blake3 v1.4.1
 )
 
 require (
 	github.com/inconshreveable/mousetrap v1.1.0 // indirect
+	github.com/klauspost/cpuid/v2 v2.2.10 // indirect
 	github.com/spf13/pflag v1.0.6 // indirect
 	golang.org/x/net v0.40.0 // indirect
 	golang.org/x/text v0.25.0 // indirect